@@ -1,18 +1,73 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/csv"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"main/common"
+	"math"
+	"math/rand"
 	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
+// subcommands maps the optional first argument of the client to its implementation.
+// Without a subcommand the client runs the basic tests against the local servers.
+var subcommands = map[string]func(args []string){
+	"tls-audit":   runTLSAudit,
+	"matrix":      runMatrix,
+	"chaos":       runChaos,
+	"sla":         runSLA,
+	"dns":         runDNSSuite,
+	"sockopt":     runSockopt,
+	"bisect":      runBisect,
+	"consistency": runConsistency,
+	"survival":    runSurvival,
+	"latency":     runLatency,
+	"canary":      runCanary,
+	"golden":      runGolden,
+	"rtt":         runRTT,
+	"journey":     runJourney,
+}
+
 func main() {
+	// Global options, such as -k8s-events, come before the subcommand
+	if len(os.Args) > 1 && strings.HasPrefix(os.Args[1], "-") {
+		runWithKubeEvents(os.Args[1:])
+		return
+	}
+
+	if len(os.Args) > 1 {
+		run, ok := subcommands[os.Args[1]]
+		if !ok {
+			log.Fatalf("Unknown subcommand %q", os.Args[1])
+		}
+		run(os.Args[2:])
+		return
+	}
+
 	// Test HTTP server
 	testHTTPServer()
 
@@ -92,7 +147,7 @@ func testUDPServer() {
 	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
 
 	// Read the response from the UDP server
-	buffer := make([]byte, 1024)
+	buffer := make([]byte, 65535) // Large enough for any UDP datagram
 	n, err := conn.Read(buffer)
 	if err != nil {
 		log.Fatalf("Error reading response from UDP server: %v", err)
@@ -144,3 +199,3868 @@ func testProxyServer(forwardType, backendUrl string) {
 
 	fmt.Printf("Proxy Server Response (%s): %+v\n\n", forwardType, response)
 }
+
+//--------------------------------- tls-audit
+
+// TLSAuditResult represents the audit result of a single TLS endpoint
+type TLSAuditResult struct {
+	Target         string   `json:"Target"`         // The audited host:port
+	ServerName     string   `json:"ServerName"`     // The SNI used for the handshake
+	Source         string   `json:"Source"`         // Where the target came from (flag, file, ingress/<ns>/<name>, gateway/<ns>/<name>)
+	TLSVersion     string   `json:"TLSVersion"`     // The negotiated TLS version
+	CipherSuite    string   `json:"CipherSuite"`    // The negotiated cipher suite
+	Subject        string   `json:"Subject"`        // The subject of the leaf certificate
+	Issuer         string   `json:"Issuer"`         // The issuer of the leaf certificate
+	SANs           []string `json:"SANs"`           // The DNS names and IPs of the leaf certificate
+	NotAfter       string   `json:"NotAfter"`       // The expiry of the leaf certificate
+	DaysLeft       int      `json:"DaysLeft"`       // The number of days until the leaf certificate expires
+	Expired        bool     `json:"Expired"`        // Indicates if the leaf certificate is expired
+	ExpiringSoon   bool     `json:"ExpiringSoon"`   // Indicates if the leaf certificate expires within the warning window
+	SANMismatch    bool     `json:"SANMismatch"`    // Indicates if the server name is not covered by the certificate
+	ChainError     string   `json:"ChainError"`     // The chain verification error against the system roots, if any
+	WeakNegotiated bool     `json:"WeakNegotiated"` // Indicates if the negotiated version or cipher suite is weak
+	WeakCiphers    []string `json:"WeakCiphers"`    // The insecure cipher suites the server accepted when offered alone
+	ErrorMessage   string   `json:"ErrorMessage"`   // Error message, if the endpoint could not be audited
+}
+
+// tlsAuditTarget is a single endpoint to audit
+type tlsAuditTarget struct {
+	Address    string
+	ServerName string
+	Source     string
+}
+
+// runTLSAudit collects the certificates of a list of TLS endpoints and reports expirations,
+// weak ciphers and SAN mismatches.
+//
+// Usage:
+// go run client.go tls-audit -targets=example.com:443,10.0.0.1:8443 [-targets-file=<file>] [-discover=ingress,gateway] [-format=json|csv]
+func runTLSAudit(args []string) {
+	fs := flag.NewFlagSet("tls-audit", flag.ExitOnError)
+	targets := fs.String("targets", "", "Comma separated list of host:port targets")
+	targetsFile := fs.String("targets-file", "", "File with one host:port target per line")
+	discover := fs.String("discover", "", "Comma separated list of resources to discover targets from: ingress, gateway")
+	kubeAPI := fs.String("kube-api", "", "Kubernetes API URL, e.g. http://127.0.0.1:8001 for `kubectl proxy` (default is the in-cluster service account)")
+	format := fs.String("format", "json", "Report format: json or csv")
+	warnDays := fs.Int("warn-days", 30, "Flag certificates expiring within this many days")
+	timeout := fs.Duration("timeout", 5*time.Second, "Timeout for each TLS handshake")
+	concurrency := fs.Int("concurrency", 8, "The number of targets audited in parallel")
+	fs.Parse(args)
+
+	var auditTargets []tlsAuditTarget
+	for _, t := range splitList(*targets) {
+		auditTargets = append(auditTargets, newTLSAuditTarget(t, "flag"))
+	}
+
+	if *targetsFile != "" {
+		data, err := ioutil.ReadFile(*targetsFile)
+		if err != nil {
+			log.Fatalf("Error reading targets file: %v", err)
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			auditTargets = append(auditTargets, newTLSAuditTarget(line, "file"))
+		}
+	}
+
+	if *discover != "" {
+		discovered, err := discoverTLSTargets(*kubeAPI, splitList(*discover))
+		if err != nil {
+			log.Fatalf("Error discovering targets: %v", err)
+		}
+		auditTargets = append(auditTargets, discovered...)
+	}
+
+	if len(auditTargets) == 0 {
+		log.Fatalf("No targets to audit. Use -targets, -targets-file or -discover.")
+	}
+	if *concurrency < 1 {
+		log.Fatalf("Invalid -concurrency %d, it must be at least 1", *concurrency)
+	}
+
+	results := make([]TLSAuditResult, len(auditTargets))
+	sem := make(chan struct{}, *concurrency)
+	var wg sync.WaitGroup
+	for i, target := range auditTargets {
+		wg.Add(1)
+		go func(i int, target tlsAuditTarget) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			results[i] = auditTLSTarget(target, *timeout, *warnDays)
+		}(i, target)
+	}
+	wg.Wait()
+
+	if err := writeTLSAuditReport(os.Stdout, results, *format); err != nil {
+		log.Fatalf("Error writing report: %v", err)
+	}
+}
+
+// newTLSAuditTarget creates an audit target, using the host part of the address as SNI
+func newTLSAuditTarget(address, source string) tlsAuditTarget {
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(address, "443")
+	}
+	host, _, _ := net.SplitHostPort(address)
+	return tlsAuditTarget{Address: address, ServerName: host, Source: source}
+}
+
+// discoverTLSTargets lists the TLS hosts of the Ingress and Gateway resources in the cluster
+func discoverTLSTargets(kubeAPI string, kinds []string) ([]tlsAuditTarget, error) {
+	client, err := common.NewKubeClient(kubeAPI)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	var targets []tlsAuditTarget
+	for _, kind := range kinds {
+		switch kind {
+		case "ingress":
+			var list struct {
+				Items []struct {
+					Metadata struct{ Name, Namespace string } `json:"metadata"`
+					Spec     struct {
+						TLS []struct {
+							Hosts []string `json:"hosts"`
+						} `json:"tls"`
+					} `json:"spec"`
+				} `json:"items"`
+			}
+			if err := client.Get(ctx, "/apis/networking.k8s.io/v1/ingresses", &list); err != nil {
+				return nil, err
+			}
+			for _, item := range list.Items {
+				source := fmt.Sprintf("ingress/%s/%s", item.Metadata.Namespace, item.Metadata.Name)
+				for _, tlsSpec := range item.Spec.TLS {
+					for _, host := range tlsSpec.Hosts {
+						targets = append(targets, newTLSAuditTarget(host, source))
+					}
+				}
+			}
+		case "gateway":
+			var list struct {
+				Items []struct {
+					Metadata struct{ Name, Namespace string } `json:"metadata"`
+					Spec     struct {
+						Listeners []struct {
+							Hostname string `json:"hostname"`
+							Port     int    `json:"port"`
+							Protocol string `json:"protocol"`
+						} `json:"listeners"`
+					} `json:"spec"`
+				} `json:"items"`
+			}
+			if err := client.Get(ctx, "/apis/gateway.networking.k8s.io/v1/gateways", &list); err != nil {
+				return nil, err
+			}
+			for _, item := range list.Items {
+				source := fmt.Sprintf("gateway/%s/%s", item.Metadata.Namespace, item.Metadata.Name)
+				for _, listener := range item.Spec.Listeners {
+					// Wildcard hostnames cannot be dialed, and plain listeners have no certificate
+					if listener.Hostname == "" || strings.HasPrefix(listener.Hostname, "*") ||
+						(listener.Protocol != "HTTPS" && listener.Protocol != "TLS") {
+						continue
+					}
+					address := net.JoinHostPort(listener.Hostname, strconv.Itoa(listener.Port))
+					targets = append(targets, newTLSAuditTarget(address, source))
+				}
+			}
+		default:
+			return nil, fmt.Errorf("unsupported resource %q, supported values are 'ingress' and 'gateway'", kind)
+		}
+	}
+	return targets, nil
+}
+
+// auditTLSTarget performs the TLS handshake with a target and inspects its certificate
+func auditTLSTarget(target tlsAuditTarget, timeout time.Duration, warnDays int) TLSAuditResult {
+	result := TLSAuditResult{Target: target.Address, ServerName: target.ServerName, Source: target.Source}
+
+	// Verification is done below, so expired or mismatching certificates can still be inspected
+	dialer := &net.Dialer{Timeout: timeout}
+	conn, err := tls.DialWithDialer(dialer, "tcp", target.Address, &tls.Config{
+		ServerName:         target.ServerName,
+		InsecureSkipVerify: true,
+	})
+	if err != nil {
+		result.ErrorMessage = fmt.Sprintf("TLS handshake failed: %v", err)
+		return result
+	}
+	state := conn.ConnectionState()
+	conn.Close()
+
+	result.TLSVersion = tls.VersionName(state.Version)
+	result.CipherSuite = tls.CipherSuiteName(state.CipherSuite)
+	result.WeakNegotiated = state.Version < tls.VersionTLS12 || isInsecureCipherSuite(state.CipherSuite)
+
+	if len(state.PeerCertificates) == 0 {
+		result.ErrorMessage = "No certificate presented by the server"
+		return result
+	}
+	leaf := state.PeerCertificates[0]
+
+	result.Subject = leaf.Subject.String()
+	result.Issuer = leaf.Issuer.String()
+	result.SANs = append(result.SANs, leaf.DNSNames...)
+	for _, ip := range leaf.IPAddresses {
+		result.SANs = append(result.SANs, ip.String())
+	}
+	result.NotAfter = leaf.NotAfter.Format(time.RFC3339)
+	result.DaysLeft = int(time.Until(leaf.NotAfter).Hours() / 24)
+	result.Expired = time.Now().After(leaf.NotAfter)
+	result.ExpiringSoon = !result.Expired && result.DaysLeft < warnDays
+	result.SANMismatch = leaf.VerifyHostname(target.ServerName) != nil
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range state.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+	if _, err := leaf.Verify(x509.VerifyOptions{DNSName: target.ServerName, Intermediates: intermediates}); err != nil {
+		result.ChainError = err.Error()
+	}
+
+	result.WeakCiphers = probeWeakCiphers(target, timeout)
+	return result
+}
+
+// isInsecureCipherSuite checks if the given cipher suite is in Go's list of insecure suites
+func isInsecureCipherSuite(id uint16) bool {
+	for _, suite := range tls.InsecureCipherSuites() {
+		if suite.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// probeWeakCiphers offers each insecure cipher suite alone and returns the ones the server accepts
+func probeWeakCiphers(target tlsAuditTarget, timeout time.Duration) []string {
+	var accepted []string
+	for _, suite := range tls.InsecureCipherSuites() {
+		dialer := &net.Dialer{Timeout: timeout}
+		conn, err := tls.DialWithDialer(dialer, "tcp", target.Address, &tls.Config{
+			ServerName:         target.ServerName,
+			InsecureSkipVerify: true,
+			CipherSuites:       []uint16{suite.ID},
+			MaxVersion:         tls.VersionTLS12, // TLS 1.3 suites are not configurable
+		})
+		if err != nil {
+			continue
+		}
+		conn.Close()
+		accepted = append(accepted, suite.Name)
+	}
+	return accepted
+}
+
+// writeTLSAuditReport writes the audit results as JSON or CSV
+func writeTLSAuditReport(w io.Writer, results []TLSAuditResult, format string) error {
+	switch format {
+	case "json":
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(results)
+	case "csv":
+		writer := csv.NewWriter(w)
+		writer.Write([]string{"Target", "ServerName", "Source", "TLSVersion", "CipherSuite", "Subject", "Issuer", "SANs",
+			"NotAfter", "DaysLeft", "Expired", "ExpiringSoon", "SANMismatch", "ChainError", "WeakNegotiated", "WeakCiphers", "ErrorMessage"})
+		for _, r := range results {
+			writer.Write([]string{r.Target, r.ServerName, r.Source, r.TLSVersion, r.CipherSuite, r.Subject, r.Issuer,
+				strings.Join(r.SANs, " "), r.NotAfter, strconv.Itoa(r.DaysLeft), strconv.FormatBool(r.Expired),
+				strconv.FormatBool(r.ExpiringSoon), strconv.FormatBool(r.SANMismatch), r.ChainError,
+				strconv.FormatBool(r.WeakNegotiated), strings.Join(r.WeakCiphers, " "), r.ErrorMessage})
+		}
+		writer.Flush()
+		return writer.Error()
+	default:
+		return fmt.Errorf("unsupported format %q, supported values are 'json' and 'csv'", format)
+	}
+}
+
+// splitList splits a comma separated list, dropping empty items
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+//--------------------------------- probes
+
+// ProbeResult represents the result of a single probe against a target
+type ProbeResult struct {
+	Protocol       string  `json:"Protocol"`       // The protocol of the probe (http, udp or tcp)
+	Target         string  `json:"Target"`         // The probed URL or host:port
+	Proxy          string  `json:"Proxy"`          // The proxy the probe was forwarded through, if any
+	Success        bool    `json:"Success"`        // Indicates if the target was reachable
+	LatencyMs      float64 `json:"LatencyMs"`      // The round trip time of the probe in milliseconds
+	ServerHostName string  `json:"ServerHostName"` // The hostname reported by the echo server, if any
+	ErrorMessage   string  `json:"ErrorMessage"`   // Error message, if the target was not reachable
+
+	Timings      *common.Timings `json:"Timings,omitempty"`      // The phases of the HTTP request of the client, to the target or to the proxy
+	ProxyTimings *common.Timings `json:"ProxyTimings,omitempty"` // The phases of the request from the proxy to the target, for http through a proxy
+}
+
+// probe checks that target is reachable over protocol, directly or through the proxy server at proxyURL
+func probe(protocol, target, proxyURL string, timeout time.Duration) ProbeResult {
+	result := ProbeResult{Protocol: protocol, Target: target, Proxy: proxyURL}
+	start := time.Now()
+
+	var err error
+	var timer *common.HTTPTimer
+	switch {
+	case proxyURL != "":
+		timer = common.NewHTTPTimer()
+		result.ServerHostName, result.ProxyTimings, err = probeViaProxy(protocol, target, proxyURL, timeout, timer)
+	case protocol == "http":
+		timer = common.NewHTTPTimer()
+		result.ServerHostName, err = probeHTTP(target, timeout, timer)
+	case protocol == "udp":
+		result.ServerHostName, err = probeUDP(target, timeout)
+	case protocol == "tcp":
+		err = probeTCP(target, timeout)
+	default:
+		err = fmt.Errorf("unsupported protocol %q, supported values are 'http', 'udp' and 'tcp'", protocol)
+	}
+
+	result.LatencyMs = float64(time.Since(start).Microseconds()) / 1000
+	result.Timings = timer.Timings()
+	if err != nil {
+		result.ErrorMessage = err.Error()
+	} else {
+		result.Success = true
+	}
+	return result
+}
+
+// probeHTTP sends a request to the HTTP server and returns the hostname it reports. The phases of
+// the request are recorded by timer.
+func probeHTTP(target string, timeout time.Duration, timer *common.HTTPTimer) (string, error) {
+	req, err := http.NewRequestWithContext(timer.Trace(context.Background()), http.MethodPost, target, strings.NewReader("probe"))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	timer.BodyRead()
+	if err != nil {
+		return "", fmt.Errorf("unable to read response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	var response common.HttpServerResponse
+	json.Unmarshal(body, &response)
+	return response.ServerHostName, nil
+}
+
+// probeUDP sends a datagram to the UDP server and returns the hostname it reports
+func probeUDP(target string, timeout time.Duration) (string, error) {
+	conn, err := net.DialTimeout("udp", target, timeout)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("probe")); err != nil {
+		return "", err
+	}
+	conn.SetReadDeadline(time.Now().Add(timeout))
+
+	buffer := make([]byte, 65535)
+	n, err := conn.Read(buffer)
+	if err != nil {
+		return "", err
+	}
+
+	var response common.UdpServerResponse
+	json.Unmarshal(buffer[:n], &response)
+	return response.ServerHostName, nil
+}
+
+// probeTCP checks that a TCP connection can be established
+func probeTCP(target string, timeout time.Duration) error {
+	conn, err := net.DialTimeout("tcp", target, timeout)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// probeViaProxy asks the proxy server to forward a probe to target and returns the backend hostname,
+// with the phases of the request of the proxy to the backend for http. The phases of the request to
+// the proxy are recorded by timer.
+func probeViaProxy(protocol, target, proxyURL string, timeout time.Duration, timer *common.HTTPTimer) (string, *common.Timings, error) {
+	requestBody, err := json.Marshal(common.ProxyClientRequest{
+		BackendUrl:  target,
+		Timeout:     int((timeout + time.Second - 1) / time.Second),
+		ForwardType: protocol,
+		EchoData:    "probe",
+	})
+	if err != nil {
+		return "", nil, err
+	}
+
+	req, err := http.NewRequestWithContext(timer.Trace(context.Background()), http.MethodPost, proxyURL, bytes.NewBuffer(requestBody))
+	if err != nil {
+		return "", nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	// A proxy started with -auth-token requires the same token
+	if token := os.Getenv("PROXY_AUTH_TOKEN"); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	// Leave the proxy some time to report a backend timeout by itself
+	client := &http.Client{Timeout: timeout + 2*time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", nil, fmt.Errorf("proxy unreachable: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	timer.BodyRead()
+	if err != nil {
+		return "", nil, fmt.Errorf("unable to read proxy response: %v", err)
+	}
+
+	var response common.ProxyResponse
+	if err := json.Unmarshal(body, &response); err != nil {
+		return "", nil, fmt.Errorf("invalid proxy response: %v", err)
+	}
+	if !response.Success {
+		return "", response.Timings, fmt.Errorf("proxy reported: %s", response.ErrorMessage)
+	}
+
+	var backend struct{ ServerHostName string }
+	json.Unmarshal([]byte(response.BackendResponse), &backend)
+	return backend.ServerHostName, response.Timings, nil
+}
+
+//--------------------------------- matrix
+
+// MatrixResult represents the compliance of a single inventory entry
+type MatrixResult struct {
+	Name      string      `json:"Name"`      // The name of the inventory entry
+	Expected  bool        `json:"Expected"`  // The expected reachability
+	Compliant bool        `json:"Compliant"` // Indicates if the observed reachability matches the expectation
+	Diff      string      `json:"Diff"`      // What differs from the expectation, if not compliant
+	Probe     ProbeResult `json:"Probe"`     // The result of the probe
+}
+
+// MatrixReport represents the compliance report of a whole inventory
+type MatrixReport struct {
+	Total      int            `json:"Total"`      // The number of inventory entries
+	Compliant  int            `json:"Compliant"`  // The number of entries matching their expectation
+	Violations int            `json:"Violations"` // The number of entries not matching their expectation
+	Results    []MatrixResult `json:"Results"`    // The result of each entry
+}
+
+// matrixEntry is a single line of the inventory file
+type matrixEntry struct {
+	Name     string
+	Protocol string
+	Target   string
+	Expected bool
+	Proxy    string
+}
+
+// runMatrix probes all targets listed in an inventory file concurrently and reports
+// the differences from their expected reachability. It exits non-zero on any violation.
+//
+// The inventory is a CSV file with the columns Name,Protocol,Target,Expect[,Proxy], e.g.
+//
+//	# Name,Protocol,Target,Expect,Proxy
+//	backend-http,http,http://backend:8080,true
+//	backend-udp,udp,backend:8080,true
+//	denied-db,tcp,db.prod:5432,false
+//	via-proxy,udp,backend:8080,true,http://proxy:8090
+//
+// Usage:
+// go run client.go matrix -inventory=<file> [-format=json|csv]
+func runMatrix(args []string) {
+	fs := flag.NewFlagSet("matrix", flag.ExitOnError)
+	inventory := fs.String("inventory", "", "CSV inventory file with the columns Name,Protocol,Target,Expect[,Proxy]")
+	format := fs.String("format", "json", "Report format: json or csv")
+	timeout := fs.Duration("timeout", 3*time.Second, "Timeout for each probe")
+	concurrency := fs.Int("concurrency", 16, "The number of probes run in parallel")
+	fs.Parse(args)
+
+	if *inventory == "" {
+		log.Fatalf("-inventory is required")
+	}
+	if *concurrency < 1 {
+		log.Fatalf("Invalid -concurrency %d, it must be at least 1", *concurrency)
+	}
+	entries, err := loadMatrixInventory(*inventory)
+	if err != nil {
+		log.Fatalf("Error loading inventory: %v", err)
+	}
+
+	report := MatrixReport{Total: len(entries), Results: make([]MatrixResult, len(entries))}
+	sem := make(chan struct{}, *concurrency)
+	var wg sync.WaitGroup
+	for i, entry := range entries {
+		wg.Add(1)
+		go func(i int, entry matrixEntry) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			result := MatrixResult{Name: entry.Name, Expected: entry.Expected}
+			result.Probe = probe(entry.Protocol, entry.Target, entry.Proxy, *timeout)
+			result.Compliant = result.Probe.Success == entry.Expected
+			if !result.Compliant {
+				if entry.Expected {
+					result.Diff = fmt.Sprintf("expected reachable, but failed: %s", result.Probe.ErrorMessage)
+				} else if result.Probe.ServerHostName != "" {
+					result.Diff = fmt.Sprintf("expected unreachable, but reached %s", result.Probe.ServerHostName)
+				} else {
+					result.Diff = "expected unreachable, but it is reachable"
+				}
+			}
+			report.Results[i] = result
+		}(i, entry)
+	}
+	wg.Wait()
+
+	for _, result := range report.Results {
+		if result.Compliant {
+			report.Compliant++
+		} else {
+			report.Violations++
+		}
+	}
+
+	if err := writeMatrixReport(os.Stdout, report, *format); err != nil {
+		log.Fatalf("Error writing report: %v", err)
+	}
+	if report.Violations > 0 {
+		os.Exit(1)
+	}
+}
+
+// loadMatrixInventory reads the inventory CSV file, skipping empty lines and # comments
+func loadMatrixInventory(path string) ([]matrixEntry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []matrixEntry
+	for i, record := range records {
+		if len(record) < 4 {
+			return nil, fmt.Errorf("line %d: expected at least 4 columns (Name,Protocol,Target,Expect), got %d", i+1, len(record))
+		}
+		// Allow a header line
+		if i == 0 && strings.EqualFold(record[0], "name") {
+			continue
+		}
+		expected, err := strconv.ParseBool(record[3])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid Expect %q, it must be true or false", i+1, record[3])
+		}
+		entry := matrixEntry{Name: record[0], Protocol: strings.ToLower(record[1]), Target: record[2], Expected: expected}
+		if len(record) > 4 {
+			entry.Proxy = record[4]
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// writeMatrixReport writes the compliance report as JSON or CSV
+func writeMatrixReport(w io.Writer, report MatrixReport, format string) error {
+	switch format {
+	case "json":
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(report)
+	case "csv":
+		writer := csv.NewWriter(w)
+		writer.Write([]string{"Name", "Protocol", "Target", "Proxy", "Expected", "Reachable", "Compliant", "LatencyMs", "ServerHostName", "Diff"})
+		for _, r := range report.Results {
+			writer.Write([]string{r.Name, r.Probe.Protocol, r.Probe.Target, r.Probe.Proxy, strconv.FormatBool(r.Expected),
+				strconv.FormatBool(r.Probe.Success), strconv.FormatBool(r.Compliant),
+				strconv.FormatFloat(r.Probe.LatencyMs, 'f', 3, 64), r.Probe.ServerHostName, r.Diff})
+		}
+		writer.Flush()
+		return writer.Error()
+	default:
+		return fmt.Errorf("unsupported format %q, supported values are 'json' and 'csv'", format)
+	}
+}
+
+//--------------------------------- chaos
+
+// ChaosIteration represents the disruption and recovery of a single chaos iteration
+type ChaosIteration struct {
+	Iteration      int      `json:"Iteration"`      // The number of the iteration, starting at 1
+	Action         string   `json:"Action"`         // The disruption applied: delete or restart
+	Pods           []string `json:"Pods"`           // The pods that were deleted, or the restarted deployment
+	Disrupted      bool     `json:"Disrupted"`      // Indicates if any probe failed after the disruption
+	FirstFailureMs float64  `json:"FirstFailureMs"` // The time from the disruption to the first failed probe
+	RecoveryMs     float64  `json:"RecoveryMs"`     // The time from the disruption until success resumed
+	Recovered      bool     `json:"Recovered"`      // Indicates if success resumed before the recovery timeout
+	Probes         int      `json:"Probes"`         // The number of probes sent during the iteration
+	Failures       int      `json:"Failures"`       // The number of failed probes during the iteration
+	ErrorMessage   string   `json:"ErrorMessage"`   // Why the disruption could not be applied, if any
+}
+
+// ChaosReport represents the result of a chaos run
+type ChaosReport struct {
+	Target        string           `json:"Target"`        // The probed URL or host:port
+	Protocol      string           `json:"Protocol"`      // The protocol of the probes
+	Selector      string           `json:"Selector"`      // The label selector of the disrupted pods
+	Namespace     string           `json:"Namespace"`     // The namespace of the disrupted pods
+	MaxRecoveryMs float64          `json:"MaxRecoveryMs"` // The longest recovery time of all iterations
+	Unrecovered   int              `json:"Unrecovered"`   // The number of iterations that did not recover in time
+	Iterations    []ChaosIteration `json:"Iterations"`    // The result of each iteration
+}
+
+// runChaos automates failover drills: between iterations it deletes some of the backend pods
+// (or restarts their deployment) and probes the target until success resumes, measuring the
+// recovery time. It exits non-zero if any iteration did not recover in time.
+//
+// Only pods matching -selector in -namespace are touched. The service account needs no more than:
+//
+//	rules:
+//	- apiGroups: [""]
+//	  resources: ["pods"]
+//	  verbs: ["list", "delete"]
+//	- apiGroups: ["apps"]
+//	  resources: ["deployments"]
+//	  verbs: ["patch"]  # only for -action=restart
+//
+// Usage:
+// go run client.go chaos -target=<url|host:port> -selector=<labels> [-protocol=http|udp|tcp] [-proxy=<url>]
+//
+//	[-namespace=<ns>] [-action=delete|restart] [-deployment=<name>] [-count=1] [-iterations=3]
+func runChaos(args []string) {
+	fs := flag.NewFlagSet("chaos", flag.ExitOnError)
+	target := fs.String("target", "", "The URL or host:port probed to measure the recovery")
+	protocol := fs.String("protocol", "http", "The protocol of the probes: http, udp or tcp")
+	proxyURL := fs.String("proxy", "", "Probe through this proxy server (optional)")
+	selector := fs.String("selector", "", "Label selector of the backend pods to disrupt, e.g. app=backend")
+	namespace := fs.String("namespace", common.PodNamespace(), "Namespace of the backend pods")
+	action := fs.String("action", "delete", "The disruption: delete (pods) or restart (rollout restart of -deployment)")
+	deployment := fs.String("deployment", "", "The deployment to restart with -action=restart")
+	count := fs.Int("count", 1, "The number of pods deleted per iteration")
+	gracePeriod := fs.Int("grace-period", -1, "Grace period in seconds for deleted pods, -1 for the pod's default, 0 to kill")
+	iterations := fs.Int("iterations", 3, "The number of disruptions")
+	interval := fs.Duration("interval", 500*time.Millisecond, "The interval between probes")
+	stable := fs.Int("stable", 3, "The number of consecutive successful probes that mark the recovery")
+	recoveryTimeout := fs.Duration("recovery-timeout", 2*time.Minute, "How long to wait for success to resume")
+	timeout := fs.Duration("timeout", 2*time.Second, "Timeout for each probe")
+	kubeAPI := fs.String("kube-api", "", "Kubernetes API URL, e.g. from `kubectl proxy` (default is the in-cluster service account)")
+	fs.Parse(args)
+
+	if *target == "" || *selector == "" {
+		log.Fatalf("-target and -selector are required")
+	}
+	if *action != "delete" && *action != "restart" {
+		log.Fatalf("Invalid -action %q. Supported values are 'delete' and 'restart'.", *action)
+	}
+	if *action == "restart" && *deployment == "" {
+		log.Fatalf("-deployment is required with -action=restart")
+	}
+
+	client, err := common.NewKubeClient(*kubeAPI)
+	if err != nil {
+		log.Fatalf("Error creating Kubernetes client: %v", err)
+	}
+
+	// The target must be healthy before it is disrupted
+	if result := probe(*protocol, *target, *proxyURL, *timeout); !result.Success {
+		log.Fatalf("Target is not healthy before the first disruption: %s", result.ErrorMessage)
+	}
+
+	report := ChaosReport{Target: *target, Protocol: *protocol, Selector: *selector, Namespace: *namespace}
+	for i := 1; i <= *iterations; i++ {
+		iteration := ChaosIteration{Iteration: i, Action: *action}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		if *action == "delete" {
+			iteration.Pods, err = deleteRandomPods(ctx, client, *namespace, *selector, *count, *gracePeriod)
+		} else {
+			iteration.Pods, err = []string{"deployment/" + *deployment}, restartDeployment(ctx, client, *namespace, *deployment)
+		}
+		cancel()
+		if err != nil {
+			iteration.ErrorMessage = err.Error()
+			report.Iterations = append(report.Iterations, iteration)
+			log.Printf("Iteration %d: %v", i, err)
+			continue
+		}
+		disruptedAt := time.Now()
+		log.Printf("Iteration %d: %s %v", i, *action, iteration.Pods)
+
+		// Probe until enough consecutive probes succeed; success resumed with the first of them
+		successes := 0
+		var resumedAt time.Time
+		for time.Since(disruptedAt) < *recoveryTimeout {
+			result := probe(*protocol, *target, *proxyURL, *timeout)
+			iteration.Probes++
+			if result.Success {
+				if successes++; successes == 1 {
+					resumedAt = time.Now()
+				}
+				if successes >= *stable {
+					iteration.Recovered = true
+					break
+				}
+			} else {
+				if !iteration.Disrupted {
+					iteration.Disrupted = true
+					iteration.FirstFailureMs = float64(time.Since(disruptedAt).Microseconds()) / 1000
+				}
+				iteration.Failures++
+				successes = 0
+			}
+			time.Sleep(*interval)
+		}
+
+		switch {
+		case !iteration.Recovered:
+			report.Unrecovered++
+			iteration.RecoveryMs = float64(time.Since(disruptedAt).Microseconds()) / 1000
+		case iteration.Disrupted:
+			iteration.RecoveryMs = float64(resumedAt.Sub(disruptedAt).Microseconds()) / 1000
+		}
+		if iteration.RecoveryMs > report.MaxRecoveryMs {
+			report.MaxRecoveryMs = iteration.RecoveryMs
+		}
+		log.Printf("Iteration %d: recovered=%t after %.0fms with %d/%d failed probes",
+			i, iteration.Recovered, iteration.RecoveryMs, iteration.Failures, iteration.Probes)
+		report.Iterations = append(report.Iterations, iteration)
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(report)
+	if report.Unrecovered > 0 {
+		os.Exit(1)
+	}
+}
+
+// deleteRandomPods deletes count random running pods matching the selector and returns their names
+func deleteRandomPods(ctx context.Context, client *common.KubeClient, namespace, selector string, count, gracePeriod int) ([]string, error) {
+	var list struct {
+		Items []struct {
+			Metadata struct {
+				Name              string  `json:"name"`
+				DeletionTimestamp *string `json:"deletionTimestamp"`
+			} `json:"metadata"`
+			Status struct {
+				Phase string `json:"phase"`
+			} `json:"status"`
+		} `json:"items"`
+	}
+	path := fmt.Sprintf("/api/v1/namespaces/%s/pods?labelSelector=%s", namespace, url.QueryEscape(selector))
+	if err := client.Get(ctx, path, &list); err != nil {
+		return nil, err
+	}
+
+	var candidates []string
+	for _, pod := range list.Items {
+		if pod.Status.Phase == "Running" && pod.Metadata.DeletionTimestamp == nil {
+			candidates = append(candidates, pod.Metadata.Name)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("no running pod matches %q in namespace %s", selector, namespace)
+	}
+	rand.Shuffle(len(candidates), func(i, j int) { candidates[i], candidates[j] = candidates[j], candidates[i] })
+	if count < len(candidates) {
+		candidates = candidates[:count]
+	}
+
+	var body interface{}
+	if gracePeriod >= 0 {
+		body = map[string]int{"gracePeriodSeconds": gracePeriod}
+	}
+	for _, name := range candidates {
+		if err := client.Do(ctx, http.MethodDelete, fmt.Sprintf("/api/v1/namespaces/%s/pods/%s", namespace, name), body, nil); err != nil {
+			return nil, err
+		}
+	}
+	return candidates, nil
+}
+
+// restartDeployment triggers a rollout restart of a deployment, like `kubectl rollout restart`
+func restartDeployment(ctx context.Context, client *common.KubeClient, namespace, name string) error {
+	patch := map[string]interface{}{
+		"spec": map[string]interface{}{
+			"template": map[string]interface{}{
+				"metadata": map[string]interface{}{
+					"annotations": map[string]string{
+						"kubectl.kubernetes.io/restartedAt": time.Now().Format(time.RFC3339),
+					},
+				},
+			},
+		},
+	}
+	return client.Do(ctx, http.MethodPatch, fmt.Sprintf("/apis/apps/v1/namespaces/%s/deployments/%s", namespace, name), patch, nil)
+}
+
+//--------------------------------- sla
+
+// SLAReport represents the result of an SLA run and the thresholds it violated
+type SLAReport struct {
+	Target      string   `json:"Target"`      // The probed URL or host:port
+	Protocol    string   `json:"Protocol"`    // The protocol of the probes
+	Proxy       string   `json:"Proxy"`       // The proxy the probes were forwarded through, if any
+	Probes      int      `json:"Probes"`      // The number of probes sent
+	Failures    int      `json:"Failures"`    // The number of failed probes
+	SuccessRate float64  `json:"SuccessRate"` // The percentage of successful probes
+	P50Ms       float64  `json:"P50Ms"`       // The median latency of the successful probes
+	P99Ms       float64  `json:"P99Ms"`       // The 99th percentile latency of the successful probes
+	MaxMs       float64  `json:"MaxMs"`       // The highest latency of the successful probes
+	Passed      bool     `json:"Passed"`      // Indicates if all the thresholds were met
+	Violations  []string `json:"Violations"`  // The thresholds that were violated
+	LastError   string   `json:"LastError"`   // The error of the last failed probe, if any
+}
+
+// runSLA probes a target for a while and exits non-zero when the latency or success thresholds
+// are violated, so it can gate a deployment in a CD pipeline.
+//
+// Usage:
+// go run client.go sla -target=<url|host:port> [-protocol=http|udp|tcp] [-proxy=<url>] [-duration=30s]
+//
+//	[-interval=100ms] [-concurrency=1] [-max-p50=<duration>] [-max-p99=<duration>] [-min-success=99.9%]
+func runSLA(args []string) {
+	fs := flag.NewFlagSet("sla", flag.ExitOnError)
+	target := fs.String("target", "", "The URL or host:port to probe")
+	protocol := fs.String("protocol", "http", "The protocol of the probes: http, udp or tcp")
+	proxyURL := fs.String("proxy", "", "Probe through this proxy server (optional)")
+	duration := fs.Duration("duration", 30*time.Second, "How long to probe the target")
+	interval := fs.Duration("interval", 100*time.Millisecond, "The interval between probes of each worker")
+	concurrency := fs.Int("concurrency", 1, "The number of workers probing in parallel")
+	timeout := fs.Duration("timeout", 2*time.Second, "Timeout for each probe")
+	maxP50 := fs.Duration("max-p50", 0, "Fail if the median latency exceeds this duration (0 disables the check)")
+	maxP99 := fs.Duration("max-p99", 0, "Fail if the 99th percentile latency exceeds this duration (0 disables the check)")
+	minSuccess := fs.String("min-success", "", "Fail if the success rate is below this percentage, e.g. 99.9%")
+	fs.Parse(args)
+
+	if *target == "" {
+		log.Fatalf("-target is required")
+	}
+	minSuccessRate := -1.0
+	if *minSuccess != "" {
+		rate, err := strconv.ParseFloat(strings.TrimSuffix(*minSuccess, "%"), 64)
+		if err != nil || rate < 0 || rate > 100 {
+			log.Fatalf("Invalid -min-success %q, expected a percentage such as 99.9%%", *minSuccess)
+		}
+		minSuccessRate = rate
+	}
+
+	var latencies []float64
+	report := SLAReport{Target: *target, Protocol: *protocol, Proxy: *proxyURL}
+	var reportMutex sync.Mutex
+	deadline := time.Now().Add(*duration)
+	var wg sync.WaitGroup
+	for i := 0; i < *concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for time.Now().Before(deadline) {
+				result := probe(*protocol, *target, *proxyURL, *timeout)
+				reportMutex.Lock()
+				report.Probes++
+				if result.Success {
+					latencies = append(latencies, result.LatencyMs)
+				} else {
+					report.Failures++
+					report.LastError = result.ErrorMessage
+				}
+				reportMutex.Unlock()
+				time.Sleep(*interval)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if report.Probes > 0 {
+		report.SuccessRate = float64(report.Probes-report.Failures) * 100 / float64(report.Probes)
+	}
+	sort.Float64s(latencies)
+	report.P50Ms = percentile(latencies, 50)
+	report.P99Ms = percentile(latencies, 99)
+	if len(latencies) > 0 {
+		report.MaxMs = latencies[len(latencies)-1]
+	}
+
+	thresholdMs := func(d time.Duration) float64 { return float64(d.Microseconds()) / 1000 }
+	if *maxP50 > 0 && report.P50Ms > thresholdMs(*maxP50) {
+		report.Violations = append(report.Violations, fmt.Sprintf("p50 %.3fms exceeds %s", report.P50Ms, *maxP50))
+	}
+	if *maxP99 > 0 && report.P99Ms > thresholdMs(*maxP99) {
+		report.Violations = append(report.Violations, fmt.Sprintf("p99 %.3fms exceeds %s", report.P99Ms, *maxP99))
+	}
+	if minSuccessRate >= 0 && report.SuccessRate < minSuccessRate {
+		report.Violations = append(report.Violations, fmt.Sprintf("success rate %.3f%% is below %s%%", report.SuccessRate, strings.TrimSuffix(*minSuccess, "%")))
+	}
+	if len(latencies) == 0 && (*maxP50 > 0 || *maxP99 > 0) {
+		report.Violations = append(report.Violations, "no successful probe to measure the latency")
+	}
+	report.Passed = len(report.Violations) == 0
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(report)
+	if !report.Passed {
+		os.Exit(1)
+	}
+}
+
+// percentile returns the nearest-rank percentile p of sorted values, or 0 if there are none
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(p/100*float64(len(sorted)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	if rank >= len(sorted) {
+		rank = len(sorted) - 1
+	}
+	return sorted[rank]
+}
+
+//--------------------------------- dns
+
+// DNSTraceQuery represents a single query sent to the nameserver
+type DNSTraceQuery struct {
+	Name         string  `json:"Name"`         // The queried name, after the search domain expansion
+	Type         string  `json:"Type"`         // The queried record type
+	Rcode        string  `json:"Rcode"`        // The response code, e.g. NOERROR or NXDOMAIN
+	Answers      int     `json:"Answers"`      // The number of answer records
+	LatencyMs    float64 `json:"LatencyMs"`    // The round trip time of the query
+	ErrorMessage string  `json:"ErrorMessage"` // Why the query failed, if it did
+}
+
+// DNSLookupTrace represents a lookup and the queries the stub resolver sends for it
+type DNSLookupTrace struct {
+	Name       string          `json:"Name"`       // The looked up name, as given
+	Type       string          `json:"Type"`       // The looked up record type
+	Dots       int             `json:"Dots"`       // The number of dots in the name, compared with ndots
+	Resolved   bool            `json:"Resolved"`   // Indicates if one of the queries returned answers
+	ResolvedAs string          `json:"ResolvedAs"` // The expanded name that returned answers
+	Answers    []string        `json:"Answers"`    // The data of the answer records
+	Queries    []DNSTraceQuery `json:"Queries"`    // Every query sent, in order
+	TotalMs    float64         `json:"TotalMs"`    // The time spent on all the queries
+}
+
+// NegativeCacheResult represents repeated lookups of a name that does not exist
+type NegativeCacheResult struct {
+	Name    string          `json:"Name"`    // The non-existent name
+	Queries []DNSTraceQuery `json:"Queries"` // The repeated queries, in order
+	Cached  bool            `json:"Cached"`  // Indicates if the repeated queries answered clearly faster than the first one
+}
+
+// DNSSuiteReport represents the result of the DNS test suite
+type DNSSuiteReport struct {
+	Nameserver    string              `json:"Nameserver"`    // The nameserver the queries were sent to
+	Search        []string            `json:"Search"`        // The search domains
+	Ndots         int                 `json:"Ndots"`         // The ndots option
+	Lookups       []DNSLookupTrace    `json:"Lookups"`       // The traced lookups
+	NegativeCache NegativeCacheResult `json:"NegativeCache"` // The negative caching test
+}
+
+// resolvConf represents the settings of /etc/resolv.conf used by the stub resolver
+type resolvConf struct {
+	Nameservers []string
+	Search      []string
+	Ndots       int
+}
+
+// runDNSSuite exercises the DNS behavior seen from inside a pod: ndots expansion, search domain
+// fallback and negative caching. It emulates the search logic of the glibc stub resolver with the
+// settings of /etc/resolv.conf and sends each query itself, so every query is traced with its
+// response code and latency.
+//
+// Usage:
+// go run client.go dns [-names=kubernetes.default,kubernetes] [-types=A,AAAA] [-server=<ip:port>]
+//
+//	[-resolv-conf=/etc/resolv.conf] [-nx-name=<name>] [-nx-repeat=3]
+func runDNSSuite(args []string) {
+	fs := flag.NewFlagSet("dns", flag.ExitOnError)
+	names := fs.String("names", "kubernetes.default,kubernetes,kubernetes.default.svc", "Comma separated names to look up")
+	types := fs.String("types", "A,AAAA", "Comma separated record types queried for each name")
+	resolvConfPath := fs.String("resolv-conf", "/etc/resolv.conf", "The resolv.conf providing the nameserver, search domains and ndots")
+	server := fs.String("server", "", "Send the queries to this nameserver instead of the one of resolv.conf, as ip:port")
+	nxName := fs.String("nx-name", "", "A non-existent name for the negative caching test (default is a random name)")
+	nxRepeat := fs.Int("nx-repeat", 3, "The number of lookups of the non-existent name")
+	timeout := fs.Duration("timeout", 2*time.Second, "Timeout for each query")
+	fs.Parse(args)
+
+	conf, err := loadResolvConf(*resolvConfPath)
+	if err != nil {
+		log.Fatalf("Error reading %s: %v", *resolvConfPath, err)
+	}
+	nameserver := *server
+	if nameserver == "" {
+		if len(conf.Nameservers) == 0 {
+			log.Fatalf("No nameserver in %s, use -server", *resolvConfPath)
+		}
+		nameserver = net.JoinHostPort(conf.Nameservers[0], "53")
+	}
+
+	report := DNSSuiteReport{Nameserver: nameserver, Search: conf.Search, Ndots: conf.Ndots}
+	for _, name := range splitList(*names) {
+		for _, typeName := range splitList(*types) {
+			qtype, err := common.DNSTypeFromName(typeName)
+			if err != nil {
+				log.Fatalf("Invalid -types: %v", err)
+			}
+			report.Lookups = append(report.Lookups, traceLookup(nameserver, conf, name, qtype, *timeout))
+		}
+	}
+
+	// A random name is never cached before the test, so the first query reaches the authority
+	report.NegativeCache.Name = *nxName
+	if report.NegativeCache.Name == "" {
+		report.NegativeCache.Name = fmt.Sprintf("nx-%d.invalid.", rand.Int63())
+	}
+	for i := 0; i < *nxRepeat; i++ {
+		query := sendTracedQuery(nameserver, report.NegativeCache.Name, common.DNSTypeA, *timeout)
+		report.NegativeCache.Queries = append(report.NegativeCache.Queries, query.DNSTraceQuery)
+	}
+	if queries := report.NegativeCache.Queries; len(queries) > 1 && queries[0].ErrorMessage == "" {
+		report.NegativeCache.Cached = true
+		for _, query := range queries[1:] {
+			if query.ErrorMessage != "" || query.LatencyMs > queries[0].LatencyMs/2 {
+				report.NegativeCache.Cached = false
+			}
+		}
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(report)
+}
+
+// loadResolvConf reads the nameservers, search domains and ndots option of a resolv.conf file
+func loadResolvConf(path string) (resolvConf, error) {
+	conf := resolvConf{Ndots: 1}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return conf, err
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || strings.HasPrefix(fields[0], "#") || strings.HasPrefix(fields[0], ";") {
+			continue
+		}
+		switch fields[0] {
+		case "nameserver":
+			conf.Nameservers = append(conf.Nameservers, fields[1])
+		case "search", "domain":
+			conf.Search = fields[1:]
+		case "options":
+			for _, option := range fields[1:] {
+				if value, ok := strings.CutPrefix(option, "ndots:"); ok {
+					if ndots, err := strconv.Atoi(value); err == nil {
+						conf.Ndots = ndots
+					}
+				}
+			}
+		}
+	}
+	return conf, nil
+}
+
+// searchCandidates returns the names the glibc stub resolver queries for name, in order: names
+// with a trailing dot are absolute; names with at least ndots dots are tried as is first, then
+// with the search domains; other names are tried with the search domains first
+func searchCandidates(name string, conf resolvConf) []string {
+	if strings.HasSuffix(name, ".") {
+		return []string{name}
+	}
+
+	var candidates []string
+	dots := strings.Count(name, ".")
+	if dots >= conf.Ndots {
+		candidates = append(candidates, name+".")
+	}
+	for _, domain := range conf.Search {
+		candidates = append(candidates, name+"."+strings.TrimSuffix(domain, ".")+".")
+	}
+	if dots < conf.Ndots {
+		candidates = append(candidates, name+".")
+	}
+	return candidates
+}
+
+// tracedQuery is a traced query together with the answers it returned
+type tracedQuery struct {
+	DNSTraceQuery
+	answers []common.DNSAnswer
+}
+
+// traceLookup looks up name like the stub resolver does, recording every query sent
+func traceLookup(nameserver string, conf resolvConf, name string, qtype uint16, timeout time.Duration) DNSLookupTrace {
+	trace := DNSLookupTrace{Name: name, Type: common.DNSTypeName(qtype), Dots: strings.Count(strings.TrimSuffix(name, "."), ".")}
+	start := time.Now()
+	for _, candidate := range searchCandidates(name, conf) {
+		query := sendTracedQuery(nameserver, candidate, qtype, timeout)
+		trace.Queries = append(trace.Queries, query.DNSTraceQuery)
+		if query.Answers > 0 {
+			trace.Resolved = true
+			trace.ResolvedAs = candidate
+			for _, answer := range query.answers {
+				trace.Answers = append(trace.Answers, answer.Data)
+			}
+			break
+		}
+	}
+	trace.TotalMs = float64(time.Since(start).Microseconds()) / 1000
+	return trace
+}
+
+// sendTracedQuery sends a single query over UDP and records its outcome
+func sendTracedQuery(nameserver, name string, qtype uint16, timeout time.Duration) tracedQuery {
+	query := tracedQuery{DNSTraceQuery: DNSTraceQuery{Name: name, Type: common.DNSTypeName(qtype)}}
+
+	request, err := common.BuildDNSQuery(uint16(rand.Intn(65536)), name, qtype)
+	if err != nil {
+		query.ErrorMessage = err.Error()
+		return query
+	}
+
+	start := time.Now()
+	conn, err := net.DialTimeout("udp", nameserver, timeout)
+	if err != nil {
+		query.ErrorMessage = err.Error()
+		return query
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	buffer := make([]byte, 65535)
+	n := 0
+	if _, err = conn.Write(request); err == nil {
+		n, err = conn.Read(buffer)
+	}
+	query.LatencyMs = float64(time.Since(start).Microseconds()) / 1000
+	if err != nil {
+		query.ErrorMessage = err.Error()
+		return query
+	}
+
+	response, err := common.ParseDNSMessage(buffer[:n])
+	if err != nil {
+		query.ErrorMessage = err.Error()
+		return query
+	}
+	query.Rcode = response.Rcode
+	query.Answers = len(response.Answers)
+	query.answers = response.Answers
+	return query
+}
+
+//--------------------------------- sockopt
+
+// SockoptResult represents the latency of requests sent with one combination of socket options
+type SockoptResult struct {
+	NoDelay    bool                     `json:"NoDelay"`             // The requested TCP_NODELAY
+	Linger     string                   `json:"Linger"`              // The requested SO_LINGER: default or a number of seconds
+	KeepAlive  string                   `json:"KeepAlive"`           // The requested keepalive: default, off or the idle time
+	Effective  *common.TCPSocketOptions `json:"Effective,omitempty"` // The options read back from the kernel
+	Requests   int                      `json:"Requests"`            // The number of requests sent
+	Failures   int                      `json:"Failures"`            // The number of failed requests
+	Reconnects int                      `json:"Reconnects"`          // The number of connections opened after the first one
+	ConnectMs  float64                  `json:"ConnectMs"`           // The average duration of the TCP handshake
+	CloseMs    float64                  `json:"CloseMs"`             // The average duration of closing a connection, which SO_LINGER can block
+	P50Ms      float64                  `json:"P50Ms"`               // The median latency of the successful requests
+	P99Ms      float64                  `json:"P99Ms"`               // The 99th percentile latency of the successful requests
+	MaxMs      float64                  `json:"MaxMs"`               // The highest latency of the successful requests
+	StdDevMs   float64                  `json:"StdDevMs"`            // The standard deviation of the latency, lower is more regular
+	LastError  string                   `json:"LastError"`           // The error of the last failed request, if any
+}
+
+// SockoptReport represents the socket option matrix run against a target
+type SockoptReport struct {
+	Target      string          `json:"Target"`      // The URL of the echo server or proxy
+	SplitWrites bool            `json:"SplitWrites"` // Indicates if the request headers and body were written separately
+	Idle        string          `json:"Idle"`        // The idle time between requests
+	Results     []SockoptResult `json:"Results"`     // The result of each combination of options
+}
+
+// sockoptSettings is one combination of the socket options under test
+type sockoptSettings struct {
+	noDelay   bool
+	linger    string
+	lingerSec int // -1 keeps the system default
+	keepAlive string
+	keepIdle  time.Duration // Passed as net.Dialer.KeepAlive: 0 for the default, negative to disable
+}
+
+// runSockopt sends requests to an HTTP echo server (or through the proxy server) over connections
+// with every combination of TCP_NODELAY, SO_LINGER and keepalive settings, and reports the latency
+// and its regularity for each combination. The requests are written with raw HTTP/1.1 on a
+// persistent connection, by default as two writes (headers, then body), the pattern where Nagle's
+// algorithm and delayed ACKs interact.
+//
+// Usage:
+// go run client.go sockopt -target=<url> [-nodelay=true,false] [-linger=default,0] [-keepalive=default,off]
+//
+//	[-requests=50] [-idle=0s] [-reconnect-every=0] [-split-writes=true] [-body=probe]
+func runSockopt(args []string) {
+	fs := flag.NewFlagSet("sockopt", flag.ExitOnError)
+	target := fs.String("target", "", "The http:// URL of the echo server or proxy server")
+	noDelays := fs.String("nodelay", "true,false", "Comma separated TCP_NODELAY values to test")
+	lingers := fs.String("linger", "default,0", "Comma separated SO_LINGER values to test: default or seconds (0 resets on close)")
+	keepAlives := fs.String("keepalive", "default,off", "Comma separated keepalive values to test: default, off or an idle time such as 30s")
+	requests := fs.Int("requests", 50, "The number of requests sent with each combination")
+	idle := fs.Duration("idle", 0, "The idle time between requests, to test keepalive against idle timeouts of proxies and NAT")
+	reconnectEvery := fs.Int("reconnect-every", 0, "Open a new connection every N requests, to test SO_LINGER on close (0 keeps one connection)")
+	splitWrites := fs.Bool("split-writes", true, "Write the request headers and body with separate writes")
+	body := fs.String("body", "probe", "The request body, e.g. a proxy request as JSON")
+	timeout := fs.Duration("timeout", 2*time.Second, "Timeout for each request")
+	fs.Parse(args)
+
+	targetURL, err := url.Parse(*target)
+	if err != nil || targetURL.Scheme != "http" || targetURL.Host == "" {
+		log.Fatalf("-target must be an http:// URL")
+	}
+	address := targetURL.Host
+	if targetURL.Port() == "" {
+		address = net.JoinHostPort(targetURL.Hostname(), "80")
+	}
+
+	var combinations []sockoptSettings
+	for _, noDelay := range splitList(*noDelays) {
+		noDelayValue, err := strconv.ParseBool(noDelay)
+		if err != nil {
+			log.Fatalf("Invalid -nodelay value %q", noDelay)
+		}
+		for _, linger := range splitList(*lingers) {
+			lingerSec := -1
+			if linger != "default" {
+				if lingerSec, err = strconv.Atoi(linger); err != nil || lingerSec < 0 {
+					log.Fatalf("Invalid -linger value %q, expected default or seconds", linger)
+				}
+			}
+			for _, keepAlive := range splitList(*keepAlives) {
+				var keepIdle time.Duration
+				switch keepAlive {
+				case "default":
+				case "off":
+					keepIdle = -1
+				default:
+					if keepIdle, err = time.ParseDuration(keepAlive); err != nil || keepIdle < time.Second {
+						log.Fatalf("Invalid -keepalive value %q, expected default, off or a duration of at least 1s", keepAlive)
+					}
+				}
+				combinations = append(combinations, sockoptSettings{noDelayValue, linger, lingerSec, keepAlive, keepIdle})
+			}
+		}
+	}
+
+	request := fmt.Sprintf("POST %s HTTP/1.1\r\nHost: %s\r\nContent-Type: application/json\r\nContent-Length: %d\r\n\r\n",
+		targetURL.RequestURI(), targetURL.Host, len(*body))
+	report := SockoptReport{Target: *target, SplitWrites: *splitWrites, Idle: idle.String()}
+	for _, settings := range combinations {
+		result := measureSockopt(address, settings, []byte(request), []byte(*body), *splitWrites, *requests, *reconnectEvery, *idle, *timeout)
+		log.Printf("nodelay=%t linger=%s keepalive=%s: p50 %.3fms p99 %.3fms, %d/%d failed",
+			settings.noDelay, settings.linger, settings.keepAlive, result.P50Ms, result.P99Ms, result.Failures, result.Requests)
+		report.Results = append(report.Results, result)
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(report)
+}
+
+// measureSockopt sends the requests with one combination of socket options and measures them
+func measureSockopt(address string, settings sockoptSettings, header, body []byte, splitWrites bool, requests, reconnectEvery int, idle, timeout time.Duration) SockoptResult {
+	result := SockoptResult{NoDelay: settings.noDelay, Linger: settings.linger, KeepAlive: settings.keepAlive}
+	dialer := net.Dialer{Timeout: timeout, KeepAlive: settings.keepIdle}
+
+	var conn *net.TCPConn
+	var reader *bufio.Reader
+	var connects, closes int
+	var connectTotal, closeTotal time.Duration
+	closeConn := func() {
+		start := time.Now()
+		conn.Close()
+		closeTotal += time.Since(start)
+		closes++
+		conn = nil
+	}
+
+	var latencies []float64
+	for i := 0; i < requests; i++ {
+		if i > 0 && idle > 0 {
+			time.Sleep(idle)
+		}
+		if conn != nil && reconnectEvery > 0 && i%reconnectEvery == 0 {
+			closeConn()
+		}
+		result.Requests++
+
+		if conn == nil {
+			start := time.Now()
+			c, err := dialer.Dial("tcp", address)
+			if err != nil {
+				result.Failures++
+				result.LastError = err.Error()
+				continue
+			}
+			connectTotal += time.Since(start)
+			connects++
+			conn = c.(*net.TCPConn)
+			conn.SetNoDelay(settings.noDelay)
+			if settings.lingerSec >= 0 {
+				conn.SetLinger(settings.lingerSec)
+			}
+			if result.Effective == nil {
+				if effective, err := common.GetTCPSocketOptions(conn); err == nil {
+					result.Effective = &effective
+				}
+			}
+			reader = bufio.NewReader(conn)
+		}
+
+		latency, keepOpen, err := sendRawRequest(conn, reader, header, body, splitWrites, timeout)
+		if err != nil {
+			result.Failures++
+			result.LastError = err.Error()
+			closeConn()
+			continue
+		}
+		latencies = append(latencies, latency)
+		if !keepOpen {
+			closeConn()
+		}
+	}
+	if conn != nil {
+		closeConn()
+	}
+
+	if connects > 1 {
+		result.Reconnects = connects - 1
+	}
+	if connects > 0 {
+		result.ConnectMs = float64(connectTotal.Microseconds()) / 1000 / float64(connects)
+	}
+	if closes > 0 {
+		result.CloseMs = float64(closeTotal.Microseconds()) / 1000 / float64(closes)
+	}
+	sort.Float64s(latencies)
+	result.P50Ms = percentile(latencies, 50)
+	result.P99Ms = percentile(latencies, 99)
+	if len(latencies) > 0 {
+		result.MaxMs = latencies[len(latencies)-1]
+		var sum, squares float64
+		for _, latency := range latencies {
+			sum += latency
+		}
+		mean := sum / float64(len(latencies))
+		for _, latency := range latencies {
+			squares += (latency - mean) * (latency - mean)
+		}
+		result.StdDevMs = math.Sqrt(squares / float64(len(latencies)))
+	}
+	return result
+}
+
+// sendRawRequest writes an HTTP/1.1 request on conn and reads the whole response. It returns the
+// latency from the first write to the end of the response, and whether the connection can be reused.
+func sendRawRequest(conn *net.TCPConn, reader *bufio.Reader, header, body []byte, splitWrites bool, timeout time.Duration) (float64, bool, error) {
+	conn.SetDeadline(time.Now().Add(timeout))
+	start := time.Now()
+	if splitWrites {
+		if _, err := conn.Write(header); err != nil {
+			return 0, false, err
+		}
+		if _, err := conn.Write(body); err != nil {
+			return 0, false, err
+		}
+	} else if _, err := conn.Write(append(append([]byte{}, header...), body...)); err != nil {
+		return 0, false, err
+	}
+
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		return 0, false, err
+	}
+	_, err = io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	latency := float64(time.Since(start).Microseconds()) / 1000
+	if err != nil {
+		return 0, false, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return 0, !resp.Close, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return latency, !resp.Close, nil
+}
+
+//--------------------------------- bisect
+
+// BisectSegment represents the check of one segment of a multi-hop path
+type BisectSegment struct {
+	Segment      string   `json:"Segment"`      // The segment, e.g. "http://proxy1:8090 -> http://proxy2:8090"
+	Via          []string `json:"Via"`          // The proxies the single-hop request went through to reach the start of the segment
+	Success      bool     `json:"Success"`      // Indicates if the segment works
+	Skipped      bool     `json:"Skipped"`      // Indicates if the segment was not checked, since an earlier one is broken
+	LatencyMs    float64  `json:"LatencyMs"`    // The round trip time of the check
+	ErrorMessage string   `json:"ErrorMessage"` // Why the segment is considered broken, if it is
+}
+
+// BisectReport represents the end-to-end check of a multi-hop path and, when it fails, of each segment
+type BisectReport struct {
+	Path          string          `json:"Path"`          // The path, from the client to the backend
+	Protocol      string          `json:"Protocol"`      // The protocol of the last hop: http or udp
+	Success       bool            `json:"Success"`       // Indicates if the end-to-end request succeeded
+	LatencyMs     float64         `json:"LatencyMs"`     // The round trip time of the end-to-end request
+	ErrorMessage  string          `json:"ErrorMessage"`  // Why the end-to-end request failed, if it did
+	BrokenSegment string          `json:"BrokenSegment"` // The first broken segment, empty if none was found
+	Verdict       string          `json:"Verdict"`       // A summary of the result
+	Segments      []BisectSegment `json:"Segments"`      // The check of each segment, in path order
+}
+
+// runBisect sends a request to the backend through a chain of proxy servers and, when it fails,
+// checks each segment of the path in order with single-hop requests to find the broken one:
+//
+//   - client -> proxy1: the /healthy endpoint of proxy1, requested directly
+//   - proxyN -> proxyN+1: proxyN forwards a request to the /healthy endpoint of proxyN+1
+//   - last proxy -> backend: the last proxy forwards a probe to the backend with -protocol
+//
+// The start of each segment is reached through the proxies before it, which the earlier segments
+// have verified, so the first failing segment is the broken one. It exits non-zero when the
+// end-to-end request fails.
+//
+// Usage:
+// go run client.go bisect -hops=<proxy url>,<proxy url> -backend=<url|host:port> [-protocol=http|udp] [-always]
+func runBisect(args []string) {
+	fs := flag.NewFlagSet("bisect", flag.ExitOnError)
+	hopList := fs.String("hops", "", "Comma separated URLs of the proxy servers, in path order from the client")
+	backend := fs.String("backend", "", "The backend URL or host:port behind the last proxy")
+	protocol := fs.String("protocol", "http", "The protocol from the last proxy to the backend: http or udp")
+	timeout := fs.Duration("timeout", 3*time.Second, "Timeout of the last hop, each earlier hop gets one more second")
+	always := fs.Bool("always", false, "Check every segment even when the end-to-end request succeeds")
+	fs.Parse(args)
+
+	hops := splitList(*hopList)
+	if len(hops) == 0 || *backend == "" {
+		log.Fatalf("-hops and -backend are required")
+	}
+	if *protocol != "http" && *protocol != "udp" {
+		log.Fatalf("Invalid -protocol %q, supported values are 'http' and 'udp'", *protocol)
+	}
+
+	report := BisectReport{
+		Path:     strings.Join(append(append([]string{"client"}, hops...), *backend), " -> "),
+		Protocol: *protocol,
+	}
+	endToEnd := checkChain(hops, *backend, *protocol, *timeout)
+	report.Success, report.LatencyMs, report.ErrorMessage = endToEnd.Success, endToEnd.LatencyMs, endToEnd.ErrorMessage
+
+	if !report.Success || *always {
+		report.Segments = bisectSegments(hops, *backend, *protocol, *timeout)
+		for _, segment := range report.Segments {
+			if !segment.Success && !segment.Skipped {
+				report.BrokenSegment = segment.Segment
+				break
+			}
+		}
+	}
+
+	switch {
+	case report.Success:
+		report.Verdict = "the path works end to end"
+	case report.BrokenSegment != "":
+		report.Verdict = fmt.Sprintf("the segment %s is broken", report.BrokenSegment)
+	default:
+		report.Verdict = "every segment works on its own, the failure only shows end to end (e.g. stacked timeouts, payload size or MTU)"
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(report)
+	if !report.Success {
+		os.Exit(1)
+	}
+}
+
+// bisectSegments checks each segment of the path in order, and skips the segments after a broken one
+// since their start can only be reached through it
+func bisectSegments(hops []string, backend, protocol string, timeout time.Duration) []BisectSegment {
+	var segments []BisectSegment
+
+	start := time.Now()
+	first := BisectSegment{Segment: "client -> " + hops[0], Via: []string{}}
+	if err := checkHealthy(hops[0], timeout); err != nil {
+		first.ErrorMessage = err.Error()
+	} else {
+		first.Success = true
+	}
+	first.LatencyMs = float64(time.Since(start).Microseconds()) / 1000
+	segments = append(segments, first)
+
+	broken := !first.Success
+	for i := range hops {
+		target, targetProtocol := backend, protocol
+		if i+1 < len(hops) {
+			target, targetProtocol = strings.TrimSuffix(hops[i+1], "/")+"/healthy", "http"
+		}
+		segment := BisectSegment{Segment: hops[i] + " -> " + backend, Via: hops[:i]}
+		if i+1 < len(hops) {
+			segment.Segment = hops[i] + " -> " + hops[i+1]
+		}
+		if broken {
+			segment.Skipped = true
+			segment.ErrorMessage = "not checked, an earlier segment is broken"
+			segments = append(segments, segment)
+			continue
+		}
+
+		result := checkChain(hops[:i+1], target, targetProtocol, timeout)
+		segment.Success, segment.LatencyMs, segment.ErrorMessage = result.Success, result.LatencyMs, result.ErrorMessage
+		broken = !segment.Success
+		segments = append(segments, segment)
+	}
+	return segments
+}
+
+// checkHealthy checks the /healthy endpoint of a proxy server directly
+func checkHealthy(proxyURL string, timeout time.Duration) error {
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Get(strings.TrimSuffix(proxyURL, "/") + "/healthy")
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// checkChain sends a probe to target through the chain of proxies: the request of each proxy is
+// the EchoData of the request to the proxy before it. The nested responses are unwrapped to find
+// the hop that reported a failure.
+func checkChain(hops []string, target, protocol string, timeout time.Duration) ProbeResult {
+	result := ProbeResult{Protocol: protocol, Target: target, Proxy: hops[0]}
+
+	// Build the requests from the last hop outwards; each outer hop waits one second longer, so
+	// the inner hops report their timeouts before the outer ones give up
+	request := common.ProxyClientRequest{
+		BackendUrl:  target,
+		Timeout:     int((timeout + time.Second - 1) / time.Second),
+		ForwardType: protocol,
+		EchoData:    "probe",
+	}
+	for i := len(hops) - 1; i > 0; i-- {
+		inner, _ := json.Marshal(request)
+		request = common.ProxyClientRequest{
+			BackendUrl:  hops[i],
+			Timeout:     request.Timeout + 1,
+			ForwardType: "http",
+			EchoData:    string(inner),
+		}
+	}
+	requestBody, _ := json.Marshal(request)
+
+	start := time.Now()
+	client := &http.Client{Timeout: time.Duration(request.Timeout+2) * time.Second}
+	resp, err := client.Post(hops[0], "application/json", bytes.NewBuffer(requestBody))
+	result.LatencyMs = float64(time.Since(start).Microseconds()) / 1000
+	if err != nil {
+		result.ErrorMessage = fmt.Sprintf("%s unreachable: %v", hops[0], err)
+		return result
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		result.ErrorMessage = fmt.Sprintf("unable to read the response of %s: %v", hops[0], err)
+		return result
+	}
+
+	for i, hop := range hops {
+		var response common.ProxyResponse
+		if err := json.Unmarshal(body, &response); err != nil {
+			result.ErrorMessage = fmt.Sprintf("invalid response from %s: %v", hop, err)
+			return result
+		}
+		if !response.Success {
+			next := target
+			if i+1 < len(hops) {
+				next = hops[i+1]
+			}
+			result.ErrorMessage = fmt.Sprintf("%s failed to reach %s: %s", hop, next, response.ErrorMessage)
+			return result
+		}
+		body = []byte(response.BackendResponse)
+	}
+
+	// The /healthy endpoint responds with OK, and the echo servers report their hostname
+	if strings.HasSuffix(target, "/healthy") && string(body) != "OK" {
+		result.ErrorMessage = fmt.Sprintf("unexpected response from %s: %q", target, body)
+		return result
+	}
+	var backend struct{ ServerHostName string }
+	json.Unmarshal(body, &backend)
+	result.ServerHostName = backend.ServerHostName
+	result.Success = true
+	return result
+}
+
+//--------------------------------- consistency
+
+// ProtocolConsistency represents the probes of one protocol in a cross-protocol consistency check
+type ProtocolConsistency struct {
+	Protocol    string   `json:"Protocol"`    // The protocol: http, udp or tcp
+	Target      string   `json:"Target"`      // The probed URL or host:port
+	Probes      int      `json:"Probes"`      // The number of probes sent
+	Failures    int      `json:"Failures"`    // The number of failed probes
+	P50Ms       float64  `json:"P50Ms"`       // The median latency of the successful probes
+	ServerNames []string `json:"ServerNames"` // The hostnames reported by the echo server, none for tcp
+	LastError   string   `json:"LastError"`   // The error of the last failed probe, if any
+}
+
+// ConsistencyReport represents the comparison of the same logical probe over HTTP, UDP and TCP
+type ConsistencyReport struct {
+	Host       string                `json:"Host"`       // The probed host
+	Proxy      string                `json:"Proxy"`      // The proxy the probes were forwarded through, if any
+	Rounds     int                   `json:"Rounds"`     // The number of rounds, each probing all protocols at the same time
+	Consistent bool                  `json:"Consistent"` // Indicates if all protocols behave the same
+	Verdict    string                `json:"Verdict"`    // A summary of the comparison
+	Findings   []string              `json:"Findings"`   // The differences between the protocols
+	Protocols  []ProtocolConsistency `json:"Protocols"`  // The probes of each protocol
+}
+
+// runConsistency probes a backend over HTTP, UDP and TCP at the same time for a few rounds and
+// compares the results: a backend reachable over some protocols but not others is the signature
+// of a network policy or CNI bug affecting one protocol path. It also compares the identity of
+// the servers reached and the latency of each protocol. It exits non-zero when the protocols
+// do not behave the same.
+//
+// Usage:
+// go run client.go consistency -host=<host> [-http-port=8080] [-udp-port=8080] [-tcp-port=8080] [-proxy=<url>] [-rounds=5]
+func runConsistency(args []string) {
+	fs := flag.NewFlagSet("consistency", flag.ExitOnError)
+	host := fs.String("host", "", "The host of the backend running the echo servers")
+	httpPort := fs.String("http-port", "8080", "The port of the HTTP echo server (empty to skip HTTP)")
+	udpPort := fs.String("udp-port", "8080", "The port of the UDP echo server (empty to skip UDP)")
+	tcpPort := fs.String("tcp-port", "8080", "The TCP port checked with a connection only (empty to skip TCP)")
+	proxyURL := fs.String("proxy", "", "Probe through this proxy server (optional)")
+	rounds := fs.Int("rounds", 5, "The number of rounds")
+	interval := fs.Duration("interval", 200*time.Millisecond, "The interval between rounds")
+	latencyRatio := fs.Float64("latency-ratio", 5, "Flag a protocol whose median latency exceeds this multiple of the fastest one (0 disables the check)")
+	timeout := fs.Duration("timeout", 2*time.Second, "Timeout for each probe")
+	fs.Parse(args)
+
+	if *host == "" {
+		log.Fatalf("-host is required")
+	}
+	if *rounds < 1 {
+		log.Fatalf("-rounds must be at least 1")
+	}
+
+	type protocolProbe struct{ protocol, target string }
+	var probes []protocolProbe
+	if *httpPort != "" {
+		probes = append(probes, protocolProbe{"http", "http://" + net.JoinHostPort(*host, *httpPort)})
+	}
+	if *udpPort != "" {
+		probes = append(probes, protocolProbe{"udp", net.JoinHostPort(*host, *udpPort)})
+	}
+	if *tcpPort != "" {
+		probes = append(probes, protocolProbe{"tcp", net.JoinHostPort(*host, *tcpPort)})
+	}
+	if len(probes) < 2 {
+		log.Fatalf("At least two protocols are needed to compare them")
+	}
+
+	latencies := make([][]float64, len(probes))
+	names := make([]map[string]bool, len(probes))
+	report := ConsistencyReport{Host: *host, Proxy: *proxyURL, Rounds: *rounds, Findings: []string{}}
+	for i, p := range probes {
+		report.Protocols = append(report.Protocols, ProtocolConsistency{Protocol: p.protocol, Target: p.target, ServerNames: []string{}})
+		names[i] = make(map[string]bool)
+	}
+
+	for round := 0; round < *rounds; round++ {
+		if round > 0 {
+			time.Sleep(*interval)
+		}
+		results := make([]ProbeResult, len(probes))
+		var wg sync.WaitGroup
+		for i, p := range probes {
+			wg.Add(1)
+			go func(i int, protocol, target string) {
+				defer wg.Done()
+				// The proxy checks TCP with the connect forward type
+				if protocol == "tcp" && *proxyURL != "" {
+					protocol, target = "connect", "tcp://"+target
+				}
+				results[i] = probe(protocol, target, *proxyURL, *timeout)
+			}(i, p.protocol, p.target)
+		}
+		wg.Wait()
+
+		for i, result := range results {
+			protocol := &report.Protocols[i]
+			protocol.Probes++
+			if !result.Success {
+				protocol.Failures++
+				protocol.LastError = result.ErrorMessage
+				continue
+			}
+			latencies[i] = append(latencies[i], result.LatencyMs)
+			if result.ServerHostName != "" && !names[i][result.ServerHostName] {
+				names[i][result.ServerHostName] = true
+				protocol.ServerNames = append(protocol.ServerNames, result.ServerHostName)
+			}
+		}
+	}
+
+	var working, broken, flaky []string
+	fastest := math.MaxFloat64
+	for i := range report.Protocols {
+		protocol := &report.Protocols[i]
+		sort.Float64s(latencies[i])
+		protocol.P50Ms = percentile(latencies[i], 50)
+		sort.Strings(protocol.ServerNames)
+		switch {
+		case protocol.Failures == 0:
+			working = append(working, protocol.Protocol)
+		case protocol.Failures == protocol.Probes:
+			broken = append(broken, protocol.Protocol)
+		default:
+			flaky = append(flaky, protocol.Protocol)
+		}
+		if protocol.Failures < protocol.Probes && protocol.P50Ms < fastest {
+			fastest = protocol.P50Ms
+		}
+	}
+
+	for _, protocol := range report.Protocols {
+		switch {
+		case protocol.Failures == protocol.Probes && len(broken) < len(report.Protocols):
+			report.Findings = append(report.Findings, fmt.Sprintf("%s is broken while other protocols work: %s", protocol.Protocol, protocol.LastError))
+		case protocol.Failures > 0 && protocol.Failures < protocol.Probes:
+			report.Findings = append(report.Findings, fmt.Sprintf("%s failed %d of %d probes: %s", protocol.Protocol, protocol.Failures, protocol.Probes, protocol.LastError))
+		}
+		if *latencyRatio > 0 && protocol.Failures < protocol.Probes && fastest > 0 && protocol.P50Ms > fastest**latencyRatio {
+			report.Findings = append(report.Findings, fmt.Sprintf("%s is slow: median %.3fms, over %.0f times the fastest protocol (%.3fms)", protocol.Protocol, protocol.P50Ms, *latencyRatio, fastest))
+		}
+	}
+
+	// The HTTP and UDP echo servers of a backend run side by side, so they should report the same hosts
+	var reference *ProtocolConsistency
+	for i := range report.Protocols {
+		protocol := &report.Protocols[i]
+		if len(protocol.ServerNames) == 0 {
+			continue
+		}
+		if reference == nil {
+			reference = protocol
+		} else if strings.Join(protocol.ServerNames, ",") != strings.Join(reference.ServerNames, ",") {
+			report.Findings = append(report.Findings, fmt.Sprintf("%s reached %v but %s reached %v", reference.Protocol, reference.ServerNames, protocol.Protocol, protocol.ServerNames))
+		}
+	}
+
+	report.Consistent = len(report.Findings) == 0
+	switch {
+	case len(broken) == len(report.Protocols):
+		report.Verdict = "the backend is unreachable over every protocol"
+		report.Consistent = false
+	case len(broken) > 0:
+		report.Verdict = fmt.Sprintf("only %s broken, the signature of a network policy or CNI bug on one protocol path", strings.Join(broken, " and "))
+	case len(flaky) > 0:
+		report.Verdict = fmt.Sprintf("%s intermittently failing", strings.Join(flaky, " and "))
+	case report.Consistent:
+		report.Verdict = fmt.Sprintf("%s behave the same", strings.Join(working, ", "))
+	default:
+		report.Verdict = "every protocol works, with differences"
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(report)
+	if !report.Consistent {
+		os.Exit(1)
+	}
+}
+
+//--------------------------------- survival
+
+// survivalEventReasons are the reasons of the Kubernetes events that can explain a broken
+// long-lived connection: node drains, node failures and pod terminations
+var survivalEventReasons = []string{
+	"NodeNotSchedulable", "NodeNotReady", "RemovingNode", "Rebooted", "Shutdown",
+	"Killing", "Evicted", "Preempting", "TaintManagerEviction",
+}
+
+// survivalEventLag is how long after a breakage an event still explains it, since the events
+// are recorded asynchronously
+const survivalEventLag = 10 * time.Second
+
+// ClusterEvent represents a Kubernetes event observed during a survival test
+type ClusterEvent struct {
+	Time      string `json:"Time"`      // When the event last occurred
+	Namespace string `json:"Namespace"` // The namespace of the event
+	Kind      string `json:"Kind"`      // The kind of the involved object, e.g. Node or Pod
+	Name      string `json:"Name"`      // The name of the involved object
+	Reason    string `json:"Reason"`    // The reason of the event, e.g. NodeNotSchedulable
+	Message   string `json:"Message"`   // The message of the event
+	Count     int    `json:"Count"`     // The number of occurrences of the event
+
+	time time.Time
+}
+
+// EventAttribution represents a cluster event that may explain a flow breakage
+type EventAttribution struct {
+	Match         string       `json:"Match"`         // How the event relates to the flow: pod, node (of the backend) or time only
+	OffsetSeconds float64      `json:"OffsetSeconds"` // When the event occurred relative to the breakage, negative if before
+	Event         ClusterEvent `json:"Event"`         // The event
+}
+
+// FlowBreakage represents the breakage of a long-lived flow
+type FlowBreakage struct {
+	Time               string             `json:"Time"`               // When the breakage was detected
+	UpSeconds          float64            `json:"UpSeconds"`          // How long the connection had been up
+	Kind               string             `json:"Kind"`               // reset, closed, timeout, refused, rerouted (UDP only) or error
+	ErrorMessage       string             `json:"ErrorMessage"`       // The error that ended the flow
+	ServerHostName     string             `json:"ServerHostName"`     // The last backend reached by the flow
+	PodName            string             `json:"PodName"`            // The pod of the last backend, if it reports it
+	NodeName           string             `json:"NodeName"`           // The node of the last backend, if it reports it
+	ReconnectedAfterMs float64            `json:"ReconnectedAfterMs"` // The time until the flow was established again, 0 if it was not
+	Attributed         bool               `json:"Attributed"`         // Indicates if a cluster event occurred around the breakage
+	Attributions       []EventAttribution `json:"Attributions"`       // The most likely explanations, best first
+
+	time time.Time
+}
+
+// FlowSurvival represents one long-lived flow of a survival test
+type FlowSurvival struct {
+	ID               string         `json:"ID"`               // The ID of the flow, e.g. tcp-1
+	Protocol         string         `json:"Protocol"`         // tcp (a keep-alive HTTP/1.1 connection), ws (a WebSocket) or udp
+	Target           string         `json:"Target"`           // The host:port of the flow
+	Connects         int            `json:"Connects"`         // The number of times the flow was established
+	ConnectFailures  int            `json:"ConnectFailures"`  // The number of failed attempts to establish the flow
+	Messages         int            `json:"Messages"`         // The number of messages echoed over the flow
+	LongestUpSeconds float64        `json:"LongestUpSeconds"` // The longest time the flow stayed up
+	Survived         bool           `json:"Survived"`         // Indicates if the flow never broke
+	Breakages        []FlowBreakage `json:"Breakages"`        // The breakages of the flow
+}
+
+// SurvivalReport represents the result of a long-lived connection survival test
+type SurvivalReport struct {
+	Started      string         `json:"Started"`      // When the test started
+	Duration     string         `json:"Duration"`     // How long the test ran
+	Flows        int            `json:"Flows"`        // The number of flows
+	Survived     int            `json:"Survived"`     // The number of flows that never broke
+	SurvivalRate float64        `json:"SurvivalRate"` // The percentage of flows that never broke
+	Breakages    int            `json:"Breakages"`    // The number of breakages of all flows
+	Unexplained  int            `json:"Unexplained"`  // The number of breakages without any cluster event around them
+	EventsError  string         `json:"EventsError"`  // The last error of the event poller, if any
+	Events       []ClusterEvent `json:"Events"`       // The cluster events observed during the test
+	FlowResults  []FlowSurvival `json:"FlowResults"`  // The result of each flow
+}
+
+// survivalBackend is the backend reached by a flow, as reported by the echo server
+type survivalBackend struct {
+	ServerHostName string
+	PodName        string
+	NodeName       string
+}
+
+// survivalConn is an established flow, exchanging one echo at a time
+type survivalConn interface {
+	Exchange(id string, seq int, timeout time.Duration) (survivalBackend, error)
+	Close() error
+}
+
+// runSurvival opens long-lived TCP, WebSocket and UDP flows to the echo servers and keeps them
+// busy for hours, recording every reset, close and timeout. It polls the Kubernetes events at the
+// same time and attributes each breakage to the node drains, node failures and pod evictions that
+// occurred around it, preferring the events of the pod and node of the backend the flow reached.
+// The report is printed at the end of -duration or on interrupt, and the program exits non-zero
+// when a breakage is not explained by any cluster event.
+//
+// The service account needs no more than:
+//
+//	rules:
+//	- apiGroups: [""]
+//	  resources: ["events"]
+//	  verbs: ["list"]
+//
+// Usage:
+// go run client.go survival -http=<host:port> -udp=<host:port> [-protocols=tcp,ws,udp] [-flows=4]
+//
+//	[-duration=1h] [-interval=1s] [-namespace=<ns>] [-kube-api=<url>] [-no-kube]
+func runSurvival(args []string) {
+	fs := flag.NewFlagSet("survival", flag.ExitOnError)
+	httpTarget := fs.String("http", "", "The host:port of the HTTP echo server, for the tcp and ws flows")
+	udpTarget := fs.String("udp", "", "The host:port of the UDP echo server, for the udp flows")
+	protocols := fs.String("protocols", "tcp,ws,udp", "The kinds of flows: tcp (a keep-alive HTTP/1.1 connection), ws (a WebSocket) and udp")
+	flows := fs.Int("flows", 4, "The number of flows per protocol")
+	duration := fs.Duration("duration", time.Hour, "How long to keep the flows open")
+	interval := fs.Duration("interval", time.Second, "The interval between the echoes of each flow")
+	timeout := fs.Duration("timeout", 5*time.Second, "Timeout for establishing a flow and for each echo")
+	udpMisses := fs.Int("udp-misses", 3, "The number of consecutive unanswered datagrams that break a udp flow")
+	reconnectDelay := fs.Duration("reconnect-delay", time.Second, "The delay before establishing a broken flow again")
+	namespace := fs.String("namespace", "", "Only watch the events of this namespace, besides the node events (default is all namespaces)")
+	reasons := fs.String("event-reasons", strings.Join(survivalEventReasons, ","), "The reasons of the events that can explain a breakage, or 'all'")
+	window := fs.Duration("attribution-window", 2*time.Minute, "How long before a breakage an event can explain it")
+	eventPoll := fs.Duration("event-poll", 10*time.Second, "The interval between the polls of the Kubernetes events")
+	kubeAPI := fs.String("kube-api", "", "Kubernetes API URL, e.g. from `kubectl proxy` (default is the in-cluster service account)")
+	noKube := fs.Bool("no-kube", false, "Do not poll the Kubernetes events, no breakage is then explained")
+	fs.Parse(args)
+
+	kinds := splitList(*protocols)
+	for _, kind := range kinds {
+		switch kind {
+		case "tcp", "ws":
+			if *httpTarget == "" {
+				log.Fatalf("-http is required for %s flows", kind)
+			}
+		case "udp":
+			if *udpTarget == "" {
+				log.Fatalf("-udp is required for udp flows")
+			}
+		default:
+			log.Fatalf("Invalid protocol %q. Supported values are 'tcp', 'ws' and 'udp'.", kind)
+		}
+	}
+	if len(kinds) == 0 || *flows < 1 {
+		log.Fatalf("At least one protocol and one flow are needed")
+	}
+
+	var kube *common.KubeClient
+	if !*noKube {
+		var err error
+		if kube, err = common.NewKubeClient(*kubeAPI); err != nil {
+			log.Fatalf("Error creating Kubernetes client (use -no-kube to run without it): %v", err)
+		}
+	}
+
+	started := time.Now()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	ctx, cancel := context.WithTimeout(ctx, *duration)
+	defer cancel()
+
+	events := &survivalEvents{seen: make(map[string]int), since: started.Add(-*window)}
+	if *reasons != "all" {
+		events.reasons = make(map[string]bool)
+		for _, reason := range splitList(*reasons) {
+			events.reasons[reason] = true
+		}
+	}
+	var wg sync.WaitGroup
+	if kube != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			events.poll(ctx, kube, *namespace, *eventPoll)
+		}()
+	}
+
+	var results []*FlowSurvival
+	for _, kind := range kinds {
+		target := *httpTarget
+		if kind == "udp" {
+			target = *udpTarget
+		}
+		for i := 1; i <= *flows; i++ {
+			flow := &FlowSurvival{ID: fmt.Sprintf("%s-%d", kind, i), Protocol: kind, Target: target, Breakages: []FlowBreakage{}}
+			results = append(results, flow)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				runSurvivalFlow(ctx, flow, *interval, *timeout, *udpMisses, *reconnectDelay)
+			}()
+		}
+	}
+	log.Printf("Started %d flows for %s, interrupt to stop earlier", len(results), *duration)
+	wg.Wait()
+
+	// Poll once more, the events of the last breakages may have been recorded after the last poll
+	if kube != nil {
+		events.fetch(kube, *namespace)
+	}
+
+	report := SurvivalReport{
+		Started:  started.Format(time.RFC3339),
+		Duration: time.Since(started).Round(time.Second).String(),
+		Flows:    len(results),
+		Events:   events.list,
+	}
+	if events.err != nil {
+		report.EventsError = events.err.Error()
+	}
+	if report.Events == nil {
+		report.Events = []ClusterEvent{}
+	}
+	for _, flow := range results {
+		for i := range flow.Breakages {
+			breakage := &flow.Breakages[i]
+			breakage.Attributions = attributeBreakage(*breakage, events.list, *window)
+			breakage.Attributed = len(breakage.Attributions) > 0
+			if !breakage.Attributed {
+				report.Unexplained++
+			}
+		}
+		flow.Survived = len(flow.Breakages) == 0
+		if flow.Survived {
+			report.Survived++
+		}
+		report.Breakages += len(flow.Breakages)
+		report.FlowResults = append(report.FlowResults, *flow)
+	}
+	report.SurvivalRate = float64(report.Survived) * 100 / float64(report.Flows)
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(report)
+	if report.Unexplained > 0 {
+		os.Exit(1)
+	}
+}
+
+// runSurvivalFlow keeps a flow established and busy until ctx is done, recording its breakages
+func runSurvivalFlow(ctx context.Context, flow *FlowSurvival, interval, timeout time.Duration, udpMisses int, reconnectDelay time.Duration) {
+	// brokenAt is when the last breakage occurred, until the flow is established again
+	var brokenAt time.Time
+	seq := 0
+
+	for ctx.Err() == nil {
+		conn, err := dialSurvivalFlow(flow.Protocol, flow.Target, timeout)
+		if err != nil {
+			flow.ConnectFailures++
+			sleepContext(ctx, reconnectDelay)
+			continue
+		}
+		flow.Connects++
+		connectedAt := time.Now()
+		if !brokenAt.IsZero() {
+			flow.Breakages[len(flow.Breakages)-1].ReconnectedAfterMs = float64(connectedAt.Sub(brokenAt).Microseconds()) / 1000
+			brokenAt = time.Time{}
+		}
+
+		var backend survivalBackend
+		misses := 0
+		for ctx.Err() == nil {
+			seq++
+			reached, err := conn.Exchange(flow.ID, seq, timeout)
+			if err == nil {
+				misses = 0
+				flow.Messages++
+				if flow.Protocol == "udp" && backend.ServerHostName != "" && reached.ServerHostName != backend.ServerHostName {
+					// The same socket reached another backend: its conntrack entry or load balancing changed
+					recordBreakage(flow, connectedAt, "rerouted", fmt.Sprintf("moved from %s to %s", backend.ServerHostName, reached.ServerHostName), backend)
+					connectedAt = time.Now()
+				}
+				backend = reached
+				if up := time.Since(connectedAt).Seconds(); up > flow.LongestUpSeconds {
+					flow.LongestUpSeconds = up
+				}
+				sleepContext(ctx, interval)
+				continue
+			}
+			if ctx.Err() != nil {
+				break
+			}
+			// A single lost datagram does not break a UDP flow
+			if misses++; flow.Protocol == "udp" && classifyBreakage(err) == "timeout" && misses < udpMisses {
+				continue
+			}
+			brokenAt = recordBreakage(flow, connectedAt, classifyBreakage(err), err.Error(), backend)
+			break
+		}
+		conn.Close()
+		if !brokenAt.IsZero() {
+			sleepContext(ctx, reconnectDelay)
+		}
+	}
+}
+
+// recordBreakage adds a breakage to the flow and returns when it occurred
+func recordBreakage(flow *FlowSurvival, connectedAt time.Time, kind, message string, backend survivalBackend) time.Time {
+	now := time.Now()
+	flow.Breakages = append(flow.Breakages, FlowBreakage{
+		Time:           now.Format(time.RFC3339Nano),
+		UpSeconds:      math.Round(now.Sub(connectedAt).Seconds()*1000) / 1000,
+		Kind:           kind,
+		ErrorMessage:   message,
+		ServerHostName: backend.ServerHostName,
+		PodName:        backend.PodName,
+		NodeName:       backend.NodeName,
+		time:           now,
+	})
+	log.Printf("Flow %s to %s broke after %s (%s): %s", flow.ID, backend.ServerHostName, now.Sub(connectedAt).Round(time.Second), kind, message)
+	return now
+}
+
+// classifyBreakage names the way a flow broke from its error
+func classifyBreakage(err error) string {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE):
+		return "reset"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "refused"
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, common.ErrWebSocketClosed):
+		return "closed"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	default:
+		return "error"
+	}
+}
+
+// sleepContext sleeps for d or until ctx is done
+func sleepContext(ctx context.Context, d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
+	}
+}
+
+// dialSurvivalFlow establishes a flow of the given protocol
+func dialSurvivalFlow(protocol, target string, timeout time.Duration) (survivalConn, error) {
+	switch protocol {
+	case "ws":
+		ws, err := common.DialWebSocket(target, "/ws", timeout)
+		if err != nil {
+			return nil, err
+		}
+		return &survivalWebSocket{ws: ws}, nil
+	case "udp":
+		conn, err := net.DialTimeout("udp", target, timeout)
+		if err != nil {
+			return nil, err
+		}
+		return &survivalUDP{conn: conn}, nil
+	default:
+		conn, err := net.DialTimeout("tcp", target, timeout)
+		if err != nil {
+			return nil, err
+		}
+		return &survivalHTTP{conn: conn, reader: bufio.NewReader(conn), target: target}, nil
+	}
+}
+
+// survivalHTTP is a tcp flow: a keep-alive HTTP/1.1 connection to the HTTP echo server
+type survivalHTTP struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	target string
+}
+
+func (s *survivalHTTP) Exchange(id string, seq int, timeout time.Duration) (survivalBackend, error) {
+	s.conn.SetDeadline(time.Now().Add(timeout))
+	req, err := http.NewRequest(http.MethodPost, "http://"+s.target+"/", strings.NewReader(fmt.Sprintf("%s %d", id, seq)))
+	if err != nil {
+		return survivalBackend{}, err
+	}
+	if err := req.Write(s.conn); err != nil {
+		return survivalBackend{}, err
+	}
+	resp, err := http.ReadResponse(s.reader, req)
+	if err != nil {
+		return survivalBackend{}, err
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return survivalBackend{}, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return survivalBackend{}, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	var response common.HttpServerResponse
+	json.Unmarshal(body, &response)
+	backend := survivalBackend{response.ServerHostName, response.Identity.PodName, response.Identity.NodeName}
+	if resp.Close {
+		// The server will close the connection, e.g. it is shutting down
+		return backend, fmt.Errorf("the server closed the connection: %w", io.EOF)
+	}
+	return backend, nil
+}
+
+func (s *survivalHTTP) Close() error {
+	return s.conn.Close()
+}
+
+// survivalWebSocket is a ws flow: a WebSocket to the /ws endpoint of the HTTP echo server
+type survivalWebSocket struct {
+	ws *common.WebSocketConn
+}
+
+func (s *survivalWebSocket) Exchange(id string, seq int, timeout time.Duration) (survivalBackend, error) {
+	s.ws.NetConn().SetDeadline(time.Now().Add(timeout))
+	if err := s.ws.WriteMessage(common.WebSocketText, []byte(fmt.Sprintf("%s %d", id, seq))); err != nil {
+		return survivalBackend{}, err
+	}
+	_, data, err := s.ws.ReadMessage()
+	if err != nil {
+		return survivalBackend{}, err
+	}
+	var echo common.WebSocketEcho
+	json.Unmarshal(data, &echo)
+	return survivalBackend{echo.ServerHostName, echo.Identity.PodName, echo.Identity.NodeName}, nil
+}
+
+func (s *survivalWebSocket) Close() error {
+	return s.ws.Close()
+}
+
+// survivalUDP is a udp flow: datagrams sent from the same socket to the UDP echo server
+type survivalUDP struct {
+	conn net.Conn
+}
+
+func (s *survivalUDP) Exchange(id string, seq int, timeout time.Duration) (survivalBackend, error) {
+	message := fmt.Sprintf("%s %d", id, seq)
+	s.conn.SetDeadline(time.Now().Add(timeout))
+	if _, err := s.conn.Write([]byte(message)); err != nil {
+		return survivalBackend{}, err
+	}
+	buffer := make([]byte, 65535)
+	for {
+		n, err := s.conn.Read(buffer)
+		if err != nil {
+			return survivalBackend{}, err
+		}
+		var response common.UdpServerResponse
+		if json.Unmarshal(buffer[:n], &response) != nil || response.ClientEchoData != message {
+			continue // A late reply to a previous datagram
+		}
+		return survivalBackend{response.ServerHostName, response.Identity.PodName, response.Identity.NodeName}, nil
+	}
+}
+
+func (s *survivalUDP) Close() error {
+	return s.conn.Close()
+}
+
+// survivalEvents collects the Kubernetes events occurring during a survival test
+type survivalEvents struct {
+	reasons map[string]bool // The reasons of the kept events, nil for all
+	since   time.Time       // Older events are ignored
+	seen    map[string]int  // The index of each event in list, by UID
+	list    []ClusterEvent
+	err     error
+}
+
+// poll fetches the events every interval until ctx is done
+func (e *survivalEvents) poll(ctx context.Context, kube *common.KubeClient, namespace string, interval time.Duration) {
+	for {
+		e.fetch(kube, namespace)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// fetch lists the events and keeps the new and updated ones. The node events are in the default
+// namespace, so they are also listed when the events are restricted to another namespace.
+func (e *survivalEvents) fetch(kube *common.KubeClient, namespace string) {
+	paths := []string{"/api/v1/events"}
+	if namespace != "" {
+		paths = []string{"/api/v1/namespaces/" + namespace + "/events"}
+		if namespace != "default" {
+			paths = append(paths, "/api/v1/namespaces/default/events?fieldSelector=involvedObject.kind%3DNode")
+		}
+	}
+
+	for _, path := range paths {
+		var list struct {
+			Items []struct {
+				Metadata struct {
+					UID               string `json:"uid"`
+					Namespace         string `json:"namespace"`
+					CreationTimestamp string `json:"creationTimestamp"`
+				} `json:"metadata"`
+				InvolvedObject struct {
+					Kind string `json:"kind"`
+					Name string `json:"name"`
+				} `json:"involvedObject"`
+				Reason        string `json:"reason"`
+				Message       string `json:"message"`
+				Count         int    `json:"count"`
+				LastTimestamp string `json:"lastTimestamp"`
+				EventTime     string `json:"eventTime"`
+				Series        *struct {
+					Count            int    `json:"count"`
+					LastObservedTime string `json:"lastObservedTime"`
+				} `json:"series"`
+			} `json:"items"`
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		err := kube.Get(ctx, path, &list)
+		cancel()
+		if err != nil {
+			e.err = err
+			log.Printf("Unable to list the events: %v", err)
+			continue
+		}
+
+		for _, item := range list.Items {
+			if e.reasons != nil && !e.reasons[item.Reason] {
+				continue
+			}
+			stamp, count := item.LastTimestamp, item.Count
+			if item.Series != nil {
+				stamp, count = item.Series.LastObservedTime, item.Series.Count
+			}
+			for _, candidate := range []string{stamp, item.EventTime, item.Metadata.CreationTimestamp} {
+				if candidate != "" {
+					stamp = candidate
+					break
+				}
+			}
+			occurred, err := time.Parse(time.RFC3339, stamp)
+			if err != nil || occurred.Before(e.since) {
+				continue
+			}
+
+			event := ClusterEvent{
+				Time:      occurred.Format(time.RFC3339),
+				Namespace: item.Metadata.Namespace,
+				Kind:      item.InvolvedObject.Kind,
+				Name:      item.InvolvedObject.Name,
+				Reason:    item.Reason,
+				Message:   item.Message,
+				Count:     count,
+				time:      occurred,
+			}
+			if i, ok := e.seen[item.Metadata.UID]; ok {
+				e.list[i] = event
+				continue
+			}
+			e.seen[item.Metadata.UID] = len(e.list)
+			e.list = append(e.list, event)
+			log.Printf("Event: %s %s/%s: %s", event.Reason, event.Kind, event.Name, event.Message)
+		}
+	}
+}
+
+// attributeBreakage returns the events that occurred from window before a breakage until shortly
+// after it, the events of the pod and node of the backend first, then the closest in time
+func attributeBreakage(breakage FlowBreakage, events []ClusterEvent, window time.Duration) []EventAttribution {
+	rank := map[string]int{"pod": 0, "node": 1, "time": 2}
+	var attributions []EventAttribution
+	for _, event := range events {
+		offset := event.time.Sub(breakage.time)
+		if offset < -window || offset > survivalEventLag {
+			continue
+		}
+		match := "time"
+		switch {
+		case event.Kind == "Pod" && event.Name != "" && (event.Name == breakage.PodName || event.Name == breakage.ServerHostName):
+			match = "pod"
+		case event.Kind == "Node" && event.Name != "" && event.Name == breakage.NodeName:
+			match = "node"
+		}
+		attributions = append(attributions, EventAttribution{Match: match, OffsetSeconds: math.Round(offset.Seconds()*1000) / 1000, Event: event})
+	}
+
+	sort.SliceStable(attributions, func(i, j int) bool {
+		if a, b := rank[attributions[i].Match], rank[attributions[j].Match]; a != b {
+			return a < b
+		}
+		return math.Abs(attributions[i].OffsetSeconds) < math.Abs(attributions[j].OffsetSeconds)
+	})
+	if len(attributions) > 3 {
+		attributions = attributions[:3]
+	}
+	return attributions
+}
+
+//--------------------------------- latency
+
+// runLatency sends HTTP probes to a target, directly or through the proxy server, and prints the
+// phases of each request as a JSON line: Timings as the client observed them and, through a proxy,
+// ProxyTimings as the proxy observed its request to the target, so slowness can be located hop by hop.
+//
+// Usage:
+// go run client.go latency -target=<url> [-proxy=<url>] [-count=10] [-interval=1s] [-timeout=5s] [-keepalive]
+func runLatency(args []string) {
+	fs := flag.NewFlagSet("latency", flag.ExitOnError)
+	target := fs.String("target", "", "The URL to probe")
+	proxyURL := fs.String("proxy", "", "Probe through this proxy server (optional)")
+	count := fs.Int("count", 10, "The number of requests")
+	interval := fs.Duration("interval", time.Second, "The interval between requests")
+	timeout := fs.Duration("timeout", 5*time.Second, "Timeout for each request")
+	keepAlive := fs.Bool("keepalive", false, "Reuse the connections between requests, so only the first one pays DNS, connect and TLS")
+	fs.Parse(args)
+
+	if *target == "" {
+		log.Fatalf("-target is required")
+	}
+	if !*keepAlive {
+		// Each probe then pays the whole connection setup, which is what the breakdown is about
+		http.DefaultTransport.(*http.Transport).DisableKeepAlives = true
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	failures := 0
+	for i := 0; i < *count; i++ {
+		if i > 0 {
+			time.Sleep(*interval)
+		}
+		result := probe("http", *target, *proxyURL, *timeout)
+		if !result.Success {
+			failures++
+		}
+		encoder.Encode(result)
+	}
+	if failures > 0 {
+		os.Exit(1)
+	}
+}
+
+//--------------------------------- canary
+
+// Canary states: probing at -interval while healthy, backing off while failing, and probing at
+// -interval again on the first success, until the recovery is confirmed
+const (
+	canaryHealthy    = "Healthy"
+	canaryFailing    = "Failing"
+	canaryRecovering = "Recovering"
+)
+
+// CanaryTransition represents a change of the state of the canary
+type CanaryTransition struct {
+	Time                string  `json:"Time"`                // When the state changed
+	From                string  `json:"From"`                // The previous state
+	To                  string  `json:"To"`                  // The new state
+	ConsecutiveFailures int     `json:"ConsecutiveFailures"` // The failures in a row when the state changed
+	NextIntervalMs      float64 `json:"NextIntervalMs"`      // The interval until the next probe
+	LastError           string  `json:"LastError"`           // The error of the last failed probe, if any
+}
+
+// CanaryReport represents the result of an adaptive probing run
+type CanaryReport struct {
+	Target         string             `json:"Target"`         // The probed URL or host:port
+	Protocol       string             `json:"Protocol"`       // The protocol of the probes
+	Proxy          string             `json:"Proxy"`          // The proxy server the probes went through, if any
+	Probes         int                `json:"Probes"`         // The number of probes sent
+	Failures       int                `json:"Failures"`       // The number of failed probes
+	SavedProbes    int                `json:"SavedProbes"`    // The probes not sent thanks to the back-off, compared with a fixed -interval
+	State          string             `json:"State"`          // The state at the end of the run
+	SecondsInState map[string]float64 `json:"SecondsInState"` // The time spent in each state
+	Transitions    []CanaryTransition `json:"Transitions"`    // Every change of state, in order
+	Passed         bool               `json:"Passed"`         // Indicates if the run ended Healthy
+}
+
+// canary tracks the state of the adaptive probing and computes the interval until the next probe
+type canary struct {
+	interval         time.Duration
+	maxInterval      time.Duration
+	factor           float64
+	failureThreshold int
+	recoveryCount    int
+
+	state     string
+	failures  int // Consecutive failures
+	successes int // Consecutive successes
+	backoff   time.Duration
+}
+
+// observe updates the state with the result of a probe, and returns the transition it caused, if any
+func (c *canary) observe(result ProbeResult) *CanaryTransition {
+	from := c.state
+	if result.Success {
+		c.failures = 0
+		c.successes++
+		switch {
+		case c.state == canaryFailing && c.successes < c.recoveryCount:
+			c.state = canaryRecovering
+		case c.state != canaryHealthy && c.successes >= c.recoveryCount:
+			c.state, c.backoff = canaryHealthy, 0
+		}
+	} else {
+		c.successes = 0
+		c.failures++
+		if c.state == canaryRecovering || (c.state == canaryHealthy && c.failures >= c.failureThreshold) {
+			c.state = canaryFailing
+		}
+		if c.state == canaryFailing {
+			// A failed recovery resumes the back-off where it stopped
+			c.backoff = min(c.maxInterval, time.Duration(float64(max(c.backoff, c.interval))*c.factor))
+		}
+	}
+
+	if c.state == from {
+		return nil
+	}
+	return &CanaryTransition{
+		Time:                time.Now().Format(time.RFC3339Nano),
+		From:                from,
+		To:                  c.state,
+		ConsecutiveFailures: c.failures,
+		NextIntervalMs:      float64(c.next().Microseconds()) / 1000,
+		LastError:           result.ErrorMessage,
+	}
+}
+
+// next returns the interval until the next probe: the back-off while failing, -interval otherwise,
+// so a recovery is confirmed as fast as a failure is detected
+func (c *canary) next() time.Duration {
+	if c.state == canaryFailing {
+		return c.backoff
+	}
+	return c.interval
+}
+
+// runCanary probes a target continuously with an adaptive interval: every -interval while healthy,
+// backing off exponentially up to -max-interval after -failure-threshold failures in a row, and back
+// to -interval on the first success to detect the recovery quickly. Canaries then do not amplify an
+// outage with their own load. Each state transition is logged as it happens, and the report with all
+// of them is printed when the run ends, after -duration or on SIGINT/SIGTERM. The client exits
+// non-zero unless the target ended healthy.
+//
+// Usage:
+// go run client.go canary -target=<url|host:port> [-protocol=http|udp|tcp] [-proxy=<url>] [-duration=0]
+//
+//	[-interval=1s] [-max-interval=1m] [-backoff-factor=2] [-failure-threshold=3] [-recovery-threshold=3]
+func runCanary(args []string) {
+	fs := flag.NewFlagSet("canary", flag.ExitOnError)
+	target := fs.String("target", "", "The URL or host:port to probe")
+	protocol := fs.String("protocol", "http", "The protocol of the probes: http, udp or tcp")
+	proxyURL := fs.String("proxy", "", "Probe through this proxy server (optional)")
+	duration := fs.Duration("duration", 0, "How long to probe the target (default is until interrupted)")
+	interval := fs.Duration("interval", time.Second, "The interval between probes while healthy or recovering")
+	maxInterval := fs.Duration("max-interval", time.Minute, "The longest interval between probes while failing")
+	factor := fs.Float64("backoff-factor", 2, "The factor the interval grows by after each failure while failing")
+	failureThreshold := fs.Int("failure-threshold", 3, "The failures in a row that start the back-off")
+	recoveryThreshold := fs.Int("recovery-threshold", 3, "The successes in a row that confirm a recovery")
+	timeout := fs.Duration("timeout", 2*time.Second, "Timeout for each probe")
+	fs.Parse(args)
+
+	if *target == "" {
+		log.Fatalf("-target is required")
+	}
+	if *interval <= 0 || *maxInterval < *interval || *factor < 1 || *failureThreshold < 1 || *recoveryThreshold < 1 {
+		log.Fatalf("Invalid back-off: -interval must be positive, -max-interval at least -interval, -backoff-factor at least 1 and the thresholds at least 1")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if *duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *duration)
+		defer cancel()
+	}
+
+	c := &canary{
+		interval:         *interval,
+		maxInterval:      *maxInterval,
+		factor:           *factor,
+		failureThreshold: *failureThreshold,
+		recoveryCount:    *recoveryThreshold,
+		state:            canaryHealthy,
+	}
+	report := CanaryReport{Target: *target, Protocol: *protocol, Proxy: *proxyURL, SecondsInState: make(map[string]float64), Transitions: []CanaryTransition{}}
+	started := time.Now()
+	stateSince := started
+	for ctx.Err() == nil {
+		result := probe(*protocol, *target, *proxyURL, *timeout)
+		report.Probes++
+		if !result.Success {
+			report.Failures++
+		}
+		if transition := c.observe(result); transition != nil {
+			now := time.Now()
+			report.SecondsInState[transition.From] += now.Sub(stateSince).Seconds()
+			stateSince = now
+			report.Transitions = append(report.Transitions, *transition)
+			if transition.LastError != "" {
+				log.Printf("%s -> %s after %d failures in a row, next probe in %s: %s",
+					transition.From, transition.To, transition.ConsecutiveFailures, c.next(), transition.LastError)
+			} else {
+				log.Printf("%s -> %s, next probe in %s", transition.From, transition.To, c.next())
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(c.next()):
+		}
+	}
+
+	report.State = c.state
+	report.SecondsInState[c.state] += time.Since(stateSince).Seconds()
+	if fixed := int(time.Since(started) / *interval) + 1; fixed > report.Probes {
+		report.SavedProbes = fixed - report.Probes
+	}
+	report.Passed = c.state == canaryHealthy
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(report)
+	if !report.Passed {
+		os.Exit(1)
+	}
+}
+
+//--------------------------------- golden
+
+// goldenVolatile are the fields of the echo responses that change between runs even when the
+// infrastructure does not: timestamps, counters, the ephemeral port of the client, the identity
+// of the pod reached and the headers of tracing. Array elements and map keys are matched as path
+// segments, e.g. Identity.InterfaceIPs.0 or RequestHttpHeaders.X-Request-Id.
+var goldenVolatile = []string{
+	"RequestTimestamp", "RequestCounter", "ClientPort", "ServerHostName", "ServerIP",
+	"ServerProcessingMicros", "RequestCost", "Resources", "TLSSession",
+	"KernelRxTimestamp", "KernelRxUnixNano", "ReceiveDelayMs", "ReadSyscallMicros",
+	"Identity.HostName", "Identity.PodName", "Identity.NodeName", "Identity.RefreshedAt", "Identity.Generation",
+	"RequestHeaderStats.TotalBytes", "RequestHeaderStats.LargestBytes",
+	"RequestHttpHeaders.X-Request-Id", "RequestHttpHeaders.Traceparent", "RequestHttpHeaders.Tracestate",
+	"RequestHttpHeaders.X-B3-*", "RequestHttpHeaders.X-Amzn-Trace-Id",
+}
+
+// goldenIPFamily are the fields holding IPs of the server, normalized to their family, so adding
+// or removing a family is caught while new pod IPs are not
+var goldenIPFamily = []string{"Identity.InterfaceIPs.*"}
+
+// GoldenEntry represents the normalized response of one target in a golden file
+type GoldenEntry struct {
+	Name     string      `json:"Name"`     // The protocol and target, and the proxy if any
+	Protocol string      `json:"Protocol"` // http or udp
+	Target   string      `json:"Target"`   // The URL or host:port of the echo server
+	Proxy    string      `json:"Proxy"`    // The proxy the request was forwarded through, if any
+	Response interface{} `json:"Response"` // The normalized JSON response of the echo server
+}
+
+// GoldenFile represents a baseline of normalized echo responses
+type GoldenFile struct {
+	Recorded string        `json:"Recorded"` // When the baseline was recorded
+	EchoData string        `json:"EchoData"` // The data sent to the echo servers
+	Volatile []string      `json:"Volatile"` // The patterns of the fields whose value is not compared, including the ones detected while recording
+	Ignore   []string      `json:"Ignore"`   // The patterns of the fields not compared at all, not even their presence
+	Keep     []string      `json:"Keep"`     // The patterns of the fields compared even if volatile
+	Entries  []GoldenEntry `json:"Entries"`  // The normalized response of each target
+}
+
+// GoldenDiff represents a structural difference between the golden response and the current one
+type GoldenDiff struct {
+	Path    string      `json:"Path"`              // The path of the field, e.g. RequestHttpHeaders.Via
+	Kind    string      `json:"Kind"`              // added, removed or changed
+	Golden  interface{} `json:"Golden,omitempty"`  // The value in the golden file
+	Current interface{} `json:"Current,omitempty"` // The value of the current run
+}
+
+// GoldenResult represents the comparison of one target with its golden response
+type GoldenResult struct {
+	Name         string       `json:"Name"`         // The name of the golden entry
+	Passed       bool         `json:"Passed"`       // Indicates if the current response matches the golden one
+	ErrorMessage string       `json:"ErrorMessage"` // Why the current response could not be fetched, if so
+	Diffs        []GoldenDiff `json:"Diffs"`        // The differences from the golden response
+}
+
+// GoldenReport represents the comparison of a run with a golden file
+type GoldenReport struct {
+	File        string         `json:"File"`        // The golden file
+	Recorded    string         `json:"Recorded"`    // When the golden file was recorded
+	Targets     int            `json:"Targets"`     // The number of targets compared
+	Passed      int            `json:"Passed"`      // The number of targets matching their golden response
+	Regressions int            `json:"Regressions"` // The number of targets differing from their golden response, or failing
+	Results     []GoldenResult `json:"Results"`     // The result of each target
+}
+
+// runGolden records the responses of the echo servers as a golden file, or compares the current
+// responses with a golden file. The responses are normalized first: the volatile fields are replaced
+// with "<volatile>", so only their presence is compared, the IPs of the server with their family, and
+// ClientIP with "<local>" when it is an IP of the client (no SNAT) or kept as is otherwise; the fields
+// of -ignore are dropped. While recording, each target is sampled -samples times and the fields that
+// still differ between the samples are added to the volatile ones.
+// Comparing reports the added, removed and changed fields, e.g. a Via header added by a new mesh or
+// a ClientIP that became a node IP, and exits non-zero on any difference or failure.
+//
+// Usage:
+// go run client.go golden -record -http=<url>[,<url>] -udp=<host:port>[,<host:port>] [-proxy=<url>] [-file=golden.json]
+//
+//	[-samples=3] [-ignore=<pattern>,...] [-keep=<pattern>,...]
+//
+// go run client.go golden [-file=golden.json] [-ignore=<pattern>,...]
+func runGolden(args []string) {
+	fs := flag.NewFlagSet("golden", flag.ExitOnError)
+	record := fs.Bool("record", false, "Record the golden file instead of comparing with it")
+	file := fs.String("file", "golden.json", "The golden file")
+	httpTargets := fs.String("http", "", "The URLs of the HTTP echo servers to record, separated by commas")
+	udpTargets := fs.String("udp", "", "The host:port of the UDP echo servers to record, separated by commas")
+	proxyURL := fs.String("proxy", "", "Record the responses forwarded by this proxy server (optional)")
+	echoData := fs.String("data", "golden", "The data sent to the echo servers")
+	samples := fs.Int("samples", 3, "The responses sampled per target while recording, to detect the volatile fields")
+	ignore := fs.String("ignore", "", "Patterns of fields not to compare at all, e.g. RequestHttpHeaders.X-Envoy-*")
+	keep := fs.String("keep", "", "Patterns of fields to compare even if volatile, e.g. ServerIP (recording only)")
+	timeout := fs.Duration("timeout", 2*time.Second, "Timeout for each request")
+	fs.Parse(args)
+
+	if *record {
+		recordGolden(*file, *httpTargets, *udpTargets, *proxyURL, *echoData, *samples, splitList(*ignore), splitList(*keep), *timeout)
+		return
+	}
+
+	data, err := os.ReadFile(*file)
+	if err != nil {
+		log.Fatalf("Unable to read the golden file, record it with -record: %v", err)
+	}
+	var golden GoldenFile
+	if err := json.Unmarshal(data, &golden); err != nil {
+		log.Fatalf("Invalid golden file %s: %v", *file, err)
+	}
+	golden.Ignore = append(golden.Ignore, splitList(*ignore)...)
+
+	report := GoldenReport{File: *file, Recorded: golden.Recorded, Targets: len(golden.Entries), Results: []GoldenResult{}}
+	for _, entry := range golden.Entries {
+		result := GoldenResult{Name: entry.Name, Diffs: []GoldenDiff{}}
+		response, err := fetchEcho(entry.Protocol, entry.Target, entry.Proxy, golden.EchoData, *timeout)
+		if err != nil {
+			result.ErrorMessage = err.Error()
+		} else {
+			normalized := normalizeGolden("", response, &golden)
+			// The golden response was normalized with the patterns of its time, -ignore applies too
+			goldenResponse := normalizeGolden("", entry.Response, &golden)
+			diffGolden("", goldenResponse, normalized, &result.Diffs)
+			result.Passed = len(result.Diffs) == 0
+		}
+		if result.Passed {
+			report.Passed++
+		} else {
+			report.Regressions++
+		}
+		report.Results = append(report.Results, result)
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(report)
+	if report.Regressions > 0 {
+		os.Exit(1)
+	}
+}
+
+// recordGolden samples the targets and writes their normalized responses to the golden file
+func recordGolden(file, httpTargets, udpTargets, proxyURL, echoData string, samples int, ignore, keep []string, timeout time.Duration) {
+	if samples < 1 {
+		log.Fatalf("-samples must be at least 1")
+	}
+	var entries []GoldenEntry
+	for _, target := range splitList(httpTargets) {
+		entries = append(entries, GoldenEntry{Protocol: "http", Target: target, Proxy: proxyURL})
+	}
+	for _, target := range splitList(udpTargets) {
+		entries = append(entries, GoldenEntry{Protocol: "udp", Target: target, Proxy: proxyURL})
+	}
+	if len(entries) == 0 {
+		log.Fatalf("-http or -udp is required to record")
+	}
+
+	golden := GoldenFile{
+		Recorded: time.Now().Format(time.RFC3339),
+		EchoData: echoData,
+		Volatile: append([]string(nil), goldenVolatile...),
+		Ignore:   append([]string{}, ignore...),
+		Keep:     append([]string{}, keep...),
+	}
+	detected := make(map[string]bool)
+	for i := range entries {
+		entry := &entries[i]
+		entry.Name = entry.Protocol + " " + entry.Target
+		if entry.Proxy != "" {
+			entry.Name += " via " + entry.Proxy
+		}
+
+		var normalized []interface{}
+		for n := 0; n < samples; n++ {
+			response, err := fetchEcho(entry.Protocol, entry.Target, entry.Proxy, echoData, timeout)
+			if err != nil {
+				log.Fatalf("Unable to record %s: %v", entry.Name, err)
+			}
+			normalized = append(normalized, normalizeGolden("", response, &golden))
+		}
+		// The fields that differ between the samples are volatile too, e.g. when several pods answer
+		for _, sample := range normalized[1:] {
+			var diffs []GoldenDiff
+			diffGolden("", normalized[0], sample, &diffs)
+			for _, diff := range diffs {
+				if !detected[diff.Path] {
+					detected[diff.Path] = true
+					golden.Volatile = append(golden.Volatile, diff.Path)
+					log.Printf("Detected the volatile field %s of %s", diff.Path, entry.Name)
+				}
+			}
+		}
+		entry.Response = normalizeGolden("", normalized[0], &golden)
+	}
+	golden.Entries = entries
+
+	// The placeholders are kept readable, e.g. <volatile> rather than \u003cvolatile\u003e
+	var data bytes.Buffer
+	encoder := json.NewEncoder(&data)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(golden); err != nil {
+		log.Fatalf("Unable to encode the golden file: %v", err)
+	}
+	if err := os.WriteFile(file, data.Bytes(), 0644); err != nil {
+		log.Fatalf("Unable to write the golden file: %v", err)
+	}
+	log.Printf("Recorded the responses of %d targets to %s", len(entries), file)
+}
+
+// fetchEcho sends data to an echo server, directly or through the proxy server, and returns its
+// JSON response
+func fetchEcho(protocol, target, proxyURL, data string, timeout time.Duration) (interface{}, error) {
+	var body []byte
+	var err error
+	switch {
+	case proxyURL != "":
+		body, err = fetchEchoViaProxy(protocol, target, proxyURL, data, timeout)
+	case protocol == "http":
+		client := &http.Client{Timeout: timeout}
+		var resp *http.Response
+		if resp, err = client.Post(target, "application/json", strings.NewReader(data)); err == nil {
+			defer resp.Body.Close()
+			if body, err = io.ReadAll(resp.Body); err == nil && resp.StatusCode != http.StatusOK {
+				err = fmt.Errorf("unexpected status %s", resp.Status)
+			}
+		}
+	case protocol == "udp":
+		var conn net.Conn
+		if conn, err = net.DialTimeout("udp", target, timeout); err == nil {
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(timeout))
+			buffer := make([]byte, 65535)
+			var n int
+			if _, err = conn.Write([]byte(data)); err == nil {
+				n, err = conn.Read(buffer)
+				body = buffer[:n]
+			}
+		}
+	default:
+		err = fmt.Errorf("unsupported protocol %q, supported values are 'http' and 'udp'", protocol)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var response interface{}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return nil, fmt.Errorf("the response is not JSON: %v", err)
+	}
+	return response, nil
+}
+
+// fetchEchoViaProxy asks the proxy server to forward data to target and returns the backend response
+func fetchEchoViaProxy(protocol, target, proxyURL, data string, timeout time.Duration) ([]byte, error) {
+	requestBody, err := json.Marshal(common.ProxyClientRequest{
+		BackendUrl:  target,
+		Timeout:     int((timeout + time.Second - 1) / time.Second),
+		ForwardType: protocol,
+		EchoData:    data,
+	})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, proxyURL, bytes.NewReader(requestBody))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token := os.Getenv("PROXY_AUTH_TOKEN"); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	client := &http.Client{Timeout: timeout + 2*time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("proxy unreachable: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var response common.ProxyResponse
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return nil, fmt.Errorf("invalid proxy response: %v", err)
+	}
+	if !response.Success {
+		return nil, fmt.Errorf("proxy reported: %s", response.ErrorMessage)
+	}
+	return []byte(response.BackendResponse), nil
+}
+
+// normalizeGolden replaces the volatile fields of a JSON value with "<volatile>", the IPs of
+// goldenIPFamily with their family and ClientIP with "<local>" when it is an IP of the client,
+// unless they match a keep pattern, and drops the ignored fields
+func normalizeGolden(fieldPath string, value interface{}, golden *GoldenFile) interface{} {
+	if fieldPath != "" && !matchesAny(golden.Keep, fieldPath) {
+		if matchesAny(golden.Volatile, fieldPath) {
+			return "<volatile>"
+		}
+		if s, ok := value.(string); ok && (matchesAny(goldenIPFamily, fieldPath) || fieldPath == "ClientIP") {
+			return normalizeGoldenIP(fieldPath, s)
+		}
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		normalized := make(map[string]interface{}, len(v))
+		for key, field := range v {
+			if keyPath := joinGoldenPath(fieldPath, key); !matchesAny(golden.Ignore, keyPath) {
+				normalized[key] = normalizeGolden(keyPath, field, golden)
+			}
+		}
+		return normalized
+	case []interface{}:
+		normalized := make([]interface{}, 0, len(v))
+		for i, element := range v {
+			if elementPath := joinGoldenPath(fieldPath, strconv.Itoa(i)); !matchesAny(golden.Ignore, elementPath) {
+				normalized = append(normalized, normalizeGolden(elementPath, element, golden))
+			}
+		}
+		return normalized
+	}
+	return value
+}
+
+// normalizeGoldenIP returns the family of an IP, or "<local>" for a ClientIP of the client itself
+func normalizeGoldenIP(fieldPath, value string) string {
+	ip := net.ParseIP(value)
+	if ip == nil || value == "<local>" || strings.HasPrefix(value, "<IPv") {
+		return value
+	}
+	if fieldPath == "ClientIP" {
+		if ip.IsLoopback() {
+			return "<local>"
+		}
+		addrs, _ := net.InterfaceAddrs()
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+				return "<local>"
+			}
+		}
+		return value
+	}
+	if ip.To4() != nil {
+		return "<IPv4>"
+	}
+	return "<IPv6>"
+}
+
+// diffGolden appends the differences between a golden JSON value and the current one to diffs
+func diffGolden(fieldPath string, golden, current interface{}, diffs *[]GoldenDiff) {
+	switch g := golden.(type) {
+	case map[string]interface{}:
+		c, ok := current.(map[string]interface{})
+		if !ok {
+			break
+		}
+		keys := make(map[string]bool)
+		for key := range g {
+			keys[key] = true
+		}
+		for key := range c {
+			keys[key] = true
+		}
+		for _, key := range sortedKeys(keys) {
+			keyPath := joinGoldenPath(fieldPath, key)
+			goldenField, inGolden := g[key]
+			currentField, inCurrent := c[key]
+			switch {
+			case !inCurrent:
+				*diffs = append(*diffs, GoldenDiff{Path: keyPath, Kind: "removed", Golden: goldenField})
+			case !inGolden:
+				*diffs = append(*diffs, GoldenDiff{Path: keyPath, Kind: "added", Current: currentField})
+			default:
+				diffGolden(keyPath, goldenField, currentField, diffs)
+			}
+		}
+		return
+	case []interface{}:
+		c, ok := current.([]interface{})
+		if !ok {
+			break
+		}
+		for i := 0; i < max(len(g), len(c)); i++ {
+			elementPath := joinGoldenPath(fieldPath, strconv.Itoa(i))
+			switch {
+			case i >= len(c):
+				*diffs = append(*diffs, GoldenDiff{Path: elementPath, Kind: "removed", Golden: g[i]})
+			case i >= len(g):
+				*diffs = append(*diffs, GoldenDiff{Path: elementPath, Kind: "added", Current: c[i]})
+			default:
+				diffGolden(elementPath, g[i], c[i], diffs)
+			}
+		}
+		return
+	}
+	if !reflect.DeepEqual(golden, current) {
+		*diffs = append(*diffs, GoldenDiff{Path: fieldPath, Kind: "changed", Golden: golden, Current: current})
+	}
+}
+
+// joinGoldenPath returns the path of a field or element of the value at path
+func joinGoldenPath(fieldPath, key string) string {
+	if fieldPath == "" {
+		return key
+	}
+	return fieldPath + "." + key
+}
+
+// matchesAny reports if the path of a field matches one of the patterns, as path.Match does
+func matchesAny(patterns []string, fieldPath string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, fieldPath); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// sortedKeys returns the keys of a set in order
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+//--------------------------------- rtt
+
+// RTTSample represents the reply to one ping of the rtt subcommand
+type RTTSample struct {
+	Sequence   uint32  `json:"Sequence"`   // The sequence number of the ping
+	RTTMicros  float64 `json:"RTTMicros"`  // The round trip time without the hold time of the server
+	HoldMicros float64 `json:"HoldMicros"` // How long the server held the request
+}
+
+// RTTReport represents the result of the rtt subcommand. The RTT statistics exclude the hold time
+// of the server, so they describe the network path and the kernels of both ends.
+type RTTReport struct {
+	Target        string      `json:"Target"`        // The host:port of the UDP echo server
+	Size          int         `json:"Size"`          // The size of each ping in bytes
+	Sent          int         `json:"Sent"`          // The number of pings sent
+	Received      int         `json:"Received"`      // The number of pings answered within -timeout
+	LossPercent   float64     `json:"LossPercent"`   // The percentage of pings not answered within -timeout
+	Late          int         `json:"Late"`          // The replies received after -timeout, counted as lost
+	Duplicates    int         `json:"Duplicates"`    // The replies received more than once
+	Reordered     int         `json:"Reordered"`     // The replies received after the reply of a later ping
+	Invalid       int         `json:"Invalid"`       // The datagrams received that are not replies of the RTT ping protocol
+	MinMicros     float64     `json:"MinMicros"`     // The minimum RTT
+	AvgMicros     float64     `json:"AvgMicros"`     // The average RTT
+	P50Micros     float64     `json:"P50Micros"`     // The median RTT
+	P90Micros     float64     `json:"P90Micros"`     // The 90th percentile RTT
+	P99Micros     float64     `json:"P99Micros"`     // The 99th percentile RTT
+	MaxMicros     float64     `json:"MaxMicros"`     // The maximum RTT
+	StdDevMicros  float64     `json:"StdDevMicros"`  // The standard deviation of the RTT
+	JitterMicros  float64     `json:"JitterMicros"`  // The mean difference between the RTT of consecutive pings
+	HoldAvgMicros float64     `json:"HoldAvgMicros"` // The average hold time of the server, subtracted from the RTT
+	LastError     string      `json:"LastError"`     // The last error sending or receiving, if any
+	Samples       []RTTSample `json:"Samples,omitempty"`
+}
+
+// runRTT measures the RTT and jitter to a UDP echo server with the binary RTT ping protocol of
+// common/ping.go. Each ping carries the send time on the monotonic clock of the client, echoed by
+// the server with how long it held the request, so the RTT needs no clock synchronization and is
+// not skewed by JSON encoding and logging, which take longer than the RTT inside a cluster.
+// The client exits non-zero when no ping is answered.
+//
+// Usage:
+// go run client.go rtt -target=<host:port> [-count=100] [-interval=10ms] [-timeout=1s] [-size=28] [-samples]
+func runRTT(args []string) {
+	fs := flag.NewFlagSet("rtt", flag.ExitOnError)
+	target := fs.String("target", "", "The host:port of the UDP echo server")
+	count := fs.Int("count", 100, "The number of pings")
+	interval := fs.Duration("interval", 10*time.Millisecond, "The interval between pings")
+	timeout := fs.Duration("timeout", time.Second, "How long to wait for each reply before counting the ping as lost")
+	size := fs.Int("size", common.PingHeaderLength, "The size of each ping in bytes, at least the 28 bytes of the header")
+	withSamples := fs.Bool("samples", false, "Include the RTT of each ping in the report")
+	fs.Parse(args)
+
+	if *target == "" {
+		log.Fatalf("-target is required")
+	}
+	if *count <= 0 || *size < common.PingHeaderLength || *size > 65507 {
+		log.Fatalf("-count must be positive and -size between %d and 65507", common.PingHeaderLength)
+	}
+	conn, err := net.Dial("udp", *target)
+	if err != nil {
+		log.Fatalf("Unable to reach %s: %v", *target, err)
+	}
+
+	report := RTTReport{Target: *target, Size: *size}
+	var reportMutex sync.Mutex
+	replies := make([]*RTTSample, *count)
+	answered := make([]bool, *count) // Including the late replies, to count their duplicates
+	start := time.Now()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		buffer := make([]byte, 65535)
+		highest := -1
+		for {
+			n, err := conn.Read(buffer)
+			now := time.Since(start)
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			reportMutex.Lock()
+			if err != nil {
+				// e.g. connection refused, when the ICMP port unreachable of a ping comes back
+				report.LastError = err.Error()
+				reportMutex.Unlock()
+				continue
+			}
+			packet, err := common.ParsePingPacket(buffer[:n])
+			sequence := int(packet.Sequence)
+			switch {
+			case err != nil || packet.Type != common.PingTypeReply || sequence >= *count:
+				report.Invalid++
+				report.LastError = "received a datagram that is not an RTT ping reply, the server may not support the protocol"
+			case answered[sequence]:
+				report.Duplicates++
+			case now-time.Duration(packet.ClientTimestamp) > *timeout:
+				answered[sequence] = true
+				report.Late++
+			default:
+				answered[sequence] = true
+				if sequence < highest {
+					report.Reordered++
+				}
+				highest = max(highest, sequence)
+				rtt := now - time.Duration(packet.ClientTimestamp) - packet.ServerHold
+				replies[sequence] = &RTTSample{
+					Sequence:   packet.Sequence,
+					RTTMicros:  float64(rtt) / float64(time.Microsecond),
+					HoldMicros: float64(packet.ServerHold) / float64(time.Microsecond),
+				}
+			}
+			reportMutex.Unlock()
+		}
+	}()
+
+	packet := make([]byte, 0, *size)
+	for i := 0; i < *count; i++ {
+		// Pings are scheduled from the start, so a slow write does not shift the following ones
+		time.Sleep(time.Until(start.Add(time.Duration(i) * *interval)))
+		packet = common.AppendPingPacket(packet[:0], common.PingPacket{
+			Type:            common.PingTypeRequest,
+			Sequence:        uint32(i),
+			ClientTimestamp: uint64(time.Since(start)),
+		}, *size)
+		if _, err := conn.Write(packet); err != nil {
+			reportMutex.Lock()
+			report.LastError = err.Error()
+			reportMutex.Unlock()
+			continue
+		}
+		report.Sent++
+	}
+	time.Sleep(*timeout)
+	conn.Close()
+	<-done
+
+	var rtts []float64
+	var sum, holdSum, jitterSum float64
+	var previous *RTTSample
+	jitters := 0
+	for _, sample := range replies {
+		if sample == nil {
+			continue
+		}
+		rtts = append(rtts, sample.RTTMicros)
+		sum += sample.RTTMicros
+		holdSum += sample.HoldMicros
+		if previous != nil {
+			jitterSum += math.Abs(sample.RTTMicros - previous.RTTMicros)
+			jitters++
+		}
+		previous = sample
+		if *withSamples {
+			report.Samples = append(report.Samples, *sample)
+		}
+	}
+	report.Received = len(rtts)
+	if report.Sent > 0 {
+		report.LossPercent = float64(report.Sent-report.Received) * 100 / float64(report.Sent)
+	}
+	if report.Received > 0 {
+		report.AvgMicros = sum / float64(report.Received)
+		report.HoldAvgMicros = holdSum / float64(report.Received)
+		var squares float64
+		for _, rtt := range rtts {
+			squares += (rtt - report.AvgMicros) * (rtt - report.AvgMicros)
+		}
+		report.StdDevMicros = math.Sqrt(squares / float64(report.Received))
+		sort.Float64s(rtts)
+		report.MinMicros, report.MaxMicros = rtts[0], rtts[len(rtts)-1]
+		report.P50Micros = percentile(rtts, 50)
+		report.P90Micros = percentile(rtts, 90)
+		report.P99Micros = percentile(rtts, 99)
+	}
+	if jitters > 0 {
+		report.JitterMicros = jitterSum / float64(jitters)
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(report)
+	if report.Received == 0 {
+		os.Exit(1)
+	}
+}
+
+//--------------------------------- journey
+
+// JourneyStep is a step of a journey: a call (Protocol and Target, optionally through Proxy) or a
+// think time (Think), during which the virtual user waits like a user reading a page
+type JourneyStep struct {
+	Name        string `json:"Name"`        // The name of the call in the report (default is <protocol>-<index>)
+	Protocol    string `json:"Protocol"`    // The protocol of the call: http, udp or tcp
+	Target      string `json:"Target"`      // The URL or host:port of the call
+	Proxy       string `json:"Proxy"`       // Send the call through this proxy server (optional)
+	Optional    bool   `json:"Optional"`    // Indicates if a failure of the call neither fails nor stops the journey
+	Think       string `json:"Think"`       // The think time, e.g. 2s
+	ThinkJitter string `json:"ThinkJitter"` // A random extra think time up to this duration, e.g. 1s
+
+	think       time.Duration
+	thinkJitter time.Duration
+}
+
+// JourneyFile represents a journey, the sequence of steps each virtual user goes through
+type JourneyFile struct {
+	Name  string        `json:"Name"`  // The name of the journey
+	Steps []JourneyStep `json:"Steps"` // The calls and think times, in order
+}
+
+// JourneyStepReport represents the results of a call of the journey over all the virtual users
+type JourneyStepReport struct {
+	Name        string  `json:"Name"`        // The name of the call
+	Protocol    string  `json:"Protocol"`    // The protocol of the call
+	Target      string  `json:"Target"`      // The URL or host:port of the call
+	Proxy       string  `json:"Proxy"`       // The proxy server the call went through, if any
+	Attempts    int     `json:"Attempts"`    // The number of calls made
+	Successes   int     `json:"Successes"`   // The number of successful calls
+	Failures    int     `json:"Failures"`    // The number of failed calls
+	Skipped     int     `json:"Skipped"`     // The calls not made since an earlier call of the journey failed
+	SuccessRate float64 `json:"SuccessRate"` // The percentage of successful calls
+	P50Ms       float64 `json:"P50Ms"`       // The median latency of the successful calls
+	P90Ms       float64 `json:"P90Ms"`       // The 90th percentile latency of the successful calls
+	P99Ms       float64 `json:"P99Ms"`       // The 99th percentile latency of the successful calls
+	MaxMs       float64 `json:"MaxMs"`       // The highest latency of the successful calls
+	LastError   string  `json:"LastError"`   // The error of the last failed call, if any
+
+	latencies []float64
+}
+
+// JourneyReport represents the result of the journey subcommand
+type JourneyReport struct {
+	Journey         string              `json:"Journey"`         // The name of the journey
+	Users           int                 `json:"Users"`           // The number of virtual users
+	DurationSeconds float64             `json:"DurationSeconds"` // How long the run took
+	Started         int                 `json:"Started"`         // The number of journeys started
+	Succeeded       int                 `json:"Succeeded"`       // The journeys whose calls all succeeded, optional ones aside
+	Failed          int                 `json:"Failed"`          // The journeys stopped by a failed call
+	Interrupted     int                 `json:"Interrupted"`     // The journeys cut short by the end of the run, left out of the success rate
+	SuccessRate     float64             `json:"SuccessRate"`     // The percentage of succeeded journeys among the succeeded and failed ones
+	JourneysPerMin  float64             `json:"JourneysPerMin"`  // The rate of finished journeys
+	P50Ms           float64             `json:"P50Ms"`           // The median duration of the succeeded journeys, think times included
+	P99Ms           float64             `json:"P99Ms"`           // The 99th percentile duration of the succeeded journeys, think times included
+	ActiveP50Ms     float64             `json:"ActiveP50Ms"`     // The median time the succeeded journeys spent in calls
+	ActiveP99Ms     float64             `json:"ActiveP99Ms"`     // The 99th percentile time the succeeded journeys spent in calls
+	Passed          bool                `json:"Passed"`          // Indicates if the success rate reached -min-success
+	LastError       string              `json:"LastError"`       // The error of the last failed call, with the name of its step
+	Steps           []JourneyStepReport `json:"Steps"`           // The results of each call
+}
+
+// runJourney emulates application traffic: virtual users go through a journey of calls of
+// different protocols, directly or through the proxy server, separated by think times, over and
+// over until -duration or -iterations. A failed call fails the journey and the user abandons its
+// remaining calls, unless the step is Optional. The report gives the success and latency of each
+// call and of the whole journeys, and the client exits non-zero when the journey success rate is
+// below -min-success.
+//
+// The journey file is JSON, e.g.
+//
+//	{"Name":"checkout","Steps":[
+//	  {"Name":"home","Protocol":"http","Target":"http://backend:8080/"},
+//	  {"Think":"2s","ThinkJitter":"1s"},
+//	  {"Name":"presence","Protocol":"udp","Target":"backend:8080"},
+//	  {"Think":"500ms"},
+//	  {"Name":"pay","Protocol":"http","Target":"http://backend:8080/","Proxy":"http://proxy:8090"}]}
+//
+// Usage:
+// go run client.go journey -file=<journey.json> [-users=10] [-duration=1m] [-iterations=0] [-ramp-up=0]
+//
+//	[-think-scale=1] [-timeout=3s] [-min-success=100%]
+func runJourney(args []string) {
+	fs := flag.NewFlagSet("journey", flag.ExitOnError)
+	file := fs.String("file", "", "The JSON file of the journey")
+	users := fs.Int("users", 10, "The number of virtual users going through the journey concurrently")
+	duration := fs.Duration("duration", time.Minute, "How long to run the journeys (0 for until interrupted or -iterations)")
+	iterations := fs.Int("iterations", 0, "The number of journeys of each user (0 for until -duration)")
+	rampUp := fs.Duration("ramp-up", 0, "Start the users evenly over this duration instead of all at once")
+	thinkScale := fs.Float64("think-scale", 1, "The factor applied to all think times, e.g. 0 to remove them")
+	timeout := fs.Duration("timeout", 3*time.Second, "Timeout for each call")
+	minSuccess := fs.String("min-success", "100%", "Fail if the journey success rate is below this percentage")
+	fs.Parse(args)
+
+	if *file == "" {
+		log.Fatalf("-file is required")
+	}
+	journey, err := loadJourney(*file)
+	if err != nil {
+		log.Fatalf("Invalid journey %s: %v", *file, err)
+	}
+	if *users <= 0 || *iterations < 0 || *rampUp < 0 || *thinkScale < 0 {
+		log.Fatalf("-users must be positive, -iterations, -ramp-up and -think-scale not negative")
+	}
+	if *duration <= 0 && *iterations == 0 {
+		log.Printf("Running until interrupted, neither -duration nor -iterations is set")
+	}
+	minSuccessRate, err := strconv.ParseFloat(strings.TrimSuffix(*minSuccess, "%"), 64)
+	if err != nil || minSuccessRate < 0 || minSuccessRate > 100 {
+		log.Fatalf("Invalid -min-success %q, expected a percentage such as 99.9%%", *minSuccess)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if *duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *duration)
+		defer cancel()
+	}
+
+	report := JourneyReport{Journey: journey.Name, Users: *users}
+	stepReports := make([]*JourneyStepReport, len(journey.Steps))
+	for i, step := range journey.Steps {
+		if step.Protocol != "" {
+			stepReports[i] = &JourneyStepReport{Name: step.Name, Protocol: step.Protocol, Target: step.Target, Proxy: step.Proxy}
+		}
+	}
+	var totals, actives []float64
+	var reportMutex sync.Mutex
+
+	started := time.Now()
+	var wg sync.WaitGroup
+	for user := 0; user < *users; user++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sleepContext(ctx, *rampUp*time.Duration(user)/time.Duration(*users))
+			for i := 0; (*iterations == 0 || i < *iterations) && ctx.Err() == nil; i++ {
+				reportMutex.Lock()
+				report.Started++
+				reportMutex.Unlock()
+
+				begin := time.Now()
+				var active time.Duration
+				outcome := "succeeded"
+				for s, step := range journey.Steps {
+					if ctx.Err() != nil {
+						outcome = "interrupted"
+						break
+					}
+					if step.Protocol == "" {
+						think := step.think
+						if step.thinkJitter > 0 {
+							think += time.Duration(rand.Int63n(int64(step.thinkJitter) + 1))
+						}
+						sleepContext(ctx, time.Duration(float64(think)**thinkScale))
+						continue
+					}
+
+					result := probe(step.Protocol, step.Target, step.Proxy, *timeout)
+					active += time.Duration(result.LatencyMs * float64(time.Millisecond))
+					reportMutex.Lock()
+					stepReport := stepReports[s]
+					stepReport.Attempts++
+					if result.Success {
+						stepReport.Successes++
+						stepReport.latencies = append(stepReport.latencies, result.LatencyMs)
+					} else {
+						stepReport.Failures++
+						stepReport.LastError = result.ErrorMessage
+						report.LastError = fmt.Sprintf("%s: %s", step.Name, result.ErrorMessage)
+					}
+					reportMutex.Unlock()
+					if !result.Success && !step.Optional {
+						outcome = "failed"
+						reportMutex.Lock()
+						for _, skipped := range stepReports[s+1:] {
+							if skipped != nil {
+								skipped.Skipped++
+							}
+						}
+						reportMutex.Unlock()
+						break
+					}
+				}
+
+				reportMutex.Lock()
+				switch outcome {
+				case "succeeded":
+					report.Succeeded++
+					totals = append(totals, float64(time.Since(begin).Microseconds())/1000)
+					actives = append(actives, float64(active.Microseconds())/1000)
+				case "failed":
+					report.Failed++
+				case "interrupted":
+					report.Interrupted++
+				}
+				reportMutex.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	elapsed := time.Since(started)
+	report.DurationSeconds = math.Round(elapsed.Seconds()*1000) / 1000
+	if finished := report.Succeeded + report.Failed; finished > 0 {
+		report.SuccessRate = float64(report.Succeeded) * 100 / float64(finished)
+		report.JourneysPerMin = float64(finished) / elapsed.Minutes()
+	}
+	sort.Float64s(totals)
+	sort.Float64s(actives)
+	report.P50Ms, report.P99Ms = percentile(totals, 50), percentile(totals, 99)
+	report.ActiveP50Ms, report.ActiveP99Ms = percentile(actives, 50), percentile(actives, 99)
+	report.Steps = []JourneyStepReport{}
+	for _, stepReport := range stepReports {
+		if stepReport == nil {
+			continue
+		}
+		if stepReport.Attempts > 0 {
+			stepReport.SuccessRate = float64(stepReport.Successes) * 100 / float64(stepReport.Attempts)
+		}
+		sort.Float64s(stepReport.latencies)
+		stepReport.P50Ms = percentile(stepReport.latencies, 50)
+		stepReport.P90Ms = percentile(stepReport.latencies, 90)
+		stepReport.P99Ms = percentile(stepReport.latencies, 99)
+		if len(stepReport.latencies) > 0 {
+			stepReport.MaxMs = stepReport.latencies[len(stepReport.latencies)-1]
+		}
+		report.Steps = append(report.Steps, *stepReport)
+	}
+	report.Passed = report.Succeeded+report.Failed > 0 && report.SuccessRate >= minSuccessRate
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(report)
+	if !report.Passed {
+		os.Exit(1)
+	}
+}
+
+// loadJourney reads and validates a journey file, and names its unnamed calls
+func loadJourney(path string) (*JourneyFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var journey JourneyFile
+	if err := json.Unmarshal(data, &journey); err != nil {
+		return nil, err
+	}
+
+	calls := 0
+	names := make(map[string]bool)
+	for i := range journey.Steps {
+		step := &journey.Steps[i]
+		step.Protocol = strings.ToLower(step.Protocol)
+		if step.Protocol == "" {
+			if step.Think == "" || step.Target != "" || step.Proxy != "" {
+				return nil, fmt.Errorf("step %d: a step is either a call with Protocol and Target or a Think time", i+1)
+			}
+			if step.think, err = time.ParseDuration(step.Think); err != nil || step.think < 0 {
+				return nil, fmt.Errorf("step %d: invalid Think %q", i+1, step.Think)
+			}
+			if step.ThinkJitter != "" {
+				if step.thinkJitter, err = time.ParseDuration(step.ThinkJitter); err != nil || step.thinkJitter < 0 {
+					return nil, fmt.Errorf("step %d: invalid ThinkJitter %q", i+1, step.ThinkJitter)
+				}
+			}
+			continue
+		}
+
+		switch {
+		case step.Think != "":
+			return nil, fmt.Errorf("step %d: a call cannot have a Think time, add a Think step after it", i+1)
+		case step.Protocol != "http" && step.Protocol != "udp" && step.Protocol != "tcp":
+			return nil, fmt.Errorf("step %d: unsupported Protocol %q, supported values are 'http', 'udp' and 'tcp'", i+1, step.Protocol)
+		case step.Target == "":
+			return nil, fmt.Errorf("step %d: Target is required", i+1)
+		}
+		calls++
+		if step.Name == "" {
+			step.Name = fmt.Sprintf("%s-%d", step.Protocol, i+1)
+		}
+		if names[step.Name] {
+			return nil, fmt.Errorf("step %d: duplicate Name %q", i+1, step.Name)
+		}
+		names[step.Name] = true
+	}
+	if calls == 0 {
+		return nil, fmt.Errorf("the journey has no call")
+	}
+	if journey.Name == "" {
+		journey.Name = strings.TrimSuffix(path[strings.LastIndex(path, "/")+1:], ".json")
+	}
+	return &journey, nil
+}
+
+//--------------------------------- kubernetes events
+
+// maxEventMessage bounds the message of the emitted events, the API server rejects longer ones
+const maxEventMessage = 1024
+
+// maxCapturedReport bounds the output of a subcommand kept to summarize it
+const maxCapturedReport = 16 << 20
+
+// testRunAnnotation is the annotation set on the involved object with -events-annotate
+const testRunAnnotation = "connectivity-test/last-run"
+
+// eventObject describes a kind of object the events can be attached to
+type eventObject struct {
+	Kind       string // The kind of the object, e.g. Deployment
+	APIVersion string // The API version of the kind, e.g. apps/v1
+	Resource   string // The resource of the kind in the API paths, e.g. deployments
+	Namespaced bool   // Indicates if the objects of the kind live in a namespace
+}
+
+// eventObjects are the kinds of objects -events-object accepts
+var eventObjects = map[string]eventObject{
+	"pod":         {Kind: "Pod", APIVersion: "v1", Resource: "pods", Namespaced: true},
+	"service":     {Kind: "Service", APIVersion: "v1", Resource: "services", Namespaced: true},
+	"node":        {Kind: "Node", APIVersion: "v1", Resource: "nodes"},
+	"namespace":   {Kind: "Namespace", APIVersion: "v1", Resource: "namespaces"},
+	"deployment":  {Kind: "Deployment", APIVersion: "apps/v1", Resource: "deployments", Namespaced: true},
+	"daemonset":   {Kind: "DaemonSet", APIVersion: "apps/v1", Resource: "daemonsets", Namespaced: true},
+	"statefulset": {Kind: "StatefulSet", APIVersion: "apps/v1", Resource: "statefulsets", Namespaced: true},
+}
+
+// TestRunRecord represents a test run, as written in the testRunAnnotation of the involved object
+type TestRunRecord struct {
+	Subcommand string            `json:"Subcommand"` // The subcommand of the client
+	Args       []string          `json:"Args"`       // The arguments of the subcommand
+	Host       string            `json:"Host"`       // The host the client runs on
+	Started    string            `json:"Started"`    // When the run started
+	Finished   string            `json:"Finished"`   // When the run finished, empty while it runs
+	Result     string            `json:"Result"`     // Running, Passed or Failed
+	ExitCode   int               `json:"ExitCode"`   // The exit code of the subcommand
+	Summary    map[string]string `json:"Summary"`    // The scalar top-level fields of the JSON report of the subcommand
+}
+
+// kubeEventRecorder emits the start and end events of a test run, and optionally annotates the
+// involved object with the run
+type kubeEventRecorder struct {
+	kube      *common.KubeClient
+	namespace string // The namespace of the events
+	object    eventObject
+	name      string // The name of the involved object
+	objectNS  string // The namespace of the involved object, empty for cluster scoped kinds
+	annotate  bool
+	host      string
+
+	resultsURL string // The results server the report is pushed to, with -results-url
+}
+
+// runWithKubeEvents parses the global options given before the subcommand and runs it. With
+// -k8s-events or -results-url, the subcommand runs as a child process, so its report and exit code
+// are captured whatever the way it ends. With -k8s-events, Kubernetes events are emitted when it starts and ends:
+// ConnectivityTestStarted, then ConnectivityTestPassed or ConnectivityTestFailed (a Warning) with
+// the summary of the report. With -events-annotate, the run is also recorded in the
+// connectivity-test/last-run annotation of the involved object. With -results-url, the report is
+// pushed to the results server (results_server.go) with the subcommand as its kind.
+//
+// The service account needs no more than:
+//
+//	rules:
+//	- apiGroups: [""]
+//	  resources: ["events"]
+//	  verbs: ["create"]
+//	- apiGroups: ["<group of the involved object>"]   # only with -events-annotate
+//	  resources: ["<resource of the involved object>"]
+//	  verbs: ["patch"]
+//
+// Usage:
+// go run client.go -k8s-events [-events-object=<kind>/<name>] [-events-namespace=<ns>]
+//
+//	[-events-annotate] [-kube-api=<url>] [-results-url=<url>] <subcommand> [options]
+func runWithKubeEvents(args []string) {
+	fs := flag.NewFlagSet("client", flag.ExitOnError)
+	enabled := fs.Bool("k8s-events", false, "Emit Kubernetes events when the subcommand starts and ends")
+	objectRef := fs.String("events-object", "", "The object the events are attached to, as <kind>/<name>, e.g. deployment/backend (default is the pod of the client, or its namespace)")
+	namespace := fs.String("events-namespace", "", "The namespace of the events and of the object (default is the namespace of the client)")
+	annotate := fs.Bool("events-annotate", false, "Also record the run in the connectivity-test/last-run annotation of the object")
+	kubeAPI := fs.String("kube-api", "", "Kubernetes API URL, e.g. from `kubectl proxy` (default is the in-cluster service account)")
+	resultsURL := fs.String("results-url", "", "Push the report of the subcommand to the results server at this URL, e.g. http://results:8095")
+	fs.Parse(args)
+
+	rest := fs.Args()
+	if len(rest) == 0 {
+		log.Fatalf("A subcommand is required after the global options")
+	}
+	run, ok := subcommands[rest[0]]
+	if !ok {
+		log.Fatalf("Unknown subcommand %q", rest[0])
+	}
+	if !*enabled && *resultsURL == "" {
+		run(rest[1:])
+		return
+	}
+
+	// Without -k8s-events, the recorder has no API client and only pushes the report
+	recorder := &kubeEventRecorder{}
+	recorder.host, _ = os.Hostname()
+	if *enabled {
+		var err error
+		if recorder, err = newKubeEventRecorder(*kubeAPI, *objectRef, *namespace, *annotate); err != nil {
+			log.Fatalf("Invalid Kubernetes event options: %v", err)
+		}
+	}
+	recorder.resultsURL = strings.TrimSuffix(*resultsURL, "/")
+	os.Exit(recorder.run(rest))
+}
+
+// newKubeEventRecorder creates the kubeEventRecorder of the global options
+func newKubeEventRecorder(kubeAPI, objectRef, namespace string, annotate bool) (*kubeEventRecorder, error) {
+	kube, err := common.NewKubeClient(kubeAPI)
+	if err != nil {
+		return nil, err
+	}
+	if namespace == "" {
+		namespace = common.PodNamespace()
+	}
+	recorder := &kubeEventRecorder{kube: kube, namespace: namespace, annotate: annotate}
+	recorder.host, _ = os.Hostname()
+
+	if objectRef == "" {
+		if pod := os.Getenv("POD_NAME"); pod != "" {
+			objectRef = "pod/" + pod
+		} else {
+			objectRef = "namespace/" + namespace
+		}
+	}
+	kind, name, ok := strings.Cut(objectRef, "/")
+	object, known := eventObjects[strings.ToLower(kind)]
+	if !ok || name == "" || !known {
+		return nil, fmt.Errorf("invalid -events-object %q, expected <kind>/<name> with a kind among pod, service, node, namespace, deployment, daemonset and statefulset", objectRef)
+	}
+	recorder.object, recorder.name = object, name
+	if object.Namespaced {
+		recorder.objectNS = namespace
+	}
+	return recorder, nil
+}
+
+// run runs the subcommand as a child process between its start and end events, and returns its
+// exit code. The interrupts are forwarded to the child, which prints its report as usual.
+func (k *kubeEventRecorder) run(args []string) int {
+	record := TestRunRecord{Subcommand: args[0], Args: args[1:], Host: k.host, Started: time.Now().Format(time.RFC3339), Result: "Running"}
+	k.emit("ConnectivityTestStarted", "Normal", fmt.Sprintf("%s started on %s: %s", record.Subcommand, k.host, strings.Join(args, " ")))
+	k.annotateObject(record)
+
+	executable, err := os.Executable()
+	if err != nil {
+		log.Fatalf("Unable to find the executable of the client: %v", err)
+	}
+	var report bytes.Buffer
+	cmd := exec.Command(executable, args...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = io.MultiWriter(os.Stdout, &limitedBuffer{buffer: &report, limit: maxCapturedReport})
+	cmd.Stderr = os.Stderr
+
+	started := time.Now()
+	exitCode := 0
+	if err := cmd.Start(); err != nil {
+		log.Printf("Unable to start %s: %v", record.Subcommand, err)
+		exitCode = 1
+	} else {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			for sig := range signals {
+				cmd.Process.Signal(sig)
+			}
+		}()
+		err = cmd.Wait()
+		signal.Stop(signals)
+		close(signals)
+
+		var exitErr *exec.ExitError
+		switch {
+		case errors.As(err, &exitErr):
+			exitCode = exitErr.ExitCode()
+		case err != nil:
+			exitCode = 1
+		}
+	}
+
+	record.Finished = time.Now().Format(time.RFC3339)
+	record.ExitCode = exitCode
+	record.Summary = common.SummarizeReport(report.Bytes())
+	reason, eventType := "ConnectivityTestPassed", "Normal"
+	record.Result = "Passed"
+	if exitCode != 0 {
+		reason, eventType = "ConnectivityTestFailed", "Warning"
+		record.Result = "Failed"
+	}
+
+	message := fmt.Sprintf("%s %s on %s after %s (exit code %d)", record.Subcommand, strings.ToLower(record.Result), k.host, time.Since(started).Round(time.Second), exitCode)
+	keys := make([]string, 0, len(record.Summary))
+	for key := range record.Summary {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for i, key := range keys {
+		separator := ", "
+		if i == 0 {
+			separator = ": "
+		}
+		message += separator + key + "=" + record.Summary[key]
+	}
+	k.emit(reason, eventType, message)
+	k.annotateObject(record)
+	k.pushReport(record, report.Bytes())
+	return exitCode
+}
+
+// pushReport posts the report of the subcommand to the results server, with -results-url. The
+// source of the report is the pod of the client, or its host.
+func (k *kubeEventRecorder) pushReport(record TestRunRecord, report []byte) {
+	if k.resultsURL == "" {
+		return
+	}
+	source := os.Getenv("POD_NAME")
+	if source == "" {
+		source = k.host
+	}
+	if len(bytes.TrimSpace(report)) == 0 {
+		// Keep a trace of the runs without JSON report, e.g. crashed ones, with the run record itself
+		report, _ = json.Marshal(record)
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+	if err := common.PostResults(client, common.ResultsEndpoint(k.resultsURL, record.Subcommand, source, &record.ExitCode), report); err != nil {
+		log.Printf("Unable to push the report to %s: %v", k.resultsURL, err)
+	}
+}
+
+// emit creates an event attached to the involved object. Failures are logged, they do not fail the test.
+func (k *kubeEventRecorder) emit(reason, eventType, message string) {
+	if k.kube == nil {
+		return
+	}
+	if len(message) > maxEventMessage {
+		message = message[:maxEventMessage-3] + "..."
+	}
+	now := time.Now().Format(time.RFC3339)
+	involved := map[string]interface{}{"kind": k.object.Kind, "apiVersion": k.object.APIVersion, "name": k.name}
+	if k.objectNS != "" {
+		involved["namespace"] = k.objectNS
+	}
+	event := map[string]interface{}{
+		"metadata":           map[string]interface{}{"generateName": "connectivity-test-", "namespace": k.namespace},
+		"involvedObject":     involved,
+		"reason":             reason,
+		"message":            message,
+		"type":               eventType,
+		"source":             map[string]interface{}{"component": "connectivity-client", "host": k.host},
+		"firstTimestamp":     now,
+		"lastTimestamp":      now,
+		"count":              1,
+		"reportingComponent": "connectivity-client",
+		"reportingInstance":  k.host,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := k.kube.Do(ctx, http.MethodPost, "/api/v1/namespaces/"+k.namespace+"/events", event, nil); err != nil {
+		log.Printf("Unable to emit the %s event: %v", reason, err)
+	}
+}
+
+// annotateObject records the run in the annotation of the involved object, with -events-annotate
+func (k *kubeEventRecorder) annotateObject(record TestRunRecord) {
+	if !k.annotate {
+		return
+	}
+	value, _ := json.Marshal(record)
+	patch := map[string]interface{}{
+		"metadata": map[string]interface{}{"annotations": map[string]string{testRunAnnotation: string(value)}},
+	}
+
+	path := "/api/v1"
+	if k.object.APIVersion != "v1" {
+		path = "/apis/" + k.object.APIVersion
+	}
+	if k.objectNS != "" {
+		path += "/namespaces/" + k.objectNS
+	}
+	path += "/" + k.object.Resource + "/" + k.name
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := k.kube.Do(ctx, http.MethodPatch, path, patch, nil); err != nil {
+		log.Printf("Unable to annotate %s %s: %v", k.object.Kind, k.name, err)
+	}
+}
+
+// limitedBuffer keeps the first limit bytes written to it and drops the rest, so a huge output
+// does not exhaust the memory of the client
+type limitedBuffer struct {
+	buffer *bytes.Buffer
+	limit  int
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if room := b.limit - b.buffer.Len(); room > 0 {
+		if len(p) > room {
+			b.buffer.Write(p[:room])
+		} else {
+			b.buffer.Write(p)
+		}
+	}
+	return len(p), nil
+}
@@ -0,0 +1,183 @@
+package common
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// BackendSamplesKept is the number of recent requests kept per backend for the rolling stats
+const BackendSamplesKept = 4096
+
+// latencyBucketsMs are the upper bounds of the latency histogram buckets, in milliseconds
+var latencyBucketsMs = []float64{1, 2, 5, 10, 20, 50, 100, 200, 500, 1000, 2000, 5000, 10000}
+
+// LatencyBucket represents a bucket of a latency histogram
+type LatencyBucket struct {
+	LeMs  float64 `json:"LeMs"`  // The upper bound of the bucket in milliseconds, 0 for the last bucket without bound
+	Count int     `json:"Count"` // The number of requests in the bucket, not cumulative
+}
+
+// BackendSLO represents the SLO of the backends and whether a backend meets it over the window
+type BackendSLO struct {
+	LatencyMs     float64 `json:"LatencyMs"`     // The latency objective in milliseconds, 0 for none
+	SuccessTarget float64 `json:"SuccessTarget"` // The objective of the fraction of successful requests within LatencyMs, e.g. 0.99
+	Good          float64 `json:"Good"`          // The fraction of the requests of the window that succeeded within LatencyMs
+	Met           bool    `json:"Met"`           // Indicates if Good meets SuccessTarget
+}
+
+// BackendStats represents the requests forwarded to a backend: totals since the tracker started or
+// was reset, and rolling stats over the recent requests of the window
+type BackendStats struct {
+	Backend     string `json:"Backend"`     // The backend, as host:port or the BackendUrl for dns and doh
+	ForwardType string `json:"ForwardType"` // The forward type of the requests
+	Requests    uint64 `json:"Requests"`    // The number of requests since the tracker started or was reset
+	Failures    uint64 `json:"Failures"`    // The number of failed requests since the tracker started or was reset
+	LastSeen    string `json:"LastSeen"`    // When the last request completed
+	LastError   string `json:"LastError"`   // The error message of the last failed request
+
+	WindowRequests int             `json:"WindowRequests"` // The number of requests in the window
+	SuccessRatio   float64         `json:"SuccessRatio"`   // The fraction of successful requests in the window
+	P50Ms          float64         `json:"P50Ms"`          // The median latency of the requests of the window
+	P95Ms          float64         `json:"P95Ms"`          // The 95th percentile latency of the requests of the window
+	P99Ms          float64         `json:"P99Ms"`          // The 99th percentile latency of the requests of the window
+	MaxMs          float64         `json:"MaxMs"`          // The maximum latency of the requests of the window
+	Histogram      []LatencyBucket `json:"Histogram"`      // The latency histogram of the requests of the window
+	Errors         map[string]int  `json:"Errors"`         // The failed requests of the window by ErrorCode
+	SLO            *BackendSLO     `json:"SLO,omitempty"`  // The SLO summary of the window, when an objective is set
+}
+
+// BackendReport represents the stats of all the backends of a proxy
+type BackendReport struct {
+	Since    string         `json:"Since"`    // When the tracker started or was last reset
+	Window   string         `json:"Window"`   // The duration of the rolling window
+	Backends []BackendStats `json:"Backends"` // The stats of each backend, sorted by backend and forward type
+}
+
+// backendSample is a request recorded for a backend
+type backendSample struct {
+	at        time.Time
+	latency   time.Duration
+	errorCode string // Empty for successful requests
+}
+
+// backendRecord holds the totals and the recent samples of a backend
+type backendRecord struct {
+	stats BackendStats
+	ring  []backendSample
+	next  int
+}
+
+// BackendTracker keeps rolling latency histograms and success ratios per backend
+type BackendTracker struct {
+	mutex    sync.Mutex
+	window   time.Duration
+	since    time.Time
+	backends map[string]*backendRecord
+}
+
+// NewBackendTracker creates a BackendTracker whose rolling stats cover the requests of the last window
+func NewBackendTracker(window time.Duration) *BackendTracker {
+	return &BackendTracker{window: window, since: time.Now(), backends: make(map[string]*backendRecord)}
+}
+
+// Observe records a request forwarded to a backend, with its ErrorCode if it failed
+func (t *BackendTracker) Observe(forwardType, backend string, latency time.Duration, errorCode, errorMessage string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	key := forwardType + " " + backend
+	record := t.backends[key]
+	if record == nil {
+		record = &backendRecord{stats: BackendStats{Backend: backend, ForwardType: forwardType}}
+		t.backends[key] = record
+	}
+
+	now := time.Now()
+	record.stats.Requests++
+	record.stats.LastSeen = now.Format(time.RFC3339)
+	if errorCode != "" {
+		record.stats.Failures++
+		record.stats.LastError = errorMessage
+	}
+
+	sample := backendSample{at: now, latency: latency, errorCode: errorCode}
+	if len(record.ring) < BackendSamplesKept {
+		record.ring = append(record.ring, sample)
+	} else {
+		record.ring[record.next] = sample
+		record.next = (record.next + 1) % BackendSamplesKept
+	}
+}
+
+// Report returns the stats of each backend against an optional SLO, and optionally resets the tracker
+func (t *BackendTracker) Report(slo BackendSLO, reset bool) BackendReport {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	report := BackendReport{Since: t.since.Format(time.RFC3339), Window: t.window.String(), Backends: []BackendStats{}}
+	start := time.Now().Add(-t.window)
+	for _, record := range t.backends {
+		stats := record.stats
+		stats.Errors = make(map[string]int)
+		stats.Histogram = make([]LatencyBucket, len(latencyBucketsMs)+1)
+		for i, le := range latencyBucketsMs {
+			stats.Histogram[i].LeMs = le
+		}
+
+		var latencies []time.Duration
+		successes, good := 0, 0
+		sloLatency := time.Duration(slo.LatencyMs * float64(time.Millisecond))
+		for _, sample := range record.ring {
+			if sample.at.Before(start) {
+				continue
+			}
+			latencies = append(latencies, sample.latency)
+			stats.Histogram[sort.SearchFloat64s(latencyBucketsMs, milliseconds(sample.latency))].Count++
+			if sample.errorCode != "" {
+				stats.Errors[sample.errorCode]++
+				continue
+			}
+			successes++
+			if sloLatency == 0 || sample.latency <= sloLatency {
+				good++
+			}
+		}
+
+		stats.WindowRequests = len(latencies)
+		if len(latencies) > 0 {
+			sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+			stats.SuccessRatio = float64(successes) / float64(len(latencies))
+			stats.P50Ms = milliseconds(percentile(latencies, 0.50))
+			stats.P95Ms = milliseconds(percentile(latencies, 0.95))
+			stats.P99Ms = milliseconds(percentile(latencies, 0.99))
+			stats.MaxMs = milliseconds(latencies[len(latencies)-1])
+		}
+		if slo.LatencyMs > 0 || slo.SuccessTarget > 0 {
+			summary := slo
+			if len(latencies) > 0 {
+				summary.Good = float64(good) / float64(len(latencies))
+				summary.Met = summary.Good >= slo.SuccessTarget
+			}
+			stats.SLO = &summary
+		}
+		report.Backends = append(report.Backends, stats)
+	}
+	sort.Slice(report.Backends, func(i, j int) bool {
+		if report.Backends[i].Backend != report.Backends[j].Backend {
+			return report.Backends[i].Backend < report.Backends[j].Backend
+		}
+		return report.Backends[i].ForwardType < report.Backends[j].ForwardType
+	})
+
+	if reset {
+		t.since = time.Now()
+		t.backends = make(map[string]*backendRecord)
+	}
+	return report
+}
+
+// milliseconds converts a duration to fractional milliseconds
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
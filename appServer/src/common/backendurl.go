@@ -0,0 +1,205 @@
+package common
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// defaultPorts are the ports of the backend URL schemes when the URL has none
+var defaultPorts = map[string]string{"http": "80", "https": "443"}
+
+// BackendAddress represents the host and port of a backend, as parsed from a URL or a host:port
+type BackendAddress struct {
+	Scheme      string // The scheme of the URL, empty for a host:port
+	Host        string // The host name or IP, without brackets nor zone
+	Zone        string // The zone of a link-local IPv6 literal, e.g. eth0
+	Port        string // The port, given or the default of the scheme
+	IP          net.IP // The IP of Host when it is a literal, nil for a name
+	DefaultPort bool   // Indicates if Port is the default of the scheme
+}
+
+// Hostname returns the host with its zone, as the resolver and net.Dial expect it
+func (a BackendAddress) Hostname() string {
+	if a.Zone != "" {
+		return a.Host + "%" + a.Zone
+	}
+	return a.Host
+}
+
+// Address returns the host:port to dial, with brackets for IPv6
+func (a BackendAddress) Address() string {
+	return net.JoinHostPort(a.Hostname(), a.Port)
+}
+
+// BackendURLProblem represents a component of a BackendUrl that failed the validation
+type BackendURLProblem struct {
+	Component string `json:"Component"` // scheme, host, zone, port or url
+	Value     string `json:"Value"`     // The text of the component as given
+	Message   string `json:"Message"`   // What is wrong with it
+}
+
+// BackendURLError lists the components of a BackendUrl that failed the validation
+type BackendURLError struct {
+	BackendUrl string
+	Problems   []BackendURLProblem
+}
+
+func (e *BackendURLError) Error() string {
+	problems := make([]string, 0, len(e.Problems))
+	for _, problem := range e.Problems {
+		problems = append(problems, fmt.Sprintf("%s %q: %s", problem.Component, problem.Value, problem.Message))
+	}
+	return fmt.Sprintf("invalid BackendUrl %q: %s", e.BackendUrl, strings.Join(problems, "; "))
+}
+
+// add records a problem of a component
+func (e *BackendURLError) add(component, value, format string, args ...interface{}) {
+	e.Problems = append(e.Problems, BackendURLProblem{Component: component, Value: value, Message: fmt.Sprintf(format, args...)})
+}
+
+// ParseBackendURL parses a backend URL of one of the schemes. The port defaults to the one of the
+// scheme (80 for http, 443 for https), IPv6 literals must be bracketed, and their zone is given as
+// %25<zone> as RFC 6874 requires. The error is a *BackendURLError.
+func ParseBackendURL(raw string, schemes ...string) (BackendAddress, error) {
+	problems := &BackendURLError{BackendUrl: raw}
+	scheme, rest, ok := strings.Cut(raw, "://")
+	if !ok {
+		problems.add("scheme", "", "missing, expected %s://", strings.Join(schemes, ":// or "))
+		return BackendAddress{}, problems
+	}
+	scheme = strings.ToLower(scheme)
+	known := false
+	for _, s := range schemes {
+		known = known || scheme == s
+	}
+	if !known {
+		problems.add("scheme", scheme, "unsupported, expected %s", strings.Join(schemes, " or "))
+	}
+
+	// The authority ends at the path, the query or the fragment, and may start with user info
+	authority := rest
+	if end := strings.IndexAny(rest, "/?#"); end >= 0 {
+		authority = rest[:end]
+	}
+	if at := strings.LastIndex(authority, "@"); at >= 0 {
+		authority = authority[at+1:]
+	}
+
+	address := parseHostPort(authority, defaultPorts[scheme], true, problems)
+	address.Scheme = scheme
+	if len(problems.Problems) == 0 {
+		if _, err := url.Parse(raw); err != nil {
+			problems.add("url", raw, "%v", err)
+		}
+	}
+	if len(problems.Problems) > 0 {
+		return BackendAddress{}, problems
+	}
+	return address, nil
+}
+
+// ParseBackendHostPort parses a backend given as host:port, or as [IPv6]:port with an optional
+// %<zone> or %25<zone>. Without a port, defaultPort is used, and a port is required when it is
+// empty. The error is a *BackendURLError.
+func ParseBackendHostPort(raw, defaultPort string) (BackendAddress, error) {
+	problems := &BackendURLError{BackendUrl: raw}
+	address := parseHostPort(raw, defaultPort, false, problems)
+	if len(problems.Problems) > 0 {
+		return BackendAddress{}, problems
+	}
+	return address, nil
+}
+
+// parseHostPort parses the host and the optional port of an authority, recording its problems.
+// In a URL, the zone of an IPv6 literal must be escaped as %25<zone>.
+func parseHostPort(authority, defaultPort string, inURL bool, problems *BackendURLError) BackendAddress {
+	var address BackendAddress
+	host, port, hasPort, portReported := authority, "", false, false
+
+	if strings.HasPrefix(authority, "[") {
+		end := strings.Index(authority, "]")
+		if end < 0 {
+			problems.add("host", authority, "missing ']' closing the IPv6 literal")
+			return address
+		}
+		host = authority[1:end]
+		if after := authority[end+1:]; after != "" && !strings.HasPrefix(after, ":") {
+			problems.add("port", after, "unexpected text after the IPv6 literal, expected :<port>")
+			portReported = true
+		} else if after != "" {
+			port, hasPort = after[1:], true
+		}
+		if i := strings.Index(host, "%"); i >= 0 {
+			zone := host[i:]
+			host, address.Zone = host[:i], strings.TrimPrefix(zone[1:], "25")
+			switch {
+			case inURL && !strings.HasPrefix(zone, "%25"):
+				problems.add("zone", zone, "the '%%' of the zone must be escaped as %%25 in a URL, e.g. %%25eth0")
+			case address.Zone == "" || strings.ContainsAny(address.Zone, "%[]/ "):
+				problems.add("zone", zone, "invalid IPv6 zone, expected e.g. %%25eth0")
+			}
+		}
+		if ip := net.ParseIP(host); ip == nil || ip.To4() != nil || !strings.Contains(host, ":") {
+			problems.add("host", host, "not an IPv6 address, only IPv6 literals are bracketed")
+		} else {
+			address.IP = ip
+		}
+	} else {
+		switch strings.Count(authority, ":") {
+		case 0:
+		case 1:
+			host, port, _ = strings.Cut(authority, ":")
+			hasPort = true
+		default:
+			problems.add("host", authority, "IPv6 literals must be bracketed, e.g. [fd00::1]:8080")
+			return address
+		}
+		if strings.Contains(host, "%") {
+			problems.add("zone", host, "zones are only valid in bracketed IPv6 literals, e.g. [fe80::1%%25eth0]")
+		} else if host == "" {
+			problems.add("host", host, "missing")
+		} else if ip := net.ParseIP(host); ip != nil {
+			address.IP = ip
+		} else if err := validateHostName(host); err != nil {
+			problems.add("host", host, "%v", err)
+		}
+	}
+	address.Host = host
+
+	switch {
+	case portReported:
+	case hasPort && port == "":
+		problems.add("port", port, "empty after ':'")
+	case !hasPort && defaultPort == "":
+		problems.add("port", "", "missing, expected host:port")
+	case !hasPort:
+		address.Port, address.DefaultPort = defaultPort, true
+	default:
+		if number, err := strconv.Atoi(port); err != nil || number < 1 || number > 65535 {
+			problems.add("port", port, "not a port number between 1 and 65535")
+		}
+		address.Port = port
+	}
+	return address
+}
+
+// validateHostName checks a DNS name: dot-separated labels of letters, digits, '-' and '_'
+func validateHostName(host string) error {
+	if len(host) > 253 {
+		return fmt.Errorf("longer than 253 characters")
+	}
+	for _, label := range strings.Split(strings.TrimSuffix(host, "."), ".") {
+		if label == "" || len(label) > 63 {
+			return fmt.Errorf("empty label or label longer than 63 characters")
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return fmt.Errorf("invalid character %q in a host name", c)
+			}
+		}
+	}
+	return nil
+}
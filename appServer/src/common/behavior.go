@@ -0,0 +1,156 @@
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// BehaviorConfig represents the behavior settings of an echo server, as written in its config
+// file, e.g. a key of a ConfigMap mounted in the pod
+type BehaviorConfig struct {
+	Delay       string            `json:"Delay"`       // The delay added before each response, e.g. 100ms
+	DelayJitter string            `json:"DelayJitter"` // A random extra delay up to this duration, e.g. 50ms
+	ErrorRate   float64           `json:"ErrorRate"`   // The fraction of the requests answered with an error, from 0 to 1
+	ErrorStatus int               `json:"ErrorStatus"` // The status code of the HTTP errors (default is 503)
+	Headers     map[string]string `json:"Headers"`     // The headers added to the HTTP responses
+}
+
+// Behavior represents the behavior settings in effect, and the generation of the config they
+// come from
+type Behavior struct {
+	Generation uint64         `json:"Generation"` // The generation of the config, incremented on each reload, 0 without config
+	Source     string         `json:"Source"`     // The config file
+	LoadedAt   string         `json:"LoadedAt"`   // When the config was loaded
+	Config     BehaviorConfig `json:"Config"`     // The settings, with their defaults filled in
+
+	delay       time.Duration
+	delayJitter time.Duration
+}
+
+// NextDelay returns the delay of a response, with its random jitter
+func (b *Behavior) NextDelay() time.Duration {
+	delay := b.delay
+	if b.delayJitter > 0 {
+		delay += time.Duration(rand.Int63n(int64(b.delayJitter) + 1))
+	}
+	return delay
+}
+
+// InjectError tells whether a request is answered with an error, according to the error rate
+func (b *Behavior) InjectError() bool {
+	return b.Config.ErrorRate > 0 && rand.Float64() < b.Config.ErrorRate
+}
+
+// BehaviorProvider holds the behavior settings of the config file of a server and reloads them
+// when the file changes. A nil provider, for servers started without config, returns the default
+// behavior of generation 0.
+//
+// The file is polled instead of watched with inotify: a ConfigMap mount is updated by swapping a
+// symlink of its directory, which inotify watches on the file itself miss, and polling needs no
+// dependency. Each reload swaps the whole Behavior at once, so a request never sees a mix of two
+// generations; an invalid new config is logged and the previous one stays in effect.
+type BehaviorProvider struct {
+	path       string
+	current    atomic.Pointer[Behavior]
+	content    []byte // The content of the config in effect
+	rejected   []byte // The content of the last invalid config, reported once
+	generation uint64
+}
+
+// defaultBehavior is the behavior of servers without config
+var defaultBehavior = &Behavior{Config: BehaviorConfig{ErrorStatus: 503}}
+
+// NewBehaviorProvider loads the config file, which must be valid
+func NewBehaviorProvider(path string) (*BehaviorProvider, error) {
+	p := &BehaviorProvider{path: path}
+	if _, err := p.Reload(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Get returns the behavior in effect
+func (p *BehaviorProvider) Get() *Behavior {
+	if p == nil {
+		return defaultBehavior
+	}
+	return p.current.Load()
+}
+
+// Reload reads the config file again and applies it when its content changed. It returns
+// whether a new generation was applied, and reports an invalid content only the first time. Reload is not safe for concurrent use, Watch calls it
+// from a single goroutine.
+func (p *BehaviorProvider) Reload() (bool, error) {
+	data, err := os.ReadFile(p.path)
+	if err != nil {
+		return false, err
+	}
+	if (p.content != nil && bytes.Equal(data, p.content)) || (p.rejected != nil && bytes.Equal(data, p.rejected)) {
+		return false, nil
+	}
+
+	behavior, err := parseBehavior(data)
+	if err != nil {
+		p.rejected = data
+		return false, fmt.Errorf("invalid config %s: %v", p.path, err)
+	}
+	p.content = data
+	p.generation++
+	behavior.Generation = p.generation
+	behavior.Source = p.path
+	behavior.LoadedAt = time.Now().Format(time.RFC3339)
+	p.current.Store(behavior)
+
+	log.Printf("Loaded config generation %d from %s: %s", behavior.Generation, p.path, bytes.TrimSpace(data))
+	return true, nil
+}
+
+// Watch polls the config file at interval and reloads it when it changes
+func (p *BehaviorProvider) Watch(interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			if _, err := p.Reload(); err != nil {
+				log.Printf("Keeping config generation %d: %v", p.Get().Generation, err)
+			}
+		}
+	}()
+}
+
+// parseBehavior validates a config and resolves its settings
+func parseBehavior(data []byte) (*Behavior, error) {
+	var config BehaviorConfig
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&config); err != nil {
+		return nil, err
+	}
+
+	behavior := &Behavior{Config: config}
+	var err error
+	if config.Delay != "" {
+		if behavior.delay, err = time.ParseDuration(config.Delay); err != nil || behavior.delay < 0 {
+			return nil, fmt.Errorf("invalid Delay %q", config.Delay)
+		}
+	}
+	if config.DelayJitter != "" {
+		if behavior.delayJitter, err = time.ParseDuration(config.DelayJitter); err != nil || behavior.delayJitter < 0 {
+			return nil, fmt.Errorf("invalid DelayJitter %q", config.DelayJitter)
+		}
+	}
+	if config.ErrorRate < 0 || config.ErrorRate > 1 {
+		return nil, fmt.Errorf("invalid ErrorRate %v, it must be between 0 and 1", config.ErrorRate)
+	}
+	if config.ErrorStatus == 0 {
+		behavior.Config.ErrorStatus = 503
+	}
+	if status := behavior.Config.ErrorStatus; status < 400 || status > 599 {
+		return nil, fmt.Errorf("invalid ErrorStatus %d, it must be between 400 and 599", status)
+	}
+	return behavior, nil
+}
@@ -0,0 +1,231 @@
+package common
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// cgroupRoot is where the cgroup filesystems are mounted
+const cgroupRoot = "/sys/fs/cgroup"
+
+// CgroupResources represents the CPU and memory limits of the container and their current usage, so
+// performance differences observed in tests can be attributed to throttling rather than the network.
+// The counters are cumulative since the cgroup was created, compare two responses to get a rate.
+type CgroupResources struct {
+	CgroupVersion         int     `json:"CgroupVersion"`         // 1 or 2, 0 if no cgroup was found
+	CPULimitCores         float64 `json:"CPULimitCores"`         // The CPU quota in cores, 0 for no limit
+	CPUUsageSeconds       float64 `json:"CPUUsageSeconds"`       // The CPU time consumed by the cgroup
+	CPUPeriods            int64   `json:"CPUPeriods"`            // The enforcement periods of the quota that elapsed
+	ThrottledPeriods      int64   `json:"ThrottledPeriods"`      // The periods in which the cgroup was throttled
+	ThrottledSeconds      float64 `json:"ThrottledSeconds"`      // The time the cgroup was throttled
+	MemoryLimitBytes      int64   `json:"MemoryLimitBytes"`      // The memory limit, 0 for no limit
+	MemoryUsageBytes      int64   `json:"MemoryUsageBytes"`      // The memory usage, including the page cache
+	MemoryWorkingSetBytes int64   `json:"MemoryWorkingSetBytes"` // The usage without the inactive page cache, as the kubelet computes it
+	OOMKills              int64   `json:"OOMKills"`              // The processes of the cgroup killed by the OOM killer
+	GOMAXPROCS            int     `json:"GOMAXPROCS"`            // The processors of the Go scheduler, which may exceed CPULimitCores
+	ErrorMessage          string  `json:"ErrorMessage"`          // Why part of the resources could not be read, if any
+}
+
+// ReadCgroupResources reads the limits and usage of the cgroup of the process, from cgroup v2 or
+// from the cpu, cpuacct and memory controllers of cgroup v1
+func ReadCgroupResources() *CgroupResources {
+	resources := &CgroupResources{GOMAXPROCS: runtime.GOMAXPROCS(0)}
+	paths, err := cgroupPaths()
+	if err != nil {
+		resources.ErrorMessage = err.Error()
+		return resources
+	}
+
+	var errs []string
+	if path, ok := paths[""]; ok {
+		resources.CgroupVersion = 2
+		errs = readCgroupV2(resources, cgroupDir(cgroupRoot, path))
+	} else {
+		resources.CgroupVersion = 1
+		errs = readCgroupV1(resources, paths)
+	}
+	if len(errs) > 0 {
+		resources.ErrorMessage = fmt.Sprint(errs)
+	}
+	return resources
+}
+
+// cgroupPaths returns the cgroup path of the process per controller from /proc/self/cgroup, the
+// unified hierarchy of cgroup v2 being the "" controller. It only counts when it is mounted, hybrid
+// hosts list it even when the controllers are all in cgroup v1.
+func cgroupPaths() (map[string]string, error) {
+	data, err := os.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return nil, err
+	}
+	_, statErr := os.Stat(filepath.Join(cgroupRoot, "cgroup.controllers"))
+	unified := statErr == nil
+
+	paths := make(map[string]string)
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		// hierarchy-ID:controller-list:cgroup-path
+		fields := strings.SplitN(line, ":", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		if fields[1] == "" {
+			if unified {
+				paths[""] = fields[2]
+			}
+			continue
+		}
+		for _, controller := range strings.Split(fields[1], ",") {
+			paths[controller] = fields[2]
+		}
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no cgroup found in /proc/self/cgroup")
+	}
+	return paths, nil
+}
+
+// cgroupDir returns the directory of a cgroup path under a mount. Without a cgroup namespace, the
+// path is the one of the host, while the container only sees its own cgroup at the mount root.
+func cgroupDir(mount, path string) string {
+	dir := filepath.Join(mount, path)
+	if _, err := os.Stat(dir); err != nil {
+		return mount
+	}
+	return dir
+}
+
+// readCgroupV2 reads the cpu and memory files of a cgroup v2 directory
+func readCgroupV2(resources *CgroupResources, dir string) []string {
+	var errs []string
+	// cpu.max is "<quota> <period>", the quota being "max" without limit
+	if fields, err := readCgroupFields(filepath.Join(dir, "cpu.max")); err != nil {
+		errs = append(errs, err.Error())
+	} else if len(fields) == 2 && fields[0] != "max" {
+		quota, _ := strconv.ParseFloat(fields[0], 64)
+		period, _ := strconv.ParseFloat(fields[1], 64)
+		if period > 0 {
+			resources.CPULimitCores = quota / period
+		}
+	}
+	if stat, err := readCgroupStat(filepath.Join(dir, "cpu.stat")); err != nil {
+		errs = append(errs, err.Error())
+	} else {
+		resources.CPUUsageSeconds = float64(stat["usage_usec"]) / 1e6
+		resources.CPUPeriods = stat["nr_periods"]
+		resources.ThrottledPeriods = stat["nr_throttled"]
+		resources.ThrottledSeconds = float64(stat["throttled_usec"]) / 1e6
+	}
+
+	if fields, err := readCgroupFields(filepath.Join(dir, "memory.max")); err != nil {
+		errs = append(errs, err.Error())
+	} else if len(fields) == 1 && fields[0] != "max" {
+		resources.MemoryLimitBytes, _ = strconv.ParseInt(fields[0], 10, 64)
+	}
+	if value, err := readCgroupInt(filepath.Join(dir, "memory.current")); err != nil {
+		errs = append(errs, err.Error())
+	} else {
+		resources.MemoryUsageBytes = value
+	}
+	if stat, err := readCgroupStat(filepath.Join(dir, "memory.stat")); err == nil {
+		resources.MemoryWorkingSetBytes = max(0, resources.MemoryUsageBytes-stat["inactive_file"])
+	}
+	if events, err := readCgroupStat(filepath.Join(dir, "memory.events")); err == nil {
+		resources.OOMKills = events["oom_kill"]
+	}
+	return errs
+}
+
+// readCgroupV1 reads the files of the cpu, cpuacct and memory controllers of cgroup v1
+func readCgroupV1(resources *CgroupResources, paths map[string]string) []string {
+	var errs []string
+	// The cpu and cpuacct controllers are usually co-mounted as cpu,cpuacct, with cpu and cpuacct links
+	cpuDir := cgroupDir(filepath.Join(cgroupRoot, "cpu"), paths["cpu"])
+	quota, err := readCgroupInt(filepath.Join(cpuDir, "cpu.cfs_quota_us"))
+	if err != nil {
+		errs = append(errs, err.Error())
+	} else if period, err := readCgroupInt(filepath.Join(cpuDir, "cpu.cfs_period_us")); err == nil && quota > 0 && period > 0 {
+		resources.CPULimitCores = float64(quota) / float64(period)
+	}
+	if stat, err := readCgroupStat(filepath.Join(cpuDir, "cpu.stat")); err != nil {
+		errs = append(errs, err.Error())
+	} else {
+		resources.CPUPeriods = stat["nr_periods"]
+		resources.ThrottledPeriods = stat["nr_throttled"]
+		resources.ThrottledSeconds = float64(stat["throttled_time"]) / 1e9
+	}
+	cpuacctDir := cgroupDir(filepath.Join(cgroupRoot, "cpuacct"), paths["cpuacct"])
+	if usage, err := readCgroupInt(filepath.Join(cpuacctDir, "cpuacct.usage")); err != nil {
+		errs = append(errs, err.Error())
+	} else {
+		resources.CPUUsageSeconds = float64(usage) / 1e9
+	}
+
+	memoryDir := cgroupDir(filepath.Join(cgroupRoot, "memory"), paths["memory"])
+	// Without limit, memory.limit_in_bytes is the largest multiple of the page size
+	if limit, err := readCgroupInt(filepath.Join(memoryDir, "memory.limit_in_bytes")); err != nil {
+		errs = append(errs, err.Error())
+	} else if limit < 1<<62 {
+		resources.MemoryLimitBytes = limit
+	}
+	if usage, err := readCgroupInt(filepath.Join(memoryDir, "memory.usage_in_bytes")); err != nil {
+		errs = append(errs, err.Error())
+	} else {
+		resources.MemoryUsageBytes = usage
+	}
+	if stat, err := readCgroupStat(filepath.Join(memoryDir, "memory.stat")); err == nil {
+		resources.MemoryWorkingSetBytes = max(0, resources.MemoryUsageBytes-stat["total_inactive_file"])
+	}
+	if control, err := readCgroupStat(filepath.Join(memoryDir, "memory.oom_control")); err == nil {
+		resources.OOMKills = control["oom_kill"]
+	}
+	return errs
+}
+
+// readCgroupFields returns the fields of a single line cgroup file
+func readCgroupFields(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return strings.Fields(string(data)), nil
+}
+
+// readCgroupInt reads a cgroup file holding a single integer
+func readCgroupInt(path string) (int64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	value, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value in %s: %v", path, err)
+	}
+	return value, nil
+}
+
+// readCgroupStat reads a cgroup file of "<key> <value>" lines, such as cpu.stat or memory.stat
+func readCgroupStat(path string) (map[string]int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	stat := make(map[string]int64)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		if value, err := strconv.ParseInt(fields[1], 10, 64); err == nil {
+			stat[fields[0]] = value
+		}
+	}
+	return stat, scanner.Err()
+}
@@ -65,3 +65,108 @@ func GetEnvironmentVariables(envPrefix string) map[string]string {
 	}
 	return envVars
 }
+
+// NewHeaderStats measures all the values of the given headers
+func NewHeaderStats(header http.Header) HeaderStats {
+	stats := HeaderStats{Names: len(header)}
+	for name, values := range header {
+		for _, value := range values {
+			size := len(name) + len(value) + 4
+			stats.Values++
+			stats.TotalBytes += size
+			if size > stats.LargestBytes {
+				stats.LargestName, stats.LargestBytes = name, size
+			}
+		}
+	}
+	return stats
+}
+
+// ParseCIDRList parses a comma separated list of CIDRs or IPs, an IP being a network of its own
+func ParseCIDRList(list string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP %q", item)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// MatchCIDRList returns the first network of the list containing the IP, nil if none does
+func MatchCIDRList(networks []*net.IPNet, ip net.IP) *net.IPNet {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return network
+		}
+	}
+	return nil
+}
+
+// Middleware wraps an HTTP handler with a behavior shared by all the handlers of a server, such as
+// authentication, rate limiting or recording the requests
+type Middleware func(http.Handler) http.Handler
+
+// Chain is the ordered list of middlewares applied to all the handlers of a server. The first one
+// is the outermost: it sees the request first and the response last. Nil middlewares, e.g. options
+// that are disabled, are skipped, and so are middlewares returning their handler as is.
+type Chain []Middleware
+
+// NewChain returns a chain of the given middlewares, the outermost first
+func NewChain(middlewares ...Middleware) Chain {
+	return Chain(middlewares)
+}
+
+// Append returns a new chain running the given middlewares inside the ones of c
+func (c Chain) Append(middlewares ...Middleware) Chain {
+	chain := make(Chain, 0, len(c)+len(middlewares))
+	return append(append(chain, c...), middlewares...)
+}
+
+// Then wraps handler with the middlewares of the chain
+func (c Chain) Then(handler http.Handler) http.Handler {
+	for i := len(c) - 1; i >= 0; i-- {
+		if c[i] != nil {
+			handler = c[i](handler)
+		}
+	}
+	return handler
+}
+
+// Except applies a middleware to all the requests but the ones of the given paths, which go
+// straight to the next handler, e.g. to keep /healthy or /status available
+func Except(middleware Middleware, paths ...string) Middleware {
+	if middleware == nil {
+		return nil
+	}
+	return func(next http.Handler) http.Handler {
+		wrapped := middleware(next)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for _, path := range paths {
+				if r.URL.Path == path {
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+			wrapped.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,84 @@
+package common
+
+import (
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+// RequestCost represents the server side cost of handling one request
+type RequestCost struct {
+	CPUMicros    int64  `json:"CPUMicros"`    // The CPU time (user and system) of the thread handling the request, -1 if unknown
+	AllocBytes   uint64 `json:"AllocBytes"`   // The heap bytes allocated while handling the request
+	AllocObjects uint64 `json:"AllocObjects"` // The heap objects allocated while handling the request
+	Overlapped   bool   `json:"Overlapped"`   // Indicates if other measured requests ran at the same time, so the allocations include theirs
+}
+
+// costMeasurements counts the measurements started, and costInFlight the ones still running, to
+// detect the overlapping ones
+var costMeasurements, costInFlight atomic.Int64
+
+// CostMeter measures the processing time of a request and, when detailed, its CPU time and heap
+// allocations.
+//
+// The CPU time is the one of the OS thread running the request, which the goroutine is locked to
+// while measuring. The allocations are read from the process wide counters of runtime.ReadMemStats,
+// so they are only exact for requests that do not overlap with other measured ones; Overlapped flags
+// the others. ReadMemStats briefly stops the world, which is why the detailed meter is optional.
+type CostMeter struct {
+	start    time.Time
+	detailed bool
+	stopped  bool
+
+	cpuStart    time.Duration
+	cpuOK       bool
+	memStart    runtime.MemStats
+	measurement int64
+	overlapped  bool
+}
+
+// StartCostMeter starts measuring the request handled by the calling goroutine. A detailed meter
+// must be stopped by the same goroutine.
+func StartCostMeter(detailed bool) *CostMeter {
+	m := &CostMeter{start: time.Now(), detailed: detailed}
+	if !detailed {
+		return m
+	}
+
+	m.measurement = costMeasurements.Add(1)
+	m.overlapped = costInFlight.Add(1) > 1
+	runtime.ReadMemStats(&m.memStart)
+
+	runtime.LockOSThread()
+	m.cpuStart, m.cpuOK = ThreadCPUTime()
+	return m
+}
+
+// Stop returns the processing time since the meter started and, for a detailed meter, the cost
+// of the request. Only the first call measures, later ones return zero values.
+func (m *CostMeter) Stop() (time.Duration, *RequestCost) {
+	if m.stopped {
+		return 0, nil
+	}
+	m.stopped = true
+	elapsed := time.Since(m.start)
+	if !m.detailed {
+		return elapsed, nil
+	}
+
+	cost := &RequestCost{CPUMicros: -1}
+	if cpuEnd, ok := ThreadCPUTime(); ok && m.cpuOK {
+		cost.CPUMicros = (cpuEnd - m.cpuStart).Microseconds()
+	}
+	runtime.UnlockOSThread()
+
+	var memEnd runtime.MemStats
+	runtime.ReadMemStats(&memEnd)
+	cost.AllocBytes = memEnd.TotalAlloc - m.memStart.TotalAlloc
+	cost.AllocObjects = memEnd.Mallocs - m.memStart.Mallocs
+
+	// Another measurement started after this one, or was still running when it started
+	cost.Overlapped = m.overlapped || costMeasurements.Load() != m.measurement
+	costInFlight.Add(-1)
+	return elapsed, cost
+}
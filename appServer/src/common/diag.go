@@ -0,0 +1,298 @@
+package common
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// RecentRequestsKept is the number of recent requests kept by the servers for their diagnostic bundle
+const RecentRequestsKept = 100
+
+// RecentRequest represents one request kept in the ring buffer of the diagnostic bundle
+type RecentRequest struct {
+	Time       string  `json:"Time"`       // When the request arrived
+	Client     string  `json:"Client"`     // The address of the client
+	Request    string  `json:"Request"`    // A summary of the request, e.g. "GET /stream" or the size of a datagram
+	Status     string  `json:"Status"`     // How the request ended, e.g. the HTTP status code
+	DurationMs float64 `json:"DurationMs"` // The time taken to handle the request
+}
+
+// DiagnosticBundle represents the state of a server captured with SIGQUIT or its dump endpoint,
+// to investigate hangs that are hard to reproduce
+type DiagnosticBundle struct {
+	Time           string                 `json:"Time"`           // When the bundle was captured
+	ServerType     string                 `json:"ServerType"`     // The type of server (http, udp or proxy)
+	Identity       Identity               `json:"Identity"`       // The identity of the server
+	Uptime         string                 `json:"Uptime"`         // How long the server has been running
+	Config         map[string]string      `json:"Config"`         // The command-line flags, with their defaults when not set and the secret ones redacted
+	Counters       map[string]interface{} `json:"Counters"`       // The counters of the server, e.g. the request counter
+	Resources      ResourceStatus         `json:"Resources"`      // The goroutines, file descriptors and socket states of the process
+	RecentRequests []RecentRequest        `json:"RecentRequests"` // The last requests, oldest first
+	Goroutines     string                 `json:"Goroutines"`     // The stacks of all goroutines
+}
+
+// Diagnostics keeps the recent requests of a server and captures its diagnostic bundle
+type Diagnostics struct {
+	serverType string
+	started    time.Time
+	counters   func() map[string]interface{}
+	identity   *IdentityProvider
+	guard      *ResourceGuard
+	dir        string // The directory of the dumped files
+
+	mutex  sync.Mutex
+	recent []RecentRequest
+	next   int // The position of the next request in recent once it is full
+	size   int
+
+	secrets map[string]bool // The flags whose values are redacted from the bundles, guarded by mutex
+}
+
+// NewDiagnostics creates the diagnostics of a server, keeping its last size requests and dumping
+// the bundles to files in dir (default is the temporary directory). counters returns the counters
+// of the server at capture time, identity and guard may be nil.
+func NewDiagnostics(serverType string, size int, dir string, counters func() map[string]interface{}, identity *IdentityProvider, guard *ResourceGuard) *Diagnostics {
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	return &Diagnostics{
+		serverType: serverType,
+		started:    time.Now(),
+		counters:   counters,
+		identity:   identity,
+		guard:      guard,
+		dir:        dir,
+		size:       size,
+	}
+}
+
+// RedactFlags hides the values of the named flags, e.g. tokens, from the bundles. A set flag
+// is reported as <redacted>, so the bundle still tells whether it was set.
+func (d *Diagnostics) RedactFlags(names ...string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.secrets == nil {
+		d.secrets = make(map[string]bool)
+	}
+	for _, name := range names {
+		d.secrets[name] = true
+	}
+}
+
+// Record adds a request to the ring buffer, replacing the oldest one when it is full
+func (d *Diagnostics) Record(request RecentRequest) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.size <= 0 {
+		return
+	}
+	if len(d.recent) < d.size {
+		d.recent = append(d.recent, request)
+		return
+	}
+	d.recent[d.next] = request
+	d.next = (d.next + 1) % d.size
+}
+
+// Bundle captures the diagnostic bundle of the server
+func (d *Diagnostics) Bundle() DiagnosticBundle {
+	bundle := DiagnosticBundle{
+		Time:       time.Now().Format(time.RFC3339Nano),
+		ServerType: d.serverType,
+		Uptime:     time.Since(d.started).Round(time.Second).String(),
+		Config:     make(map[string]string),
+		Goroutines: goroutineStacks(),
+	}
+	if d.identity != nil {
+		bundle.Identity = d.identity.Get()
+	}
+	d.mutex.Lock()
+	flag.VisitAll(func(f *flag.Flag) {
+		bundle.Config[f.Name] = f.Value.String()
+		if d.secrets[f.Name] && bundle.Config[f.Name] != "" {
+			bundle.Config[f.Name] = "<redacted>"
+		}
+	})
+	d.mutex.Unlock()
+	if d.counters != nil {
+		bundle.Counters = d.counters()
+	}
+	guard := d.guard
+	if guard == nil {
+		guard = NewResourceGuard(0, 0)
+	}
+	bundle.Resources = guard.Status()
+
+	d.mutex.Lock()
+	bundle.RecentRequests = append(append([]RecentRequest{}, d.recent[d.next:]...), d.recent[:d.next]...)
+	d.mutex.Unlock()
+	return bundle
+}
+
+// goroutineStacks returns the stacks of all goroutines, growing the buffer until they fit
+func goroutineStacks() string {
+	buf := make([]byte, 1<<20)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) || len(buf) >= 64<<20 {
+			return string(buf[:n])
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+}
+
+// DumpOnQuit writes the diagnostic bundle to a file whenever the process receives SIGQUIT,
+// instead of the default of printing the stacks and exiting
+func (d *Diagnostics) DumpOnQuit() {
+	quits := make(chan os.Signal, 1)
+	signal.Notify(quits, syscall.SIGQUIT)
+	go func() {
+		for range quits {
+			path, err := d.DumpToFile()
+			if err != nil {
+				log.Printf("Unable to write the diagnostic bundle: %v", err)
+				continue
+			}
+			log.Printf("Wrote the diagnostic bundle to %s", path)
+		}
+	}()
+}
+
+// DumpToFile writes the diagnostic bundle to a new JSON file in the dump directory and returns its path
+func (d *Diagnostics) DumpToFile() (string, error) {
+	data, err := json.MarshalIndent(d.Bundle(), "", "  ")
+	if err != nil {
+		return "", err
+	}
+	name := fmt.Sprintf("%s-diag-%d-%s.json", d.serverType, os.Getpid(), time.Now().Format("20060102-150405.000"))
+	path := filepath.Join(d.dir, name)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// ServeHTTP sends the diagnostic bundle, or writes it to a file in the dump directory with ?file=true
+func (d *Diagnostics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("file") == "true" {
+		path, err := d.DumpToFile()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Unable to write the diagnostic bundle: %v", err), http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(path + "\n"))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(d.Bundle())
+}
+
+// Recorder wraps an HTTP handler to add each request to the ring buffer once it completes
+func (d *Diagnostics) Recorder(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &StatusRecorder{ResponseWriter: w}
+		completed := false
+		// Deferred, so handlers aborted with a panic (e.g. http.ErrAbortHandler) are recorded too
+		defer func() {
+			status := "no response"
+			switch {
+			case recorder.hijacked:
+				status = "hijacked"
+			case !completed:
+				status = "aborted"
+			case recorder.status != 0:
+				status = fmt.Sprintf("%d", recorder.status)
+			}
+			d.Record(RecentRequest{
+				Time:       start.Format(time.RFC3339Nano),
+				Client:     r.RemoteAddr,
+				Request:    r.Method + " " + r.URL.RequestURI() + " " + r.Proto,
+				Status:     status,
+				DurationMs: float64(time.Since(start).Microseconds()) / 1000,
+			})
+		}()
+		next.ServeHTTP(recorder, r)
+		completed = true
+	})
+}
+
+// StatusRecorder records the final status code of a response. It keeps the Flusher and Hijacker
+// of the wrapped ResponseWriter available to the handlers.
+type StatusRecorder struct {
+	http.ResponseWriter
+	status   int
+	bytes    int64 // The size of the body written
+	hijacked bool
+}
+
+func (s *StatusRecorder) WriteHeader(code int) {
+	// Informational responses such as 103 Early Hints precede the final one
+	if s.status == 0 && code >= 200 {
+		s.status = code
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *StatusRecorder) Write(data []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	n, err := s.ResponseWriter.Write(data)
+	s.bytes += int64(n)
+	return n, err
+}
+
+func (s *StatusRecorder) Flush() {
+	if flusher, ok := s.ResponseWriter.(http.Flusher); ok {
+		if s.status == 0 {
+			s.status = http.StatusOK
+		}
+		flusher.Flush()
+	}
+}
+
+func (s *StatusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := s.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("the response does not support hijacking")
+	}
+	s.hijacked = true
+	return hijacker.Hijack()
+}
+
+// Unwrap gives http.ResponseController access to the wrapped ResponseWriter
+func (s *StatusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// Status returns the final status code of the response, 0 until the handler writes one
+func (s *StatusRecorder) Status() int {
+	return s.status
+}
+
+// Bytes returns the size of the body written
+func (s *StatusRecorder) Bytes() int64 {
+	return s.bytes
+}
+
+// Hijacked indicates if the handler took over the connection
+func (s *StatusRecorder) Hijacked() bool {
+	return s.hijacked
+}
@@ -0,0 +1,332 @@
+package common
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// DNS record types supported by the minimal DNS codec below
+const (
+	DNSTypeA     uint16 = 1
+	DNSTypeNS    uint16 = 2
+	DNSTypeCNAME uint16 = 5
+	DNSTypeSOA   uint16 = 6
+	DNSTypePTR   uint16 = 12
+	DNSTypeTXT   uint16 = 16
+	DNSTypeAAAA  uint16 = 28
+	DNSTypeSRV   uint16 = 33
+)
+
+var dnsTypeNames = map[uint16]string{
+	DNSTypeA:     "A",
+	DNSTypeNS:    "NS",
+	DNSTypeCNAME: "CNAME",
+	DNSTypeSOA:   "SOA",
+	DNSTypePTR:   "PTR",
+	DNSTypeTXT:   "TXT",
+	DNSTypeAAAA:  "AAAA",
+	DNSTypeSRV:   "SRV",
+}
+
+var dnsRcodeNames = map[int]string{
+	0: "NOERROR",
+	1: "FORMERR",
+	2: "SERVFAIL",
+	3: "NXDOMAIN",
+	4: "NOTIMP",
+	5: "REFUSED",
+}
+
+// DNSTypeName returns the name of a DNS record type, e.g. "AAAA"
+func DNSTypeName(qtype uint16) string {
+	if name, ok := dnsTypeNames[qtype]; ok {
+		return name
+	}
+	return fmt.Sprintf("TYPE%d", qtype)
+}
+
+// DNSTypeFromName returns the DNS record type of a name such as "AAAA"
+func DNSTypeFromName(name string) (uint16, error) {
+	for qtype, typeName := range dnsTypeNames {
+		if strings.EqualFold(typeName, name) {
+			return qtype, nil
+		}
+	}
+	return 0, fmt.Errorf("unsupported DNS type %q", name)
+}
+
+// DNSRcodeName returns the name of a DNS response code, e.g. "NXDOMAIN"
+func DNSRcodeName(rcode int) string {
+	if name, ok := dnsRcodeNames[rcode]; ok {
+		return name
+	}
+	return fmt.Sprintf("RCODE%d", rcode)
+}
+
+// DNSQuestion represents the question section of a DNS message
+type DNSQuestion struct {
+	Name  string `json:"Name"` // The queried name
+	Type  string `json:"Type"` // The queried record type
+	QType uint16 `json:"-"`    // The numeric record type
+	Class uint16 `json:"-"`    // The query class, usually IN
+}
+
+// DNSAnswer represents a resource record of a DNS response
+type DNSAnswer struct {
+	Name string `json:"Name"` // The owner name of the record
+	Type string `json:"Type"` // The record type
+	TTL  uint32 `json:"TTL"`  // The TTL of the record in seconds
+	Data string `json:"Data"` // The record data in presentation format
+}
+
+// DNSMessage represents a decoded DNS message
+type DNSMessage struct {
+	ID        uint16        `json:"ID"`        // The message ID
+	Response  bool          `json:"Response"`  // Indicates if the message is a response
+	Rcode     string        `json:"Rcode"`     // The response code
+	Truncated bool          `json:"Truncated"` // Indicates if the TC bit is set
+	Questions []DNSQuestion `json:"Questions"` // The question section
+	Answers   []DNSAnswer   `json:"Answers"`   // The answer section
+}
+
+// NewDNSQueryID returns a random DNS message ID, so spoofed replies cannot guess it
+func NewDNSQueryID() uint16 {
+	var id [2]byte
+	rand.Read(id[:])
+	return binary.BigEndian.Uint16(id[:])
+}
+
+// RepliesTo reports whether m is a reply to query: the same ID and the same question
+func (m *DNSMessage) RepliesTo(query *DNSMessage) bool {
+	if !m.Response || m.ID != query.ID || len(m.Questions) != len(query.Questions) {
+		return false
+	}
+	for i, question := range query.Questions {
+		reply := m.Questions[i]
+		if !strings.EqualFold(reply.Name, question.Name) || reply.QType != question.QType || reply.Class != question.Class {
+			return false
+		}
+	}
+	return true
+}
+
+// BuildDNSQuery encodes a recursive DNS query for name and qtype
+func BuildDNSQuery(id uint16, name string, qtype uint16) ([]byte, error) {
+	msg := make([]byte, 12, 512)
+	binary.BigEndian.PutUint16(msg[0:2], id)
+	binary.BigEndian.PutUint16(msg[2:4], 0x0100) // RD
+	binary.BigEndian.PutUint16(msg[4:6], 1)      // QDCOUNT
+
+	msg, err := appendDNSName(msg, name)
+	if err != nil {
+		return nil, err
+	}
+	msg = binary.BigEndian.AppendUint16(msg, qtype)
+	msg = binary.BigEndian.AppendUint16(msg, 1) // IN
+	return msg, nil
+}
+
+// BuildDNSResponse encodes a response to query with the given rcode and answers. Answer data
+// is given in presentation format: an IP for A/AAAA, a name for CNAME/PTR/NS and text for TXT.
+func BuildDNSResponse(query *DNSMessage, rcode int, answers []DNSAnswer) ([]byte, error) {
+	msg := make([]byte, 12, 512)
+	binary.BigEndian.PutUint16(msg[0:2], query.ID)
+	binary.BigEndian.PutUint16(msg[2:4], 0x8180|uint16(rcode&0xf)) // QR, RD, RA
+	binary.BigEndian.PutUint16(msg[4:6], uint16(len(query.Questions)))
+	binary.BigEndian.PutUint16(msg[6:8], uint16(len(answers)))
+
+	var err error
+	for _, question := range query.Questions {
+		if msg, err = appendDNSName(msg, question.Name); err != nil {
+			return nil, err
+		}
+		msg = binary.BigEndian.AppendUint16(msg, question.QType)
+		msg = binary.BigEndian.AppendUint16(msg, question.Class)
+	}
+
+	for _, answer := range answers {
+		qtype, err := DNSTypeFromName(answer.Type)
+		if err != nil {
+			return nil, err
+		}
+
+		var rdata []byte
+		switch qtype {
+		case DNSTypeA, DNSTypeAAAA:
+			ip := net.ParseIP(answer.Data)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP %q for %s record", answer.Data, answer.Type)
+			}
+			if qtype == DNSTypeA {
+				if ip.To4() == nil {
+					return nil, fmt.Errorf("invalid IPv4 %q for A record", answer.Data)
+				}
+				rdata = ip.To4()
+			} else {
+				rdata = ip.To16()
+			}
+		case DNSTypeCNAME, DNSTypePTR, DNSTypeNS:
+			if rdata, err = appendDNSName(nil, answer.Data); err != nil {
+				return nil, err
+			}
+		case DNSTypeTXT:
+			for text := answer.Data; ; {
+				chunk := text
+				if len(chunk) > 255 {
+					chunk = chunk[:255]
+				}
+				rdata = append(append(rdata, byte(len(chunk))), chunk...)
+				if text = text[len(chunk):]; text == "" {
+					break
+				}
+			}
+		default:
+			return nil, fmt.Errorf("encoding %s records is not supported", answer.Type)
+		}
+
+		if msg, err = appendDNSName(msg, answer.Name); err != nil {
+			return nil, err
+		}
+		msg = binary.BigEndian.AppendUint16(msg, qtype)
+		msg = binary.BigEndian.AppendUint16(msg, 1) // IN
+		msg = binary.BigEndian.AppendUint32(msg, answer.TTL)
+		msg = binary.BigEndian.AppendUint16(msg, uint16(len(rdata)))
+		msg = append(msg, rdata...)
+	}
+	return msg, nil
+}
+
+// ParseDNSMessage decodes the header, question and answer sections of a DNS message
+func ParseDNSMessage(msg []byte) (*DNSMessage, error) {
+	if len(msg) < 12 {
+		return nil, fmt.Errorf("DNS message too short: %d bytes", len(msg))
+	}
+
+	flags := binary.BigEndian.Uint16(msg[2:4])
+	parsed := &DNSMessage{
+		ID:        binary.BigEndian.Uint16(msg[0:2]),
+		Response:  flags&0x8000 != 0,
+		Truncated: flags&0x0200 != 0,
+		Rcode:     DNSRcodeName(int(flags & 0xf)),
+	}
+	qdcount := int(binary.BigEndian.Uint16(msg[4:6]))
+	ancount := int(binary.BigEndian.Uint16(msg[6:8]))
+
+	offset := 12
+	for i := 0; i < qdcount; i++ {
+		name, next, err := readDNSName(msg, offset)
+		if err != nil {
+			return nil, err
+		}
+		if next+4 > len(msg) {
+			return nil, fmt.Errorf("truncated DNS question")
+		}
+		qtype := binary.BigEndian.Uint16(msg[next : next+2])
+		parsed.Questions = append(parsed.Questions, DNSQuestion{
+			Name:  name,
+			Type:  DNSTypeName(qtype),
+			QType: qtype,
+			Class: binary.BigEndian.Uint16(msg[next+2 : next+4]),
+		})
+		offset = next + 4
+	}
+
+	for i := 0; i < ancount; i++ {
+		name, next, err := readDNSName(msg, offset)
+		if err != nil {
+			return nil, err
+		}
+		if next+10 > len(msg) {
+			return nil, fmt.Errorf("truncated DNS answer")
+		}
+		qtype := binary.BigEndian.Uint16(msg[next : next+2])
+		ttl := binary.BigEndian.Uint32(msg[next+4 : next+8])
+		rdlength := int(binary.BigEndian.Uint16(msg[next+8 : next+10]))
+		rdataStart := next + 10
+		if rdataStart+rdlength > len(msg) {
+			return nil, fmt.Errorf("truncated DNS answer data")
+		}
+		rdata := msg[rdataStart : rdataStart+rdlength]
+
+		answer := DNSAnswer{Name: name, Type: DNSTypeName(qtype), TTL: ttl}
+		switch qtype {
+		case DNSTypeA, DNSTypeAAAA:
+			answer.Data = net.IP(rdata).String()
+		case DNSTypeCNAME, DNSTypePTR, DNSTypeNS:
+			answer.Data, _, err = readDNSName(msg, rdataStart)
+			if err != nil {
+				return nil, err
+			}
+		case DNSTypeTXT:
+			var texts []string
+			for j := 0; j < len(rdata); {
+				length := int(rdata[j])
+				if j+1+length > len(rdata) {
+					break
+				}
+				texts = append(texts, string(rdata[j+1:j+1+length]))
+				j += 1 + length
+			}
+			answer.Data = strings.Join(texts, "")
+		default:
+			answer.Data = fmt.Sprintf("%x", rdata)
+		}
+		parsed.Answers = append(parsed.Answers, answer)
+		offset = rdataStart + rdlength
+	}
+
+	return parsed, nil
+}
+
+// appendDNSName appends name in DNS wire format (without compression)
+func appendDNSName(msg []byte, name string) ([]byte, error) {
+	name = strings.TrimSuffix(name, ".")
+	if name != "" {
+		for _, label := range strings.Split(name, ".") {
+			if len(label) == 0 || len(label) > 63 {
+				return nil, fmt.Errorf("invalid DNS name %q", name)
+			}
+			msg = append(append(msg, byte(len(label))), label...)
+		}
+	}
+	return append(msg, 0), nil
+}
+
+// readDNSName decodes a possibly compressed name at offset and returns the offset following it
+func readDNSName(msg []byte, offset int) (string, int, error) {
+	var labels []string
+	next := -1
+	for jumps := 0; ; {
+		if offset >= len(msg) {
+			return "", 0, fmt.Errorf("truncated DNS name")
+		}
+		length := int(msg[offset])
+		switch {
+		case length == 0:
+			if next < 0 {
+				next = offset + 1
+			}
+			return strings.Join(labels, ".") + ".", next, nil
+		case length&0xc0 == 0xc0:
+			if offset+1 >= len(msg) {
+				return "", 0, fmt.Errorf("truncated DNS name pointer")
+			}
+			if jumps++; jumps > 32 {
+				return "", 0, fmt.Errorf("too many DNS name pointers")
+			}
+			if next < 0 {
+				next = offset + 2
+			}
+			offset = int(binary.BigEndian.Uint16(msg[offset:offset+2]) & 0x3fff)
+		default:
+			if offset+1+length > len(msg) {
+				return "", 0, fmt.Errorf("truncated DNS label")
+			}
+			labels = append(labels, string(msg[offset+1:offset+1+length]))
+			offset += 1 + length
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package common
+
+import (
+	"bufio"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// fingerprintSysctls are the network sysctls reported in the fingerprint. The net.* ones are
+// per network namespace, so they describe the namespace of the server, not necessarily the node.
+var fingerprintSysctls = []string{
+	"net.core.somaxconn",
+	"net.core.rmem_max",
+	"net.core.wmem_max",
+	"net.ipv4.ip_forward",
+	"net.ipv4.ip_local_port_range",
+	"net.ipv4.conf.all.rp_filter",
+	"net.ipv4.tcp_congestion_control",
+	"net.ipv4.tcp_keepalive_time",
+	"net.ipv4.tcp_mtu_probing",
+	"net.ipv4.tcp_tw_reuse",
+	"net.ipv6.conf.all.disable_ipv6",
+	"net.netfilter.nf_conntrack_max",
+}
+
+// NodeFingerprint represents the kernel and OS of the node serving a request
+type NodeFingerprint struct {
+	KernelVersion string            `json:"KernelVersion"` // The kernel release, e.g. 6.8.0-45-generic
+	KernelBuild   string            `json:"KernelBuild"`   // The kernel build string
+	OSImage       string            `json:"OSImage"`       // The PRETTY_NAME of os-release
+	OSImageSource string            `json:"OSImageSource"` // The os-release file read: the node one under HOST_ROOT, or the container one
+	Architecture  string            `json:"Architecture"`  // The architecture of the server binary
+	Sysctls       map[string]string `json:"Sysctls"`       // The network sysctls, missing when unavailable
+	CollectedAt   string            `json:"CollectedAt"`   // When the fingerprint was collected
+}
+
+// FingerprintProvider caches the NodeFingerprint, which is collected at startup and on Refresh
+type FingerprintProvider struct {
+	mutex       sync.RWMutex
+	fingerprint NodeFingerprint
+}
+
+// NewFingerprintProvider creates a FingerprintProvider and collects the fingerprint
+func NewFingerprintProvider() *FingerprintProvider {
+	p := &FingerprintProvider{}
+	p.Refresh()
+	return p
+}
+
+// Get returns the cached fingerprint
+func (p *FingerprintProvider) Get() NodeFingerprint {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	return p.fingerprint
+}
+
+// Refresh collects the fingerprint again
+func (p *FingerprintProvider) Refresh() NodeFingerprint {
+	fingerprint := NodeFingerprint{
+		KernelVersion: readProcValue("/proc/sys/kernel/osrelease"),
+		KernelBuild:   readProcValue("/proc/sys/kernel/version"),
+		Architecture:  runtime.GOARCH,
+		Sysctls:       make(map[string]string),
+		CollectedAt:   time.Now().Format(time.RFC3339),
+	}
+
+	// The container sees the os-release of its image; the node one needs the host root mounted
+	osRelease := "/etc/os-release"
+	fingerprint.OSImageSource = "container"
+	if hostRoot := os.Getenv("HOST_ROOT"); hostRoot != "" {
+		osRelease = filepath.Join(hostRoot, "etc/os-release")
+		fingerprint.OSImageSource = "node"
+	}
+	fingerprint.OSImage = readOSImage(osRelease)
+
+	for _, name := range fingerprintSysctls {
+		if value := readProcValue(filepath.Join("/proc/sys", strings.ReplaceAll(name, ".", "/"))); value != "" {
+			fingerprint.Sysctls[name] = value
+		}
+	}
+
+	p.mutex.Lock()
+	p.fingerprint = fingerprint
+	p.mutex.Unlock()
+	log.Printf("Collected fingerprint: kernel %s, OS %s (%s)", fingerprint.KernelVersion, fingerprint.OSImage, fingerprint.OSImageSource)
+	return fingerprint
+}
+
+// RefreshOnHangup refreshes the fingerprint whenever the process receives SIGHUP, e.g. after
+// the node was upgraded in place
+func (p *FingerprintProvider) RefreshOnHangup() {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	go func() {
+		for range hangups {
+			p.Refresh()
+		}
+	}()
+}
+
+// readProcValue reads a single value file such as a sysctl, with its whitespace normalized
+func readProcValue(path string) string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return strings.Join(strings.Fields(string(data)), " ")
+}
+
+// readOSImage returns the PRETTY_NAME of an os-release file
+func readOSImage(path string) string {
+	file, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if value, ok := strings.CutPrefix(scanner.Text(), "PRETTY_NAME="); ok {
+			return strings.Trim(value, `"'`)
+		}
+	}
+	return ""
+}
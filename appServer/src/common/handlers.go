@@ -0,0 +1,172 @@
+package common
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// HandlersListed bounds the oldest active handlers listed in HandlerStats
+const HandlersListed = 20
+
+// HandlerStats represents the lifecycle of the per-request handler goroutines of a server, to spot
+// handlers that pile up or never return, e.g. under packet floods
+type HandlerStats struct {
+	Active          int           `json:"Active"`          // The handlers running now
+	Peak            int           `json:"Peak"`            // The most handlers running at once since the server started
+	Started         uint64        `json:"Started"`         // The handlers started since the server started
+	Finished        uint64        `json:"Finished"`        // The handlers returned since the server started
+	Threshold       int           `json:"Threshold"`       // The active handlers above which an alert is logged, 0 for none
+	ThresholdAlerts uint64        `json:"ThresholdAlerts"` // How many times the active handlers crossed the threshold
+	DeadlineMs      float64       `json:"DeadlineMs"`      // The age beyond which a handler is reported as overdue, 0 for none
+	Overdue         int           `json:"Overdue"`         // The active handlers older than the deadline
+	OverdueTotal    uint64        `json:"OverdueTotal"`    // The handlers that outlived the deadline since the server started, suspected leaks
+	OldestAgeMs     float64       `json:"OldestAgeMs"`     // The age of the oldest active handler
+	Oldest          []HandlerInfo `json:"Oldest"`          // The oldest active handlers, at most HandlersListed
+}
+
+// HandlerInfo represents an active handler goroutine
+type HandlerInfo struct {
+	Client  string  `json:"Client"`  // The client of the request
+	Started string  `json:"Started"` // When the handler started
+	AgeMs   float64 `json:"AgeMs"`   // How long the handler has been running
+	Overdue bool    `json:"Overdue"` // Indicates if the handler outlived the deadline
+}
+
+// HandlerTracker counts the handler goroutines of a server and logs an alert when too many of them
+// run at once or one of them lives beyond a deadline. A nil tracker tracks nothing.
+type HandlerTracker struct {
+	threshold int
+	deadline  time.Duration
+
+	mutex        sync.Mutex
+	nextID       uint64
+	active       map[uint64]*trackedHandler
+	peak         int
+	started      uint64
+	finished     uint64
+	alerts       uint64
+	overThresh   bool
+	overdueTotal uint64
+}
+
+// trackedHandler is an active handler of a HandlerTracker
+type trackedHandler struct {
+	client  string
+	start   time.Time
+	overdue bool
+}
+
+// NewHandlerTracker creates a HandlerTracker alerting above threshold active handlers and for the
+// handlers older than deadline, checked every interval; 0 disables an alert
+func NewHandlerTracker(threshold int, deadline, interval time.Duration) *HandlerTracker {
+	t := &HandlerTracker{threshold: threshold, deadline: deadline, active: make(map[uint64]*trackedHandler)}
+	if deadline > 0 {
+		go func() {
+			for range time.Tick(interval) {
+				t.checkDeadline()
+			}
+		}()
+	}
+	return t
+}
+
+// Start records a handler started for a request of client, and returns the function to call when
+// it returns
+func (t *HandlerTracker) Start(client string) func() {
+	if t == nil {
+		return func() {}
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.nextID++
+	id := t.nextID
+	t.active[id] = &trackedHandler{client: client, start: time.Now()}
+	t.started++
+	t.peak = max(t.peak, len(t.active))
+
+	// Alert once when crossing the threshold, and again after falling back under it
+	if t.threshold > 0 && len(t.active) > t.threshold && !t.overThresh {
+		t.overThresh = true
+		t.alerts++
+		log.Printf("ALERT: %d handler goroutines running, over the threshold of %d", len(t.active), t.threshold)
+	}
+	return func() { t.finish(id) }
+}
+
+// finish records the return of a handler
+func (t *HandlerTracker) finish(id uint64) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	handler := t.active[id]
+	delete(t.active, id)
+	t.finished++
+	if handler != nil && handler.overdue {
+		log.Printf("Overdue handler for %s returned after %s", handler.client, time.Since(handler.start).Round(time.Millisecond))
+	}
+	if t.overThresh && len(t.active) <= t.threshold {
+		t.overThresh = false
+		log.Printf("Handler goroutines back to %d, under the threshold of %d", len(t.active), t.threshold)
+	}
+}
+
+// checkDeadline logs the handlers that just outlived the deadline, once per handler
+func (t *HandlerTracker) checkDeadline() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for _, handler := range t.active {
+		if handler.overdue {
+			continue
+		}
+		if age := time.Since(handler.start); age > t.deadline {
+			handler.overdue = true
+			t.overdueTotal++
+			log.Printf("ALERT: handler for %s running for %s, over the deadline of %s, possibly leaked", handler.client, age.Round(time.Millisecond), t.deadline)
+		}
+	}
+}
+
+// Stats returns the current handlers and the counters since the server started
+func (t *HandlerTracker) Stats() HandlerStats {
+	if t == nil {
+		return HandlerStats{Oldest: []HandlerInfo{}}
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	stats := HandlerStats{
+		Active:          len(t.active),
+		Peak:            t.peak,
+		Started:         t.started,
+		Finished:        t.finished,
+		Threshold:       t.threshold,
+		ThresholdAlerts: t.alerts,
+		DeadlineMs:      milliseconds(t.deadline),
+		OverdueTotal:    t.overdueTotal,
+		Oldest:          []HandlerInfo{},
+	}
+	handlers := make([]*trackedHandler, 0, len(t.active))
+	for _, handler := range t.active {
+		handlers = append(handlers, handler)
+		if handler.overdue {
+			stats.Overdue++
+		}
+	}
+	sort.Slice(handlers, func(i, j int) bool { return handlers[i].start.Before(handlers[j].start) })
+	if len(handlers) > 0 {
+		stats.OldestAgeMs = milliseconds(time.Since(handlers[0].start))
+	}
+	for _, handler := range handlers[:min(len(handlers), HandlersListed)] {
+		stats.Oldest = append(stats.Oldest, HandlerInfo{
+			Client:  handler.client,
+			Started: handler.start.Format(time.RFC3339Nano),
+			AgeMs:   milliseconds(time.Since(handler.start)),
+			Overdue: handler.overdue,
+		})
+	}
+	return stats
+}
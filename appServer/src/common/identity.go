@@ -0,0 +1,115 @@
+package common
+
+import (
+	"log"
+	"net"
+	"os"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// Identity represents who is serving a request: the host, the pod and its addresses
+type Identity struct {
+	HostName     string   `json:"HostName"`     // The hostname of the server
+	NodeName     string   `json:"NodeName"`     // The node name, from the NODE_NAME environment variable (downward API)
+	PodName      string   `json:"PodName"`      // The pod name, from the POD_NAME environment variable (downward API)
+	PodNamespace string   `json:"PodNamespace"` // The pod namespace, from the POD_NAMESPACE environment variable (downward API)
+	InterfaceIPs []string `json:"InterfaceIPs"` // The non-loopback IP addresses of the server
+	RefreshedAt  string   `json:"RefreshedAt"`  // When the identity was last refreshed
+	Generation   int      `json:"Generation"`   // The number of times the identity was refreshed
+	Topology     Topology `json:"Topology"`     // The cluster, region and zone of the server, from -cluster, -region and -zone
+	Arch         string   `json:"Arch"`         // The OS and architecture of the server binary, e.g. linux/arm64
+	NumCPU       int      `json:"NumCPU"`       // The logical CPUs of the node the server can run on, regardless of the CPU limit
+}
+
+// IdentityProvider keeps the Identity of the server up to date. It refreshes the identity
+// whenever the network interfaces or their addresses change, so long-running pods report
+// accurate IPs after re-IP events.
+type IdentityProvider struct {
+	mutex    sync.RWMutex
+	identity Identity
+	topology Topology
+}
+
+// NewIdentityProvider creates an IdentityProvider and starts watching for interface changes
+func NewIdentityProvider() *IdentityProvider {
+	p := &IdentityProvider{}
+	p.Refresh()
+
+	go func() {
+		// Bursts of events (e.g. an address removed then added) are collapsed into one refresh
+		changes := make(chan struct{}, 1)
+		go func() {
+			for range changes {
+				time.Sleep(200 * time.Millisecond)
+				p.Refresh()
+			}
+		}()
+
+		err := watchInterfaceChanges(func() {
+			select {
+			case changes <- struct{}{}:
+			default:
+			}
+		})
+		log.Printf("Stopped watching interface changes: %v", err)
+	}()
+
+	return p
+}
+
+// Get returns the current identity
+func (p *IdentityProvider) Get() Identity {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	identity := p.identity
+	identity.InterfaceIPs = append([]string(nil), p.identity.InterfaceIPs...)
+	return identity
+}
+
+// SetTopology sets the topology reported in the identity, which the refreshes keep
+func (p *IdentityProvider) SetTopology(topology Topology) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.topology = topology
+	p.identity.Topology = topology
+}
+
+// Refresh re-reads the hostname, the downward API environment variables and the interface addresses
+func (p *IdentityProvider) Refresh() {
+	hostName, err := os.Hostname()
+	if err != nil {
+		log.Printf("Unable to get hostname: %v", err)
+	}
+
+	var ips []string
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && !ipNet.IP.IsLoopback() && !ipNet.IP.IsLinkLocalUnicast() {
+				ips = append(ips, ipNet.IP.String())
+			}
+		}
+	} else {
+		log.Printf("Unable to get interface addresses: %v", err)
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.identity = Identity{
+		HostName:     hostName,
+		NodeName:     os.Getenv("NODE_NAME"),
+		PodName:      os.Getenv("POD_NAME"),
+		PodNamespace: os.Getenv("POD_NAMESPACE"),
+		InterfaceIPs: ips,
+		RefreshedAt:  time.Now().Format(time.RFC3339),
+		Generation:   p.identity.Generation + 1,
+		Topology:     p.topology,
+		Arch:         runtime.GOOS + "/" + runtime.GOARCH,
+		NumCPU:       runtime.NumCPU(),
+	}
+	log.Printf("Refreshed identity: hostname %s, IPs %v", hostName, ips)
+}
@@ -0,0 +1,297 @@
+package common
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AuthEcho represents the claims of the bearer token found in the Authorization header
+type AuthEcho struct {
+	Algorithm         string   `json:"Algorithm"`         // The signing algorithm from the token header
+	KeyID             string   `json:"KeyID"`             // The key ID from the token header
+	Issuer            string   `json:"Issuer"`            // The iss claim
+	Subject           string   `json:"Subject"`           // The sub claim
+	Audience          []string `json:"Audience"`          // The aud claim
+	ExpiresAt         string   `json:"ExpiresAt"`         // The exp claim
+	Expired           bool     `json:"Expired"`           // Indicates if the token is expired
+	Verified          bool     `json:"Verified"`          // Indicates if the signature was verified against the JWKS
+	VerificationError string   `json:"VerificationError"` // Why the signature could not be verified, if a JWKS is configured
+	ParseError        string   `json:"ParseError"`        // Why the token could not be parsed, if it is not a valid JWT
+}
+
+// ParseBearerToken parses the bearer token of the Authorization header without verifying it.
+// It returns nil if the request carries no bearer token. If jwks is not nil the signature
+// is verified as well.
+func ParseBearerToken(r *http.Request, jwks *JWKSCache) *AuthEcho {
+	authorization := r.Header.Get("Authorization")
+	if len(authorization) < 7 || !strings.EqualFold(authorization[:7], "Bearer ") {
+		return nil
+	}
+	token := strings.TrimSpace(authorization[7:])
+	echo := &AuthEcho{}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		echo.ParseError = "token is not a JWT, expected 3 dot separated parts"
+		return echo
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		echo.ParseError = fmt.Sprintf("invalid token header: %v", err)
+		return echo
+	}
+	echo.Algorithm, echo.KeyID = header.Alg, header.Kid
+
+	var claims struct {
+		Iss string          `json:"iss"`
+		Sub string          `json:"sub"`
+		Aud json.RawMessage `json:"aud"`
+		Exp json.Number     `json:"exp"`
+	}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		echo.ParseError = fmt.Sprintf("invalid token claims: %v", err)
+		return echo
+	}
+	echo.Issuer, echo.Subject = claims.Iss, claims.Sub
+
+	// aud is either a single string or an array of strings
+	var audience string
+	if err := json.Unmarshal(claims.Aud, &audience); err == nil {
+		echo.Audience = []string{audience}
+	} else {
+		json.Unmarshal(claims.Aud, &echo.Audience)
+	}
+
+	if exp, err := claims.Exp.Int64(); err == nil {
+		expiresAt := time.Unix(exp, 0)
+		echo.ExpiresAt = expiresAt.Format(time.RFC3339)
+		echo.Expired = time.Now().After(expiresAt)
+	}
+
+	if jwks != nil {
+		if err := jwks.Verify(header.Alg, header.Kid, parts[0]+"."+parts[1], parts[2]); err != nil {
+			echo.VerificationError = err.Error()
+		} else {
+			echo.Verified = true
+		}
+	}
+	return echo
+}
+
+// decodeJWTPart decodes a base64url encoded JSON part of a JWT
+func decodeJWTPart(part string, out interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(strings.NewReader(string(data)))
+	decoder.UseNumber()
+	return decoder.Decode(out)
+}
+
+// maxJWKSBytes bounds the size of a JWKS document
+const maxJWKSBytes = 1 << 20
+
+// JWKSCache fetches the keys of a JWKS endpoint and refreshes them periodically.
+// Tokens with an unknown key ID trigger a refetch at most once per MinRefetch, so
+// forged key IDs cannot make the server hammer the JWKS endpoint.
+type JWKSCache struct {
+	URL         string
+	TTL         time.Duration
+	MinRefetch  time.Duration
+	mutex       sync.Mutex
+	keys        map[string]crypto.PublicKey
+	fetchedAt   time.Time
+	attemptedAt time.Time     // When the last fetch started, successful or not
+	fetchErr    error         // Why the last fetch failed, nil if it succeeded
+	fetching    chan struct{} // Closed when the fetch in progress completes, nil if none is
+}
+
+// NewJWKSCache creates a JWKSCache for the given JWKS URL
+func NewJWKSCache(url string) *JWKSCache {
+	return &JWKSCache{URL: url, TTL: 5 * time.Minute, MinRefetch: 30 * time.Second}
+}
+
+// Verify checks the signature of signingInput with the key identified by kid
+func (c *JWKSCache) Verify(alg, kid, signingInput, signature string) error {
+	key, err := c.key(kid)
+	if err != nil {
+		return err
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil {
+		return fmt.Errorf("invalid signature encoding: %v", err)
+	}
+
+	if len(alg) != 5 {
+		return fmt.Errorf("unsupported algorithm %q", alg)
+	}
+
+	var hash crypto.Hash
+	switch alg[2:] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported algorithm %q", alg)
+	}
+	hasher := hash.New()
+	hasher.Write([]byte(signingInput))
+	digest := hasher.Sum(nil)
+
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		switch {
+		case strings.HasPrefix(alg, "RS"):
+			return rsa.VerifyPKCS1v15(pub, hash, digest, sig)
+		case strings.HasPrefix(alg, "PS"):
+			return rsa.VerifyPSS(pub, hash, digest, sig, nil)
+		}
+	case *ecdsa.PublicKey:
+		// ES256, ES384 and ES512 sign with P-256, P-384 and P-521, in fixed size r||s signatures
+		curves := map[string]string{"ES256": "P-256", "ES384": "P-384", "ES512": "P-521"}
+		if curves[alg] == pub.Curve.Params().Name {
+			size := (pub.Curve.Params().BitSize + 7) / 8
+			if len(sig) != 2*size {
+				return fmt.Errorf("invalid %s signature length %d, expected %d", alg, len(sig), 2*size)
+			}
+			if ecdsa.Verify(pub, digest, new(big.Int).SetBytes(sig[:size]), new(big.Int).SetBytes(sig[size:])) {
+				return nil
+			}
+			return fmt.Errorf("ecdsa: verification error")
+		}
+	}
+	return fmt.Errorf("algorithm %q does not match the key %q", alg, kid)
+}
+
+// key returns the public key with the given ID, refreshing the key set when it is stale or the key is unknown.
+// The key set is fetched without holding the mutex, concurrent callers wait for the same fetch.
+func (c *JWKSCache) key(kid string) (crypto.PublicKey, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for {
+		key, ok := c.keys[kid]
+		if ok && time.Since(c.fetchedAt) < c.TTL {
+			return key, nil
+		}
+		if c.fetching != nil {
+			done := c.fetching
+			c.mutex.Unlock()
+			<-done
+			c.mutex.Lock()
+			continue
+		}
+		if !c.attemptedAt.IsZero() && time.Since(c.attemptedAt) < c.MinRefetch {
+			// Keep using a stale key until the refetch is allowed
+			if ok {
+				return key, nil
+			}
+			if c.fetchErr != nil {
+				return nil, c.fetchErr
+			}
+			return nil, fmt.Errorf("key %q not found in JWKS %s", kid, c.URL)
+		}
+
+		c.fetching = make(chan struct{})
+		c.attemptedAt = time.Now()
+		c.mutex.Unlock()
+		keys, err := c.fetch()
+		c.mutex.Lock()
+		if err == nil {
+			c.keys, c.fetchedAt = keys, time.Now()
+		}
+		c.fetchErr = err
+		close(c.fetching)
+		c.fetching = nil
+	}
+}
+
+// fetch downloads and parses the key set
+func (c *JWKSCache) fetch() (map[string]crypto.PublicKey, error) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(c.URL)
+	if err != nil {
+		return nil, fmt.Errorf("unable to fetch JWKS: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unable to fetch JWKS: %s answered %s", c.URL, resp.Status)
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxJWKSBytes+1))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read JWKS: %v", err)
+	}
+	if len(data) > maxJWKSBytes {
+		return nil, fmt.Errorf("invalid JWKS: larger than %d bytes", maxJWKSBytes)
+	}
+
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("invalid JWKS: %v", err)
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		switch k.Kty {
+		case "RSA":
+			n, errN := base64.RawURLEncoding.DecodeString(k.N)
+			e, errE := base64.RawURLEncoding.DecodeString(k.E)
+			if errN != nil || errE != nil {
+				continue
+			}
+			keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		case "EC":
+			var curve elliptic.Curve
+			switch k.Crv {
+			case "P-256":
+				curve = elliptic.P256()
+			case "P-384":
+				curve = elliptic.P384()
+			case "P-521":
+				curve = elliptic.P521()
+			default:
+				continue
+			}
+			x, errX := base64.RawURLEncoding.DecodeString(k.X)
+			y, errY := base64.RawURLEncoding.DecodeString(k.Y)
+			if errX != nil || errY != nil {
+				continue
+			}
+			keys[k.Kid] = &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		}
+	}
+
+	return keys, nil
+}
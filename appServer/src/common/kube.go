@@ -0,0 +1,129 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// KubeClient is a minimal Kubernetes API client built on net/http only, so the
+// programs in this directory keep building without external dependencies
+type KubeClient struct {
+	BaseURL    string       // The base URL of the API server
+	Token      string       // The bearer token, empty when talking to `kubectl proxy`
+	HTTPClient *http.Client // The client used for the API requests
+}
+
+// NewKubeClient creates a KubeClient. If apiURL is set it is used as is, which is
+// meant for `kubectl proxy` (e.g. http://127.0.0.1:8001). Otherwise the in-cluster
+// service account of the pod is used.
+func NewKubeClient(apiURL string) (*KubeClient, error) {
+	if apiURL != "" {
+		return &KubeClient{
+			BaseURL:    strings.TrimSuffix(apiURL, "/"),
+			HTTPClient: &http.Client{Timeout: 30 * time.Second},
+		}, nil
+	}
+
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("not running in a cluster, KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT are not set")
+	}
+
+	token, err := ioutil.ReadFile(serviceAccountDir + "/token")
+	if err != nil {
+		return nil, fmt.Errorf("unable to read service account token: %v", err)
+	}
+
+	caData, err := ioutil.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, fmt.Errorf("unable to read service account CA: %v", err)
+	}
+	caPool := x509.NewCertPool()
+	if !caPool.AppendCertsFromPEM(caData) {
+		return nil, fmt.Errorf("no valid certificate found in the service account CA")
+	}
+
+	return &KubeClient{
+		BaseURL: "https://" + net.JoinHostPort(host, port),
+		Token:   strings.TrimSpace(string(token)),
+		HTTPClient: &http.Client{
+			Timeout:   30 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: caPool}},
+		},
+	}, nil
+}
+
+// PodNamespace returns the namespace of the pod the program runs in, or "default"
+func PodNamespace() string {
+	if ns := os.Getenv("POD_NAMESPACE"); ns != "" {
+		return ns
+	}
+	if data, err := ioutil.ReadFile(serviceAccountDir + "/namespace"); err == nil {
+		return strings.TrimSpace(string(data))
+	}
+	return "default"
+}
+
+// Do sends a request to the API server and decodes the JSON response into out (if not nil)
+func (k *KubeClient) Do(ctx context.Context, method, path string, body interface{}, out interface{}) error {
+	var reqBody []byte
+	if body != nil {
+		var err error
+		if reqBody, err = json.Marshal(body); err != nil {
+			return fmt.Errorf("unable to marshal request body: %v", err)
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, k.BaseURL+path, bytes.NewReader(reqBody))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if method == http.MethodPatch {
+		req.Header.Set("Content-Type", "application/merge-patch+json")
+	}
+	if k.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+k.Token)
+	}
+
+	resp, err := k.HTTPClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("%s %s failed: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("unable to read response of %s %s: %v", method, path, err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s %s returned %s: %s", method, path, resp.Status, strings.TrimSpace(string(data)))
+	}
+
+	if out != nil {
+		if err := json.Unmarshal(data, out); err != nil {
+			return fmt.Errorf("unable to decode response of %s %s: %v", method, path, err)
+		}
+	}
+	return nil
+}
+
+// Get is a shortcut for Do with the GET method
+func (k *KubeClient) Get(ctx context.Context, path string, out interface{}) error {
+	return k.Do(ctx, http.MethodGet, path, nil, out)
+}
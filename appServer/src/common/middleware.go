@@ -0,0 +1,168 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The middlewares of this file are shared by the HTTP servers, see Chain. The middlewares bound to
+// the state of a server live next to it: Diagnostics.Recorder and ResourceGuard.Guard, or in their own
+// package when they need external modules, like journal.Journal.Record.
+
+// RequestIDHeader carries the ID of a request: the one sent by the client, or the one the server
+// assigned, echoed in the response
+const RequestIDHeader = "X-Request-Id"
+
+// MaxRequestIDLength bounds the request IDs taken from the clients, longer ones are replaced
+const MaxRequestIDLength = 128
+
+// requestIDKey is the context key of the ID of a request
+type requestIDKey struct{}
+
+// RequestID returns the ID AssignRequestID gave to a request, or else its X-Request-Id header, which
+// carries the ID in the subrequests of the proxy server
+func RequestID(r *http.Request) string {
+	if id, ok := r.Context().Value(requestIDKey{}).(string); ok {
+		return id
+	}
+	if id := r.Header.Get(RequestIDHeader); len(id) <= MaxRequestIDLength {
+		return id
+	}
+	return ""
+}
+
+// AssignRequestID gives each request an ID: its X-Request-Id, or a new UUID when it has none or one
+// longer than MaxRequestIDLength. The ID is set in the X-Request-Id response header and in the
+// context of the request, see RequestID.
+func AssignRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, WithRequestID(w, r))
+	})
+}
+
+// WithRequestID returns the request with its ID in its context as AssignRequestID does, for the
+// middlewares that need the ID wherever they are in the chain. A request that already has its ID
+// is returned as is.
+func WithRequestID(w http.ResponseWriter, r *http.Request) *http.Request {
+	if _, ok := r.Context().Value(requestIDKey{}).(string); ok {
+		return r
+	}
+	id := r.Header.Get(RequestIDHeader)
+	if id == "" || len(id) > MaxRequestIDLength {
+		var err error
+		if id, err = randomUUID(); err != nil {
+			id = strconv.FormatInt(time.Now().UnixNano(), 10)
+		}
+	}
+	w.Header().Set(RequestIDHeader, id)
+	return r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id))
+}
+
+// Recover answers 500 to the requests whose handler panicked, if it wrote nothing yet, and logs the
+// panic with its stack. http.ErrAbortHandler, which handlers raise to reset the connection on
+// purpose, is passed on to net/http.
+func Recover(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		recorder := &StatusRecorder{ResponseWriter: w}
+		defer func() {
+			err := recover()
+			if err == nil {
+				return
+			}
+			if err == http.ErrAbortHandler {
+				panic(err)
+			}
+			log.Printf("Recovered from a panic in %s %s: %v\n%s", r.Method, r.URL.Path, err, debug.Stack())
+			if recorder.status == 0 && !recorder.hijacked {
+				http.Error(w, fmt.Sprintf("Internal server error: %v", err), http.StatusInternalServerError)
+			}
+		}()
+		next.ServeHTTP(recorder, r)
+	})
+}
+
+// AccessLog logs a line per request once it is served: the client, the request, the status, the
+// size of the body and the duration, and the ID of the request if it has one
+func AccessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &StatusRecorder{ResponseWriter: w}
+		completed := false
+		// Deferred, so handlers aborted with a panic are logged too
+		defer func() {
+			status := "no response"
+			switch {
+			case recorder.hijacked:
+				status = "hijacked"
+			case !completed:
+				status = "aborted"
+			case recorder.status != 0:
+				status = strconv.Itoa(recorder.status)
+			}
+			id := RequestID(r)
+			if id == "" {
+				id = "-"
+			}
+			log.Printf("Access: %s \"%s %s %s\" %s %d bytes %.3fms request %s", r.RemoteAddr, r.Method, r.URL.RequestURI(), r.Proto,
+				status, recorder.bytes, float64(time.Since(start).Microseconds())/1000, id)
+		}()
+		next.ServeHTTP(recorder, r)
+		completed = true
+	})
+}
+
+// RateLimiter limits the rate of the requests of a server with a token bucket, holding up to one
+// second of requests, so short bursts pass while a sustained excess is rejected with 429. A nil
+// RateLimiter limits nothing.
+type RateLimiter struct {
+	mutex  sync.Mutex
+	rate   float64 // Tokens added per second
+	burst  float64 // The capacity of the bucket
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter returns a limiter of rate requests per second, or nil if rate is not positive
+func NewRateLimiter(rate float64) *RateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	burst := math.Max(rate, 1)
+	return &RateLimiter{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// Allow takes a token for a request, or returns how long until the next one is available
+func (l *RateLimiter) Allow() (bool, time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	now := time.Now()
+	l.tokens = math.Min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	if l.tokens >= 1 {
+		l.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - l.tokens) / l.rate * float64(time.Second))
+}
+
+// Limit rejects the requests over the rate with 429 and a Retry-After header
+func (l *RateLimiter) Limit(next http.Handler) http.Handler {
+	if l == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ok, wait := l.Allow(); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			http.Error(w, fmt.Sprintf("Rate limit of %g requests per second exceeded", l.rate), http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
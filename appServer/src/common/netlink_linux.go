@@ -0,0 +1,57 @@
+//go:build linux
+
+package common
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// rtnetlink multicast groups, see include/uapi/linux/rtnetlink.h
+const (
+	rtmgrpLink       = 0x1
+	rtmgrpIPv4IfAddr = 0x10
+	rtmgrpIPv6IfAddr = 0x100
+)
+
+// watchInterfaceChanges subscribes to the rtnetlink link and address notifications
+// and calls onChange for every received message. It only returns on error.
+func watchInterfaceChanges(onChange func()) error {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return fmt.Errorf("unable to open netlink socket: %v", err)
+	}
+	defer syscall.Close(fd)
+
+	addr := &syscall.SockaddrNetlink{
+		Family: syscall.AF_NETLINK,
+		Groups: rtmgrpLink | rtmgrpIPv4IfAddr | rtmgrpIPv6IfAddr,
+	}
+	if err := syscall.Bind(fd, addr); err != nil {
+		return fmt.Errorf("unable to bind netlink socket: %v", err)
+	}
+
+	buffer := make([]byte, 8192)
+	for {
+		n, _, err := syscall.Recvfrom(fd, buffer, 0)
+		if err != nil {
+			if err == syscall.EINTR || err == syscall.ENOBUFS {
+				// ENOBUFS means notifications were dropped, refresh anyway
+				onChange()
+				continue
+			}
+			return fmt.Errorf("unable to read netlink socket: %v", err)
+		}
+
+		msgs, err := syscall.ParseNetlinkMessage(buffer[:n])
+		if err != nil {
+			continue
+		}
+		for _, msg := range msgs {
+			switch msg.Header.Type {
+			case syscall.RTM_NEWLINK, syscall.RTM_DELLINK, syscall.RTM_NEWADDR, syscall.RTM_DELADDR:
+				onChange()
+			}
+		}
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package common
+
+import "time"
+
+// watchInterfaceChanges falls back to polling where netlink is not available
+func watchInterfaceChanges(onChange func()) error {
+	for range time.Tick(30 * time.Second) {
+		onChange()
+	}
+	return nil
+}
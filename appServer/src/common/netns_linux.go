@@ -0,0 +1,62 @@
+//go:build linux
+
+package common
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// DetectHostNetwork reports whether the server runs in the host network namespace, e.g. in a
+// hostNetwork pod. Like kubernetes/check_network_namespace.go, it compares the network namespace
+// of the current process with the one of PID 1. PID 1 is looked up in HOST_PROC (default /proc),
+// so pods without hostPID can mount the host /proc and point HOST_PROC at it.
+//
+// When PID 1 turns out to be the init process of our own container, the comparison says nothing,
+// so the hostname is compared with NODE_NAME instead: hostNetwork pods use the node's hostname.
+// The same fallback is used when the namespace of PID 1 cannot be read.
+// The returned string describes how the result was determined.
+func DetectHostNetwork() (bool, string, error) {
+	hostProc := os.Getenv("HOST_PROC")
+	if hostProc == "" {
+		hostProc = "/proc"
+	}
+
+	// PID 1 shares our mount namespace only if it is the init process of our own container
+	ownInit := os.Getpid() == 1 || sameNamespace("/proc/self/ns/mnt", "/proc/1/ns/mnt")
+	if hostProc != "/proc" || !ownInit {
+		var self, host syscall.Stat_t
+		hostNS := filepath.Join(hostProc, "1/ns/net")
+		err := syscall.Stat("/proc/self/ns/net", &self)
+		if err == nil {
+			err = syscall.Stat(hostNS, &host)
+		}
+		if err == nil {
+			return self.Dev == host.Dev && self.Ino == host.Ino, "network namespace compared with " + hostNS, nil
+		}
+		if os.Getenv("NODE_NAME") == "" {
+			return false, "", fmt.Errorf("unable to compare the network namespace with %s: %v", hostNS, err)
+		}
+	}
+
+	nodeName := os.Getenv("NODE_NAME")
+	if nodeName == "" {
+		return false, "", fmt.Errorf("PID 1 belongs to this container and NODE_NAME is not set, mount the host /proc and set HOST_PROC")
+	}
+	hostName, err := os.Hostname()
+	if err != nil {
+		return false, "", err
+	}
+	return hostName == nodeName, "hostname compared with NODE_NAME", nil
+}
+
+// sameNamespace checks if two namespace files refer to the same namespace
+func sameNamespace(a, b string) bool {
+	var statA, statB syscall.Stat_t
+	if syscall.Stat(a, &statA) != nil || syscall.Stat(b, &statB) != nil {
+		return false
+	}
+	return statA.Dev == statB.Dev && statA.Ino == statB.Ino
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package common
+
+import "fmt"
+
+// DetectHostNetwork is only supported on Linux
+func DetectHostNetwork() (bool, string, error) {
+	return false, "", fmt.Errorf("detecting the host network namespace is not supported on this platform")
+}
@@ -0,0 +1,99 @@
+package common
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+)
+
+// ntpEpochOffset is the number of seconds between the NTP epoch (1900) and the Unix epoch (1970)
+const ntpEpochOffset = 2208988800
+
+// NTPResult represents the clock offset measured against an NTP server
+type NTPResult struct {
+	Server      string        // The queried server, as host:port
+	Offset      time.Duration // How far the server clock is ahead of the local clock
+	RoundTrip   time.Duration // The round trip delay, excluding the processing time of the server
+	Stratum     int           // The stratum of the server, 1 for a primary reference
+	ReferenceID string        // The reference clock of a stratum 1 server, or the IP of its upstream server
+	Leap        int           // The leap indicator, 3 when the server clock is not synchronized
+}
+
+// QueryNTP measures the offset of the local clock against an NTP server with a single SNTP
+// (RFC 4330) request. The server is given as host or host:port, the port defaults to 123.
+func QueryNTP(ctx context.Context, server string) (*NTPResult, error) {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "123")
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "udp", server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	request := make([]byte, 48)
+	request[0] = 0<<6 | 4<<3 | 3 // LI 0, version 4, mode 3 (client)
+	sent := time.Now()
+	binary.BigEndian.PutUint64(request[40:48], toNTPTime(sent))
+	if _, err := conn.Write(request); err != nil {
+		return nil, err
+	}
+
+	response := make([]byte, 48)
+	for {
+		n, err := conn.Read(response)
+		if err != nil {
+			return nil, err
+		}
+		// Skip stray packets that do not answer our request
+		if n >= 48 && response[0]&0x7 == 4 && binary.BigEndian.Uint64(response[24:32]) == binary.BigEndian.Uint64(request[40:48]) {
+			break
+		}
+	}
+	received := time.Now()
+
+	stratum := int(response[1])
+	if stratum == 0 {
+		return nil, fmt.Errorf("kiss-o'-death from %s: %s", server, string(response[12:16]))
+	}
+
+	// t1/t4 are the local send/receive times, t2/t3 the server receive/transmit times
+	t1, t4 := sent, received
+	t2 := fromNTPTime(binary.BigEndian.Uint64(response[32:40]))
+	t3 := fromNTPTime(binary.BigEndian.Uint64(response[40:48]))
+
+	result := &NTPResult{
+		Server:    server,
+		Offset:    (t2.Sub(t1) + t3.Sub(t4)) / 2,
+		RoundTrip: t4.Sub(t1) - t3.Sub(t2),
+		Stratum:   stratum,
+		Leap:      int(response[0] >> 6),
+	}
+	if stratum == 1 {
+		result.ReferenceID = string(response[12:16])
+	} else {
+		result.ReferenceID = net.IP(response[12:16]).String()
+	}
+	return result, nil
+}
+
+// toNTPTime converts a time to the 64-bit NTP timestamp format
+func toNTPTime(t time.Time) uint64 {
+	seconds := uint64(t.Unix() + ntpEpochOffset)
+	fraction := uint64(t.Nanosecond()) << 32 / 1e9
+	return seconds<<32 | fraction
+}
+
+// fromNTPTime converts a 64-bit NTP timestamp to a time
+func fromNTPTime(ntp uint64) time.Time {
+	seconds := int64(ntp>>32) - ntpEpochOffset
+	nanoseconds := int64((ntp & 0xffffffff) * 1e9 >> 32)
+	return time.Unix(seconds, nanoseconds)
+}
@@ -0,0 +1,79 @@
+package common
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// The RTT ping protocol is a tiny binary protocol over UDP, answered by the UDP server without
+// JSON so microsecond round trip times are not skewed by the encoding. The client stamps each
+// request with its own clock and the server echoes the stamp, adding how long it held the request,
+// so the RTT needs no clock synchronization between the two. All fields are big-endian:
+//
+//	0-3   magic "RTTP"
+//	4     version, 1
+//	5     type, 1 for a request and 2 for a reply
+//	6-7   reserved, zero
+//	8-11  sequence number, chosen by the client
+//	12-19 client timestamp in nanoseconds of the client clock, echoed as is
+//	20-27 server hold time in nanoseconds, from the receipt of the request to the reply, zero in requests
+//
+// The bytes after the header are padding, echoed in the reply so both directions carry the same size.
+const (
+	PingMagic        = "RTTP"
+	PingVersion      = 1
+	PingTypeRequest  = 1
+	PingTypeReply    = 2
+	PingHeaderLength = 28
+)
+
+// PingPacket is the header of a packet of the RTT ping protocol
+type PingPacket struct {
+	Type            uint8
+	Sequence        uint32
+	ClientTimestamp uint64        // Nanoseconds of the client clock, only meaningful to the client
+	ServerHold      time.Duration // How long the server held the request, zero in requests
+}
+
+// IsPingRequest reports whether data is a request of the RTT ping protocol
+func IsPingRequest(data []byte) bool {
+	return len(data) >= PingHeaderLength && string(data[:4]) == PingMagic && data[4] == PingVersion && data[5] == PingTypeRequest
+}
+
+// ParsePingPacket parses the header of a packet of the RTT ping protocol
+func ParsePingPacket(data []byte) (PingPacket, error) {
+	if len(data) < PingHeaderLength || string(data[:4]) != PingMagic {
+		return PingPacket{}, errors.New("not a packet of the RTT ping protocol")
+	}
+	if data[4] != PingVersion {
+		return PingPacket{}, errors.New("unsupported version of the RTT ping protocol")
+	}
+	return PingPacket{
+		Type:            data[5],
+		Sequence:        binary.BigEndian.Uint32(data[8:12]),
+		ClientTimestamp: binary.BigEndian.Uint64(data[12:20]),
+		ServerHold:      time.Duration(binary.BigEndian.Uint64(data[20:28])),
+	}, nil
+}
+
+// AppendPingPacket appends the packet to data, padded with zeros to size bytes if it is larger than
+// the header
+func AppendPingPacket(data []byte, packet PingPacket, size int) []byte {
+	data = append(data, PingMagic...)
+	data = append(data, PingVersion, packet.Type, 0, 0)
+	data = binary.BigEndian.AppendUint32(data, packet.Sequence)
+	data = binary.BigEndian.AppendUint64(data, packet.ClientTimestamp)
+	data = binary.BigEndian.AppendUint64(data, uint64(packet.ServerHold))
+	for i := PingHeaderLength; i < size; i++ {
+		data = append(data, 0)
+	}
+	return data
+}
+
+// MakePingReply turns a request into its reply in place, keeping the sequence number, the client
+// timestamp and the padding
+func MakePingReply(request []byte, hold time.Duration) {
+	request[5] = PingTypeReply
+	binary.BigEndian.PutUint64(request[20:28], uint64(max(hold, 0)))
+}
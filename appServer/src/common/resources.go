@@ -0,0 +1,137 @@
+package common
+
+import (
+	"fmt"
+	"net/http"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// fdCountInterval bounds how often the open file descriptors are counted, since counting them
+// reads a directory with one entry per descriptor
+const fdCountInterval = 100 * time.Millisecond
+
+// ResourceStatus represents the goroutine and file descriptor usage of a server and its caps
+type ResourceStatus struct {
+	Goroutines         int            `json:"Goroutines"`         // The number of goroutines
+	MaxGoroutines      int            `json:"MaxGoroutines"`      // The goroutine cap above which requests are rejected, 0 for none
+	OpenFDs            int            `json:"OpenFDs"`            // The number of open file descriptors, -1 if unknown
+	MaxFDs             int            `json:"MaxFDs"`             // The file descriptor cap above which requests are rejected, 0 for none
+	FDLimit            uint64         `json:"FDLimit"`            // The soft RLIMIT_NOFILE of the process, 0 if unknown
+	SocketStates       map[string]int `json:"SocketStates"`       // The number of sockets of the process per protocol and state, e.g. tcp/ESTABLISHED
+	RejectedGoroutines uint64         `json:"RejectedGoroutines"` // The requests rejected over the goroutine cap since the server started
+	RejectedFDs        uint64         `json:"RejectedFDs"`        // The requests rejected over the file descriptor cap since the server started
+	ErrorMessage       string         `json:"ErrorMessage"`       // Why part of the status could not be collected, if any
+}
+
+// SocketStats represents the TCP sockets of the ports of a server and the listen queue counters of
+// its network namespace, to understand the server-side saturation during load tests
+type SocketStats struct {
+	Ports            []int            `json:"Ports"`            // The TCP ports of the server
+	States           map[string]int   `json:"States"`           // The sockets of the ports per state, including TIME_WAIT
+	AcceptQueue      map[string]int   `json:"AcceptQueue"`      // The connections waiting to be accepted, per listening address
+	AcceptQueueLimit int              `json:"AcceptQueueLimit"` // net.core.somaxconn, which caps the backlog Go listens with, 0 if unknown
+	ListenCounters   map[string]int64 `json:"ListenCounters"`   // The TcpExt counters of listen overflows and backlog drops of the network namespace
+	ErrorMessage     string           `json:"ErrorMessage"`     // Why part of the stats could not be collected, if any
+}
+
+// ResourceGuard tracks the goroutines and file descriptors of the server, and rejects new requests
+// while they exceed their caps, so a runaway test gets a clear rejection instead of the confusing
+// failures of an exhausted process (accept errors, failed DNS lookups, unopenable files).
+type ResourceGuard struct {
+	maxGoroutines int
+	maxFDs        int
+
+	rejectedGoroutines atomic.Uint64
+	rejectedFDs        atomic.Uint64
+
+	mutex     sync.Mutex
+	openFDs   int
+	countedAt time.Time
+}
+
+// NewResourceGuard creates a ResourceGuard with the given caps, 0 disables a cap
+func NewResourceGuard(maxGoroutines, maxFDs int) *ResourceGuard {
+	return &ResourceGuard{maxGoroutines: maxGoroutines, maxFDs: maxFDs}
+}
+
+// Admit returns an error when a new request must be rejected because the server is over one of its caps
+func (g *ResourceGuard) Admit() error {
+	if g.maxGoroutines > 0 {
+		if goroutines := runtime.NumGoroutine(); goroutines > g.maxGoroutines {
+			g.rejectedGoroutines.Add(1)
+			return fmt.Errorf("too many goroutines: %d over the cap of %d", goroutines, g.maxGoroutines)
+		}
+	}
+	if g.maxFDs > 0 {
+		if openFDs := g.countFDs(); openFDs > g.maxFDs {
+			g.rejectedFDs.Add(1)
+			return fmt.Errorf("too many open file descriptors: %d over the cap of %d", openFDs, g.maxFDs)
+		}
+	}
+	return nil
+}
+
+// countFDs returns the number of open file descriptors, counted at most every fdCountInterval
+func (g *ResourceGuard) countFDs() int {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	if time.Since(g.countedAt) >= fdCountInterval {
+		openFDs, err := CountOpenFDs()
+		if err != nil {
+			openFDs = -1
+		}
+		g.openFDs, g.countedAt = openFDs, time.Now()
+	}
+	return g.openFDs
+}
+
+// Status returns the current usage, counting the file descriptors and sockets afresh
+func (g *ResourceGuard) Status() ResourceStatus {
+	status := ResourceStatus{
+		Goroutines:         runtime.NumGoroutine(),
+		MaxGoroutines:      g.maxGoroutines,
+		OpenFDs:            -1,
+		MaxFDs:             g.maxFDs,
+		RejectedGoroutines: g.rejectedGoroutines.Load(),
+		RejectedFDs:        g.rejectedFDs.Load(),
+	}
+
+	var errs []string
+	if openFDs, err := CountOpenFDs(); err != nil {
+		errs = append(errs, err.Error())
+	} else {
+		status.OpenFDs = openFDs
+	}
+	if limit, err := FDLimit(); err != nil {
+		errs = append(errs, err.Error())
+	} else {
+		status.FDLimit = limit
+	}
+	if states, err := SocketStates(); err != nil {
+		errs = append(errs, err.Error())
+	} else {
+		status.SocketStates = states
+	}
+	if len(errs) > 0 {
+		status.ErrorMessage = fmt.Sprint(errs)
+	}
+	return status
+}
+
+// Guard wraps an HTTP handler to reject requests with 503 while the server is over one of its caps.
+// The rejected connection is closed, to release its file descriptor.
+func (g *ResourceGuard) Guard(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := g.Admit(); err != nil {
+			w.Header().Set("Connection", "close")
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "Server overloaded: "+err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,264 @@
+//go:build linux
+
+package common
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// tcpStates maps the hexadecimal states of /proc/net/tcp to their names
+var tcpStates = map[string]string{
+	"01": "ESTABLISHED",
+	"02": "SYN_SENT",
+	"03": "SYN_RECV",
+	"04": "FIN_WAIT1",
+	"05": "FIN_WAIT2",
+	"06": "TIME_WAIT",
+	"07": "CLOSE",
+	"08": "CLOSE_WAIT",
+	"09": "LAST_ACK",
+	"0A": "LISTEN",
+	"0B": "CLOSING",
+}
+
+// CountOpenFDs returns the number of open file descriptors of the process
+func CountOpenFDs() (int, error) {
+	dir, err := os.Open("/proc/self/fd")
+	if err != nil {
+		return 0, err
+	}
+	defer dir.Close()
+
+	names, err := dir.Readdirnames(-1)
+	if err != nil {
+		return 0, err
+	}
+	// The directory itself is open while it is read
+	return len(names) - 1, nil
+}
+
+// FDLimit returns the soft limit of open file descriptors of the process
+func FDLimit() (uint64, error) {
+	var limit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &limit); err != nil {
+		return 0, err
+	}
+	return limit.Cur, nil
+}
+
+// SocketStates returns the number of sockets of the process per protocol and state, e.g.
+// tcp/ESTABLISHED or udp/UNCONN. The sockets of the process are the socket inodes of its file
+// descriptors, looked up in the socket tables of its network namespace. Sockets in TIME_WAIT
+// no longer belong to a descriptor and are not counted.
+func SocketStates() (map[string]int, error) {
+	entries, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		return nil, err
+	}
+	inodes := make(map[string]bool)
+	for _, entry := range entries {
+		link, err := os.Readlink("/proc/self/fd/" + entry.Name())
+		if err == nil && strings.HasPrefix(link, "socket:[") {
+			inodes[strings.TrimSuffix(strings.TrimPrefix(link, "socket:["), "]")] = true
+		}
+	}
+
+	states := make(map[string]int)
+	found := 0
+	for _, table := range []string{"tcp", "tcp6", "udp", "udp6"} {
+		protocol := strings.TrimSuffix(table, "6")
+		err := readSocketTable("/proc/self/net/"+table, func(fields []string) {
+			state, inode := fields[3], fields[9]
+			if !inodes[inode] {
+				return
+			}
+			name := tcpStates[state]
+			if protocol == "udp" {
+				// UDP sockets are either connected or not
+				name = "UNCONN"
+				if state == "01" {
+					name = "CONNECTED"
+				}
+			}
+			if name == "" {
+				name = state
+			}
+			states[protocol+"/"+name]++
+			found++
+		})
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	if other := len(inodes) - found; other > 0 {
+		states["other"] = other
+	}
+	return states, nil
+}
+
+// ServerSocketStats returns the TCP sockets of the given local ports per state, the accept queue of
+// their listening sockets and the listen drop counters. Unlike SocketStates, the sockets are matched
+// by port, so the TIME_WAIT sockets of the server are counted too.
+func ServerSocketStats(ports []int) SocketStats {
+	stats := SocketStats{
+		Ports:          ports,
+		States:         make(map[string]int),
+		AcceptQueue:    make(map[string]int),
+		ListenCounters: make(map[string]int64),
+	}
+	serverPorts := make(map[int]bool)
+	for _, port := range ports {
+		serverPorts[port] = true
+	}
+
+	var errs []string
+	for _, table := range []string{"tcp", "tcp6"} {
+		err := readSocketTable("/proc/self/net/"+table, func(fields []string) {
+			ip, port, err := parseProcAddress(fields[1])
+			if err != nil || !serverPorts[port] {
+				return
+			}
+			name := tcpStates[fields[3]]
+			if name == "" {
+				name = fields[3]
+			}
+			stats.States[name]++
+			// rx_queue of a listening socket is the length of its accept queue
+			if name == "LISTEN" {
+				queues := strings.SplitN(fields[4], ":", 2)
+				if len(queues) == 2 {
+					if length, err := strconv.ParseInt(queues[1], 16, 64); err == nil {
+						stats.AcceptQueue[net.JoinHostPort(ip.String(), strconv.Itoa(port))] = int(length)
+					}
+				}
+			}
+		})
+		if err != nil && !os.IsNotExist(err) {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	if data, err := os.ReadFile("/proc/sys/net/core/somaxconn"); err != nil {
+		errs = append(errs, err.Error())
+	} else {
+		stats.AcceptQueueLimit, _ = strconv.Atoi(strings.TrimSpace(string(data)))
+	}
+
+	counters, err := readNetstatCounters("/proc/self/net/netstat", "TcpExt")
+	if err != nil {
+		errs = append(errs, err.Error())
+	}
+	for _, name := range listenCounters {
+		if value, ok := counters[name]; ok {
+			stats.ListenCounters[name] = value
+		}
+	}
+
+	if len(errs) > 0 {
+		stats.ErrorMessage = fmt.Sprint(errs)
+	}
+	return stats
+}
+
+// listenCounters are the TcpExt counters of the connections dropped before they were accepted
+var listenCounters = []string{
+	"ListenOverflows",      // The accept queue was full
+	"ListenDrops",          // All drops of incoming connections, including the overflows
+	"TCPBacklogDrop",       // Segments dropped since the socket backlog was full
+	"TCPReqQFullDrop",      // SYNs dropped since the SYN queue was full, without syncookies
+	"TCPReqQFullDoCookies", // SYNs answered with syncookies since the SYN queue was full
+	"SyncookiesSent",       // The syncookies sent
+	"SyncookiesFailed",     // The invalid syncookies received
+}
+
+// readNetstatCounters returns the counters of a section of /proc/net/netstat or /proc/net/snmp,
+// where a line of names is followed by a line of values with the same prefix
+func readNetstatCounters(path, section string) (map[string]int64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	lines := strings.Split(string(data), "\n")
+	for i := 0; i+1 < len(lines); i++ {
+		names, values := strings.Fields(lines[i]), strings.Fields(lines[i+1])
+		if len(names) == 0 || names[0] != section+":" || len(values) != len(names) || values[0] != names[0] {
+			continue
+		}
+		counters := make(map[string]int64)
+		for j := 1; j < len(names); j++ {
+			if value, err := strconv.ParseInt(values[j], 10, 64); err == nil {
+				counters[names[j]] = value
+			}
+		}
+		return counters, nil
+	}
+	return nil, fmt.Errorf("no %s counters in %s", section, path)
+}
+
+// parseProcAddress parses an address of a /proc/net socket table, e.g. 0100007F:1F90, where the IP
+// is in 32-bit words of host byte order
+func parseProcAddress(address string) (net.IP, int, error) {
+	hexIP, hexPort, ok := strings.Cut(address, ":")
+	if !ok {
+		return nil, 0, fmt.Errorf("invalid address %q", address)
+	}
+	port, err := strconv.ParseUint(hexPort, 16, 16)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid port in %q", address)
+	}
+	raw, err := hex.DecodeString(hexIP)
+	if err != nil || (len(raw) != net.IPv4len && len(raw) != net.IPv6len) {
+		return nil, 0, fmt.Errorf("invalid IP in %q", address)
+	}
+	ip := make(net.IP, len(raw))
+	for word := 0; word < len(raw); word += 4 {
+		binary.BigEndian.PutUint32(ip[word:], binary.NativeEndian.Uint32(raw[word:]))
+	}
+	return ip, int(port), nil
+}
+
+// readSocketTable calls fn with the fields of each socket of a /proc/net socket table, e.g. the
+// local address, the state and the inode as fields[1], fields[3] and fields[9]
+func readSocketTable(path string, fn func(fields []string)) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Scan() // Skip the header
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 10 {
+			continue
+		}
+		if _, err := strconv.ParseUint(fields[9], 10, 64); err != nil {
+			return fmt.Errorf("invalid inode in %s: %q", path, fields[9])
+		}
+		fn(fields)
+	}
+	return scanner.Err()
+}
+
+// clockThreadCPUTime is CLOCK_THREAD_CPUTIME_ID, see include/uapi/linux/time.h
+const clockThreadCPUTime = 3
+
+// ThreadCPUTime returns the CPU time consumed by the calling OS thread
+func ThreadCPUTime() (time.Duration, bool) {
+	var ts syscall.Timespec
+	if _, _, errno := syscall.Syscall(syscall.SYS_CLOCK_GETTIME, clockThreadCPUTime, uintptr(unsafe.Pointer(&ts)), 0); errno != 0 {
+		return 0, false
+	}
+	return time.Duration(ts.Nano()), true
+}
@@ -0,0 +1,33 @@
+//go:build !linux
+
+package common
+
+import (
+	"fmt"
+	"time"
+)
+
+// CountOpenFDs is only supported on Linux
+func CountOpenFDs() (int, error) {
+	return 0, fmt.Errorf("counting open file descriptors is not supported on this platform")
+}
+
+// FDLimit is only supported on Linux
+func FDLimit() (uint64, error) {
+	return 0, fmt.Errorf("reading the file descriptor limit is not supported on this platform")
+}
+
+// SocketStates is only supported on Linux
+func SocketStates() (map[string]int, error) {
+	return nil, fmt.Errorf("reading socket states is not supported on this platform")
+}
+
+// ServerSocketStats is only supported on Linux
+func ServerSocketStats(ports []int) SocketStats {
+	return SocketStats{Ports: ports, ErrorMessage: "reading socket statistics is not supported on this platform"}
+}
+
+// ThreadCPUTime is only supported on Linux and never reports any value
+func ThreadCPUTime() (time.Duration, bool) {
+	return 0, false
+}
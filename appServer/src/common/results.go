@@ -0,0 +1,123 @@
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// resultsQueueSize bounds the reports waiting to be pushed, further reports are dropped
+const resultsQueueSize = 1000
+
+// ResultsPusher pushes JSON reports to the results server in the background, batched as JSON lines.
+// A nil pusher drops the reports, and a slow or unreachable results server never blocks the caller.
+type ResultsPusher struct {
+	endpoint string
+	client   *http.Client
+	queue    chan []byte
+	dropped  atomic.Int64
+}
+
+// NewResultsPusher creates a ResultsPusher posting the reports of a kind and source to the results
+// server at serverURL, e.g. http://results:8095, at most once per interval
+func NewResultsPusher(serverURL, kind, source string, interval time.Duration) *ResultsPusher {
+	p := &ResultsPusher{
+		endpoint: ResultsEndpoint(serverURL, kind, source, nil),
+		client:   &http.Client{Timeout: 10 * time.Second},
+		queue:    make(chan []byte, resultsQueueSize),
+	}
+	go p.loop(interval)
+	return p
+}
+
+// ResultsEndpoint returns the URL of the push API of the results server for a kind and source of reports
+func ResultsEndpoint(serverURL, kind, source string, exitCode *int) string {
+	query := url.Values{"kind": {kind}, "source": {source}}
+	if exitCode != nil {
+		query.Set("exit-code", strconv.Itoa(*exitCode))
+	}
+	return serverURL + "/api/reports?" + query.Encode()
+}
+
+// Push queues a report, or drops it when the queue is full
+func (p *ResultsPusher) Push(report interface{}) {
+	if p == nil {
+		return
+	}
+	data, err := json.Marshal(report)
+	if err != nil {
+		return
+	}
+	select {
+	case p.queue <- data:
+	default:
+		p.dropped.Add(1)
+	}
+}
+
+// loop posts the queued reports every interval
+func (p *ResultsPusher) loop(interval time.Duration) {
+	for range time.Tick(interval) {
+		if dropped := p.dropped.Swap(0); dropped > 0 {
+			log.Printf("Dropped %d reports, the results server does not keep up", dropped)
+		}
+		var batch bytes.Buffer
+		for pending := len(p.queue); pending > 0; pending-- {
+			batch.Write(<-p.queue)
+			batch.WriteByte('\n')
+		}
+		if batch.Len() == 0 {
+			continue
+		}
+		if err := PostResults(p.client, p.endpoint, batch.Bytes()); err != nil {
+			log.Printf("Unable to push the reports to the results server: %v", err)
+		}
+	}
+}
+
+// PostResults posts reports, a JSON document or JSON lines, to a push endpoint of the results server
+func PostResults(client *http.Client, endpoint string, reports []byte) error {
+	resp, err := client.Post(endpoint, "application/json", bytes.NewReader(reports))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("the results server returned %s", resp.Status)
+	}
+	return nil
+}
+
+// SummarizeReport returns the scalar top-level fields of a JSON report: numbers, booleans and
+// short strings. Other reports (e.g. CSV) have no summary.
+func SummarizeReport(report []byte) map[string]string {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(bytes.TrimSpace(report), &fields); err != nil {
+		return nil
+	}
+
+	summary := make(map[string]string)
+	for key, raw := range fields {
+		var value interface{}
+		if err := json.Unmarshal(raw, &value); err != nil {
+			continue
+		}
+		switch v := value.(type) {
+		case float64:
+			summary[key] = strconv.FormatFloat(v, 'f', -1, 64)
+		case bool:
+			summary[key] = strconv.FormatBool(v)
+		case string:
+			if v != "" && len(v) <= 64 {
+				summary[key] = v
+			}
+		}
+	}
+	return summary
+}
@@ -0,0 +1,150 @@
+package common
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"log"
+	"net"
+	"strings"
+	"time"
+)
+
+// The protocols detected by a SniffListener from the first bytes of a connection
+const (
+	SniffedHTTP1 = "http1" // An HTTP/1.x request line
+	SniffedH2C   = "h2c"   // The HTTP/2 connection preface, i.e. HTTP/2 with prior knowledge
+	SniffedTLS   = "tls"   // A TLS handshake record, i.e. a client expecting HTTPS
+	SniffedRaw   = "raw"   // Anything else, or nothing sent within the sniff timeout
+)
+
+// http2Preface is the client connection preface of HTTP/2 (RFC 9113)
+const http2Preface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+// httpMethods are the methods starting an HTTP/1.x request line
+var httpMethods = []string{"GET ", "HEAD ", "POST ", "PUT ", "DELETE ", "CONNECT ", "OPTIONS ", "TRACE ", "PATCH "}
+
+// SniffedConn is a connection whose first bytes were read to detect its protocol. They are
+// replayed to the reader of the connection.
+type SniffedConn struct {
+	net.Conn
+	Protocol string // The detected protocol: SniffedHTTP1, SniffedH2C, SniffedTLS or SniffedRaw
+	reader   *bufio.Reader
+}
+
+// Read reads the sniffed bytes first, then the connection
+func (c *SniffedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// SniffListener serves several protocols on a single port, like cmux does: it detects the protocol
+// of each accepted connection from its first bytes, returns the HTTP/1 and h2c connections from
+// Accept for an http.Server, and passes the others (raw and TLS) to a raw handler. Connections are sniffed in
+// their own goroutine, so a silent client does not hold the others back.
+type SniffListener struct {
+	net.Listener
+	timeout time.Duration
+	raw     func(*SniffedConn)
+	conns   chan net.Conn
+	done    chan struct{}
+	err     error
+}
+
+// NewSniffListener wraps listener, handling the raw connections with raw. A client that sends
+// nothing within timeout is considered raw, since HTTP clients speak first.
+func NewSniffListener(listener net.Listener, timeout time.Duration, raw func(*SniffedConn)) *SniffListener {
+	l := &SniffListener{Listener: listener, timeout: timeout, raw: raw, conns: make(chan net.Conn), done: make(chan struct{})}
+	go l.loop()
+	return l
+}
+
+// Accept returns the next HTTP/1 or h2c connection
+func (l *SniffListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, l.err
+	}
+}
+
+// loop accepts the connections and sniffs each of them in its own goroutine
+func (l *SniffListener) loop() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			if isTimeout(err) {
+				continue
+			}
+			l.err = err
+			close(l.done)
+			return
+		}
+		go func() {
+			sniffed := l.sniff(conn)
+			if sniffed.Protocol != SniffedHTTP1 && sniffed.Protocol != SniffedH2C {
+				l.raw(sniffed)
+				return
+			}
+			select {
+			case l.conns <- sniffed:
+			case <-l.done:
+				conn.Close()
+			}
+		}()
+	}
+}
+
+// sniff reads the first bytes of a connection until they tell its protocol
+func (l *SniffListener) sniff(conn net.Conn) *SniffedConn {
+	sniffed := &SniffedConn{Conn: conn, Protocol: SniffedRaw, reader: bufio.NewReader(conn)}
+	conn.SetReadDeadline(time.Now().Add(l.timeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	for n := 1; n <= len(http2Preface); n++ {
+		data, err := sniffed.reader.Peek(n)
+		if err != nil {
+			if !isTimeout(err) {
+				log.Printf("Unable to sniff the protocol of %s: %v", conn.RemoteAddr(), err)
+			}
+			return sniffed
+		}
+		protocol, complete := SniffProtocol(data)
+		if complete {
+			sniffed.Protocol = protocol
+			return sniffed
+		}
+	}
+	return sniffed
+}
+
+// SniffProtocol detects the protocol of a connection from its first bytes, and reports whether
+// the bytes are enough to tell
+func SniffProtocol(data []byte) (string, bool) {
+	if len(data) > 0 && data[0] == 0x16 {
+		return SniffedTLS, true
+	}
+	if bytes.HasPrefix(data, []byte(http2Preface)) {
+		return SniffedH2C, true
+	}
+	if strings.HasPrefix(http2Preface, string(data)) {
+		return "", false
+	}
+	undecided := false
+	for _, method := range httpMethods {
+		if bytes.HasPrefix(data, []byte(method)) {
+			return SniffedHTTP1, true
+		}
+		undecided = undecided || strings.HasPrefix(method, string(data))
+	}
+	if undecided {
+		return "", false
+	}
+	return SniffedRaw, true
+}
+
+// isTimeout reports whether err is a timeout of a deadline
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
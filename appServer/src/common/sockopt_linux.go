@@ -0,0 +1,335 @@
+//go:build linux
+
+package common
+
+import (
+	"encoding/binary"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// IPv6 flow label socket options, see include/uapi/linux/in6.h
+const (
+	ipv6FlowInfo       = 0xb
+	ipv6FlowLabelMgr   = 0x20
+	ipv6FlowLabelMask  = 0xfffff
+	ipv6FlowLabelGet   = 0   // IPV6_FL_A_GET
+	ipv6FlowLabelAny   = 255 // IPV6_FL_S_ANY
+	ipv6FlowLabelNew   = 1   // IPV6_FL_F_CREATE
+	flowLabelReqLength = 32  // sizeof(struct in6_flowlabel_req)
+)
+
+// UDP checksum socket options, see include/uapi/linux/udp.h
+const (
+	udpNoCheck6Tx = 101
+	udpNoCheck6Rx = 102
+)
+
+// SO_TIMESTAMPING flags, see include/uapi/linux/net_tstamp.h
+const (
+	sofTimestampingRxHardware  = 1 << 2
+	sofTimestampingRxSoftware  = 1 << 3
+	sofTimestampingSoftware    = 1 << 4
+	sofTimestampingRawHardware = 1 << 6
+)
+
+// IPQoSControl returns a net.Dialer Control function that sets the outgoing
+// TTL (IPv4) or hop limit (IPv6) and the DSCP bits of the TOS / traffic class.
+// A value of 0 leaves the kernel default untouched. When recv is true the
+// socket is also asked to deliver the TTL and TOS of received packets as
+// control messages, see ParseIPQoS. On IPv6 sockets the flow label of received
+// packets is requested too, see ParseFlowLabel.
+func IPQoSControl(ttl, dscp int, recv bool) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		ipv6 := strings.HasSuffix(network, "6")
+
+		var sockErr error
+		err := c.Control(func(fd uintptr) {
+			setInt := func(level, opt, value int) {
+				if sockErr == nil {
+					sockErr = syscall.SetsockoptInt(int(fd), level, opt, value)
+				}
+			}
+
+			if ipv6 {
+				if ttl > 0 {
+					setInt(syscall.IPPROTO_IPV6, syscall.IPV6_UNICAST_HOPS, ttl)
+				}
+				if dscp > 0 {
+					setInt(syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS, dscp<<2)
+				}
+				if recv {
+					setInt(syscall.IPPROTO_IPV6, syscall.IPV6_RECVHOPLIMIT, 1)
+					setInt(syscall.IPPROTO_IPV6, syscall.IPV6_RECVTCLASS, 1)
+					setInt(syscall.IPPROTO_IPV6, ipv6FlowInfo, 1)
+				}
+				return
+			}
+
+			if ttl > 0 {
+				setInt(syscall.IPPROTO_IP, syscall.IP_TTL, ttl)
+			}
+			if dscp > 0 {
+				setInt(syscall.IPPROTO_IP, syscall.IP_TOS, dscp<<2)
+			}
+			if recv {
+				setInt(syscall.IPPROTO_IP, syscall.IP_RECVTTL, 1)
+				setInt(syscall.IPPROTO_IP, syscall.IP_RECVTOS, 1)
+			}
+		})
+		if err != nil {
+			return err
+		}
+		return sockErr
+	}
+}
+
+// ParseIPQoS extracts the TTL / hop limit and DSCP of a received packet from
+// the control messages returned by ReadMsgUDP. The returned flags report
+// whether each value was present.
+func ParseIPQoS(oob []byte) (ttl int, ttlOK bool, dscp int, dscpOK bool) {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return 0, false, 0, false
+	}
+
+	for _, msg := range msgs {
+		switch {
+		case msg.Header.Level == syscall.IPPROTO_IP && msg.Header.Type == syscall.IP_TTL && len(msg.Data) >= 4:
+			ttl, ttlOK = int(binary.NativeEndian.Uint32(msg.Data)), true
+		case msg.Header.Level == syscall.IPPROTO_IP && msg.Header.Type == syscall.IP_TOS && len(msg.Data) >= 1:
+			dscp, dscpOK = int(msg.Data[0])>>2, true
+		case msg.Header.Level == syscall.IPPROTO_IPV6 && msg.Header.Type == syscall.IPV6_HOPLIMIT && len(msg.Data) >= 4:
+			ttl, ttlOK = int(binary.NativeEndian.Uint32(msg.Data)), true
+		case msg.Header.Level == syscall.IPPROTO_IPV6 && msg.Header.Type == syscall.IPV6_TCLASS && len(msg.Data) >= 4:
+			dscp, dscpOK = int(binary.NativeEndian.Uint32(msg.Data))>>2, true
+		}
+	}
+	return ttl, ttlOK, dscp, dscpOK
+}
+
+// EnableFlowLabelRecv asks the kernel to deliver the flow label of received IPv6
+// packets as a control message, see ParseFlowLabel
+func EnableFlowLabelRecv(conn *net.UDPConn) error {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var sockErr error
+	err = rawConn.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, ipv6FlowInfo, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// ParseFlowLabel extracts the flow label of a received IPv6 packet from the control
+// messages returned by ReadMsgUDP. The returned flag reports whether it was present.
+func ParseFlowLabel(oob []byte) (int, bool) {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return 0, false
+	}
+
+	for _, msg := range msgs {
+		if msg.Header.Level == syscall.IPPROTO_IPV6 && msg.Header.Type == ipv6FlowInfo && len(msg.Data) >= 4 {
+			return int(binary.BigEndian.Uint32(msg.Data) & ipv6FlowLabelMask), true
+		}
+	}
+	return 0, false
+}
+
+// FlowLabelOOB prepares conn to send IPv6 packets to dst with the given flow label and
+// returns the control message to pass to WriteMsgUDP. The label is leased from the
+// kernel flow label manager when possible; recent kernels accept unleased labels too.
+func FlowLabelOOB(conn *net.UDPConn, dst net.IP, label int) ([]byte, error) {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	// struct in6_flowlabel_req: flr_dst, flr_label, flr_action, flr_share, flr_flags, ...
+	req := make([]byte, flowLabelReqLength)
+	copy(req[0:16], dst.To16())
+	binary.BigEndian.PutUint32(req[16:20], uint32(label))
+	req[20] = ipv6FlowLabelGet
+	req[21] = ipv6FlowLabelAny
+	binary.NativeEndian.PutUint16(req[22:24], ipv6FlowLabelNew)
+	rawConn.Control(func(fd uintptr) {
+		// Best effort, labels in the stateless range cannot be leased
+		syscall.SetsockoptString(int(fd), syscall.IPPROTO_IPV6, ipv6FlowLabelMgr, string(req))
+	})
+
+	oob := make([]byte, syscall.CmsgSpace(4))
+	header := (*syscall.Cmsghdr)(unsafe.Pointer(&oob[0]))
+	header.Level = syscall.IPPROTO_IPV6
+	header.Type = ipv6FlowInfo
+	header.SetLen(syscall.CmsgLen(4))
+	binary.BigEndian.PutUint32(oob[syscall.CmsgLen(0):], uint32(label)&ipv6FlowLabelMask)
+	return oob, nil
+}
+
+// EnableRxTimestamps asks the kernel to deliver the receive timestamp of each packet as a
+// control message, see ParseRxTimestamp. Hardware timestamps are requested as well, but the
+// NIC only generates them once hardware timestamping is enabled on it (e.g. hwstamp_ctl -r 1).
+// Kernels without SO_TIMESTAMPING fall back to software timestamps with SO_TIMESTAMPNS.
+func EnableRxTimestamps(conn *net.UDPConn) error {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var sockErr error
+	err = rawConn.Control(func(fd uintptr) {
+		flags := sofTimestampingRxHardware | sofTimestampingRxSoftware | sofTimestampingSoftware | sofTimestampingRawHardware
+		if sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_TIMESTAMPING, flags); sockErr != nil {
+			sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_TIMESTAMPNS, 1)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// GetTCPSocketOptions reads back the Nagle, keepalive and linger options of a TCP connection
+// from the kernel, to report what was actually applied
+func GetTCPSocketOptions(conn *net.TCPConn) (TCPSocketOptions, error) {
+	var options TCPSocketOptions
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return options, err
+	}
+
+	var sockErr error
+	err = rawConn.Control(func(fd uintptr) {
+		getInt := func(level, opt int) int {
+			value, err := syscall.GetsockoptInt(int(fd), level, opt)
+			if err != nil && sockErr == nil {
+				sockErr = err
+			}
+			return value
+		}
+		options.NoDelay = getInt(syscall.IPPROTO_TCP, syscall.TCP_NODELAY) != 0
+		options.KeepAlive = getInt(syscall.SOL_SOCKET, syscall.SO_KEEPALIVE) != 0
+		options.KeepIdleSec = getInt(syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE)
+		options.KeepIntervalSec = getInt(syscall.IPPROTO_TCP, syscall.TCP_KEEPINTVL)
+
+		var linger syscall.Linger
+		size := uint32(unsafe.Sizeof(linger))
+		_, _, errno := syscall.Syscall6(syscall.SYS_GETSOCKOPT, fd, syscall.SOL_SOCKET, syscall.SO_LINGER,
+			uintptr(unsafe.Pointer(&linger)), uintptr(unsafe.Pointer(&size)), 0)
+		if errno != 0 && sockErr == nil {
+			sockErr = errno
+		}
+		options.Linger = linger.Onoff != 0
+		options.LingerSec = int(linger.Linger)
+	})
+	if err != nil {
+		return options, err
+	}
+	return options, sockErr
+}
+
+// SetUDP6ZeroChecksum lets the socket accept IPv6 packets with a zero UDP checksum (rx), as
+// tunnels do per RFC 6936, and send its own IPv6 packets with a zero checksum (tx). Without rx
+// the kernel drops such packets and counts them as Udp6InCsumErrors.
+func SetUDP6ZeroChecksum(conn *net.UDPConn, rx, tx bool) error {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var sockErr error
+	err = rawConn.Control(func(fd uintptr) {
+		if rx {
+			sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_UDP, udpNoCheck6Rx, 1)
+		}
+		if tx && sockErr == nil {
+			sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_UDP, udpNoCheck6Tx, 1)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// ReadUDPChecksumErrors returns the number of UDP packets the kernel dropped for a bad checksum
+// over IPv4 and IPv6, counted for the whole network namespace in /proc/net/snmp and snmp6
+func ReadUDPChecksumErrors() (uint64, uint64, error) {
+	var ipv4, ipv6 uint64
+
+	data, err := os.ReadFile("/proc/net/snmp")
+	if err != nil {
+		return 0, 0, err
+	}
+	var header []string
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || fields[0] != "Udp:" {
+			continue
+		}
+		if header == nil {
+			header = fields
+			continue
+		}
+		for i, name := range header {
+			if name == "InCsumErrors" && i < len(fields) {
+				ipv4, _ = strconv.ParseUint(fields[i], 10, 64)
+			}
+		}
+		break
+	}
+
+	data, err = os.ReadFile("/proc/net/snmp6")
+	if err != nil {
+		return ipv4, 0, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if fields := strings.Fields(line); len(fields) == 2 && fields[0] == "Udp6InCsumErrors" {
+			ipv6, _ = strconv.ParseUint(fields[1], 10, 64)
+		}
+	}
+	return ipv4, ipv6, nil
+}
+
+// ParseRxTimestamp extracts the receive timestamp of a packet from the control messages
+// returned by ReadMsgUDP, preferring the raw hardware timestamp over the software one.
+// The returned source is "hardware" or "software"; the flag reports whether it was present.
+func ParseRxTimestamp(oob []byte) (time.Time, string, bool) {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return time.Time{}, "", false
+	}
+
+	size := int(unsafe.Sizeof(syscall.Timespec{}))
+	for _, msg := range msgs {
+		if msg.Header.Level != syscall.SOL_SOCKET {
+			continue
+		}
+		switch {
+		case msg.Header.Type == syscall.SO_TIMESTAMPING && len(msg.Data) >= 3*size:
+			// struct scm_timestamping: ts[0] is the software timestamp, ts[2] the raw hardware one
+			stamps := (*[3]syscall.Timespec)(unsafe.Pointer(&msg.Data[0]))
+			if stamps[2].Sec != 0 || stamps[2].Nsec != 0 {
+				return time.Unix(stamps[2].Unix()), "hardware", true
+			}
+			if stamps[0].Sec != 0 || stamps[0].Nsec != 0 {
+				return time.Unix(stamps[0].Unix()), "software", true
+			}
+		case msg.Header.Type == syscall.SO_TIMESTAMPNS && len(msg.Data) >= size:
+			stamp := (*syscall.Timespec)(unsafe.Pointer(&msg.Data[0]))
+			return time.Unix(stamp.Unix()), "software", true
+		}
+	}
+	return time.Time{}, "", false
+}
@@ -0,0 +1,65 @@
+//go:build !linux
+
+package common
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+)
+
+// IPQoSControl is only supported on Linux; it fails when a TTL or DSCP is requested
+func IPQoSControl(ttl, dscp int, recv bool) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		if ttl > 0 || dscp > 0 {
+			return fmt.Errorf("setting TTL/DSCP is not supported on this platform")
+		}
+		return nil
+	}
+}
+
+// ParseIPQoS is only supported on Linux and never reports any value
+func ParseIPQoS(oob []byte) (ttl int, ttlOK bool, dscp int, dscpOK bool) {
+	return 0, false, 0, false
+}
+
+// EnableFlowLabelRecv is only supported on Linux
+func EnableFlowLabelRecv(conn *net.UDPConn) error {
+	return fmt.Errorf("receiving IPv6 flow labels is not supported on this platform")
+}
+
+// ParseFlowLabel is only supported on Linux and never reports any value
+func ParseFlowLabel(oob []byte) (int, bool) {
+	return 0, false
+}
+
+// FlowLabelOOB is only supported on Linux
+func FlowLabelOOB(conn *net.UDPConn, dst net.IP, label int) ([]byte, error) {
+	return nil, fmt.Errorf("setting IPv6 flow labels is not supported on this platform")
+}
+
+// EnableRxTimestamps is only supported on Linux
+func EnableRxTimestamps(conn *net.UDPConn) error {
+	return fmt.Errorf("receive timestamps are not supported on this platform")
+}
+
+// ParseRxTimestamp is only supported on Linux and never reports any value
+func ParseRxTimestamp(oob []byte) (time.Time, string, bool) {
+	return time.Time{}, "", false
+}
+
+// GetTCPSocketOptions is only supported on Linux
+func GetTCPSocketOptions(conn *net.TCPConn) (TCPSocketOptions, error) {
+	return TCPSocketOptions{}, fmt.Errorf("reading TCP socket options is not supported on this platform")
+}
+
+// SetUDP6ZeroChecksum is only supported on Linux
+func SetUDP6ZeroChecksum(conn *net.UDPConn, rx, tx bool) error {
+	return fmt.Errorf("zero UDP checksums are not supported on this platform")
+}
+
+// ReadUDPChecksumErrors is only supported on Linux
+func ReadUDPChecksumErrors() (uint64, uint64, error) {
+	return 0, 0, fmt.Errorf("UDP checksum counters are not supported on this platform")
+}
@@ -0,0 +1,171 @@
+package common
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// SyscallSamplesKept is the number of recent samples kept per operation to compute the percentiles
+const SyscallSamplesKept = 4096
+
+// SyscallLatency represents the latency distribution of one operation over its recent samples
+type SyscallLatency struct {
+	Count      uint64  `json:"Count"`      // The number of samples since the sampler started or was reset
+	Window     int     `json:"Window"`     // The number of recent samples the percentiles are computed on
+	MeanMicros float64 `json:"MeanMicros"` // The mean of the recent samples
+	P50Micros  float64 `json:"P50Micros"`  // The median of the recent samples
+	P90Micros  float64 `json:"P90Micros"`  // The 90th percentile of the recent samples
+	P99Micros  float64 `json:"P99Micros"`  // The 99th percentile of the recent samples
+	MaxMicros  float64 `json:"MaxMicros"`  // The maximum since the sampler started or was reset
+}
+
+// SyscallReport represents the latency distributions of the sampled operations of a server
+type SyscallReport struct {
+	Since      string                    `json:"Since"`      // When the sampler started or was last reset
+	Operations map[string]SyscallLatency `json:"Operations"` // The distributions per operation, e.g. read, write and handle
+}
+
+// syscallSamples is the ring buffer of the samples of one operation
+type syscallSamples struct {
+	ring  []time.Duration
+	next  int
+	count uint64
+	max   time.Duration
+}
+
+// SyscallSampler records how long the read and write syscalls of a server take, next to how long
+// the server takes to handle the requests ("handle"), to tell the delays of the kernel and the
+// datapath from the ones of the application at high load. A nil sampler records nothing.
+type SyscallSampler struct {
+	mutex      sync.Mutex
+	since      time.Time
+	operations map[string]*syscallSamples
+}
+
+// NewSyscallSampler creates an empty SyscallSampler
+func NewSyscallSampler() *SyscallSampler {
+	return &SyscallSampler{since: time.Now(), operations: make(map[string]*syscallSamples)}
+}
+
+// Observe records a sample of an operation
+func (s *SyscallSampler) Observe(operation string, d time.Duration) {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	samples := s.operations[operation]
+	if samples == nil {
+		samples = &syscallSamples{ring: make([]time.Duration, 0, SyscallSamplesKept)}
+		s.operations[operation] = samples
+	}
+	if len(samples.ring) < SyscallSamplesKept {
+		samples.ring = append(samples.ring, d)
+	} else {
+		samples.ring[samples.next] = d
+		samples.next = (samples.next + 1) % SyscallSamplesKept
+	}
+	samples.count++
+	if d > samples.max {
+		samples.max = d
+	}
+}
+
+// Report returns the latency distribution of each operation, and optionally resets the sampler
+func (s *SyscallSampler) Report(reset bool) SyscallReport {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	report := SyscallReport{Since: s.since.Format(time.RFC3339), Operations: make(map[string]SyscallLatency)}
+	for operation, samples := range s.operations {
+		sorted := append([]time.Duration(nil), samples.ring...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		var total time.Duration
+		for _, d := range sorted {
+			total += d
+		}
+		report.Operations[operation] = SyscallLatency{
+			Count:      samples.count,
+			Window:     len(sorted),
+			MeanMicros: micros(total / time.Duration(len(sorted))),
+			P50Micros:  micros(percentile(sorted, 0.50)),
+			P90Micros:  micros(percentile(sorted, 0.90)),
+			P99Micros:  micros(percentile(sorted, 0.99)),
+			MaxMicros:  micros(samples.max),
+		}
+	}
+
+	if reset {
+		s.since = time.Now()
+		s.operations = make(map[string]*syscallSamples)
+	}
+	return report
+}
+
+// percentile returns the nearest-rank percentile of sorted durations
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	rank := int(p*float64(len(sorted))+0.5) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	if rank >= len(sorted) {
+		rank = len(sorted) - 1
+	}
+	return sorted[rank]
+}
+
+// micros converts a duration to fractional microseconds
+func micros(d time.Duration) float64 {
+	return float64(d) / float64(time.Microsecond)
+}
+
+// sampledListener wraps the TCP connections it accepts into sampledConns
+type sampledListener struct {
+	net.Listener
+	sampler *SyscallSampler
+}
+
+// sampledConn is a TCP connection whose read and write syscalls are sampled
+type sampledConn struct {
+	*net.TCPConn
+	sampler *SyscallSampler
+}
+
+// SampledListener returns a listener whose TCP connections sample the duration of their read and
+// write syscalls. Reads only count the time spent in the syscalls, not the wait for the data to
+// arrive, while writes count the time of the whole call, including the waits for space in the send
+// buffer, which are backpressure from the datapath.
+func SampledListener(listener net.Listener, sampler *SyscallSampler) net.Listener {
+	return &sampledListener{Listener: listener, sampler: sampler}
+}
+
+func (l *sampledListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		return &sampledConn{TCPConn: tcpConn, sampler: l.sampler}, nil
+	}
+	return conn, nil
+}
+
+func (c *sampledConn) Write(b []byte) (int, error) {
+	start := time.Now()
+	n, err := c.TCPConn.Write(b)
+	c.sampler.Observe("write", time.Since(start))
+	return n, err
+}
+
+// UnwrapTCPConn returns the TCP connection of a connection accepted by a SampledListener, or the
+// connection itself when it is a TCP connection
+func UnwrapTCPConn(conn net.Conn) (*net.TCPConn, bool) {
+	if sampled, ok := conn.(*sampledConn); ok {
+		return sampled.TCPConn, true
+	}
+	tcpConn, ok := conn.(*net.TCPConn)
+	return tcpConn, ok
+}
@@ -0,0 +1,105 @@
+//go:build linux
+
+package common
+
+import (
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// CheckSyscallSampling returns an error when the syscalls cannot be sampled on this platform
+func CheckSyscallSampling() error {
+	return nil
+}
+
+// Read calls read(2) once the socket is readable and only samples the duration of the syscall
+func (c *sampledConn) Read(b []byte) (int, error) {
+	raw, err := c.TCPConn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+
+	var n int
+	var readErr error
+	err = raw.Read(func(fd uintptr) bool {
+		for {
+			start := time.Now()
+			n, readErr = syscall.Read(int(fd), b)
+			if readErr == syscall.EINTR {
+				continue
+			}
+			if readErr == syscall.EAGAIN {
+				return false // Wait until the socket is readable
+			}
+			c.sampler.Observe("read", time.Since(start))
+			return true
+		}
+	})
+	if err == nil {
+		err = readErr
+	}
+	if err != nil {
+		if _, ok := err.(syscall.Errno); ok {
+			err = os.NewSyscallError("read", err)
+		}
+		return 0, &net.OpError{Op: "read", Net: "tcp", Source: c.LocalAddr(), Addr: c.RemoteAddr(), Err: err}
+	}
+	if n == 0 && len(b) > 0 {
+		return 0, io.EOF
+	}
+	return n, nil
+}
+
+// ReadMsgUDPSampled works like conn.ReadMsgUDP, calling recvmsg(2) once the socket is readable,
+// and returns the duration of the syscall, which it also records as a "read" sample
+func ReadMsgUDPSampled(conn *net.UDPConn, b, oob []byte, sampler *SyscallSampler) (n, oobn, flags int, addr *net.UDPAddr, took time.Duration, err error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return 0, 0, 0, nil, 0, err
+	}
+
+	var from syscall.Sockaddr
+	var readErr error
+	err = raw.Read(func(fd uintptr) bool {
+		for {
+			start := time.Now()
+			n, oobn, flags, from, readErr = syscall.Recvmsg(int(fd), b, oob, 0)
+			if readErr == syscall.EINTR {
+				continue
+			}
+			if readErr == syscall.EAGAIN {
+				return false // Wait until the socket is readable
+			}
+			took = time.Since(start)
+			return true
+		}
+	})
+	if err == nil {
+		err = readErr
+	}
+	if err != nil {
+		if _, ok := err.(syscall.Errno); ok {
+			err = os.NewSyscallError("recvmsg", err)
+		}
+		return 0, 0, 0, nil, 0, &net.OpError{Op: "read", Net: "udp", Addr: conn.LocalAddr(), Err: err}
+	}
+	sampler.Observe("read", took)
+
+	switch sa := from.(type) {
+	case *syscall.SockaddrInet4:
+		addr = &net.UDPAddr{IP: net.IPv4(sa.Addr[0], sa.Addr[1], sa.Addr[2], sa.Addr[3]), Port: sa.Port}
+	case *syscall.SockaddrInet6:
+		addr = &net.UDPAddr{IP: append(net.IP(nil), sa.Addr[:]...), Port: sa.Port}
+		if sa.ZoneId != 0 {
+			addr.Zone = strconv.Itoa(int(sa.ZoneId))
+			if iface, err := net.InterfaceByIndex(int(sa.ZoneId)); err == nil {
+				addr.Zone = iface.Name
+			}
+		}
+	}
+	return n, oobn, flags, addr, took, nil
+}
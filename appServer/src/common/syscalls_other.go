@@ -0,0 +1,19 @@
+//go:build !linux
+
+package common
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// CheckSyscallSampling returns an error since the syscalls can only be sampled on Linux
+func CheckSyscallSampling() error {
+	return fmt.Errorf("sampling the syscalls is not supported on this platform")
+}
+
+// ReadMsgUDPSampled is only supported on Linux
+func ReadMsgUDPSampled(conn *net.UDPConn, b, oob []byte, sampler *SyscallSampler) (n, oobn, flags int, addr *net.UDPAddr, took time.Duration, err error) {
+	return 0, 0, 0, nil, 0, fmt.Errorf("sampling the syscalls is not supported on this platform")
+}
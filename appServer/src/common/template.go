@@ -0,0 +1,172 @@
+package common
+
+import (
+	"crypto/rand"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// maxTemplateRandLength bounds {{rand N}} so a request cannot make the server allocate without limit
+const maxTemplateRandLength = 1 << 20
+
+const templateRandAlphabet = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+
+// PayloadTemplate is a parsed EchoData template. Only the variables below are allowed, without
+// the actions, pipelines and arguments of text/template, so the size of an expansion is bounded
+// by MaxSize before it is expanded:
+//
+//	{{counter}}    the request counter
+//	{{timestamp}}  the current time in RFC3339 with nanoseconds
+//	{{unixnano}}   the current time in nanoseconds since the Unix epoch
+//	{{rand 16}}    16 random alphanumeric characters
+//	{{uuid}}       a random UUID (version 4)
+//	{{hostname}}   the hostname of the server
+type PayloadTemplate struct {
+	parts []templatePart
+}
+
+// templatePart is either a literal text or a variable of a PayloadTemplate
+type templatePart struct {
+	text     string // The literal text, when name is empty
+	name     string // The variable
+	length   int    // The length of {{rand N}}
+	maxBytes int    // The maximum size of the expanded part
+}
+
+// The maximum sizes of the expanded variables
+var templateVariableSizes = map[string]int{
+	"counter":   20,                                         // A 64-bit integer
+	"timestamp": len("2006-01-02T15:04:05.999999999-07:00"), // RFC3339 with nanoseconds
+	"unixnano":  20,                                         // A 64-bit integer
+	"uuid":      36,
+	"hostname":  255,
+}
+
+// ParsePayloadTemplate parses an EchoData template
+func ParsePayloadTemplate(text string) (*PayloadTemplate, error) {
+	tmpl := &PayloadTemplate{}
+	for text != "" {
+		start := strings.Index(text, "{{")
+		if start < 0 {
+			tmpl.parts = append(tmpl.parts, templatePart{text: text, maxBytes: len(text)})
+			break
+		}
+		if start > 0 {
+			tmpl.parts = append(tmpl.parts, templatePart{text: text[:start], maxBytes: start})
+		}
+		end := strings.Index(text[start:], "}}")
+		if end < 0 {
+			return nil, fmt.Errorf("invalid template: unclosed {{")
+		}
+		fields := strings.Fields(text[start+2 : start+end])
+		text = text[start+end+2:]
+
+		if len(fields) == 0 {
+			return nil, fmt.Errorf("invalid template: empty {{}}")
+		}
+		part := templatePart{name: fields[0]}
+		switch {
+		case part.name == "rand" && len(fields) == 2:
+			n, err := strconv.Atoi(fields[1])
+			if err != nil || n < 0 || n > maxTemplateRandLength {
+				return nil, fmt.Errorf("invalid template: rand length must be between 0 and %d", maxTemplateRandLength)
+			}
+			part.length, part.maxBytes = n, n
+		case templateVariableSizes[part.name] > 0 && len(fields) == 1:
+			part.maxBytes = templateVariableSizes[part.name]
+		default:
+			return nil, fmt.Errorf("invalid template: unsupported {{%s}}, the variables are counter, timestamp, unixnano, rand N, uuid and hostname", strings.Join(fields, " "))
+		}
+		tmpl.parts = append(tmpl.parts, part)
+	}
+	return tmpl, nil
+}
+
+// MaxSize returns the maximum size of an expansion of the template in bytes
+func (t *PayloadTemplate) MaxSize() int64 {
+	var size int64
+	for _, part := range t.parts {
+		size += int64(part.maxBytes)
+	}
+	return size
+}
+
+// Expand expands the template, each call generating new random values and timestamps
+func (t *PayloadTemplate) Expand(counter int) (string, error) {
+	var expanded strings.Builder
+	for _, part := range t.parts {
+		switch part.name {
+		case "":
+			expanded.WriteString(part.text)
+		case "counter":
+			expanded.WriteString(strconv.Itoa(counter))
+		case "timestamp":
+			expanded.WriteString(time.Now().Format(time.RFC3339Nano))
+		case "unixnano":
+			expanded.WriteString(strconv.FormatInt(time.Now().UnixNano(), 10))
+		case "rand":
+			value, err := randomString(part.length)
+			if err != nil {
+				return "", fmt.Errorf("unable to expand template: %v", err)
+			}
+			expanded.WriteString(value)
+		case "uuid":
+			value, err := randomUUID()
+			if err != nil {
+				return "", fmt.Errorf("unable to expand template: %v", err)
+			}
+			expanded.WriteString(value)
+		case "hostname":
+			hostname, _ := os.Hostname()
+			expanded.WriteString(hostname)
+		}
+	}
+	return expanded.String(), nil
+}
+
+// TemplateFuncs returns the variables of PayloadTemplate as text/template functions, for the
+// response templates of the HTTP server and the conditions of scenarios
+func TemplateFuncs(counter int) template.FuncMap {
+	return template.FuncMap{
+		"counter":   func() int { return counter },
+		"timestamp": func() string { return time.Now().Format(time.RFC3339Nano) },
+		"unixnano":  func() int64 { return time.Now().UnixNano() },
+		"rand":      randomString,
+		"uuid":      randomUUID,
+		"hostname": func() string {
+			hostname, _ := os.Hostname()
+			return hostname
+		},
+	}
+}
+
+// randomString returns n random alphanumeric characters
+func randomString(n int) (string, error) {
+	if n < 0 || n > maxTemplateRandLength {
+		return "", fmt.Errorf("rand length must be between 0 and %d", maxTemplateRandLength)
+	}
+	result := make([]byte, n)
+	if _, err := rand.Read(result); err != nil {
+		return "", err
+	}
+	// The modulo bias does not matter for generated payloads
+	for i, b := range result {
+		result[i] = templateRandAlphabet[int(b)%len(templateRandAlphabet)]
+	}
+	return string(result), nil
+}
+
+// randomUUID returns a random version 4 UUID
+func randomUUID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40 // Version 4
+	b[8] = b[8]&0x3f | 0x80 // RFC 4122 variant
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
@@ -0,0 +1,118 @@
+package common
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// Timings represents the phases of an HTTP request, in milliseconds. The client and the proxy
+// report the same schema, so the breakdowns observed on each hop can be compared.
+type Timings struct {
+	DNSMs      float64 `json:"DNSMs"`      // Resolving the host name, 0 for an IP or a reused connection
+	ConnectMs  float64 `json:"ConnectMs"`  // Establishing the TCP connection
+	TLSMs      float64 `json:"TLSMs"`      // The TLS handshake, 0 without TLS
+	TTFBMs     float64 `json:"TTFBMs"`     // From the request written to the first byte of the response
+	BodyMs     float64 `json:"BodyMs"`     // From the first byte of the response to the body read
+	TotalMs    float64 `json:"TotalMs"`    // From the start of the request to the body read, or to the failure
+	ConnReused bool    `json:"ConnReused"` // Indicates if the request reused a kept-alive connection
+}
+
+// HTTPTimer records the phases of an HTTP request with httptrace. A nil timer records nothing.
+type HTTPTimer struct {
+	mutex        sync.Mutex
+	start        time.Time
+	dnsStart     time.Time
+	dnsDone      time.Time
+	connectStart time.Time
+	connectDone  time.Time
+	tlsStart     time.Time
+	tlsDone      time.Time
+	wroteRequest time.Time
+	firstByte    time.Time
+	bodyRead     time.Time
+	reused       bool
+}
+
+// NewHTTPTimer creates an HTTPTimer
+func NewHTTPTimer() *HTTPTimer {
+	return &HTTPTimer{}
+}
+
+// Trace returns ctx with the trace of the timer, to be used as the context of the request. It
+// composes with the other traces of ctx.
+func (t *HTTPTimer) Trace(ctx context.Context) context.Context {
+	if t == nil {
+		return ctx
+	}
+	t.start = time.Now()
+	// Dialing may race IPv4 and IPv6 connections, so the first start and the first success count
+	mark := func(at *time.Time, first bool) {
+		t.mutex.Lock()
+		defer t.mutex.Unlock()
+		if !first || at.IsZero() {
+			*at = time.Now()
+		}
+	}
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		DNSStart:     func(httptrace.DNSStartInfo) { mark(&t.dnsStart, true) },
+		DNSDone:      func(httptrace.DNSDoneInfo) { mark(&t.dnsDone, false) },
+		ConnectStart: func(string, string) { mark(&t.connectStart, true) },
+		ConnectDone: func(_, _ string, err error) {
+			if err == nil {
+				mark(&t.connectDone, true)
+			}
+		},
+		TLSHandshakeStart: func() { mark(&t.tlsStart, true) },
+		TLSHandshakeDone:  func(tls.ConnectionState, error) { mark(&t.tlsDone, false) },
+		GotConn: func(info httptrace.GotConnInfo) {
+			t.mutex.Lock()
+			t.reused = info.Reused
+			t.mutex.Unlock()
+		},
+		WroteRequest:         func(httptrace.WroteRequestInfo) { mark(&t.wroteRequest, false) },
+		GotFirstResponseByte: func() { mark(&t.firstByte, true) },
+	})
+}
+
+// BodyRead marks the end of the read of the response body
+func (t *HTTPTimer) BodyRead() {
+	if t == nil {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.bodyRead = time.Now()
+}
+
+// Timings returns the phases recorded so far, or nil if no request was traced. The phases that
+// did not complete are 0, and TotalMs runs to now when the body was not read.
+func (t *HTTPTimer) Timings() *Timings {
+	if t == nil || t.start.IsZero() {
+		return nil
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	between := func(from, to time.Time) float64 {
+		if from.IsZero() || to.IsZero() {
+			return 0
+		}
+		return float64(to.Sub(from).Microseconds()) / 1000
+	}
+	end := t.bodyRead
+	if end.IsZero() {
+		end = time.Now()
+	}
+	return &Timings{
+		DNSMs:      between(t.dnsStart, t.dnsDone),
+		ConnectMs:  between(t.connectStart, t.connectDone),
+		TLSMs:      between(t.tlsStart, t.tlsDone),
+		TTFBMs:     between(t.wroteRequest, t.firstByte),
+		BodyMs:     between(t.firstByte, t.bodyRead),
+		TotalMs:    float64(end.Sub(t.start).Microseconds()) / 1000,
+		ConnReused: t.reused,
+	}
+}
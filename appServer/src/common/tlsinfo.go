@@ -0,0 +1,99 @@
+package common
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"os"
+	"time"
+)
+
+// TLSDetails represents the TLS connection and certificate details of a backend
+type TLSDetails struct {
+	ServerName  string   `json:"ServerName"`  // The SNI sent in the handshake
+	Version     string   `json:"Version"`     // The negotiated TLS version
+	CipherSuite string   `json:"CipherSuite"` // The negotiated cipher suite
+	Subject     string   `json:"Subject"`     // The subject of the leaf certificate
+	Issuer      string   `json:"Issuer"`      // The issuer of the leaf certificate
+	SANs        []string `json:"SANs"`        // The DNS names and IPs of the leaf certificate
+	NotAfter    string   `json:"NotAfter"`    // The expiry of the leaf certificate
+	VerifyError string   `json:"VerifyError"` // The verification error against the system roots, if any
+	HandshakeMs float64  `json:"HandshakeMs"` // The duration of the TLS handshake in milliseconds
+}
+
+// InspectTLS extracts the TLS details of a connection and verifies its certificate chain
+// for serverName. The handshake itself is expected to skip verification, so that details
+// of invalid certificates can still be reported.
+func InspectTLS(state tls.ConnectionState, serverName string, handshake time.Duration) *TLSDetails {
+	details := &TLSDetails{
+		ServerName:  serverName,
+		Version:     tls.VersionName(state.Version),
+		CipherSuite: tls.CipherSuiteName(state.CipherSuite),
+		HandshakeMs: float64(handshake.Microseconds()) / 1000,
+	}
+	if len(state.PeerCertificates) == 0 {
+		details.VerifyError = "no certificate presented by the server"
+		return details
+	}
+
+	leaf := state.PeerCertificates[0]
+	details.Subject = leaf.Subject.String()
+	details.Issuer = leaf.Issuer.String()
+	details.SANs = append(details.SANs, leaf.DNSNames...)
+	for _, ip := range leaf.IPAddresses {
+		details.SANs = append(details.SANs, ip.String())
+	}
+	details.NotAfter = leaf.NotAfter.Format(time.RFC3339)
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range state.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+	if _, err := leaf.Verify(x509.VerifyOptions{DNSName: serverName, Intermediates: intermediates}); err != nil {
+		details.VerifyError = err.Error()
+	}
+	return details
+}
+
+// LoadOrGenerateCertificate loads the certificate and key from the given PEM files, or
+// generates a self-signed certificate for the hostname and the interface IPs when both are empty
+func LoadOrGenerateCertificate(certFile, keyFile string) (tls.Certificate, error) {
+	if certFile != "" || keyFile != "" {
+		return tls.LoadX509KeyPair(certFile, keyFile)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	hostName, _ := os.Hostname()
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: hostName, Organization: []string{"appServer self-signed"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(1, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{hostName, "localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && !ipNet.IP.IsLoopback() {
+				template.IPAddresses = append(template.IPAddresses, ipNet.IP)
+			}
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
@@ -0,0 +1,113 @@
+package common
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"time"
+)
+
+// Topology represents where a server runs, so the results of several clusters, regions and zones
+// can be aggregated without a mapping table of the pods
+type Topology struct {
+	Cluster string `json:"Cluster"` // The cluster name
+	Region  string `json:"Region"`  // The region, e.g. the topology.kubernetes.io/region label of the node
+	Zone    string `json:"Zone"`    // The zone, e.g. the topology.kubernetes.io/zone label of the node
+	Source  string `json:"Source"`  // Where the labels come from: flags, node, or flags+node
+}
+
+// Labels of the nodes the topology is detected from. Kubernetes has no well-known label for the
+// cluster name, so the cluster one only helps when the nodes were labeled that way.
+const (
+	zoneLabel    = "topology.kubernetes.io/zone"
+	regionLabel  = "topology.kubernetes.io/region"
+	clusterLabel = "topology.kubernetes.io/cluster"
+)
+
+// TopologyFlags are the topology flags shared by the servers. Their defaults come from the
+// TOPOLOGY_CLUSTER, TOPOLOGY_REGION and TOPOLOGY_ZONE environment variables, so a Helm chart can set
+// them either way.
+type TopologyFlags struct {
+	cluster  *string
+	region   *string
+	zone     *string
+	fromNode *bool
+	kubeAPI  *string
+}
+
+// RegisterTopologyFlags defines the -cluster, -region, -zone, -topology-from-node and
+// -topology-kube-api flags, to be called before flag.Parse
+func RegisterTopologyFlags() *TopologyFlags {
+	return &TopologyFlags{
+		cluster:  flag.String("cluster", os.Getenv("TOPOLOGY_CLUSTER"), "The cluster name reported in the responses (default is $TOPOLOGY_CLUSTER)"),
+		region:   flag.String("region", os.Getenv("TOPOLOGY_REGION"), "The region reported in the responses (default is $TOPOLOGY_REGION)"),
+		zone:     flag.String("zone", os.Getenv("TOPOLOGY_ZONE"), "The zone reported in the responses (default is $TOPOLOGY_ZONE)"),
+		fromNode: flag.Bool("topology-from-node", false, "Detect the labels not set by flags from the topology labels of the node $NODE_NAME"),
+		kubeAPI:  flag.String("topology-kube-api", "", "The API server URL for -topology-from-node, e.g. http://127.0.0.1:8001 (default is the in-cluster service account)"),
+	}
+}
+
+// Resolve returns the topology of the flags, completed with the labels of the node when
+// -topology-from-node is set. The flags take precedence over the node labels, and a failed
+// detection is logged rather than fatal.
+func (f *TopologyFlags) Resolve() Topology {
+	topology := Topology{Cluster: *f.cluster, Region: *f.region, Zone: *f.zone}
+	if topology.Cluster != "" || topology.Region != "" || topology.Zone != "" {
+		topology.Source = "flags"
+	}
+	if !*f.fromNode {
+		return topology
+	}
+
+	labels, err := nodeLabels(*f.kubeAPI)
+	if err != nil {
+		log.Printf("Unable to detect the topology from the node labels: %v", err)
+		return topology
+	}
+	detected := false
+	for _, field := range []struct {
+		value *string
+		label string
+	}{{&topology.Cluster, clusterLabel}, {&topology.Region, regionLabel}, {&topology.Zone, zoneLabel}} {
+		if *field.value == "" && labels[field.label] != "" {
+			*field.value = labels[field.label]
+			detected = true
+		}
+	}
+	if detected {
+		if topology.Source == "" {
+			topology.Source = "node"
+		} else {
+			topology.Source += "+node"
+		}
+	}
+	log.Printf("Topology: cluster %q, region %q, zone %q (%s)", topology.Cluster, topology.Region, topology.Zone, topology.Source)
+	return topology
+}
+
+// nodeLabels returns the labels of the node the server runs on, named by NODE_NAME
+func nodeLabels(kubeAPI string) (map[string]string, error) {
+	nodeName := os.Getenv("NODE_NAME")
+	if nodeName == "" {
+		return nil, fmt.Errorf("NODE_NAME is not set, expose spec.nodeName with the downward API")
+	}
+	client, err := NewKubeClient(kubeAPI)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var node struct {
+		Metadata struct {
+			Labels map[string]string `json:"labels"`
+		} `json:"metadata"`
+	}
+	if err := client.Get(ctx, "/api/v1/nodes/"+url.PathEscape(nodeName), &node); err != nil {
+		return nil, err
+	}
+	return node.Metadata.Labels, nil
+}
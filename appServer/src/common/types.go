@@ -4,21 +4,90 @@ package common
 
 // UdpServerResponse represents the structure of the UDP server response data
 type UdpServerResponse struct {
-	ServerHostName   string `json:"ServerHostName"`   // The hostname of the server
-	ClientIP         string `json:"ClientIP"`         // The IP address of the client
-	ClientPort       string `json:"ClientPort"`       // The port of the client
-	ServerIP         string `json:"ServerIP"`         // The IP address of the server
-	ServerPort       string `json:"ServerPort"`       // The port on which the server is listening
-	IPVersion        string `json:"IPVersion"`        // The IP version (IPv4 or IPv6)
-	ClientEchoData   string `json:"ClientEchoData"`   // The data echoed from the client's request
-	RequestTimestamp string `json:"RequestTimestamp"` // The timestamp of the request
-	RequestCounter   int    `json:"RequestCounter"`   // The count of requests since the server started
-	ServerType       string `json:"ServerType"`       // The type of server (udp)
-	EnvList          map[string]string `json:"EnvList"` // The list of environment variables
+	ServerHostName   string            `json:"ServerHostName"`   // The hostname of the server
+	ClientIP         string            `json:"ClientIP"`         // The IP address of the client
+	ClientPort       string            `json:"ClientPort"`       // The port of the client
+	ServerIP         string            `json:"ServerIP"`         // The IP address of the server
+	ServerPort       string            `json:"ServerPort"`       // The port on which the server is listening
+	IPVersion        string            `json:"IPVersion"`        // The IP version (IPv4 or IPv6)
+	ClientEchoData   string            `json:"ClientEchoData"`   // The data echoed from the client's request
+	RequestTimestamp string            `json:"RequestTimestamp"` // The timestamp of the request
+	RequestCounter   int               `json:"RequestCounter"`   // The count of requests since the server started
+	ServerType       string            `json:"ServerType"`       // The type of server (udp)
+	EnvList          map[string]string `json:"EnvList"`          // The list of environment variables
+	Identity         Identity          `json:"Identity"`         // The identity of the server, refreshed on interface changes
+	HostNetwork      bool              `json:"HostNetwork"`      // Indicates if the server runs in the host network namespace
+
+	FlowLabel *int `json:"FlowLabel,omitempty"` // The IPv6 flow label of the received packet, when available
+
+	KernelRxTimestamp       string   `json:"KernelRxTimestamp,omitempty"`       // The time the packet was received, taken by the kernel or the NIC (RFC3339 with nanoseconds)
+	KernelRxUnixNano        int64    `json:"KernelRxUnixNano,omitempty"`        // The same receive timestamp in nanoseconds since the Unix epoch
+	KernelRxTimestampSource string   `json:"KernelRxTimestampSource,omitempty"` // Where the receive timestamp was taken: hardware or software
+	ReceiveDelayMs          *float64 `json:"ReceiveDelayMs,omitempty"`          // The time between the software receive timestamp and the server reading the packet
+
+	Fingerprint *NodeFingerprint `json:"Fingerprint,omitempty"` // The kernel, OS and network sysctls of the node, when -fingerprint is enabled
+
+	Checksum *UDPChecksumStats `json:"Checksum,omitempty"` // The zero checksum settings and checksum error counters, when enabled
+
+	Resources *CgroupResources `json:"Resources,omitempty"` // The CPU and memory limits and usage of the container, when -report-resources is enabled
+
+	ReplyTo      string `json:"ReplyTo,omitempty"`      // The address the reply was sent to instead of the client, when the request asked for it
+	ReplyToError string `json:"ReplyToError,omitempty"` // Why the reply-to override of the request was refused, the reply then goes to the client
+
+	ReadSyscallMicros *float64 `json:"ReadSyscallMicros,omitempty"` // The duration of the recvmsg syscall that read the request, with -syscall-sampling
+
+	ConfigGeneration uint64 `json:"ConfigGeneration,omitempty"` // The generation of the -config file the reply was produced with
+
+	DNS *DNSMessage `json:"DNS,omitempty"` // The DNS response sent to a DNS query instead of this reply, with -dns-responder
+}
+
+// UDPRequestEnvelope is an optional JSON envelope of the data sent to the UDP server, asking for
+// the reply to be sent to another address than the client's, e.g. another pod or a NodePort
+type UDPRequestEnvelope struct {
+	ReplyTo  string `json:"ReplyTo"`  // The host:port to send the reply to
+	EchoData string `json:"EchoData"` // The data to echo
+}
+
+// UDPChecksumStats represents the UDP checksum handling of the server. A socket cannot tell whether
+// a delivered packet had a zero checksum, so anomalies are detected from the kernel counters:
+// packets with a bad checksum, or with a zero checksum over IPv6 while it is not accepted, are
+// dropped and counted there.
+type UDPChecksumStats struct {
+	ZeroChecksumRx bool   `json:"ZeroChecksumRx"` // Indicates if IPv6 packets with a zero checksum are accepted (UDP_NO_CHECK6_RX)
+	ZeroChecksumTx bool   `json:"ZeroChecksumTx"` // Indicates if replies over IPv6 are sent with a zero checksum (UDP_NO_CHECK6_TX)
+	InCsumErrors4  uint64 `json:"InCsumErrors4"`  // The IPv4 UDP packets dropped for a bad checksum in the network namespace since the server started
+	InCsumErrors6  uint64 `json:"InCsumErrors6"`  // The IPv6 UDP packets dropped for a bad or zero checksum in the network namespace since the server started
+}
+
+// OverloadResponse is sent instead of the echo response when the server rejects a request over its resource caps
+type OverloadResponse struct {
+	ServerHostName string   `json:"ServerHostName"` // The hostname of the server
+	ServerType     string   `json:"ServerType"`     // The type of server (udp)
+	Rejected       bool     `json:"Rejected"`       // Always true
+	Reason         string   `json:"Reason"`         // The exceeded cap, or the injected error
+	Topology       Topology `json:"Topology"`       // The cluster, region and zone of the server
+
+	ConfigGeneration uint64 `json:"ConfigGeneration,omitempty"` // The generation of the -config file the reply was produced with
 }
 
 //--------------------------------- for http server
 
+// AccessDeniedResponse represents the 403 response of the HTTP server to a client outside its
+// -allow-cidr or inside its -deny-cidr lists, reporting the client as the server observed it
+type AccessDeniedResponse struct {
+	ServerHostName string   `json:"ServerHostName"` // The hostname of the server
+	ServerType     string   `json:"ServerType"`     // The type of server (http)
+	Denied         bool     `json:"Denied"`         // Always true
+	Reason         string   `json:"Reason"`         // The rule that denied the client
+	ClientIP       string   `json:"ClientIP"`       // The IP address of the client, as observed by the server after any SNAT
+	ClientPort     string   `json:"ClientPort"`     // The port of the client
+	ServerIP       string   `json:"ServerIP"`       // The IP address of the server
+	ServerPort     string   `json:"ServerPort"`     // The port on which the server is listening
+	IPVersion      string   `json:"IPVersion"`      // The IP version (IPv4 or IPv6)
+	ForwardedFor   []string `json:"ForwardedFor"`   // The X-Forwarded-For and Forwarded headers, which the rules ignore
+	Identity       Identity `json:"Identity"`       // The identity of the server
+}
+
 // HttpServerResponse represents the structure of the HTTP server response data
 type HttpServerResponse struct {
 	ServerHostName     string            `json:"ServerHostName"`     // The hostname of the server
@@ -33,7 +102,121 @@ type HttpServerResponse struct {
 	URL                string            `json:"URL"`                // The URL of the request
 	RequestCounter     int               `json:"RequestCounter"`     // The count of requests since the server started
 	ServerType         string            `json:"ServerType"`         // The type of server (http)
-	EnvList            map[string]string `json:"EnvList"`             // The list of environment variables
+	EnvList            map[string]string `json:"EnvList"`            // The list of environment variables
+
+	ExpectContinue string `json:"ExpectContinue"` // How "Expect: 100-continue" was handled (accepted, delayed, or empty if not requested)
+	EarlyHints     int    `json:"EarlyHints"`     // The number of 103 Early Hints responses sent before the final response
+
+	Identity    Identity  `json:"Identity"`       // The identity of the server, refreshed on interface changes
+	HostNetwork bool      `json:"HostNetwork"`    // Indicates if the server runs in the host network namespace
+	Auth        *AuthEcho `json:"Auth,omitempty"` // The claims of the bearer token, when -auth-echo is enabled and a token is present
+
+	Resources *CgroupResources `json:"Resources,omitempty"` // The CPU and memory limits and usage of the container, when -report-resources is enabled
+
+	RequestHeaderStats  HeaderStats `json:"RequestHeaderStats"`  // The count and size of all the request headers, including repeated ones
+	ResponseHeaders     int         `json:"ResponseHeaders"`     // The number of X-Stress-<n> headers added to the response
+	ResponseHeaderBytes int         `json:"ResponseHeaderBytes"` // The size of the X-Stress-<n> headers on the wire
+
+	Fingerprint *NodeFingerprint `json:"Fingerprint,omitempty"` // The kernel, OS and network sysctls of the node, when -fingerprint is enabled
+
+	TLSSession *TLSSessionEcho `json:"TLSSession,omitempty"` // The TLS session of the connection and the resumption stats of the client, for HTTPS requests
+
+	ServerProcessingMicros int64        `json:"ServerProcessingMicros"` // The time the server spent handling the request, excluding the rendering of the response
+	RequestCost            *RequestCost `json:"RequestCost,omitempty"`  // The CPU time and allocations of the request, when -request-cost is enabled
+
+	ConfigGeneration uint64 `json:"ConfigGeneration,omitempty"` // The generation of the -config file the response was produced with
+	InjectedError    bool   `json:"InjectedError,omitempty"`    // Indicates if the response is an error injected by the ErrorRate of the config
+
+	DetectedProtocol string `json:"DetectedProtocol,omitempty"` // The protocol detected on the -mux-port: http1, h2c, grpc or raw
+
+	RequestID string `json:"RequestID,omitempty"` // The ID of the request, from X-Request-Id or assigned by the server
+}
+
+// TLSSessionEcho represents the TLS session of the connection carrying a request
+type TLSSessionEcho struct {
+	Version            string            `json:"Version"`            // The negotiated TLS version
+	CipherSuite        string            `json:"CipherSuite"`        // The negotiated cipher suite
+	ServerName         string            `json:"ServerName"`         // The SNI sent by the client
+	NegotiatedProtocol string            `json:"NegotiatedProtocol"` // The ALPN protocol, e.g. h2
+	DidResume          bool              `json:"DidResume"`          // Indicates if the connection resumed a previous session
+	Client             TLSClientSessions `json:"Client"`             // The session stats of the client IP, including this connection
+}
+
+// TLSClientSessions represents the TLS session resumption and ticket reuse stats of one client IP
+type TLSClientSessions struct {
+	ClientIP         string  `json:"ClientIP"`         // The IP address of the client
+	Connections      int     `json:"Connections"`      // The number of TLS connections of the client
+	Resumed          int     `json:"Resumed"`          // The number of connections that resumed a session
+	ResumptionRate   float64 `json:"ResumptionRate"`   // Resumed divided by Connections
+	TicketsIssued    int     `json:"TicketsIssued"`    // The number of session tickets sent to the client
+	TicketsPresented int     `json:"TicketsPresented"` // The number of valid session tickets offered by the client
+	TicketsReused    int     `json:"TicketsReused"`    // The tickets offered again after a previous use
+	ForeignTickets   int     `json:"ForeignTickets"`   // The tickets offered by the client that were issued to another client IP
+	LastSeen         string  `json:"LastSeen"`         // The time of the last connection of the client
+}
+
+// TLSSessionReport sums up the TLS session resumption and ticket reuse of the clients of the server
+type TLSSessionReport struct {
+	Connections      int                 `json:"Connections"`      // The number of TLS connections
+	Resumed          int                 `json:"Resumed"`          // The number of connections that resumed a session
+	ResumptionRate   float64             `json:"ResumptionRate"`   // Resumed divided by Connections
+	TicketsIssued    int                 `json:"TicketsIssued"`    // The number of session tickets sent
+	TicketsPresented int                 `json:"TicketsPresented"` // The number of valid session tickets offered by clients
+	TicketsReused    int                 `json:"TicketsReused"`    // The tickets offered again after a previous use
+	ForeignTickets   int                 `json:"ForeignTickets"`   // The tickets offered by another client IP than the one they were issued to
+	Clients          []TLSClientSessions `json:"Clients"`          // The stats of each client IP
+}
+
+// WebSocketEcho represents the reply of the HTTP server to each message received on its /ws WebSocket
+type WebSocketEcho struct {
+	ServerHostName   string   `json:"ServerHostName"`   // The hostname of the server
+	ClientIP         string   `json:"ClientIP"`         // The IP address of the client
+	ClientPort       string   `json:"ClientPort"`       // The port of the client
+	ClientEchoData   string   `json:"ClientEchoData"`   // The message received from the client
+	ConnectedAt      string   `json:"ConnectedAt"`      // When the WebSocket was opened
+	MessageCounter   int      `json:"MessageCounter"`   // The number of messages received on this WebSocket
+	RequestTimestamp string   `json:"RequestTimestamp"` // The timestamp of the message
+	Identity         Identity `json:"Identity"`         // The identity of the server
+}
+
+// HeaderStats represents the count and size of a set of HTTP headers
+type HeaderStats struct {
+	Names        int    `json:"Names"`        // The number of distinct header names
+	Values       int    `json:"Values"`       // The number of header lines, counting each value of repeated headers
+	TotalBytes   int    `json:"TotalBytes"`   // The size of all header lines (name, ": ", value and CRLF)
+	LargestName  string `json:"LargestName"`  // The name of the largest header line
+	LargestBytes int    `json:"LargestBytes"` // The size of the largest header line
+}
+
+// ResponseData represents the legacy HTTP server response data, as rendered by the
+// former appServer/http_server.go, for consumers that have not moved to HttpServerResponse
+type ResponseData struct {
+	HostName       string            `json:"hostName"`       // The hostname of the server
+	ClientIP       string            `json:"clientIP"`       // The IP address of the client
+	ClientPort     string            `json:"clientPort"`     // The port of the client
+	ServerIP       string            `json:"serverIP"`       // The IP address of the server
+	ServerPort     string            `json:"serverPort"`     // The port on which the server is listening
+	IPVersion      string            `json:"ipVersion"`      // The IP version (IPv4 or IPv6)
+	EchoData       string            `json:"echoData"`       // The data echoed from the client's request
+	Headers        map[string]string `json:"headers"`        // The HTTP headers from the client's request
+	Timestamp      string            `json:"timestamp"`      // The timestamp of the request
+	RequestCounter int               `json:"requestCounter"` // The count of requests since the server started
+}
+
+// NewResponseData converts an HttpServerResponse to the legacy ResponseData shape
+func NewResponseData(response HttpServerResponse) ResponseData {
+	return ResponseData{
+		HostName:       response.ServerHostName,
+		ClientIP:       response.ClientIP,
+		ClientPort:     response.ClientPort,
+		ServerIP:       response.ServerIP,
+		ServerPort:     response.ServerPort,
+		IPVersion:      response.IPVersion,
+		EchoData:       response.ClientEchoData,
+		Headers:        response.RequestHttpHeaders,
+		Timestamp:      response.RequestTimestamp,
+		RequestCounter: response.RequestCounter,
+	}
 }
 
 //--------------------------------- for proxy server
@@ -43,6 +226,7 @@ type ProxyResponse struct {
 	Success         bool   `json:"Success"`         // Indicates if the request was successful
 	BackendResponse string `json:"BackendResponse"` // The response data from the backend server
 	ErrorMessage    string `json:"ErrorMessage"`    // Error message, if any
+	ErrorCode       string `json:"ErrorCode"`       // The class of the error, e.g. TIMEOUT or CONNECTION_REFUSED, empty on success
 	ProxyHostName   string `json:"ProxyHostName"`   // The hostname of the proxy server
 	ClientIP        string `json:"ClientIP"`        // The IP address of the client
 	ClientPort      string `json:"ClientPort"`      // The port of the client
@@ -55,6 +239,136 @@ type ProxyResponse struct {
 	FrontPort       string `json:"FrontPort"`       // The port of the proxy server
 	RequestCounter  int    `json:"RequestCounter"`  // The count of requests since the proxy server started
 	ForwardType     string `json:"ForwardType"`     // The type of forwarding (http or udp)
+	TTL             int    `json:"TTL"`             // The TTL / hop limit set on forwarded packets (0 for the system default)
+	DSCP            int    `json:"DSCP"`            // The DSCP set on forwarded packets (0 for the system default)
+	Cancelled       bool   `json:"Cancelled"`       // Indicates if the backend work was cancelled before it completed
+	CancelReason    string `json:"CancelReason"`    // Why the backend work was cancelled (client disconnected or deadline exceeded)
+	FlowLabel       int    `json:"FlowLabel"`       // The IPv6 flow label set on forwarded UDP packets (0 for none)
+
+	// Only reported when the proxy can observe them (currently UDP forwarding on Linux)
+	ObservedTTL       *int `json:"ObservedTTL,omitempty"`       // The TTL / hop limit seen on the backend response
+	ObservedDSCP      *int `json:"ObservedDSCP,omitempty"`      // The DSCP seen on the backend response
+	ObservedFlowLabel *int `json:"ObservedFlowLabel,omitempty"` // The IPv6 flow label seen on the backend response
+
+	DNS *DNSProbeResult `json:"DNS,omitempty"` // The result of a dns, dot or doh probe
+
+	NAT []NATHop `json:"NAT,omitempty"` // The source address of each hop as sent and as observed, to spot SNAT
+
+	WarmConnection bool `json:"WarmConnection"` // Indicates if a pre-established connection from /warm was used
+
+	SentEchoData string `json:"SentEchoData,omitempty"` // The data sent to the backend, when EchoData is a template
+
+	Backend *BackendEcho `json:"Backend,omitempty"` // The fields of the backend response, when it is JSON like the echo servers respond
+
+	Connect *ConnectResult `json:"Connect,omitempty"` // The result of a connect-only probe
+
+	UDPSource *UDPSourceResult `json:"UDPSource,omitempty"` // The source ports used for UDP forwarding
+
+	Transforms *TransformResult `json:"Transforms,omitempty"` // The transformations applied to the payloads, when requested
+
+	HostsUsed []string `json:"HostsUsed,omitempty"` // The entries of Hosts used instead of DNS to reach the backend, as <host>=<IP>
+
+	Timings *Timings `json:"Timings,omitempty"` // The phases of the request to the backend as the proxy observed them, for http forwarding
+
+	Caller *ProxyCaller `json:"Caller,omitempty"` // The authenticated caller, when the proxy API requires authentication
+
+	Hops      int    `json:"Hops"`                // The position of the proxy in a chain of proxies, 1 for the first one
+	RequestID string `json:"RequestID,omitempty"` // The ID of the request, from X-Request-Id or assigned by the proxy, forwarded to http backends
+
+	AmplificationLimit *AmplificationLimit `json:"AmplificationLimit,omitempty"` // The payload ceiling the request exceeded, when rejected with AMPLIFICATION_LIMIT
+
+	ValidationErrors []BackendURLProblem `json:"ValidationErrors,omitempty"` // The components of BackendUrl that failed the validation, when it was rejected
+
+	Resources *CgroupResources `json:"Resources,omitempty"` // The CPU and memory limits and usage of the proxy container, when -report-resources is enabled
+
+	ServerType  string            `json:"ServerType"`  // The type of server (proxy)
+	EnvList     map[string]string `json:"EnvList"`     // The environment variables of the proxy with the -env-prefix prefix
+	Identity    Identity          `json:"Identity"`    // The identity of the proxy, refreshed on interface changes
+	HostNetwork bool              `json:"HostNetwork"` // Indicates if the proxy runs in the host network namespace
+}
+
+// ProxyCaller represents the caller of the proxy API as authenticated by its bearer token or its
+// client certificate, so the audit logs and the responses tell who asked for each forwarding
+type ProxyCaller struct {
+	Method  string   `json:"Method"`            // How the caller authenticated: token, mtls or mtls+token
+	Token   string   `json:"Token,omitempty"`   // The name of the bearer token, never the token itself
+	Subject string   `json:"Subject,omitempty"` // The subject of the client certificate
+	URIs    []string `json:"URIs,omitempty"`    // The URI SANs of the client certificate, e.g. a SPIFFE ID
+}
+
+// TransformResult represents the transformations applied by the proxy to the payloads, with the
+// size and SHA-256 of each payload before and after, so clients can verify that their end-to-end
+// integrity checks detect the mutation
+type TransformResult struct {
+	RequestTransforms  []string `json:"RequestTransforms"`  // The transformations applied to EchoData
+	ResponseTransforms []string `json:"ResponseTransforms"` // The transformations applied to the backend response
+	OriginalBytes      int      `json:"OriginalBytes"`      // The size of EchoData, after the template expansion
+	OriginalSHA256     string   `json:"OriginalSHA256"`     // The SHA-256 of EchoData, after the template expansion
+	SentBytes          int      `json:"SentBytes"`          // The size of the data sent to the backend
+	SentSHA256         string   `json:"SentSHA256"`         // The SHA-256 of the data sent to the backend
+	BackendBytes       int      `json:"BackendBytes"`       // The size of the backend response
+	BackendSHA256      string   `json:"BackendSHA256"`      // The SHA-256 of the backend response
+	ReturnedBytes      int      `json:"ReturnedBytes"`      // The size of the transformed backend response
+	ReturnedSHA256     string   `json:"ReturnedSHA256"`     // The SHA-256 of the transformed backend response
+	SentBase64         bool     `json:"SentBase64"`         // Indicates if SentEchoData is base64 encoded since it is not valid UTF-8, e.g. after gzip
+	ResponseBase64     bool     `json:"ResponseBase64"`     // Indicates if BackendResponse is base64 encoded since it is not valid UTF-8, e.g. after gzip
+}
+
+// UDPSourceResult represents the local source ports used to forward a UDP request, to reproduce
+// problems with stale conntrack entries when the same 5-tuple is reused after a backend restart
+type UDPSourceResult struct {
+	Policy             string       `json:"Policy"`             // The UDPSourcePort policy: reuse, new, sticky or a port number
+	SourcePort         int          `json:"SourcePort"`         // The source port of the last attempt
+	PreviousSourcePort int          `json:"PreviousSourcePort"` // The source port of the previous request to the same backend, 0 if none
+	Reused             bool         `json:"Reused"`             // Indicates if SourcePort is the same as PreviousSourcePort
+	Attempts           []UDPAttempt `json:"Attempts"`           // Each attempt, the last one received the response on success
+}
+
+// UDPAttempt represents one attempt to forward a UDP request
+type UDPAttempt struct {
+	SourcePort   int    `json:"SourcePort"`   // The local source port of the attempt
+	ErrorMessage string `json:"ErrorMessage"` // Why no response was received, empty on success
+}
+
+// ConnectResult represents a connect-only probe, which establishes the connection without sending EchoData
+type ConnectResult struct {
+	Protocol     string      `json:"Protocol"`      // The probed protocol: tcp, tls or udp
+	Address      string      `json:"Address"`       // The probed host:port
+	LocalAddress string      `json:"LocalAddress"`  // The local address of the connection
+	ConnectMs    float64     `json:"ConnectMs"`     // The duration of the TCP handshake, or of the UDP check
+	TLS          *TLSDetails `json:"TLS,omitempty"` // The TLS details of the backend, including the handshake duration
+	UDPState     string      `json:"UDPState"`      // For udp: responded, or no-error when nothing came back before the wait
+}
+
+// BackendEcho represents the fields of a backend response from one of our echo servers, validated
+// against their schema, so multi-hop results can be checked without parsing BackendResponse
+type BackendEcho struct {
+	ServerHostName string   `json:"ServerHostName"` // The hostname of the backend
+	ServerIP       string   `json:"ServerIP"`       // The IP address of the backend, as seen by the backend
+	ServerType     string   `json:"ServerType"`     // The type of the backend server (http or udp)
+	RequestCounter int      `json:"RequestCounter"` // The request counter of the backend
+	EchoMatches    bool     `json:"EchoMatches"`    // Indicates if the backend echoed exactly the data that was sent
+	SchemaValid    bool     `json:"SchemaValid"`    // Indicates if the response has all the fields of the echo server schema
+	SchemaErrors   []string `json:"SchemaErrors"`   // The fields that are missing or have the wrong type
+}
+
+// NATHop represents the source address of one hop, as used by the sender and as observed by the receiver
+type NATHop struct {
+	Hop             string `json:"Hop"`             // The hop, "client->proxy" or "proxy->backend"
+	LocalAddress    string `json:"LocalAddress"`    // The source address used by the sender, empty if unknown
+	ObservedAddress string `json:"ObservedAddress"` // The source address seen by the receiver, empty if unknown
+	Translated      *bool  `json:"Translated"`      // Indicates if the source address was translated, null if unknown
+}
+
+// DNSProbeResult represents the result of a DNS query forwarded by the proxy server
+type DNSProbeResult struct {
+	Name      string      `json:"Name"`          // The queried name
+	Type      string      `json:"Type"`          // The queried record type
+	Rcode     string      `json:"Rcode"`         // The response code, e.g. NOERROR or NXDOMAIN
+	Answers   []DNSAnswer `json:"Answers"`       // The answer records
+	LatencyMs float64     `json:"LatencyMs"`     // The time from sending the query to receiving the answer, including connection setup
+	TLS       *TLSDetails `json:"TLS,omitempty"` // The TLS details of the resolver for DoT and DoH
+	OverTCP   bool        `json:"OverTCP"`       // Indicates if the UDP response was truncated and the query was retried over TCP
 }
 
 // ProxyClientRequest represents the structure of the client's request body
@@ -63,4 +377,176 @@ type ProxyClientRequest struct {
 	Timeout     int    `json:"Timeout"`     // The timeout for the request in seconds
 	ForwardType string `json:"ForwardType"` // The type of forwarding (http or udp)
 	EchoData    string `json:"EchoData"`    // The data to be echoed back by the server
+	TTL         int    `json:"TTL"`         // Optional TTL / hop limit for forwarded packets (1-255, 0 for the system default)
+	DSCP        int    `json:"DSCP"`        // Optional DSCP for forwarded packets (0-63)
+	FlowLabel   int    `json:"FlowLabel"`   // Optional IPv6 flow label for forwarded UDP packets (1-1048575)
+
+	EchoDataTemplate bool `json:"EchoDataTemplate"` // Expand the variables of EchoData, e.g. {{counter}} or {{rand 16}}, for each attempt
+
+	// For the dns, dot and doh forward types
+	DNSName string `json:"DNSName"` // The name to resolve
+	DNSType string `json:"DNSType"` // The record type to query (default is A)
+	SNI     string `json:"SNI"`     // Optional SNI for DoT/DoH (default is the host of BackendUrl)
+
+	UseWarm bool `json:"UseWarm"` // Use a connection pre-established with /warm for the http forward type, if one is held
+
+	UDPWait int `json:"UDPWait"` // For the connect forward type over udp: how long to wait for an ICMP error in milliseconds (default is 500)
+
+	// For the udp forward type
+	UDPRetries    int    `json:"UDPRetries"`    // The number of retries when no response arrives, each attempt waits for its share of the timeout (0-10)
+	UDPSourcePort string `json:"UDPSourcePort"` // The source port: reuse (default, the same ephemeral port across retries), new (a new port for each retry), sticky (the port of the previous request to the backend) or a port number
+
+	// For the http and udp forward types, the transformations applied in order like a middlebox
+	// would: base64, base64-decode, gzip, gunzip or inject-hop[:<field>] (default field is ProxyHops)
+	RequestTransforms  []string `json:"RequestTransforms"`  // Applied to EchoData before it is sent to the backend
+	ResponseTransforms []string `json:"ResponseTransforms"` // Applied to the backend response before it is returned as BackendResponse
+
+	// For the http, udp and connect forward types, the static IPs of hostnames, like /etc/hosts
+	// entries: the proxy connects to the IP instead of resolving the name, while the Host header
+	// and the SNI keep the name, e.g. {"echo.example.com":"10.244.1.7"}
+	Hosts map[string]string `json:"Hosts"`
+}
+
+// BundleRequest represents the body of a request to the proxy's /bundle endpoint
+type BundleRequest struct {
+	Name    string        `json:"Name"`    // Optional name of the bundle, echoed in the response
+	Timeout int           `json:"Timeout"` // The global deadline for all probes in seconds (default is 10)
+	Probes  []BundleProbe `json:"Probes"`  // The probes to run concurrently
+}
+
+// BundleProbe represents one probe of a bundle, with the same fields as a proxy request
+type BundleProbe struct {
+	Name string `json:"Name"` // Optional name of the probe (default is "<ForwardType> <BackendUrl>")
+	ProxyClientRequest
+}
+
+// BundleResponse represents the response of the proxy's /bundle endpoint
+type BundleResponse struct {
+	Success          bool                `json:"Success"`          // Indicates if all probes succeeded
+	ErrorMessage     string              `json:"ErrorMessage"`     // Error message, if any
+	Name             string              `json:"Name"`             // The name of the bundle
+	DurationMs       float64             `json:"DurationMs"`       // The time taken by the whole bundle
+	DeadlineExceeded bool                `json:"DeadlineExceeded"` // Indicates if the global deadline passed before all probes completed
+	Passed           int                 `json:"Passed"`           // The number of successful probes
+	Failed           int                 `json:"Failed"`           // The number of failed probes
+	Results          []BundleProbeResult `json:"Results"`          // The result of each probe, in the order of the request
+
+	AmplificationLimit *AmplificationLimit `json:"AmplificationLimit,omitempty"` // The payload ceiling the bundle or one of its probes exceeded
+}
+
+// BundleProbeResult represents the result of one probe of a bundle
+type BundleProbeResult struct {
+	Name         string         `json:"Name"`         // The name of the probe
+	StatusCode   int            `json:"StatusCode"`   // The status code the proxy would have returned for the probe alone
+	DurationMs   float64        `json:"DurationMs"`   // The time taken by the probe
+	ErrorMessage string         `json:"ErrorMessage"` // Why the probe could not be run, if any
+	Response     *ProxyResponse `json:"Response"`     // The proxy response of the probe
+}
+
+// ScenarioRequest represents the body of a request to the proxy's /scenario endpoint: a script
+// of steps the proxy runs one after the other, server-side
+type ScenarioRequest struct {
+	Name    string         `json:"Name"`    // Optional name of the scenario, echoed in the response
+	Timeout int            `json:"Timeout"` // The global deadline of the scenario in seconds (default is 60, at most 3600)
+	Async   bool           `json:"Async"`   // Return at once with the ID of the run, whose progress is then polled with GET /scenario?id=<ID>
+	Steps   []ScenarioStep `json:"Steps"`   // The steps to run in order
+}
+
+// ScenarioStep represents one step of a scenario. A step forwards a request, waits, or runs a block
+// of nested steps, optionally only if a condition holds, and optionally repeated as a loop.
+//
+// Conditions are text/template expressions rendering "true" or "false", with .Prev for the result
+// of the previous forward, .Steps for the last result of each named step, and .Iteration for the
+// current iteration of the step, e.g. {{.Prev.Success}} or
+// {{ne (index .Steps "first").Response.Backend.ServerHostName .Prev.Response.Backend.ServerHostName}}.
+type ScenarioStep struct {
+	Name    string              `json:"Name"`    // Optional name of the step, to reference its result in conditions (default is step<n>)
+	Forward *ProxyClientRequest `json:"Forward"` // The request to forward, whose BackendUrl may also be a template of the previous results
+	Wait    string              `json:"Wait"`    // How long to wait before the forward, or alone, e.g. 500ms
+	Steps   []ScenarioStep      `json:"Steps"`   // A block of nested steps, typically repeated
+
+	If        string `json:"If"`        // Run the step only if this condition is true
+	Repeat    int    `json:"Repeat"`    // The number of iterations (default is 1, at most 1000)
+	Until     string `json:"Until"`     // Stop repeating once this condition is true after an iteration
+	Interval  string `json:"Interval"`  // How long to wait between iterations
+	OnFailure string `json:"OnFailure"` // "continue" (default) or "stop" the scenario when the final forward of the step fails
+}
+
+// ScenarioResponse represents the response of the proxy's /scenario endpoint
+type ScenarioResponse struct {
+	ID               string               `json:"ID"`               // The ID of the run
+	Name             string               `json:"Name"`             // The name of the scenario
+	Running          bool                 `json:"Running"`          // Indicates if an asynchronous run is still in progress
+	Success          bool                 `json:"Success"`          // Indicates if the final forward of every step succeeded and the scenario ran to its end
+	ErrorMessage     string               `json:"ErrorMessage"`     // Why the scenario failed or stopped, if any
+	DurationMs       float64              `json:"DurationMs"`       // The time taken by the scenario so far
+	DeadlineExceeded bool                 `json:"DeadlineExceeded"` // Indicates if the global deadline passed before the scenario ended
+	Executed         int                  `json:"Executed"`         // The number of executed forwards and waits
+	Passed           int                  `json:"Passed"`           // The number of successful forwards
+	Failed           int                  `json:"Failed"`           // The number of failed forwards
+	Steps            []ScenarioStepResult `json:"Steps"`            // The result of each executed or skipped step, in the order they ran
+
+	AmplificationLimit *AmplificationLimit `json:"AmplificationLimit,omitempty"` // The payload ceiling the scenario or one of its forwards exceeded
+}
+
+// AmplificationLimit describes the payload ceiling of the proxy a request exceeded, so the client
+// knows which of its payload size or fan-out to reduce
+type AmplificationLimit struct {
+	Limit    string `json:"Limit"`              // The exceeded ceiling: max-echo-data, max-fanout-bytes or max-bundle-bytes, after the flag setting it
+	MaxBytes int64  `json:"MaxBytes"`           // The ceiling in bytes
+	Bytes    int64  `json:"Bytes"`              // The bytes the request would have sent
+	Forwards int    `json:"Forwards,omitempty"` // The number of sends of EchoData, for max-fanout-bytes
+}
+
+// ScenarioStepResult represents the result of one iteration of a scenario step. Name is the name
+// of the step, prefixed with the names of its enclosing blocks and their iteration when they are
+// repeated, e.g. "retry#2/probe".
+type ScenarioStepResult struct {
+	Iteration int     `json:"Iteration"` // The iteration of the step, starting at 1
+	Action    string  `json:"Action"`    // What the step did: forward, wait, skip or error
+	Success   bool    `json:"Success"`   // Indicates if the forward succeeded, always true for waits
+	StartMs   float64 `json:"StartMs"`   // When the step started, since the start of the scenario
+	BundleProbeResult
+}
+
+// WarmRequest represents the body of a request to the proxy's /warm endpoint
+type WarmRequest struct {
+	Backends    []string `json:"Backends"`    // The backends, as URLs (http:// or https://) or host:port
+	Connections int      `json:"Connections"` // The number of connections to establish per backend
+	TLS         bool     `json:"TLS"`         // Use TLS for backends given as host:port
+	SNI         string   `json:"SNI"`         // Optional SNI for TLS (default is the backend host)
+	Timeout     int      `json:"Timeout"`     // The timeout for establishing all connections in seconds
+}
+
+// WarmResponse represents the response of the proxy's /warm endpoint
+type WarmResponse struct {
+	Success      bool                `json:"Success"`      // Indicates if all requested connections were established
+	ErrorMessage string              `json:"ErrorMessage"` // Error message, if any
+	Backends     []WarmBackendResult `json:"Backends"`     // The result per backend
+	Held         map[string]int      `json:"Held"`         // The number of connections held per backend
+	Closed       int                 `json:"Closed"`       // The number of connections closed by a DELETE request
+}
+
+// WarmBackendResult represents the connections pre-established to a single backend
+type WarmBackendResult struct {
+	Backend        string   `json:"Backend"`        // The backend, as tcp://host:port or tls://host:port
+	Requested      int      `json:"Requested"`      // The number of connections requested
+	Established    int      `json:"Established"`    // The number of connections established
+	Held           int      `json:"Held"`           // The number of connections now held for the backend
+	MinHandshakeMs float64  `json:"MinHandshakeMs"` // The fastest connection setup, including the TLS handshake
+	AvgHandshakeMs float64  `json:"AvgHandshakeMs"` // The average connection setup, including the TLS handshake
+	MaxHandshakeMs float64  `json:"MaxHandshakeMs"` // The slowest connection setup, including the TLS handshake
+	Errors         []string `json:"Errors"`         // The errors of the failed connections
+}
+
+//--------------------------------- for client
+
+// TCPSocketOptions represents the options of a TCP socket as read back from the kernel
+type TCPSocketOptions struct {
+	NoDelay         bool `json:"NoDelay"`         // Indicates if TCP_NODELAY is set, i.e. Nagle's algorithm is disabled
+	KeepAlive       bool `json:"KeepAlive"`       // Indicates if SO_KEEPALIVE is set
+	KeepIdleSec     int  `json:"KeepIdleSec"`     // The idle time before the first keepalive probe (TCP_KEEPIDLE)
+	KeepIntervalSec int  `json:"KeepIntervalSec"` // The interval between keepalive probes (TCP_KEEPINTVL)
+	Linger          bool `json:"Linger"`          // Indicates if SO_LINGER is enabled
+	LingerSec       int  `json:"LingerSec"`       // The SO_LINGER timeout, 0 resets the connection on close
 }
@@ -0,0 +1,187 @@
+package common
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WarmPool holds pre-established TCP or TLS connections per backend, so request latency
+// can be measured without the connection setup. Limit bounds the connections held and being
+// established across all backends, 0 for no limit.
+type WarmPool struct {
+	Limit int
+	mutex sync.Mutex
+	conns map[string][]net.Conn
+	held  int // The connections held or being established
+}
+
+// NewWarmPool creates an empty WarmPool
+func NewWarmPool() *WarmPool {
+	return &WarmPool{conns: make(map[string][]net.Conn)}
+}
+
+// ParseWarmBackend normalizes a backend given as a URL (http:// or https://) or as host:port
+// to the host:port address used by net/http when dialing, and reports if TLS is used. IPv6
+// literals are bracketed, with their zone if any. The error is a *BackendURLError.
+func ParseWarmBackend(backend string, useTLS bool) (string, bool, error) {
+	if strings.Contains(backend, "://") {
+		address, err := ParseBackendURL(backend, "http", "https")
+		if err != nil {
+			return "", false, err
+		}
+		return address.Address(), address.Scheme == "https", nil
+	}
+	address, err := ParseBackendHostPort(backend, "")
+	if err != nil {
+		return "", false, err
+	}
+	return address.Address(), useTLS, nil
+}
+
+// warmKey returns the pool key of a backend address
+func warmKey(address string, useTLS bool) string {
+	if useTLS {
+		return "tls://" + address
+	}
+	return "tcp://" + address
+}
+
+// Warm establishes count connections to address and holds them in the pool. For TLS the
+// handshake is completed too, using serverName as SNI (the host of address if empty).
+func (p *WarmPool) Warm(ctx context.Context, address string, useTLS bool, serverName string, count int) WarmBackendResult {
+	result := WarmBackendResult{Backend: warmKey(address, useTLS), Requested: count}
+	if serverName == "" {
+		serverName, _, _ = net.SplitHostPort(address)
+	}
+
+	var total time.Duration
+	for i := 0; i < count; i++ {
+		p.mutex.Lock()
+		if p.Limit > 0 && p.held >= p.Limit {
+			p.mutex.Unlock()
+			result.Errors = append(result.Errors, fmt.Sprintf("the pool already holds its maximum of %d connections", p.Limit))
+			break
+		}
+		p.held++
+		p.mutex.Unlock()
+
+		start := time.Now()
+		var conn net.Conn
+		var err error
+		if useTLS {
+			// The warm connections are only meant for test traffic, so any certificate is accepted
+			dialer := &tls.Dialer{Config: &tls.Config{ServerName: serverName, InsecureSkipVerify: true}}
+			conn, err = dialer.DialContext(ctx, "tcp", address)
+		} else {
+			var dialer net.Dialer
+			conn, err = dialer.DialContext(ctx, "tcp", address)
+		}
+		if err != nil {
+			p.mutex.Lock()
+			p.held--
+			p.mutex.Unlock()
+			result.Errors = append(result.Errors, err.Error())
+			continue
+		}
+
+		handshake := time.Since(start)
+		handshakeMs := float64(handshake.Microseconds()) / 1000
+		if result.Established == 0 || handshakeMs < result.MinHandshakeMs {
+			result.MinHandshakeMs = handshakeMs
+		}
+		if handshakeMs > result.MaxHandshakeMs {
+			result.MaxHandshakeMs = handshakeMs
+		}
+		total += handshake
+		result.Established++
+
+		p.mutex.Lock()
+		p.conns[result.Backend] = append(p.conns[result.Backend], conn)
+		p.mutex.Unlock()
+	}
+
+	if result.Established > 0 {
+		result.AvgHandshakeMs = float64((total / time.Duration(result.Established)).Microseconds()) / 1000
+	}
+	result.Held = p.Held(address, useTLS)
+	return result
+}
+
+// Take removes a held connection to address from the pool and returns it, or nil if there is
+// none. Connections closed by the backend while being held are discarded.
+func (p *WarmPool) Take(address string, useTLS bool) net.Conn {
+	key := warmKey(address, useTLS)
+	for {
+		p.mutex.Lock()
+		conns := p.conns[key]
+		if len(conns) == 0 {
+			p.mutex.Unlock()
+			return nil
+		}
+		conn := conns[0]
+		p.conns[key] = conns[1:]
+		p.held--
+		p.mutex.Unlock()
+
+		if isConnAlive(conn) {
+			return conn
+		}
+		conn.Close()
+	}
+}
+
+// isConnAlive checks that the backend has not closed an idle connection, by reading with a
+// deadline that has almost passed: a timeout means the connection is still open and idle
+func isConnAlive(conn net.Conn) bool {
+	conn.SetReadDeadline(time.Now().Add(time.Millisecond))
+	defer conn.SetReadDeadline(time.Time{})
+
+	_, err := conn.Read(make([]byte, 1))
+	return errors.Is(err, os.ErrDeadlineExceeded)
+}
+
+// Held returns the number of connections held for address
+func (p *WarmPool) Held(address string, useTLS bool) int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return len(p.conns[warmKey(address, useTLS)])
+}
+
+// Stats returns the number of held connections per backend
+func (p *WarmPool) Stats() map[string]int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	stats := make(map[string]int, len(p.conns))
+	for key, conns := range p.conns {
+		if len(conns) > 0 {
+			stats[key] = len(conns)
+		}
+	}
+	return stats
+}
+
+// CloseAll closes all held connections and returns how many were closed
+func (p *WarmPool) CloseAll() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	closed := 0
+	for key, conns := range p.conns {
+		for _, conn := range conns {
+			conn.Close()
+			closed++
+		}
+		delete(p.conns, key)
+	}
+	p.held -= closed
+	return closed
+}
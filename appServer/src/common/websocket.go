@@ -0,0 +1,281 @@
+package common
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// websocketGUID is appended to the key of the handshake to compute the accept key (RFC 6455)
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// maxWebSocketMessage bounds the size of a received WebSocket message
+const maxWebSocketMessage = 1 << 20
+
+// The WebSocket opcodes
+const (
+	WebSocketContinuation = 0x0
+	WebSocketText         = 0x1
+	WebSocketBinary       = 0x2
+	WebSocketClose        = 0x8
+	WebSocketPing         = 0x9
+	WebSocketPong         = 0xA
+)
+
+// ErrWebSocketClosed is returned by ReadMessage when the peer closed the WebSocket with a close frame
+var ErrWebSocketClosed = errors.New("websocket closed by the peer")
+
+// WebSocketConn is a minimal WebSocket connection built on net/http only, enough to echo and
+// exchange messages over long-lived connections. Only one goroutine may read at a time.
+type WebSocketConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	client bool // Clients mask the frames they send
+
+	writeMutex sync.Mutex
+}
+
+// WebSocketAcceptKey computes the Sec-WebSocket-Accept value of a Sec-WebSocket-Key
+func WebSocketAcceptKey(key string) string {
+	sum := sha1.Sum([]byte(key + websocketGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// UpgradeWebSocket completes the WebSocket handshake of an HTTP/1.1 request and takes over its
+// connection. On failure an error response has already been sent.
+func UpgradeWebSocket(w http.ResponseWriter, r *http.Request) (*WebSocketConn, error) {
+	if !headerContains(r.Header, "Connection", "upgrade") || !headerContains(r.Header, "Upgrade", "websocket") {
+		http.Error(w, "Expected a WebSocket upgrade request", http.StatusBadRequest)
+		return nil, fmt.Errorf("not a WebSocket upgrade request")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "Unsupported WebSocket version", http.StatusUpgradeRequired)
+		return nil, fmt.Errorf("unsupported WebSocket version %q", r.Header.Get("Sec-WebSocket-Version"))
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		http.Error(w, "Missing Sec-WebSocket-Key", http.StatusBadRequest)
+		return nil, fmt.Errorf("missing Sec-WebSocket-Key")
+	}
+
+	conn, rw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		http.Error(w, "WebSocket needs HTTP/1.1", http.StatusBadRequest)
+		return nil, fmt.Errorf("unable to take over the connection: %v", err)
+	}
+	// The deadlines of the server do not apply to the WebSocket
+	conn.SetDeadline(time.Time{})
+
+	response := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + WebSocketAcceptKey(key) + "\r\n\r\n"
+	if _, err := rw.WriteString(response); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &WebSocketConn{conn: conn, reader: rw.Reader}, nil
+}
+
+// DialWebSocket opens a WebSocket to ws://address/path
+func DialWebSocket(address, path string, timeout time.Duration) (*WebSocketConn, error) {
+	conn, err := net.DialTimeout("tcp", address, timeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	key := base64.StdEncoding.EncodeToString(nonce)
+	req, err := http.NewRequest(http.MethodGet, "http://"+address+path, nil)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("unable to read the handshake response: %v", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		resp.Body.Close()
+		conn.Close()
+		return nil, fmt.Errorf("handshake returned %s", resp.Status)
+	}
+	if resp.Header.Get("Sec-WebSocket-Accept") != WebSocketAcceptKey(key) {
+		conn.Close()
+		return nil, fmt.Errorf("handshake returned an invalid Sec-WebSocket-Accept")
+	}
+
+	conn.SetDeadline(time.Time{})
+	return &WebSocketConn{conn: conn, reader: reader, client: true}, nil
+}
+
+// headerContains checks whether a comma separated header contains a token, ignoring case
+func headerContains(header http.Header, name, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, part := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// NetConn returns the underlying connection, e.g. to set deadlines
+func (c *WebSocketConn) NetConn() net.Conn {
+	return c.conn
+}
+
+// Close closes the connection without a close frame
+func (c *WebSocketConn) Close() error {
+	return c.conn.Close()
+}
+
+// WriteMessage sends a message in a single frame
+func (c *WebSocketConn) WriteMessage(opcode byte, data []byte) error {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	header := []byte{0x80 | opcode, 0}
+	switch {
+	case len(data) < 126:
+		header[1] = byte(len(data))
+	case len(data) <= 0xFFFF:
+		header[1] = 126
+		header = binary.BigEndian.AppendUint16(header, uint16(len(data)))
+	default:
+		header[1] = 127
+		header = binary.BigEndian.AppendUint64(header, uint64(len(data)))
+	}
+
+	payload := data
+	if c.client {
+		header[1] |= 0x80
+		mask := make([]byte, 4)
+		rand.Read(mask)
+		header = append(header, mask...)
+		payload = make([]byte, len(data))
+		for i := range data {
+			payload[i] = data[i] ^ mask[i%4]
+		}
+	}
+
+	_, err := c.conn.Write(append(header, payload...))
+	return err
+}
+
+// ReadMessage reads the next text or binary message, joining fragmented frames. It answers pings,
+// skips pongs and returns ErrWebSocketClosed after answering a close frame.
+func (c *WebSocketConn) ReadMessage() (byte, []byte, error) {
+	var opcode byte
+	var message []byte
+	for {
+		fin, frameOpcode, payload, err := c.readFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+		switch frameOpcode {
+		case WebSocketPing:
+			if err := c.WriteMessage(WebSocketPong, payload); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case WebSocketPong:
+			continue
+		case WebSocketClose:
+			c.WriteMessage(WebSocketClose, payload)
+			return 0, nil, ErrWebSocketClosed
+		case WebSocketContinuation:
+			if opcode == 0 {
+				return 0, nil, fmt.Errorf("unexpected continuation frame")
+			}
+		default:
+			if opcode != 0 {
+				return 0, nil, fmt.Errorf("unexpected frame with opcode %d in a fragmented message", frameOpcode)
+			}
+			opcode = frameOpcode
+		}
+
+		if len(message)+len(payload) > maxWebSocketMessage {
+			return 0, nil, fmt.Errorf("message over %d bytes", maxWebSocketMessage)
+		}
+		message = append(message, payload...)
+		if fin {
+			return opcode, message, nil
+		}
+	}
+}
+
+// readFrame reads a single frame and unmasks its payload
+func (c *WebSocketConn) readFrame() (bool, byte, []byte, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(c.reader, header); err != nil {
+		return false, 0, nil, err
+	}
+	fin, opcode := header[0]&0x80 != 0, header[0]&0x0F
+	masked, length := header[1]&0x80 != 0, uint64(header[1]&0x7F)
+
+	switch length {
+	case 126:
+		extended := make([]byte, 2)
+		if _, err := io.ReadFull(c.reader, extended); err != nil {
+			return false, 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(extended))
+	case 127:
+		extended := make([]byte, 8)
+		if _, err := io.ReadFull(c.reader, extended); err != nil {
+			return false, 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(extended)
+	}
+	if length > maxWebSocketMessage {
+		return false, 0, nil, fmt.Errorf("frame over %d bytes", maxWebSocketMessage)
+	}
+
+	var mask []byte
+	if masked {
+		mask = make([]byte, 4)
+		if _, err := io.ReadFull(c.reader, mask); err != nil {
+			return false, 0, nil, err
+		}
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(c.reader, payload); err != nil {
+		return false, 0, nil, err
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+	return fin, opcode, payload, nil
+}
@@ -5,6 +5,81 @@ Main Features:
 1. Returns the server's hostname when an HTTP request is received.
 2. Returns the client's source IP address.
 3. Echoes any data from the client's request.
+4. Reports the identity of the server (hostname, pod, node and IPs), refreshed whenever
+   the network interfaces change.
+5. Controls how "Expect: 100-continue" is handled (accept, delay or reject) and optionally
+   sends 103 Early Hints before the final response, reporting what the server actually did.
+6. Optionally echoes the claims (iss, sub, aud, exp) of the Authorization bearer token, verified
+   against a JWKS endpoint if one is configured, to validate auth header propagation through gateways.
+7. Optionally renders the legacy ResponseData shape, either for every request (-legacy-schema)
+   or for requests under the /v1/ path, so existing dashboards keep working.
+8. Reports whether the server runs with hostNetwork, since the hostname alone is ambiguous.
+9. Optionally serves HTTPS with HTTP/2, where the /h2order endpoint responds to the concurrent
+   streams of a connection in a controlled order and with per-stream delays, reporting the arrival
+   index of the streams in the bodies, to validate the HTTP/2 multiplexing behavior of intermediaries.
+10. Stresses header limits: responds with a configurable number and size of response headers, accepts
+    inbound header sets up to -max-header-bytes (larger ones get 431) and reports their count and size,
+    to test the header limits of proxies and their 431 handling.
+11. Sends truncated responses with the /truncate endpoint: it declares a Content-Length but closes
+    (or resets) the connection after fewer bytes, to test how clients and proxies handle them. The
+    declared and actually sent byte counts are logged and summed up by /truncate/stats.
+12. Optionally reports the kernel version, OS image and network sysctls of the node, collected at
+    startup and refreshed on SIGHUP or with /fingerprint?refresh=true, to correlate behavioral
+    differences with node software.
+13. Serves bulk bodies with /payload (a body of a given size) and /stream (chunks flushed at an
+    interval), optionally shaped to a bandwidth per connection with -response-rate-limit, so the
+    timeout and buffering behaviors of clients under slow servers can be reproduced deterministically.
+14. Optionally renders the response body with user provided Go templates loaded from a config file
+    (-response-template), selected by path prefix or with the "template" query parameter. The templates
+    reference the request (method, path, query, headers, body) and the server identity, so the echo
+    server can mimic the payload shapes expected by downstream parsers.
+15. Monitors its own goroutines, open file descriptors and socket states, reports them on /status,
+    and rejects requests with 503 while they exceed -max-goroutines or -max-fds, so runaway tests
+    get a clear rejection instead of the confusing failures of an exhausted process.
+16. Tracks the TLS session resumption and session ticket reuse of each client IP on the HTTPS port:
+    HTTPS responses echo the session of the connection (version, cipher, ALPN, resumed or not) and
+    the stats of the client, and /tls/sessions sums them up, to verify whether the proxies in the
+    path break session reuse and inflate the handshake overhead.
+17. Dumps a diagnostic bundle on SIGQUIT or with /debug/dump: goroutine stacks, flags, counters,
+    resource usage and socket states, and the last requests, to capture the state of the server
+    during hangs that are hard to reproduce.
+18. Serves a WebSocket on /ws that replies to each message with the identity of the server, for
+    clients that keep long-lived connections open to detect when they break.
+19. Reports the time spent handling each request (ServerProcessingMicros and a Server-Timing header)
+    and optionally its CPU time and heap allocations, to separate the network latency from the
+    server overhead in latency budgets.
+20. Optionally samples how long the read and write syscalls of the connections take, next to how long
+    the requests take to handle, and reports their percentiles on /syscalls, to tell kernel and
+    datapath delays from application delays at high load without systemtap or eBPF.
+21. Optionally applies the behavior settings (delay, error rate, response headers) of a config file,
+    e.g. mounted from a ConfigMap, and reloads them when the file changes, without restart. Each
+    reload increments a config generation, logged and echoed in the responses, so tests know which
+    config produced each response.
+22. Optionally enforces an IP allowlist and denylist of CIDRs (-allow-cidr, -deny-cidr) on the address
+    the connections come from, answering the denied clients with 403 and the client IP and port the
+    server observed, to verify which source addresses traffic actually arrives from after SNAT layers.
+23. Reports the cluster, region and zone of the server in Identity.Topology of all responses, from
+    the -cluster, -region and -zone flags (or their TOPOLOGY_* environment variables) or detected
+    from the labels of the node, so results of multi-cluster and multi-zone runs aggregate without
+    mapping tables.
+24. Reports the TCP sockets of its ports per state (ESTABLISHED, TIME_WAIT, ...), the accept queue
+    of its listening sockets and the listen overflow and backlog drop counters on /sockstats, to
+    understand the server-side saturation during load tests.
+25. Optionally reports the cgroup CPU and memory limits of the container and their usage (CPU time,
+    throttled periods and time, memory working set, OOM kills) as Resources, and the architecture
+    and CPUs of the node in Identity, so performance differences observed in tests can be
+    attributed to throttling rather than the network.
+26. Optionally serves HTTP/1, HTTP/2 without TLS (h2c), gRPC and a raw line echo protocol on a single
+    port (-mux-port), detecting the protocol of each connection from its first bytes like cmux, and
+    reports the detected protocol as DetectedProtocol, to test how proxies and meshes handle several
+    protocols sharing a port.
+27. Optionally journals every request in a bounded on-disk ring (-journal), with its ID (X-Request-Id
+    of the client or assigned), the times it was received and finished, the client and the outcome,
+    queryable by ID with GET /requests/{id}, to prove whether the server ever received a request a
+    client claims has disappeared.
+28. Applies the same middleware chain of common/common.go to all its handlers: panic recovery, request
+    IDs, an optional access log (-access-log), the journal, the diagnostics, the access list, an
+    optional rate limit (-rate-limit) and the resource caps, outermost first.
 
 Usage:
 go run http_server.go -port=<port>
@@ -12,40 +87,307 @@ go run http_server.go -port=<port>
 Options:
 -h: Display help information
 -port: Specify the TCP port for the server to listen on (default is 8080)
+-expect-mode: How to handle "Expect: 100-continue": accept, delay or reject (default is accept)
+-expect-delay: How long to wait before sending 100 Continue in delay mode (default is 2s)
+-early-hints: The number of 103 Early Hints responses to send before the final response, at most 10 (default is 0)
+-auth-echo: Echo the claims of the Authorization bearer token (default is false)
+-jwks-url: Verify the bearer token signature against this JWKS URL (optional, implies -auth-echo)
+-legacy-schema: Render the legacy ResponseData shape instead of HttpServerResponse (default is false)
+-tls-port: Also serve HTTPS with HTTP/2 on this TCP port (optional)
+-tls-cert, -tls-key: The PEM certificate and key for HTTPS (default is a generated self-signed certificate)
+-max-header-bytes: The maximum size of the request headers, larger ones are rejected with 431 (default is 1MB)
+-response-headers: The number of X-Stress-<n> headers added to each response, at most 10000 (default is 0)
+-response-header-size: The size in bytes of the value of each X-Stress-<n> header (default is 64)
+-fingerprint: Include the kernel and OS fingerprint of the node in responses (default is false)
+-report-resources: Include the cgroup CPU and memory limits and usage of the container as Resources (default is false)
+-response-rate-limit: The bandwidth of /payload and /stream bodies per connection, e.g. 1MB/s or 512KB/s (default is unlimited)
+-response-template: A JSON config file of response body templates (optional), e.g.
+    {"Templates":[{"Name":"order","PathPrefix":"/api/orders","ContentType":"application/json",
+      "Body":"{\"id\":{{.RequestCounter}},\"pod\":{{json .Identity.PodName}},\"trace\":{{json (.Header.Get \"X-Trace-Id\")}}}"}]}
+    A template gives its body inline with "Body" or in a file with "BodyFile" (relative to the config
+    file), and optionally sets "StatusCode" (default is 200). Templates use the text/template syntax
+    with the fields of HttpServerResponse plus .Method, .Path, .Query and .Header of the request, and
+    the functions of EchoData templates ({{counter}}, {{uuid}}, {{rand 16}}...) plus {{json <value>}}.
+-max-goroutines: Reject requests with 503 while the server has more goroutines (default is 0, no cap)
+-max-fds: Reject requests with 503 while the server has more open file descriptors (default is 0, no cap)
+-request-cost: Report the CPU time and heap allocations of each request (default is false)
+-syscall-sampling: Sample the duration of the read and write syscalls, reported on /syscalls (Linux only, default is false)
+-dump-dir: The directory of the diagnostic bundles written on SIGQUIT or with /debug/dump?file=true (default is the temporary directory)
+-config: A JSON config file of behavior settings, reloaded when it changes (optional), e.g.
+    {"Delay":"100ms","DelayJitter":"50ms","ErrorRate":0.1,"ErrorStatus":503,"Headers":{"X-Version":"v2"}}
+    Erroneous responses carry the echo response with InjectedError set. The settings in effect are served on /config.
+-config-poll: How often the -config file is checked for changes (default is 2s)
+-allow-cidr: Only accept clients from these comma separated CIDRs or IPs, others get 403 (default is all clients)
+-deny-cidr: Reject clients from these comma separated CIDRs or IPs with 403, even when allowed by -allow-cidr (default is none)
+-mux-port: Also serve HTTP/1, h2c, gRPC and a raw line echo protocol on this TCP port, detected from the first bytes (optional)
+-cluster, -region, -zone: The topology labels reported in Identity.Topology of the responses (default is
+    $TOPOLOGY_CLUSTER, $TOPOLOGY_REGION and $TOPOLOGY_ZONE)
+-topology-from-node: Detect the labels not set above from the topology.kubernetes.io/region, zone and
+    cluster labels of the node $NODE_NAME, with the API (default is false)
+-topology-kube-api: The API server URL for -topology-from-node, e.g. http://127.0.0.1:8001 of kubectl
+    proxy (default is the in-cluster service account)
+-journal: Journal the requests in this bbolt file, served on /requests/{id} (optional), e.g. /var/lib/journal/requests.db
+-journal-size: The number of requests kept in the -journal file, the oldest ones are evicted (default is 100000)
+-access-log: Log a line per request with its status, body size, duration and ID (default is false)
+-rate-limit: Reject the requests over this rate per second with 429, bursts of up to one second pass (default is 0, no limit)
+
+The options above can be overridden per request with the query parameters "expect-mode", "expect-delay",
+"early-hints", "response-headers", "response-header-size", "fingerprint", "resources", "request-cost", "rate-limit" and "template"
+(the name of a template, or "none" for the default JSON response).
 
 Notes:
 - The server listens on the specified port.
+- -topology-from-node reads the node once at startup, which needs the RBAC permission to get nodes
+  (a ClusterRole with "get" on "nodes"). Flags take precedence over the node labels; a failed
+  detection is logged and the flags alone are reported.
+- hostNetwork is detected by comparing the network namespace with the one of PID 1. In pods
+  without hostPID, mount the host /proc and set HOST_PROC to it, or set NODE_NAME so the
+  hostname can be compared with the node name instead.
+- The OS image is the one of the container image, unless the host root is mounted and HOST_ROOT
+  points to it. The net.* sysctls are the ones of the network namespace of the server.
+- TLS connections are counted on their first request, the session tickets when they are issued or
+  offered. A ticket offered again after a previous use (TicketsReused) is normal with TLS 1.2 but
+  not with the single-use tickets of TLS 1.3 clients, and a ticket offered by another client IP than
+  the one it was issued to (ForeignTickets) means a proxy shares sessions between its clients.
+- ServerProcessingMicros spans from the arrival of the request at the handler to the rendering of
+  the response, so it includes the waits of expect-mode=delay. The CPU time of -request-cost is the
+  one of the thread handling the request; its allocations are process wide counters, exact only when
+  no other measured request overlapped (RequestCost.Overlapped), and reading them briefly stops the world.
+- With -syscall-sampling, a read sample is the time spent in read(2) once the socket is readable, not
+  the wait for the data, while a write sample is the whole write call, including the waits for space
+  in the send buffer. The percentiles are computed on the last 4096 samples of each operation.
+- The -config file is polled rather than watched, since a ConfigMap mount is updated by swapping a
+  symlink. The kubelet syncs ConfigMap mounts periodically, so a change takes up to a minute or so to
+  reach the pod, and mounts with subPath are never updated. A config that does not parse is logged
+  and ignored, the previous generation stays in effect. Responses and the X-Config-Generation header
+  carry the generation, 0 (omitted) without config.
+- -allow-cidr and -deny-cidr apply to the peer address of the TCP connection, which is the last SNAT
+  address, never to X-Forwarded-For or Forwarded: the 403 response reports those headers next to the
+  observed client for comparison. /healthy is always served, so the kubelet probes keep working.
+- Resources comes from the cgroup of the process: cgroup v2, or the cpu, cpuacct and memory
+  controllers of cgroup v1. The CPU, throttling and OOM counters are cumulative since the container
+  started, compare two responses to see whether a slow run was throttled. Identity.NumCPU is the
+  number of CPUs of the node, GOMAXPROCS in Resources may exceed the CPU limit and cause throttling.
+- /sockstats matches the sockets by the local port (-port and -tls-port), so it also counts the
+  TIME_WAIT sockets and the sockets of other processes sharing the network namespace on those ports,
+  e.g. with hostNetwork. The accept queue is the current one, its limit is the smaller of the backlog
+  and net.core.somaxconn. ListenCounters are the counters of the whole network namespace since it was
+  created, compare two calls to get the drops of a test. /sockstats is served over the resource caps.
+- The -mux-port serves HTTP/1 when a connection starts with a request line, h2c when it starts with
+  the HTTP/2 preface (prior knowledge, the Upgrade: h2c handshake is not supported), and the raw line
+  echo otherwise, including clients that send nothing within 2s. gRPC is detected per request from
+  its content type, on h2c and on the -tls-port: any method answers the echo response as the JSON in
+  field 1 of the response message, the echo data being field 1 of the request message, and
+  /grpc.health.v1.Health/Check answers SERVING. Errors of the echo response become gRPC statuses,
+  e.g. 400 becomes INVALID_ARGUMENT. The raw protocol answers each line with a line of JSON. TLS
+  clients are closed, since HTTPS is served on the -tls-port. h2c needs Go 1.24 or newer.
+- With -journal, the entry of a request is synced to disk before the request is handled, which adds
+  the latency of an fsync to each request; concurrent requests share it. The entry is written once the
+  headers of the request were read, so requests lost before (dropped connections, 431 headers) are not
+  journaled, while requests rejected by -allow-cidr or the resource caps are. An entry left "received"
+  was still being handled, or the server stopped before it finished. Put the file on a volume that
+  survives restarts, e.g. an emptyDir or a PVC, and give a single server per file: bbolt locks it.
+- Every response carries the ID of its request in X-Request-Id (and RequestID for the echo responses):
+  the X-Request-Id of the request, or a UUID the server assigned. A handler that panics gets a 500
+  if it wrote nothing yet, the panic and its stack are logged. -rate-limit counts all the requests of
+  the server together, /healthy aside.
 
 Testing with curl:
 - To test the server over IPv4, use:
   curl http://127.0.0.1:8080
 - To test the server over IPv6, use:
   curl http://[::1]:8080
+- To respond to three concurrent HTTP/2 streams in the order 3, 1, 2 of their arrival with the first delayed, use:
+  for i in 1 2 3; do echo "url = \"https://127.0.0.1:8443/h2order?order=3,1,2&delays=1:200ms\""; done > streams.txt
+  curl -sk --http2 --parallel --config streams.txt
+- To get the fingerprint of the node after refreshing it, use:
+  curl 'http://127.0.0.1:8080/fingerprint?refresh=true'
+- To get the legacy ResponseData shape without restarting the server, use:
+  curl http://127.0.0.1:8080/v1/
+- To get 200 response headers of 1KB each, use:
+  curl -s -D - -o /dev/null 'http://127.0.0.1:8080/?response-headers=200&response-header-size=1024' | wc -c
+- To send 100 request headers of 1KB each and get their count and size, use:
+  curl -s $(for i in $(seq 100); do printf -- "-H X-Big-$i:%01024d " 0; done) http://127.0.0.1:8080 | jq .RequestHeaderStats
+- To download 10MB at 1MB/s, or 5 chunks of 64KB every 500ms at 128KB/s, use:
+  curl -o /dev/null 'http://127.0.0.1:8080/payload?size=10MB&rate-limit=1MB/s'
+  curl -N 'http://127.0.0.1:8080/stream?chunks=5&chunk-size=64KB&interval=500ms&rate-limit=128KB/s' | wc -c
+- To get a response declaring 1000 bytes that is reset after 100 bytes, use:
+  curl -v 'http://127.0.0.1:8080/truncate?length=1000&after=100&mode=reset'
+  curl http://127.0.0.1:8080/truncate/stats
+- To get the order template of the config file above, by path or by name, use:
+  curl -H 'X-Trace-Id: abc' http://127.0.0.1:8080/api/orders/1
+  curl 'http://127.0.0.1:8080/?template=order'
+- To check the session resumption of consecutive HTTPS connections, then the stats of all clients, use:
+  curl -sk --http1.1 -H 'Connection: close' https://127.0.0.1:8443 https://127.0.0.1:8443 | jq .TLSSession
+  curl -s 'http://127.0.0.1:8080/tls/sessions?reset=true'
+- To compare the client side latency with the server side processing time and cost, use:
+  curl -s -o r.json -w '%{time_total}\n' 'http://127.0.0.1:8080/?request-cost=true'
+  jq -c '{ServerProcessingMicros,RequestCost}' r.json
+- To only accept the pod network and see where denied requests come from, use:
+  go run http_server.go -allow-cidr=10.244.0.0/16,fd00:10:244::/56 &
+  curl -s http://<service-ip>:8080 | jq -c '{Denied, Reason, ClientIP, ForwardedFor}'
+- To inject errors in 10% of the responses, then check which config the responses come from, use:
+  echo '{"ErrorRate":0.1}' > behavior.json && go run http_server.go -config=behavior.json &
+  for i in $(seq 20); do curl -s http://127.0.0.1:8080 | jq -c '{ConfigGeneration,InjectedError}'; done
+- To get the percentiles of the read/write syscalls and of the request handling, then start over, use:
+  curl 'http://127.0.0.1:8080/syscalls?reset=true'
+- To detect HTTP/1, h2c, gRPC (with grpcurl) and raw clients on the same port, use:
+  go run http_server.go -mux-port=9090 &
+  curl -s http://127.0.0.1:9090 | jq .DetectedProtocol
+  curl -s --http2-prior-knowledge http://127.0.0.1:9090 | jq .DetectedProtocol
+  grpcurl -plaintext 127.0.0.1:9090 grpc.health.v1.Health/Check
+  echo hello | python3 -c 'import socket,sys; s=socket.create_connection(("127.0.0.1",9090)); s.sendall(sys.stdin.buffer.read()); print(s.makefile().readline())'
+- To get the goroutines, open file descriptors and socket states of the server, use:
+  curl http://127.0.0.1:8080/status
+- To check whether the server was throttled during a test, use:
+  curl -s 'http://127.0.0.1:8080/?resources=true' | jq -c '{Resources, Arch: .Identity.Arch}'
+- To watch the sockets and the listen drops of the server during a load test, use:
+  watch -n1 "curl -s http://127.0.0.1:8080/sockstats | jq -c '{States, AcceptQueue, ListenCounters}'"
+- To get the diagnostic bundle of a hanging server, or write it to a file in -dump-dir, use:
+  curl http://127.0.0.1:8080/debug/dump | jq -r .Goroutines
+  kill -QUIT <pid>
+- To exchange messages over the WebSocket (with websocat), use:
+  echo hello | websocat ws://127.0.0.1:8080/ws | jq .MessageCounter
+- To test a delayed 100 Continue followed by two Early Hints, use:
+  curl -v -H 'Expect: 100-continue' -d 'hello' 'http://127.0.0.1:8080/?expect-mode=delay&expect-delay=3s&early-hints=2'
+- To journal the requests, then check whether the server received a request and what became of it, use:
+  go run http_server.go -journal=/tmp/requests.db &
+  curl -s -H 'X-Request-Id: order-42' http://127.0.0.1:8080 | jq .RequestID
+  curl -s http://127.0.0.1:8080/requests/order-42 | jq -c '.Entries[] | {ReceivedAt, Outcome, Status}'
 */
 
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"main/common"
+	"main/journal"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"text/template"
 	"time"
 )
 
 var requestCount int
 var mutex sync.Mutex
+var identity *common.IdentityProvider
+var hostNetwork bool
+var fingerprint *common.FingerprintProvider
+var resourceGuard *common.ResourceGuard
+var diagnostics *common.Diagnostics
+var syscallSampler *common.SyscallSampler
+var behaviors *common.BehaviorProvider
+
+// serverOptions holds the runtime options of the HTTP server
+type serverOptions struct {
+	ExpectMode  string            // How to handle "Expect: 100-continue": accept, delay or reject
+	ExpectDelay time.Duration     // How long to wait before sending 100 Continue in delay mode
+	EarlyHints  int               // The number of 103 Early Hints responses to send
+	AuthEcho    bool              // Whether to echo the claims of the bearer token
+	JWKS        *common.JWKSCache // The keys used to verify the bearer token, nil to skip verification
+	Legacy      bool              // Whether to render the legacy ResponseData shape
+
+	ResponseHeaders    int // The number of X-Stress-<n> headers added to the response
+	ResponseHeaderSize int // The size in bytes of the value of each X-Stress-<n> header
+
+	Fingerprint bool // Whether to include the fingerprint of the node
+
+	Resources bool // Whether to include the cgroup limits and usage of the container
+
+	RequestCost bool // Whether to measure the CPU time and allocations of the request
+
+	ResponseRateLimit int64 // The bandwidth of /payload and /stream bodies per connection in bytes per second, 0 for unlimited
+
+	Templates    []*responseTemplate // The response body templates of -response-template
+	TemplateName string              // The template selected with the "template" query parameter, "none" for the default response
+}
+
+// responseTemplate is a user provided template of the response body
+type responseTemplate struct {
+	Name        string `json:"Name"`        // The name of the template, selected with the "template" query parameter
+	PathPrefix  string `json:"PathPrefix"`  // Requests under this path use the template, unless another one is selected
+	ContentType string `json:"ContentType"` // The Content-Type of the response (default is application/json)
+	StatusCode  int    `json:"StatusCode"`  // The status code of the response (default is 200)
+	Body        string `json:"Body"`        // The template of the body
+	BodyFile    string `json:"BodyFile"`    // The file holding the template of the body instead of Body, relative to the config file
+
+	tmpl *template.Template
+}
+
+// templateData is the data available to response templates: the fields of the echo response
+// and the request
+type templateData struct {
+	common.HttpServerResponse
+	Method string      // The method of the request
+	Path   string      // The path of the request
+	Query  url.Values  // The query parameters of the request
+	Header http.Header // The headers of the request, with all their values
+}
+
+// maxEarlyHints bounds the number of 103 Early Hints responses sent before the final response
+const maxEarlyHints = 10
+
+// maxStressHeaderBytes bounds the total size of the X-Stress-<n> response headers
+const maxStressHeaderBytes = 64 << 20
+
+// maxStressHeaders bounds the number of X-Stress-<n> response headers, whatever their size
+const maxStressHeaders = 10000
+
+// maxPayloadBytes bounds the size of /payload and /stream bodies
+const maxPayloadBytes = 1 << 30
 
 func main() {
 	// Define command-line flags
 	help := flag.Bool("h", false, "Display help information")
 	port := flag.String("port", "8080", "Specify the TCP port for the server to listen on")
+	expectMode := flag.String("expect-mode", "accept", "How to handle 'Expect: 100-continue': accept, delay or reject")
+	expectDelay := flag.Duration("expect-delay", 2*time.Second, "How long to wait before sending 100 Continue in delay mode")
+	earlyHints := flag.Int("early-hints", 0, "The number of 103 Early Hints responses to send before the final response")
+	authEcho := flag.Bool("auth-echo", false, "Echo the claims of the Authorization bearer token")
+	jwksURL := flag.String("jwks-url", "", "Verify the bearer token signature against this JWKS URL (implies -auth-echo)")
+	legacySchema := flag.Bool("legacy-schema", false, "Render the legacy ResponseData shape instead of HttpServerResponse")
+	tlsPort := flag.String("tls-port", "", "Also serve HTTPS with HTTP/2 on this TCP port")
+	tlsCert := flag.String("tls-cert", "", "The PEM certificate for HTTPS (default is a generated self-signed certificate)")
+	tlsKey := flag.String("tls-key", "", "The PEM key for HTTPS")
+	maxHeaderBytes := flag.Int("max-header-bytes", http.DefaultMaxHeaderBytes, "The maximum size of the request headers, larger ones are rejected with 431")
+	responseHeaders := flag.Int("response-headers", 0, "The number of X-Stress-<n> headers added to each response")
+	responseHeaderSize := flag.Int("response-header-size", 64, "The size in bytes of the value of each X-Stress-<n> header")
+	withFingerprint := flag.Bool("fingerprint", false, "Include the kernel and OS fingerprint of the node in responses")
+	reportResources := flag.Bool("report-resources", false, "Include the cgroup CPU and memory limits and usage of the container in responses")
+	requestCost := flag.Bool("request-cost", false, "Report the CPU time and heap allocations of each request")
+	responseRateLimit := flag.String("response-rate-limit", "", "The bandwidth of /payload and /stream bodies per connection, e.g. 1MB/s (default is unlimited)")
+	responseTemplateFile := flag.String("response-template", "", "A JSON config file of response body templates")
+	maxGoroutines := flag.Int("max-goroutines", 0, "Reject requests with 503 while the server has more goroutines (0 for no cap)")
+	maxFDs := flag.Int("max-fds", 0, "Reject requests with 503 while the server has more open file descriptors (0 for no cap)")
+	dumpDir := flag.String("dump-dir", "", "The directory of the diagnostic bundles (default is the temporary directory)")
+	syscallSampling := flag.Bool("syscall-sampling", false, "Sample the duration of the read and write syscalls, reported on /syscalls")
+	configFile := flag.String("config", "", "A JSON config file of behavior settings (delay, error rate, headers), reloaded when it changes")
+	configPoll := flag.Duration("config-poll", 2*time.Second, "How often the -config file is checked for changes")
+	allowCIDR := flag.String("allow-cidr", "", "Only accept clients from these CIDRs (or IPs), e.g. 10.244.0.0/16,fd00::/64, others get 403 (default is all)")
+	denyCIDR := flag.String("deny-cidr", "", "Reject clients from these CIDRs (or IPs) with 403, even when allowed by -allow-cidr (default is none)")
+	muxPort := flag.String("mux-port", "", "Also serve HTTP/1, h2c, gRPC and a raw line echo protocol on this TCP port, detected from the first bytes")
+	journalFile := flag.String("journal", "", "Journal the requests in this bbolt file, served on /requests/{id}")
+	journalSize := flag.Int("journal-size", 100000, "The number of requests kept in the -journal file, the oldest ones are evicted")
+	accessLogEnabled := flag.Bool("access-log", false, "Log a line per request with its status, size, duration and ID")
+	rateLimit := flag.Float64("rate-limit", 0, "Reject the requests over this rate per second with 429, bursts of up to one second pass (0 for no limit)")
+	topologyFlags := common.RegisterTopologyFlags()
 	flag.Parse()
 
 	// If the -h flag is set, display help information and exit
@@ -54,8 +396,189 @@ func main() {
 		return
 	}
 
+	if !isValidExpectMode(*expectMode) {
+		log.Fatalf("Invalid -expect-mode %q. Supported values are 'accept', 'delay' and 'reject'.", *expectMode)
+	}
+
+	// The ports of the sockets reported on /sockstats
+	var serverPorts []int
+	for _, value := range []string{*port, *tlsPort, *muxPort} {
+		if serverPort, err := strconv.Atoi(value); err == nil {
+			serverPorts = append(serverPorts, serverPort)
+		}
+	}
+
+	identity = common.NewIdentityProvider()
+	identity.SetTopology(topologyFlags.Resolve())
+
+	detected, method, err := common.DetectHostNetwork()
+	if err != nil {
+		log.Printf("Unable to detect hostNetwork, reporting false: %v", err)
+	} else {
+		log.Printf("HostNetwork: %t (%s)", detected, method)
+	}
+	hostNetwork = detected
+
+	var access accessList
+	if access.allow, err = common.ParseCIDRList(*allowCIDR); err != nil {
+		log.Fatalf("Invalid -allow-cidr: %v", err)
+	}
+	if access.deny, err = common.ParseCIDRList(*denyCIDR); err != nil {
+		log.Fatalf("Invalid -deny-cidr: %v", err)
+	}
+
+	fingerprint = common.NewFingerprintProvider()
+	fingerprint.RefreshOnHangup()
+
+	resourceGuard = common.NewResourceGuard(*maxGoroutines, *maxFDs)
+
+	if *syscallSampling {
+		if err := common.CheckSyscallSampling(); err != nil {
+			log.Fatalf("Invalid -syscall-sampling: %v", err)
+		}
+		syscallSampler = common.NewSyscallSampler()
+	}
+
+	if *configFile != "" {
+		if behaviors, err = common.NewBehaviorProvider(*configFile); err != nil {
+			log.Fatalf("Invalid -config: %v", err)
+		}
+		behaviors.Watch(*configPoll)
+	}
+
+	var requestJournal *journal.Journal
+	if *journalFile != "" {
+		if requestJournal, err = journal.Open(*journalFile, *journalSize); err != nil {
+			log.Fatalf("Invalid -journal: %v", err)
+		}
+		log.Printf("Journaling the last %d requests in %s", *journalSize, *journalFile)
+	}
+
+	diagnostics = common.NewDiagnostics("http", common.RecentRequestsKept, *dumpDir, func() map[string]interface{} {
+		mutex.Lock()
+		counters := map[string]interface{}{"Requests": requestCount, "Connections": connectionCount}
+		mutex.Unlock()
+		truncateMutex.Lock()
+		counters["Truncated"] = truncateStats
+		truncateMutex.Unlock()
+		return counters
+	}, identity, resourceGuard)
+	diagnostics.DumpOnQuit()
+
+	options := serverOptions{
+		ExpectMode:  *expectMode,
+		ExpectDelay: *expectDelay,
+		EarlyHints:  *earlyHints,
+		AuthEcho:    *authEcho || *jwksURL != "",
+		Legacy:      *legacySchema,
+
+		ResponseHeaders:    *responseHeaders,
+		ResponseHeaderSize: *responseHeaderSize,
+
+		Fingerprint: *withFingerprint,
+		Resources:   *reportResources,
+		RequestCost: *requestCost,
+	}
+	if options.EarlyHints < 0 || options.EarlyHints > maxEarlyHints {
+		log.Fatalf("Invalid -early-hints %d, it must be between 0 and %d", options.EarlyHints, maxEarlyHints)
+	}
+	if err := validateStressHeaders(options.ResponseHeaders, options.ResponseHeaderSize); err != nil {
+		log.Fatalf("Invalid response header options: %v", err)
+	}
+	if *jwksURL != "" {
+		options.JWKS = common.NewJWKSCache(*jwksURL)
+	}
+	if *responseRateLimit != "" {
+		if options.ResponseRateLimit, err = parseRate(*responseRateLimit); err != nil {
+			log.Fatalf("Invalid -response-rate-limit: %v", err)
+		}
+	}
+	if *responseTemplateFile != "" {
+		if options.Templates, err = loadResponseTemplates(*responseTemplateFile); err != nil {
+			log.Fatalf("Invalid -response-template: %v", err)
+		}
+		log.Printf("Loaded %d response templates from %s", len(options.Templates), *responseTemplateFile)
+	}
+
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		handleRequest(w, r, *port)
+		if isGRPCRequest(r) {
+			handleGRPC(w, r, *port, options)
+			return
+		}
+		handleRequest(w, r, *port, options)
+	})
+
+	// The /v1/ path always renders the legacy ResponseData shape
+	http.HandleFunc("/v1/", func(w http.ResponseWriter, r *http.Request) {
+		legacyOptions := options
+		legacyOptions.Legacy = true
+		handleRequest(w, r, *port, legacyOptions)
+	})
+
+	http.HandleFunc("/payload", func(w http.ResponseWriter, r *http.Request) {
+		handlePayload(w, r, options)
+	})
+	http.HandleFunc("/stream", func(w http.ResponseWriter, r *http.Request) {
+		handleStream(w, r, options)
+	})
+	http.HandleFunc("/h2order", handleH2Order)
+	http.HandleFunc("/truncate", handleTruncate)
+	http.HandleFunc("/ws", handleWebSocket)
+	http.HandleFunc("/fingerprint", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("refresh") == "true" {
+			sendJSON(w, fingerprint.Refresh())
+			return
+		}
+		sendJSON(w, fingerprint.Get())
+	})
+	http.HandleFunc("/truncate/stats", func(w http.ResponseWriter, r *http.Request) {
+		truncateMutex.Lock()
+		stats := truncateStats
+		truncateMutex.Unlock()
+		sendJSON(w, stats)
+	})
+
+	http.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		sendJSON(w, resourceGuard.Status())
+	})
+
+	http.Handle("/debug/dump", diagnostics)
+
+	http.HandleFunc("/syscalls", func(w http.ResponseWriter, r *http.Request) {
+		if syscallSampler == nil {
+			http.Error(w, "Syscall sampling is disabled, start the server with -syscall-sampling", http.StatusNotFound)
+			return
+		}
+		sendJSON(w, syscallSampler.Report(r.URL.Query().Get("reset") == "true"))
+	})
+
+	http.HandleFunc("/config", func(w http.ResponseWriter, r *http.Request) {
+		sendJSON(w, behaviors.Get())
+	})
+
+	http.HandleFunc("/sockstats", func(w http.ResponseWriter, r *http.Request) {
+		sendJSON(w, common.ServerSocketStats(serverPorts))
+	})
+
+	http.HandleFunc("/tls/sessions", func(w http.ResponseWriter, r *http.Request) {
+		sendJSON(w, tlsSessions.report(r.URL.Query().Get("reset") == "true"))
+	})
+
+	http.HandleFunc("GET /requests/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if requestJournal == nil {
+			http.Error(w, "The request journal is disabled, start the server with -journal", http.StatusNotFound)
+			return
+		}
+		lookup, err := requestJournal.Lookup(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Unable to read the journal: %v", err), http.StatusInternalServerError)
+			return
+		}
+		status := http.StatusOK
+		if !lookup.Found {
+			status = http.StatusNotFound
+		}
+		sendJSONStatus(w, lookup, status)
 	})
 
 	// 添加 /healthy 路由
@@ -64,21 +587,200 @@ func main() {
 		w.Write([]byte("OK"))
 	})
 
+	// The middlewares of all the handlers, the outermost first: the requests rejected by the access list,
+	// the rate limit or the resource caps are still journaled and kept for the diagnostic bundle. /status,
+	// /sockstats and /debug/dump stay available over the resource caps, to diagnose
+	var accessLog common.Middleware
+	if *accessLogEnabled {
+		accessLog = common.AccessLog
+	}
+	chain := common.NewChain(
+		common.Recover,
+		common.AssignRequestID,
+		accessLog,
+		requestJournal.Record,
+		diagnostics.Recorder,
+		access.guard,
+		common.Except(common.NewRateLimiter(*rateLimit).Limit, "/healthy"),
+		common.Except(resourceGuard.Guard, "/status", "/sockstats", "/debug/dump"),
+	)
+	handler := chain.Then(http.DefaultServeMux)
+
+	// Start the HTTPS server, net/http enables HTTP/2 on it
+	if *tlsPort != "" {
+		cert, err := common.LoadOrGenerateCertificate(*tlsCert, *tlsKey)
+		if err != nil {
+			log.Fatalf("Unable to load the TLS certificate: %v", err)
+		}
+		// NextProtos is set here since net/http adds h2 to a copy of TLSConfig, not to the
+		// configs returned by GetConfigForClient
+		tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}, NextProtos: []string{"h2", "http/1.1"}}
+		tlsConfig.GetConfigForClient = tlsSessions.configForClient(tlsConfig)
+		tlsServer := &http.Server{
+			Addr:           fmt.Sprintf(":%s", *tlsPort),
+			Handler:        common.NewChain(recordTLSSessions).Append(chain...).Then(http.DefaultServeMux),
+			ConnContext:    withStreamTracker,
+			TLSConfig:      tlsConfig,
+			MaxHeaderBytes: *maxHeaderBytes,
+		}
+		go func() {
+			fmt.Printf("HTTPS server is listening on port %s\n", *tlsPort)
+			listener, err := listen(tlsServer.Addr)
+			if err == nil {
+				err = tlsServer.ServeTLS(listener, "", "")
+			}
+			if err != nil {
+				log.Fatalf("HTTPS server failed to start: %v", err)
+			}
+		}()
+	}
+
+	// Start the server sniffing the protocol of each connection: HTTP/1 and h2c connections go to an
+	// http.Server serving both, the others to the raw line echo
+	if *muxPort != "" {
+		muxServer := &http.Server{
+			Addr:           fmt.Sprintf(":%s", *muxPort),
+			Handler:        handler,
+			ConnContext:    withSniffedProtocol,
+			MaxHeaderBytes: *maxHeaderBytes,
+			Protocols:      new(http.Protocols),
+		}
+		muxServer.Protocols.SetHTTP1(true)
+		muxServer.Protocols.SetUnencryptedHTTP2(true)
+		go func() {
+			fmt.Printf("Multi-protocol server is listening on port %s\n", *muxPort)
+			listener, err := listen(muxServer.Addr)
+			if err == nil {
+				err = muxServer.Serve(common.NewSniffListener(listener, sniffTimeout, func(conn *common.SniffedConn) {
+					serveRawEcho(conn, access)
+				}))
+			}
+			if err != nil {
+				log.Fatalf("Multi-protocol server failed to start: %v", err)
+			}
+		}()
+	}
+
 	// Start the HTTP server
 	address := fmt.Sprintf(":%s", *port)
+	server := &http.Server{Addr: address, Handler: handler, ConnContext: withStreamTracker, MaxHeaderBytes: *maxHeaderBytes}
 	fmt.Printf("Server is listening on port %s\n", *port)
-	if err := http.ListenAndServe(address, nil); err != nil {
+	listener, err := listen(address)
+	if err == nil {
+		err = server.Serve(listener)
+	}
+	if err != nil {
 		fmt.Printf("Server failed to start: %v\n", err)
 	}
 }
 
+// accessList holds the -allow-cidr and -deny-cidr rules, which apply to the IP the connection
+// comes from, as observed after any SNAT, not to the forwarding headers
+type accessList struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// check returns why a client IP is denied, or an empty string when it is allowed
+func (a accessList) check(ip net.IP) string {
+	if network := common.MatchCIDRList(a.deny, ip); network != nil {
+		return fmt.Sprintf("client %s is in the denied CIDR %s", ip, network)
+	}
+	if len(a.allow) > 0 && common.MatchCIDRList(a.allow, ip) == nil {
+		return fmt.Sprintf("client %s is not in the allowed CIDRs", ip)
+	}
+	return ""
+}
+
+// guard rejects the denied clients with 403 and the client as the server observed it. /healthy
+// stays available, so the probes of the kubelet do not depend on the rules.
+func (a accessList) guard(next http.Handler) http.Handler {
+	if len(a.allow) == 0 && len(a.deny) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		clientIP, clientPort, _ := net.SplitHostPort(r.RemoteAddr)
+		reason := a.check(net.ParseIP(clientIP))
+		if reason == "" || r.URL.Path == "/healthy" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		serverIP, ipVersion := common.GetServerIPAndVersion(r)
+		response := common.AccessDeniedResponse{
+			ServerHostName: identity.Get().HostName,
+			ServerType:     "http",
+			Denied:         true,
+			Reason:         reason,
+			ClientIP:       clientIP,
+			ClientPort:     clientPort,
+			ServerIP:       serverIP,
+			ServerPort:     localPort(r),
+			IPVersion:      ipVersion,
+			ForwardedFor:   append(r.Header.Values("X-Forwarded-For"), r.Header.Values("Forwarded")...),
+			Identity:       identity.Get(),
+		}
+		log.Printf("Denied request from %s: %s", r.RemoteAddr, reason)
+		sendJSONStatus(w, response, http.StatusForbidden)
+	})
+}
+
+// listen listens on a TCP address, sampling the syscalls of the connections with -syscall-sampling
+func listen(address string) (net.Listener, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil || syscallSampler == nil {
+		return listener, err
+	}
+	return common.SampledListener(listener, syscallSampler), nil
+}
+
 // handleRequest processes incoming HTTP requests
-func handleRequest(w http.ResponseWriter, r *http.Request, serverPort string) {
+func handleRequest(w http.ResponseWriter, r *http.Request, serverPort string, options serverOptions) {
 	mutex.Lock()
 	requestCount++
 	currentRequestCount := requestCount
 	mutex.Unlock()
 
+	options, err := applyQueryOptions(r, options)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// The processing time spans from here to the rendering of the response, which is left out
+	// since the response carries it
+	meter := common.StartCostMeter(options.RequestCost)
+	defer meter.Stop()
+
+	// The behavior of the config is read once, so the whole request follows the same generation
+	behavior := behaviors.Get()
+	for name, value := range behavior.Config.Headers {
+		w.Header().Set(name, value)
+	}
+	if behavior.Generation > 0 {
+		w.Header().Set("X-Config-Generation", strconv.FormatUint(behavior.Generation, 10))
+	}
+	if delay := behavior.NextDelay(); delay > 0 {
+		time.Sleep(delay)
+	}
+
+	// Handle "Expect: 100-continue" before the body is read, since reading the
+	// body is what makes net/http send the 100 Continue response
+	expectContinue := ""
+	if strings.EqualFold(r.Header.Get("Expect"), "100-continue") {
+		switch options.ExpectMode {
+		case "reject":
+			log.Printf("Rejected 'Expect: 100-continue' from %s", r.RemoteAddr)
+			http.Error(w, "Expectation rejected by server (expect-mode=reject)", http.StatusExpectationFailed)
+			return
+		case "delay":
+			time.Sleep(options.ExpectDelay)
+			expectContinue = fmt.Sprintf("delayed %s", options.ExpectDelay)
+		default:
+			expectContinue = "accepted"
+		}
+	}
+
 	serverHostName, clientIP, clientPort, serverIP, ipVersion, echoData, requestHttpHeaders, err := processRequest(r)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -87,6 +789,14 @@ func handleRequest(w http.ResponseWriter, r *http.Request, serverPort string) {
 
 	envList := common.GetEnvironmentVariables("ENV_")
 
+	earlyHints := sendEarlyHints(w, options.EarlyHints)
+	serverIdentity := identity.Get()
+
+	var authEcho *common.AuthEcho
+	if options.AuthEcho {
+		authEcho = common.ParseBearerToken(r, options.JWKS)
+	}
+
 	response := common.HttpServerResponse{
 		ServerHostName:     serverHostName,
 		ClientIP:           clientIP,
@@ -101,6 +811,57 @@ func handleRequest(w http.ResponseWriter, r *http.Request, serverPort string) {
 		RequestCounter:     currentRequestCount,
 		ServerType:         "http",  // Set server type to http
 		EnvList:            envList, // Add environment variables to the response
+		ExpectContinue:     expectContinue,
+		EarlyHints:         earlyHints,
+		Identity:           serverIdentity,
+		HostNetwork:        hostNetwork,
+		Auth:               authEcho,
+		RequestHeaderStats: common.NewHeaderStats(r.Header),
+		ConfigGeneration:   behavior.Generation,
+		RequestID:          common.RequestID(r),
+	}
+	response.ResponseHeaders, response.ResponseHeaderBytes = addStressHeaders(w, options.ResponseHeaders, options.ResponseHeaderSize)
+	if options.Fingerprint {
+		nodeFingerprint := fingerprint.Get()
+		response.Fingerprint = &nodeFingerprint
+	}
+	if options.Resources {
+		response.Resources = common.ReadCgroupResources()
+	}
+	if r.TLS != nil {
+		response.TLSSession = newTLSSessionEcho(r, clientIP)
+	}
+	if protocol := detectedProtocol(r); protocol != "" {
+		response.DetectedProtocol = protocol
+		response.ServerPort = localPort(r)
+	}
+
+	processing, cost := meter.Stop()
+	syscallSampler.Observe("handle", processing)
+	response.ServerProcessingMicros = processing.Microseconds()
+	response.RequestCost = cost
+	w.Header().Set("Server-Timing", fmt.Sprintf("app;dur=%.3f", float64(processing)/float64(time.Millisecond)))
+
+	// Injected errors always carry the echo response, so the tests see which generation produced them
+	if behavior.InjectError() {
+		response.InjectedError = true
+		log.Printf("Injected a %d error (config generation %d)", behavior.Config.ErrorStatus, behavior.Generation)
+		if err := sendJSONStatus(w, response, behavior.Config.ErrorStatus); err != nil {
+			http.Error(w, "Unable to send response", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	if tmpl := selectResponseTemplate(options, r.URL.Path); tmpl != nil {
+		sendTemplate(w, r, tmpl, response)
+		return
+	}
+
+	if options.Legacy {
+		if err := sendJSON(w, common.NewResponseData(response)); err != nil {
+			http.Error(w, "Unable to send response", http.StatusInternalServerError)
+		}
+		return
 	}
 
 	if err := sendResponse(w, response); err != nil {
@@ -108,11 +869,746 @@ func handleRequest(w http.ResponseWriter, r *http.Request, serverPort string) {
 	}
 }
 
+// streamTrackerKey is the context key of the streamTracker of a connection
+type streamTrackerKey struct{}
+
+// streamTracker records the requests of one connection, in the order they arrived and responded,
+// and paces the rate limited bodies sent on it
+type streamTracker struct {
+	mutex     sync.Mutex
+	cond      *sync.Cond
+	id        int          // The ID of the connection
+	arrivals  int          // The number of requests received on the connection
+	responded map[int]bool // The stream IDs that have been responded to
+	responses int          // The number of responses sent on the connection
+	paceUntil time.Time    // When the rate limited bytes scheduled so far on the connection are sent
+
+	tlsRecorded bool // Whether the TLS handshake of the connection has been counted
+}
+
+var connectionCount int
+
+// withStreamTracker attaches a new streamTracker to the context of each accepted connection
+func withStreamTracker(ctx context.Context, conn net.Conn) context.Context {
+	mutex.Lock()
+	connectionCount++
+	tracker := &streamTracker{id: connectionCount, responded: make(map[int]bool)}
+	mutex.Unlock()
+
+	tracker.cond = sync.NewCond(&tracker.mutex)
+	return context.WithValue(ctx, streamTrackerKey{}, tracker)
+}
+
+// pace schedules n more bytes on the connection at rate bytes per second and returns how long
+// to wait before sending them. All the streams of a connection share the schedule, so the
+// limit applies to the connection as a whole.
+func (t *streamTracker) pace(n int, rate int64) time.Duration {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	now := time.Now()
+	if t.paceUntil.Before(now) {
+		t.paceUntil = now
+	}
+	wait := t.paceUntil.Sub(now)
+	t.paceUntil = t.paceUntil.Add(time.Duration(float64(n) / float64(rate) * float64(time.Second)))
+	return wait
+}
+
+// maxH2OrderWait bounds the delay of a /h2order stream and its wait for the streams ordered before it
+const maxH2OrderWait = 30 * time.Second
+
+// H2OrderResponse represents the body of a /h2order response
+type H2OrderResponse struct {
+	Protocol      string  `json:"Protocol"`      // The protocol of the request, e.g. HTTP/2.0
+	ConnectionID  int     `json:"ConnectionID"`  // The ID of the connection, in the order connections were accepted
+	ArrivalIndex  int     `json:"ArrivalIndex"`  // The position of this request among the requests of the connection, starting at 1
+	ResponseIndex int     `json:"ResponseIndex"` // The position of this response among the responses of the connection, starting at 1
+	DelayMs       float64 `json:"DelayMs"`       // The delay applied to this stream
+	WaitedMs      float64 `json:"WaitedMs"`      // How long this stream waited for the streams ordered before it
+	TimedOut      bool    `json:"TimedOut"`      // Indicates if the wait for the streams ordered before it timed out
+}
+
+// handleH2Order responds to the concurrent streams of a connection in a controlled order.
+//
+// net/http does not expose HTTP/2 stream IDs to handlers, so the streams are identified by
+// their arrival index on the connection: 1 for the first request whose headers were read, 2 for
+// the next one and so on. Streams whose headers arrive within the same instant may be numbered
+// in either order.
+//
+// Query parameters:
+//   - order: the arrival indexes in the order the streams must be responded to, e.g. "3,1,2".
+//     A stream waits until all streams listed before it have been responded to.
+//   - delay: the delay applied to every stream before responding, e.g. "100ms"
+//   - delays: per-stream delays overriding delay, e.g. "1:300ms,3:0s"
+//   - wait: how long a stream waits for the streams ordered before it (default is 5s)
+//
+// delay, delays and wait are bounded by maxH2OrderWait. A stream whose client goes away stops
+// waiting and is not responded to.
+func handleH2Order(w http.ResponseWriter, r *http.Request) {
+	tracker, ok := r.Context().Value(streamTrackerKey{}).(*streamTracker)
+	if !ok {
+		http.Error(w, "No stream tracker for this connection", http.StatusInternalServerError)
+		return
+	}
+
+	tracker.mutex.Lock()
+	tracker.arrivals++
+	arrival := tracker.arrivals
+	tracker.mutex.Unlock()
+
+	query := r.URL.Query()
+	var order []int
+	for _, item := range splitParam(query.Get("order")) {
+		id, err := strconv.Atoi(item)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid order %q, expected a list of arrival indexes", query.Get("order")), http.StatusBadRequest)
+			return
+		}
+		order = append(order, id)
+	}
+
+	delay, err := parseOptionalDuration(query.Get("delay"), 0)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid delay: %v", err), http.StatusBadRequest)
+		return
+	}
+	for _, item := range splitParam(query.Get("delays")) {
+		parts := strings.SplitN(item, ":", 2)
+		id, err := strconv.Atoi(parts[0])
+		if err != nil || len(parts) != 2 {
+			http.Error(w, fmt.Sprintf("invalid delays %q, expected <arrival index>:<duration> pairs", query.Get("delays")), http.StatusBadRequest)
+			return
+		}
+		if id == arrival {
+			if delay, err = time.ParseDuration(parts[1]); err != nil {
+				http.Error(w, fmt.Sprintf("invalid delay for stream %d: %v", id, err), http.StatusBadRequest)
+				return
+			}
+		}
+	}
+	wait, err := parseOptionalDuration(query.Get("wait"), 5*time.Second)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid wait: %v", err), http.StatusBadRequest)
+		return
+	}
+	if delay < 0 || delay > maxH2OrderWait || wait < 0 || wait > maxH2OrderWait {
+		http.Error(w, fmt.Sprintf("invalid delay or wait, they must be between 0 and %s", maxH2OrderWait), http.StatusBadRequest)
+		return
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-r.Context().Done():
+		return
+	}
+
+	// Wait until the streams ordered before this one have been responded to
+	var predecessors []int
+	for _, id := range order {
+		if id == arrival {
+			break
+		}
+		predecessors = append(predecessors, id)
+	}
+	if len(predecessors) == len(order) {
+		predecessors = nil // Streams not listed in the order are not held back
+	}
+
+	response := H2OrderResponse{Protocol: r.Proto, ConnectionID: tracker.id, ArrivalIndex: arrival, DelayMs: float64(delay.Microseconds()) / 1000}
+	waitStart := time.Now()
+	wakeUp := func() {
+		tracker.mutex.Lock()
+		tracker.cond.Broadcast()
+		tracker.mutex.Unlock()
+	}
+	deadline := time.AfterFunc(wait, wakeUp)
+	defer deadline.Stop()
+	stopWakeUp := context.AfterFunc(r.Context(), wakeUp)
+	defer stopWakeUp()
+
+	tracker.mutex.Lock()
+	for !allResponded(tracker.responded, predecessors) {
+		if r.Context().Err() != nil {
+			tracker.mutex.Unlock()
+			return
+		}
+		if time.Since(waitStart) >= wait {
+			response.TimedOut = true
+			break
+		}
+		tracker.cond.Wait()
+	}
+	tracker.responded[arrival] = true
+	tracker.responses++
+	response.ResponseIndex = tracker.responses
+	tracker.cond.Broadcast()
+	tracker.mutex.Unlock()
+	response.WaitedMs = float64(time.Since(waitStart).Microseconds()) / 1000
+
+	log.Printf("Responding to request %d of connection %d (%s) as response %d", arrival, tracker.id, r.Proto, response.ResponseIndex)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// allResponded checks if all the streams of the given arrival indexes have been responded to
+func allResponded(responded map[int]bool, arrivals []int) bool {
+	for _, id := range arrivals {
+		if !responded[id] {
+			return false
+		}
+	}
+	return true
+}
+
+// splitParam splits a comma separated query parameter, ignoring empty items
+func splitParam(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// parseOptionalDuration parses a duration, returning defaultValue for an empty string
+func parseOptionalDuration(value string, defaultValue time.Duration) (time.Duration, error) {
+	if value == "" {
+		return defaultValue, nil
+	}
+	return time.ParseDuration(value)
+}
+
+// handlePayload sends a body of "size" bytes (default 1MB) with a Content-Length, shaped to the
+// rate limit of the server or of the "rate-limit" query parameter
+func handlePayload(w http.ResponseWriter, r *http.Request, options serverOptions) {
+	options, err := applyQueryOptions(r, options)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	size, err := parseSize(r.URL.Query().Get("size"), 1<<20)
+	if err != nil || size > maxPayloadBytes {
+		http.Error(w, fmt.Sprintf("invalid size %q, it must be between 0 and 1GB", r.URL.Query().Get("size")), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	start := time.Now()
+	sent, err := writeShaped(w, r, size, options.ResponseRateLimit)
+	logShaped(r, "payload", sent, start, options.ResponseRateLimit, err)
+}
+
+// handleStream sends "chunks" chunks (default 10) of "chunk-size" bytes (default 1KB), flushing
+// each one and sleeping "interval" (default 1s) between them, shaped to the rate limit
+func handleStream(w http.ResponseWriter, r *http.Request, options serverOptions) {
+	options, err := applyQueryOptions(r, options)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	query := r.URL.Query()
+	chunks, err := strconv.Atoi(query.Get("chunks"))
+	if query.Get("chunks") == "" {
+		chunks, err = 10, nil
+	}
+	chunkSize, sizeErr := parseSize(query.Get("chunk-size"), 1024)
+	interval, intervalErr := parseOptionalDuration(query.Get("interval"), time.Second)
+	if err != nil || sizeErr != nil || intervalErr != nil || chunks < 0 || chunkSize <= 0 || int64(chunks) > maxPayloadBytes/chunkSize {
+		http.Error(w, "invalid chunks, chunk-size or interval, the stream must not exceed 1GB", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	start := time.Now()
+	var sent int64
+	for i := 0; i < chunks && err == nil; i++ {
+		if i > 0 {
+			select {
+			case <-time.After(interval):
+			case <-r.Context().Done():
+				err = r.Context().Err()
+				continue
+			}
+		}
+		var n int64
+		n, err = writeShaped(w, r, chunkSize, options.ResponseRateLimit)
+		sent += n
+	}
+	logShaped(r, "stream", sent, start, options.ResponseRateLimit, err)
+}
+
+// writeShaped writes size bytes to the response and flushes them. With a rate limit, the bytes
+// are written in small slices paced by the streamTracker of the connection, and each slice is
+// flushed so the client sees the bandwidth rather than the buffering of the server.
+func writeShaped(w http.ResponseWriter, r *http.Request, size int64, rate int64) (int64, error) {
+	tracker, _ := r.Context().Value(streamTrackerKey{}).(*streamTracker)
+	flusher, _ := w.(http.Flusher)
+
+	sliceSize := int64(32 << 10)
+	if rate > 0 && rate/20 < sliceSize {
+		sliceSize = max(rate/20, 1) // About 20 writes per second
+	}
+	slice := bytes.Repeat([]byte("x"), int(min(sliceSize, max(size, 1))))
+
+	var sent int64
+	for sent < size {
+		n := min(int64(len(slice)), size-sent)
+		if rate > 0 && tracker != nil {
+			select {
+			case <-time.After(tracker.pace(int(n), rate)):
+			case <-r.Context().Done():
+				return sent, r.Context().Err()
+			}
+		}
+		written, err := w.Write(slice[:n])
+		sent += int64(written)
+		if err != nil {
+			return sent, err
+		}
+		if rate > 0 && flusher != nil {
+			flusher.Flush()
+		}
+	}
+	if flusher != nil {
+		flusher.Flush()
+	}
+	return sent, nil
+}
+
+// logShaped logs the size and the achieved bandwidth of a /payload or /stream body
+func logShaped(r *http.Request, endpoint string, sent int64, start time.Time, rate int64, err error) {
+	elapsed := time.Since(start)
+	achieved := float64(sent) / elapsed.Seconds()
+	status := "completed"
+	if err != nil {
+		status = fmt.Sprintf("aborted (%v)", err)
+	}
+	log.Printf("Sent %s of %d bytes to %s (%s) in %s at %.0f B/s (limit %d B/s): %s", endpoint, sent, r.RemoteAddr, r.Proto, elapsed, achieved, rate, status)
+}
+
+// parseSize parses a size in bytes with an optional KB, MB or GB suffix (powers of 1024),
+// returning defaultValue for an empty string
+func parseSize(value string, defaultValue int64) (int64, error) {
+	if value == "" {
+		return defaultValue, nil
+	}
+	multiplier := int64(1)
+	upper := strings.ToUpper(value)
+	for _, unit := range []struct {
+		suffix     string
+		multiplier int64
+	}{{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1}} {
+		if strings.HasSuffix(upper, unit.suffix) {
+			upper, multiplier = strings.TrimSuffix(upper, unit.suffix), unit.multiplier
+			break
+		}
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(upper), 10, 64)
+	if err != nil || n < 0 || n > maxPayloadBytes/multiplier {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+	return n * multiplier, nil
+}
+
+// parseRate parses a bandwidth such as "1MB/s" or "512KB" in bytes per second, "0" disables the limit
+func parseRate(value string) (int64, error) {
+	rate, err := parseSize(strings.TrimSuffix(strings.TrimSpace(value), "/s"), 0)
+	if err != nil {
+		return 0, fmt.Errorf("invalid rate %q, expected e.g. 1MB/s", value)
+	}
+	return rate, nil
+}
+
+// TruncateStats sums up the truncated responses sent by the /truncate endpoint
+type TruncateStats struct {
+	Responses     int   `json:"Responses"`     // The number of truncated responses
+	DeclaredBytes int64 `json:"DeclaredBytes"` // The sum of the declared Content-Length
+	SentBytes     int64 `json:"SentBytes"`     // The sum of the body bytes actually sent
+}
+
+var truncateStats TruncateStats
+var truncateMutex sync.Mutex
+
+// handleTruncate declares a Content-Length of "length" bytes but aborts the response after
+// "after" bytes of body. With mode=close the connection is closed gracefully (FIN), with
+// mode=reset it is reset (RST). HTTP/2 connections are shared by other streams, so there
+// only the stream is reset, whatever the mode.
+func handleTruncate(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	length, err := strconv.ParseInt(query.Get("length"), 10, 64)
+	if query.Get("length") == "" {
+		length, err = 1024, nil
+	}
+	if err != nil || length <= 0 || length > 1<<30 {
+		http.Error(w, "invalid length, it must be between 1 and 1073741824", http.StatusBadRequest)
+		return
+	}
+	after, err := strconv.ParseInt(query.Get("after"), 10, 64)
+	if query.Get("after") == "" {
+		after, err = length/2, nil
+	}
+	if err != nil || after < 0 || after >= length {
+		http.Error(w, "invalid after, it must be at least 0 and less than length", http.StatusBadRequest)
+		return
+	}
+	mode := query.Get("mode")
+	if mode == "" {
+		mode = "close"
+	}
+	if mode != "close" && mode != "reset" {
+		http.Error(w, "invalid mode, supported values are 'close' and 'reset'", http.StatusBadRequest)
+		return
+	}
+
+	body := bytes.Repeat([]byte("x"), int(after))
+	var sent int
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok || r.ProtoMajor != 1 {
+		// HTTP/2: send what we can and abort the handler, which resets the stream
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", strconv.FormatInt(length, 10))
+		w.WriteHeader(http.StatusOK)
+		sent, _ = w.Write(body)
+		if flusher, ok := w.(http.Flusher); ok {
+			flusher.Flush()
+		}
+		recordTruncate(r, length, sent, "stream reset")
+		panic(http.ErrAbortHandler)
+	}
+
+	conn, buffered, err := hijacker.Hijack()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("unable to take over the connection: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer conn.Close()
+
+	fmt.Fprintf(buffered, "HTTP/1.1 200 OK\r\nContent-Type: application/octet-stream\r\nContent-Length: %d\r\n\r\n", length)
+	if err := buffered.Flush(); err == nil {
+		sent, _ = conn.Write(body)
+	}
+
+	if tcpConn, ok := common.UnwrapTCPConn(conn); ok && mode == "reset" {
+		tcpConn.SetLinger(0) // Closing with a zero linger sends a RST
+	}
+	recordTruncate(r, length, sent, mode)
+}
+
+// recordTruncate logs a truncated response and adds it to the stats
+func recordTruncate(r *http.Request, declared int64, sent int, mode string) {
+	truncateMutex.Lock()
+	truncateStats.Responses++
+	truncateStats.DeclaredBytes += declared
+	truncateStats.SentBytes += int64(sent)
+	truncateMutex.Unlock()
+
+	log.Printf("Truncated response to %s (%s): sent %d of %d declared bytes, then %s", r.RemoteAddr, r.Proto, sent, declared, mode)
+}
+
+// handleWebSocket upgrades the request to a WebSocket and replies to each text or binary message
+// with a WebSocketEcho, until the client closes it. Long-lived clients use it to detect when
+// their connection breaks.
+func handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	ws, err := common.UpgradeWebSocket(w, r)
+	if err != nil {
+		log.Printf("WebSocket upgrade from %s failed: %v", r.RemoteAddr, err)
+		return
+	}
+	defer ws.Close()
+
+	serverHostName, _ := os.Hostname()
+	clientIP, clientPort, _ := net.SplitHostPort(r.RemoteAddr)
+	connectedAt := time.Now().Format(time.RFC3339)
+	log.Printf("WebSocket opened by %s", r.RemoteAddr)
+
+	messages := 0
+	for {
+		_, data, err := ws.ReadMessage()
+		if err != nil {
+			log.Printf("WebSocket of %s ended after %d messages: %v", r.RemoteAddr, messages, err)
+			return
+		}
+		messages++
+		reply, _ := json.Marshal(common.WebSocketEcho{
+			ServerHostName:   serverHostName,
+			ClientIP:         clientIP,
+			ClientPort:       clientPort,
+			ClientEchoData:   string(data),
+			ConnectedAt:      connectedAt,
+			MessageCounter:   messages,
+			RequestTimestamp: time.Now().Format(time.RFC3339),
+			Identity:         identity.Get(),
+		})
+		if err := ws.WriteMessage(common.WebSocketText, reply); err != nil {
+			log.Printf("WebSocket of %s ended after %d messages: %v", r.RemoteAddr, messages, err)
+			return
+		}
+	}
+}
+
+// isValidExpectMode checks if the given mode is a supported "Expect: 100-continue" handling mode
+func isValidExpectMode(mode string) bool {
+	return mode == "accept" || mode == "delay" || mode == "reject"
+}
+
+// applyQueryOptions overrides the server options with the ones given in the request's query parameters
+func applyQueryOptions(r *http.Request, options serverOptions) (serverOptions, error) {
+	query := r.URL.Query()
+
+	if mode := query.Get("expect-mode"); mode != "" {
+		if !isValidExpectMode(mode) {
+			return options, fmt.Errorf("invalid expect-mode %q, supported values are 'accept', 'delay' and 'reject'", mode)
+		}
+		options.ExpectMode = mode
+	}
+
+	if delay := query.Get("expect-delay"); delay != "" {
+		d, err := time.ParseDuration(delay)
+		if err != nil {
+			return options, fmt.Errorf("invalid expect-delay %q: %v", delay, err)
+		}
+		options.ExpectDelay = d
+	}
+
+	if hints := query.Get("early-hints"); hints != "" {
+		n, err := strconv.Atoi(hints)
+		if err != nil || n < 0 || n > maxEarlyHints {
+			return options, fmt.Errorf("invalid early-hints %q, it must be an integer between 0 and %d", hints, maxEarlyHints)
+		}
+		options.EarlyHints = n
+	}
+
+	if headers := query.Get("response-headers"); headers != "" {
+		n, err := strconv.Atoi(headers)
+		if err != nil {
+			return options, fmt.Errorf("invalid response-headers %q, it must be a non-negative integer", headers)
+		}
+		options.ResponseHeaders = n
+	}
+
+	if size := query.Get("response-header-size"); size != "" {
+		n, err := strconv.Atoi(size)
+		if err != nil {
+			return options, fmt.Errorf("invalid response-header-size %q, it must be a non-negative integer", size)
+		}
+		options.ResponseHeaderSize = n
+	}
+
+	if err := validateStressHeaders(options.ResponseHeaders, options.ResponseHeaderSize); err != nil {
+		return options, err
+	}
+
+	if value := query.Get("fingerprint"); value != "" {
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return options, fmt.Errorf("invalid fingerprint %q, it must be true or false", value)
+		}
+		options.Fingerprint = enabled
+	}
+
+	if value := query.Get("resources"); value != "" {
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return options, fmt.Errorf("invalid resources %q, it must be true or false", value)
+		}
+		options.Resources = enabled
+	}
+
+	if value := query.Get("request-cost"); value != "" {
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return options, fmt.Errorf("invalid request-cost %q, it must be true or false", value)
+		}
+		options.RequestCost = enabled
+	}
+
+	if value := query.Get("rate-limit"); value != "" {
+		rate, err := parseRate(value)
+		if err != nil {
+			return options, err
+		}
+		options.ResponseRateLimit = rate
+	}
+
+	if name := query.Get("template"); name != "" {
+		if name != "none" && findResponseTemplate(options.Templates, name) == nil {
+			return options, fmt.Errorf("unknown template %q", name)
+		}
+		options.TemplateName = name
+	}
+
+	return options, nil
+}
+
+// loadResponseTemplates loads and parses the response body templates of a JSON config file
+func loadResponseTemplates(path string) ([]*responseTemplate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var config struct {
+		Templates []*responseTemplate `json:"Templates"`
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("invalid config %s: %v", path, err)
+	}
+
+	for i, t := range config.Templates {
+		if t.Name == "" || t.Name == "none" || findResponseTemplate(config.Templates[:i], t.Name) != nil {
+			return nil, fmt.Errorf("template %d must have a unique name other than 'none'", i+1)
+		}
+		if (t.Body == "") == (t.BodyFile == "") {
+			return nil, fmt.Errorf("template %s must have either Body or BodyFile", t.Name)
+		}
+		if t.StatusCode == 0 {
+			t.StatusCode = http.StatusOK
+		}
+		if t.StatusCode < 100 || t.StatusCode > 999 {
+			return nil, fmt.Errorf("template %s has an invalid StatusCode %d", t.Name, t.StatusCode)
+		}
+		if t.ContentType == "" {
+			t.ContentType = "application/json"
+		}
+
+		body := t.Body
+		if t.BodyFile != "" {
+			bodyFile := t.BodyFile
+			if !filepath.IsAbs(bodyFile) {
+				bodyFile = filepath.Join(filepath.Dir(path), bodyFile)
+			}
+			content, err := os.ReadFile(bodyFile)
+			if err != nil {
+				return nil, fmt.Errorf("template %s: %v", t.Name, err)
+			}
+			body = string(content)
+		}
+		if t.tmpl, err = template.New(t.Name).Funcs(templateFuncs(0)).Parse(body); err != nil {
+			return nil, fmt.Errorf("template %s: %v", t.Name, err)
+		}
+	}
+	return config.Templates, nil
+}
+
+// templateFuncs returns the functions of response templates: the ones of EchoData templates plus json
+func templateFuncs(counter int) template.FuncMap {
+	funcs := common.TemplateFuncs(counter)
+	funcs["json"] = func(value interface{}) (string, error) {
+		data, err := json.Marshal(value)
+		return string(data), err
+	}
+	return funcs
+}
+
+// findResponseTemplate returns the template with the given name, or nil
+func findResponseTemplate(templates []*responseTemplate, name string) *responseTemplate {
+	for _, t := range templates {
+		if t.Name == name {
+			return t
+		}
+	}
+	return nil
+}
+
+// selectResponseTemplate returns the template selected with the "template" query parameter, or
+// else the first one whose PathPrefix matches the path, or nil for the default response
+func selectResponseTemplate(options serverOptions, path string) *responseTemplate {
+	if options.TemplateName == "none" {
+		return nil
+	}
+	if options.TemplateName != "" {
+		return findResponseTemplate(options.Templates, options.TemplateName)
+	}
+	for _, t := range options.Templates {
+		if t.PathPrefix != "" && strings.HasPrefix(path, t.PathPrefix) {
+			return t
+		}
+	}
+	return nil
+}
+
+// sendTemplate renders the response with a response template and writes it to the response writer
+func sendTemplate(w http.ResponseWriter, r *http.Request, t *responseTemplate, response common.HttpServerResponse) {
+	// Clone the template to bind the counter of this request
+	tmpl, err := t.tmpl.Clone()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Unable to render template %s: %v", t.Name, err), http.StatusInternalServerError)
+		return
+	}
+	tmpl.Funcs(templateFuncs(response.RequestCounter))
+
+	var body bytes.Buffer
+	err = tmpl.Execute(&body, templateData{
+		HttpServerResponse: response,
+		Method:             r.Method,
+		Path:               r.URL.Path,
+		Query:              r.URL.Query(),
+		Header:             r.Header,
+	})
+	if err != nil {
+		log.Printf("Unable to render template %s: %v", t.Name, err)
+		http.Error(w, fmt.Sprintf("Unable to render template %s: %v", t.Name, err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", t.ContentType)
+	w.WriteHeader(t.StatusCode)
+	w.Write(body.Bytes())
+
+	log.Printf("Sent response with template %s: %s", t.Name, body.Bytes())
+}
+
+// validateStressHeaders checks the number and size of the X-Stress-<n> response headers
+func validateStressHeaders(count, size int) error {
+	if count < 0 || size < 0 {
+		return fmt.Errorf("response-headers and response-header-size must be non-negative")
+	}
+	if count > maxStressHeaders {
+		return fmt.Errorf("response-headers must not exceed %d", maxStressHeaders)
+	}
+	if count > 0 && size > maxStressHeaderBytes/count {
+		return fmt.Errorf("response-headers x response-header-size must not exceed %d bytes", maxStressHeaderBytes)
+	}
+	return nil
+}
+
+// addStressHeaders adds count X-Stress-<n> headers with values of size bytes to the response,
+// and returns the number of headers and their size on the wire (name, ": ", value and CRLF)
+func addStressHeaders(w http.ResponseWriter, count, size int) (int, int) {
+	if count == 0 {
+		return 0, 0
+	}
+	value := strings.Repeat("x", size)
+	total := 0
+	for i := 1; i <= count; i++ {
+		name := fmt.Sprintf("X-Stress-%d", i)
+		w.Header().Set(name, value)
+		total += len(name) + len(value) + 4
+	}
+	return count, total
+}
+
+// sendEarlyHints sends the given number of 103 Early Hints responses and returns how many were sent
+func sendEarlyHints(w http.ResponseWriter, count int) int {
+	for i := 0; i < count; i++ {
+		w.Header().Set("Link", fmt.Sprintf("</early-hint-%d.css>; rel=preload; as=style", i+1))
+		w.WriteHeader(http.StatusEarlyHints)
+	}
+	// The Link header is only meant for the informational responses
+	w.Header().Del("Link")
+	return count
+}
+
 // processRequest extracts and logs request data
 func processRequest(r *http.Request) (string, string, string, string, string, string, map[string]string, error) {
-	serverHostName, err := os.Hostname()
-	if err != nil {
-		return "", "", "", "", "", "", nil, fmt.Errorf("unable to get hostname: %v", err)
+	serverHostName := identity.Get().HostName
+	if serverHostName == "" {
+		return "", "", "", "", "", "", nil, fmt.Errorf("unable to get hostname")
 	}
 
 	clientIP, clientPort, err := net.SplitHostPort(r.RemoteAddr)
@@ -140,14 +1636,491 @@ func processRequest(r *http.Request) (string, string, string, string, string, st
 
 // sendResponse marshals the response data to JSON and writes it to the response writer
 func sendResponse(w http.ResponseWriter, response common.HttpServerResponse) error {
+	return sendJSON(w, response)
+}
+
+// sendJSON marshals any response shape to JSON and writes it to the response writer
+func sendJSON(w http.ResponseWriter, response interface{}) error {
+	return sendJSONStatus(w, response, http.StatusOK)
+}
+
+// sendJSONStatus marshals any response shape to JSON and writes it with a status code
+func sendJSONStatus(w http.ResponseWriter, response interface{}, statusCode int) error {
 	responseJSON, err := json.Marshal(response)
 	if err != nil {
 		return fmt.Errorf("unable to marshal response data: %v", err)
 	}
 
 	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
 	w.Write(responseJSON)
 
 	log.Printf("Sent response: %s", responseJSON)
 	return nil
 }
+
+// tlsSessionTracker counts the TLS connections, session resumptions and session tickets of each
+// client IP. Tickets are tagged with an ID in their encrypted state, so a ticket offered again
+// is recognized, along with the client it was issued to.
+type tlsSessionTracker struct {
+	mutex      sync.Mutex
+	clients    map[string]*common.TLSClientSessions
+	tickets    map[uint64]*ticketRecord
+	lastTicket uint64
+}
+
+// ticketRecord records who a session ticket was issued to and how often it was offered
+type ticketRecord struct {
+	issuedTo string
+	uses     int
+}
+
+// ticketTagPrefix marks the ticket ID in the Extra data of the session state
+const ticketTagPrefix = "echo-ticket:"
+
+// maxTrackedTickets and maxTrackedTLSClients bound the memory of the TLS session stats,
+// the tracked tickets or clients are forgotten when they are exceeded
+const (
+	maxTrackedTickets    = 100000
+	maxTrackedTLSClients = 10000
+)
+
+var tlsSessions = newTLSSessionTracker()
+
+func newTLSSessionTracker() *tlsSessionTracker {
+	return &tlsSessionTracker{
+		clients: make(map[string]*common.TLSClientSessions),
+		tickets: make(map[uint64]*ticketRecord),
+	}
+}
+
+// configForClient returns a GetConfigForClient callback giving each handshake a copy of base
+// that tags the tickets it issues and records the tickets it is offered. The tickets are
+// encrypted with the keys of base, so they stay valid across connections.
+func (t *tlsSessionTracker) configForClient(base *tls.Config) func(*tls.ClientHelloInfo) (*tls.Config, error) {
+	return func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		clientIP, _, err := net.SplitHostPort(hello.Conn.RemoteAddr().String())
+		if err != nil {
+			clientIP = hello.Conn.RemoteAddr().String()
+		}
+
+		config := base.Clone()
+		config.GetConfigForClient = nil
+		config.WrapSession = func(cs tls.ConnectionState, ss *tls.SessionState) ([]byte, error) {
+			id := t.issueTicket(clientIP)
+			extra := [][]byte{[]byte(ticketTagPrefix + strconv.FormatUint(id, 10))}
+			for _, data := range ss.Extra {
+				// A resumed session carries the tag of the ticket it came from
+				if !strings.HasPrefix(string(data), ticketTagPrefix) {
+					extra = append(extra, data)
+				}
+			}
+			ss.Extra = extra
+			return base.EncryptTicket(cs, ss)
+		}
+		config.UnwrapSession = func(identity []byte, cs tls.ConnectionState) (*tls.SessionState, error) {
+			ss, err := base.DecryptTicket(identity, cs)
+			if ss != nil {
+				for _, data := range ss.Extra {
+					tag, ok := strings.CutPrefix(string(data), ticketTagPrefix)
+					if !ok {
+						continue
+					}
+					if id, err := strconv.ParseUint(tag, 10, 64); err == nil {
+						t.presentTicket(clientIP, id)
+					}
+				}
+			}
+			return ss, err
+		}
+		return config, nil
+	}
+}
+
+// client returns the stats of a client IP, creating them if needed. The caller holds the mutex.
+func (t *tlsSessionTracker) client(clientIP string) *common.TLSClientSessions {
+	stats, ok := t.clients[clientIP]
+	if !ok {
+		if len(t.clients) >= maxTrackedTLSClients {
+			log.Printf("Tracking more than %d TLS clients, forgetting them", maxTrackedTLSClients)
+			t.clients = make(map[string]*common.TLSClientSessions)
+		}
+		stats = &common.TLSClientSessions{ClientIP: clientIP}
+		t.clients[clientIP] = stats
+	}
+	return stats
+}
+
+// issueTicket records a ticket sent to a client and returns its ID
+func (t *tlsSessionTracker) issueTicket(clientIP string) uint64 {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if len(t.tickets) >= maxTrackedTickets {
+		log.Printf("Tracking more than %d TLS session tickets, forgetting them", maxTrackedTickets)
+		t.tickets = make(map[uint64]*ticketRecord)
+	}
+	t.lastTicket++
+	t.tickets[t.lastTicket] = &ticketRecord{issuedTo: clientIP}
+	t.client(clientIP).TicketsIssued++
+	return t.lastTicket
+}
+
+// presentTicket records a valid ticket offered by a client
+func (t *tlsSessionTracker) presentTicket(clientIP string, id uint64) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	stats := t.client(clientIP)
+	stats.TicketsPresented++
+	record, ok := t.tickets[id]
+	if !ok {
+		// Issued before the stats were reset or by a previous run sharing the ticket keys
+		return
+	}
+	record.uses++
+	if record.uses > 1 {
+		stats.TicketsReused++
+	}
+	if record.issuedTo != clientIP {
+		stats.ForeignTickets++
+	}
+}
+
+// recordConnection records the handshake of a connection and returns the stats of its client
+func (t *tlsSessionTracker) recordConnection(clientIP string, resumed bool) common.TLSClientSessions {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	stats := t.client(clientIP)
+	stats.Connections++
+	if resumed {
+		stats.Resumed++
+	}
+	stats.ResumptionRate = float64(stats.Resumed) / float64(stats.Connections)
+	stats.LastSeen = time.Now().Format(time.RFC3339)
+	return *stats
+}
+
+// clientStats returns the stats of a client IP
+func (t *tlsSessionTracker) clientStats(clientIP string) common.TLSClientSessions {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if stats, ok := t.clients[clientIP]; ok {
+		return *stats
+	}
+	return common.TLSClientSessions{ClientIP: clientIP}
+}
+
+// report sums up the stats of all the clients, optionally resetting them
+func (t *tlsSessionTracker) report(reset bool) common.TLSSessionReport {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	report := common.TLSSessionReport{Clients: []common.TLSClientSessions{}}
+	for _, stats := range t.clients {
+		report.Connections += stats.Connections
+		report.Resumed += stats.Resumed
+		report.TicketsIssued += stats.TicketsIssued
+		report.TicketsPresented += stats.TicketsPresented
+		report.TicketsReused += stats.TicketsReused
+		report.ForeignTickets += stats.ForeignTickets
+		report.Clients = append(report.Clients, *stats)
+	}
+	if report.Connections > 0 {
+		report.ResumptionRate = float64(report.Resumed) / float64(report.Connections)
+	}
+	sort.Slice(report.Clients, func(i, j int) bool { return report.Clients[i].ClientIP < report.Clients[j].ClientIP })
+
+	if reset {
+		t.clients = make(map[string]*common.TLSClientSessions)
+		t.tickets = make(map[uint64]*ticketRecord)
+	}
+	return report
+}
+
+// recordTLSSessions counts the handshake of each TLS connection once, on its first request
+func recordTLSSessions(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if tracker, ok := r.Context().Value(streamTrackerKey{}).(*streamTracker); ok && r.TLS != nil {
+			tracker.mutex.Lock()
+			first := !tracker.tlsRecorded
+			tracker.tlsRecorded = true
+			tracker.mutex.Unlock()
+
+			if first {
+				clientIP, _, _ := net.SplitHostPort(r.RemoteAddr)
+				tlsSessions.recordConnection(clientIP, r.TLS.DidResume)
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// newTLSSessionEcho describes the TLS session of a request and the stats of its client
+func newTLSSessionEcho(r *http.Request, clientIP string) *common.TLSSessionEcho {
+	return &common.TLSSessionEcho{
+		Version:            tls.VersionName(r.TLS.Version),
+		CipherSuite:        tls.CipherSuiteName(r.TLS.CipherSuite),
+		ServerName:         r.TLS.ServerName,
+		NegotiatedProtocol: r.TLS.NegotiatedProtocol,
+		DidResume:          r.TLS.DidResume,
+		Client:             tlsSessions.clientStats(clientIP),
+	}
+}
+
+// sniffTimeout is how long the -mux-port waits for the first bytes of a connection, after which
+// the connection is served as raw
+const sniffTimeout = 2 * time.Second
+
+// sniffedProtocolKey is the context key of the protocol detected on a -mux-port connection
+type sniffedProtocolKey struct{}
+
+// withSniffedProtocol attaches the streamTracker and the detected protocol to the context of each
+// connection of the -mux-port
+func withSniffedProtocol(ctx context.Context, conn net.Conn) context.Context {
+	ctx = withStreamTracker(ctx, conn)
+	if sniffed, ok := conn.(*common.SniffedConn); ok {
+		ctx = context.WithValue(ctx, sniffedProtocolKey{}, sniffed.Protocol)
+	}
+	return ctx
+}
+
+// detectedProtocol returns the protocol of a request: grpc for gRPC calls, or the protocol
+// detected from the first bytes of its -mux-port connection, empty for the other ports
+func detectedProtocol(r *http.Request) string {
+	if isGRPCRequest(r) {
+		return "grpc"
+	}
+	protocol, _ := r.Context().Value(sniffedProtocolKey{}).(string)
+	return protocol
+}
+
+// localPort returns the port a request arrived on
+func localPort(r *http.Request) string {
+	var port string
+	if local, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		_, port, _ = net.SplitHostPort(local.String())
+	}
+	return port
+}
+
+// isGRPCRequest reports whether a request is a gRPC call, which requires HTTP/2
+func isGRPCRequest(r *http.Request) bool {
+	return r.ProtoMajor == 2 && strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc")
+}
+
+// grpcHealthCheck is the method of the standard gRPC health service
+const grpcHealthCheck = "/grpc.health.v1.Health/Check"
+
+// grpcStatuses maps the statuses of the echo response to gRPC status codes, others are UNKNOWN (2)
+var grpcStatuses = map[int]int{
+	http.StatusOK:                  0,  // OK
+	http.StatusBadRequest:          3,  // INVALID_ARGUMENT
+	http.StatusForbidden:           7,  // PERMISSION_DENIED
+	http.StatusExpectationFailed:   9,  // FAILED_PRECONDITION
+	http.StatusInternalServerError: 13, // INTERNAL
+	http.StatusServiceUnavailable:  14, // UNAVAILABLE
+}
+
+// handleGRPC answers any gRPC method with the echo response, without the proto of a service: the
+// JSON of the response is sent as field 1 (a string) of the response message, and the echo data
+// is field 1 of the request message, or the whole message when it has no such field. The health
+// check method answers SERVING, for the gRPC probes of the kubelet.
+func handleGRPC(w http.ResponseWriter, r *http.Request, serverPort string, options serverOptions) {
+	message, err := readGRPCMessage(r.Body)
+	if err != nil {
+		writeGRPCStatus(w, 3, fmt.Sprintf("unable to read the request message: %v", err))
+		return
+	}
+	if r.URL.Path == grpcHealthCheck {
+		w.Header().Set("Content-Type", "application/grpc")
+		writeGRPCMessage(w, []byte{0x08, 0x01}) // status: SERVING
+		writeGRPCStatus(w, 0, "")
+		return
+	}
+
+	// The echo response is rendered by handleRequest, as for the other protocols
+	echo := r.Clone(r.Context())
+	echo.Body = io.NopCloser(strings.NewReader(protobufStringField(message)))
+	recorder := &grpcRecorder{header: make(http.Header), status: http.StatusOK}
+	handleRequest(recorder, echo, serverPort, options)
+
+	for name, values := range recorder.header {
+		if name != "Content-Type" && name != "Content-Length" {
+			w.Header()[name] = values
+		}
+	}
+	w.Header().Set("Content-Type", "application/grpc")
+	code, ok := grpcStatuses[recorder.status]
+	if !ok {
+		code = 2
+	}
+	if code != 0 {
+		writeGRPCStatus(w, code, strings.TrimSpace(recorder.body.String()))
+		return
+	}
+	writeGRPCMessage(w, appendProtobufString(nil, recorder.body.Bytes()))
+	writeGRPCStatus(w, 0, "")
+}
+
+// grpcRecorder captures the response of handleRequest, to send it as a gRPC message
+type grpcRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (g *grpcRecorder) Header() http.Header { return g.header }
+
+func (g *grpcRecorder) Write(data []byte) (int, error) { return g.body.Write(data) }
+
+// WriteHeader records the final status, the informational ones have no gRPC equivalent
+func (g *grpcRecorder) WriteHeader(statusCode int) {
+	if statusCode >= 200 {
+		g.status = statusCode
+	}
+}
+
+// readGRPCMessage reads the first length-prefixed message of a gRPC request: a compressed flag,
+// which must be 0, and the big-endian length of the message. An empty body is an empty message.
+func readGRPCMessage(body io.Reader) ([]byte, error) {
+	var prefix [5]byte
+	if _, err := io.ReadFull(body, prefix[:]); err == io.EOF {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if prefix[0] != 0 {
+		return nil, fmt.Errorf("compressed messages are not supported")
+	}
+	length := binary.BigEndian.Uint32(prefix[1:])
+	if length > 4<<20 {
+		return nil, fmt.Errorf("message of %d bytes over the limit of 4MB", length)
+	}
+	message := make([]byte, length)
+	_, err := io.ReadFull(body, message)
+	return message, err
+}
+
+// writeGRPCMessage sends a length-prefixed message, uncompressed
+func writeGRPCMessage(w http.ResponseWriter, message []byte) {
+	prefix := make([]byte, 5, 5+len(message))
+	binary.BigEndian.PutUint32(prefix[1:], uint32(len(message)))
+	w.Write(append(prefix, message...))
+}
+
+// writeGRPCStatus ends a gRPC call with its status, in the trailers. The message is
+// percent-encoded as the gRPC over HTTP/2 protocol requires.
+func writeGRPCStatus(w http.ResponseWriter, code int, message string) {
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set(http.TrailerPrefix+"Grpc-Status", strconv.Itoa(code))
+	if message != "" {
+		var encoded strings.Builder
+		for _, c := range []byte(message) {
+			if c < 0x20 || c > 0x7e || c == '%' {
+				fmt.Fprintf(&encoded, "%%%02X", c)
+			} else {
+				encoded.WriteByte(c)
+			}
+		}
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", encoded.String())
+	}
+}
+
+// protobufStringField returns the length-delimited field 1 of a protobuf message when the whole
+// message is that field, otherwise the message itself
+func protobufStringField(message []byte) string {
+	if len(message) < 2 || message[0] != 0x0a {
+		return string(message)
+	}
+	length, n := binary.Uvarint(message[1:])
+	if n <= 0 || uint64(len(message)-1-n) != length {
+		return string(message)
+	}
+	return string(message[1+n:])
+}
+
+// appendProtobufString appends value as the length-delimited field 1 of a protobuf message
+func appendProtobufString(message, value []byte) []byte {
+	message = append(message, 0x0a)
+	message = binary.AppendUvarint(message, uint64(len(value)))
+	return append(message, value...)
+}
+
+// serveRawEcho answers each line received on a raw connection of the -mux-port with the echo
+// response of the line, as a line of JSON, until the client closes the connection. TLS clients
+// are closed with a hint, since HTTPS is served on the -tls-port.
+func serveRawEcho(conn *common.SniffedConn, access accessList) {
+	defer conn.Close()
+	if conn.Protocol == common.SniffedTLS {
+		log.Printf("Closed the TLS connection of %s on the multi-protocol port, HTTPS is served on -tls-port", conn.RemoteAddr())
+		return
+	}
+
+	clientIP, clientPort, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	serverIP, serverPort, _ := net.SplitHostPort(conn.LocalAddr().String())
+	ipVersion := "IPv4"
+	if ip := net.ParseIP(serverIP); ip != nil && ip.To4() == nil {
+		ipVersion = "IPv6"
+	}
+	encoder := json.NewEncoder(conn)
+	if reason := access.check(net.ParseIP(clientIP)); reason != "" {
+		log.Printf("Denied raw connection from %s: %s", conn.RemoteAddr(), reason)
+		encoder.Encode(common.AccessDeniedResponse{
+			ServerHostName: identity.Get().HostName,
+			ServerType:     "raw",
+			Denied:         true,
+			Reason:         reason,
+			ClientIP:       clientIP,
+			ClientPort:     clientPort,
+			ServerIP:       serverIP,
+			ServerPort:     serverPort,
+			IPVersion:      ipVersion,
+			ForwardedFor:   []string{},
+			Identity:       identity.Get(),
+		})
+		return
+	}
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+	for scanner.Scan() {
+		if err := resourceGuard.Admit(); err != nil {
+			log.Printf("Rejected raw request from %s: %v", conn.RemoteAddr(), err)
+			encoder.Encode(map[string]string{"Error": err.Error()})
+			return
+		}
+		mutex.Lock()
+		requestCount++
+		currentRequestCount := requestCount
+		mutex.Unlock()
+
+		echoData := strings.TrimSuffix(scanner.Text(), "\r")
+		log.Printf("Received raw request from %s:%s with data: %s", clientIP, clientPort, echoData)
+		response := common.HttpServerResponse{
+			ServerHostName:   identity.Get().HostName,
+			ClientIP:         clientIP,
+			ClientPort:       clientPort,
+			ServerIP:         serverIP,
+			ServerPort:       serverPort,
+			IPVersion:        ipVersion,
+			ClientEchoData:   echoData,
+			RequestTimestamp: time.Now().Format(time.RFC3339),
+			RequestCounter:   currentRequestCount,
+			ServerType:       "raw",
+			EnvList:          common.GetEnvironmentVariables("ENV_"),
+			Identity:         identity.Get(),
+			HostNetwork:      hostNetwork,
+			DetectedProtocol: common.SniffedRaw,
+		}
+		if err := encoder.Encode(response); err != nil {
+			log.Printf("Unable to send the raw response to %s: %v", conn.RemoteAddr(), err)
+			return
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		log.Printf("Raw connection of %s failed: %v", conn.RemoteAddr(), err)
+	}
+}
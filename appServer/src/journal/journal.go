@@ -0,0 +1,289 @@
+// Package journal persists an entry per request of the HTTP server in a bbolt file. It lives out
+// of common, which keeps building without external modules.
+package journal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"main/common"
+	"net/http"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// The outcomes of a journal entry
+const (
+	Received = "received"  // Persisted on receipt, not finished yet, or the server stopped before it finished
+	Answered = "answered"  // The handler returned after writing a response, see Status
+	NoAnswer = "no answer" // The handler returned without writing anything, net/http sent an empty 200
+	Aborted  = "aborted"   // The handler panicked, e.g. with http.ErrAbortHandler, the client got no complete response or a 500 of Recover
+	Hijacked = "hijacked"  // The connection was taken over, e.g. by a WebSocket
+)
+
+// Entry represents a request recorded by the journal
+type Entry struct {
+	RequestID          string  `json:"RequestID"`                    // The ID of the request, from X-Request-Id or assigned by the server
+	IDAssigned         bool    `json:"IDAssigned,omitempty"`         // Indicates if the server assigned the ID, the client sent none or an invalid one
+	Sequence           uint64  `json:"Sequence"`                     // The position of the entry in the journal
+	ReceivedAt         string  `json:"ReceivedAt"`                   // When the request reached the server, once its headers were read
+	FinishedAt         string  `json:"FinishedAt,omitempty"`         // When the handler returned
+	DurationMs         float64 `json:"DurationMs,omitempty"`         // The time between ReceivedAt and FinishedAt
+	Client             string  `json:"Client"`                       // The address of the client, as the server observed it
+	Method             string  `json:"Method"`                       // The method of the request
+	Host               string  `json:"Host"`                         // The Host header of the request
+	URI                string  `json:"URI"`                          // The request URI
+	Proto              string  `json:"Proto"`                        // The protocol of the request, e.g. HTTP/1.1
+	UserAgent          string  `json:"UserAgent,omitempty"`          // The User-Agent header of the request
+	Outcome            string  `json:"Outcome"`                      // What became of the request: received, answered, no answer, aborted or hijacked
+	Status             int     `json:"Status,omitempty"`             // The status code of the response
+	ResponseBytes      int64   `json:"ResponseBytes,omitempty"`      // The size of the response body written by the handler
+	ClientDisconnected bool    `json:"ClientDisconnected,omitempty"` // Indicates if the client was gone before the handler returned
+}
+
+// LookupResult represents the entries of a request ID. When none is found, the retention window
+// tells whether the request would still be in the journal had it been received.
+type LookupResult struct {
+	RequestID        string  `json:"RequestID"`                  // The looked up request ID
+	Found            bool    `json:"Found"`                      // Indicates if the journal holds the request
+	Entries          []Entry `json:"Entries"`                    // The entries of the request ID, several when the client reused it, e.g. on retries
+	Retained         int     `json:"Retained"`                   // The number of entries in the journal
+	Capacity         int     `json:"Capacity"`                   // The maximum number of entries kept
+	OldestReceivedAt string  `json:"OldestReceivedAt,omitempty"` // When the oldest entry kept was received
+}
+
+var (
+	entriesBucket = []byte("entries") // Sequence -> JSON entry
+	idsBucket     = []byte("ids")     // Request ID, NUL, sequence -> nothing
+)
+
+// Journal persists an entry per request in a bbolt file, so it can be proven after the fact whether
+// the server received a request and what became of it, including across restarts. The journal is a
+// ring: once it holds capacity entries, each new entry evicts the oldest one.
+//
+// The entry of a request is committed on receipt, before the request is handled, and updated
+// when the handler returns. bbolt syncs each commit to disk; concurrent requests share commits,
+// which are delayed by up to a millisecond to gather them. A nil Journal records nothing.
+type Journal struct {
+	db       *bolt.DB
+	capacity uint64
+}
+
+// Open opens or creates the journal file at path, keeping up to capacity entries. A journal
+// reopened with a smaller capacity drops its oldest entries.
+func Open(path string, capacity int) (*Journal, error) {
+	if capacity <= 0 {
+		return nil, fmt.Errorf("the capacity must be positive, got %d", capacity)
+	}
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("unable to open %s: %v", path, err)
+	}
+	db.MaxBatchDelay = time.Millisecond
+	j := &Journal{db: db, capacity: uint64(capacity)}
+	err = db.Update(func(tx *bolt.Tx) error {
+		entries, err := tx.CreateBucketIfNotExists(entriesBucket)
+		if err != nil {
+			return err
+		}
+		ids, err := tx.CreateBucketIfNotExists(idsBucket)
+		if err != nil {
+			return err
+		}
+		return j.evict(entries, ids, entries.Sequence())
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("unable to initialize %s: %v", path, err)
+	}
+	return j, nil
+}
+
+// Close closes the journal file
+func (j *Journal) Close() error {
+	if j == nil {
+		return nil
+	}
+	return j.db.Close()
+}
+
+// Record journals the requests passed to next under their ID, assigning it as common.AssignRequestID does
+// unless a middleware of the chain did already. A request whose entry cannot be committed is still
+// served, the failure is logged.
+func (j *Journal) Record(next http.Handler) http.Handler {
+	if j == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Lookups of the journal are not journaled, they would evict the entries being looked up
+		if strings.HasPrefix(r.URL.Path, "/requests/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		r = common.WithRequestID(w, r)
+		start := time.Now()
+		entry := Entry{
+			RequestID:  common.RequestID(r),
+			IDAssigned: common.RequestID(r) != r.Header.Get(common.RequestIDHeader),
+			ReceivedAt: start.Format(time.RFC3339Nano),
+			Client:     r.RemoteAddr,
+			Method:     r.Method,
+			Host:       r.Host,
+			URI:        r.URL.RequestURI(),
+			Proto:      r.Proto,
+			UserAgent:  r.UserAgent(),
+			Outcome:    Received,
+		}
+		sequence, err := j.begin(&entry)
+		if err != nil {
+			log.Printf("Unable to journal request %s: %v", entry.RequestID, err)
+		}
+
+		recorder := &common.StatusRecorder{ResponseWriter: w}
+		completed := false
+		// Deferred, so handlers aborted with a panic (e.g. http.ErrAbortHandler) are journaled too
+		defer func() {
+			if sequence == 0 {
+				return
+			}
+			finished := time.Now()
+			entry.FinishedAt = finished.Format(time.RFC3339Nano)
+			entry.DurationMs = float64(finished.Sub(start).Microseconds()) / 1000
+			entry.Status = recorder.Status()
+			entry.ResponseBytes = recorder.Bytes()
+			entry.ClientDisconnected = r.Context().Err() != nil
+			switch {
+			case recorder.Hijacked():
+				entry.Outcome = Hijacked
+			case !completed:
+				entry.Outcome = Aborted
+			case recorder.Status() == 0:
+				entry.Outcome = NoAnswer
+			default:
+				entry.Outcome = Answered
+			}
+			// The response is complete once the handler returns, the update need not delay it
+			go func() {
+				if err := j.finish(sequence, entry); err != nil {
+					log.Printf("Unable to journal the outcome of request %s: %v", entry.RequestID, err)
+				}
+			}()
+		}()
+		next.ServeHTTP(recorder, r)
+		completed = true
+	})
+}
+
+// begin commits the entry of a received request and returns its sequence
+func (j *Journal) begin(entry *Entry) (uint64, error) {
+	var sequence uint64
+	err := j.db.Batch(func(tx *bolt.Tx) error {
+		entries, ids := tx.Bucket(entriesBucket), tx.Bucket(idsBucket)
+		next, err := entries.NextSequence()
+		if err != nil {
+			return err
+		}
+		entry.Sequence = next
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		if err := entries.Put(entryKey(next), data); err != nil {
+			return err
+		}
+		if err := ids.Put(idKey(entry.RequestID, next), nil); err != nil {
+			return err
+		}
+		sequence = next
+		return j.evict(entries, ids, next)
+	})
+	return sequence, err
+}
+
+// finish updates the entry of a request once handled, unless it was evicted meanwhile
+func (j *Journal) finish(sequence uint64, entry Entry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return j.db.Batch(func(tx *bolt.Tx) error {
+		entries := tx.Bucket(entriesBucket)
+		if entries.Get(entryKey(sequence)) == nil {
+			return nil
+		}
+		return entries.Put(entryKey(sequence), data)
+	})
+}
+
+// evict removes the oldest entries until the ones up to sequence fit in the capacity
+func (j *Journal) evict(entries, ids *bolt.Bucket, sequence uint64) error {
+	var expiredEntries, expiredIDs [][]byte
+	cursor := entries.Cursor()
+	for key, value := cursor.First(); key != nil && sequence-binary.BigEndian.Uint64(key) >= j.capacity; key, value = cursor.Next() {
+		var entry Entry
+		if err := json.Unmarshal(value, &entry); err == nil {
+			expiredIDs = append(expiredIDs, idKey(entry.RequestID, binary.BigEndian.Uint64(key)))
+		}
+		expiredEntries = append(expiredEntries, key)
+	}
+	// Deleting while iterating would make the cursor skip keys
+	for _, key := range expiredEntries {
+		if err := entries.Delete(key); err != nil {
+			return err
+		}
+	}
+	for _, key := range expiredIDs {
+		if err := ids.Delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Lookup returns the entries of a request ID, oldest first
+func (j *Journal) Lookup(id string) (LookupResult, error) {
+	lookup := LookupResult{RequestID: id, Entries: []Entry{}, Capacity: int(j.capacity)}
+	err := j.db.View(func(tx *bolt.Tx) error {
+		entries, ids := tx.Bucket(entriesBucket), tx.Bucket(idsBucket)
+		prefix := idKey(id, 0)[:len(id)+1]
+		cursor := ids.Cursor()
+		for key, _ := cursor.Seek(prefix); key != nil && bytes.HasPrefix(key, prefix) && len(key) == len(prefix)+8; key, _ = cursor.Next() {
+			var entry Entry
+			if err := json.Unmarshal(entries.Get(key[len(prefix):]), &entry); err != nil {
+				return fmt.Errorf("corrupted entry %x: %v", key[len(prefix):], err)
+			}
+			lookup.Entries = append(lookup.Entries, entry)
+		}
+
+		// The sequences of the entries kept are contiguous
+		cursor = entries.Cursor()
+		first, value := cursor.First()
+		last, _ := cursor.Last()
+		if first != nil {
+			lookup.Retained = int(binary.BigEndian.Uint64(last)-binary.BigEndian.Uint64(first)) + 1
+			var oldest Entry
+			if json.Unmarshal(value, &oldest) == nil {
+				lookup.OldestReceivedAt = oldest.ReceivedAt
+			}
+		}
+		return nil
+	})
+	lookup.Found = len(lookup.Entries) > 0
+	return lookup, err
+}
+
+// entryKey returns the key of an entry, its big-endian sequence, so the entries are kept in order
+func entryKey(sequence uint64) []byte {
+	return binary.BigEndian.AppendUint64(nil, sequence)
+}
+
+// idKey returns the key indexing an entry by its request ID
+func idKey(id string, sequence uint64) []byte {
+	key := append([]byte(id), 0)
+	return binary.BigEndian.AppendUint64(key, sequence)
+}
@@ -2,9 +2,92 @@
 This program implements a simple proxy server that can forward requests using either HTTP or UDP.
 
 Main Features:
-1. Forwards client requests to a specified backend URL using HTTP or UDP.
+1. Forwards client requests to a specified backend URL using HTTP or UDP, or sends DNS queries
+   to a resolver over plain DNS, DNS-over-TLS (dot) or DNS-over-HTTPS (doh).
 2. Controls the timeout for backend requests.
 3. Returns the backend response to the client, including success status and data or error message.
+4. Optionally sets the TTL / hop limit and DSCP of forwarded packets, and reports the values
+   observed on UDP backend responses, to test QoS marking preservation across the fabric.
+5. Optionally sets the IPv6 flow label of forwarded UDP packets and reports the flow label observed
+   on the backend response, to study ECMP hashing on the fabric.
+6. Propagates the client's request context to the backend, so backend work is cancelled as soon as
+   the client disconnects or the timeout passes, and reports whether cancellation occurred.
+7. Reports the source address of each hop (client->proxy, proxy->backend) as sent and as observed
+   by the echo servers, so SNAT behavior at each hop is visible in one document.
+8. Pre-establishes and holds TCP/TLS connections to backends with the /warm endpoint, reporting
+   the handshake latency per backend. Requests with "UseWarm" consume them, so the measured
+   request latency excludes the connection setup.
+9. Expands the variables of EchoData for every attempt of a forward when EchoDataTemplate is set,
+   e.g. {{counter}}, {{timestamp}}, {{unixnano}}, {{rand 16}}, {{uuid}} and {{hostname}}, so generated
+   payloads vary without the client building each body. The sent data is reported as SentEchoData.
+10. Validates responses of our echo servers against their schema and surfaces their main fields
+    (ServerHostName, ServerIP, RequestCounter) and whether the data was echoed intact as the
+    structured Backend field, so multi-hop results are machine-checkable.
+11. Checks reachability only with the connect forward type: it establishes the TCP, TLS or UDP
+    "connection" and reports the handshake timing without sending EchoData, for backends that
+    treat unexpected payloads as protocol errors.
+12. Runs a bundle of heterogeneous probes (http, udp, dns, dot, doh and connect for TCP/TLS)
+    posted to /bundle concurrently under one global deadline, and returns the response of each
+    probe in a combined report, saving round trips for the connectivity-matrix runner.
+13. Controls the source port of UDP forwarding with UDPSourcePort: keep the same ephemeral port
+    across retries (reuse), take a new one for each retry (new), reuse the port of the previous
+    request to the same backend (sticky) or bind a fixed port. The ports used by each attempt are
+    reported as UDPSource, to reproduce conntrack tuple-reuse problems after backend pod restarts.
+    The ports of up to 10000 backends are remembered for sticky, the least recently used first forgotten.
+14. Reports its own identity (hostname, pod, node and IPs), hostNetwork and the environment
+    variables with the -env-prefix prefix like the echo servers, so proxy hops are as identifiable
+    as the backends in aggregated reports.
+15. Runs scenario scripts posted to /scenario server-side: a sequence of forwards and waits, with
+    loops (Repeat, Until, Interval), blocks of nested steps and conditions (If) on the previous
+    results, reporting the result of each step, so complex flows need no client-side orchestration.
+    Conditions and templated BackendUrls are text/template expressions over .Prev (the previous
+    forward), .Steps (the last result of each named step) and .Iteration. Long scenarios can run
+    asynchronously ("Async":true) and be polled with GET /scenario?id=<ID>.
+16. Dumps a diagnostic bundle on SIGQUIT or with /debug/dump: goroutine stacks, flags, counters,
+    resource usage and socket states, and the last requests, to capture the state of the proxy
+    during hangs that are hard to reproduce. The value of -auth-token is redacted.
+17. Transforms the payloads like a middlebox would, as declared per request: RequestTransforms
+    change EchoData before it is sent and ResponseTransforms change the backend response before it
+    is returned, with base64, gzip (and their inverses) and the injection of the hop metadata into a
+    JSON array field. The size and SHA-256 of each payload are reported as Transforms, to verify
+    that end-to-end integrity checks detect the mutation. Up to 8 transforms are applied in each
+    direction, and the payload may not grow over -max-echo-data (EchoData) or 16 MiB after any of them.
+18. Overrides DNS per request with hosts-style Hosts entries: the http, udp and connect forward types
+    connect to the given IP instead of resolving the backend name, while the Host header and the SNI
+    keep the name, to test "what if DNS returned X" without editing /etc/hosts in the proxy pod. The
+    entries used are reported as HostsUsed.
+19. Keeps rolling latency histograms and success ratios per backend, served on /admin/backends with
+    the p50/p95/p99 latencies, the failures by ErrorCode and an optional SLO summary, so long fan-out
+    runs can be monitored live without scraping individual responses. Each failed response carries
+    the ErrorCode classifying its error.
+20. Reports the cluster, region and zone of the proxy in Identity.Topology of all responses, from
+    the -cluster, -region and -zone flags (or their TOPOLOGY_* environment variables) or detected
+    from the labels of the node, so results of multi-cluster and multi-zone runs aggregate without
+    mapping tables.
+21. Reports the phases of the request to the backend for http forwarding as Timings (DNS, connect,
+    TLS, time to first byte, body read), in the schema the client reports for its own requests, so
+    the breakdowns observed by the client and by each proxy can be compared hop by hop.
+22. Optionally pushes its responses to the results server, which keeps them with the reports of the
+    clients for the dashboards of latency trends and failures.
+23. Optionally protects its API with bearer tokens and/or client certificates (mTLS), since an open
+    forwarding proxy inside the cluster is an SSRF risk. Every request is logged with its caller in
+    an audit line, and the caller is reported as Caller in the responses.
+24. Optionally reports the cgroup CPU and memory limits of its container and their usage as
+    Resources, and the architecture and CPUs of the node in Identity, so a slow hop can be
+    attributed to the throttling of the proxy rather than the network.
+25. Stops forwarding loops of chained proxies: each proxy sets the X-Proxy-Hops header of http
+    forwarding to the number of proxies the request went through, and rejects the requests that
+    already went through -max-hops proxies with the LOOP_DETECTED ErrorCode. The position of the
+    proxy in the chain is reported as Hops.
+26. Guards against turning the proxy into a traffic amplifier: the EchoData of a forward, the EchoData
+    of all the forwards of a bundle or scenario multiplied by their fan-out, and the bytes actually
+    sent by a bundle or scenario run are capped by -max-echo-data, -max-fanout-bytes and
+    -max-bundle-bytes. Requests over a ceiling are rejected with the AMPLIFICATION_LIMIT ErrorCode
+    and the exceeded ceiling as AmplificationLimit.
+27. Applies the same middleware chain of common/common.go as the HTTP server to the proxy API and the
+    admin endpoints: panic recovery, request IDs, an optional access log (-access-log) and rate limit
+    (-rate-limit), the diagnostics and the authentication. The ID of a request is reported as
+    RequestID and forwarded to http backends in X-Request-Id, so it can be looked up in their journal.
 
 Usage:
 go run proxy_server.go -port=<port> -timeout=<seconds>
@@ -13,44 +96,368 @@ Options:
 -h: Display help information
 -port: Specify the TCP port for the server to listen on (default is 8090)
 -timeout: Specify the default timeout for backend requests in seconds (default is 4)
+-env-prefix: Report the environment variables with this prefix as EnvList (default is ENV_)
+-report-resources: Include the cgroup CPU and memory limits and usage of the container as Resources (default is false)
+-dump-dir: The directory of the diagnostic bundles written on SIGQUIT or with /debug/dump?file=true (default is the temporary directory)
+-backend-window: The rolling window of the backend stats of /admin/backends (default is 5m)
+-slo-latency: The latency objective of the backends, e.g. 200ms (default is none)
+-slo-success: The objective of the fraction of requests succeeding within -slo-latency, e.g. 0.99 (default is none)
+-cluster, -region, -zone: The topology labels reported in Identity.Topology of the responses (default is
+    $TOPOLOGY_CLUSTER, $TOPOLOGY_REGION and $TOPOLOGY_ZONE)
+-topology-from-node: Detect the labels not set above from the topology.kubernetes.io/region, zone and
+    cluster labels of the node $NODE_NAME, with the API (default is false)
+-topology-kube-api: The API server URL for -topology-from-node, e.g. http://127.0.0.1:8001 of kubectl
+    proxy (default is the in-cluster service account)
+-results-url: Push every response to the results server (results_server.go) at this URL, e.g.
+    http://results:8095, batched each second (optional)
+-auth-token: Require this bearer token in the Authorization header, the caller is named "default" (default
+    is $PROXY_AUTH_TOKEN, read when the flag is not set so the token is not shown by -h)
+-auth-tokens-file: Require one of the bearer tokens of this file, with a "<name> <token>" line per caller (optional)
+-tls-cert, -tls-key: Serve the API over HTTPS with this PEM certificate and key (default is plain HTTP, or a
+    self-signed certificate with -client-ca)
+-client-ca: Require a client certificate signed by one of the CAs of this PEM file (optional)
+-max-hops: The maximum number of chained proxies a request goes through, including this one, 0 for no limit (default is 8)
+-max-echo-data: The maximum size of the EchoData of a forward in bytes, once expanded, 0 for no limit (default is 1048576)
+-max-fanout-bytes: The maximum EchoData of all the forwards of a bundle or scenario in bytes, counting each probe,
+    loop iteration and UDP retry, 0 for no limit (default is 16777216)
+-max-bundle-bytes: The maximum EchoData actually sent by a bundle or scenario run in bytes, 0 for no limit
+    (default is 16777216)
+-max-warm: The maximum number of warm connections held across all backends, 0 for no limit (default is 1000).
+    A /warm request asks for at most 100 connections to each of at most 32 backends.
+-access-log: Log a line per request with its status, body size, duration and ID (default is false)
+-rate-limit: Reject the requests over this rate per second with 429, bursts of up to one second pass (default is 0, no limit)
 
 Notes:
 - The server listens on the specified port.
+- -topology-from-node reads the node once at startup, which needs the RBAC permission to get nodes
+  (a ClusterRole with "get" on "nodes"). Flags take precedence over the node labels; a failed
+  detection is logged and the flags alone are reported.
+- Like the echo servers, the pod name, namespace and node name of Identity come from the POD_NAME,
+  POD_NAMESPACE and NODE_NAME environment variables, set with the downward API.
+- Hosts entries also apply to the redirects followed by http forwarding. Names are matched without
+  case and without a trailing dot, and HTTPS certificates are still verified against the name.
+- ErrorCode is one of INVALID_REQUEST (the request was rejected before forwarding), TIMEOUT,
+  CLIENT_DISCONNECTED, CONNECTION_REFUSED, CONNECTION_RESET, UNREACHABLE, DNS_ERROR (the backend
+  name did not resolve), DNS_QUERY_FAILED (a dns, dot or doh probe failed), TLS_ERROR and
+  BACKEND_ERROR for the others, or UNAUTHENTICATED when the credentials are missing or invalid. It is derived from the error message, like a human would read it.
+  LOOP_DETECTED (answered with 508 Loop Detected) means the request went through too many proxies, and
+  AMPLIFICATION_LIMIT (answered with 413) that it exceeded a payload ceiling.
+- -max-fanout-bytes is checked before a bundle or scenario starts, from the EchoData as posted: loops
+  count all their Repeat iterations, as if Until never stopped them, udp forwards all their
+  UDPRetries and EchoData templates their largest expansion. -max-echo-data is checked against the
+  largest expansion of a template before it is expanded, and with -max-bundle-bytes against the
+  EchoData of each forward as it is sent. A scenario stops at its first forward over a ceiling. The dns, dot, doh
+  and connect forward types send no EchoData.
+- Hops counts the proxies of http forwarding only: the requests of the udp, dns, dot, doh and
+  connect forward types do not reach another proxy API. Each proxy of a chain must allow the
+  length of the chain with -max-hops, the probes of bundles and scenarios inherit the hops of
+  their request.
+- /admin/backends counts the forwarded requests only, including the probes of bundles and scenarios,
+  from the start of the forwarding to the response. The backend of http requests is the BackendUrl
+  without its path. The rolling stats cover the last -backend-window of at most 4096 requests per
+  backend, the Requests and Failures totals everything since the start or the last reset.
+- With -auth-token, -auth-tokens-file or -client-ca, every endpoint but /healthy requires all the
+  configured credentials and answers 401 otherwise. Each request is logged as "Audit: <method> <path>
+  from <address> by <caller>", or as rejected with the reason. Callers are named by their token name
+  and by the subject and URI SANs (e.g. SPIFFE IDs) of their certificate, tokens are never logged.
+  The probes of bundles and scenarios run with the caller of the request that started them. The
+  latency subcommand of the client sends the token of $PROXY_AUTH_TOKEN.
+- Resources describes the cgroup of the proxy, not of the backend: a backend echo server started
+  with -report-resources reports its own in the backend response (Backend does not surface it).
+- BackendUrl must bracket IPv6 literals, with their zone if any: http://[fd00::1]:8080 or
+  http://[fe80::1%25eth0]:8080 (the '%' is escaped in URLs), and [fe80::1%eth0]:53 for host:port
+  backends. URLs without a port use 80 for http and 443 for https; host:port backends (udp, dns, dot,
+  tcp://, tls:// and udp:// connect probes) require the port. A rejected BackendUrl is answered with
+  ValidationErrors, listing each component (scheme, host, zone, port or url) that failed and why.
 
 Testing with curl:
 - To test the proxy server over IPv4, use:
   curl -X POST http://127.0.0.1:8090 -d '{"BackendUrl":"http://127.0.0.1:8080","Timeout":5,"ForwardType":"http"}'  | jq .
 
 - To test the proxy server over IPv6, use:
-  curl -X POST http://\[::1\]:8090 -d '{"BackendUrl":"http://[::1]:8080","Timeout":5,"ForwardType":"udp"}'  | jq .
+  curl -X POST http://\[::1\]:8090 -d '{"BackendUrl":"http://[::1]:8080","Timeout":5,"ForwardType":"http"}'  | jq .
+  curl -X POST http://\[::1\]:8090 -d '{"BackendUrl":"[::1]:8080","Timeout":5,"ForwardType":"udp"}'  | jq .
+
+- To see which component of a BackendUrl is invalid, e.g. an unbracketed IPv6 literal, use:
+  curl -X POST http://127.0.0.1:8090 -d '{"BackendUrl":"http://fd00::1:8080","ForwardType":"http"}'  | jq .ValidationErrors
+
+- To resolve a name through a DNS-over-TLS resolver with a custom SNI, use:
+  curl -X POST http://127.0.0.1:8090 -d '{"BackendUrl":"1.1.1.1:853","ForwardType":"dot","DNSName":"example.com","DNSType":"AAAA","SNI":"one.one.one.one"}'  | jq .
+
+- To resolve a name through a DNS-over-HTTPS resolver, use:
+  curl -X POST http://127.0.0.1:8090 -d '{"BackendUrl":"https://1.1.1.1/dns-query","ForwardType":"doh","DNSName":"example.com"}'  | jq .
+
+- To hold 10 warm connections to a backend and then use one of them, use:
+  curl -X POST http://127.0.0.1:8090/warm -d '{"Backends":["http://127.0.0.1:8080"],"Connections":10}'  | jq .
+  curl -X POST http://127.0.0.1:8090 -d '{"BackendUrl":"http://127.0.0.1:8080","ForwardType":"http","UseWarm":true}'  | jq .
+  curl http://127.0.0.1:8090/warm | jq .            # held connections per backend
+  curl -X DELETE http://127.0.0.1:8090/warm | jq .  # close all held connections
+
+- To watch the latency percentiles and the failures of each backend during a run, against an SLO
+  of 99% of the requests succeeding within 200ms, use:
+  curl -s 'http://127.0.0.1:8090/admin/backends?slo-latency=200ms&slo-success=0.99' | jq -c '.Backends[] | {Backend, P50Ms, P99Ms, SuccessRatio, Errors, Met: .SLO.Met}'
+  curl -s 'http://127.0.0.1:8090/admin/backends?reset=true' > /dev/null  # start a new run
+
+- To check that a TLS backend accepts connections without sending any payload, use:
+  curl -X POST http://127.0.0.1:8090 -d '{"BackendUrl":"tls://127.0.0.1:8443","ForwardType":"connect"}'  | jq .Connect
+
+- To run several probes in one request with a global deadline of 5 seconds, use:
+  curl -X POST http://127.0.0.1:8090/bundle -d '{"Name":"node-a","Timeout":5,"Probes":[
+    {"Name":"http","BackendUrl":"http://127.0.0.1:8080","ForwardType":"http"},
+    {"Name":"udp","BackendUrl":"127.0.0.1:8080","ForwardType":"udp"},
+    {"Name":"dns","BackendUrl":"10.96.0.10:53","ForwardType":"dns","DNSName":"kubernetes.default.svc.cluster.local"},
+    {"Name":"tls","BackendUrl":"tls://127.0.0.1:8443","ForwardType":"connect"}]}'  | jq '.Results[] | {Name, Success: .Response.Success}'
+
+- To send a unique payload with each request, use:
+  curl -X POST http://127.0.0.1:8090 -d '{"BackendUrl":"127.0.0.1:8080","ForwardType":"udp","EchoData":"req-{{counter}} at {{timestamp}} {{rand 16}}","EchoDataTemplate":true}'  | jq .SentEchoData
+
+- To retry a UDP request 3 times with a new source port for each retry, or to keep the port of
+  the previous request to the same backend, use:
+  curl -X POST http://127.0.0.1:8090 -d '{"BackendUrl":"127.0.0.1:8080","ForwardType":"udp","UDPRetries":3,"UDPSourcePort":"new"}'  | jq .UDPSource
+  curl -X POST http://127.0.0.1:8090 -d '{"BackendUrl":"127.0.0.1:8080","ForwardType":"udp","UDPSourcePort":"sticky"}'  | jq .UDPSource
+
+- To retry a backend until it answers, then compare the pod reached by two requests only if the
+  first one succeeded, stopping at the first failure of the check, use:
+  curl -X POST http://127.0.0.1:8090/scenario -d '{"Name":"failover","Timeout":30,"Steps":[
+    {"Name":"ready","Forward":{"BackendUrl":"http://127.0.0.1:8080","ForwardType":"http","Timeout":1},
+     "Repeat":10,"Interval":"1s","Until":"{{.Prev.Success}}","OnFailure":"stop"},
+    {"Wait":"2s"},
+    {"Name":"again","If":"{{.Prev.Success}}","Forward":{"BackendUrl":"http://127.0.0.1:8080","ForwardType":"http"}},
+    {"Name":"loop","Repeat":3,"Steps":[{"Name":"udp","Forward":{"BackendUrl":"127.0.0.1:8080","ForwardType":"udp"}}]}]}' \
+    | jq '{Success, Steps: [.Steps[] | {Name, Iteration, Action, Success}]}'
+
+- To get the diagnostic bundle of a hanging proxy, or write it to a file in -dump-dir, use:
+  curl http://127.0.0.1:8090/debug/dump | jq '{Counters, RecentRequests}'
+  kill -QUIT <pid>
+
+- To add the metadata of the proxy to a JSON payload, then gzip the backend response (returned
+  base64 encoded), use:
+  curl -X POST http://127.0.0.1:8090 -d '{"BackendUrl":"http://127.0.0.1:8080","ForwardType":"http","EchoData":"{\"id\":1}",
+    "RequestTransforms":["inject-hop"],"ResponseTransforms":["gzip"]}'  | jq '{SentEchoData, Transforms}'
+
+- To reach echo.example.com at 10.244.1.7 whatever DNS says, keeping the name in the Host header and SNI, use:
+  curl -X POST http://127.0.0.1:8090 -d '{"BackendUrl":"https://echo.example.com:8443","ForwardType":"http",
+    "Hosts":{"echo.example.com":"10.244.1.7"}}'  | jq '{BackendIP, HostsUsed}'
+
+- To require a bearer token and client certificates, then forward as the caller "ci", use:
+  go run proxy_server.go -auth-tokens-file=tokens.txt -client-ca=ca.pem -tls-cert=proxy.pem -tls-key=proxy-key.pem
+  curl --cacert ca.pem --cert ci.pem --key ci-key.pem -H "Authorization: Bearer $TOKEN" \
+    -X POST https://proxy:8090 -d '{"BackendUrl":"http://127.0.0.1:8080","ForwardType":"http"}'  | jq .Caller
+
+- To chain two proxies, the second one forwarding the EchoData of the first one as its request, use:
+  curl -X POST http://127.0.0.1:8090 -d '{"BackendUrl":"http://127.0.0.1:8091","ForwardType":"http",
+    "EchoData":"{\"BackendUrl\":\"http://127.0.0.1:8080\",\"ForwardType\":\"http\"}"}'  | jq '{Hops, Next: (.BackendResponse | fromjson | .Hops)}'
+
+- To see which payload ceiling a bundle of large payloads exceeds, use:
+  curl -X POST http://127.0.0.1:8090/bundle -d '{"Probes":[{"BackendUrl":"127.0.0.1:8080","ForwardType":"udp",
+    "EchoData":"{{rand 60000}}","EchoDataTemplate":true,"UDPRetries":10}]}'  | jq '{ErrorMessage, AmplificationLimit}'
+
+- To forward with a TTL of 5 and DSCP EF (46), use:
+  curl -X POST http://127.0.0.1:8090 -d '{"BackendUrl":"127.0.0.1:8080","ForwardType":"udp","TTL":5,"DSCP":46}'  | jq .
 */
 
 package main
 
 import (
 	"bytes"
+	"compress/gzip"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"main/common"
+	"math"
 	"net"
 	"net/http"
+	"net/http/httptrace"
 	"net/url"
 	"os"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"text/template"
 	"time"
+	"unicode/utf8"
 )
 
 var requestCount int
 var mutex sync.Mutex
+var warmPool = common.NewWarmPool()
+
+// maxWarmBackends and maxWarmConnections bound the backends and the connections per backend of a /warm request
+const (
+	maxWarmBackends    = 32
+	maxWarmConnections = 100
+)
+
+var identity *common.IdentityProvider
+var hostNetwork bool
+var envPrefix string
+var diagnostics *common.Diagnostics
+var reportResources bool
+
+// maxStickyUDPPorts bounds the UDP backends whose last source port is remembered for "sticky"
+const maxStickyUDPPorts = 10000
+
+// stickyUDPPorts holds the last source port used towards each UDP backend, guarded by mutex
+var stickyUDPPorts = newStickyPorts(maxStickyUDPPorts)
+
+// stickyPorts remembers the last source port used towards each backend, and forgets the least
+// recently used backends beyond its limit, so probing many backends does not grow it forever
+type stickyPorts struct {
+	limit int
+	ports map[string]*list.Element // The elements of order by backend
+	order *list.List               // The stickyPort of each backend, the most recently used first
+}
+
+// stickyPort is the last source port used towards a backend
+type stickyPort struct {
+	backend string
+	port    int
+}
+
+// newStickyPorts returns a stickyPorts remembering up to limit backends
+func newStickyPorts(limit int) *stickyPorts {
+	return &stickyPorts{limit: limit, ports: make(map[string]*list.Element), order: list.New()}
+}
+
+// get returns the last source port used towards backend, 0 if none is remembered
+func (s *stickyPorts) get(backend string) int {
+	if element, ok := s.ports[backend]; ok {
+		return element.Value.(*stickyPort).port
+	}
+	return 0
+}
+
+// set records the source port used towards backend
+func (s *stickyPorts) set(backend string, port int) {
+	if element, ok := s.ports[backend]; ok {
+		element.Value.(*stickyPort).port = port
+		s.order.MoveToFront(element)
+		return
+	}
+	s.ports[backend] = s.order.PushFront(&stickyPort{backend: backend, port: port})
+	if s.order.Len() > s.limit {
+		oldest := s.order.Remove(s.order.Back()).(*stickyPort)
+		delete(s.ports, oldest.backend)
+	}
+}
+
+// len returns the number of backends remembered
+func (s *stickyPorts) len() int {
+	return len(s.ports)
+}
+
+// maxUDPRetries limits the number of retries of a UDP request
+const maxUDPRetries = 10
+
+// maxBundleProbes limits the number of probes of a single /bundle request
+const maxBundleProbes = 256
+
+// echoPayloadKey is the request context key of the echoPayload of a forward
+type echoPayloadKey struct{}
+
+// forwardFunc validates and forwards a proxy request, and returns the response to send
+type forwardFunc func(r *http.Request, clientReq common.ProxyClientRequest, invalidBody string) (common.ProxyResponse, int)
+
+// echoPayload builds the EchoData sent by each attempt of a forward: the EchoData template, if any,
+// is expanded with new random values and timestamps, then the RequestTransforms are applied
+type echoPayload struct {
+	data     string                  // EchoData as posted
+	template *common.PayloadTemplate // The parsed EchoData, nil unless EchoDataTemplate is set
+	counter  int                     // The request counter, for {{counter}}
+	state    *transformState         // The transformations of the forward, nil without transforms
+	sent     string                  // The EchoData of the last attempt, once expanded and transformed
+}
+
+// build returns the EchoData of an attempt. The transformations report the last attempt.
+func (p *echoPayload) build() (string, error) {
+	data := p.data
+	if p.template != nil {
+		expanded, err := p.template.Expand(p.counter)
+		if err != nil {
+			return "", err
+		}
+		data = expanded
+	}
+	if p.state == nil {
+		p.sent = data
+		return data, nil
+	}
+
+	p.state.result.OriginalBytes, p.state.result.OriginalSHA256 = len(data), sha256Hex([]byte(data))
+	sent, err := applyTransforms([]byte(data), p.state.result.RequestTransforms, p.state.hop("request"), requestTransformBytes())
+	if err != nil {
+		return "", fmt.Errorf("unable to apply RequestTransforms: %v", err)
+	}
+	p.state.result.SentBytes, p.state.result.SentSHA256 = len(sent), sha256Hex(sent)
+	p.sent = string(sent)
+	return p.sent, nil
+}
+
+// proxyHopsHeader is the header carrying the number of proxies a request of http forwarding
+// went through, so the next proxy of a chain can stop a forwarding loop
+const proxyHopsHeader = "X-Proxy-Hops"
+
+// maxHops limits the number of chained proxies a request goes through, 0 for no limit
+var maxHops int
+
+// The payload ceilings of -max-echo-data, -max-fanout-bytes and -max-bundle-bytes, 0 for no limit
+var maxEchoData, maxFanoutBytes, maxBundleBytes int64
+
+// byteBudgetKey is the request context key of the bytes sent by the forwards of a bundle or scenario run
+type byteBudgetKey struct{}
+
+// forwardStartKey is the request context key of the time the forwarding to the backend started
+type forwardStartKey struct{}
+
+// backendTracker keeps the latency and success stats of each backend for /admin/backends
+var backendTracker *common.BackendTracker
+
+// defaultSLO is the SLO of the backends of -slo-latency and -slo-success
+var defaultSLO common.BackendSLO
+
+// resultsPusher pushes the responses to the results server of -results-url, nil without
+var resultsPusher *common.ResultsPusher
 
 func main() {
 	// Define command-line flags
 	help := flag.Bool("h", false, "Display help information")
 	port := flag.String("port", "8090", "Specify the TCP port for the server to listen on")
 	defaultTimeout := flag.Int("timeout", 4, "Specify the default timeout for backend requests in seconds")
+	flag.StringVar(&envPrefix, "env-prefix", "ENV_", "Report the environment variables with this prefix as EnvList")
+	flag.BoolVar(&reportResources, "report-resources", false, "Include the cgroup CPU and memory limits and usage of the proxy container in responses")
+	dumpDir := flag.String("dump-dir", "", "The directory of the diagnostic bundles (default is the temporary directory)")
+	backendWindow := flag.Duration("backend-window", 5*time.Minute, "The rolling window of the backend stats of /admin/backends")
+	sloLatency := flag.Duration("slo-latency", 0, "The latency objective of the backends, e.g. 200ms (default is none)")
+	sloSuccess := flag.Float64("slo-success", 0, "The objective of the fraction of requests succeeding within -slo-latency, e.g. 0.99 (default is none)")
+	resultsURL := flag.String("results-url", "", "Push the responses to the results server at this URL, e.g. http://results:8095 (optional)")
+	authToken := flag.String("auth-token", "", "Require this bearer token on the proxy API (default is $PROXY_AUTH_TOKEN)")
+	authTokensFile := flag.String("auth-tokens-file", "", "Require one of the bearer tokens of this file of \"<name> <token>\" lines on the proxy API")
+	tlsCert := flag.String("tls-cert", "", "Serve the proxy API over HTTPS with this PEM certificate")
+	tlsKey := flag.String("tls-key", "", "The PEM key of -tls-cert")
+	clientCA := flag.String("client-ca", "", "Require a client certificate signed by the CAs of this PEM file (mTLS), implies HTTPS")
+	flag.IntVar(&maxHops, "max-hops", 8, "The maximum number of chained proxies a request goes through, including this one, 0 for no limit")
+	flag.Int64Var(&maxEchoData, "max-echo-data", 1<<20, "The maximum size of the EchoData of a forward in bytes, 0 for no limit")
+	flag.Int64Var(&maxFanoutBytes, "max-fanout-bytes", 16<<20, "The maximum EchoData of all the forwards of a bundle or scenario in bytes, 0 for no limit")
+	flag.Int64Var(&maxBundleBytes, "max-bundle-bytes", 16<<20, "The maximum EchoData actually sent by a bundle or scenario run in bytes, 0 for no limit")
+	flag.IntVar(&warmPool.Limit, "max-warm", 1000, "The maximum number of warm connections held across all backends, 0 for no limit")
+	accessLogEnabled := flag.Bool("access-log", false, "Log a line per request with its status, size, duration and ID")
+	rateLimit := flag.Float64("rate-limit", 0, "Reject the requests over this rate per second with 429, bursts of up to one second pass (0 for no limit)")
+	topologyFlags := common.RegisterTopologyFlags()
 	flag.Parse()
 
 	// If the -h flag is set, display help information and exit
@@ -59,30 +466,84 @@ func main() {
 		return
 	}
 
+	if *backendWindow <= 0 || *sloLatency < 0 || *sloSuccess < 0 || *sloSuccess > 1 {
+		log.Fatalf("Invalid backend stats options: -backend-window must be positive, -slo-latency not negative and -slo-success between 0 and 1")
+	}
+	// The environment is read here rather than as the flag default, which -h would print
+	token := *authToken
+	if token == "" {
+		token = os.Getenv("PROXY_AUTH_TOKEN")
+	}
+	auth, err := newProxyAuth(token, *authTokensFile, *clientCA != "")
+	if err != nil {
+		log.Fatalf("Unable to load the bearer tokens: %v", err)
+	}
+	backendTracker = common.NewBackendTracker(*backendWindow)
+	defaultSLO = common.BackendSLO{LatencyMs: float64(*sloLatency) / float64(time.Millisecond), SuccessTarget: *sloSuccess}
+
+	identity = common.NewIdentityProvider()
+	identity.SetTopology(topologyFlags.Resolve())
+
+	if *resultsURL != "" {
+		source := os.Getenv("POD_NAME")
+		if source == "" {
+			source = identity.Get().HostName
+		}
+		resultsPusher = common.NewResultsPusher(strings.TrimSuffix(*resultsURL, "/"), "proxy", source, time.Second)
+	}
+
+	detected, method, err := common.DetectHostNetwork()
+	if err != nil {
+		log.Printf("Unable to detect hostNetwork, reporting false: %v", err)
+	} else {
+		log.Printf("HostNetwork: %t (%s)", detected, method)
+	}
+	hostNetwork = detected
+
+	diagnostics = common.NewDiagnostics("proxy", common.RecentRequestsKept, *dumpDir, func() map[string]interface{} {
+		mutex.Lock()
+		counters := map[string]interface{}{"Requests": requestCount, "StickyUDPPorts": stickyUDPPorts.len()}
+		mutex.Unlock()
+		scenarioMutex.Lock()
+		counters["ScenarioRuns"] = len(scenarioRuns)
+		scenarioMutex.Unlock()
+		counters["WarmConnections"] = warmPool.Stats()
+		return counters
+	}, identity, nil)
+	diagnostics.RedactFlags("auth-token")
+	diagnostics.DumpOnQuit()
+
 	// 添加 /healthy 路由
 	http.HandleFunc("/healthy", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte("OK"))
 	})
 
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+	http.HandleFunc("/warm", handleWarm)
+	http.Handle("/debug/dump", diagnostics)
+
+	// forward validates a proxy request and forwards it, for the proxy API as well as the probes of
+	// bundles and scenarios. invalidBody is the error of a request body that could not be decoded.
+	forward := func(r *http.Request, clientReq common.ProxyClientRequest, invalidBody string) (response common.ProxyResponse, statusCode int) {
 		mutex.Lock()
 		requestCount++
 		currentRequestCount := requestCount
 		mutex.Unlock()
 
+		// Completed with the request as last updated, e.g. once the forward started
+		defer func() {
+			response, statusCode = completeProxyResponse(r, response, statusCode)
+		}()
+
 		serverIP, _, err := common.GetServerIPAndPort()
 		if err != nil {
-			http.Error(w, "Unable to determine server IP", http.StatusInternalServerError)
-			return
+			return common.ProxyResponse{Success: false, ErrorMessage: "Unable to determine server IP"}, http.StatusInternalServerError
 		}
 
-		var clientReq common.ProxyClientRequest
-		body, err := ioutil.ReadAll(r.Body)
-		if err != nil {
-			sendProxyResponse(w, r, common.ProxyResponse{
+		if invalidBody != "" {
+			return common.ProxyResponse{
 				Success:         false,
-				ErrorMessage:    "Unable to read request body. Ensure it is valid JSON.",
+				ErrorMessage:    invalidBody,
 				BackendResponse: "",
 				BackendUrl:      clientReq.BackendUrl,
 				FrontUrl:        constructFullURL(r),
@@ -90,14 +551,16 @@ func main() {
 				FrontPort:       *port,
 				RequestCounter:  currentRequestCount,
 				ForwardType:     clientReq.ForwardType,
-			}, http.StatusBadRequest)
-			return
+			}, http.StatusBadRequest
 		}
 
-		if err := json.Unmarshal(body, &clientReq); err != nil {
-			sendProxyResponse(w, r, common.ProxyResponse{
+		// Reject the requests of a forwarding loop before they reach another proxy
+		if hops := requestHops(r); maxHops > 0 && hops >= maxHops {
+			log.Printf("Loop detected: the request from %s to %s already went through %d proxies (-max-hops=%d)", r.RemoteAddr, clientReq.BackendUrl, hops, maxHops)
+			return common.ProxyResponse{
 				Success:         false,
-				ErrorMessage:    "Invalid request format. Ensure it is a valid JSON with required fields.",
+				ErrorMessage:    fmt.Sprintf("Loop detected: the request already went through %d proxies, the limit is %d. Check that the chained proxies do not forward to each other.", hops, maxHops),
+				ErrorCode:       "LOOP_DETECTED",
 				BackendResponse: "",
 				BackendUrl:      clientReq.BackendUrl,
 				FrontUrl:        constructFullURL(r),
@@ -105,12 +568,11 @@ func main() {
 				FrontPort:       *port,
 				RequestCounter:  currentRequestCount,
 				ForwardType:     clientReq.ForwardType,
-			}, http.StatusBadRequest)
-			return
+			}, http.StatusLoopDetected
 		}
 
 		if clientReq.BackendUrl == "" {
-			sendProxyResponse(w, r, common.ProxyResponse{
+			return common.ProxyResponse{
 				Success:         false,
 				ErrorMessage:    "BackendUrl is required. Please provide a valid URL for the backend server.",
 				BackendResponse: "",
@@ -120,31 +582,186 @@ func main() {
 				FrontPort:       *port,
 				RequestCounter:  currentRequestCount,
 				ForwardType:     clientReq.ForwardType,
-			}, http.StatusBadRequest)
-			return
+			}, http.StatusBadRequest
 		}
 
 		// Validate BackendUrl based on ForwardType
 		if clientReq.ForwardType == "http" {
-			if !isValidHTTPURL(clientReq.BackendUrl) {
-				sendProxyResponse(w, r, common.ProxyResponse{
-					Success:         false,
-					ErrorMessage:    "Invalid HTTP URL format for BackendUrl. Use a valid HTTP URL, e.g., 'http://example.com'.",
-					BackendResponse: "",
-					BackendUrl:      clientReq.BackendUrl,
-					FrontUrl:        constructFullURL(r),
-					FrontIP:         serverIP,
-					FrontPort:       *port,
-					RequestCounter:  currentRequestCount,
-					ForwardType:     clientReq.ForwardType,
-				}, http.StatusBadRequest)
-				return
+			if _, err := parseHTTPBackend(clientReq.BackendUrl); err != nil {
+				return common.ProxyResponse{
+					Success:          false,
+					ErrorMessage:     fmt.Sprintf("Invalid HTTP URL format for BackendUrl. Use a valid HTTP URL, e.g., 'http://example.com' or 'http://[fd00::1]:8080': %v", err),
+					ValidationErrors: backendURLProblems(err),
+					BackendResponse:  "",
+					BackendUrl:       clientReq.BackendUrl,
+					FrontUrl:         constructFullURL(r),
+					FrontIP:          serverIP,
+					FrontPort:        *port,
+					RequestCounter:   currentRequestCount,
+					ForwardType:      clientReq.ForwardType,
+				}, http.StatusBadRequest
 			}
 		} else if clientReq.ForwardType == "udp" {
-			if !isValidUDPAddress(clientReq.BackendUrl) {
-				sendProxyResponse(w, r, common.ProxyResponse{
+			if _, err := parseUDPBackend(clientReq.BackendUrl); err != nil {
+				return common.ProxyResponse{
+					Success:          false,
+					ErrorMessage:     fmt.Sprintf("Invalid UDP address format for BackendUrl. Use a valid UDP address, e.g., 'localhost:8080' or '[fd00::1]:8080': %v", err),
+					ValidationErrors: backendURLProblems(err),
+					BackendResponse:  "",
+					BackendUrl:       clientReq.BackendUrl,
+					FrontUrl:         constructFullURL(r),
+					FrontIP:          serverIP,
+					FrontPort:        *port,
+					RequestCounter:   currentRequestCount,
+					ForwardType:      clientReq.ForwardType,
+				}, http.StatusBadRequest
+			}
+		} else if clientReq.ForwardType == "dns" || clientReq.ForwardType == "dot" || clientReq.ForwardType == "doh" {
+			_, err := parseUDPBackend(clientReq.BackendUrl)
+			if clientReq.ForwardType == "doh" {
+				_, err = common.ParseBackendURL(clientReq.BackendUrl, "https")
+			}
+			if err != nil || clientReq.DNSName == "" {
+				return common.ProxyResponse{
+					Success:          false,
+					ErrorMessage:     "Invalid DNS probe. DNSName is required, and BackendUrl must be a resolver address, e.g. '10.96.0.10:53' for dns, '1.1.1.1:853' for dot, or 'https://1.1.1.1/dns-query' for doh.",
+					ValidationErrors: backendURLProblems(err),
+					BackendResponse:  "",
+					BackendUrl:       clientReq.BackendUrl,
+					FrontUrl:         constructFullURL(r),
+					FrontIP:          serverIP,
+					FrontPort:        *port,
+					RequestCounter:   currentRequestCount,
+					ForwardType:      clientReq.ForwardType,
+				}, http.StatusBadRequest
+			}
+		} else if clientReq.ForwardType == "connect" {
+			if _, _, err := parseConnectBackend(clientReq.BackendUrl); err != nil {
+				return common.ProxyResponse{
+					Success:          false,
+					ErrorMessage:     fmt.Sprintf("Invalid connect probe: %v", err),
+					ValidationErrors: backendURLProblems(err),
+					BackendResponse:  "",
+					BackendUrl:       clientReq.BackendUrl,
+					FrontUrl:         constructFullURL(r),
+					FrontIP:          serverIP,
+					FrontPort:        *port,
+					RequestCounter:   currentRequestCount,
+					ForwardType:      clientReq.ForwardType,
+				}, http.StatusBadRequest
+			}
+		} else {
+			return common.ProxyResponse{
+				Success:         false,
+				ErrorMessage:    "Unsupported ForwardType. Supported values are 'http', 'udp', 'dns', 'dot', 'doh' and 'connect'.",
+				BackendResponse: "",
+				BackendUrl:      clientReq.BackendUrl,
+				FrontUrl:        constructFullURL(r),
+				FrontIP:         serverIP,
+				FrontPort:       *port,
+				RequestCounter:  currentRequestCount,
+				ForwardType:     clientReq.ForwardType,
+			}, http.StatusBadRequest
+		}
+
+		if clientReq.TTL < 0 || clientReq.TTL > 255 || clientReq.DSCP < 0 || clientReq.DSCP > 63 {
+			return common.ProxyResponse{
+				Success:         false,
+				ErrorMessage:    "Invalid TTL or DSCP. TTL must be between 1 and 255, or 0 for the system default, and DSCP between 0 and 63.",
+				BackendResponse: "",
+				BackendUrl:      clientReq.BackendUrl,
+				FrontUrl:        constructFullURL(r),
+				FrontIP:         serverIP,
+				FrontPort:       *port,
+				RequestCounter:  currentRequestCount,
+				ForwardType:     clientReq.ForwardType,
+			}, http.StatusBadRequest
+		}
+
+		// Warm connections were dialed by /warm without the TTL / DSCP of the request, which would be silently ignored
+		if clientReq.UseWarm && (clientReq.TTL != 0 || clientReq.DSCP != 0) {
+			return common.ProxyResponse{
+				Success:         false,
+				ErrorMessage:    "UseWarm cannot be combined with TTL or DSCP, the warm connections are established without them.",
+				BackendResponse: "",
+				BackendUrl:      clientReq.BackendUrl,
+				FrontUrl:        constructFullURL(r),
+				FrontIP:         serverIP,
+				FrontPort:       *port,
+				RequestCounter:  currentRequestCount,
+				ForwardType:     clientReq.ForwardType,
+			}, http.StatusBadRequest
+		}
+
+		if clientReq.FlowLabel < 0 || clientReq.FlowLabel > 0xfffff || (clientReq.FlowLabel > 0 && clientReq.ForwardType != "udp") {
+			return common.ProxyResponse{
+				Success:         false,
+				ErrorMessage:    "Invalid FlowLabel. It must be between 1 and 1048575 and is only supported for UDP forwarding.",
+				BackendResponse: "",
+				BackendUrl:      clientReq.BackendUrl,
+				FrontUrl:        constructFullURL(r),
+				FrontIP:         serverIP,
+				FrontPort:       *port,
+				RequestCounter:  currentRequestCount,
+				ForwardType:     clientReq.ForwardType,
+			}, http.StatusBadRequest
+		}
+
+		if _, err := parseUDPSourcePort(clientReq.UDPSourcePort); err != nil || clientReq.UDPRetries < 0 || clientReq.UDPRetries > maxUDPRetries ||
+			((clientReq.UDPSourcePort != "" || clientReq.UDPRetries > 0) && clientReq.ForwardType != "udp") {
+			return common.ProxyResponse{
+				Success:         false,
+				ErrorMessage:    "Invalid UDPSourcePort or UDPRetries. UDPSourcePort must be 'reuse', 'new', 'sticky' or a port number, UDPRetries between 0 and 10, and both are only supported for UDP forwarding.",
+				BackendResponse: "",
+				BackendUrl:      clientReq.BackendUrl,
+				FrontUrl:        constructFullURL(r),
+				FrontIP:         serverIP,
+				FrontPort:       *port,
+				RequestCounter:  currentRequestCount,
+				ForwardType:     clientReq.ForwardType,
+			}, http.StatusBadRequest
+		}
+
+		if err := validateHosts(clientReq); err != nil {
+			return common.ProxyResponse{
+				Success:         false,
+				ErrorMessage:    fmt.Sprintf("Invalid Hosts: %v", err),
+				BackendResponse: "",
+				BackendUrl:      clientReq.BackendUrl,
+				FrontUrl:        constructFullURL(r),
+				FrontIP:         serverIP,
+				FrontPort:       *port,
+				RequestCounter:  currentRequestCount,
+				ForwardType:     clientReq.ForwardType,
+			}, http.StatusBadRequest
+		}
+		if len(clientReq.Hosts) > 0 {
+			r = r.WithContext(context.WithValue(r.Context(), hostsOverrideKey{}, newHostsOverride(clientReq.Hosts)))
+		}
+
+		if err := validateTransforms(clientReq); err != nil {
+			return common.ProxyResponse{
+				Success:         false,
+				ErrorMessage:    fmt.Sprintf("Invalid transforms: %v", err),
+				BackendResponse: "",
+				BackendUrl:      clientReq.BackendUrl,
+				FrontUrl:        constructFullURL(r),
+				FrontIP:         serverIP,
+				FrontPort:       *port,
+				RequestCounter:  currentRequestCount,
+				ForwardType:     clientReq.ForwardType,
+			}, http.StatusBadRequest
+		}
+
+		// Parse the EchoData template when asked to, and bound its expansion before making it
+		payload := &echoPayload{data: clientReq.EchoData, counter: currentRequestCount}
+		r = r.WithContext(context.WithValue(r.Context(), echoPayloadKey{}, payload))
+		if clientReq.EchoDataTemplate {
+			tmpl, err := common.ParsePayloadTemplate(clientReq.EchoData)
+			if err != nil {
+				return common.ProxyResponse{
 					Success:         false,
-					ErrorMessage:    "Invalid UDP address format for BackendUrl. Use a valid UDP address, e.g., 'localhost:8080'.",
+					ErrorMessage:    fmt.Sprintf("Invalid EchoData: %v", err),
 					BackendResponse: "",
 					BackendUrl:      clientReq.BackendUrl,
 					FrontUrl:        constructFullURL(r),
@@ -152,13 +769,42 @@ func main() {
 					FrontPort:       *port,
 					RequestCounter:  currentRequestCount,
 					ForwardType:     clientReq.ForwardType,
-				}, http.StatusBadRequest)
-				return
+				}, http.StatusBadRequest
 			}
-		} else {
-			sendProxyResponse(w, r, common.ProxyResponse{
+			if size := tmpl.MaxSize(); maxEchoData > 0 && size > maxEchoData {
+				limit := &common.AmplificationLimit{Limit: "max-echo-data", MaxBytes: maxEchoData, Bytes: size}
+				return common.ProxyResponse{
+					Success:            false,
+					ErrorMessage:       amplificationMessage(limit),
+					ErrorCode:          "AMPLIFICATION_LIMIT",
+					AmplificationLimit: limit,
+					BackendResponse:    "",
+					BackendUrl:         clientReq.BackendUrl,
+					FrontUrl:           constructFullURL(r),
+					FrontIP:            serverIP,
+					FrontPort:          *port,
+					RequestCounter:     currentRequestCount,
+					ForwardType:        clientReq.ForwardType,
+				}, http.StatusRequestEntityTooLarge
+			}
+			// udp forwards expand the template again for each retry
+			payload.template = tmpl
+		}
+
+		// Transform the payload like a middlebox would, the response is transformed by completeProxyResponse
+		if len(clientReq.RequestTransforms) > 0 || len(clientReq.ResponseTransforms) > 0 {
+			payload.state = &transformState{
+				result:  &common.TransformResult{RequestTransforms: clientReq.RequestTransforms, ResponseTransforms: clientReq.ResponseTransforms},
+				counter: currentRequestCount,
+			}
+			r = r.WithContext(context.WithValue(r.Context(), transformStateKey{}, payload.state))
+		}
+
+		echoData, err := payload.build()
+		if err != nil {
+			return common.ProxyResponse{
 				Success:         false,
-				ErrorMessage:    "Unsupported ForwardType. Supported values are 'http' and 'udp'.",
+				ErrorMessage:    fmt.Sprintf("Invalid EchoData: %v", err),
 				BackendResponse: "",
 				BackendUrl:      clientReq.BackendUrl,
 				FrontUrl:        constructFullURL(r),
@@ -166,8 +812,25 @@ func main() {
 				FrontPort:       *port,
 				RequestCounter:  currentRequestCount,
 				ForwardType:     clientReq.ForwardType,
-			}, http.StatusBadRequest)
-			return
+			}, http.StatusBadRequest
+		}
+		// EchoData is expanded from now on, its size is the one of this attempt
+		clientReq.EchoData, clientReq.EchoDataTemplate = echoData, false
+
+		if limit := checkForwardBytes(r.Context(), clientReq); limit != nil {
+			return common.ProxyResponse{
+				Success:            false,
+				ErrorMessage:       amplificationMessage(limit),
+				ErrorCode:          "AMPLIFICATION_LIMIT",
+				AmplificationLimit: limit,
+				BackendResponse:    "",
+				BackendUrl:         clientReq.BackendUrl,
+				FrontUrl:           constructFullURL(r),
+				FrontIP:            serverIP,
+				FrontPort:          *port,
+				RequestCounter:     currentRequestCount,
+				ForwardType:        clientReq.ForwardType,
+			}, http.StatusRequestEntityTooLarge
 		}
 
 		timeout := time.Duration(clientReq.Timeout) * time.Second
@@ -175,44 +838,126 @@ func main() {
 			timeout = time.Duration(*defaultTimeout) * time.Second
 		}
 
+		// Only the requests reaching this point are counted in the backend stats
+		r = r.WithContext(context.WithValue(r.Context(), forwardStartKey{}, time.Now()))
+
 		switch clientReq.ForwardType {
 		case "http":
-			handleHTTPForwarding(w, r, clientReq, serverIP, *port, currentRequestCount, timeout)
+			return forwardHTTP(r, clientReq, serverIP, *port, currentRequestCount, timeout)
 		case "udp":
-			handleUDPForwarding(w, r, clientReq, serverIP, *port, currentRequestCount, timeout)
+			return forwardUDP(r, clientReq, serverIP, *port, currentRequestCount, timeout)
+		case "dns", "dot", "doh":
+			return forwardDNS(r, clientReq, serverIP, *port, currentRequestCount, timeout)
+		default:
+			return forwardConnect(r, clientReq, serverIP, *port, currentRequestCount, timeout)
+		}
+	}
+
+	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		var clientReq common.ProxyClientRequest
+		invalidBody := ""
+		if body, err := ioutil.ReadAll(r.Body); err != nil {
+			invalidBody = "Unable to read request body. Ensure it is valid JSON."
+		} else if err := json.Unmarshal(body, &clientReq); err != nil {
+			invalidBody = "Invalid request format. Ensure it is a valid JSON with required fields."
 		}
+		response, statusCode := forward(r, clientReq, invalidBody)
+		writeProxyResponse(w, response, statusCode)
+	})
+
+	http.HandleFunc("/bundle", func(w http.ResponseWriter, r *http.Request) {
+		handleBundle(w, r, forward)
 	})
 
-	// Start the HTTP server
+	http.HandleFunc("/scenario", func(w http.ResponseWriter, r *http.Request) {
+		handleScenario(w, r, forward)
+	})
+
+	http.HandleFunc("/admin/backends", handleAdminBackends)
+
+	// Start the HTTP server, or the HTTPS server with -tls-cert or -client-ca
 	address := fmt.Sprintf(":%s", *port)
-	fmt.Printf("Proxy server is listening on port %s\n", *port)
-	if err := http.ListenAndServe(address, nil); err != nil {
+	// The middlewares of all the handlers, the outermost first. The rate limit applies before the
+	// authentication, so floods of unauthenticated requests do not fill the audit log
+	var accessLog common.Middleware
+	if *accessLogEnabled {
+		accessLog = common.AccessLog
+	}
+	chain := common.NewChain(
+		common.Recover,
+		common.AssignRequestID,
+		accessLog,
+		diagnostics.Recorder,
+		common.Except(common.NewRateLimiter(*rateLimit).Limit, "/healthy"),
+		auth.guard,
+	)
+	server := &http.Server{Addr: address, Handler: chain.Then(http.DefaultServeMux)}
+	if *tlsCert == "" && *clientCA == "" {
+		fmt.Printf("Proxy server is listening on port %s\n", *port)
+		err = server.ListenAndServe()
+	} else {
+		server.TLSConfig, err = proxyTLSConfig(*tlsCert, *tlsKey, *clientCA)
+		if err != nil {
+			log.Fatalf("Unable to configure TLS: %v", err)
+		}
+		fmt.Printf("Proxy server is listening on port %s with TLS\n", *port)
+		err = server.ListenAndServeTLS("", "")
+	}
+	if err != nil {
 		fmt.Printf("Server failed to start: %v\n", err)
 	}
 }
 
-// isValidHTTPURL checks if the given URL is a valid HTTP URL
-func isValidHTTPURL(urlStr string) bool {
-	u, err := url.Parse(urlStr)
-	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
-}
+// proxyTLSConfig returns the TLS config of the proxy listener with the certificate of -tls-cert, or a
+// self-signed one, verifying the client certificates against the CAs of clientCAFile if set. A
+// client without certificate still completes the handshake, so /healthy stays available to the
+// probes and the other endpoints reject it with an audit log.
+func proxyTLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	cert, err := common.LoadOrGenerateCertificate(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if clientCAFile == "" {
+		return config, nil
+	}
 
-// isValidUDPAddress checks if the given address is a valid UDP address
-func isValidUDPAddress(address string) bool {
-	host, port, err := net.SplitHostPort(address)
+	data, err := os.ReadFile(clientCAFile)
 	if err != nil {
-		return false
+		return nil, err
 	}
-	if host == "" || port == "" {
-		return false
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no PEM certificate found in %s", clientCAFile)
 	}
-	return true
+	config.ClientCAs = pool
+	config.ClientAuth = tls.VerifyClientCertIfGiven
+	return config, nil
 }
 
-// handleHTTPForwarding handles HTTP forwarding to the backend server
-func handleHTTPForwarding(w http.ResponseWriter, r *http.Request, clientReq common.ProxyClientRequest, serverIP, port string, requestCounter int, timeout time.Duration) {
+// parseHTTPBackend parses an http:// or https:// BackendUrl, the port defaulting to the one of the scheme
+func parseHTTPBackend(urlStr string) (common.BackendAddress, error) {
+	return common.ParseBackendURL(urlStr, "http", "https")
+}
+
+// parseUDPBackend parses a host:port BackendUrl, e.g. 10.0.0.1:53 or [fe80::1%eth0]:8080
+func parseUDPBackend(address string) (common.BackendAddress, error) {
+	return common.ParseBackendHostPort(address, "")
+}
+
+// backendURLProblems returns the components of the BackendUrl that failed the validation, if err lists them
+func backendURLProblems(err error) []common.BackendURLProblem {
+	var urlErr *common.BackendURLError
+	if errors.As(err, &urlErr) {
+		return urlErr.Problems
+	}
+	return nil
+}
+
+// forwardHTTP forwards a request to an HTTP backend and returns the response to send
+func forwardHTTP(r *http.Request, clientReq common.ProxyClientRequest, serverIP, port string, requestCounter int, timeout time.Duration) (common.ProxyResponse, int) {
 	if clientReq.BackendUrl == "" {
-		sendProxyResponse(w, r, common.ProxyResponse{
+		return common.ProxyResponse{
 			Success:         false,
 			ErrorMessage:    "BackendUrl is required",
 			BackendResponse: "",
@@ -222,18 +967,85 @@ func handleHTTPForwarding(w http.ResponseWriter, r *http.Request, clientReq comm
 			FrontPort:       port,
 			RequestCounter:  requestCounter,
 			ForwardType:     clientReq.ForwardType,
-		}, http.StatusBadRequest)
-		return
+		}, http.StatusBadRequest
+	}
+
+	// Apply the requested TTL / DSCP to the TCP connection towards the backend, and connect to the
+	// IPs of Hosts instead of resolving their names, including for redirects
+	hosts := hostsOverrideFrom(r)
+	dialer := &net.Dialer{Control: common.IPQoSControl(clientReq.TTL, clientReq.DSCP, false)}
+	dial := func(ctx context.Context, network, address string) (net.Conn, error) {
+		return dialer.DialContext(ctx, network, hosts.address(address))
+	}
+	transport := &http.Transport{DialContext: dial, DisableKeepAlives: true}
+	client := &http.Client{Transport: transport}
+
+	// Take a pre-established connection from the warm pool when asked to; the connection is
+	// closed after the request since keep-alives are disabled, so each one serves one request
+	usedWarm := false
+	if clientReq.UseWarm {
+		transport.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+			if conn := warmPool.Take(address, false); conn != nil {
+				usedWarm = true
+				return conn, nil
+			}
+			return dial(ctx, network, address)
+		}
+		transport.DialTLSContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+			if conn := warmPool.Take(address, true); conn != nil {
+				usedWarm = true
+				return conn, nil
+			}
+			host, _, _ := net.SplitHostPort(address)
+			conn, err := dial(ctx, network, address)
+			if err != nil {
+				return nil, err
+			}
+			tlsConn := tls.Client(conn, &tls.Config{ServerName: host})
+			if err := tlsConn.HandshakeContext(ctx); err != nil {
+				conn.Close()
+				return nil, err
+			}
+			return tlsConn, nil
+		}
 	}
 
-	client := &http.Client{Timeout: timeout}
+	// The backend work is bound to the client's request, so it stops when the client goes away
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
 
-	// Parse the backend URL to extract the host and port
-	parsedURL, err := url.Parse(clientReq.BackendUrl)
+	// Parse the backend URL to extract the host and port, the default port of its scheme if none
+	backend, err := parseHTTPBackend(clientReq.BackendUrl)
 	if err != nil {
-		sendProxyResponse(w, r, common.ProxyResponse{
+		return common.ProxyResponse{
+			Success:          false,
+			ErrorMessage:     fmt.Sprintf("Invalid BackendUrl: %v", err),
+			ValidationErrors: backendURLProblems(err),
+			BackendResponse:  "",
+			BackendUrl:       clientReq.BackendUrl,
+			FrontUrl:         constructFullURL(r),
+			FrontIP:          serverIP,
+			FrontPort:        port,
+			RequestCounter:   requestCounter,
+			ForwardType:      clientReq.ForwardType,
+		}, http.StatusBadRequest
+	}
+
+	backendPort := backend.Port
+
+	// Resolve the backend IP address, unless it is a literal or Hosts gives it
+	var backendIPs []net.IP
+	if backend.IP != nil {
+		backendIPs = []net.IP{backend.IP}
+	} else if ip := hosts.lookup(backend.Host); ip != nil {
+		backendIPs = []net.IP{ip}
+	} else {
+		backendIPs, err = net.DefaultResolver.LookupIP(ctx, "ip", backend.Host)
+	}
+	if err != nil || len(backendIPs) == 0 {
+		return common.ProxyResponse{
 			Success:         false,
-			ErrorMessage:    fmt.Sprintf("Invalid BackendUrl: %v", err),
+			ErrorMessage:    fmt.Sprintf("Failed to resolve backend IP: %v", err),
 			BackendResponse: "",
 			BackendUrl:      clientReq.BackendUrl,
 			FrontUrl:        constructFullURL(r),
@@ -241,22 +1053,16 @@ func handleHTTPForwarding(w http.ResponseWriter, r *http.Request, clientReq comm
 			FrontPort:       port,
 			RequestCounter:  requestCounter,
 			ForwardType:     clientReq.ForwardType,
-		}, http.StatusBadRequest)
-		return
+		}, http.StatusBadRequest
 	}
+	backendIP := backendIPs[0].String()
 
-	backendHost, backendPort, err := net.SplitHostPort(parsedURL.Host)
+	// Send EchoData as the request body
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, clientReq.BackendUrl, bytes.NewBuffer([]byte(clientReq.EchoData)))
 	if err != nil {
-		backendHost = parsedURL.Host
-		backendPort = "80" // Default to port 80 if not specified
-	}
-
-	// Resolve the backend IP address
-	backendIPs, err := net.LookupIP(backendHost)
-	if err != nil || len(backendIPs) == 0 {
-		sendProxyResponse(w, r, common.ProxyResponse{
+		return common.ProxyResponse{
 			Success:         false,
-			ErrorMessage:    fmt.Sprintf("Failed to resolve backend IP: %v", err),
+			ErrorMessage:    fmt.Sprintf("Unable to create backend request: %v", err),
 			BackendResponse: "",
 			BackendUrl:      clientReq.BackendUrl,
 			FrontUrl:        constructFullURL(r),
@@ -264,15 +1070,27 @@ func handleHTTPForwarding(w http.ResponseWriter, r *http.Request, clientReq comm
 			FrontPort:       port,
 			RequestCounter:  requestCounter,
 			ForwardType:     clientReq.ForwardType,
-		}, http.StatusBadRequest)
-		return
+		}, http.StatusBadRequest
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(proxyHopsHeader, strconv.Itoa(requestHops(r)+1))
+	if id := common.RequestID(r); id != "" {
+		req.Header.Set(common.RequestIDHeader, id)
 	}
-	backendIP := backendIPs[0].String()
 
-	// Send EchoData as the request body
-	resp, err := client.Post(clientReq.BackendUrl, "application/json", bytes.NewBuffer([]byte(clientReq.EchoData)))
+	// Record the local address of the backend connection for the NAT observation
+	var localAddr net.Addr
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) { localAddr = info.Conn.LocalAddr() },
+	}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+	timer := common.NewHTTPTimer()
+	req = req.WithContext(timer.Trace(req.Context()))
+
+	resp, err := client.Do(req)
 	if err != nil {
-		sendProxyResponse(w, r, common.ProxyResponse{
+		cancelled, cancelReason := cancellationReason(r, ctx)
+		return common.ProxyResponse{
 			Success:         false,
 			ErrorMessage:    fmt.Sprintf("Failed to access backend: %v", err),
 			BackendResponse: "",
@@ -284,14 +1102,18 @@ func handleHTTPForwarding(w http.ResponseWriter, r *http.Request, clientReq comm
 			FrontPort:       port,
 			RequestCounter:  requestCounter,
 			ForwardType:     clientReq.ForwardType,
-		}, http.StatusGatewayTimeout) // 传入 504 状态码
-		return
+			Cancelled:       cancelled,
+			CancelReason:    cancelReason,
+			Timings:         timer.Timings(),
+		}, http.StatusGatewayTimeout // 传入 504 状态码
 	}
 	defer resp.Body.Close()
 
 	backendData, err := ioutil.ReadAll(resp.Body)
+	timer.BodyRead()
 	if err != nil {
-		sendProxyResponse(w, r, common.ProxyResponse{
+		cancelled, cancelReason := cancellationReason(r, ctx)
+		return common.ProxyResponse{
 			Success:         false,
 			ErrorMessage:    fmt.Sprintf("Failed to read backend response: %v", err),
 			BackendResponse: "",
@@ -303,11 +1125,13 @@ func handleHTTPForwarding(w http.ResponseWriter, r *http.Request, clientReq comm
 			FrontPort:       port,
 			RequestCounter:  requestCounter,
 			ForwardType:     clientReq.ForwardType,
-		}, http.StatusBadRequest)
-		return
+			Cancelled:       cancelled,
+			CancelReason:    cancelReason,
+			Timings:         timer.Timings(),
+		}, http.StatusBadRequest
 	}
 
-	sendProxyResponse(w, r, common.ProxyResponse{
+	return common.ProxyResponse{
 		Success:         true,
 		BackendResponse: string(backendData),
 		ErrorMessage:    "",
@@ -319,14 +1143,21 @@ func handleHTTPForwarding(w http.ResponseWriter, r *http.Request, clientReq comm
 		FrontPort:       port,
 		RequestCounter:  requestCounter,
 		ForwardType:     clientReq.ForwardType,
-	}, http.StatusOK)
+		TTL:             clientReq.TTL,
+		DSCP:            clientReq.DSCP,
+		NAT:             observeNAT(r, localAddr, backendData),
+		WarmConnection:  usedWarm,
+		Backend:         parseBackendEcho(backendData, "http", clientReq.EchoData),
+		Timings:         timer.Timings(),
+	}, http.StatusOK
 }
 
-// handleUDPForwarding handles UDP forwarding to the backend server
-func handleUDPForwarding(w http.ResponseWriter, r *http.Request, clientReq common.ProxyClientRequest, serverIP, port string, requestCounter int, timeout time.Duration) {
-	backendAddr, err := net.ResolveUDPAddr("udp", clientReq.BackendUrl)
+// forwardUDP forwards a request to a UDP backend and returns the response to send
+func forwardUDP(r *http.Request, clientReq common.ProxyClientRequest, serverIP, port string, requestCounter int, timeout time.Duration) (common.ProxyResponse, int) {
+	backend, _ := parseUDPBackend(clientReq.BackendUrl)
+	backendAddr, err := net.ResolveUDPAddr("udp", hostsOverrideFrom(r).address(backend.Address()))
 	if err != nil {
-		sendProxyResponse(w, r, common.ProxyResponse{
+		return common.ProxyResponse{
 			Success:         false,
 			ErrorMessage:    "Failed to resolve backend address. Ensure BackendUrl is a valid UDP address.",
 			BackendResponse: "",
@@ -336,57 +1167,134 @@ func handleUDPForwarding(w http.ResponseWriter, r *http.Request, clientReq commo
 			FrontPort:       port,
 			RequestCounter:  requestCounter,
 			ForwardType:     clientReq.ForwardType,
-		}, http.StatusBadRequest)
-		return
+		}, http.StatusBadRequest
 	}
 
-	// Forward the EchoData to the backend server
-	backendConn, err := net.DialUDP("udp", nil, backendAddr)
-	if err != nil {
-		w.WriteHeader(http.StatusBadGateway) // 设置 HTTP 状态码为 502 表示错误网关
-		sendProxyResponse(w, r, common.ProxyResponse{
-			Success:         false,
-			ErrorMessage:    "Failed to connect to backend server. Ensure the backend server is reachable via UDP.",
-			BackendResponse: "",
-			BackendUrl:      clientReq.BackendUrl,
-			BackendIP:       backendAddr.IP.String(),
-			BackendPort:     fmt.Sprintf("%d", backendAddr.Port),
-			FrontUrl:        constructFullURL(r),
-			FrontIP:         serverIP,
-			FrontPort:       port,
-			RequestCounter:  requestCounter,
-			ForwardType:     clientReq.ForwardType,
-		}, http.StatusBadGateway)
-		return
-	}
-	defer backendConn.Close()
+	// Forward the EchoData to the backend server, applying the requested TTL / DSCP
+	// and asking the kernel to report the TTL / DSCP of the response. Each attempt waits
+	// for its share of the timeout, and retries keep or change the source port as requested.
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
 
-	_, err = backendConn.Write([]byte(clientReq.EchoData))
-	if err != nil {
-		sendProxyResponse(w, r, common.ProxyResponse{
-			Success:         false,
-			ErrorMessage:    "Failed to send data to backend server. Ensure the data can be sent to the backend server.",
-			BackendResponse: "",
-			BackendUrl:      clientReq.BackendUrl,
-			BackendIP:       backendAddr.IP.String(),
-			BackendPort:     fmt.Sprintf("%d", backendAddr.Port),
-			FrontUrl:        constructFullURL(r),
-			FrontIP:         serverIP,
-			FrontPort:       port,
-			RequestCounter:  requestCounter,
-			ForwardType:     clientReq.ForwardType,
-		}, http.StatusBadRequest)
-		return
+	policy := clientReq.UDPSourcePort
+	if policy == "" {
+		policy = "reuse"
 	}
+	source := &common.UDPSourceResult{Policy: policy}
+	mutex.Lock()
+	source.PreviousSourcePort = stickyUDPPorts.get(backendAddr.String())
+	mutex.Unlock()
+
+	attempts := clientReq.UDPRetries + 1
+	attemptTimeout := timeout / time.Duration(attempts)
+	buffer := make([]byte, 65535) // Large enough for any UDP datagram
+	oob := make([]byte, 128)
+	var backendConn *net.UDPConn
+	defer func() {
+		if backendConn != nil {
+			backendConn.Close()
+		}
+	}()
+	var n, oobn int
+	for attempt := 0; attempt < attempts; attempt++ {
+		attemptEnd := time.Now().Add(attemptTimeout)
+		if backendConn == nil || policy == "new" {
+			if backendConn != nil {
+				backendConn.Close()
+			}
+			backendConn, err = dialUDPBackend(ctx, clientReq, backendAddr, udpLocalPort(policy, source.PreviousSourcePort))
+			if err != nil {
+				return common.ProxyResponse{
+					Success:         false,
+					ErrorMessage:    fmt.Sprintf("Failed to connect to backend server. Ensure the backend server is reachable via UDP and the source port is free: %v", err),
+					BackendResponse: "",
+					BackendUrl:      clientReq.BackendUrl,
+					BackendIP:       backendAddr.IP.String(),
+					BackendPort:     fmt.Sprintf("%d", backendAddr.Port),
+					FrontUrl:        constructFullURL(r),
+					FrontIP:         serverIP,
+					FrontPort:       port,
+					RequestCounter:  requestCounter,
+					ForwardType:     clientReq.ForwardType,
+					UDPSource:       source,
+				}, http.StatusBadGateway
+			}
+		}
+		result := common.UDPAttempt{SourcePort: backendConn.LocalAddr().(*net.UDPAddr).Port}
+
+		// The flow label is carried as a control message on each sent packet
+		var sendOOB []byte
+		if clientReq.FlowLabel > 0 {
+			if backendAddr.IP.To4() != nil {
+				err = fmt.Errorf("the backend %s is not an IPv6 address", backendAddr.IP)
+			} else {
+				sendOOB, err = common.FlowLabelOOB(backendConn, backendAddr.IP, clientReq.FlowLabel)
+			}
+			if err != nil {
+				return common.ProxyResponse{
+					Success:         false,
+					ErrorMessage:    fmt.Sprintf("Unable to set the IPv6 flow label: %v", err),
+					BackendResponse: "",
+					BackendUrl:      clientReq.BackendUrl,
+					BackendIP:       backendAddr.IP.String(),
+					BackendPort:     fmt.Sprintf("%d", backendAddr.Port),
+					FrontUrl:        constructFullURL(r),
+					FrontIP:         serverIP,
+					FrontPort:       port,
+					RequestCounter:  requestCounter,
+					ForwardType:     clientReq.ForwardType,
+				}, http.StatusBadRequest
+			}
+		}
+
+		// A retry sends a new expansion of the EchoData template
+		if payload, ok := r.Context().Value(echoPayloadKey{}).(*echoPayload); ok && payload.template != nil && attempt > 0 {
+			if clientReq.EchoData, err = payload.build(); err != nil {
+				return common.ProxyResponse{
+					Success:         false,
+					ErrorMessage:    fmt.Sprintf("Unable to build the EchoData of retry %d: %v", attempt, err),
+					BackendResponse: "",
+					BackendUrl:      clientReq.BackendUrl,
+					BackendIP:       backendAddr.IP.String(),
+					BackendPort:     fmt.Sprintf("%d", backendAddr.Port),
+					FrontUrl:        constructFullURL(r),
+					FrontIP:         serverIP,
+					FrontPort:       port,
+					RequestCounter:  requestCounter,
+					ForwardType:     clientReq.ForwardType,
+					UDPSource:       source,
+				}, http.StatusInternalServerError
+			}
+		}
 
-	// Set a read deadline for the response
-	backendConn.SetReadDeadline(time.Now().Add(timeout))
+		_, _, err = backendConn.WriteMsgUDP([]byte(clientReq.EchoData), sendOOB, nil)
+		if err == nil {
+			n, oobn, err = readUDPAttempt(ctx, backendConn, buffer, oob, attemptEnd)
+		}
+		if err == nil {
+			source.Attempts = append(source.Attempts, result)
+			break
+		}
+		result.ErrorMessage = err.Error()
+		source.Attempts = append(source.Attempts, result)
+		if ctx.Err() != nil || attempt == attempts-1 {
+			break
+		}
+		// An ICMP error fails the read at once, wait for the rest of the attempt before retrying
+		select {
+		case <-time.After(time.Until(attemptEnd)):
+		case <-ctx.Done():
+		}
+	}
+	source.SourcePort = source.Attempts[len(source.Attempts)-1].SourcePort
+	source.Reused = source.SourcePort == source.PreviousSourcePort
+	mutex.Lock()
+	stickyUDPPorts.set(backendAddr.String(), source.SourcePort)
+	mutex.Unlock()
 
-	// Read the response from the backend server
-	buffer := make([]byte, 1024)
-	n, _, err := backendConn.ReadFromUDP(buffer)
 	if err != nil {
-		sendProxyResponse(w, r, common.ProxyResponse{
+		cancelled, cancelReason := cancellationReason(r, ctx)
+		return common.ProxyResponse{
 			Success:         false,
 			ErrorMessage:    "Failed to read response from backend server. Ensure the backend server sends a valid response.",
 			BackendResponse: "",
@@ -398,11 +1306,13 @@ func handleUDPForwarding(w http.ResponseWriter, r *http.Request, clientReq commo
 			FrontPort:       port,
 			RequestCounter:  requestCounter,
 			ForwardType:     clientReq.ForwardType,
-		}, http.StatusGatewayTimeout) // 传入 504 状态码
-		return
+			Cancelled:       cancelled,
+			CancelReason:    cancelReason,
+			UDPSource:       source,
+		}, http.StatusGatewayTimeout // 传入 504 状态码
 	}
 
-	sendProxyResponse(w, r, common.ProxyResponse{
+	response := common.ProxyResponse{
 		Success:         true,
 		BackendResponse: string(buffer[:n]),
 		ErrorMessage:    "",
@@ -414,32 +1324,500 @@ func handleUDPForwarding(w http.ResponseWriter, r *http.Request, clientReq commo
 		FrontPort:       port,
 		RequestCounter:  requestCounter,
 		ForwardType:     clientReq.ForwardType,
-	}, http.StatusOK)
+		TTL:             clientReq.TTL,
+		DSCP:            clientReq.DSCP,
+		FlowLabel:       clientReq.FlowLabel,
+		NAT:             observeNAT(r, backendConn.LocalAddr(), buffer[:n]),
+		Backend:         parseBackendEcho(buffer[:n], "udp", clientReq.EchoData),
+		UDPSource:       source,
+	}
+	if flowLabel, ok := common.ParseFlowLabel(oob[:oobn]); ok {
+		response.ObservedFlowLabel = &flowLabel
+	}
+	if ttl, ttlOK, dscp, dscpOK := common.ParseIPQoS(oob[:oobn]); ttlOK || dscpOK {
+		if ttlOK {
+			response.ObservedTTL = &ttl
+		}
+		if dscpOK {
+			response.ObservedDSCP = &dscp
+		}
+	}
+
+	return response, http.StatusOK
 }
 
-// constructFullURL constructs the full URL from the request
-func constructFullURL(r *http.Request) string {
-	scheme := "http"
-	if r.TLS != nil {
-		scheme = "https"
+// dialUDPBackend connects a UDP socket to the backend, from the given local port or from an
+// ephemeral port when it is 0
+func dialUDPBackend(ctx context.Context, clientReq common.ProxyClientRequest, backendAddr *net.UDPAddr, localPort int) (*net.UDPConn, error) {
+	dialer := &net.Dialer{Control: common.IPQoSControl(clientReq.TTL, clientReq.DSCP, true)}
+	if localPort > 0 {
+		dialer.LocalAddr = &net.UDPAddr{Port: localPort}
 	}
-	return fmt.Sprintf("%s://%s%s", scheme, r.Host, r.URL.Path)
+	conn, err := dialer.DialContext(ctx, "udp", backendAddr.String())
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.UDPConn), nil
 }
 
-// sendProxyResponse marshals the response data to JSON and writes it to the response writer
-func sendProxyResponse(w http.ResponseWriter, r *http.Request, response common.ProxyResponse, statusCode int) {
-	hostname, _ := os.Hostname()
-	clientIP, clientPort, _ := net.SplitHostPort(r.RemoteAddr)
-	_, ipVersion := common.GetServerIPAndVersion(r)
+// udpLocalPort returns the local port of an attempt for the UDPSourcePort policy, 0 for an ephemeral port
+func udpLocalPort(policy string, previousPort int) int {
+	switch policy {
+	case "reuse", "new":
+		return 0
+	case "sticky":
+		return previousPort
+	}
+	localPort, _ := parseUDPSourcePort(policy)
+	return localPort
+}
 
-	response.ProxyHostName = hostname
-	response.ClientIP = clientIP
-	response.ClientPort = clientPort
-	response.IPVersion = ipVersion
+// parseUDPSourcePort validates the UDPSourcePort of a request and returns its port number, if any
+func parseUDPSourcePort(policy string) (int, error) {
+	switch policy {
+	case "", "reuse", "new", "sticky":
+		return 0, nil
+	}
+	localPort, err := strconv.Atoi(policy)
+	if err != nil || localPort < 1 || localPort > 65535 {
+		return 0, fmt.Errorf("invalid UDPSourcePort %q", policy)
+	}
+	return localPort, nil
+}
 
-	// 使用传入的 statusCode 设置 HTTP 状态码
-	w.WriteHeader(statusCode)
+// readUDPAttempt reads the response of one attempt, until the end of the attempt, the timeout,
+// or the client disconnecting
+func readUDPAttempt(ctx context.Context, conn *net.UDPConn, buffer, oob []byte, attemptEnd time.Time) (int, int, error) {
+	conn.SetReadDeadline(attemptEnd)
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetReadDeadline(time.Now())
+	})
+	defer stop()
+
+	n, oobn, _, _, err := conn.ReadMsgUDP(buffer, oob)
+	return n, oobn, err
+}
+
+// forwardDNS sends a DNS query to the resolver in BackendUrl over plain DNS (UDP),
+// DNS-over-TLS or DNS-over-HTTPS, and reports the answers, the latency and for the encrypted
+// transports the TLS and certificate details of the resolver
+func forwardDNS(r *http.Request, clientReq common.ProxyClientRequest, serverIP, port string, requestCounter int, timeout time.Duration) (common.ProxyResponse, int) {
+	response := common.ProxyResponse{
+		BackendUrl:     clientReq.BackendUrl,
+		FrontUrl:       constructFullURL(r),
+		FrontIP:        serverIP,
+		FrontPort:      port,
+		RequestCounter: requestCounter,
+		ForwardType:    clientReq.ForwardType,
+	}
+
+	dnsType := clientReq.DNSType
+	if dnsType == "" {
+		dnsType = "A"
+	}
+	qtype, err := common.DNSTypeFromName(dnsType)
+	if err != nil {
+		response.ErrorMessage = fmt.Sprintf("Invalid DNSType: %v", err)
+		return response, http.StatusBadRequest
+	}
+
+	query, err := common.BuildDNSQuery(common.NewDNSQueryID(), clientReq.DNSName, qtype)
+	if err != nil {
+		response.ErrorMessage = fmt.Sprintf("Invalid DNSName: %v", err)
+		return response, http.StatusBadRequest
+	}
+
+	// The host of the resolver is the default SNI
+	backend, _ := parseUDPBackend(clientReq.BackendUrl)
+	if clientReq.ForwardType == "doh" {
+		backend, _ = common.ParseBackendURL(clientReq.BackendUrl, "https")
+	}
+	response.BackendIP, response.BackendPort = backend.Hostname(), backend.Port
+	serverName := clientReq.SNI
+	if serverName == "" {
+		serverName = backend.Host
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+
+	start := time.Now()
+	var answer []byte
+	var tlsDetails *common.TLSDetails
+	var overTCP bool
+	switch clientReq.ForwardType {
+	case "dns":
+		answer, overTCP, err = queryPlainDNS(ctx, backend.Address(), query)
+	case "dot":
+		answer, tlsDetails, err = queryDNSOverTLS(ctx, backend.Address(), serverName, query)
+	case "doh":
+		answer, tlsDetails, err = queryDNSOverHTTPS(ctx, clientReq.BackendUrl, serverName, query)
+	}
+	latency := time.Since(start)
+
+	response.DNS = &common.DNSProbeResult{
+		Name:      clientReq.DNSName,
+		Type:      dnsType,
+		LatencyMs: float64(latency.Microseconds()) / 1000,
+		TLS:       tlsDetails,
+		OverTCP:   overTCP,
+	}
+	if err != nil {
+		response.Cancelled, response.CancelReason = cancellationReason(r, ctx)
+		response.ErrorMessage = fmt.Sprintf("DNS query failed: %v", err)
+		return response, http.StatusGatewayTimeout
+	}
+
+	msg, err := common.ParseDNSMessage(answer)
+	if err != nil {
+		response.ErrorMessage = fmt.Sprintf("Invalid DNS response: %v", err)
+		return response, http.StatusBadGateway
+	}
+	if sent, _ := common.ParseDNSMessage(query); !msg.RepliesTo(sent) {
+		response.ErrorMessage = "Invalid DNS response: its ID or question does not match the query"
+		return response, http.StatusBadGateway
+	}
+	response.DNS.Rcode = msg.Rcode
+	response.DNS.Answers = msg.Answers
+
+	response.Success = true
+	response.BackendResponse = fmt.Sprintf("%s %d answers", msg.Rcode, len(msg.Answers))
+	return response, http.StatusOK
+}
+
+// parseConnectBackend returns the protocol and host:port of a connect probe. The backend is
+// given as tcp://, tls:// or udp://host:port, as an http:// or https:// URL, or as host:port for tcp.
+func parseConnectBackend(backend string) (string, string, error) {
+	if protocol, address, ok := strings.Cut(backend, "://"); ok {
+		switch protocol {
+		case "tcp", "tls", "udp":
+			parsed, err := parseUDPBackend(address)
+			var urlErr *common.BackendURLError
+			if errors.As(err, &urlErr) {
+				urlErr.BackendUrl = backend
+			}
+			if err != nil {
+				return "", "", err
+			}
+			return protocol, parsed.Address(), nil
+		case "http", "https":
+		default:
+			return "", "", fmt.Errorf("unsupported scheme %q, expected tcp, tls, udp, http or https", protocol)
+		}
+	}
+
+	address, useTLS, err := common.ParseWarmBackend(backend, false)
+	if err != nil {
+		return "", "", err
+	}
+	if useTLS {
+		return "tls", address, nil
+	}
+	return "tcp", address, nil
+}
+
+// forwardConnect establishes a TCP, TLS or UDP "connection" to the backend without
+// sending EchoData, and reports its timing. Since UDP has no handshake, an empty datagram is
+// sent and the probe fails only if an ICMP error (e.g. port unreachable) comes back in time.
+func forwardConnect(r *http.Request, clientReq common.ProxyClientRequest, serverIP, port string, requestCounter int, timeout time.Duration) (common.ProxyResponse, int) {
+	response := common.ProxyResponse{
+		BackendUrl:     clientReq.BackendUrl,
+		FrontUrl:       constructFullURL(r),
+		FrontIP:        serverIP,
+		FrontPort:      port,
+		RequestCounter: requestCounter,
+		ForwardType:    clientReq.ForwardType,
+		TTL:            clientReq.TTL,
+		DSCP:           clientReq.DSCP,
+	}
 
+	protocol, address, _ := parseConnectBackend(clientReq.BackendUrl)
+	dialAddress := hostsOverrideFrom(r).address(address)
+	response.BackendIP, response.BackendPort, _ = net.SplitHostPort(dialAddress)
+	response.Connect = &common.ConnectResult{Protocol: protocol, Address: address}
+
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+
+	network := "tcp"
+	if protocol == "udp" {
+		network = "udp"
+	}
+	dialer := &net.Dialer{Control: common.IPQoSControl(clientReq.TTL, clientReq.DSCP, false)}
+	start := time.Now()
+	conn, err := dialer.DialContext(ctx, network, dialAddress)
+	response.Connect.ConnectMs = float64(time.Since(start).Microseconds()) / 1000
+	if err != nil {
+		response.Cancelled, response.CancelReason = cancellationReason(r, ctx)
+		response.ErrorMessage = fmt.Sprintf("Failed to connect to backend: %v", err)
+		return response, http.StatusBadGateway
+	}
+	defer conn.Close()
+	response.Connect.LocalAddress = conn.LocalAddr().String()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	switch protocol {
+	case "tls":
+		serverName := clientReq.SNI
+		if serverName == "" {
+			serverName, _, _ = net.SplitHostPort(address)
+		}
+		// Verification is done by InspectTLS, so details of invalid certificates are still reported
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: serverName, InsecureSkipVerify: true})
+		handshakeStart := time.Now()
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			response.Cancelled, response.CancelReason = cancellationReason(r, ctx)
+			response.ErrorMessage = fmt.Sprintf("TLS handshake failed: %v", err)
+			return response, http.StatusBadGateway
+		}
+		response.Connect.TLS = common.InspectTLS(tlsConn.ConnectionState(), serverName, time.Since(handshakeStart))
+	case "udp":
+		wait := 500 * time.Millisecond
+		if clientReq.UDPWait > 0 {
+			wait = time.Duration(clientReq.UDPWait) * time.Millisecond
+		}
+		if deadline, ok := ctx.Deadline(); !ok || time.Now().Add(wait).Before(deadline) {
+			conn.SetReadDeadline(time.Now().Add(wait))
+		}
+
+		_, err := conn.Write(nil)
+		if err == nil {
+			_, err = conn.Read(make([]byte, 65535))
+		}
+		response.Connect.ConnectMs = float64(time.Since(start).Microseconds()) / 1000
+		var netErr net.Error
+		switch {
+		case err == nil:
+			response.Connect.UDPState = "responded"
+		case errors.As(err, &netErr) && netErr.Timeout() && r.Context().Err() == nil:
+			response.Connect.UDPState = "no-error"
+		default:
+			response.Cancelled, response.CancelReason = cancellationReason(r, ctx)
+			response.ErrorMessage = fmt.Sprintf("UDP backend unreachable: %v", err)
+			return response, http.StatusBadGateway
+		}
+	}
+
+	response.Success = true
+	response.BackendResponse = fmt.Sprintf("%s connection to %s established", protocol, address)
+	return response, http.StatusOK
+}
+
+// queryPlainDNS sends a DNS query over UDP. Datagrams that are not a reply to the query, e.g.
+// spoofed or late replies to an earlier query, are dropped. A truncated reply makes the query be
+// retried over TCP, as a stub resolver does, which is reported by the returned boolean.
+func queryPlainDNS(ctx context.Context, address string, query []byte) ([]byte, bool, error) {
+	sent, err := common.ParseDNSMessage(query)
+	if err != nil {
+		return nil, false, err
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "udp", address)
+	if err != nil {
+		return nil, false, err
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if _, err := conn.Write(query); err != nil {
+		return nil, false, err
+	}
+
+	buffer := make([]byte, 65535)
+	for {
+		n, err := conn.Read(buffer)
+		if err != nil {
+			return nil, false, err
+		}
+		msg, err := common.ParseDNSMessage(buffer[:n])
+		if err != nil || !msg.RepliesTo(sent) {
+			continue
+		}
+		if !msg.Truncated {
+			return buffer[:n], false, nil
+		}
+
+		tcpConn, err := dialer.DialContext(ctx, "tcp", address)
+		if err != nil {
+			return nil, true, fmt.Errorf("truncated UDP response, retry over TCP failed: %v", err)
+		}
+		defer tcpConn.Close()
+		if deadline, ok := ctx.Deadline(); ok {
+			tcpConn.SetDeadline(deadline)
+		}
+		answer, err := exchangeFramedDNS(tcpConn, query)
+		return answer, true, err
+	}
+}
+
+// exchangeFramedDNS sends a DNS query and reads its answer over a stream connection, using
+// the TCP length-prefixed framing (RFC 1035 section 4.2.2)
+func exchangeFramedDNS(conn net.Conn, query []byte) ([]byte, error) {
+	framed := binary.BigEndian.AppendUint16(nil, uint16(len(query)))
+	if _, err := conn.Write(append(framed, query...)); err != nil {
+		return nil, err
+	}
+
+	lengthBytes := make([]byte, 2)
+	if _, err := io.ReadFull(conn, lengthBytes); err != nil {
+		return nil, err
+	}
+	answer := make([]byte, binary.BigEndian.Uint16(lengthBytes))
+	if _, err := io.ReadFull(conn, answer); err != nil {
+		return nil, err
+	}
+	return answer, nil
+}
+
+// queryDNSOverTLS sends a DNS query over TLS (RFC 7858), using the TCP length-prefixed framing
+func queryDNSOverTLS(ctx context.Context, address, serverName string, query []byte) ([]byte, *common.TLSDetails, error) {
+	var dialer net.Dialer
+	rawConn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rawConn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		rawConn.SetDeadline(deadline)
+	}
+
+	// Verification is done by InspectTLS, so details of invalid certificates are still reported
+	conn := tls.Client(rawConn, &tls.Config{ServerName: serverName, InsecureSkipVerify: true})
+	handshakeStart := time.Now()
+	if err := conn.HandshakeContext(ctx); err != nil {
+		return nil, nil, fmt.Errorf("TLS handshake failed: %v", err)
+	}
+	tlsDetails := common.InspectTLS(conn.ConnectionState(), serverName, time.Since(handshakeStart))
+
+	answer, err := exchangeFramedDNS(conn, query)
+	return answer, tlsDetails, err
+}
+
+// queryDNSOverHTTPS sends a DNS query over HTTPS (RFC 8484) using the POST method
+func queryDNSOverHTTPS(ctx context.Context, resolverURL, serverName string, query []byte) ([]byte, *common.TLSDetails, error) {
+	client := &http.Client{
+		Transport: &http.Transport{
+			// Verification is done by InspectTLS, so details of invalid certificates are still reported
+			TLSClientConfig:   &tls.Config{ServerName: serverName, InsecureSkipVerify: true},
+			DisableKeepAlives: true,
+		},
+	}
+
+	var handshakeStart time.Time
+	var handshake time.Duration
+	trace := &httptrace.ClientTrace{
+		TLSHandshakeStart: func() { handshakeStart = time.Now() },
+		TLSHandshakeDone:  func(tls.ConnectionState, error) { handshake = time.Since(handshakeStart) },
+	}
+
+	req, err := http.NewRequestWithContext(httptrace.WithClientTrace(ctx, trace), http.MethodPost, resolverURL, bytes.NewReader(query))
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	var tlsDetails *common.TLSDetails
+	if resp.TLS != nil {
+		tlsDetails = common.InspectTLS(*resp.TLS, serverName, handshake)
+	}
+
+	answer, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, tlsDetails, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, tlsDetails, fmt.Errorf("resolver returned %s", resp.Status)
+	}
+	return answer, tlsDetails, nil
+}
+
+// handleWarm manages the pool of pre-established backend connections:
+// POST establishes connections as described by a WarmRequest, GET reports the
+// held connections and DELETE closes them all
+func handleWarm(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		sendWarmResponse(w, common.WarmResponse{Success: true, Held: warmPool.Stats()}, http.StatusOK)
+		return
+	case http.MethodDelete:
+		closed := warmPool.CloseAll()
+		log.Printf("Closed %d warm connections", closed)
+		sendWarmResponse(w, common.WarmResponse{Success: true, Held: warmPool.Stats(), Closed: closed}, http.StatusOK)
+		return
+	case http.MethodPost:
+	default:
+		sendWarmResponse(w, common.WarmResponse{ErrorMessage: "Unsupported method. Use POST, GET or DELETE."}, http.StatusMethodNotAllowed)
+		return
+	}
+
+	var warmReq common.WarmRequest
+	if err := json.NewDecoder(r.Body).Decode(&warmReq); err != nil || len(warmReq.Backends) == 0 || warmReq.Connections <= 0 {
+		sendWarmResponse(w, common.WarmResponse{
+			ErrorMessage: "Invalid request format. Backends and a positive Connections are required.",
+		}, http.StatusBadRequest)
+		return
+	}
+	if len(warmReq.Backends) > maxWarmBackends || warmReq.Connections > maxWarmConnections {
+		sendWarmResponse(w, common.WarmResponse{
+			ErrorMessage: fmt.Sprintf("Too many connections requested. At most %d Backends and %d Connections per backend are allowed.", maxWarmBackends, maxWarmConnections),
+		}, http.StatusBadRequest)
+		return
+	}
+
+	timeout := time.Duration(warmReq.Timeout) * time.Second
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+
+	// Warm all backends in parallel, each establishing its connections one after another
+	response := common.WarmResponse{Success: true, Backends: make([]common.WarmBackendResult, len(warmReq.Backends))}
+	var wg sync.WaitGroup
+	for i, backend := range warmReq.Backends {
+		address, useTLS, err := common.ParseWarmBackend(backend, warmReq.TLS)
+		if err != nil {
+			response.Backends[i] = common.WarmBackendResult{Backend: backend, Requested: warmReq.Connections, Errors: []string{err.Error()}}
+			continue
+		}
+		wg.Add(1)
+		go func(i int, address string, useTLS bool) {
+			defer wg.Done()
+			response.Backends[i] = warmPool.Warm(ctx, address, useTLS, warmReq.SNI, warmReq.Connections)
+		}(i, address, useTLS)
+	}
+	wg.Wait()
+
+	for _, result := range response.Backends {
+		if result.Established < result.Requested {
+			response.Success = false
+			response.ErrorMessage = "Some connections could not be established"
+		}
+	}
+	response.Held = warmPool.Stats()
+
+	statusCode := http.StatusOK
+	if !response.Success {
+		statusCode = http.StatusBadGateway
+	}
+	sendWarmResponse(w, response, statusCode)
+}
+
+// sendWarmResponse sends the response of the /warm endpoint
+func sendWarmResponse(w http.ResponseWriter, response common.WarmResponse, statusCode int) {
 	responseJSON, err := json.Marshal(response)
 	if err != nil {
 		http.Error(w, "Unable to marshal response data", http.StatusInternalServerError)
@@ -447,7 +1825,1326 @@ func sendProxyResponse(w http.ResponseWriter, r *http.Request, response common.P
 	}
 
 	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
 	w.Write(responseJSON)
+	log.Printf("Sent warm response: %s", responseJSON)
+}
 
-	log.Printf("Sent response: %s", responseJSON)
+// handleBundle runs all the probes of a BundleRequest concurrently with forward,
+// under a single deadline, and returns their responses in one BundleResponse
+func handleBundle(w http.ResponseWriter, r *http.Request, forward forwardFunc) {
+	if r.Method != http.MethodPost {
+		sendBundleResponse(w, common.BundleResponse{ErrorMessage: "Unsupported method. Use POST."}, http.StatusMethodNotAllowed)
+		return
+	}
+
+	var bundleReq common.BundleRequest
+	if err := json.NewDecoder(r.Body).Decode(&bundleReq); err != nil || len(bundleReq.Probes) == 0 {
+		sendBundleResponse(w, common.BundleResponse{
+			ErrorMessage: "Invalid request format. Probes must contain at least one probe.",
+		}, http.StatusBadRequest)
+		return
+	}
+	if len(bundleReq.Probes) > maxBundleProbes {
+		sendBundleResponse(w, common.BundleResponse{
+			Name:         bundleReq.Name,
+			ErrorMessage: fmt.Sprintf("Too many probes: %d, the maximum is %d.", len(bundleReq.Probes), maxBundleProbes),
+		}, http.StatusBadRequest)
+		return
+	}
+
+	var payload float64
+	forwards := 0
+	for _, probe := range bundleReq.Probes {
+		bytes, sends := forwardedBytes(probe.ProxyClientRequest)
+		payload += float64(bytes)
+		forwards += sends
+	}
+	if limit := checkFanout(payload, forwards); limit != nil {
+		sendBundleResponse(w, common.BundleResponse{
+			Name:               bundleReq.Name,
+			ErrorMessage:       amplificationMessage(limit),
+			AmplificationLimit: limit,
+		}, http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	timeout := time.Duration(bundleReq.Timeout) * time.Second
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+	ctx = context.WithValue(ctx, byteBudgetKey{}, new(atomic.Int64))
+
+	start := time.Now()
+	response := common.BundleResponse{Name: bundleReq.Name, Results: make([]common.BundleProbeResult, len(bundleReq.Probes))}
+	var wg sync.WaitGroup
+	for i, probe := range bundleReq.Probes {
+		wg.Add(1)
+		go func(i int, probe common.BundleProbe) {
+			defer wg.Done()
+			response.Results[i] = runBundleProbe(ctx, r, forward, probe)
+		}(i, probe)
+	}
+	wg.Wait()
+
+	response.DurationMs = float64(time.Since(start).Microseconds()) / 1000
+	response.DeadlineExceeded = ctx.Err() == context.DeadlineExceeded
+	for _, result := range response.Results {
+		if result.Response != nil && result.Response.Success {
+			response.Passed++
+		} else {
+			response.Failed++
+		}
+		if result.Response != nil && result.Response.AmplificationLimit != nil && response.AmplificationLimit == nil {
+			response.AmplificationLimit = result.Response.AmplificationLimit
+		}
+	}
+	response.Success = response.Failed == 0
+	if !response.Success {
+		response.ErrorMessage = fmt.Sprintf("%d of %d probes failed", response.Failed, len(response.Results))
+	}
+	if response.AmplificationLimit != nil {
+		response.ErrorMessage += ", some over the -" + response.AmplificationLimit.Limit + " ceiling"
+	}
+	sendBundleResponse(w, response, http.StatusOK)
+}
+
+// runBundleProbe forwards a single probe on behalf of the bundle request r, bound to the bundle
+// context, so it is cancelled when the bundle deadline passes or the client disconnects
+func runBundleProbe(ctx context.Context, r *http.Request, forward forwardFunc, probe common.BundleProbe) common.BundleProbeResult {
+	result := common.BundleProbeResult{Name: probe.Name}
+	if result.Name == "" {
+		result.Name = probe.ForwardType + " " + probe.BackendUrl
+	}
+
+	// The probe keeps the client, hops, request ID and caller of the bundle request
+	req := r.WithContext(ctx)
+	req.URL = &url.URL{Path: "/"}
+
+	start := time.Now()
+	response, statusCode := forward(req, probe.ProxyClientRequest, "")
+	result.DurationMs = float64(time.Since(start).Microseconds()) / 1000
+	result.StatusCode = statusCode
+	result.Response = &response
+	return result
+}
+
+// sendBundleResponse sends the response of the /bundle endpoint
+func sendBundleResponse(w http.ResponseWriter, response common.BundleResponse, statusCode int) {
+	responseJSON, err := json.Marshal(response)
+	if err != nil {
+		http.Error(w, "Unable to marshal response data", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	w.Write(responseJSON)
+	log.Printf("Sent bundle response: %s", responseJSON)
+}
+
+// observeNAT describes the source address of each hop: the client address seen by the proxy,
+// and the local address the proxy used for the backend connection together with the client
+// address the backend observed, when the backend is one of our echo servers
+func observeNAT(r *http.Request, localAddr net.Addr, backendData []byte) []common.NATHop {
+	hops := []common.NATHop{{Hop: "client->proxy", ObservedAddress: r.RemoteAddr}}
+
+	backendHop := common.NATHop{Hop: "proxy->backend"}
+	if localAddr != nil {
+		backendHop.LocalAddress = localAddr.String()
+	}
+
+	// Both echo servers report the source address they saw as ClientIP and ClientPort;
+	// the match is case-insensitive, so the legacy clientIP and clientPort fields work too
+	var echo struct {
+		ClientIP   string
+		ClientPort string
+	}
+	if json.Unmarshal(backendData, &echo) == nil && echo.ClientIP != "" {
+		backendHop.ObservedAddress = net.JoinHostPort(echo.ClientIP, echo.ClientPort)
+		if localAddr != nil {
+			translated := !sameAddress(backendHop.LocalAddress, backendHop.ObservedAddress)
+			backendHop.Translated = &translated
+		}
+	}
+
+	return append(hops, backendHop)
+}
+
+// backendEchoSchema lists the fields every echo server response has, with their JSON types
+var backendEchoSchema = []struct {
+	Field string
+	Type  string
+}{
+	{"ServerHostName", "string"},
+	{"ClientIP", "string"},
+	{"ClientPort", "string"},
+	{"ServerIP", "string"},
+	{"ServerPort", "string"},
+	{"IPVersion", "string"},
+	{"ClientEchoData", "string"},
+	{"RequestTimestamp", "string"},
+	{"RequestCounter", "number"},
+	{"ServerType", "string"},
+}
+
+// parseBackendEcho validates a backend response against the schema of our echo servers and
+// returns its main fields. It returns nil when the response is not a JSON object, since the
+// backend is then not one of our echo servers.
+func parseBackendEcho(backendData []byte, serverType, sentData string) *common.BackendEcho {
+	var fields map[string]interface{}
+	if json.Unmarshal(backendData, &fields) != nil {
+		return nil
+	}
+
+	echo := &common.BackendEcho{}
+	for _, field := range backendEchoSchema {
+		value, ok := fields[field.Field]
+		if !ok {
+			echo.SchemaErrors = append(echo.SchemaErrors, fmt.Sprintf("missing %s", field.Field))
+			continue
+		}
+		_, isString := value.(string)
+		_, isNumber := value.(float64)
+		if (field.Type == "string" && !isString) || (field.Type == "number" && !isNumber) {
+			echo.SchemaErrors = append(echo.SchemaErrors, fmt.Sprintf("%s is not a %s", field.Field, field.Type))
+		}
+	}
+
+	echo.ServerHostName, _ = fields["ServerHostName"].(string)
+	echo.ServerIP, _ = fields["ServerIP"].(string)
+	echo.ServerType, _ = fields["ServerType"].(string)
+	if counter, ok := fields["RequestCounter"].(float64); ok {
+		echo.RequestCounter = int(counter)
+	}
+	if echo.ServerType != "" && echo.ServerType != serverType {
+		echo.SchemaErrors = append(echo.SchemaErrors, fmt.Sprintf("ServerType is %q, expected %q", echo.ServerType, serverType))
+	}
+	echoData, _ := fields["ClientEchoData"].(string)
+	echo.EchoMatches = echoData == sentData
+	echo.SchemaValid = len(echo.SchemaErrors) == 0
+	return echo
+}
+
+// sameAddress compares two host:port addresses, ignoring IPv4-mapped IPv6 notation
+func sameAddress(a, b string) bool {
+	hostA, portA, errA := net.SplitHostPort(a)
+	hostB, portB, errB := net.SplitHostPort(b)
+	if errA != nil || errB != nil {
+		return a == b
+	}
+	ipA, ipB := net.ParseIP(hostA), net.ParseIP(hostB)
+	return portA == portB && ipA != nil && ipA.Equal(ipB)
+}
+
+// cancellationReason reports whether the backend work bound to ctx was cancelled, and why
+func cancellationReason(r *http.Request, ctx context.Context) (bool, string) {
+	if err := r.Context().Err(); err != nil {
+		// Only the probes of a bundle have a request context with a deadline
+		if err == context.DeadlineExceeded {
+			return true, "bundle deadline exceeded"
+		}
+		return true, "client disconnected"
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		return true, "deadline exceeded"
+	}
+	return false, ""
+}
+
+// constructFullURL constructs the full URL from the request
+func constructFullURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s%s", scheme, r.Host, r.URL.Path)
+}
+
+// sendProxyResponse completes the response data, then marshals it to JSON and writes it to the response writer
+func sendProxyResponse(w http.ResponseWriter, r *http.Request, response common.ProxyResponse, statusCode int) {
+	response, statusCode = completeProxyResponse(r, response, statusCode)
+	writeProxyResponse(w, response, statusCode)
+}
+
+// completeProxyResponse fills the fields common to all the responses of a request, records the
+// outcome of its forward, if any, and pushes the response to the results server
+func completeProxyResponse(r *http.Request, response common.ProxyResponse, statusCode int) (common.ProxyResponse, int) {
+	hostname, _ := os.Hostname()
+	clientIP, clientPort, _ := net.SplitHostPort(r.RemoteAddr)
+	_, ipVersion := common.GetServerIPAndVersion(r)
+
+	response.ProxyHostName = hostname
+	response.ClientIP = clientIP
+	response.ClientPort = clientPort
+	response.IPVersion = ipVersion
+	response.ServerType = "proxy"
+	response.EnvList = common.GetEnvironmentVariables(envPrefix)
+	response.Identity = identity.Get()
+	response.HostNetwork = hostNetwork
+	response.Hops = requestHops(r) + 1
+	response.RequestID = common.RequestID(r)
+	if payload, ok := r.Context().Value(echoPayloadKey{}).(*echoPayload); ok && payload.sent != payload.data {
+		response.SentEchoData = payload.sent
+	}
+	if state, ok := r.Context().Value(transformStateKey{}).(*transformState); ok {
+		statusCode = state.transformResponse(&response, statusCode)
+	}
+	response.HostsUsed = hostsOverrideFrom(r).used()
+	response.Caller = proxyCallerFrom(r.Context())
+	if reportResources {
+		response.Resources = common.ReadCgroupResources()
+	}
+	start, forwarded := r.Context().Value(forwardStartKey{}).(time.Time)
+	if !response.Success && response.ErrorCode == "" {
+		response.ErrorCode = "INVALID_REQUEST"
+		if forwarded {
+			response.ErrorCode = proxyErrorCode(response, statusCode)
+		}
+	}
+	if forwarded {
+		backendTracker.Observe(response.ForwardType, backendName(response), time.Since(start), response.ErrorCode, response.ErrorMessage)
+	}
+
+	if r.Context().Err() != nil {
+		log.Printf("Client %s disconnected, the response is not delivered", r.RemoteAddr)
+	}
+	resultsPusher.Push(response)
+	return response, statusCode
+}
+
+// writeProxyResponse marshals the response data to JSON and writes it to the response writer
+func writeProxyResponse(w http.ResponseWriter, response common.ProxyResponse, statusCode int) {
+	// 使用传入的 statusCode 设置 HTTP 状态码
+	w.WriteHeader(statusCode)
+
+	responseJSON, err := json.Marshal(response)
+	if err != nil {
+		http.Error(w, "Unable to marshal response data", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(responseJSON)
+
+	log.Printf("Sent response: %s", responseJSON)
+}
+
+// forwardedBytes returns the EchoData bytes a forward sends to its backend and the number of sends:
+// one for http, one per attempt for udp and none for the other forward types. An EchoData template
+// counts as its largest expansion.
+func forwardedBytes(req common.ProxyClientRequest) (int64, int) {
+	size := int64(len(req.EchoData))
+	if req.EchoDataTemplate {
+		if tmpl, err := common.ParsePayloadTemplate(req.EchoData); err == nil {
+			size = tmpl.MaxSize()
+		}
+	}
+	switch req.ForwardType {
+	case "http":
+		return size, 1
+	case "udp":
+		return size * int64(1+req.UDPRetries), 1 + req.UDPRetries
+	}
+	return 0, 0
+}
+
+// checkForwardBytes checks the expanded EchoData of a forward against -max-echo-data, and the bytes
+// sent by the bundle or scenario run of the forward, if any, against -max-bundle-bytes
+func checkForwardBytes(ctx context.Context, req common.ProxyClientRequest) *common.AmplificationLimit {
+	if size := int64(len(req.EchoData)); maxEchoData > 0 && size > maxEchoData {
+		return &common.AmplificationLimit{Limit: "max-echo-data", MaxBytes: maxEchoData, Bytes: size}
+	}
+	sent, ok := ctx.Value(byteBudgetKey{}).(*atomic.Int64)
+	if !ok || maxBundleBytes <= 0 {
+		return nil
+	}
+	bytes, _ := forwardedBytes(req)
+	if total := sent.Add(bytes); total > maxBundleBytes {
+		// The rejected forward sends nothing, so the smaller ones may still fit
+		sent.Add(-bytes)
+		return &common.AmplificationLimit{Limit: "max-bundle-bytes", MaxBytes: maxBundleBytes, Bytes: total}
+	}
+	return nil
+}
+
+// checkFanout checks the EchoData of all the forwards of a bundle or scenario against -max-fanout-bytes.
+// The payload is a float64 since nested loops may multiply it beyond an int64.
+func checkFanout(payload float64, forwards int) *common.AmplificationLimit {
+	if maxFanoutBytes <= 0 || payload <= float64(maxFanoutBytes) {
+		return nil
+	}
+	return &common.AmplificationLimit{Limit: "max-fanout-bytes", MaxBytes: maxFanoutBytes, Bytes: int64(min(payload, math.MaxInt64)), Forwards: forwards}
+}
+
+// amplificationMessage returns the error message of a request over a payload ceiling
+func amplificationMessage(limit *common.AmplificationLimit) string {
+	switch limit.Limit {
+	case "max-echo-data":
+		return fmt.Sprintf("EchoData is %d bytes once expanded, over the limit of %d bytes (-max-echo-data).", limit.Bytes, limit.MaxBytes)
+	case "max-fanout-bytes":
+		return fmt.Sprintf("The %d sends of EchoData would send %d bytes, over the limit of %d bytes (-max-fanout-bytes). Reduce the payload, the probes, the Repeat of the loops or the UDPRetries.", limit.Forwards, limit.Bytes, limit.MaxBytes)
+	}
+	return fmt.Sprintf("The forwards of the bundle or scenario would send %d bytes of EchoData with this one, over the limit of %d bytes (-max-bundle-bytes).", limit.Bytes, limit.MaxBytes)
+}
+
+// requestHops returns the number of proxies the request went through before this one, from the
+// X-Proxy-Hops header set by the previous proxy
+func requestHops(r *http.Request) int {
+	hops, err := strconv.Atoi(r.Header.Get(proxyHopsHeader))
+	if err != nil || hops < 0 {
+		return 0
+	}
+	return hops
+}
+
+// proxyErrorCode classifies the error of a failed forwarding, so failures can be counted by cause
+func proxyErrorCode(response common.ProxyResponse, statusCode int) string {
+	message := strings.ToLower(response.ErrorMessage)
+	// The error of the last UDP attempt tells why the read failed
+	if response.UDPSource != nil && len(response.UDPSource.Attempts) > 0 {
+		message += " " + strings.ToLower(response.UDPSource.Attempts[len(response.UDPSource.Attempts)-1].ErrorMessage)
+	}
+	switch {
+	case response.CancelReason == "client disconnected":
+		return "CLIENT_DISCONNECTED"
+	case response.Cancelled, strings.Contains(message, "timeout"), strings.Contains(message, "deadline exceeded"):
+		return "TIMEOUT"
+	case strings.Contains(message, "connection refused"):
+		return "CONNECTION_REFUSED"
+	case strings.Contains(message, "connection reset"), strings.Contains(message, "broken pipe"), strings.Contains(message, "eof"):
+		return "CONNECTION_RESET"
+	case strings.Contains(message, "no route to host"), strings.Contains(message, "unreachable"):
+		return "UNREACHABLE"
+	case strings.Contains(message, "resolve"), strings.Contains(message, "no such host"), strings.Contains(message, "server misbehaving"):
+		return "DNS_ERROR"
+	case strings.Contains(message, "tls"), strings.Contains(message, "x509"), strings.Contains(message, "certificate"):
+		return "TLS_ERROR"
+	case strings.HasPrefix(message, "dns query failed"), strings.HasPrefix(message, "invalid dns response"):
+		return "DNS_QUERY_FAILED"
+	case statusCode == http.StatusBadRequest && strings.HasPrefix(message, "invalid"):
+		return "INVALID_REQUEST"
+	}
+	return "BACKEND_ERROR"
+}
+
+// backendName returns the backend of a response for the backend stats: the BackendUrl, without
+// the path and query for http
+func backendName(response common.ProxyResponse) string {
+	if response.ForwardType == "http" {
+		if u, err := url.Parse(response.BackendUrl); err == nil && u.Host != "" {
+			return u.Scheme + "://" + u.Host
+		}
+	}
+	return response.BackendUrl
+}
+
+// handleAdminBackends serves the latency and success stats of each backend over the rolling
+// window. The query parameters "slo-latency" (a duration) and "slo-success" override the SLO of
+// the flags, and "reset=true" resets the stats after reporting them.
+func handleAdminBackends(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	slo := defaultSLO
+	if value := query.Get("slo-latency"); value != "" {
+		latency, err := time.ParseDuration(value)
+		if err != nil || latency < 0 {
+			http.Error(w, fmt.Sprintf("invalid slo-latency %q", value), http.StatusBadRequest)
+			return
+		}
+		slo.LatencyMs = float64(latency) / float64(time.Millisecond)
+	}
+	if value := query.Get("slo-success"); value != "" {
+		success, err := strconv.ParseFloat(value, 64)
+		if err != nil || success < 0 || success > 1 {
+			http.Error(w, fmt.Sprintf("invalid slo-success %q, it must be between 0 and 1", value), http.StatusBadRequest)
+			return
+		}
+		slo.SuccessTarget = success
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(backendTracker.Report(slo, query.Get("reset") == "true"))
+}
+
+// proxyCallerKey is the request context key of the authenticated caller of a request
+type proxyCallerKey struct{}
+
+// proxyAuth holds the bearer tokens and the client certificate requirement protecting the proxy
+// API. An open forwarding proxy is an SSRF risk, so every endpoint but /healthy requires the
+// configured credentials. Without tokens nor -client-ca, the API stays open.
+type proxyAuth struct {
+	tokens   map[string]string // The caller name of each bearer token
+	clientCA bool              // Whether a client certificate verified against -client-ca is required
+}
+
+// newProxyAuth loads the bearer token of -auth-token, named "default", and the "<name> <token>"
+// lines of -auth-tokens-file
+func newProxyAuth(token, tokensFile string, clientCA bool) (*proxyAuth, error) {
+	auth := &proxyAuth{tokens: make(map[string]string), clientCA: clientCA}
+	if token != "" {
+		auth.tokens[token] = "default"
+	}
+	if tokensFile == "" {
+		return auth, nil
+	}
+
+	data, err := os.ReadFile(tokensFile)
+	if err != nil {
+		return nil, err
+	}
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d of %s: expected <name> <token>", i+1, tokensFile)
+		}
+		if _, ok := auth.tokens[fields[1]]; ok {
+			return nil, fmt.Errorf("line %d of %s: duplicate token", i+1, tokensFile)
+		}
+		auth.tokens[fields[1]] = fields[0]
+	}
+	return auth, nil
+}
+
+// guard rejects the unauthenticated requests with 401, logs an audit line for each request and
+// passes the caller to the handlers in the request context
+func (a *proxyAuth) guard(next http.Handler) http.Handler {
+	if len(a.tokens) == 0 && !a.clientCA {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The kubelet probes carry no credentials
+		if r.URL.Path == "/healthy" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		caller, err := a.authenticate(r)
+		if err != nil {
+			log.Printf("Audit: rejected %s %s from %s: %v", r.Method, r.URL.Path, r.RemoteAddr, err)
+			if len(a.tokens) > 0 {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="proxy"`)
+			}
+			sendProxyResponse(w, r, common.ProxyResponse{
+				Success:      false,
+				ErrorMessage: fmt.Sprintf("Unauthenticated: %v", err),
+				ErrorCode:    "UNAUTHENTICATED",
+				FrontUrl:     constructFullURL(r),
+			}, http.StatusUnauthorized)
+			return
+		}
+
+		log.Printf("Audit: %s %s from %s by %s", r.Method, r.URL.Path, r.RemoteAddr, formatCaller(caller))
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), proxyCallerKey{}, caller)))
+	})
+}
+
+// authenticate checks the client certificate and the bearer token of a request, as configured
+func (a *proxyAuth) authenticate(r *http.Request) (*common.ProxyCaller, error) {
+	caller := &common.ProxyCaller{}
+	var methods []string
+
+	if a.clientCA {
+		// The TLS listener verified the certificate if one was presented
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+			return nil, errors.New("no client certificate")
+		}
+		cert := r.TLS.VerifiedChains[0][0]
+		caller.Subject = cert.Subject.String()
+		for _, uri := range cert.URIs {
+			caller.URIs = append(caller.URIs, uri.String())
+		}
+		methods = append(methods, "mtls")
+	}
+
+	if len(a.tokens) > 0 {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || token == "" {
+			return nil, errors.New("no bearer token")
+		}
+		// Compare with every token in constant time, so the timing does not leak a valid prefix
+		for known, name := range a.tokens {
+			if subtle.ConstantTimeCompare([]byte(token), []byte(known)) == 1 {
+				caller.Token = name
+			}
+		}
+		if caller.Token == "" {
+			return nil, errors.New("invalid bearer token")
+		}
+		methods = append(methods, "token")
+	}
+
+	caller.Method = strings.Join(methods, "+")
+	return caller, nil
+}
+
+// formatCaller describes a caller for the audit logs
+func formatCaller(caller *common.ProxyCaller) string {
+	var parts []string
+	if caller.Token != "" {
+		parts = append(parts, "token "+caller.Token)
+	}
+	if caller.Subject != "" {
+		parts = append(parts, "certificate "+caller.Subject)
+	}
+	parts = append(parts, caller.URIs...)
+	return strings.Join(parts, ", ")
+}
+
+// proxyCallerFrom returns the authenticated caller of a request, nil when the API is open
+func proxyCallerFrom(ctx context.Context) *common.ProxyCaller {
+	caller, _ := ctx.Value(proxyCallerKey{}).(*common.ProxyCaller)
+	return caller
+}
+
+// hostsOverrideKey is the request context key of the hostsOverride of a request
+type hostsOverrideKey struct{}
+
+// hostsOverride maps the hostnames of a request to static IPs like /etc/hosts, and records the
+// entries used. A nil hostsOverride maps nothing.
+type hostsOverride struct {
+	mutex   sync.Mutex
+	hosts   map[string]net.IP
+	useList []string
+}
+
+// newHostsOverride creates the hostsOverride of validated Hosts entries
+func newHostsOverride(hosts map[string]string) *hostsOverride {
+	override := &hostsOverride{hosts: make(map[string]net.IP)}
+	for host, ip := range hosts {
+		override.hosts[strings.ToLower(strings.TrimSuffix(host, "."))] = net.ParseIP(ip)
+	}
+	return override
+}
+
+// hostsOverrideFrom returns the hostsOverride of a request, nil if it has no Hosts
+func hostsOverrideFrom(r *http.Request) *hostsOverride {
+	override, _ := r.Context().Value(hostsOverrideKey{}).(*hostsOverride)
+	return override
+}
+
+// lookup returns the IP of a host from Hosts, or nil if Hosts has no entry for it
+func (h *hostsOverride) lookup(host string) net.IP {
+	if h == nil {
+		return nil
+	}
+	ip, ok := h.hosts[strings.ToLower(strings.TrimSuffix(host, "."))]
+	if !ok {
+		return nil
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	entry := host + "=" + ip.String()
+	for _, used := range h.useList {
+		if used == entry {
+			return ip
+		}
+	}
+	h.useList = append(h.useList, entry)
+	return ip
+}
+
+// address replaces the host of a host:port address with its IP from Hosts, if it has an entry
+func (h *hostsOverride) address(address string) string {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return address
+	}
+	if ip := h.lookup(host); ip != nil {
+		return net.JoinHostPort(ip.String(), port)
+	}
+	return address
+}
+
+// used returns the entries of Hosts used so far, as <host>=<IP>
+func (h *hostsOverride) used() []string {
+	if h == nil {
+		return nil
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return append([]string(nil), h.useList...)
+}
+
+// validateHosts checks the Hosts entries of a request: each name must map to an IP, and only the
+// forward types that connect to a backend name support them
+func validateHosts(clientReq common.ProxyClientRequest) error {
+	if len(clientReq.Hosts) == 0 {
+		return nil
+	}
+	switch clientReq.ForwardType {
+	case "http", "udp", "connect":
+	default:
+		return fmt.Errorf("Hosts is only supported for the http, udp and connect forward types")
+	}
+	for host, ip := range clientReq.Hosts {
+		if host == "" {
+			return fmt.Errorf("empty hostname")
+		}
+		if net.ParseIP(ip) == nil {
+			return fmt.Errorf("%q is not an IP address for %q", ip, host)
+		}
+	}
+	return nil
+}
+
+// maxTransformBytes bounds the size of a payload after each transformation, e.g. once decompressed by gunzip
+const maxTransformBytes = 16 << 20
+
+// maxTransforms limits the number of RequestTransforms, and of ResponseTransforms, of a request
+const maxTransforms = 8
+
+// transformStateKey is the request context key of the transformState of a request
+type transformStateKey struct{}
+
+// transformState holds the transformations of a request until its response is sent
+type transformState struct {
+	result  *common.TransformResult
+	counter int // The request counter, reported in the hop metadata
+}
+
+// proxyHop is the hop metadata added to JSON payloads by the inject-hop transformation
+type proxyHop struct {
+	ProxyHostName  string `json:"ProxyHostName"`  // The hostname of the proxy
+	PodName        string `json:"PodName"`        // The pod of the proxy, if known
+	NodeName       string `json:"NodeName"`       // The node of the proxy, if known
+	Direction      string `json:"Direction"`      // request or response
+	RequestCounter int    `json:"RequestCounter"` // The request counter of the proxy
+	Timestamp      string `json:"Timestamp"`      // When the payload was transformed
+}
+
+// hop returns the hop metadata of the proxy for the given direction
+func (t *transformState) hop(direction string) proxyHop {
+	proxyIdentity := identity.Get()
+	return proxyHop{
+		ProxyHostName:  proxyIdentity.HostName,
+		PodName:        proxyIdentity.PodName,
+		NodeName:       proxyIdentity.NodeName,
+		Direction:      direction,
+		RequestCounter: t.counter,
+		Timestamp:      time.Now().Format(time.RFC3339Nano),
+	}
+}
+
+// transformResponse applies the ResponseTransforms to the backend response of a successful forward
+// and reports the transformations. Payloads that are not valid UTF-8 are base64 encoded, since
+// JSON strings would not carry them intact. It returns the status code to send.
+func (t *transformState) transformResponse(response *common.ProxyResponse, statusCode int) int {
+	response.Transforms = t.result
+	if len(t.result.RequestTransforms) > 0 && !utf8.ValidString(response.SentEchoData) {
+		response.SentEchoData = base64.StdEncoding.EncodeToString([]byte(response.SentEchoData))
+		t.result.SentBase64 = true
+	}
+	if !response.Success {
+		return statusCode
+	}
+
+	backendData := []byte(response.BackendResponse)
+	t.result.BackendBytes, t.result.BackendSHA256 = len(backendData), sha256Hex(backendData)
+	returned, err := applyTransforms(backendData, t.result.ResponseTransforms, t.hop("response"), maxTransformBytes)
+	if err != nil {
+		response.Success = false
+		response.ErrorMessage = fmt.Sprintf("Unable to apply ResponseTransforms: %v", err)
+		return http.StatusBadGateway
+	}
+	t.result.ReturnedBytes, t.result.ReturnedSHA256 = len(returned), sha256Hex(returned)
+	response.BackendResponse = string(returned)
+	if !utf8.Valid(returned) {
+		response.BackendResponse = base64.StdEncoding.EncodeToString(returned)
+		t.result.ResponseBase64 = true
+	}
+	return statusCode
+}
+
+// validateTransforms checks the transformations of a request before anything is sent
+func validateTransforms(clientReq common.ProxyClientRequest) error {
+	transforms := append(append([]string{}, clientReq.RequestTransforms...), clientReq.ResponseTransforms...)
+	if len(transforms) == 0 {
+		return nil
+	}
+	if clientReq.ForwardType != "http" && clientReq.ForwardType != "udp" {
+		return fmt.Errorf("transforms are only supported for the http and udp forward types")
+	}
+	if len(clientReq.RequestTransforms) > maxTransforms || len(clientReq.ResponseTransforms) > maxTransforms {
+		return fmt.Errorf("at most %d RequestTransforms and %d ResponseTransforms are supported", maxTransforms, maxTransforms)
+	}
+	for _, transform := range transforms {
+		name, field, _ := strings.Cut(transform, ":")
+		switch name {
+		case "base64", "base64-decode", "gzip", "gunzip":
+			if field != "" {
+				return fmt.Errorf("%q takes no argument", name)
+			}
+		case "inject-hop":
+		default:
+			return fmt.Errorf("unsupported transform %q, supported values are 'base64', 'base64-decode', 'gzip', 'gunzip' and 'inject-hop[:<field>]'", transform)
+		}
+	}
+	return nil
+}
+
+// applyTransforms applies the transformations to data in order. The payload may not grow over
+// maxBytes after any of them, so a chain of them cannot inflate it.
+func applyTransforms(data []byte, transforms []string, hop proxyHop, maxBytes int64) ([]byte, error) {
+	for _, transform := range transforms {
+		name, field, _ := strings.Cut(transform, ":")
+		var err error
+		switch name {
+		case "base64":
+			data = []byte(base64.StdEncoding.EncodeToString(data))
+		case "base64-decode":
+			data, err = base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+		case "gzip":
+			var buffer bytes.Buffer
+			writer := gzip.NewWriter(&buffer)
+			writer.Write(data)
+			err = writer.Close()
+			data = buffer.Bytes()
+		case "gunzip":
+			var reader *gzip.Reader
+			if reader, err = gzip.NewReader(bytes.NewReader(data)); err == nil {
+				data, err = ioutil.ReadAll(io.LimitReader(reader, maxBytes+1))
+			}
+		case "inject-hop":
+			if field == "" {
+				field = "ProxyHops"
+			}
+			data, err = injectHop(data, field, hop)
+		}
+		if err == nil && int64(len(data)) > maxBytes {
+			err = fmt.Errorf("the payload is over %d bytes", maxBytes)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", transform, err)
+		}
+	}
+	return data, nil
+}
+
+// requestTransformBytes returns the size the EchoData may reach after each RequestTransforms:
+// -max-echo-data, within maxTransformBytes
+func requestTransformBytes() int64 {
+	if maxEchoData > 0 && maxEchoData < maxTransformBytes {
+		return maxEchoData
+	}
+	return maxTransformBytes
+}
+
+// injectHop appends the hop metadata to the array field of a JSON object, creating the field if needed
+func injectHop(data []byte, field string, hop proxyHop) ([]byte, error) {
+	var object map[string]json.RawMessage
+	if err := json.Unmarshal(data, &object); err != nil || object == nil {
+		return nil, fmt.Errorf("the payload is not a JSON object")
+	}
+	var hops []json.RawMessage
+	if existing, ok := object[field]; ok {
+		if err := json.Unmarshal(existing, &hops); err != nil {
+			return nil, fmt.Errorf("the field %s is not an array", field)
+		}
+	}
+	encoded, err := json.Marshal(hop)
+	if err != nil {
+		return nil, err
+	}
+	object[field], err = json.Marshal(append(hops, encoded))
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(object)
+}
+
+// sha256Hex returns the hex encoded SHA-256 of data
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Limits of the scenarios run by the /scenario endpoint
+const (
+	maxScenarioActions = 1000 // The forwards and waits of a run
+	maxScenarioRepeat  = 1000 // The iterations of a step
+	maxScenarioDepth   = 5    // The nesting of blocks
+	maxScenarioTimeout = 3600 // The global deadline in seconds
+	maxScenarioRuns    = 100  // The asynchronous runs kept for polling
+)
+
+// scenarioRuns holds the asynchronous scenario runs by ID, the oldest ones are dropped beyond maxScenarioRuns
+var scenarioRuns = make(map[string]*scenarioRun)
+var scenarioRunIDs []string
+var scenarioMutex sync.Mutex
+
+// scenarioRun is the state of one run of a scenario
+type scenarioRun struct {
+	mutex    sync.Mutex
+	response common.ScenarioResponse
+	start    time.Time
+	last     map[string]common.ScenarioStepResult // The last result of each step by name
+	prev     common.ScenarioStepResult            // The result of the previous forward
+	stopped  bool                                 // Set when a step with OnFailure "stop" failed or an error occurred
+
+	r       *http.Request
+	forward forwardFunc
+}
+
+// scenarioData is the data available to the conditions and BackendUrl templates of a scenario
+type scenarioData struct {
+	Prev      common.ScenarioStepResult
+	Steps     map[string]common.ScenarioStepResult
+	Iteration int
+}
+
+// handleScenario runs a scenario posted to /scenario, or reports an asynchronous run with GET /scenario?id=<ID>
+func handleScenario(w http.ResponseWriter, r *http.Request, forward forwardFunc) {
+	if r.Method == http.MethodGet {
+		scenarioMutex.Lock()
+		run, ok := scenarioRuns[r.URL.Query().Get("id")]
+		scenarioMutex.Unlock()
+		if !ok {
+			sendScenarioResponse(w, common.ScenarioResponse{ErrorMessage: "Unknown scenario run ID."}, http.StatusNotFound)
+			return
+		}
+		sendScenarioResponse(w, run.snapshot(), http.StatusOK)
+		return
+	}
+	if r.Method != http.MethodPost {
+		sendScenarioResponse(w, common.ScenarioResponse{ErrorMessage: "Unsupported method. Use POST to run a scenario or GET to poll one."}, http.StatusMethodNotAllowed)
+		return
+	}
+
+	var scenarioReq common.ScenarioRequest
+	if err := json.NewDecoder(r.Body).Decode(&scenarioReq); err != nil || len(scenarioReq.Steps) == 0 {
+		sendScenarioResponse(w, common.ScenarioResponse{
+			ErrorMessage: "Invalid request format. Steps must contain at least one step.",
+		}, http.StatusBadRequest)
+		return
+	}
+	if err := validateScenarioSteps(scenarioReq.Steps, 1); err != nil {
+		sendScenarioResponse(w, common.ScenarioResponse{
+			Name:         scenarioReq.Name,
+			ErrorMessage: fmt.Sprintf("Invalid scenario: %v", err),
+		}, http.StatusBadRequest)
+		return
+	}
+	if limit := checkFanout(scenarioFanout(scenarioReq.Steps)); limit != nil {
+		sendScenarioResponse(w, common.ScenarioResponse{
+			Name:               scenarioReq.Name,
+			ErrorMessage:       amplificationMessage(limit),
+			AmplificationLimit: limit,
+		}, http.StatusRequestEntityTooLarge)
+		return
+	}
+	if scenarioReq.Timeout < 0 || scenarioReq.Timeout > maxScenarioTimeout {
+		sendScenarioResponse(w, common.ScenarioResponse{
+			Name:         scenarioReq.Name,
+			ErrorMessage: fmt.Sprintf("Invalid Timeout. It must be between 0 and %d seconds.", maxScenarioTimeout),
+		}, http.StatusBadRequest)
+		return
+	}
+	timeout := time.Duration(scenarioReq.Timeout) * time.Second
+	if timeout == 0 {
+		timeout = 60 * time.Second
+	}
+
+	mutex.Lock()
+	requestCount++
+	id := fmt.Sprintf("%d-%d", time.Now().Unix(), requestCount)
+	mutex.Unlock()
+
+	// Keep only what the forwards need of the request, which an asynchronous run outlives
+	header := http.Header{proxyHopsHeader: r.Header.Values(proxyHopsHeader)}
+	if id := common.RequestID(r); id != "" {
+		header.Set(common.RequestIDHeader, id)
+	}
+	run := &scenarioRun{
+		response: common.ScenarioResponse{ID: id, Name: scenarioReq.Name, Running: true, Steps: []common.ScenarioStepResult{}},
+		start:    time.Now(),
+		last:     make(map[string]common.ScenarioStepResult),
+		r:        &http.Request{RemoteAddr: r.RemoteAddr, Host: r.Host, TLS: r.TLS, Header: header},
+		forward:  forward,
+	}
+
+	if !scenarioReq.Async {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		ctx = context.WithValue(ctx, byteBudgetKey{}, new(atomic.Int64))
+		run.execute(ctx, scenarioReq.Steps)
+		sendScenarioResponse(w, run.snapshot(), http.StatusOK)
+		return
+	}
+
+	// An asynchronous run outlives the request, so it only keeps its deadline
+	scenarioMutex.Lock()
+	scenarioRuns[id] = run
+	scenarioRunIDs = append(scenarioRunIDs, id)
+	if len(scenarioRunIDs) > maxScenarioRuns {
+		delete(scenarioRuns, scenarioRunIDs[0])
+		scenarioRunIDs = scenarioRunIDs[1:]
+	}
+	scenarioMutex.Unlock()
+
+	go func() {
+		// Keep the caller, so the responses of the forwards still tell who started the run
+		ctx := context.WithValue(context.Background(), proxyCallerKey{}, proxyCallerFrom(r.Context()))
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		ctx = context.WithValue(ctx, byteBudgetKey{}, new(atomic.Int64))
+		run.execute(ctx, scenarioReq.Steps)
+		log.Printf("Scenario %s (%s) finished", id, scenarioReq.Name)
+	}()
+	sendScenarioResponse(w, run.snapshot(), http.StatusAccepted)
+}
+
+// scenarioFanout returns the EchoData bytes the forwards of scenario steps send at most, and the
+// number of sends, counting all the Repeat iterations of the loops
+func scenarioFanout(steps []common.ScenarioStep) (float64, int) {
+	var payload float64
+	forwards := 0
+	for _, step := range steps {
+		repeat := max(step.Repeat, 1)
+		var bytes int64
+		var sends int
+		if step.Forward != nil {
+			bytes, sends = forwardedBytes(*step.Forward)
+		}
+		nestedPayload, nestedForwards := scenarioFanout(step.Steps)
+		payload += float64(repeat) * (float64(bytes) + nestedPayload)
+		forwards += repeat * (sends + nestedForwards)
+	}
+	return payload, forwards
+}
+
+// validateScenarioSteps checks the steps of a scenario before running it
+func validateScenarioSteps(steps []common.ScenarioStep, depth int) error {
+	if depth > maxScenarioDepth {
+		return fmt.Errorf("blocks are nested more than %d levels deep", maxScenarioDepth)
+	}
+	for i, step := range steps {
+		name := step.Name
+		if name == "" {
+			name = fmt.Sprintf("step%d", i+1)
+		}
+		if step.Forward == nil && step.Wait == "" && len(step.Steps) == 0 {
+			return fmt.Errorf("%s: a step needs a Forward, a Wait or nested Steps", name)
+		}
+		if step.Forward != nil && len(step.Steps) > 0 {
+			return fmt.Errorf("%s: a step cannot both forward and run nested Steps", name)
+		}
+		if step.Repeat < 0 || step.Repeat > maxScenarioRepeat {
+			return fmt.Errorf("%s: Repeat must be between 0 and %d", name, maxScenarioRepeat)
+		}
+		if step.OnFailure != "" && step.OnFailure != "continue" && step.OnFailure != "stop" {
+			return fmt.Errorf("%s: OnFailure must be 'continue' or 'stop'", name)
+		}
+		for _, duration := range []string{step.Wait, step.Interval} {
+			if _, err := parseScenarioDuration(duration, 0); err != nil {
+				return fmt.Errorf("%s: invalid duration %q", name, duration)
+			}
+		}
+		for _, condition := range []string{step.If, step.Until} {
+			if _, err := template.New("condition").Funcs(common.TemplateFuncs(0)).Parse(condition); err != nil {
+				return fmt.Errorf("%s: invalid condition: %v", name, err)
+			}
+		}
+		if err := validateScenarioSteps(step.Steps, depth+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// execute runs the steps of the scenario and completes its response
+func (run *scenarioRun) execute(ctx context.Context, steps []common.ScenarioStep) {
+	run.runSteps(ctx, steps, "")
+
+	run.mutex.Lock()
+	defer run.mutex.Unlock()
+
+	response := &run.response
+	response.Running = false
+	response.DeadlineExceeded = ctx.Err() == context.DeadlineExceeded
+	response.Success = !run.stopped && ctx.Err() == nil
+	for _, result := range run.last {
+		if !result.Success {
+			response.Success = false
+		}
+	}
+	if response.ErrorMessage == "" && !response.Success {
+		switch {
+		case response.DeadlineExceeded:
+			response.ErrorMessage = "The deadline of the scenario passed"
+		case ctx.Err() != nil:
+			response.ErrorMessage = "The client disconnected"
+		default:
+			response.ErrorMessage = fmt.Sprintf("%d forwards failed", response.Failed)
+		}
+	}
+}
+
+// runSteps runs a list of steps, returning false once the scenario must stop
+func (run *scenarioRun) runSteps(ctx context.Context, steps []common.ScenarioStep, prefix string) bool {
+	for i, step := range steps {
+		name := step.Name
+		if name == "" {
+			name = fmt.Sprintf("step%d", i+1)
+		}
+		name = prefix + name
+
+		if step.If != "" {
+			ok, err := run.condition(step.If, 1)
+			if err != nil {
+				run.fail(name, 1, fmt.Sprintf("invalid If condition: %v", err))
+				return false
+			}
+			if !ok {
+				run.record(common.ScenarioStepResult{Iteration: 1, Action: "skip", Success: true, BundleProbeResult: common.BundleProbeResult{Name: name}}, false)
+				continue
+			}
+		}
+
+		repeat := step.Repeat
+		if repeat == 0 {
+			repeat = 1
+		}
+		wait, _ := parseScenarioDuration(step.Wait, 0)
+		interval, _ := parseScenarioDuration(step.Interval, 0)
+		var last common.ScenarioStepResult
+		for iteration := 1; iteration <= repeat; iteration++ {
+			if iteration > 1 && !run.sleep(ctx, interval) {
+				return false
+			}
+			if wait > 0 {
+				if !run.reserve(name, iteration) {
+					return false
+				}
+				start := time.Since(run.start)
+				if !run.sleep(ctx, wait) {
+					return false
+				}
+				run.record(common.ScenarioStepResult{
+					Iteration:         iteration,
+					Action:            "wait",
+					Success:           true,
+					StartMs:           float64(start.Microseconds()) / 1000,
+					BundleProbeResult: common.BundleProbeResult{Name: name, DurationMs: float64(wait.Microseconds()) / 1000},
+				}, false)
+			}
+
+			if step.Forward != nil {
+				if !run.reserve(name, iteration) {
+					return false
+				}
+				forward := *step.Forward
+				if strings.Contains(forward.BackendUrl, "{{") {
+					backendURL, err := run.render(forward.BackendUrl, iteration)
+					if err != nil {
+						run.fail(name, iteration, fmt.Sprintf("invalid BackendUrl template: %v", err))
+						return false
+					}
+					forward.BackendUrl = backendURL
+				}
+				start := time.Since(run.start)
+				last = common.ScenarioStepResult{
+					Iteration:         iteration,
+					Action:            "forward",
+					StartMs:           float64(start.Microseconds()) / 1000,
+					BundleProbeResult: runBundleProbe(ctx, run.r, run.forward, common.BundleProbe{Name: name, ProxyClientRequest: forward}),
+				}
+				last.Success = last.Response != nil && last.Response.Success
+				run.record(last, true)
+
+				// The next forwards would exceed the ceiling as well
+				if last.Response != nil && last.Response.AmplificationLimit != nil {
+					run.mutex.Lock()
+					run.stopped = true
+					run.response.ErrorMessage = fmt.Sprintf("Stopped at %s: %s", name, last.Response.ErrorMessage)
+					run.response.AmplificationLimit = last.Response.AmplificationLimit
+					run.mutex.Unlock()
+					return false
+				}
+			}
+
+			if len(step.Steps) > 0 {
+				blockPrefix := name + "/"
+				if repeat > 1 {
+					blockPrefix = fmt.Sprintf("%s#%d/", name, iteration)
+				}
+				if !run.runSteps(ctx, step.Steps, blockPrefix) {
+					return false
+				}
+			}
+			if ctx.Err() != nil {
+				return false
+			}
+
+			if step.Until != "" {
+				ok, err := run.condition(step.Until, iteration)
+				if err != nil {
+					run.fail(name, iteration, fmt.Sprintf("invalid Until condition: %v", err))
+					return false
+				}
+				if ok {
+					break
+				}
+			}
+		}
+
+		if step.Forward != nil && !last.Success && step.OnFailure == "stop" {
+			run.mutex.Lock()
+			run.stopped = true
+			run.response.ErrorMessage = fmt.Sprintf("Stopped after the failure of %s: %s", name, stepError(last))
+			run.mutex.Unlock()
+			return false
+		}
+	}
+	return true
+}
+
+// parseScenarioDuration parses an optional duration of a scenario step, e.g. 500ms
+func parseScenarioDuration(value string, defaultValue time.Duration) (time.Duration, error) {
+	if value == "" {
+		return defaultValue, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid duration %q", value)
+	}
+	return d, nil
+}
+
+// stepError returns why a forward failed
+func stepError(result common.ScenarioStepResult) string {
+	if result.ErrorMessage == "" && result.Response != nil {
+		return result.Response.ErrorMessage
+	}
+	return result.ErrorMessage
+}
+
+// reserve counts an action against maxScenarioActions, stopping the scenario beyond it
+func (run *scenarioRun) reserve(name string, iteration int) bool {
+	run.mutex.Lock()
+	exceeded := run.response.Executed >= maxScenarioActions
+	run.mutex.Unlock()
+	if exceeded {
+		run.fail(name, iteration, fmt.Sprintf("the scenario exceeded %d forwards and waits", maxScenarioActions))
+		return false
+	}
+	return true
+}
+
+// record adds the result of a step to the response. Forwards also become the previous result
+// and the last result of their step for the conditions.
+func (run *scenarioRun) record(result common.ScenarioStepResult, forward bool) {
+	run.mutex.Lock()
+	defer run.mutex.Unlock()
+
+	run.response.Steps = append(run.response.Steps, result)
+	run.response.DurationMs = float64(time.Since(run.start).Microseconds()) / 1000
+	if result.Action == "forward" || result.Action == "wait" {
+		run.response.Executed++
+	}
+	if !forward {
+		return
+	}
+	if result.Success {
+		run.response.Passed++
+	} else {
+		run.response.Failed++
+	}
+	run.prev = result
+	run.last[result.Name] = result
+}
+
+// fail records an error of a step and stops the scenario
+func (run *scenarioRun) fail(name string, iteration int, message string) {
+	run.record(common.ScenarioStepResult{
+		Iteration:         iteration,
+		Action:            "error",
+		StartMs:           float64(time.Since(run.start).Microseconds()) / 1000,
+		BundleProbeResult: common.BundleProbeResult{Name: name, ErrorMessage: message},
+	}, false)
+
+	run.mutex.Lock()
+	run.stopped = true
+	run.response.ErrorMessage = fmt.Sprintf("%s: %s", name, message)
+	run.mutex.Unlock()
+}
+
+// sleep waits for d, returning false if the scenario is cancelled meanwhile
+func (run *scenarioRun) sleep(ctx context.Context, d time.Duration) bool {
+	if d <= 0 {
+		return ctx.Err() == nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// render expands a template with the results of the scenario so far
+func (run *scenarioRun) render(text string, iteration int) (string, error) {
+	tmpl, err := template.New("scenario").Funcs(common.TemplateFuncs(0)).Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return "", err
+	}
+
+	run.mutex.Lock()
+	data := scenarioData{Prev: run.prev, Steps: make(map[string]common.ScenarioStepResult), Iteration: iteration}
+	for name, result := range run.last {
+		data.Steps[name] = result
+	}
+	run.mutex.Unlock()
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// condition evaluates a condition, which must render "true" or "false"
+func (run *scenarioRun) condition(text string, iteration int) (bool, error) {
+	value, err := run.render(text, iteration)
+	if err != nil {
+		return false, err
+	}
+	return strconv.ParseBool(strings.TrimSpace(value))
+}
+
+// snapshot returns a copy of the response of the run
+func (run *scenarioRun) snapshot() common.ScenarioResponse {
+	run.mutex.Lock()
+	defer run.mutex.Unlock()
+
+	response := run.response
+	response.Steps = append([]common.ScenarioStepResult{}, run.response.Steps...)
+	if response.Running {
+		response.DurationMs = float64(time.Since(run.start).Microseconds()) / 1000
+	}
+	return response
+}
+
+// sendScenarioResponse sends the response of the /scenario endpoint
+func sendScenarioResponse(w http.ResponseWriter, response common.ScenarioResponse, statusCode int) {
+	responseJSON, err := json.Marshal(response)
+	if err != nil {
+		http.Error(w, "Unable to marshal response data", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	w.Write(responseJSON)
+	log.Printf("Sent scenario response: %s", responseJSON)
 }
@@ -0,0 +1,780 @@
+/*
+This program implements a results collector, the sink of the JSON reports of the client and the
+proxy: it stores them in SQLite and serves a dashboard of the recent connectivity matrices, latency
+trends and failures.
+
+Main Features:
+1. Receives reports pushed on POST /api/reports?kind=<kind>&source=<source>, as one JSON document
+   or as JSON lines (one report per line), e.g. from `client -results-url=<url> <subcommand>` or
+   from `proxy_server -results-url=<url>`.
+2. Stores the reports in a SQLite database with the pure Go modernc.org/sqlite driver, so the
+   program keeps building without cgo, and the image needs no sqlite3 shell.
+3. Derives from each report whether it passed (Passed, Success, Consistent or no Violations, else the
+   exit code of the client) and its latency (P50Ms, LatencyMs or Timings.TotalMs), for the trends.
+4. Serves an HTML dashboard on / with the latest connectivity matrix of each source, the latency
+   trend of each kind and source of reports, and the recent failures, refreshed every 30 seconds.
+5. Serves the same data as JSON on /api/reports, /api/reports/<id>, /api/matrix and /api/trends.
+6. Deletes the reports older than -retention.
+
+Usage:
+go run results_server.go [-port=8095] [-db=results.db] [-retention=168h]
+
+Options:
+-h: Display help information
+-port: Specify the TCP port for the server to listen on (default is 8095)
+-db: The SQLite database file, created if missing (default is results.db)
+-retention: How long the reports are kept, 0 to keep them forever (default is 168h)
+-max-body: The maximum size of a push request, in bytes (default is 16MB)
+
+Endpoints:
+- POST /api/reports?kind=<kind>&source=<source>[&exit-code=<code>]: Stores the reports of the body.
+  The kind defaults to a guess from the fields of the report (matrix, sla, proxy, probe or report),
+  and the source to the client IP.
+- GET /api/reports?kind=&source=&failed=true&since=24h&limit=100&body=true: Lists the reports, latest first.
+- GET /api/reports/<id>: Returns a report with its body.
+- GET /api/matrix: Returns the latest matrix report of each source.
+- GET /api/trends?kind=&since=24h&bucket=1h: Returns the reports, failures and latencies per bucket.
+- GET /?since=24h&bucket=1h: The dashboard.
+
+Notes:
+- SQLite lets one connection write at a time, which is plenty for the reports of a test run but
+  not meant for thousands of reports per second.
+- The kind and source filters of the queries must match the names accepted by the push API.
+- Mount a volume on the directory of -db to keep the reports across restarts.
+- The push API has no authentication, expose it inside the cluster only.
+
+Testing with curl:
+- To collect the reports of the client and of a proxy, use:
+  go run results_server.go -port=8095 &
+  go run client.go -results-url=http://127.0.0.1:8095 matrix -inventory=inventory.csv
+  go run proxy_server.go -results-url=http://127.0.0.1:8095 &
+- To push a report by hand, then list the failures of the last hour, use:
+  curl -s -d '{"Passed":false,"P50Ms":12.5}' 'http://127.0.0.1:8095/api/reports?kind=sla&source=ci'
+  curl -s 'http://127.0.0.1:8095/api/reports?failed=true&since=1h'
+- To get the hourly latency trend of the sla reports, use:
+  curl -s 'http://127.0.0.1:8095/api/trends?kind=sla&bucket=1h&since=24h'
+*/
+
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"main/common"
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// StoredReport represents a report kept by the results server
+type StoredReport struct {
+	ID         int64             `json:"ID"`             // The ID of the report
+	ReceivedAt string            `json:"ReceivedAt"`     // When the report was received
+	Kind       string            `json:"Kind"`           // The kind of report, e.g. the subcommand of the client
+	Source     string            `json:"Source"`         // Who pushed the report, e.g. the pod of the client
+	Success    bool              `json:"Success"`        // Indicates if the report passed
+	LatencyMs  *float64          `json:"LatencyMs"`      // The latency of the report, if it has one
+	Summary    map[string]string `json:"Summary"`        // The scalar top-level fields of the report
+	Body       json.RawMessage   `json:"Body,omitempty"` // The report itself
+}
+
+// PushResponse represents the response to a push of reports
+type PushResponse struct {
+	Stored int     `json:"Stored"` // The number of reports stored
+	IDs    []int64 `json:"IDs"`    // The IDs of the stored reports
+}
+
+// TrendPoint represents the reports of a kind and source received in a bucket of time
+type TrendPoint struct {
+	Kind         string   `json:"Kind"`         // The kind of the reports
+	Source       string   `json:"Source"`       // The source of the reports
+	Start        string   `json:"Start"`        // The start of the bucket
+	Reports      int      `json:"Reports"`      // The number of reports in the bucket
+	Failures     int      `json:"Failures"`     // The number of failed reports in the bucket
+	AvgLatencyMs *float64 `json:"AvgLatencyMs"` // The average latency of the reports with one
+	MaxLatencyMs *float64 `json:"MaxLatencyMs"` // The highest latency of the reports with one
+}
+
+// MatrixView represents the latest connectivity matrix reported by a source
+type MatrixView struct {
+	Source     string      `json:"Source"`     // The source of the report
+	ReportID   int64       `json:"ReportID"`   // The ID of the report
+	ReceivedAt string      `json:"ReceivedAt"` // When the report was received
+	Total      int         `json:"Total"`      // The number of entries
+	Compliant  int         `json:"Compliant"`  // The number of entries matching their expectation
+	Violations int         `json:"Violations"` // The number of entries not matching their expectation
+	Results    []MatrixRow `json:"Results"`    // The entries
+}
+
+// MatrixRow represents an entry of a connectivity matrix
+type MatrixRow struct {
+	Name      string  `json:"Name"`      // The name of the entry
+	Protocol  string  `json:"Protocol"`  // The protocol of the probe
+	Target    string  `json:"Target"`    // The probed target
+	Proxy     string  `json:"Proxy"`     // The proxy of the probe, if any
+	Expected  bool    `json:"Expected"`  // The expected reachability
+	Reachable bool    `json:"Reachable"` // The observed reachability
+	Compliant bool    `json:"Compliant"` // Indicates if the observed reachability matches the expectation
+	LatencyMs float64 `json:"LatencyMs"` // The latency of the probe
+	Diff      string  `json:"Diff"`      // What differs from the expectation
+}
+
+// namePattern restricts the kinds and sources of the reports
+var namePattern = regexp.MustCompile(`^[A-Za-z0-9._:/@-]{1,128}$`)
+
+var db *sql.DB
+
+func main() {
+	// Define command-line flags
+	help := flag.Bool("h", false, "Display help information")
+	port := flag.String("port", "8095", "Specify the TCP port for the server to listen on")
+	dbPath := flag.String("db", "results.db", "The SQLite database file, created if missing")
+	retention := flag.Duration("retention", 7*24*time.Hour, "How long the reports are kept, 0 to keep them forever")
+	maxBody := flag.Int64("max-body", 16<<20, "The maximum size of a push request, in bytes")
+	flag.Parse()
+
+	// If the -h flag is set, display help information and exit
+	if *help {
+		flag.Usage()
+		return
+	}
+
+	var err error
+	if db, err = openSQLite(*dbPath); err != nil {
+		log.Fatalf("Unable to open the database: %v", err)
+	}
+	if *retention > 0 {
+		go expireReports(*retention)
+	}
+
+	http.HandleFunc("/api/reports", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			handlePush(w, r, *maxBody)
+			return
+		}
+		handleListReports(w, r)
+	})
+	http.HandleFunc("/api/reports/", handleGetReport)
+	http.HandleFunc("/api/matrix", func(w http.ResponseWriter, r *http.Request) {
+		matrices, err := latestMatrices()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		sendJSON(w, matrices)
+	})
+	http.HandleFunc("/api/trends", func(w http.ResponseWriter, r *http.Request) {
+		since, bucket, err := trendWindow(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		kind := r.URL.Query().Get("kind")
+		if kind != "" && !namePattern.MatchString(kind) {
+			http.Error(w, "Invalid kind, it must match "+namePattern.String(), http.StatusBadRequest)
+			return
+		}
+		points, err := trends(kind, since, bucket)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		sendJSON(w, points)
+	})
+	http.HandleFunc("/healthy", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	http.HandleFunc("/", handleDashboard)
+
+	fmt.Printf("Results server is listening on port %s, storing the reports in %s\n", *port, *dbPath)
+	if err := http.ListenAndServe(fmt.Sprintf(":%s", *port), nil); err != nil {
+		log.Fatalf("Results server failed to start: %v", err)
+	}
+}
+
+//--------------------------------- push API
+
+// handlePush stores the reports of the body, a JSON document or JSON lines
+func handlePush(w http.ResponseWriter, r *http.Request, maxBody int64) {
+	query := r.URL.Query()
+	kind := query.Get("kind")
+	source := query.Get("source")
+	if source == "" {
+		source, _, _ = net.SplitHostPort(r.RemoteAddr)
+	}
+	if (kind != "" && !namePattern.MatchString(kind)) || !namePattern.MatchString(source) {
+		http.Error(w, "Invalid kind or source, they must match "+namePattern.String(), http.StatusBadRequest)
+		return
+	}
+	var exitCode *int
+	if value := query.Get("exit-code"); value != "" {
+		code, err := strconv.Atoi(value)
+		if err != nil {
+			http.Error(w, "Invalid exit-code", http.StatusBadRequest)
+			return
+		}
+		exitCode = &code
+	}
+
+	var reports []StoredReport
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBody))
+	for {
+		var raw json.RawMessage
+		err := decoder.Decode(&raw)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("The reports must be JSON documents or JSON lines: %v", err), http.StatusBadRequest)
+			return
+		}
+		var body bytes.Buffer
+		json.Compact(&body, raw)
+		reports = append(reports, deriveReport(body.Bytes(), kind, source, exitCode))
+	}
+	if len(reports) == 0 {
+		http.Error(w, "No report in the request", http.StatusBadRequest)
+		return
+	}
+
+	ids, err := insertReports(reports)
+	if err != nil {
+		log.Printf("Unable to store %d reports from %s: %v", len(reports), source, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Stored %d reports of kind %s from %s", len(ids), reports[0].Kind, source)
+	sendJSON(w, PushResponse{Stored: len(ids), IDs: ids})
+}
+
+// deriveReport fills the kind (when not given), success, latency and summary of a report from its fields
+func deriveReport(body []byte, kind, source string, exitCode *int) StoredReport {
+	report := StoredReport{Kind: kind, Source: source, Success: true, Summary: common.SummarizeReport(body), Body: body}
+
+	var fields map[string]interface{}
+	if json.Unmarshal(body, &fields) != nil {
+		fields = nil
+	}
+	has := func(names ...string) bool {
+		for _, name := range names {
+			if _, ok := fields[name]; !ok {
+				return false
+			}
+		}
+		return true
+	}
+	if report.Kind == "" {
+		switch {
+		case has("Results", "Violations", "Compliant"):
+			report.Kind = "matrix"
+		case has("SuccessRate", "P50Ms"):
+			report.Kind = "sla"
+		case has("ForwardType", "ProxyHostName"):
+			report.Kind = "proxy"
+		case has("Protocol", "Target", "LatencyMs"):
+			report.Kind = "probe"
+		default:
+			report.Kind = "report"
+		}
+	}
+
+	// The verdict of the report itself comes first, the exit code of the client covers the others
+	verdict := false
+	for _, name := range []string{"Passed", "Success", "Consistent"} {
+		if value, ok := fields[name].(bool); ok {
+			report.Success, verdict = value, true
+			break
+		}
+	}
+	if violations, ok := fields["Violations"].(float64); ok && !verdict {
+		report.Success, verdict = violations == 0, true
+	}
+	if !verdict && exitCode != nil {
+		report.Success = *exitCode == 0
+	}
+
+	for _, name := range []string{"P50Ms", "LatencyMs"} {
+		if value, ok := fields[name].(float64); ok {
+			report.LatencyMs = &value
+			return report
+		}
+	}
+	if timings, ok := fields["Timings"].(map[string]interface{}); ok {
+		if value, ok := timings["TotalMs"].(float64); ok {
+			report.LatencyMs = &value
+		}
+	}
+	return report
+}
+
+//--------------------------------- queries
+
+// handleListReports lists the reports matching the query, latest first
+func handleListReports(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	var conditions []string
+	var args []interface{}
+	for _, field := range []string{"kind", "source"} {
+		if value := query.Get(field); value != "" {
+			if !namePattern.MatchString(value) {
+				http.Error(w, "Invalid "+field+", it must match "+namePattern.String(), http.StatusBadRequest)
+				return
+			}
+			conditions = append(conditions, field+" = ?")
+			args = append(args, value)
+		}
+	}
+	if query.Get("failed") == "true" {
+		conditions = append(conditions, "success = 0")
+	}
+	if value := query.Get("since"); value != "" {
+		since, err := time.ParseDuration(value)
+		if err != nil {
+			http.Error(w, "Invalid since", http.StatusBadRequest)
+			return
+		}
+		conditions = append(conditions, "received_unix >= ?")
+		args = append(args, time.Now().Add(-since).Unix())
+	}
+	limit := 100
+	if value := query.Get("limit"); value != "" {
+		var err error
+		if limit, err = strconv.Atoi(value); err != nil || limit < 1 || limit > 1000 {
+			http.Error(w, "Invalid limit, it must be between 1 and 1000", http.StatusBadRequest)
+			return
+		}
+	}
+
+	reports, err := selectReports(conditions, args, limit, query.Get("body") == "true")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sendJSON(w, reports)
+}
+
+// handleGetReport returns a report with its body
+func handleGetReport(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(strings.TrimPrefix(r.URL.Path, "/api/reports/"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid report ID", http.StatusBadRequest)
+		return
+	}
+	reports, err := selectReports([]string{"id = ?"}, []interface{}{id}, 1, true)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(reports) == 0 {
+		http.Error(w, "Report not found", http.StatusNotFound)
+		return
+	}
+	sendJSON(w, reports[0])
+}
+
+// latestMatrices returns the latest matrix report of each source
+func latestMatrices() ([]MatrixView, error) {
+	reports, err := selectReports([]string{"id IN (SELECT MAX(id) FROM reports WHERE kind = 'matrix' GROUP BY source)"}, nil, 1000, true)
+	if err != nil {
+		return nil, err
+	}
+
+	matrices := []MatrixView{}
+	for _, report := range reports {
+		var body struct {
+			Total      int
+			Compliant  int
+			Violations int
+			Results    []struct {
+				Name      string
+				Expected  bool
+				Compliant bool
+				Diff      string
+				Probe     struct {
+					Protocol  string
+					Target    string
+					Proxy     string
+					Success   bool
+					LatencyMs float64
+				}
+			}
+		}
+		if err := json.Unmarshal(report.Body, &body); err != nil {
+			continue
+		}
+		view := MatrixView{Source: report.Source, ReportID: report.ID, ReceivedAt: report.ReceivedAt,
+			Total: body.Total, Compliant: body.Compliant, Violations: body.Violations}
+		for _, result := range body.Results {
+			view.Results = append(view.Results, MatrixRow{
+				Name:      result.Name,
+				Protocol:  result.Probe.Protocol,
+				Target:    result.Probe.Target,
+				Proxy:     result.Probe.Proxy,
+				Expected:  result.Expected,
+				Reachable: result.Probe.Success,
+				Compliant: result.Compliant,
+				LatencyMs: result.Probe.LatencyMs,
+				Diff:      result.Diff,
+			})
+		}
+		matrices = append(matrices, view)
+	}
+	sort.Slice(matrices, func(i, j int) bool { return matrices[i].Source < matrices[j].Source })
+	return matrices, nil
+}
+
+// trendWindow returns the since and bucket durations of the query, 24h and 1h by default
+func trendWindow(r *http.Request) (time.Duration, time.Duration, error) {
+	since, bucket := 24*time.Hour, time.Hour
+	var err error
+	if value := r.URL.Query().Get("since"); value != "" {
+		if since, err = time.ParseDuration(value); err != nil || since <= 0 {
+			return 0, 0, fmt.Errorf("invalid since %q", value)
+		}
+	}
+	if value := r.URL.Query().Get("bucket"); value != "" {
+		if bucket, err = time.ParseDuration(value); err != nil || bucket < time.Second {
+			return 0, 0, fmt.Errorf("invalid bucket %q, it must be at least 1s", value)
+		}
+	}
+	if since/bucket > 10000 {
+		return 0, 0, fmt.Errorf("too many buckets, use a larger bucket")
+	}
+	return since, bucket, nil
+}
+
+// trends returns the reports, failures and latencies per kind, source and bucket of time
+func trends(kind string, since, bucket time.Duration) ([]TrendPoint, error) {
+	seconds := int64(bucket / time.Second)
+	statement := `SELECT kind, source, (received_unix / ?) * ? AS bucket, COUNT(*),
+  SUM(CASE WHEN success = 0 THEN 1 ELSE 0 END), AVG(latency_ms), MAX(latency_ms)
+FROM reports WHERE received_unix >= ?`
+	args := []interface{}{seconds, seconds, time.Now().Add(-since).Unix()}
+	if kind != "" {
+		statement += " AND kind = ?"
+		args = append(args, kind)
+	}
+	statement += " GROUP BY kind, source, bucket ORDER BY kind, source, bucket"
+
+	rows, err := db.Query(statement, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	points := []TrendPoint{}
+	for rows.Next() {
+		var point TrendPoint
+		var start int64
+		var average, highest sql.NullFloat64
+		if err := rows.Scan(&point.Kind, &point.Source, &start, &point.Reports, &point.Failures, &average, &highest); err != nil {
+			return nil, err
+		}
+		point.Start = time.Unix(start, 0).UTC().Format(time.RFC3339)
+		point.AvgLatencyMs, point.MaxLatencyMs = nullFloat(average), nullFloat(highest)
+		points = append(points, point)
+	}
+	return points, rows.Err()
+}
+
+// selectReports returns the reports matching all the conditions, latest first. The conditions
+// take their values from args as query parameters.
+func selectReports(conditions []string, args []interface{}, limit int, withBody bool) ([]StoredReport, error) {
+	columns := "id, received_at, kind, source, success, latency_ms, summary"
+	if withBody {
+		columns += ", body"
+	}
+	statement := "SELECT " + columns + " FROM reports"
+	if len(conditions) > 0 {
+		statement += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	statement += " ORDER BY id DESC LIMIT ?"
+
+	rows, err := db.Query(statement, append(args, limit)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	reports := []StoredReport{}
+	for rows.Next() {
+		var report StoredReport
+		var latency sql.NullFloat64
+		var summary, body string
+		fields := []interface{}{&report.ID, &report.ReceivedAt, &report.Kind, &report.Source, &report.Success, &latency, &summary}
+		if withBody {
+			fields = append(fields, &body)
+		}
+		if err := rows.Scan(fields...); err != nil {
+			return nil, err
+		}
+		report.LatencyMs = nullFloat(latency)
+		json.Unmarshal([]byte(summary), &report.Summary)
+		if withBody {
+			report.Body = json.RawMessage(body)
+		}
+		reports = append(reports, report)
+	}
+	return reports, rows.Err()
+}
+
+// insertReports stores reports in one transaction and returns their IDs
+func insertReports(reports []StoredReport) ([]int64, error) {
+	now := time.Now().UTC()
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	insert, err := tx.Prepare("INSERT INTO reports (received_at, received_unix, kind, source, success, latency_ms, summary, body) VALUES (?, ?, ?, ?, ?, ?, ?, ?)")
+	if err != nil {
+		return nil, err
+	}
+	defer insert.Close()
+	ids := make([]int64, len(reports))
+	for i, report := range reports {
+		var latency sql.NullFloat64
+		if report.LatencyMs != nil {
+			latency = sql.NullFloat64{Float64: *report.LatencyMs, Valid: true}
+		}
+		summary, _ := json.Marshal(report.Summary)
+		result, err := insert.Exec(now.Format(time.RFC3339), now.Unix(), report.Kind, report.Source, report.Success, latency, string(summary), string(report.Body))
+		if err != nil {
+			return nil, err
+		}
+		if ids[i], err = result.LastInsertId(); err != nil {
+			return nil, err
+		}
+	}
+	return ids, tx.Commit()
+}
+
+// expireReports deletes the reports older than retention, every 10 minutes
+func expireReports(retention time.Duration) {
+	for ; ; time.Sleep(10 * time.Minute) {
+		if _, err := db.Exec("DELETE FROM reports WHERE received_unix < ?", time.Now().Add(-retention).Unix()); err != nil {
+			log.Printf("Unable to delete the expired reports: %v", err)
+		}
+	}
+}
+
+//--------------------------------- sqlite
+
+// reportsSchema creates the table of the reports
+var reportsSchema = []string{`CREATE TABLE IF NOT EXISTS reports (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  received_at TEXT NOT NULL,
+  received_unix INTEGER NOT NULL,
+  kind TEXT NOT NULL,
+  source TEXT NOT NULL,
+  success INTEGER NOT NULL,
+  latency_ms REAL,
+  summary TEXT NOT NULL,
+  body TEXT NOT NULL
+)`,
+	"CREATE INDEX IF NOT EXISTS reports_kind_time ON reports (kind, received_unix)",
+	"CREATE INDEX IF NOT EXISTS reports_time ON reports (received_unix)",
+}
+
+// openSQLite opens the SQLite database and creates its schema. The writers wait for each other
+// for up to 5 seconds instead of failing with SQLITE_BUSY.
+func openSQLite(path string) (*sql.DB, error) {
+	database, err := sql.Open("sqlite", "file:"+path+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
+	if err != nil {
+		return nil, err
+	}
+	for _, statement := range reportsSchema {
+		if _, err := database.Exec(statement); err != nil {
+			database.Close()
+			return nil, fmt.Errorf("unable to create the schema of %s: %v", path, err)
+		}
+	}
+	return database, nil
+}
+
+// nullFloat returns the value of a nullable column, nil for NULL
+func nullFloat(value sql.NullFloat64) *float64 {
+	if !value.Valid {
+		return nil
+	}
+	return &value.Float64
+}
+
+//--------------------------------- dashboard
+
+// trendSeries is the latency trend of a kind and source of reports, drawn on the dashboard
+type trendSeries struct {
+	Kind     string
+	Source   string
+	Reports  int
+	Failures int
+	MaxMs    float64
+	LastMs   float64
+	Points   string // The points of the SVG polyline of the average latencies
+}
+
+// dashboardData is the data of the dashboard template
+type dashboardData struct {
+	Generated string
+	Since     string
+	Bucket    string
+	Matrices  []MatrixView
+	Trends    []trendSeries
+	Failures  []StoredReport
+}
+
+// sparklineWidth and sparklineHeight are the size of the trend charts
+const sparklineWidth, sparklineHeight = 300.0, 40.0
+
+var dashboardTemplate = template.Must(template.New("dashboard").Funcs(template.FuncMap{
+	"summary": func(summary map[string]string) string {
+		keys := make([]string, 0, len(summary))
+		for key := range summary {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		var parts []string
+		for _, key := range keys {
+			parts = append(parts, key+"="+summary[key])
+		}
+		return strings.Join(parts, " ")
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="30">
+<title>Connectivity results</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 1.5em; }
+th, td { border: 1px solid #ccc; padding: 4px 8px; text-align: left; font-size: 90%; }
+.ok { background: #dff0d8; }
+.bad { background: #f2dede; }
+svg { background: #f8f8f8; }
+</style>
+</head>
+<body>
+<h1>Connectivity results</h1>
+<p>Generated {{.Generated}}, trends of the last {{.Since}} by {{.Bucket}}. JSON: <a href="/api/matrix">/api/matrix</a>, <a href="/api/trends">/api/trends</a>, <a href="/api/reports">/api/reports</a></p>
+
+<h2>Connectivity matrices</h2>
+{{range .Matrices}}
+<h3>{{.Source}} <small>(report <a href="/api/reports/{{.ReportID}}">{{.ReportID}}</a>, {{.ReceivedAt}}, {{.Compliant}}/{{.Total}} compliant)</small></h3>
+<table>
+<tr><th>Name</th><th>Protocol</th><th>Target</th><th>Proxy</th><th>Expected</th><th>Reachable</th><th>Latency (ms)</th><th>Diff</th></tr>
+{{range .Results}}<tr class="{{if .Compliant}}ok{{else}}bad{{end}}"><td>{{.Name}}</td><td>{{.Protocol}}</td><td>{{.Target}}</td><td>{{.Proxy}}</td><td>{{.Expected}}</td><td>{{.Reachable}}</td><td>{{printf "%.3f" .LatencyMs}}</td><td>{{.Diff}}</td></tr>
+{{end}}</table>
+{{else}}<p>No matrix report yet.</p>
+{{end}}
+
+<h2>Latency trends</h2>
+{{if .Trends}}<table>
+<tr><th>Kind</th><th>Source</th><th>Average latency</th><th>Last (ms)</th><th>Max (ms)</th><th>Reports</th><th>Failures</th></tr>
+{{range .Trends}}<tr class="{{if .Failures}}bad{{else}}ok{{end}}"><td>{{.Kind}}</td><td>{{.Source}}</td>
+<td><svg width="300" height="40"><polyline fill="none" stroke="#337ab7" stroke-width="1.5" points="{{.Points}}"/></svg></td>
+<td>{{printf "%.3f" .LastMs}}</td><td>{{printf "%.3f" .MaxMs}}</td><td>{{.Reports}}</td><td>{{.Failures}}</td></tr>
+{{end}}</table>
+{{else}}<p>No report in the window.</p>
+{{end}}
+
+<h2>Recent failures</h2>
+{{if .Failures}}<table>
+<tr><th>Received</th><th>Kind</th><th>Source</th><th>Summary</th></tr>
+{{range .Failures}}<tr class="bad"><td><a href="/api/reports/{{.ID}}">{{.ReceivedAt}}</a></td><td>{{.Kind}}</td><td>{{.Source}}</td><td>{{summary .Summary}}</td></tr>
+{{end}}</table>
+{{else}}<p>No failure in the window.</p>
+{{end}}
+</body>
+</html>
+`))
+
+// handleDashboard renders the dashboard
+func handleDashboard(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	since, bucket, err := trendWindow(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	data := dashboardData{Generated: time.Now().Format(time.RFC3339), Since: since.String(), Bucket: bucket.String()}
+	if data.Matrices, err = latestMatrices(); err == nil {
+		var points []TrendPoint
+		if points, err = trends("", since, bucket); err == nil {
+			data.Trends = trendSeriesOf(points, time.Now().Add(-since), since)
+			data.Failures, err = selectReports([]string{"success = 0", "received_unix >= ?"}, []interface{}{time.Now().Add(-since).Unix()}, 50, false)
+		}
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := dashboardTemplate.Execute(w, data); err != nil {
+		log.Printf("Unable to render the dashboard: %v", err)
+	}
+}
+
+// trendSeriesOf groups the trend points per kind and source, and draws their average latencies
+// over the window, scaled to the highest average of each series
+func trendSeriesOf(points []TrendPoint, start time.Time, window time.Duration) []trendSeries {
+	var series []trendSeries
+	var averages [][]TrendPoint
+	for _, point := range points {
+		if n := len(series); n == 0 || series[n-1].Kind != point.Kind || series[n-1].Source != point.Source {
+			series = append(series, trendSeries{Kind: point.Kind, Source: point.Source})
+			averages = append(averages, nil)
+		}
+		current := &series[len(series)-1]
+		current.Reports += point.Reports
+		current.Failures += point.Failures
+		if point.MaxLatencyMs != nil && *point.MaxLatencyMs > current.MaxMs {
+			current.MaxMs = *point.MaxLatencyMs
+		}
+		if point.AvgLatencyMs != nil {
+			current.LastMs = *point.AvgLatencyMs
+			averages[len(averages)-1] = append(averages[len(averages)-1], point)
+		}
+	}
+
+	for i := range series {
+		highest := 0.0
+		for _, point := range averages[i] {
+			highest = max(highest, *point.AvgLatencyMs)
+		}
+		var coordinates []string
+		for _, point := range averages[i] {
+			at, _ := time.Parse(time.RFC3339, point.Start)
+			x := sparklineWidth * float64(at.Sub(start)) / float64(window)
+			y := sparklineHeight
+			if highest > 0 {
+				y = sparklineHeight - (sparklineHeight-2)*(*point.AvgLatencyMs/highest)
+			}
+			coordinates = append(coordinates, fmt.Sprintf("%.1f,%.1f", max(x, 0), y))
+		}
+		series[i].Points = strings.Join(coordinates, " ")
+	}
+	return series
+}
+
+// sendJSON writes a JSON response
+func sendJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(value)
+}
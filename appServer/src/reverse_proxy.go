@@ -0,0 +1,340 @@
+/*
+This program implements a simple TLS-terminating reverse proxy for a group of backends, a
+controllable stand-in for an L7 load balancer when testing client behavior behind one.
+
+Main Features:
+1. Terminates TLS (HTTP/1.1 and HTTP/2) with the given certificate, or a generated self-signed
+   one, and optionally serves plain HTTP as well.
+2. Load-balances requests across a static backend list, or across the addresses a DNS name
+   resolves to (e.g. a headless Service), re-resolved periodically.
+3. Picks the backend with round-robin or least-conn (the fewest in-flight requests) policies.
+4. Annotates every response with the chosen backend in the X-Backend header, including the
+   502 responses for unreachable backends.
+5. Reports the backends with their in-flight, total and failed requests on /lb/status.
+
+Usage:
+go run reverse_proxy.go -backends=<host:port>,<host:port> [-tls-port=8443] [-policy=round-robin]
+go run reverse_proxy.go -backend-dns=<name>:<port> [-dns-refresh=10s] [-policy=least-conn]
+
+Options:
+-h: Display help information
+-tls-port: Specify the TCP port for HTTPS (default is 8443)
+-port: Also serve plain HTTP on this TCP port (optional)
+-tls-cert, -tls-key: The PEM certificate and key for HTTPS (default is a generated self-signed certificate)
+-backends: Comma separated backends as host:port or URLs (http:// or https://)
+-backend-dns: Discover the backends from the addresses of a DNS name, as name:port, instead of -backends
+-backend-scheme: The scheme of the backends given as host:port or discovered with DNS: http or https (default is http)
+-dns-refresh: How often the DNS name is re-resolved (default is 10s)
+-policy: The load-balancing policy: round-robin or least-conn (default is round-robin)
+-timeout: Timeout for each backend request (default is 30s)
+
+Notes:
+- The backends are not health checked; a failed request is answered with 502 and counted
+  as failed for its backend, which stays in the rotation.
+- Backends with https:// are not verified, like a typical L7 load balancer re-encrypting to pods.
+- The proxy sets X-Forwarded-For, X-Forwarded-Host and X-Forwarded-Proto.
+
+Testing with curl:
+- To balance across two echo servers and see the chosen backend, use:
+  go run reverse_proxy.go -backends=127.0.0.1:8080,127.0.0.1:8081 -policy=least-conn
+  for i in 1 2 3 4; do curl -sk -o /dev/null -D - https://127.0.0.1:8443/ | grep X-Backend; done
+- To balance across the pods of a headless Service, use:
+  go run reverse_proxy.go -backend-dns=backend-headless.default.svc.cluster.local:8080
+- To get the state of the backends, use:
+  curl -sk https://127.0.0.1:8443/lb/status
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"main/common"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LBBackend represents one backend of the group and its counters
+type LBBackend struct {
+	URL      string `json:"URL"`      // The URL of the backend
+	InFlight int    `json:"InFlight"` // The number of requests being served by the backend
+	Requests int    `json:"Requests"` // The number of requests sent to the backend since it joined the group
+	Failures int    `json:"Failures"` // The number of requests that failed to reach the backend
+
+	target *url.URL
+}
+
+// LBStatus represents the response of the /lb/status endpoint
+type LBStatus struct {
+	Policy     string      `json:"Policy"`     // The load-balancing policy
+	DNSName    string      `json:"DNSName"`    // The DNS name the backends are discovered from, if any
+	ResolvedAt string      `json:"ResolvedAt"` // When the DNS name was last resolved
+	DNSError   string      `json:"DNSError"`   // The error of the last resolution, if it failed
+	Backends   []LBBackend `json:"Backends"`   // The backends, sorted by URL
+}
+
+// backendGroup holds the backends and picks one for each request
+type backendGroup struct {
+	mutex      sync.Mutex
+	policy     string
+	backends   []*LBBackend
+	next       int // The next backend for round-robin
+	dnsName    string
+	resolvedAt time.Time
+	dnsError   error
+}
+
+// chosenBackendKey is the request context key of the chosen backend
+type chosenBackendKey struct{}
+
+func main() {
+	help := flag.Bool("h", false, "Display help information")
+	tlsPort := flag.String("tls-port", "8443", "Specify the TCP port for HTTPS")
+	port := flag.String("port", "", "Also serve plain HTTP on this TCP port")
+	tlsCert := flag.String("tls-cert", "", "The PEM certificate for HTTPS (default is a generated self-signed certificate)")
+	tlsKey := flag.String("tls-key", "", "The PEM key for HTTPS")
+	backendList := flag.String("backends", "", "Comma separated backends as host:port or URLs")
+	backendDNS := flag.String("backend-dns", "", "Discover the backends from the addresses of a DNS name, as name:port")
+	backendScheme := flag.String("backend-scheme", "http", "The scheme of the backends given as host:port or discovered with DNS: http or https")
+	dnsRefresh := flag.Duration("dns-refresh", 10*time.Second, "How often the DNS name is re-resolved")
+	policy := flag.String("policy", "round-robin", "The load-balancing policy: round-robin or least-conn")
+	timeout := flag.Duration("timeout", 30*time.Second, "Timeout for each backend request")
+	flag.Parse()
+
+	if *help {
+		flag.Usage()
+		return
+	}
+
+	if *policy != "round-robin" && *policy != "least-conn" {
+		log.Fatalf("Invalid -policy %q. Supported values are 'round-robin' and 'least-conn'.", *policy)
+	}
+	if *backendScheme != "http" && *backendScheme != "https" {
+		log.Fatalf("Invalid -backend-scheme %q. Supported values are 'http' and 'https'.", *backendScheme)
+	}
+	if (*backendList == "") == (*backendDNS == "") {
+		log.Fatalf("Either -backends or -backend-dns is required")
+	}
+
+	group := &backendGroup{policy: *policy}
+	if *backendList != "" {
+		var urls []string
+		for _, backend := range strings.Split(*backendList, ",") {
+			if backend = strings.TrimSpace(backend); backend != "" {
+				urls = append(urls, backendURL(backend, *backendScheme))
+			}
+		}
+		if err := group.setBackends(urls); err != nil {
+			log.Fatalf("Invalid -backends: %v", err)
+		}
+	} else {
+		host, dnsPort, err := net.SplitHostPort(*backendDNS)
+		if err != nil {
+			log.Fatalf("Invalid -backend-dns %q, expected name:port: %v", *backendDNS, err)
+		}
+		group.dnsName = host
+		group.resolve(dnsPort, *backendScheme)
+		go func() {
+			for range time.Tick(*dnsRefresh) {
+				group.resolve(dnsPort, *backendScheme)
+			}
+		}()
+	}
+
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			backend := pr.In.Context().Value(chosenBackendKey{}).(*LBBackend)
+			pr.SetURL(backend.target)
+			pr.SetXForwarded()
+		},
+		Transport: &http.Transport{
+			DialContext:           (&net.Dialer{Timeout: 5 * time.Second}).DialContext,
+			TLSClientConfig:       &tls.Config{InsecureSkipVerify: true},
+			ResponseHeaderTimeout: *timeout,
+			MaxIdleConnsPerHost:   64,
+		},
+		ModifyResponse: func(resp *http.Response) error {
+			backend := resp.Request.Context().Value(chosenBackendKey{}).(*LBBackend)
+			resp.Header.Set("X-Backend", backend.URL)
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			backend := r.Context().Value(chosenBackendKey{}).(*LBBackend)
+			group.failed(backend)
+			log.Printf("Request %s %s to %s failed: %v", r.Method, r.URL, backend.URL, err)
+			w.Header().Set("X-Backend", backend.URL)
+			http.Error(w, fmt.Sprintf("Backend %s failed: %v", backend.URL, err), http.StatusBadGateway)
+		},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/lb/status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(group.status())
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		backend := group.pick()
+		if backend == nil {
+			http.Error(w, "No backend available", http.StatusServiceUnavailable)
+			return
+		}
+		defer group.done(backend)
+		proxy.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), chosenBackendKey{}, backend)))
+	})
+
+	if *port != "" {
+		go func() {
+			fmt.Printf("HTTP reverse proxy is listening on port %s\n", *port)
+			if err := http.ListenAndServe(fmt.Sprintf(":%s", *port), mux); err != nil {
+				log.Fatalf("HTTP server failed to start: %v", err)
+			}
+		}()
+	}
+
+	cert, err := common.LoadOrGenerateCertificate(*tlsCert, *tlsKey)
+	if err != nil {
+		log.Fatalf("Unable to load the TLS certificate: %v", err)
+	}
+	server := &http.Server{
+		Addr:      fmt.Sprintf(":%s", *tlsPort),
+		Handler:   mux,
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}},
+	}
+	fmt.Printf("HTTPS reverse proxy is listening on port %s with policy %s\n", *tlsPort, *policy)
+	if err := server.ListenAndServeTLS("", ""); err != nil {
+		log.Fatalf("HTTPS server failed to start: %v", err)
+	}
+}
+
+// backendURL returns the URL of a backend given as host:port or as a URL
+func backendURL(backend, scheme string) string {
+	if strings.Contains(backend, "://") {
+		return backend
+	}
+	return scheme + "://" + backend
+}
+
+// setBackends replaces the backends of the group, keeping the counters of the ones still present
+func (g *backendGroup) setBackends(urls []string) error {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	existing := make(map[string]*LBBackend)
+	for _, backend := range g.backends {
+		existing[backend.URL] = backend
+	}
+
+	var backends []*LBBackend
+	for _, rawURL := range urls {
+		if backend, ok := existing[rawURL]; ok {
+			backends = append(backends, backend)
+			continue
+		}
+		target, err := url.Parse(rawURL)
+		if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+			return fmt.Errorf("invalid backend %q", rawURL)
+		}
+		backends = append(backends, &LBBackend{URL: rawURL, target: target})
+	}
+	sort.Slice(backends, func(i, j int) bool { return backends[i].URL < backends[j].URL })
+
+	if len(backends) != len(g.backends) {
+		log.Printf("Backends: %d -> %d", len(g.backends), len(backends))
+	}
+	g.backends = backends
+	return nil
+}
+
+// resolve discovers the backends from the addresses of the DNS name, keeping the current
+// backends when the resolution fails
+func (g *backendGroup) resolve(port, scheme string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupHost(ctx, g.dnsName)
+
+	var urls []string
+	for _, addr := range addrs {
+		urls = append(urls, scheme+"://"+net.JoinHostPort(addr, port))
+	}
+	if err == nil {
+		err = g.setBackends(urls)
+	}
+	if err != nil {
+		log.Printf("Unable to resolve the backends of %s: %v", g.dnsName, err)
+	}
+
+	g.mutex.Lock()
+	g.resolvedAt, g.dnsError = time.Now(), err
+	g.mutex.Unlock()
+}
+
+// pick chooses the backend of a request with the policy of the group, nil when there is none
+func (g *backendGroup) pick() *LBBackend {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	if len(g.backends) == 0 {
+		return nil
+	}
+	var chosen *LBBackend
+	if g.policy == "least-conn" {
+		// Start from the round-robin position, so ties are spread across the backends
+		for i := range g.backends {
+			backend := g.backends[(g.next+i)%len(g.backends)]
+			if chosen == nil || backend.InFlight < chosen.InFlight {
+				chosen = backend
+			}
+		}
+	} else {
+		chosen = g.backends[g.next%len(g.backends)]
+	}
+	g.next = (g.next + 1) % len(g.backends)
+
+	chosen.InFlight++
+	chosen.Requests++
+	return chosen
+}
+
+// done records the end of a request to a backend
+func (g *backendGroup) done(backend *LBBackend) {
+	g.mutex.Lock()
+	backend.InFlight--
+	g.mutex.Unlock()
+}
+
+// failed records a request that failed to reach a backend
+func (g *backendGroup) failed(backend *LBBackend) {
+	g.mutex.Lock()
+	backend.Failures++
+	g.mutex.Unlock()
+}
+
+// status returns a snapshot of the group
+func (g *backendGroup) status() LBStatus {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	status := LBStatus{Policy: g.policy, DNSName: g.dnsName, Backends: []LBBackend{}}
+	if !g.resolvedAt.IsZero() {
+		status.ResolvedAt = g.resolvedAt.Format(time.RFC3339)
+	}
+	if g.dnsError != nil {
+		status.DNSError = g.dnsError.Error()
+	}
+	for _, backend := range g.backends {
+		status.Backends = append(status.Backends, *backend)
+	}
+	return status
+}
@@ -0,0 +1,209 @@
+/*
+This program checks the clock of the node or pod it runs on, since clock skew corrupts latency
+measurements and certificate validations.
+
+Main Features:
+1. Measures the offset of the local clock against a list of NTP servers (SNTP, RFC 4330),
+   keeping the sample with the lowest round trip delay for each server.
+2. Measures the offset against the Kubernetes API server from the Date header of its responses.
+   The header only has a resolution of one second, so this offset comes with an uncertainty of
+   at least 500ms and only catches gross skew.
+3. Reports the offsets as JSON and exits non-zero when one of them exceeds the allowed skew.
+
+Usage:
+go run time_checker.go [-ntp-servers=pool.ntp.org] [-kube-api=<url>] [-max-skew=100ms]
+
+Options:
+-h: Display help information
+-ntp-servers: Comma separated NTP servers, as host or host:port (default is pool.ntp.org)
+-samples: The number of NTP requests sent to each server (default is 3)
+-kube-api: Kubernetes API URL, e.g. from `kubectl proxy` (default is the in-cluster service account)
+-no-kube: Do not compare with the Kubernetes API server (default is false)
+-max-skew: The allowed offset against any source (default is 100ms)
+-timeout: Timeout for each request (default is 3s)
+
+Notes:
+- Inside a pod the clock is the clock of the node, so running it in any pod checks the node.
+- The check against the API server is skipped when not running in a cluster and -kube-api is not set.
+- The offset is positive when the source is ahead of the local clock.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"main/common"
+	"math"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// ClockSource represents the offset of the local clock against one time source
+type ClockSource struct {
+	Source        string  `json:"Source"`        // The kind of source: ntp or kube-apiserver
+	Server        string  `json:"Server"`        // The queried server
+	OffsetMs      float64 `json:"OffsetMs"`      // How far the source is ahead of the local clock
+	UncertaintyMs float64 `json:"UncertaintyMs"` // The maximum error of the offset
+	RoundTripMs   float64 `json:"RoundTripMs"`   // The round trip delay of the request
+	Stratum       int     `json:"Stratum"`       // The NTP stratum of the server
+	ReferenceID   string  `json:"ReferenceID"`   // The NTP reference of the server
+	Skewed        bool    `json:"Skewed"`        // Indicates if the offset exceeds the allowed skew beyond its uncertainty
+	ErrorMessage  string  `json:"ErrorMessage"`  // Why the source could not be queried, if any
+}
+
+// TimeCheckReport represents the result of the clock check
+type TimeCheckReport struct {
+	HostName  string        `json:"HostName"`  // The hostname of the node or pod
+	LocalTime string        `json:"LocalTime"` // The local time when the check started
+	MaxSkewMs float64       `json:"MaxSkewMs"` // The allowed offset against any source
+	Verdict   string        `json:"Verdict"`   // OK, Skewed, or Unknown when no source could be queried
+	Sources   []ClockSource `json:"Sources"`   // The offset against each source
+}
+
+func main() {
+	help := flag.Bool("h", false, "Display help information")
+	ntpServers := flag.String("ntp-servers", "pool.ntp.org", "Comma separated NTP servers, as host or host:port")
+	samples := flag.Int("samples", 3, "The number of NTP requests sent to each server")
+	kubeAPI := flag.String("kube-api", "", "Kubernetes API URL, e.g. from `kubectl proxy` (default is the in-cluster service account)")
+	noKube := flag.Bool("no-kube", false, "Do not compare with the Kubernetes API server")
+	maxSkew := flag.Duration("max-skew", 100*time.Millisecond, "The allowed offset against any source")
+	timeout := flag.Duration("timeout", 3*time.Second, "Timeout for each request")
+	flag.Parse()
+
+	if *help {
+		flag.Usage()
+		return
+	}
+
+	hostName, _ := os.Hostname()
+	report := TimeCheckReport{
+		HostName:  hostName,
+		LocalTime: time.Now().Format(time.RFC3339Nano),
+		MaxSkewMs: durationMs(*maxSkew),
+		Verdict:   "Unknown",
+	}
+
+	for _, server := range strings.Split(*ntpServers, ",") {
+		if server = strings.TrimSpace(server); server != "" {
+			report.Sources = append(report.Sources, checkNTP(server, *samples, *timeout))
+		}
+	}
+
+	if !*noKube {
+		client, err := common.NewKubeClient(*kubeAPI)
+		if err != nil {
+			log.Printf("Skipping the Kubernetes API server: %v", err)
+		} else {
+			report.Sources = append(report.Sources, checkKubeAPIServer(client, *timeout))
+		}
+	}
+
+	for i := range report.Sources {
+		source := &report.Sources[i]
+		if source.ErrorMessage != "" {
+			continue
+		}
+		// Only flag the skew when it is certain, the API server Date header is coarse
+		source.Skewed = math.Abs(source.OffsetMs)-source.UncertaintyMs > report.MaxSkewMs
+		if source.Skewed {
+			report.Verdict = "Skewed"
+		} else if report.Verdict == "Unknown" {
+			report.Verdict = "OK"
+		}
+	}
+
+	output, _ := json.MarshalIndent(report, "", "  ")
+	fmt.Println(string(output))
+
+	if report.Verdict != "OK" {
+		os.Exit(1)
+	}
+}
+
+// checkNTP queries an NTP server several times and keeps the sample with the lowest round trip,
+// which is the least affected by asymmetric network delays
+func checkNTP(server string, samples int, timeout time.Duration) ClockSource {
+	source := ClockSource{Source: "ntp", Server: server}
+
+	var best *common.NTPResult
+	var lastErr error
+	for i := 0; i < samples; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		result, err := common.QueryNTP(ctx, server)
+		cancel()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if best == nil || result.RoundTrip < best.RoundTrip {
+			best = result
+		}
+	}
+	if best == nil {
+		source.ErrorMessage = lastErr.Error()
+		return source
+	}
+
+	source.Server = best.Server
+	source.OffsetMs = durationMs(best.Offset)
+	source.RoundTripMs = durationMs(best.RoundTrip)
+	source.UncertaintyMs = source.RoundTripMs / 2
+	source.Stratum = best.Stratum
+	source.ReferenceID = best.ReferenceID
+	if best.Leap == 3 {
+		source.ErrorMessage = "the server clock is not synchronized"
+	}
+	return source
+}
+
+// checkKubeAPIServer estimates the offset against the API server from the Date header of a
+// /version response. The header is truncated to the second, so the server time lies within
+// [Date, Date+1s) and the estimate is the middle of that interval, compared with the middle
+// of the request.
+func checkKubeAPIServer(client *common.KubeClient, timeout time.Duration) ClockSource {
+	source := ClockSource{Source: "kube-apiserver", Server: client.BaseURL}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, client.BaseURL+"/version", nil)
+	if err != nil {
+		source.ErrorMessage = err.Error()
+		return source
+	}
+	if client.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+client.Token)
+	}
+
+	sent := time.Now()
+	resp, err := client.HTTPClient.Do(req)
+	received := time.Now()
+	if err != nil {
+		source.ErrorMessage = err.Error()
+		return source
+	}
+	resp.Body.Close()
+
+	date, err := http.ParseTime(resp.Header.Get("Date"))
+	if err != nil {
+		source.ErrorMessage = fmt.Sprintf("invalid Date header %q: %v", resp.Header.Get("Date"), err)
+		return source
+	}
+
+	roundTrip := received.Sub(sent)
+	midpoint := sent.Add(roundTrip / 2)
+	source.OffsetMs = durationMs(date.Add(500 * time.Millisecond).Sub(midpoint))
+	source.RoundTripMs = durationMs(roundTrip)
+	source.UncertaintyMs = 500 + source.RoundTripMs/2
+	return source
+}
+
+// durationMs converts a duration to milliseconds
+func durationMs(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
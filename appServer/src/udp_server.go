@@ -5,6 +5,52 @@ Main Features:
 1. Returns the server's hostname when a UDP packet is received.
 2. Returns the client's source IP address.
 3. Echoes any data from the client's request.
+4. Reports the identity of the server (hostname, pod, node and IPs), refreshed whenever
+   the network interfaces change.
+5. Reports the IPv6 flow label of the received packet and optionally reflects it on the reply,
+   to study ECMP hashing on the fabric.
+6. Reports whether the server runs with hostNetwork, since the hostname alone is ambiguous.
+7. Reports the kernel (or NIC hardware) receive timestamp of the packet captured with
+   SO_TIMESTAMPING, enabling one-way latency analysis when the clocks are PTP-synced.
+8. Optionally reports the kernel version, OS image and network sysctls of the node, collected at
+   startup and refreshed on SIGHUP, to correlate behavioral differences with node software.
+9. Optionally accepts IPv6 packets with a zero UDP checksum, as sent by tunnels (RFC 6936), and
+   replies with a zero checksum, reporting the checksum error counters of the kernel since start.
+10. Monitors its own goroutines, open file descriptors and socket states, optionally reported on
+    the /status endpoint of -status-port, and replies to requests with a rejection instead of the
+    echo while they exceed -max-goroutines or -max-fds, so runaway tests get a clear answer.
+11. Optionally sends the reply to another address than the client's, as asked by the request with
+    the envelope {"ReplyTo":"<host:port>","EchoData":"<data>"}, to construct asymmetric return
+    paths (reply to a different pod or NodePort) for conntrack experiments. Only the destinations
+    in the -reply-to-allow allowlist are accepted, other requests get their reply as usual, with
+    the reason of the refusal.
+12. Dumps a diagnostic bundle on SIGQUIT or with /debug/dump of -status-port: goroutine stacks,
+    flags, counters, resource usage and socket states, and the last requests, to capture the
+    state of the server during hangs that are hard to reproduce.
+13. Optionally samples how long the recvmsg and sendmsg syscalls take, next to how long the requests
+    take to handle, and reports their percentiles on /syscalls of -status-port, to tell kernel and
+    datapath delays from application delays at high load. Each reply carries the duration of the
+    recvmsg that read its request.
+14. Optionally applies the behavior settings (delay, error rate) of a config file, e.g. mounted from
+    a ConfigMap, and reloads them when the file changes, without restart. Each reload increments a
+    config generation, logged and echoed in the replies, so tests know which config produced each reply.
+15. Optionally acts as a DNS responder: requests that parse as DNS queries are answered with a fixed
+    record set for any queried name, and the query is logged in the JSON format of the replies, so
+    the server is a drop-in sink to check where the DNS redirection rules of pods send the queries.
+16. Reports the cluster, region and zone of the server in Identity.Topology of all replies, from
+    the -cluster, -region and -zone flags (or their TOPOLOGY_* environment variables) or detected
+    from the labels of the node, so results of multi-cluster and multi-zone runs aggregate without
+    mapping tables.
+17. Optionally reports the cgroup CPU and memory limits of the container and their usage as
+    Resources, and the architecture and CPUs of the node in Identity, so performance differences
+    observed in tests can be attributed to throttling rather than the network.
+18. Tracks the goroutine handling each request, reported on /handlers of -status-port (active, peak,
+    started and finished handlers, and the oldest ones), and logs an alert when more handlers than
+    -handler-threshold run at once or one of them lives beyond -handler-deadline, to spot leaked
+    handlers under packet floods.
+19. Answers the binary RTT ping protocol of common/ping.go (the rtt subcommand of the client): the
+    reply echoes the sequence number and the client timestamp and adds how long the server held the
+    request, so the client computes RTT and jitter with its own clock and without JSON overhead.
 
 Usage:
 go run udp_server.go -port=<port>
@@ -12,9 +58,75 @@ go run udp_server.go -port=<port>
 Options:
 -h: Display help information
 -port: Specify the UDP port for the server to listen on (default is 8080)
+-reflect-flow-label: Send the reply with the IPv6 flow label of the request (default is false)
+-fingerprint: Include the kernel and OS fingerprint of the node in responses (default is false)
+-report-resources: Include the cgroup CPU and memory limits and usage of the container as Resources (default is false)
+-udp6-zero-checksum-rx: Accept IPv6 packets with a zero UDP checksum (default is false)
+-udp6-zero-checksum-tx: Send replies over IPv6 with a zero UDP checksum (default is false)
+-checksum-stats: Report the UDP checksum error counters, implied by the two options above (default is false)
+-max-goroutines: Reject requests while the server has more goroutines (default is 0, no cap)
+-max-fds: Reject requests while the server has more open file descriptors (default is 0, no cap)
+-status-port: Serve the resource usage on http://<host>:<status-port>/status (optional)
+-dump-dir: The directory of the diagnostic bundles written on SIGQUIT or with /debug/dump?file=true (default is the temporary directory)
+-syscall-sampling: Sample the duration of the recvmsg and sendmsg syscalls, reported on /syscalls of -status-port (Linux only, default is false)
+-reply-to-allow: The CIDRs (or IPs) a request may redirect its reply to, e.g. 10.244.0.0/16,fd00::/64 (default is none, disabling the override)
+-config: A JSON config file of behavior settings, reloaded when it changes (optional), e.g.
+    {"Delay":"100ms","DelayJitter":"50ms","ErrorRate":0.1}
+    The erroneous replies are rejections with the reason "injected error". The settings in effect are
+    served on /config of -status-port. ErrorStatus and Headers only apply to the HTTP server.
+-config-poll: How often the -config file is checked for changes (default is 2s)
+-handler-threshold: Log an alert when more request handlers run at once (default is 0, no alert)
+-handler-deadline: Log an alert for each request handler running for longer (default is 30s, 0 for no alert)
+-dns-responder: Answer the requests that are DNS queries instead of echoing them (default is false)
+-dns-records: The records answered for any queried name, as TYPE=value separated by commas, e.g.
+    A=10.0.0.1,A=10.0.0.2,AAAA=fd00::1,TXT=sink (A, AAAA, CNAME, PTR, NS and TXT, default is none)
+-dns-ttl: The TTL of the records of the DNS responder, in seconds (default is 30)
+-cluster, -region, -zone: The topology labels reported in Identity.Topology of the responses (default is
+    $TOPOLOGY_CLUSTER, $TOPOLOGY_REGION and $TOPOLOGY_ZONE)
+-topology-from-node: Detect the labels not set above from the topology.kubernetes.io/region, zone and
+    cluster labels of the node $NODE_NAME, with the API (default is false)
+-topology-kube-api: The API server URL for -topology-from-node, e.g. http://127.0.0.1:8001 of kubectl
+    proxy (default is the in-cluster service account)
 
 Notes:
 - The server listens on the specified port.
+- -topology-from-node reads the node once at startup, which needs the RBAC permission to get nodes
+  (a ClusterRole with "get" on "nodes"). Flags take precedence over the node labels; a failed
+  detection is logged and the flags alone are reported.
+- hostNetwork is detected by comparing the network namespace with the one of PID 1. In pods
+  without hostPID, mount the host /proc and set HOST_PROC to it, or set NODE_NAME so the
+  hostname can be compared with the node name instead.
+- Hardware receive timestamps are only reported once hardware timestamping is enabled on the
+  NIC (e.g. hwstamp_ctl -i eth0 -r 1), and they use the NIC clock: run phc2sys to sync it with
+  the system clock. Otherwise the software timestamp taken by the kernel is reported.
+- For one-way latency, send the send time in nanoseconds and subtract it from KernelRxUnixNano:
+  date +%s%N | nc -u -w1 localhost 8080
+- The checksum error counters are the ones of the whole network namespace (/proc/net/snmp and
+  snmp6), so other UDP sockets of the namespace contribute to them. The server cannot tell whether
+  an accepted packet had a zero checksum, since the kernel does not report it.
+- A redirected reply is sent from the socket of the server, so it keeps the server address and port
+  as its source: conntrack on the path sees a reply for a flow it never saw the request of, or no
+  reply at all for the original flow. The data of a request is only parsed as an envelope when it
+  is a JSON object with a ReplyTo field.
+- With -syscall-sampling, a read sample is the time spent in recvmsg(2) once the socket is readable,
+  not the wait for the next datagram, while a write sample is the whole send call.
+- The -config file is polled rather than watched, since a ConfigMap mount is updated by swapping a
+  symlink; the kubelet takes up to a minute or so to update the mount. A config that does not parse
+  is logged and ignored, the previous generation stays in effect.
+- The DNS responder answers a question with the records of its type only, e.g. an MX query gets
+  NOERROR without answers, and no CNAME is followed. Requests that do not parse as a DNS query are
+  echoed as usual. An error injected by -config is answered with SERVFAIL.
+- Resources is read from the cgroup of the server for each reply, like with the HTTP server. Its
+  counters are cumulative, compare the replies of the start and the end of a run.
+- A request handler includes the -config delay and the DNS answer, so keep -handler-deadline above the
+  configured delay. The threshold alert is logged once when crossing it and again after falling back
+  under it, while each overdue handler is logged once, and again if it eventually returns. Unlike
+  -max-goroutines, these alerts never reject requests.
+- RTT pings are answered in the read loop as soon as they are read: they bypass the -config behaviors,
+  the resource caps, the handler tracking and the DNS responder, and are not logged, so thousands of
+  pings per second do not flood the log. They are counted as Pings in the diagnostic bundle. The hold
+  time starts at the kernel receive timestamp, so the RTT excludes the queueing in the socket buffer of
+  the server.
 
 Testing with netcat (nc) on Linux:
 - To test the server, you can use the following netcat commands:
@@ -22,29 +134,91 @@ Testing with netcat (nc) on Linux:
      echo "your data here" | nc -u -w1 localhost 8080
   2. Listen for responses from the server:
      nc -u -l 8080
+- To send the reply to a listener on 10.244.1.7:9000 instead of the client, use:
+  go run udp_server.go -reply-to-allow=10.244.0.0/16 &
+  echo '{"ReplyTo":"10.244.1.7:9000","EchoData":"hello"}' | nc -u -w1 localhost 8080
+- To get the goroutines, open file descriptors and socket states of the server, use:
+  go run udp_server.go -status-port=8081 &
+  curl http://127.0.0.1:8081/status
+- To be alerted when more than 1000 handlers pile up or one runs for over 5s, and list the oldest ones, use:
+  go run udp_server.go -status-port=8081 -handler-threshold=1000 -handler-deadline=5s &
+  curl http://127.0.0.1:8081/handlers | jq '{Active, Peak, OverdueTotal, Oldest}'
+- To get the diagnostic bundle of a hanging server, or write it to a file in -dump-dir, use:
+  curl http://127.0.0.1:8081/debug/dump | jq .RecentRequests
+  kill -QUIT <pid>
+- To get the percentiles of the syscalls and of the request handling, use:
+  go run udp_server.go -status-port=8081 -syscall-sampling &
+  curl http://127.0.0.1:8081/syscalls
+- To delay the replies by 100ms, then change the delay without restarting the server, use:
+  echo '{"Delay":"100ms"}' > behavior.json && go run udp_server.go -config=behavior.json -status-port=8081 &
+  echo '{"Delay":"500ms"}' > behavior.json; sleep 3; curl http://127.0.0.1:8081/config
+- To measure the RTT and jitter to the server with 1000 pings of 64 bytes every 10ms, use:
+  go run client.go rtt -target=127.0.0.1:8080 -count=1000 -interval=10ms -size=64
+- To answer any DNS query on port 53 with 10.0.0.1, use:
+  go run udp_server.go -port=53 -dns-responder -dns-records=A=10.0.0.1,TXT=sink &
+  dig @127.0.0.1 kubernetes.default.svc.cluster.local +short
 */
 
 package main
 
 import (
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"main/common"
 	"net"
-	"os"
+	"net/http"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 var requestCount int
 var mutex sync.Mutex
+var identity *common.IdentityProvider
+var hostNetwork bool
+var fingerprint *common.FingerprintProvider
+var reportResources bool
+var checksumStats *common.UDPChecksumStats
+var checksumBaseline4, checksumBaseline6 uint64
+var resourceGuard *common.ResourceGuard
+var replyToAllow []*net.IPNet
+var diagnostics *common.Diagnostics
+var syscallSampler *common.SyscallSampler
+var behaviors *common.BehaviorProvider
+var handlers *common.HandlerTracker
+var dnsRecords map[uint16][]string // The records of the DNS responder by type, nil when disabled
+var dnsTTL uint32
+var pingCount atomic.Uint64 // The requests of the RTT ping protocol answered
 
 func main() {
 	// Define command-line flags
 	help := flag.Bool("h", false, "Display help information")
 	port := flag.String("port", "8080", "Specify the UDP port for the server to listen on")
+	reflectFlowLabel := flag.Bool("reflect-flow-label", false, "Send the reply with the IPv6 flow label of the request")
+	withFingerprint := flag.Bool("fingerprint", false, "Include the kernel and OS fingerprint of the node in responses")
+	flag.BoolVar(&reportResources, "report-resources", false, "Include the cgroup CPU and memory limits and usage of the container in responses")
+	zeroChecksumRx := flag.Bool("udp6-zero-checksum-rx", false, "Accept IPv6 packets with a zero UDP checksum")
+	zeroChecksumTx := flag.Bool("udp6-zero-checksum-tx", false, "Send replies over IPv6 with a zero UDP checksum")
+	withChecksumStats := flag.Bool("checksum-stats", false, "Report the UDP checksum error counters")
+	maxGoroutines := flag.Int("max-goroutines", 0, "Reject requests while the server has more goroutines (0 for no cap)")
+	maxFDs := flag.Int("max-fds", 0, "Reject requests while the server has more open file descriptors (0 for no cap)")
+	statusPort := flag.String("status-port", "", "Serve the resource usage on /status on this TCP port")
+	dumpDir := flag.String("dump-dir", "", "The directory of the diagnostic bundles (default is the temporary directory)")
+	replyToAllowList := flag.String("reply-to-allow", "", "The CIDRs (or IPs) a request may redirect its reply to, e.g. 10.244.0.0/16 (default is none)")
+	syscallSampling := flag.Bool("syscall-sampling", false, "Sample the duration of the read and write syscalls, reported on /syscalls of -status-port")
+	configFile := flag.String("config", "", "A JSON config file of behavior settings (delay, error rate), reloaded when it changes")
+	configPoll := flag.Duration("config-poll", 2*time.Second, "How often the -config file is checked for changes")
+	handlerThreshold := flag.Int("handler-threshold", 0, "Log an alert when more request handlers run at once (0 for no alert)")
+	handlerDeadline := flag.Duration("handler-deadline", 30*time.Second, "Log an alert for each request handler running for longer (0 for no alert)")
+	dnsResponder := flag.Bool("dns-responder", false, "Answer the requests that are DNS queries with the -dns-records record set")
+	dnsRecordList := flag.String("dns-records", "", "The records of the DNS responder for any queried name, e.g. A=10.0.0.1,AAAA=fd00::1,TXT=sink")
+	dnsTTLFlag := flag.Uint("dns-ttl", 30, "The TTL of the records of the DNS responder, in seconds")
+	topologyFlags := common.RegisterTopologyFlags()
 	flag.Parse()
 
 	// If the -h flag is set, display help information and exit
@@ -53,6 +227,56 @@ func main() {
 		return
 	}
 
+	if *replyToAllowList != "" {
+		allow, err := common.ParseCIDRList(*replyToAllowList)
+		if err != nil {
+			log.Fatalf("Invalid -reply-to-allow: %v", err)
+		}
+		replyToAllow = allow
+	}
+
+	if *dnsResponder {
+		records, err := parseDNSRecords(*dnsRecordList)
+		if err != nil {
+			log.Fatalf("Invalid -dns-records: %v", err)
+		}
+		dnsRecords = records
+		dnsTTL = uint32(*dnsTTLFlag)
+	} else if *dnsRecordList != "" {
+		log.Fatalf("-dns-records requires -dns-responder")
+	}
+
+	if *syscallSampling {
+		if err := common.CheckSyscallSampling(); err != nil {
+			log.Fatalf("Invalid -syscall-sampling: %v", err)
+		}
+		syscallSampler = common.NewSyscallSampler()
+	}
+
+	if *configFile != "" {
+		var err error
+		if behaviors, err = common.NewBehaviorProvider(*configFile); err != nil {
+			log.Fatalf("Invalid -config: %v", err)
+		}
+		behaviors.Watch(*configPoll)
+	}
+
+	identity = common.NewIdentityProvider()
+	identity.SetTopology(topologyFlags.Resolve())
+
+	detected, method, err := common.DetectHostNetwork()
+	if err != nil {
+		log.Printf("Unable to detect hostNetwork, reporting false: %v", err)
+	} else {
+		log.Printf("HostNetwork: %t (%s)", detected, method)
+	}
+	hostNetwork = detected
+
+	if *withFingerprint {
+		fingerprint = common.NewFingerprintProvider()
+		fingerprint.RefreshOnHangup()
+	}
+
 	// Start the UDP server
 	address := fmt.Sprintf(":%s", *port)
 	udpAddr, err := net.ResolveUDPAddr("udp", address)
@@ -66,30 +290,174 @@ func main() {
 	}
 	defer conn.Close()
 
+	if err := common.EnableFlowLabelRecv(conn); err != nil {
+		log.Printf("Unable to receive IPv6 flow labels: %v", err)
+	}
+	if err := common.EnableRxTimestamps(conn); err != nil {
+		log.Printf("Unable to receive kernel timestamps: %v", err)
+	}
+
+	if *zeroChecksumRx || *zeroChecksumTx || *withChecksumStats {
+		if *zeroChecksumRx || *zeroChecksumTx {
+			if err := common.SetUDP6ZeroChecksum(conn, *zeroChecksumRx, *zeroChecksumTx); err != nil {
+				log.Fatalf("Unable to set the zero UDP checksum options: %v", err)
+			}
+		}
+		checksumStats = &common.UDPChecksumStats{ZeroChecksumRx: *zeroChecksumRx, ZeroChecksumTx: *zeroChecksumTx}
+		if checksumBaseline4, checksumBaseline6, err = common.ReadUDPChecksumErrors(); err != nil {
+			log.Printf("Unable to read the UDP checksum error counters: %v", err)
+		}
+	}
+
+	resourceGuard = common.NewResourceGuard(*maxGoroutines, *maxFDs)
+	handlers = common.NewHandlerTracker(*handlerThreshold, *handlerDeadline, max(time.Millisecond, min(time.Second, *handlerDeadline/2)))
+
+	diagnostics = common.NewDiagnostics("udp", common.RecentRequestsKept, *dumpDir, func() map[string]interface{} {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return map[string]interface{}{"Requests": requestCount, "Pings": pingCount.Load(), "Handlers": handlers.Stats()}
+	}, identity, resourceGuard)
+	diagnostics.DumpOnQuit()
+	if *statusPort != "" {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(resourceGuard.Status())
+		})
+		mux.Handle("/debug/dump", diagnostics)
+		mux.HandleFunc("/handlers", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(handlers.Stats())
+		})
+		mux.HandleFunc("/config", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(behaviors.Get())
+		})
+		mux.HandleFunc("/syscalls", func(w http.ResponseWriter, r *http.Request) {
+			if syscallSampler == nil {
+				http.Error(w, "Syscall sampling is disabled, start the server with -syscall-sampling", http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(syscallSampler.Report(r.URL.Query().Get("reset") == "true"))
+		})
+		go func() {
+			fmt.Printf("Status server is listening on port %s\n", *statusPort)
+			if err := http.ListenAndServe(fmt.Sprintf(":%s", *statusPort), common.NewChain(common.Recover).Then(mux)); err != nil {
+				log.Fatalf("Status server failed to start: %v", err)
+			}
+		}()
+	}
+
 	fmt.Printf("UDP server is listening on port %s\n", *port)
 
-	buffer := make([]byte, 1024)
+	buffer := make([]byte, 65535) // Large enough for any UDP datagram
+	oob := make([]byte, 256)
 	for {
-		n, addr, err := conn.ReadFromUDP(buffer)
+		var n, oobn int
+		var addr *net.UDPAddr
+		var readSyscall time.Duration
+		if syscallSampler != nil {
+			n, oobn, _, addr, readSyscall, err = common.ReadMsgUDPSampled(conn, buffer, oob, syscallSampler)
+		} else {
+			n, oobn, _, addr, err = conn.ReadMsgUDP(buffer, oob)
+		}
+		readTime := time.Now()
 		if err != nil {
 			log.Printf("Error reading from UDP: %v", err)
 			continue
 		}
 
-		go handleUDPRequest(conn, addr, buffer[:n], *port)
+		var flowLabel *int
+		if label, ok := common.ParseFlowLabel(oob[:oobn]); ok {
+			flowLabel = &label
+		}
+
+		rxTimestamp := rxTimestampInfo{readTime: readTime, readSyscall: readSyscall}
+		rxTimestamp.time, rxTimestamp.source, rxTimestamp.ok = common.ParseRxTimestamp(oob[:oobn])
+
+		// Answer the RTT pings right away, without JSON nor a goroutine, so their replies are not
+		// delayed by the handling of other requests
+		if common.IsPingRequest(buffer[:n]) {
+			answerPing(conn, addr, buffer[:n], rxTimestamp)
+			continue
+		}
+
+		// Reject over the caps without starting a goroutine for the request
+		if err := resourceGuard.Admit(); err != nil {
+			log.Printf("Rejected request from %s: %v", addr, err)
+			rejectUDPRequest(conn, addr, err, behaviors.Get().Generation)
+			diagnostics.Record(common.RecentRequest{
+				Time:    readTime.Format(time.RFC3339Nano),
+				Client:  addr.String(),
+				Request: fmt.Sprintf("%d bytes", n),
+				Status:  "rejected: " + err.Error(),
+			})
+			continue
+		}
+
+		// The buffer is reused by the next read, so the handler gets its own copy of the data
+		data := append([]byte(nil), buffer[:n]...)
+		finished := handlers.Start(addr.String())
+		go func() {
+			defer finished()
+			handleUDPRequest(conn, addr, data, *port, flowLabel, *reflectFlowLabel, rxTimestamp)
+		}()
 	}
 }
 
+// rxTimestampInfo holds the receive timestamp of a packet and when the server read it
+type rxTimestampInfo struct {
+	time        time.Time
+	source      string
+	ok          bool
+	readTime    time.Time
+	readSyscall time.Duration // The duration of the recvmsg syscall, with -syscall-sampling
+}
+
 // handleUDPRequest processes incoming UDP requests
-func handleUDPRequest(conn *net.UDPConn, addr *net.UDPAddr, data []byte, port string) {
+func handleUDPRequest(conn *net.UDPConn, addr *net.UDPAddr, data []byte, port string, flowLabel *int, reflectFlowLabel bool, rxTimestamp rxTimestampInfo) {
 	mutex.Lock()
 	requestCount++
 	currentRequestCount := requestCount
 	mutex.Unlock()
 
-	serverHostName, err := os.Hostname()
-	if err != nil {
-		log.Printf("Unable to get hostname: %v", err)
+	// With -dns-responder, the requests that parse as DNS queries get a DNS answer instead of the echo
+	query := parseDNSQuery(data)
+	request := fmt.Sprintf("%d bytes", len(data))
+	if query != nil {
+		request = fmt.Sprintf("DNS %s %s", query.Questions[0].Name, query.Questions[0].Type)
+	}
+
+	status := "replied"
+	defer func() {
+		diagnostics.Record(common.RecentRequest{
+			Time:       rxTimestamp.readTime.Format(time.RFC3339Nano),
+			Client:     addr.String(),
+			Request:    request,
+			Status:     status,
+			DurationMs: float64(time.Since(rxTimestamp.readTime).Microseconds()) / 1000,
+		})
+	}()
+
+	// The behavior of the config is read once, so the whole request follows the same generation
+	behavior := behaviors.Get()
+	if delay := behavior.NextDelay(); delay > 0 {
+		time.Sleep(delay)
+	}
+	injectError := behavior.InjectError()
+	if injectError && query == nil {
+		log.Printf("Injected an error for %s (config generation %d)", addr, behavior.Generation)
+		rejectUDPRequest(conn, addr, errors.New("injected error"), behavior.Generation)
+		status = "injected error"
+		return
+	}
+
+	serverIdentity := identity.Get()
+	serverHostName := serverIdentity.HostName
+	if serverHostName == "" {
+		log.Printf("Unable to get hostname")
+		status = "no hostname, not replied"
 		return
 	}
 
@@ -97,10 +465,49 @@ func handleUDPRequest(conn *net.UDPConn, addr *net.UDPAddr, data []byte, port st
 	clientPort := fmt.Sprintf("%d", addr.Port)
 	serverIP, ipVersion := getServerIPAndVersion(addr)
 
+	envList := common.GetEnvironmentVariables("ENV_")
+
+	if query != nil {
+		// An injected error is a SERVFAIL, so the resolver of the client sees a failing server
+		rcode := dnsRcodeNoError
+		if injectError {
+			rcode = dnsRcodeServFail
+		}
+		status = answerDNSQuery(conn, addr, query, rcode, common.UdpServerResponse{
+			ServerHostName:   serverHostName,
+			ClientIP:         clientIP,
+			ClientPort:       clientPort,
+			ServerIP:         serverIP,
+			ServerPort:       port,
+			IPVersion:        ipVersion,
+			ClientEchoData:   request,
+			RequestTimestamp: time.Now().Format(time.RFC3339),
+			RequestCounter:   currentRequestCount,
+			ServerType:       "udp",
+			EnvList:          envList,
+			Identity:         serverIdentity,
+			HostNetwork:      hostNetwork,
+			FlowLabel:        flowLabel,
+			ConfigGeneration: behavior.Generation,
+		})
+		return
+	}
+
 	echoData := string(data)
 	log.Printf("Received request from %s:%s with data: %s", clientIP, clientPort, echoData)
 
-	envList := common.GetEnvironmentVariables("ENV_")
+	var err error
+	replyAddr := addr
+	envelope, isEnvelope := parseEnvelope(data)
+	var replyToError string
+	if isEnvelope {
+		echoData = envelope.EchoData
+		if replyAddr, err = resolveReplyTo(envelope.ReplyTo); err != nil {
+			replyAddr = addr
+			replyToError = err.Error()
+			log.Printf("Refused to reply to %s for %s:%s: %v", envelope.ReplyTo, clientIP, clientPort, err)
+		}
+	}
 
 	response := common.UdpServerResponse{
 		ServerHostName:   serverHostName,
@@ -114,11 +521,205 @@ func handleUDPRequest(conn *net.UDPConn, addr *net.UDPAddr, data []byte, port st
 		RequestCounter:   currentRequestCount,
 		ServerType:       "udp",   // Set server type to udp
 		EnvList:          envList, // Add environment variables to the response
+		Identity:         serverIdentity,
+		HostNetwork:      hostNetwork,
+		FlowLabel:        flowLabel,
+		ReplyToError:     replyToError,
+		ConfigGeneration: behavior.Generation,
+	}
+	if replyAddr != addr {
+		response.ReplyTo = replyAddr.String()
+	}
+
+	if fingerprint != nil {
+		nodeFingerprint := fingerprint.Get()
+		response.Fingerprint = &nodeFingerprint
+	}
+
+	if reportResources {
+		response.Resources = common.ReadCgroupResources()
+	}
+
+	if checksumStats != nil {
+		stats := *checksumStats
+		if errors4, errors6, err := common.ReadUDPChecksumErrors(); err == nil {
+			stats.InCsumErrors4 = errors4 - checksumBaseline4
+			stats.InCsumErrors6 = errors6 - checksumBaseline6
+		}
+		response.Checksum = &stats
+	}
+
+	if rxTimestamp.ok {
+		response.KernelRxTimestamp = rxTimestamp.time.Format(time.RFC3339Nano)
+		response.KernelRxUnixNano = rxTimestamp.time.UnixNano()
+		response.KernelRxTimestampSource = rxTimestamp.source
+		// The hardware clock of the NIC is not comparable with the system clock unless synced
+		if rxTimestamp.source == "software" {
+			delay := float64(rxTimestamp.readTime.Sub(rxTimestamp.time).Microseconds()) / 1000
+			response.ReceiveDelayMs = &delay
+		}
+	}
+
+	// Reflect the flow label of the request on the reply
+	var oob []byte
+	if reflectFlowLabel && flowLabel != nil && replyAddr.IP.To4() == nil {
+		if oob, err = common.FlowLabelOOB(conn, replyAddr.IP, *flowLabel); err != nil {
+			log.Printf("Unable to set the IPv6 flow label: %v", err)
+		}
+	}
+
+	if syscallSampler != nil {
+		readSyscall := float64(rxTimestamp.readSyscall) / float64(time.Microsecond)
+		response.ReadSyscallMicros = &readSyscall
+		syscallSampler.Observe("handle", time.Since(rxTimestamp.readTime))
 	}
 
-	if err := sendUDPResponse(conn, addr, response); err != nil {
+	if replyAddr != addr {
+		status = "replied to " + replyAddr.String()
+	}
+	if err := sendUDPResponse(conn, replyAddr, response, oob); err != nil {
 		log.Printf("Unable to send response: %v", err)
+		status = err.Error()
+	}
+}
+
+// answerPing replies to a request of the RTT ping protocol with how long the server held it, from
+// the kernel receive timestamp when it is a software one, or from the read of the request otherwise
+func answerPing(conn *net.UDPConn, addr *net.UDPAddr, packet []byte, rxTimestamp rxTimestampInfo) {
+	received := rxTimestamp.readTime
+	if rxTimestamp.ok && rxTimestamp.source == "software" {
+		received = rxTimestamp.time
 	}
+	common.MakePingReply(packet, time.Since(received))
+
+	start := time.Now()
+	_, err := conn.WriteToUDP(packet, addr)
+	syscallSampler.Observe("write", time.Since(start))
+	if err != nil {
+		log.Printf("Error sending ping reply to %s: %v", addr, err)
+		return
+	}
+	pingCount.Add(1)
+}
+
+// parseEnvelope returns the envelope of the data of a request, if it is a JSON object with a ReplyTo field
+func parseEnvelope(data []byte) (common.UDPRequestEnvelope, bool) {
+	var envelope common.UDPRequestEnvelope
+	trimmed := strings.TrimSpace(string(data))
+	if !strings.HasPrefix(trimmed, "{") || json.Unmarshal([]byte(trimmed), &envelope) != nil || envelope.ReplyTo == "" {
+		return envelope, false
+	}
+	return envelope, true
+}
+
+// resolveReplyTo checks the reply-to address of a request against the allowlist
+func resolveReplyTo(replyTo string) (*net.UDPAddr, error) {
+	if len(replyToAllow) == 0 {
+		return nil, fmt.Errorf("reply-to override is disabled, start the server with -reply-to-allow")
+	}
+	host, port, err := net.SplitHostPort(replyTo)
+	if err != nil {
+		return nil, fmt.Errorf("invalid reply-to address %q: %v", replyTo, err)
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid reply-to address %q: the host must be an IP address", replyTo)
+	}
+	portNumber, err := strconv.Atoi(port)
+	if err != nil || portNumber < 1 || portNumber > 65535 {
+		return nil, fmt.Errorf("invalid reply-to port %q", port)
+	}
+	if common.MatchCIDRList(replyToAllow, ip) != nil {
+		return &net.UDPAddr{IP: ip, Port: portNumber}, nil
+	}
+	return nil, fmt.Errorf("reply-to address %s is not in the allowlist", ip)
+}
+
+// DNS response codes of the DNS responder
+const (
+	dnsRcodeNoError  = 0
+	dnsRcodeServFail = 2
+)
+
+// parseDNSRecords parses the record set of the DNS responder, a comma-separated list of TYPE=value
+func parseDNSRecords(list string) (map[uint16][]string, error) {
+	records := make(map[uint16][]string)
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		typeName, value, ok := strings.Cut(item, "=")
+		if !ok || value == "" {
+			return nil, fmt.Errorf("invalid record %q, expected TYPE=value", item)
+		}
+		qtype, err := common.DNSTypeFromName(strings.TrimSpace(typeName))
+		if err != nil {
+			return nil, err
+		}
+		records[qtype] = append(records[qtype], strings.TrimSpace(value))
+	}
+
+	// Encode a response with each record once, so an invalid value fails at startup
+	query := &common.DNSMessage{Questions: []common.DNSQuestion{{Name: "check.", Class: 1}}}
+	for qtype, values := range records {
+		for _, value := range values {
+			answer := common.DNSAnswer{Name: "check.", Type: common.DNSTypeName(qtype), Data: value}
+			if _, err := common.BuildDNSResponse(query, dnsRcodeNoError, []common.DNSAnswer{answer}); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return records, nil
+}
+
+// parseDNSQuery returns the request as a DNS query when the DNS responder is enabled, or nil
+func parseDNSQuery(data []byte) *common.DNSMessage {
+	if dnsRecords == nil {
+		return nil
+	}
+	query, err := common.ParseDNSMessage(data)
+	if err != nil || query.Response || len(query.Questions) == 0 {
+		return nil
+	}
+	return query
+}
+
+// answerDNSQuery answers a DNS query with the records of its question types, logs the exchange
+// in the JSON format of the replies, and returns the status of the request
+func answerDNSQuery(conn *net.UDPConn, addr *net.UDPAddr, query *common.DNSMessage, rcode int, response common.UdpServerResponse) string {
+	var answers []common.DNSAnswer
+	if rcode == dnsRcodeNoError {
+		for _, question := range query.Questions {
+			for _, value := range dnsRecords[question.QType] {
+				answers = append(answers, common.DNSAnswer{Name: question.Name, Type: question.Type, TTL: dnsTTL, Data: value})
+			}
+		}
+	}
+
+	reply, err := common.BuildDNSResponse(query, rcode, answers)
+	if err != nil {
+		log.Printf("Unable to encode the DNS response for %s: %v", addr, err)
+		return err.Error()
+	}
+	response.DNS = &common.DNSMessage{
+		ID:        query.ID,
+		Response:  true,
+		Rcode:     common.DNSRcodeName(rcode),
+		Questions: query.Questions,
+		Answers:   answers,
+	}
+	responseJSON, _ := json.Marshal(response)
+	log.Printf("Answered DNS query from %s: %s", addr, responseJSON)
+
+	start := time.Now()
+	_, err = conn.WriteToUDP(reply, addr)
+	syscallSampler.Observe("write", time.Since(start))
+	if err != nil {
+		log.Printf("Error sending DNS response to %s: %v", addr, err)
+		return err.Error()
+	}
+	return fmt.Sprintf("DNS %s, %d answers", response.DNS.Rcode, len(answers))
 }
 
 // getServerIPAndVersion determines the server IP and whether the request is IPv4 or IPv6
@@ -130,14 +731,35 @@ func getServerIPAndVersion(addr *net.UDPAddr) (string, string) {
 	return ip.String(), "IPv6"
 }
 
+// rejectUDPRequest replies to a request rejected over the resource caps, or answered with an
+// error injected by the config
+func rejectUDPRequest(conn *net.UDPConn, addr *net.UDPAddr, reason error, generation uint64) {
+	responseJSON, _ := json.Marshal(common.OverloadResponse{
+		ServerHostName:   identity.Get().HostName,
+		ServerType:       "udp",
+		Rejected:         true,
+		Topology:         identity.Get().Topology,
+		Reason:           reason.Error(),
+		ConfigGeneration: generation,
+	})
+	start := time.Now()
+	_, err := conn.WriteToUDP(responseJSON, addr)
+	syscallSampler.Observe("write", time.Since(start))
+	if err != nil {
+		log.Printf("Error sending rejection to %s: %v", addr, err)
+	}
+}
+
 // sendUDPResponse marshals the response data to JSON and sends it back to the client
-func sendUDPResponse(conn *net.UDPConn, addr *net.UDPAddr, response common.UdpServerResponse) error {
+func sendUDPResponse(conn *net.UDPConn, addr *net.UDPAddr, response common.UdpServerResponse, oob []byte) error {
 	responseJSON, err := json.Marshal(response)
 	if err != nil {
 		return fmt.Errorf("unable to marshal response data: %v", err)
 	}
 
-	_, err = conn.WriteToUDP(responseJSON, addr)
+	start := time.Now()
+	_, _, err = conn.WriteMsgUDP(responseJSON, oob, addr)
+	syscallSampler.Observe("write", time.Since(start))
 	if err != nil {
 		return fmt.Errorf("unable to send response: %v", err)
 	}
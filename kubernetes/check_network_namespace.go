@@ -1,7 +1,7 @@
 package main
 
 /*
-本程序用于检查给定进程ID (PID) 是否与主机共享网络命名空间。
+本程序用于检查给定进程、网络命名空间、容器或 Pod 是否与主机共享网络命名空间。
 
 主要功能：
 1. 接受一个进程ID作为命令行参数。
@@ -9,28 +9,87 @@ package main
 3. 获取目标进程的网络命名空间。
 4. 比较两个网络命名空间是否相同。
 5. 输出结果，说明目标进程是否与主机共享网络命名空间。
+6. 除了 PID，也可以用以下方式指定要检查的网络命名空间，省去先找到 PID 的步骤
+   （在 PID 命名空间被重新映射的节点上，找到 PID 往往是最困难的一步）：
+   - -netns：网络命名空间文件的路径，或 /var/run/netns 下的名称（例如 ip netns 和 CNI 创建的 cni-xxxx）。
+   - -container：容器 ID（可以是前缀），通过 CRI 的 ContainerStatus 接口获取容器进程的 PID；
+     CRI 不可用或未返回 PID 时，扫描各进程的 /proc/<pid>/cgroup 查找属于该容器的进程。
+   - -pod：<namespace>/<name> 形式的 Pod 名称，通过 CRI 的 ListPodSandbox 和 PodSandboxStatus 接口
+     获取 Pod sandbox 的网络命名空间路径或 PID；使用 hostNetwork 的 Pod 直接由 CRI 上报的命名空间模式判断。
 
 使用方法：
 go run check_network_namespace.go <PID>
+go run check_network_namespace.go -netns <path 或 /var/run/netns 下的名称>
+go run check_network_namespace.go -container <container-id> [-cri-socket=<path>] [-timeout=3s]
+go run check_network_namespace.go -pod <namespace>/<name> [-cri-socket=<path>] [-timeout=3s]
 
 注意事项：
 - 本程序需要在Linux环境下运行。
 - 需要root权限或足够的权限来访问进程的网络命名空间。
 - 程序使用github.com/vishvananda/netns库来处理网络命名空间操作。
+- -container 和 -pod 需要访问 CRI socket，未指定 -cri-socket 时，会依次尝试 containerd、CRI-O 和 cri-dockerd 的默认 socket 路径。
+- CRI 上报的 PID 和 /proc 中的 PID 都是节点（本程序所在 PID 命名空间）视角的 PID，
+  因此本程序应在节点上运行，或在使用 hostPID 的 Pod 中运行。
+- -pod 只检查处于 Ready 状态的 sandbox；同名 Pod 被重建后，检查的是最新创建的 sandbox。
 
 此程序对于理解容器化环境中进程的网络隔离状态非常有用，
 可用于调试、安全审计和系统管理等场景。
 */
 
 import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
 	"fmt"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/vishvananda/netns"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
 )
 
-func checkNetworkNamespace(pid int) (bool, error) {
+// netnsRunDir 是 ip netns 和 CNI 存放具名网络命名空间的目录
+const netnsRunDir = "/var/run/netns"
+
+// defaultCRISockets 是常见 CRI 运行时的默认 socket 路径
+var defaultCRISockets = []string{
+	"/run/containerd/containerd.sock",
+	"/var/run/crio/crio.sock",
+	"/var/run/cri-dockerd.sock",
+}
+
+// criVerboseInfo 是 CRI 运行时在 verbose 模式下返回的 info 中与网络命名空间有关的字段
+type criVerboseInfo struct {
+	Pid         int `json:"pid"`
+	RuntimeSpec struct {
+		Linux struct {
+			Namespaces []struct {
+				Type string `json:"type"`
+				Path string `json:"path"`
+			} `json:"namespaces"`
+		} `json:"linux"`
+	} `json:"runtimeSpec"`
+}
+
+// nsTarget 描述要检查的网络命名空间
+type nsTarget struct {
+	description string // 用于输出的描述，例如 "Process with PID 1234"
+	pid         int    // 非 0 时从 /proc/<pid>/ns/net 获取网络命名空间
+	path        string // 非空时从该路径获取网络命名空间
+	hostNetwork bool   // CRI 上报该 Pod 使用节点的网络命名空间
+}
+
+func checkNetworkNamespace(target nsTarget) (bool, error) {
+	if target.hostNetwork {
+		return true, nil
+	}
+
 	// 获取宿主机（PID 1）的网络命名空间
 	hostNS, err := netns.GetFromPath("/proc/1/ns/net")
 	if err != nil {
@@ -38,10 +97,15 @@ func checkNetworkNamespace(pid int) (bool, error) {
 	}
 	defer hostNS.Close()
 
-	// 获取目标进程的网络命名空间
-	targetNS, err := netns.GetFromPid(pid)
+	// 获取目标的网络命名空间
+	var targetNS netns.NsHandle
+	if target.path != "" {
+		targetNS, err = netns.GetFromPath(target.path)
+	} else {
+		targetNS, err = netns.GetFromPid(target.pid)
+	}
 	if err != nil {
-		return false, fmt.Errorf("failed to get target process network namespace: %v", err)
+		return false, fmt.Errorf("failed to get target network namespace: %v", err)
 	}
 	defer targetNS.Close()
 
@@ -49,27 +113,256 @@ func checkNetworkNamespace(pid int) (bool, error) {
 	return hostNS.Equal(targetNS), nil
 }
 
+// resolveNetnsPath 将 /var/run/netns 下的名称转换为路径，已经是路径的参数保持不变
+func resolveNetnsPath(netnsArg string) (nsTarget, error) {
+	path := netnsArg
+	if !strings.Contains(netnsArg, "/") {
+		path = filepath.Join(netnsRunDir, netnsArg)
+	}
+	if _, err := os.Stat(path); err != nil {
+		return nsTarget{}, fmt.Errorf("network namespace %s not found: %v", netnsArg, err)
+	}
+	return nsTarget{description: fmt.Sprintf("Network namespace %s", path), path: path}, nil
+}
+
+// resolveContainer 获取容器进程的 PID
+//
+// 工作原理：
+// 1. 通过 CRI 的 ContainerStatus 接口（verbose 模式）读取运行时上报的容器进程 PID。
+// 2. CRI 不可用或未返回 PID 时，扫描 /proc/*/cgroup，查找 cgroup 路径中包含该容器 ID 的第一个进程。
+func resolveContainer(containerID, socket string, timeout time.Duration) (nsTarget, error) {
+	description := fmt.Sprintf("Container %s", containerID)
+
+	pid, criErr := containerPidFromCRI(containerID, socket, timeout)
+	if criErr == nil {
+		return nsTarget{description: fmt.Sprintf("%s (PID %d)", description, pid), pid: pid}, nil
+	}
+
+	pid, err := containerPidFromCgroups(containerID)
+	if err != nil {
+		return nsTarget{}, fmt.Errorf("unable to find the process of container %s: CRI: %v; cgroups: %v", containerID, criErr, err)
+	}
+	return nsTarget{description: fmt.Sprintf("%s (PID %d)", description, pid), pid: pid}, nil
+}
+
+// containerPidFromCRI 通过 CRI 的 ContainerStatus 接口获取容器进程的 PID
+func containerPidFromCRI(containerID, socket string, timeout time.Duration) (int, error) {
+	client, closeClient, err := newCRIClient(socket)
+	if err != nil {
+		return 0, err
+	}
+	defer closeClient()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	status, err := client.ContainerStatus(ctx, &runtimeapi.ContainerStatusRequest{ContainerId: containerID, Verbose: true})
+	if err != nil {
+		return 0, fmt.Errorf("ContainerStatus failed: %v", err)
+	}
+	if state := status.GetStatus().GetState(); state != runtimeapi.ContainerState_CONTAINER_RUNNING {
+		return 0, fmt.Errorf("container is %s, not running", state)
+	}
+
+	info, err := parseVerboseInfo(status.GetInfo())
+	if err != nil {
+		return 0, err
+	}
+	if info.Pid == 0 {
+		return 0, fmt.Errorf("the runtime did not report the PID of the container")
+	}
+	return info.Pid, nil
+}
+
+// containerPidFromCgroups 扫描 /proc/*/cgroup，返回 cgroup 路径中包含该容器 ID 的第一个进程的 PID
+func containerPidFromCgroups(containerID string) (int, error) {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return 0, err
+	}
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		if cgroupContains(fmt.Sprintf("/proc/%d/cgroup", pid), containerID) {
+			return pid, nil
+		}
+	}
+	return 0, fmt.Errorf("no process found in the cgroup of the container")
+}
+
+// cgroupContains 检查 cgroup 文件中是否有路径包含容器 ID
+func cgroupContains(cgroupPath, containerID string) bool {
+	file, err := os.Open(cgroupPath)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if strings.Contains(scanner.Text(), containerID) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolvePod 获取 Pod sandbox 的网络命名空间
+//
+// 工作原理：
+// 1. 通过 CRI 的 ListPodSandbox 接口，按 Pod 名称和命名空间标签查找 Ready 状态的 sandbox，有多个时使用最新创建的一个。
+// 2. CRI 上报该 sandbox 的网络命名空间模式为 NODE 时，该 Pod 使用 hostNetwork，与主机共享网络命名空间。
+// 3. 否则读取 PodSandboxStatus 接口 verbose 模式下的 info，优先使用运行时规格中的网络命名空间路径，其次使用 sandbox 进程的 PID。
+func resolvePod(pod, socket string, timeout time.Duration) (nsTarget, error) {
+	namespace, name, found := strings.Cut(pod, "/")
+	if !found || namespace == "" || name == "" {
+		return nsTarget{}, fmt.Errorf("invalid pod %q, expected <namespace>/<name>", pod)
+	}
+	description := fmt.Sprintf("Pod %s/%s", namespace, name)
+
+	client, closeClient, err := newCRIClient(socket)
+	if err != nil {
+		return nsTarget{}, err
+	}
+	defer closeClient()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	sandboxes, err := client.ListPodSandbox(ctx, &runtimeapi.ListPodSandboxRequest{
+		Filter: &runtimeapi.PodSandboxFilter{
+			State: &runtimeapi.PodSandboxStateValue{State: runtimeapi.PodSandboxState_SANDBOX_READY},
+			LabelSelector: map[string]string{
+				"io.kubernetes.pod.namespace": namespace,
+				"io.kubernetes.pod.name":      name,
+			},
+		},
+	})
+	if err != nil {
+		return nsTarget{}, fmt.Errorf("ListPodSandbox failed: %v", err)
+	}
+	var latest *runtimeapi.PodSandbox
+	for _, sandbox := range sandboxes.GetItems() {
+		if latest == nil || sandbox.GetCreatedAt() > latest.GetCreatedAt() {
+			latest = sandbox
+		}
+	}
+	if latest == nil {
+		return nsTarget{}, fmt.Errorf("no ready sandbox found for pod %s/%s", namespace, name)
+	}
+	description = fmt.Sprintf("%s (sandbox %s)", description, shortID(latest.GetId()))
+
+	status, err := client.PodSandboxStatus(ctx, &runtimeapi.PodSandboxStatusRequest{PodSandboxId: latest.GetId(), Verbose: true})
+	if err != nil {
+		return nsTarget{}, fmt.Errorf("PodSandboxStatus failed: %v", err)
+	}
+	if status.GetStatus().GetLinux().GetNamespaces().GetOptions().GetNetwork() == runtimeapi.NamespaceMode_NODE {
+		return nsTarget{description: description, hostNetwork: true}, nil
+	}
+
+	info, err := parseVerboseInfo(status.GetInfo())
+	if err != nil {
+		return nsTarget{}, err
+	}
+	for _, ns := range info.RuntimeSpec.Linux.Namespaces {
+		if ns.Type == "network" && ns.Path != "" {
+			return nsTarget{description: fmt.Sprintf("%s, netns %s", description, ns.Path), path: ns.Path}, nil
+		}
+	}
+	if info.Pid != 0 {
+		return nsTarget{description: fmt.Sprintf("%s, PID %d", description, info.Pid), pid: info.Pid}, nil
+	}
+	return nsTarget{}, fmt.Errorf("the runtime reported neither the network namespace nor the PID of sandbox %s", latest.GetId())
+}
+
+// newCRIClient 连接 CRI 运行时，未指定 socket 时自动探测默认路径
+func newCRIClient(socket string) (runtimeapi.RuntimeServiceClient, func(), error) {
+	if socket == "" {
+		for _, candidate := range defaultCRISockets {
+			if _, err := os.Stat(candidate); err == nil {
+				socket = candidate
+				break
+			}
+		}
+		if socket == "" {
+			return nil, nil, fmt.Errorf("no CRI socket found, tried: %s", strings.Join(defaultCRISockets, ", "))
+		}
+	}
+
+	conn, err := grpc.NewClient("unix://"+socket, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to create the CRI client for %s: %v", socket, err)
+	}
+	return runtimeapi.NewRuntimeServiceClient(conn), func() { conn.Close() }, nil
+}
+
+// parseVerboseInfo 解析 CRI verbose 模式返回的 info，containerd 和 CRI-O 都将其放在 "info" 键中
+func parseVerboseInfo(info map[string]string) (criVerboseInfo, error) {
+	var parsed criVerboseInfo
+	raw, ok := info["info"]
+	if !ok {
+		return parsed, fmt.Errorf("the runtime returned no verbose info")
+	}
+	if err := json.Unmarshal([]byte(raw), &parsed); err != nil {
+		return parsed, fmt.Errorf("unable to parse the verbose info: %v", err)
+	}
+	return parsed, nil
+}
+
+// shortID 返回 ID 的前 13 个字符，与 crictl 的输出一致
+func shortID(id string) string {
+	if len(id) > 13 {
+		return id[:13]
+	}
+	return id
+}
+
 func main() {
-	if len(os.Args) != 2 {
+	netnsArg := flag.String("netns", "", "网络命名空间文件的路径，或 /var/run/netns 下的名称")
+	containerID := flag.String("container", "", "容器 ID，通过 CRI 或 cgroup 找到容器进程")
+	pod := flag.String("pod", "", "<namespace>/<name> 形式的 Pod 名称，通过 CRI 找到 Pod sandbox")
+	criSocket := flag.String("cri-socket", "", "CRI 运行时 socket 路径（默认自动探测）")
+	timeout := flag.Duration("timeout", 3*time.Second, "CRI 请求的超时时间")
+	flag.Parse()
+
+	var target nsTarget
+	var err error
+	switch {
+	case *netnsArg != "":
+		target, err = resolveNetnsPath(*netnsArg)
+	case *containerID != "":
+		target, err = resolveContainer(*containerID, *criSocket, *timeout)
+	case *pod != "":
+		target, err = resolvePod(*pod, *criSocket, *timeout)
+	case flag.NArg() == 1:
+		var pid int
+		pid, err = strconv.Atoi(flag.Arg(0))
+		if err != nil {
+			fmt.Printf("Invalid PID: %v\n", err)
+			os.Exit(1)
+		}
+		target = nsTarget{description: fmt.Sprintf("Process with PID %d", pid), pid: pid}
+	default:
 		fmt.Println("Usage: go run check_network_namespace.go <PID>")
+		fmt.Println("       go run check_network_namespace.go -netns <path or name> | -container <id> | -pod <namespace>/<name>")
 		os.Exit(1)
 	}
-
-	pid, err := strconv.Atoi(os.Args[1])
 	if err != nil {
-		fmt.Printf("Invalid PID: %v\n", err)
+		fmt.Printf("Error resolving the target: %v\n", err)
 		os.Exit(1)
 	}
 
-	shared, err := checkNetworkNamespace(pid)
+	shared, err := checkNetworkNamespace(target)
 	if err != nil {
 		fmt.Printf("Error checking network namespace: %v\n", err)
 		os.Exit(1)
 	}
 
 	if shared {
-		fmt.Printf("Process with PID %d shares the host's network namespace.\n", pid)
+		fmt.Printf("%s shares the host's network namespace.\n", target.description)
 	} else {
-		fmt.Printf("Process with PID %d has its own network namespace.\n", pid)
+		fmt.Printf("%s has its own network namespace.\n", target.description)
 	}
 }
@@ -0,0 +1,280 @@
+/*
+本程序用于检查当前节点的网络就绪状态，在节点"看起来不对劲"时替代手工逐项排查。
+
+主要功能：
+1. 检查 kubelet 的 healthz 接口是否返回 ok。
+2. 检查 CRI 运行时 socket 是否可以响应（调用 CRI 的 Version 和 Status 接口），
+   并读取运行时上报的 RuntimeReady 和 NetworkReady 状态。
+3. 检查 CNI 配置目录中是否存在有效的配置文件，以及配置中引用的 CNI 插件二进制是否存在且可执行。
+4. 汇总所有检查结果，以 JSON 格式输出一个整体的节点网络就绪结论。
+
+使用方法：
+go run check_node_readiness.go [-kubelet-healthz=http://127.0.0.1:10248/healthz] [-cri-socket=<path>] \
+    [-cni-conf-dir=/etc/cni/net.d] [-cni-bin-dir=/opt/cni/bin] [-timeout=3s]
+
+注意事项：
+- 本程序需要在节点上运行（或在挂载了相关目录的 hostNetwork Pod 中运行）。
+- 未指定 -cri-socket 时，会依次尝试 containerd、CRI-O 和 cri-dockerd 的默认 socket 路径。
+- 访问 CRI socket 通常需要 root 权限。
+- 任意一项检查失败时，结论为 NotReady，程序以非零状态退出。
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+// defaultCRISockets 是常见 CRI 运行时的默认 socket 路径
+var defaultCRISockets = []string{
+	"/run/containerd/containerd.sock",
+	"/var/run/crio/crio.sock",
+	"/var/run/cri-dockerd.sock",
+}
+
+// CheckResult 结构体用于存储单项检查的结果
+type CheckResult struct {
+	Name      string            `json:"Name"`      // 检查项名称
+	Passed    bool              `json:"Passed"`    // 是否通过
+	Message   string            `json:"Message"`   // 结果说明
+	LatencyMs float64           `json:"LatencyMs"` // 检查耗时（毫秒）
+	Details   map[string]string `json:"Details"`   // 附加信息
+}
+
+// NodeReadinessReport 结构体用于存储节点网络就绪状态的汇总结果
+type NodeReadinessReport struct {
+	NodeName  string        `json:"NodeName"`  // 节点名称
+	Verdict   string        `json:"Verdict"`   // 整体结论：Ready 或 NotReady
+	Timestamp string        `json:"Timestamp"` // 检查时间
+	Checks    []CheckResult `json:"Checks"`    // 各项检查结果
+}
+
+func main() {
+	kubeletHealthz := flag.String("kubelet-healthz", "http://127.0.0.1:10248/healthz", "kubelet healthz 接口地址")
+	criSocket := flag.String("cri-socket", "", "CRI 运行时 socket 路径（默认自动探测）")
+	cniConfDir := flag.String("cni-conf-dir", "/etc/cni/net.d", "CNI 配置目录")
+	cniBinDir := flag.String("cni-bin-dir", "/opt/cni/bin", "CNI 插件二进制目录")
+	timeout := flag.Duration("timeout", 3*time.Second, "每项检查的超时时间")
+	flag.Parse()
+
+	nodeName, _ := os.Hostname()
+	report := NodeReadinessReport{
+		NodeName:  nodeName,
+		Verdict:   "Ready",
+		Timestamp: time.Now().Format(time.RFC3339),
+	}
+
+	report.Checks = append(report.Checks, timedCheck(func() CheckResult { return checkKubeletHealthz(*kubeletHealthz, *timeout) }))
+	report.Checks = append(report.Checks, timedCheck(func() CheckResult { return checkCRIRuntime(*criSocket, *timeout) }))
+	report.Checks = append(report.Checks, timedCheck(func() CheckResult { return checkCNI(*cniConfDir, *cniBinDir) }))
+
+	for _, check := range report.Checks {
+		if !check.Passed {
+			report.Verdict = "NotReady"
+		}
+	}
+
+	output, _ := json.MarshalIndent(report, "", "  ")
+	fmt.Println(string(output))
+
+	if report.Verdict != "Ready" {
+		os.Exit(1)
+	}
+}
+
+// timedCheck 执行一项检查并记录耗时
+func timedCheck(check func() CheckResult) CheckResult {
+	start := time.Now()
+	result := check()
+	result.LatencyMs = float64(time.Since(start).Microseconds()) / 1000
+	return result
+}
+
+// checkKubeletHealthz 检查 kubelet 的 healthz 接口是否返回 200 和 "ok"
+func checkKubeletHealthz(url string, timeout time.Duration) CheckResult {
+	result := CheckResult{Name: "kubelet-healthz", Details: map[string]string{"URL": url}}
+
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Get(url)
+	if err != nil {
+		result.Message = fmt.Sprintf("kubelet healthz 不可访问: %v", err)
+		return result
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	result.Details["StatusCode"] = fmt.Sprintf("%d", resp.StatusCode)
+	result.Details["Body"] = strings.TrimSpace(string(body))
+
+	if resp.StatusCode != http.StatusOK || strings.TrimSpace(string(body)) != "ok" {
+		result.Message = fmt.Sprintf("kubelet healthz 返回异常: %s %s", resp.Status, strings.TrimSpace(string(body)))
+		return result
+	}
+
+	result.Passed = true
+	result.Message = "kubelet 健康"
+	return result
+}
+
+// checkCRIRuntime 检查 CRI 运行时 socket 是否响应，并读取运行时和网络的就绪状态
+func checkCRIRuntime(socket string, timeout time.Duration) CheckResult {
+	result := CheckResult{Name: "cri-runtime", Details: map[string]string{}}
+
+	if socket == "" {
+		for _, candidate := range defaultCRISockets {
+			if _, err := os.Stat(candidate); err == nil {
+				socket = candidate
+				break
+			}
+		}
+		if socket == "" {
+			result.Message = fmt.Sprintf("未找到 CRI socket，已尝试: %s", strings.Join(defaultCRISockets, ", "))
+			return result
+		}
+	}
+	result.Details["Socket"] = socket
+
+	conn, err := grpc.NewClient("unix://"+socket, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		result.Message = fmt.Sprintf("无法创建 CRI 客户端: %v", err)
+		return result
+	}
+	defer conn.Close()
+
+	client := runtimeapi.NewRuntimeServiceClient(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	version, err := client.Version(ctx, &runtimeapi.VersionRequest{})
+	if err != nil {
+		result.Message = fmt.Sprintf("CRI socket 无响应: %v", err)
+		return result
+	}
+	result.Details["RuntimeName"] = version.RuntimeName
+	result.Details["RuntimeVersion"] = version.RuntimeVersion
+	result.Details["RuntimeApiVersion"] = version.RuntimeApiVersion
+
+	status, err := client.Status(ctx, &runtimeapi.StatusRequest{})
+	if err != nil {
+		result.Message = fmt.Sprintf("获取 CRI 运行时状态失败: %v", err)
+		return result
+	}
+
+	var notReady []string
+	for _, condition := range status.GetStatus().GetConditions() {
+		result.Details[condition.Type] = fmt.Sprintf("%t", condition.Status)
+		if !condition.Status {
+			notReady = append(notReady, fmt.Sprintf("%s (%s: %s)", condition.Type, condition.Reason, condition.Message))
+		}
+	}
+	if len(notReady) > 0 {
+		result.Message = fmt.Sprintf("CRI 运行时未就绪: %s", strings.Join(notReady, "; "))
+		return result
+	}
+
+	result.Passed = true
+	result.Message = fmt.Sprintf("CRI 运行时 %s %s 就绪", version.RuntimeName, version.RuntimeVersion)
+	return result
+}
+
+// checkCNI 检查 CNI 配置和插件二进制
+//
+// 工作原理：
+// 1. 按文件名排序读取配置目录中的 .conf、.conflist 和 .json 文件，与 kubelet/containerd 一样使用第一个有效配置。
+// 2. 解析配置中引用的所有插件类型（type 字段）。
+// 3. 检查每个插件在二进制目录中是否存在且可执行。
+func checkCNI(confDir, binDir string) CheckResult {
+	result := CheckResult{Name: "cni", Details: map[string]string{"ConfDir": confDir, "BinDir": binDir}}
+
+	var files []string
+	for _, pattern := range []string{"*.conf", "*.conflist", "*.json"} {
+		matches, _ := filepath.Glob(filepath.Join(confDir, pattern))
+		files = append(files, matches...)
+	}
+	sort.Strings(files)
+	if len(files) == 0 {
+		result.Message = fmt.Sprintf("CNI 配置目录 %s 中没有配置文件", confDir)
+		return result
+	}
+
+	var confFile string
+	var pluginTypes []string
+	for _, file := range files {
+		types, err := parseCNIPluginTypes(file)
+		if err != nil {
+			result.Details["Invalid:"+filepath.Base(file)] = err.Error()
+			continue
+		}
+		confFile, pluginTypes = file, types
+		break
+	}
+	if confFile == "" {
+		result.Message = fmt.Sprintf("CNI 配置目录 %s 中没有有效的配置文件", confDir)
+		return result
+	}
+	result.Details["ConfFile"] = confFile
+	result.Details["Plugins"] = strings.Join(pluginTypes, ",")
+
+	var missing []string
+	for _, pluginType := range pluginTypes {
+		info, err := os.Stat(filepath.Join(binDir, pluginType))
+		if err != nil || info.IsDir() || info.Mode()&0111 == 0 {
+			missing = append(missing, pluginType)
+		}
+	}
+	if len(missing) > 0 {
+		result.Message = fmt.Sprintf("CNI 插件缺失或不可执行: %s", strings.Join(missing, ", "))
+		return result
+	}
+
+	result.Passed = true
+	result.Message = fmt.Sprintf("CNI 配置 %s 及其插件就绪", filepath.Base(confFile))
+	return result
+}
+
+// parseCNIPluginTypes 解析 CNI 配置文件（单插件 .conf 或插件列表 .conflist）中引用的插件类型
+func parseCNIPluginTypes(file string) ([]string, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var conf struct {
+		Type    string `json:"type"`
+		Plugins []struct {
+			Type string `json:"type"`
+		} `json:"plugins"`
+	}
+	if err := json.Unmarshal(data, &conf); err != nil {
+		return nil, fmt.Errorf("无效的 JSON: %v", err)
+	}
+
+	var types []string
+	if conf.Type != "" {
+		types = append(types, conf.Type)
+	}
+	for _, plugin := range conf.Plugins {
+		if plugin.Type != "" {
+			types = append(types, plugin.Type)
+		}
+	}
+	if len(types) == 0 {
+		return nil, fmt.Errorf("配置中没有插件")
+	}
+	return types, nil
+}
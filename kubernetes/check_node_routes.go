@@ -0,0 +1,533 @@
+/*
+本程序用于在节点上检查到其他节点 Pod CIDR 的主机路由，是基于路由的 CNI（Calico BGP、kube-router、
+flannel host-gw 以及由 ToR 交换机通过 BGP 通告 Pod CIDR 的 underlay 网络等）跨节点流量不通时的第一步检查。
+
+主要功能：
+1. 通过 Kubernetes API 列出所有 Node，读取每个节点的 PodCIDRs（spec.podCIDRs，兼容旧的 spec.podCIDR）和 InternalIP。
+2. 通过 netlink 读取本节点指定路由表（默认为 main 表）中的路由，对每个节点的每个 Pod CIDR：
+   - 列出该 CIDR 及其内部更具体的路由，以及路由的协议（bird、bgp、zebra、kernel、boot、static 等），
+     用于判断路由是 BGP 学到的还是手工添加的；
+   - 按最长前缀匹配找出 CIDR 中第一个地址实际命中的路由，并给出内核的 ip route get 结果，
+     两者不一致时说明有策略路由在起作用；
+   - 判断转发方式：direct（下一跳为该节点的 IP）、tunnel（经过 ipip、vxlan、geneve、wireguard 等隧道设备）、
+     router（下一跳为其他路由器，例如 BGP 邻居 ToR）、device（直接从设备发出）或 local（本节点自己的 Pod CIDR）。
+3. 标出有问题的 Pod CIDR：
+   - MISSING：没有到该 CIDR 的路由，流量会走默认路由（或根本不可达）；
+   - BLACKHOLE：命中 blackhole、unreachable 或 prohibit 类型的路由；
+   - WRONG_NODE：路由（或其内部更具体的路由）的下一跳是其他节点的 IP；
+   - CONFLICT：同一个 CIDR 有多条下一跳不同的路由，或两个节点的 Pod CIDR 重叠；
+   - UNEXPECTED_PROTOCOL：指定 -expect-protocol 时，命中的路由不是由该协议安装的，例如残留的静态路由覆盖了 BGP 路由。
+4. 检查 underlay：对每个其他节点的 InternalIP 做路由查找，给出出接口、网关和接口 MTU，无法到达时标出 NODE_UNREACHABLE。
+5. 以 JSON 格式输出每个节点的检查结果和汇总，存在问题时以非零状态退出。
+
+使用方法：
+go run check_node_routes.go [-kubeconfig=<path>] [-node=<本节点名称>] [-table=254] [-expect-protocol=<bird|bgp|zebra|...>]
+
+参数说明：
+-kubeconfig: kubeconfig 文件路径（默认为 ~/.kube/config，文件不存在时使用 in-cluster 配置）
+-node: 本节点的名称，用于识别本节点自己的 Pod CIDR（默认为 $NODE_NAME，未设置时为主机名）
+-table: 检查的路由表（默认为 254，即 main 表）
+-expect-protocol: 期望 Pod CIDR 的路由由该协议安装，例如 Calico 的 bird，FRR 的 bgp 或 zebra（默认为不检查）
+
+示例：
+  go run check_node_routes.go | jq '.Nodes[] | select(.Problems | length > 0) | {Node, Problems}'
+  kubectl debug node/worker-1 -it --image=<包含本程序的镜像> -- check_node_routes -node=worker-1 -expect-protocol=bird
+
+注意事项：
+- 本程序需要在 Linux 节点的主机网络命名空间中运行（或在使用 hostNetwork 的 Pod 中运行），读取路由不需要 root 权限。
+- 读取 Node 需要 nodes 的 list 权限。
+- Cilium（native routing 之外）、flannel vxlan 等 overlay CNI 可能只有一条覆盖整个集群 CIDR 的隧道路由，
+  这种情况下各节点的 Pod CIDR 命中的是这条更大的路由，只要不是默认路由就不会标为 MISSING。
+- 本节点自己的 Pod CIDR 常见的是 Calico 的 blackhole 路由或网桥（cni0）路由，都是正常的，只检查其下一跳不是其他节点。
+- 路由查找使用 CIDR 中的第一个地址，不发送任何报文。
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// tunnelLinkTypes 是封装 Pod 流量的隧道设备类型
+var tunnelLinkTypes = map[string]bool{
+	"ipip": true, "ip6tnl": true, "sit": true, "gre": true, "ip6gre": true,
+	"vxlan": true, "geneve": true, "wireguard": true,
+}
+
+// RouteEntry 结构体用于存储一条路由
+type RouteEntry struct {
+	Destination   string   `json:"Destination"`   // 目的网段，默认路由为 default
+	Gateways      []string `json:"Gateways"`      // 下一跳，ECMP 路由有多个
+	Interface     string   `json:"Interface"`     // 出接口
+	InterfaceType string   `json:"InterfaceType"` // 出接口的类型，例如 ipip、vxlan、bridge
+	Type          string   `json:"Type"`          // 路由类型：unicast、blackhole、unreachable 或 prohibit
+	Protocol      string   `json:"Protocol"`      // 安装路由的协议，例如 bird、bgp、kernel、boot、static
+	Table         int      `json:"Table"`         // 路由表
+	Metric        int      `json:"Metric"`        // 路由的 metric
+}
+
+// CIDRRouteCheck 结构体用于存储一个 Pod CIDR 的检查结果
+type CIDRRouteCheck struct {
+	PodCIDR string       `json:"PodCIDR"` // 节点的 Pod CIDR
+	Status  string       `json:"Status"`  // OK、LOCAL 或问题的类型
+	Mode    string       `json:"Mode"`    // 转发方式：direct、tunnel、router、device 或 local
+	Matched *RouteEntry  `json:"Matched"` // CIDR 的第一个地址按最长前缀匹配命中的路由
+	Lookup  *RouteEntry  `json:"Lookup"`  // 内核对 CIDR 的第一个地址的路由查找结果（ip route get）
+	Routes  []RouteEntry `json:"Routes"`  // 该 CIDR 及其内部更具体的路由
+	Message string       `json:"Message"` // 结果说明
+}
+
+// UnderlayCheck 结构体用于存储到节点 IP 的 underlay 路由
+type UnderlayCheck struct {
+	NodeIP    string `json:"NodeIP"`    // 节点的 InternalIP
+	Reachable bool   `json:"Reachable"` // 是否有到该 IP 的路由
+	Interface string `json:"Interface"` // 出接口
+	Gateway   string `json:"Gateway"`   // 网关，直连时为空
+	MTU       int    `json:"MTU"`       // 出接口的 MTU
+	Error     string `json:"Error"`     // 路由查找失败的原因
+}
+
+// NodeRouteCheck 结构体用于存储一个节点的检查结果
+type NodeRouteCheck struct {
+	Node     string           `json:"Node"`     // 节点名称
+	Local    bool             `json:"Local"`    // 是否为本节点
+	NodeIPs  []string         `json:"NodeIPs"`  // 节点的 InternalIP
+	PodCIDRs []CIDRRouteCheck `json:"PodCIDRs"` // 各 Pod CIDR 的检查结果
+	Underlay []UnderlayCheck  `json:"Underlay"` // 到节点 IP 的 underlay 路由，本节点为空
+	Problems []string         `json:"Problems"` // 发现的问题
+}
+
+// RouteCheckSummary 结构体用于存储检查结果的汇总
+type RouteCheckSummary struct {
+	Nodes    int            `json:"Nodes"`    // 检查的节点数量
+	PodCIDRs int            `json:"PodCIDRs"` // 检查的 Pod CIDR 数量
+	Problems map[string]int `json:"Problems"` // 各类问题的数量
+	Healthy  bool           `json:"Healthy"`  // 是否没有发现问题
+}
+
+// RouteCheckReport 结构体用于存储整体的检查结果
+type RouteCheckReport struct {
+	LocalNode string            `json:"LocalNode"` // 本节点名称
+	Table     int               `json:"Table"`     // 检查的路由表
+	Timestamp string            `json:"Timestamp"` // 检查时间
+	Summary   RouteCheckSummary `json:"Summary"`   // 汇总
+	Nodes     []NodeRouteCheck  `json:"Nodes"`     // 各节点的检查结果
+}
+
+// nodeCIDR 是一个节点的一个 Pod CIDR
+type nodeCIDR struct {
+	node  string
+	cidr  *net.IPNet
+	check *CIDRRouteCheck
+}
+
+func main() {
+	kubeconfig := flag.String("kubeconfig", filepath.Join(os.Getenv("HOME"), ".kube", "config"), "kubeconfig 文件路径，文件不存在时使用 in-cluster 配置")
+	localNode := flag.String("node", os.Getenv("NODE_NAME"), "本节点的名称（默认为 $NODE_NAME，未设置时为主机名）")
+	table := flag.Int("table", unix.RT_TABLE_MAIN, "检查的路由表")
+	expectProtocol := flag.String("expect-protocol", "", "期望 Pod CIDR 的路由由该协议安装，例如 bird、bgp 或 zebra")
+	flag.Parse()
+
+	if *localNode == "" {
+		*localNode, _ = os.Hostname()
+	}
+
+	clientset, err := newClientset(*kubeconfig)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error creating Kubernetes client: %v\n", err)
+		os.Exit(1)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	nodes, err := clientset.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error listing nodes: %v\n", err)
+		os.Exit(1)
+	}
+
+	routes, err := netlink.RouteListFiltered(netlink.FAMILY_ALL, &netlink.Route{Table: *table}, netlink.RT_FILTER_TABLE)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error listing the routes of table %d: %v\n", *table, err)
+		os.Exit(1)
+	}
+	links := make(map[int]netlink.Link)
+	if list, err := netlink.LinkList(); err == nil {
+		for _, link := range list {
+			links[link.Attrs().Index] = link
+		}
+	}
+
+	// 节点 IP 到节点名称的映射，用于识别下一跳属于哪个节点
+	nodeByIP := make(map[string]string)
+	for _, node := range nodes.Items {
+		for _, ip := range nodeInternalIPs(node) {
+			nodeByIP[ip] = node.Name
+		}
+	}
+
+	report := RouteCheckReport{LocalNode: *localNode, Table: *table, Timestamp: time.Now().Format(time.RFC3339)}
+	report.Summary.Problems = make(map[string]int)
+	var allCIDRs []nodeCIDR
+	sort.Slice(nodes.Items, func(i, j int) bool { return nodes.Items[i].Name < nodes.Items[j].Name })
+	for _, node := range nodes.Items {
+		result := NodeRouteCheck{Node: node.Name, Local: node.Name == *localNode, NodeIPs: nodeInternalIPs(node)}
+		for _, podCIDR := range nodePodCIDRs(node) {
+			_, cidr, err := net.ParseCIDR(podCIDR)
+			if err != nil {
+				result.Problems = append(result.Problems, fmt.Sprintf("INVALID_CIDR: %s: %v", podCIDR, err))
+				continue
+			}
+			check := checkPodCIDR(node.Name, result.Local, cidr, routes, links, nodeByIP, *expectProtocol)
+			result.PodCIDRs = append(result.PodCIDRs, check)
+		}
+		if len(result.PodCIDRs) == 0 && len(result.Problems) == 0 {
+			result.Problems = append(result.Problems, "NO_POD_CIDR: the node has no podCIDR, the CNI may allocate its own IPAM blocks (e.g. Calico IPPools), which this check does not cover")
+		}
+		if !result.Local {
+			for _, ip := range result.NodeIPs {
+				underlay := checkUnderlay(ip, links)
+				if !underlay.Reachable {
+					result.Problems = append(result.Problems, fmt.Sprintf("NODE_UNREACHABLE: %s: %s", ip, underlay.Error))
+				}
+				result.Underlay = append(result.Underlay, underlay)
+			}
+		}
+		report.Nodes = append(report.Nodes, result)
+	}
+
+	// 记录各 Pod CIDR 的检查结果的位置，检查节点之间的 Pod CIDR 是否重叠
+	for i := range report.Nodes {
+		for j := range report.Nodes[i].PodCIDRs {
+			_, cidr, _ := net.ParseCIDR(report.Nodes[i].PodCIDRs[j].PodCIDR)
+			allCIDRs = append(allCIDRs, nodeCIDR{node: report.Nodes[i].Node, cidr: cidr, check: &report.Nodes[i].PodCIDRs[j]})
+		}
+	}
+	for i := range allCIDRs {
+		for j := i + 1; j < len(allCIDRs); j++ {
+			a, b := allCIDRs[i], allCIDRs[j]
+			if a.cidr.Contains(b.cidr.IP) || b.cidr.Contains(a.cidr.IP) {
+				for _, c := range []nodeCIDR{a, b} {
+					c.check.Status = "CONFLICT"
+					c.check.Message = fmt.Sprintf("the pod CIDR %s of node %s overlaps the pod CIDR %s of node %s", a.cidr, a.node, b.cidr, b.node)
+				}
+			}
+		}
+	}
+
+	for i := range report.Nodes {
+		result := &report.Nodes[i]
+		for _, check := range result.PodCIDRs {
+			report.Summary.PodCIDRs++
+			if check.Status != "OK" && check.Status != "LOCAL" {
+				result.Problems = append(result.Problems, fmt.Sprintf("%s: %s: %s", check.Status, check.PodCIDR, check.Message))
+			}
+		}
+		for _, problem := range result.Problems {
+			kind, _, _ := strings.Cut(problem, ":")
+			report.Summary.Problems[kind]++
+		}
+	}
+	report.Summary.Nodes = len(report.Nodes)
+	report.Summary.Healthy = len(report.Summary.Problems) == 0
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(report)
+
+	if !report.Summary.Healthy {
+		os.Exit(1)
+	}
+}
+
+// newClientset 使用 kubeconfig 创建 Kubernetes 客户端，kubeconfig 文件不存在时使用 in-cluster 配置
+func newClientset(kubeconfig string) (*kubernetes.Clientset, error) {
+	var config *rest.Config
+	var err error
+	if _, statErr := os.Stat(kubeconfig); statErr == nil {
+		config, err = clientcmd.BuildConfigFromFlags("", kubeconfig)
+	} else {
+		config, err = rest.InClusterConfig()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error building kubeconfig: %v", err)
+	}
+	return kubernetes.NewForConfig(config)
+}
+
+// nodePodCIDRs 返回节点的 Pod CIDR，兼容只设置了 spec.podCIDR 的旧版本
+func nodePodCIDRs(node corev1.Node) []string {
+	if len(node.Spec.PodCIDRs) > 0 {
+		return node.Spec.PodCIDRs
+	}
+	if node.Spec.PodCIDR != "" {
+		return []string{node.Spec.PodCIDR}
+	}
+	return nil
+}
+
+// nodeInternalIPs 返回节点的 InternalIP
+func nodeInternalIPs(node corev1.Node) []string {
+	var ips []string
+	for _, address := range node.Status.Addresses {
+		if address.Type == corev1.NodeInternalIP {
+			ips = append(ips, address.Address)
+		}
+	}
+	return ips
+}
+
+// checkPodCIDR 检查到一个节点的 Pod CIDR 的路由
+func checkPodCIDR(node string, local bool, cidr *net.IPNet, routes []netlink.Route, links map[int]netlink.Link, nodeByIP map[string]string, expectProtocol string) CIDRRouteCheck {
+	check := CIDRRouteCheck{PodCIDR: cidr.String(), Status: "OK"}
+	probe := cidr.IP
+
+	var matched *netlink.Route
+	var exact []netlink.Route
+	for i, route := range routes {
+		if !sameFamily(route, probe) {
+			continue
+		}
+		dst := routeDestination(route)
+		if cidr.Contains(dst.IP) && prefixLength(dst) >= prefixLength(cidr) {
+			check.Routes = append(check.Routes, describeRoute(route, links))
+			if prefixLength(dst) == prefixLength(cidr) {
+				exact = append(exact, route)
+			}
+			// CIDR 内部更具体的路由指向其他节点时，部分 Pod 的流量会被送错节点
+			for _, gateway := range routeGateways(route) {
+				if owner, ok := nodeByIP[gateway]; ok && owner != node {
+					check.Status = "WRONG_NODE"
+					check.Message = fmt.Sprintf("the route to %s goes to node %s (%s)", dst, owner, gateway)
+				}
+			}
+		}
+		if dst.Contains(probe) && (matched == nil || betterMatch(route, *matched)) {
+			matched = &routes[i]
+		}
+	}
+	if lookup, err := netlink.RouteGet(probe); err == nil && len(lookup) > 0 {
+		entry := describeRoute(lookup[0], links)
+		entry.Destination = probe.String()
+		check.Lookup = &entry
+	}
+
+	if len(exact) > 1 && !sameGateways(exact) {
+		check.Status = "CONFLICT"
+		check.Message = fmt.Sprintf("%d routes to %s with different next hops, the one with the lowest metric wins", len(exact), cidr)
+	}
+	if matched == nil {
+		check.Status = "MISSING"
+		check.Message = "no route, the pod CIDR is unreachable"
+		return check
+	}
+	entry := describeRoute(*matched, links)
+	check.Matched = &entry
+	check.Mode = forwardingMode(*matched, links, node, nodeByIP)
+
+	if local {
+		check.Mode = "local"
+		if check.Status == "OK" {
+			check.Status = "LOCAL"
+		}
+		for _, gateway := range entry.Gateways {
+			if owner, ok := nodeByIP[gateway]; ok && owner != node {
+				check.Status = "WRONG_NODE"
+				check.Message = fmt.Sprintf("the local pod CIDR is routed to node %s (%s)", owner, gateway)
+			}
+		}
+		return check
+	}
+	if check.Status != "OK" {
+		return check
+	}
+
+	switch {
+	case prefixLength(routeDestination(*matched)) == 0:
+		check.Status = "MISSING"
+		check.Message = fmt.Sprintf("no route to the pod CIDR, the traffic follows the default route via %s", strings.Join(append(entry.Gateways, entry.Interface), " "))
+	case entry.Type != "unicast":
+		check.Status = "BLACKHOLE"
+		check.Message = fmt.Sprintf("the matched route %s is a %s route", entry.Destination, entry.Type)
+	case check.Mode == "wrong-node":
+		check.Status = "WRONG_NODE"
+		check.Message = fmt.Sprintf("the matched route %s goes to another node via %s", entry.Destination, strings.Join(entry.Gateways, ","))
+	case expectProtocol != "" && entry.Protocol != expectProtocol:
+		check.Status = "UNEXPECTED_PROTOCOL"
+		check.Message = fmt.Sprintf("the matched route %s was installed by %s, not %s", entry.Destination, entry.Protocol, expectProtocol)
+	default:
+		check.Message = fmt.Sprintf("routed via %s (%s)", entry.Destination, check.Mode)
+	}
+	if check.Lookup != nil && check.Status == "OK" && (check.Lookup.Interface != entry.Interface || strings.Join(check.Lookup.Gateways, ",") != strings.Join(entry.Gateways, ",")) {
+		check.Message += fmt.Sprintf(", but the kernel lookup goes via %s %s, check the policy routing rules (ip rule)", strings.Join(check.Lookup.Gateways, ","), check.Lookup.Interface)
+	}
+	return check
+}
+
+// forwardingMode 判断路由的转发方式：direct、tunnel、router、device，下一跳为其他节点时为 wrong-node
+func forwardingMode(route netlink.Route, links map[int]netlink.Link, node string, nodeByIP map[string]string) string {
+	gateways := routeGateways(route)
+	for _, gateway := range gateways {
+		if owner, ok := nodeByIP[gateway]; ok && owner != node {
+			return "wrong-node"
+		}
+	}
+	if link, ok := links[route.LinkIndex]; ok && tunnelLinkTypes[link.Type()] {
+		return "tunnel"
+	}
+	for _, gateway := range gateways {
+		if nodeByIP[gateway] == node {
+			return "direct"
+		}
+	}
+	if len(gateways) > 0 {
+		return "router"
+	}
+	return "device"
+}
+
+// checkUnderlay 查找到节点 IP 的路由
+func checkUnderlay(nodeIP string, links map[int]netlink.Link) UnderlayCheck {
+	underlay := UnderlayCheck{NodeIP: nodeIP}
+	ip := net.ParseIP(nodeIP)
+	if ip == nil {
+		underlay.Error = "invalid IP"
+		return underlay
+	}
+	routes, err := netlink.RouteGet(ip)
+	if err != nil || len(routes) == 0 {
+		underlay.Error = fmt.Sprintf("no route: %v", err)
+		return underlay
+	}
+	route := routes[0]
+	if route.Type != unix.RTN_UNICAST && route.Type != unix.RTN_LOCAL {
+		underlay.Error = fmt.Sprintf("%s route", routeTypeName(route.Type))
+		return underlay
+	}
+	underlay.Reachable = true
+	if route.Gw != nil {
+		underlay.Gateway = route.Gw.String()
+	}
+	if link, ok := links[route.LinkIndex]; ok {
+		underlay.Interface = link.Attrs().Name
+		underlay.MTU = link.Attrs().MTU
+	}
+	return underlay
+}
+
+// describeRoute 将 netlink 路由转换为 RouteEntry
+func describeRoute(route netlink.Route, links map[int]netlink.Link) RouteEntry {
+	entry := RouteEntry{
+		Destination: "default",
+		Gateways:    routeGateways(route),
+		Type:        routeTypeName(route.Type),
+		Protocol:    route.Protocol.String(),
+		Table:       route.Table,
+		Metric:      route.Priority,
+	}
+	if route.Dst != nil && prefixLength(route.Dst) > 0 {
+		entry.Destination = route.Dst.String()
+	}
+	if link, ok := links[route.LinkIndex]; ok {
+		entry.Interface = link.Attrs().Name
+		entry.InterfaceType = link.Type()
+	}
+	return entry
+}
+
+// routeGateways 返回路由的下一跳，包括 ECMP 路由的各个下一跳和跨地址族的 via 下一跳
+func routeGateways(route netlink.Route) []string {
+	var gateways []string
+	if route.Gw != nil {
+		gateways = append(gateways, route.Gw.String())
+	}
+	if via, ok := route.Via.(*netlink.Via); ok && via != nil {
+		gateways = append(gateways, via.Addr.String())
+	}
+	for _, nexthop := range route.MultiPath {
+		if nexthop.Gw != nil {
+			gateways = append(gateways, nexthop.Gw.String())
+		}
+	}
+	return gateways
+}
+
+// sameGateways 判断几条路由的下一跳是否相同
+func sameGateways(routes []netlink.Route) bool {
+	first := strings.Join(routeGateways(routes[0]), ",")
+	for _, route := range routes[1:] {
+		if strings.Join(routeGateways(route), ",") != first || route.LinkIndex != routes[0].LinkIndex {
+			return false
+		}
+	}
+	return true
+}
+
+// routeDestination 返回路由的目的网段，默认路由为 0.0.0.0/0 或 ::/0
+func routeDestination(route netlink.Route) *net.IPNet {
+	if route.Dst != nil {
+		return route.Dst
+	}
+	if route.Family == netlink.FAMILY_V6 {
+		return &net.IPNet{IP: net.IPv6zero, Mask: net.CIDRMask(0, 128)}
+	}
+	return &net.IPNet{IP: net.IPv4zero, Mask: net.CIDRMask(0, 32)}
+}
+
+// betterMatch 判断路由 a 是否比 b 更优先：前缀更长，前缀相同时 metric 更小
+func betterMatch(a, b netlink.Route) bool {
+	la, lb := prefixLength(routeDestination(a)), prefixLength(routeDestination(b))
+	if la != lb {
+		return la > lb
+	}
+	return a.Priority < b.Priority
+}
+
+// sameFamily 判断路由与地址是否属于同一地址族
+func sameFamily(route netlink.Route, ip net.IP) bool {
+	if ip.To4() != nil {
+		return route.Family == netlink.FAMILY_V4
+	}
+	return route.Family == netlink.FAMILY_V6
+}
+
+// prefixLength 返回网段的前缀长度
+func prefixLength(ipNet *net.IPNet) int {
+	ones, _ := ipNet.Mask.Size()
+	return ones
+}
+
+// routeTypeName 返回路由类型的名称
+func routeTypeName(routeType int) string {
+	switch routeType {
+	case unix.RTN_UNICAST:
+		return "unicast"
+	case unix.RTN_LOCAL:
+		return "local"
+	case unix.RTN_BLACKHOLE:
+		return "blackhole"
+	case unix.RTN_UNREACHABLE:
+		return "unreachable"
+	case unix.RTN_PROHIBIT:
+		return "prohibit"
+	case unix.RTN_THROW:
+		return "throw"
+	}
+	return fmt.Sprintf("type-%d", routeType)
+}
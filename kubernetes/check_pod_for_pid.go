@@ -8,14 +8,51 @@
 4. 如果进程属于 Kubernetes Pod，程序会连接到 Kubernetes 集群，
    并尝试获取该 Pod 的详细信息，包括 Namespace 和 Pod 名称。
 5. 最后，程序会输出进程所属的 Pod 信息，或者在无法找到匹配的 Pod 时输出错误信息。
+6. 输出进程的祖先链（各级父进程及其所属的 Pod/容器），并判断该进程是由容器入口进程、
+   exec 会话还是主机守护进程启动的，便于排查可疑进程的来源。
+7. 最小权限模式：指定 -kubelet 时，不访问 API server，而是查询本节点 kubelet 的 /pods 接口，
+   可以使用只读端口（http://127.0.0.1:10255），也可以使用需要认证的 10250 端口（https://127.0.0.1:10250），
+   使程序在没有集群凭据的节点上也能工作。kubelet 只返回本节点的 Pod，这正好覆盖了本机进程。
+8. 监视模式：指定 -follow 时，持续以 JSONL 输出本节点上新创建的进程及其所属的命名空间、Pod 和容器，
+   事件来自内核的 proc connector（netlink）或周期扫描 /proc，便于审计 Pod 中实际运行了哪些程序。
+9. 支持 Windows 节点：通过 HCS（Host Compute Service）列出各个容器中的进程，把进程归属到容器，再通过 Container ID 找到 Pod；
+   祖先链和 -follow 使用 Windows 的进程快照，在混合操作系统的集群中也能报告部分信息。
+
+与操作系统相关的实现在 check_pod_for_pid_linux.go 和 check_pod_for_pid_windows.go 中（以 build tag 区分），
+运行时需要与本文件一起指定，go run 会忽略命令行上列出的文件的 build tag。
 
 使用方法：
-go run check_pod_for_pid.go <PID>
+go run check_pod_for_pid.go check_pod_for_pid_linux.go <PID>
+go run check_pod_for_pid.go check_pod_for_pid_linux.go -kubelet=http://127.0.0.1:10255 <PID>
+go run check_pod_for_pid.go check_pod_for_pid_linux.go -kubelet=https://127.0.0.1:10250 -kubelet-token-file=<token 文件> <PID>
+go run check_pod_for_pid.go check_pod_for_pid_linux.go -kubelet=http://127.0.0.1:10255 -follow | jq -c 'select(.Namespace == "default") | {Pod, Container, Cmdline}'
+Windows 节点上（PowerShell）：
+go run check_pod_for_pid.go check_pod_for_pid_windows.go -kubelet=https://127.0.0.1:10250 -kubelet-cert=<证书> -kubelet-key=<私钥> <PID>
+
+选项：
+-kubelet: kubelet 的地址，设置后通过 kubelet 的 /pods 接口查询 Pod（默认为空，使用 kubeconfig 访问 API server）
+-kubelet-token-file: 访问 kubelet 时使用的 Bearer token 文件（默认为空，不发送 token）
+-kubelet-cert, -kubelet-key: 访问 kubelet 时使用的客户端证书和私钥，例如 /var/lib/kubelet/pki/kubelet-client-current.pem
+-kubelet-ca: 校验 kubelet 服务证书的 CA 文件（默认为空，kubelet 的服务证书通常是自签名的，因此不校验）
+-follow: 持续输出新创建的进程及其所属的 Pod（JSONL），此时不需要 PID 参数（默认为 false）
+-follow-source: 新进程的来源：netlink（proc connector）、scan（周期扫描 /proc）或 auto（优先 netlink，失败时退回 scan，默认为 auto）
+-follow-interval: scan 模式下扫描 /proc 的间隔（默认为 1s）
+-follow-all: -follow 时也输出主机进程（默认为 false，只输出属于容器的进程）
 
 注意事项：
-- 本程序需要在能够访问 Kubernetes 集群的环境中运行。
+- 默认模式下需要在能够访问 Kubernetes 集群的环境中运行。
 - 需要正确配置 kubeconfig 文件（默认路径：~/.kube/config）。
+- 10250 端口需要认证，并且需要对 nodes/proxy 资源的 get 权限（或 kubelet 配置为 AlwaysAllow 授权）。
+  只读端口 10255 不需要认证，但在较新的集群中默认是关闭的。
 - 程序使用正则表达式来解析 cgroup 路径，以适应不同的 Kubernetes 环境。
+- 祖先链通过 /proc/<PID>/stat 中的父进程 ID 逐级向上查找，需要能够读取主机的 /proc（例如在 hostPID 的 Pod 中运行）。
+- -follow 的 netlink 来源报告每一次 exec（包括已存在的进程执行新程序），需要 root 或 CAP_NET_ADMIN，并且要在主机的 PID 命名空间中运行；
+  scan 来源报告新出现的进程（按 PID 和启动时间识别），存活时间短于扫描间隔的进程可能被漏掉。
+  读取 /proc 之前就已退出的进程只能报告 PID（Exited 为 true），无法归属到 Pod，因此只在 -follow-all 时输出。
+- -follow 时遇到未知的 Pod 会重新列出 Pod（最多每 5 秒一次），新创建的 Pod 中的进程也能被归属；事件输出到 stdout，提示和错误输出到 stderr。
+- Windows 节点上需要以管理员身份运行（或在 HostProcess 容器中运行），只能归属进程隔离的容器中的进程，Hyper-V 隔离的容器中的进程在主机上不可见。
+  HCS 中没有 Pod 的信息，Pod 通过 Container ID 查找，因此 Pod 的 pause 容器中的进程无法归属到 Pod；
+  祖先链中的进程名为可执行文件名，没有命令行，也无法区分容器入口进程和 exec 会话；-follow 只支持 scan 来源。
 
 此程序对于理解容器化环境中进程与 Kubernetes Pod 之间的关系非常有用，
 可用于调试、监控和系统管理等场景。
@@ -24,13 +61,20 @@ go run check_pod_for_pid.go <PID>
 package main
 
 import (
-	"bufio"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"flag"
 	"fmt"
+	"io"
+	"net/http"
 	"os"
 	"path/filepath"
-	"regexp"
+	"runtime"
+	"strconv"
 	"strings"
+	"time"
 
 	corev1 "k8s.io/api/core/v1" // 修改这行
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -39,45 +83,82 @@ import (
 )
 
 func main() {
-	if len(os.Args) != 2 {
-		fmt.Println("Usage: go run check_pod_for_pid.go <PID>")
-		os.Exit(1)
+	kubeletURL := flag.String("kubelet", "", "kubelet 的地址，例如 http://127.0.0.1:10255 或 https://127.0.0.1:10250，设置后不访问 API server")
+	kubeletTokenFile := flag.String("kubelet-token-file", "", "访问 kubelet 时使用的 Bearer token 文件")
+	kubeletCert := flag.String("kubelet-cert", "", "访问 kubelet 时使用的客户端证书")
+	kubeletKey := flag.String("kubelet-key", "", "访问 kubelet 时使用的客户端私钥")
+	kubeletCA := flag.String("kubelet-ca", "", "校验 kubelet 服务证书的 CA 文件，为空时不校验")
+	follow := flag.Bool("follow", false, "持续输出新创建的进程及其所属的 Pod（JSONL），不需要 PID 参数")
+	followSource := flag.String("follow-source", "auto", "-follow 的事件来源：netlink（proc connector）、scan（周期扫描 /proc）或 auto（优先 netlink）")
+	followInterval := flag.Duration("follow-interval", time.Second, "scan 模式下扫描 /proc 的间隔")
+	followAll := flag.Bool("follow-all", false, "-follow 时也输出主机进程")
+	flag.Usage = func() {
+		fmt.Printf("Usage: go run check_pod_for_pid.go check_pod_for_pid_%s.go [-kubelet=<url>] <PID>\n", runtime.GOOS)
+		fmt.Printf("       go run check_pod_for_pid.go check_pod_for_pid_%s.go [-kubelet=<url>] -follow [-follow-source=auto|netlink|scan] [-follow-all]\n", runtime.GOOS)
+		flag.PrintDefaults()
 	}
+	flag.Parse()
 
-	pid := os.Args[1]
-	cgroupPath := fmt.Sprintf("/proc/%s/cgroup", pid)
+	listPods := func() ([]corev1.Pod, error) {
+		if *kubeletURL != "" {
+			return listPodsFromKubelet(*kubeletURL, *kubeletTokenFile, *kubeletCert, *kubeletKey, *kubeletCA)
+		}
+		return listPodsFromAPIServer()
+	}
 
-	podID, containerID, isHostProcess := getPodAndContainerID(cgroupPath)
+	if *follow {
+		if *followSource != "auto" && *followSource != "netlink" && *followSource != "scan" {
+			fmt.Printf("无效的 -follow-source %q，支持 auto、netlink 和 scan\n", *followSource)
+			os.Exit(1)
+		}
+		resolver := &podResolver{list: listPods, minRelist: 5 * time.Second}
+		if err := followProcesses(*followSource, *followInterval, *followAll, resolver); err != nil {
+			fmt.Printf("Error following processes: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	pid := flag.Arg(0)
+	podID, containerID, isHostProcess := processContainer(pid)
 	if isHostProcess {
 		fmt.Printf("进程 %s 是一个主机进程。\n", pid)
+		printProcessTree(pid, nil)
 		return
 	}
 
 	if podID == "" && containerID != "" {
+		// 没有 Pod ID 时（例如 Windows 节点），通过 Pod 的容器状态中的 Container ID 查找 Pod
+		if pods, err := listPods(); err == nil {
+			if pod, found := findPodInfo(pods, "", containerID); found {
+				printPodInfo(pid, pod, containerID)
+				printProcessTree(pid, pods)
+				return
+			}
+		}
 		fmt.Printf("进程 %s 属于一个容器。\n", pid)
 		fmt.Printf("Container ID: %s\n", containerID)
+		printProcessTree(pid, nil)
 		return
 	}
 
 	if podID == "" {
 		fmt.Printf("Process %s is a host process.\n", pid)
+		printProcessTree(pid, nil)
 		return
 	}
 
-	// Set up Kubernetes client
-	config, err := clientcmd.BuildConfigFromFlags("", filepath.Join(os.Getenv("HOME"), ".kube", "config"))
+	pods, err := listPods()
 	if err != nil {
-		fmt.Printf("Error building kubeconfig: %v\n", err)
-		return
-	}
-
-	clientset, err := kubernetes.NewForConfig(config)
-	if err != nil {
-		fmt.Printf("Error creating Kubernetes client: %v\n", err)
-		return
+		fmt.Printf("Error listing pods: %v\n", err)
 	}
 
-	pod, found := findPodInfo(clientset, podID, containerID)
+	pod, found := findPodInfo(pods, podID, containerID)
 	if found {
 		printPodInfo(pid, pod, containerID)
 	} else {
@@ -85,115 +166,108 @@ func main() {
 		fmt.Printf("Pod ID: %s\n", podID)
 		fmt.Printf("Container ID: %s\n", containerID)
 	}
+	printProcessTree(pid, pods)
 }
 
-// getPodAndContainerID 从给定的 cgroup 路径中提取 Pod ID 和 Container ID。
+// listPodsFromAPIServer 使用 kubeconfig 从 API server 列出所有命名空间中的 Pod
+func listPodsFromAPIServer() ([]corev1.Pod, error) {
+	home, _ := os.UserHomeDir()
+	config, err := clientcmd.BuildConfigFromFlags("", filepath.Join(home, ".kube", "config"))
+	if err != nil {
+		return nil, fmt.Errorf("error building kubeconfig: %v", err)
+	}
+
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("error creating Kubernetes client: %v", err)
+	}
+
+	pods, err := clientset.CoreV1().Pods("").List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return pods.Items, nil
+}
+
+// listPodsFromKubelet 从本节点 kubelet 的 /pods 接口列出本节点上的 Pod。
 //
 // 工作原理：
-// 1. 打开并读取 cgroup 文件。
-// 2. 使用正则表达式查找包含 "kubepods" 的行。
-// 3. 解析该行以提取 Pod ID 和 Container ID。
-// 4. Pod ID 通常在第四个路径段中，Container ID 在第五个路径段中。
-// 5. 使用正��表达式匹配以适应不同的 cgroup 路径格式。
-// 6. 将 Pod ID 中的下划线替换为连字符，以匹配 Kubernetes 中的 UID 格式。
-//
-// 参数：
-//   - cgroupPath: cgroup 文件的路径，通常为 "/proc/<PID>/cgroup"
-//
-// 返回值：
-//   - string: Pod ID（如果找到）
-//   - string: Container ID（如果找到）
-//   - bool: 是否为主机进程（如果找到）
-//   - 如果未找到，两个返回值都为空字符串
-func getPodAndContainerID(cgroupPath string) (string, string, bool) {
-	file, err := os.Open(cgroupPath)
+// 1. kubelet 的 /pods 接口返回与 API server 相同格式的 PodList，因此直接解码为 corev1.PodList。
+// 2. 只读端口（10255）不需要认证；10250 端口使用 Bearer token 或客户端证书认证。
+// 3. kubelet 的服务证书通常是自签名的，未指定 CA 时不校验服务证书。
+func listPodsFromKubelet(kubeletURL, tokenFile, certFile, keyFile, caFile string) ([]corev1.Pod, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: caFile == ""}
+	if caFile != "" {
+		caData, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(caData) {
+			return nil, fmt.Errorf("%s 中没有有效的证书", caFile)
+		}
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(kubeletURL, "/")+"/pods", nil)
 	if err != nil {
-		fmt.Printf("打开 cgroup 文件时出错：%v\n", err)
-		return "", "", false
-	}
-	defer file.Close()
-
-	podRegex := regexp.MustCompile(`kubepods-[^-]+-pod([^.]+)\.slice`)
-	containerRegex := regexp.MustCompile(`[^-]+-([^.]+)\.scope`)
-	dockerContainerRegex := regexp.MustCompile(`docker-([0-9a-f]{64})\.scope$`)
-	containerdContainerRegex := regexp.MustCompile(`containerd-([0-9a-f]{64})\.scope$`)
-	crioContainerRegex := regexp.MustCompile(`crio-([0-9a-f]{64})\.scope$`)
-
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := scanner.Text()
-		if strings.Contains(line, "kubepods") {
-			// 现有的 Kubernetes Pod 逻辑
-			parts := strings.Split(line, "/")
-			if len(parts) >= 4 {
-				podMatch := podRegex.FindStringSubmatch(parts[3])
-				if len(podMatch) == 2 {
-					podID := strings.ReplaceAll(podMatch[1], "_", "-")
-
-					if len(parts) >= 5 {
-						containerMatch := containerRegex.FindStringSubmatch(parts[4])
-						if len(containerMatch) == 2 {
-							return podID, containerMatch[1], false
-						}
-					}
-				}
-			}
-		} else if dockerMatch := dockerContainerRegex.FindStringSubmatch(line); dockerMatch != nil {
-			return "", dockerMatch[1], false
-		} else if containerdMatch := containerdContainerRegex.FindStringSubmatch(line); containerdMatch != nil {
-			return "", containerdMatch[1], false
-		} else if crioMatch := crioContainerRegex.FindStringSubmatch(line); crioMatch != nil {
-			return "", crioMatch[1], false
-		} else if isHostProcess(line) {
-			return "", "", true
+		return nil, err
+	}
+	if tokenFile != "" {
+		token, err := os.ReadFile(tokenFile)
+		if err != nil {
+			return nil, err
 		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
 	}
 
-	return "", "", false
-}
+	client := &http.Client{
+		Timeout:   10 * time.Second,
+		Transport: &http.Transport{TLSClientConfig: tlsConfig},
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
 
-var hostPatterns = []*regexp.Regexp{
-	regexp.MustCompile(`^0::/$`),
-	regexp.MustCompile(`^0::/init\.scope$`),
-	regexp.MustCompile(`^0::/user\.slice/.*$`),
-	regexp.MustCompile(`^0::/system\.slice/.*$`),
-}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("kubelet 返回 %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
 
-// isHostProcess 使用正则表达式检查给定的 cgroup 行是否表示主机进程
-func isHostProcess(line string) bool {
-	for _, pattern := range hostPatterns {
-		if pattern.MatchString(line) {
-			return true
-		}
+	var pods corev1.PodList
+	if err := json.NewDecoder(resp.Body).Decode(&pods); err != nil {
+		return nil, fmt.Errorf("无法解析 kubelet 返回的 Pod 列表：%v", err)
 	}
-	return false
+	return pods.Items, nil
 }
 
-// findPodInfo 在 Kubernetes 集群中查找与给定 Pod ID 或 Container ID 匹配的 Pod。
+// findPodInfo 在 Pod 列表中查找与给定 Pod ID 或 Container ID 匹配的 Pod。
 //
 // 工作原理：
-// 1. 使用 Kubernetes 客户端列出所有命名空间中的所有 Pod。
+// 1. Pod 列表来自 API server（所有命名空间）或本节点的 kubelet。
 // 2. 遍历 Pod 列表，检查每个 Pod 的 UID 是否与给定的 Pod ID 匹配。
 // 3. 如果 Pod ID 不匹配，则检查 Pod 中的每个容器 ID 是否与给定的 Container ID 匹配。
 // 4. 如果找到匹配的 Pod，返回该 Pod 的信息和 true。
 // 5. 如果遍历完所有 Pod 后仍未找到匹配，返回空 Pod 和 false。
 //
 // 参数：
-//   - clientset: Kubernetes 客户端集合
+//   - pods: Pod 列表
 //   - podID: 要查找的 Pod 的 ID
 //   - containerID: 要查找的容器的 ID
 //
 // 返回值：
 //   - corev1.Pod: 找到的 Pod 信息（如果未找到则为空 Pod）
 //   - bool: 是否找到匹配的 Pod
-func findPodInfo(clientset *kubernetes.Clientset, podID, containerID string) (corev1.Pod, bool) {
-	pods, err := clientset.CoreV1().Pods("").List(context.TODO(), metav1.ListOptions{})
-	if err != nil {
-		fmt.Printf("Error listing pods: %v\n", err)
-		return corev1.Pod{}, false
-	}
-
-	for _, pod := range pods.Items {
+func findPodInfo(pods []corev1.Pod, podID, containerID string) (corev1.Pod, bool) {
+	for _, pod := range pods {
 		if string(pod.UID) == podID {
 			return pod, true
 		}
@@ -218,3 +292,196 @@ func printPodInfo(pid string, pod corev1.Pod, containerID string) { // 修改这
 		fmt.Println("This is a static Pod.")
 	}
 }
+
+// ProcessAncestor 结构体用于存储祖先链中一个进程的信息
+type ProcessAncestor struct {
+	PID         int    // 进程 ID
+	PPID        int    // 父进程 ID
+	Comm        string // 进程名
+	Cmdline     string // 命令行
+	PodID       string // 所属 Pod 的 UID（如果有）
+	ContainerID string // 所属容器的 ID（如果有）
+	IsHost      bool   // 是否为主机进程
+	ContainerNS bool   // 是否为容器 PID 命名空间中的 1 号进程（即容器入口进程）
+}
+
+// classifyProcessOrigin 根据祖先链判断进程的来源：
+//   - 容器入口进程：进程所在容器的最上层进程是容器 PID 命名空间中的 1 号进程
+//   - exec 会话：进程所在容器的最上层进程不是 1 号进程，而是由容器运行时（shim）直接启动的
+//   - 主机守护进程：进程不属于任何容器
+func classifyProcessOrigin(ancestors []ProcessAncestor) string {
+	if len(ancestors) == 0 {
+		return "未知"
+	}
+	target := ancestors[0]
+	if target.ContainerID == "" {
+		for i := len(ancestors) - 1; i >= 0; i-- {
+			if ancestors[i].PID != 1 {
+				return fmt.Sprintf("主机守护进程（由 %d/%s 启动）", ancestors[i].PID, ancestors[i].Comm)
+			}
+		}
+		return "主机守护进程"
+	}
+
+	// 找到同一容器中最上层的进程
+	top := target
+	for _, ancestor := range ancestors[1:] {
+		if ancestor.ContainerID != target.ContainerID {
+			break
+		}
+		top = ancestor
+	}
+	if !containerInitKnown {
+		return fmt.Sprintf("容器进程（最上层为 %d/%s，无法区分容器入口进程和 exec 会话）", top.PID, top.Comm)
+	}
+	if top.ContainerNS {
+		return fmt.Sprintf("容器入口进程（%d/%s）", top.PID, top.Comm)
+	}
+	return fmt.Sprintf("exec 会话（%d/%s 由 %d 启动）", top.PID, top.Comm, top.PPID)
+}
+
+// printProcessTree 输出进程的祖先链及其来源，并使用 pods 将 Pod UID 解析为 namespace/name
+func printProcessTree(pid string, pods []corev1.Pod) {
+	pidNumber, err := strconv.Atoi(pid)
+	if err != nil {
+		fmt.Printf("无效的 PID %s：%v\n", pid, err)
+		return
+	}
+	ancestors, err := getProcessAncestors(pidNumber)
+	if err != nil {
+		fmt.Printf("获取进程 %s 的祖先链时出错：%v\n", pid, err)
+		if len(ancestors) == 0 {
+			return
+		}
+	}
+
+	// 复用已列出的 Pod，避免为每个祖先进程重复查询
+	podNames := make(map[string]string)
+	for _, pod := range pods {
+		podNames[string(pod.UID)] = pod.Namespace + "/" + pod.Name
+	}
+
+	fmt.Println("进程祖先链：")
+	for i, ancestor := range ancestors {
+		owner := "主机"
+		switch {
+		case ancestor.PodID != "":
+			owner = "Pod " + ancestor.PodID
+			if name, ok := podNames[ancestor.PodID]; ok {
+				owner = "Pod " + name
+			}
+			owner += " 容器 " + shortID(ancestor.ContainerID)
+		case ancestor.ContainerID != "":
+			owner = "容器 " + shortID(ancestor.ContainerID)
+		}
+		if ancestor.ContainerNS && ancestor.ContainerID != "" {
+			owner += "（容器 1 号进程）"
+		}
+		cmdline := ancestor.Cmdline
+		if len(cmdline) > 120 {
+			cmdline = cmdline[:120] + "..."
+		}
+		fmt.Printf("%s%d %s [%s] %s\n", strings.Repeat("  ", i), ancestor.PID, ancestor.Comm, owner, cmdline)
+	}
+	fmt.Printf("进程来源：%s\n", classifyProcessOrigin(ancestors))
+}
+
+// shortID 返回容器 ID 的前 12 位
+func shortID(id string) string {
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
+
+// ProcessEvent 结构体表示 -follow 模式下发现的一个新进程，每个事件输出为一行 JSON（JSONL）
+type ProcessEvent struct {
+	Time          string // 发现该进程的时间（RFC3339，带纳秒）
+	Source        string // 事件来源：netlink（proc connector 的 exec 事件）或 scan（周期扫描 /proc 发现的新进程）
+	PID           int    // 进程 ID
+	PPID          int    // 父进程 ID
+	Comm          string // 进程名
+	Cmdline       string // 命令行
+	Exited        bool   // 读取 /proc 时进程已经退出，只有 PID 可用
+	IsHost        bool   // 是否为主机进程
+	PodID         string // 所属 Pod 的 UID（如果有）
+	ContainerID   string // 所属容器的 ID（如果有）
+	Namespace     string // 所属 Pod 的命名空间（能解析到 Pod 时）
+	Pod           string // 所属 Pod 的名称（能解析到 Pod 时）
+	Container     string // 所属容器的名称（能解析到 Pod 时）
+	ParentComm    string // 父进程的进程名
+	ParentInSame  bool   // 父进程是否在同一个容器中，为 false 且进程属于容器时通常是 exec 会话或容器入口进程
+	ContainerInit bool   // 是否为容器 PID 命名空间中的 1 号进程（即容器入口进程）
+}
+
+// podResolver 缓存 Pod 列表，遇到未知的 Pod 或容器时重新列出（最多每 minRelist 一次），
+// 使新创建的 Pod 中的进程也能被归属
+type podResolver struct {
+	list      func() ([]corev1.Pod, error)
+	pods      []corev1.Pod
+	listedAt  time.Time
+	minRelist time.Duration
+}
+
+// resolve 返回进程所属的 Pod 和容器名称
+func (r *podResolver) resolve(podID, containerID string) (corev1.Pod, string, bool) {
+	for attempt := 0; attempt < 2; attempt++ {
+		if pod, found := findPodInfo(r.pods, podID, containerID); found && (podID == "" || string(pod.UID) == podID) {
+			return pod, containerName(pod, containerID), true
+		}
+		if attempt > 0 || time.Since(r.listedAt) < r.minRelist {
+			break
+		}
+		pods, err := r.list()
+		r.listedAt = time.Now()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error listing pods: %v\n", err)
+			break
+		}
+		r.pods = pods
+	}
+	return corev1.Pod{}, "", false
+}
+
+// containerName 返回 Pod 中 ID 为 containerID 的容器（包括 init 容器和临时容器）的名称
+func containerName(pod corev1.Pod, containerID string) string {
+	if containerID == "" {
+		return ""
+	}
+	statuses := append(append(append([]corev1.ContainerStatus{}, pod.Status.ContainerStatuses...),
+		pod.Status.InitContainerStatuses...), pod.Status.EphemeralContainerStatuses...)
+	for _, status := range statuses {
+		if status.ContainerID != "" && strings.HasSuffix(status.ContainerID, containerID) {
+			return status.Name
+		}
+	}
+	return ""
+}
+
+// describeNewProcess 读取新进程的信息并归属到 Pod
+func describeNewProcess(pid int, source string, resolver *podResolver) ProcessEvent {
+	event := ProcessEvent{Time: time.Now().Format(time.RFC3339Nano), Source: source, PID: pid}
+	ancestors, err := getProcessAncestors(pid)
+	if err != nil || len(ancestors) == 0 {
+		event.Exited = true
+		return event
+	}
+	process := ancestors[0]
+	event.PPID, event.Comm, event.Cmdline = process.PPID, process.Comm, process.Cmdline
+	event.IsHost, event.PodID, event.ContainerID = process.IsHost, process.PodID, process.ContainerID
+	event.ContainerInit = process.ContainerNS && process.ContainerID != ""
+	if len(ancestors) > 1 {
+		event.ParentComm = ancestors[1].Comm
+		event.ParentInSame = ancestors[1].ContainerID == process.ContainerID
+	}
+
+	if event.PodID != "" || event.ContainerID != "" {
+		if pod, container, found := resolver.resolve(event.PodID, event.ContainerID); found {
+			event.Namespace, event.Pod, event.Container = pod.Namespace, pod.Name, container
+			if event.PodID == "" {
+				event.PodID = string(pod.UID)
+			}
+		}
+	}
+	return event
+}
@@ -0,0 +1,315 @@
+//go:build linux
+
+package main
+
+// 本文件是 check_pod_for_pid.go 在 Linux 节点上的实现：通过 /proc 和 cgroup 把进程归属到 Pod 和容器，
+// 并通过 proc connector 或周期扫描 /proc 发现新进程。
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// containerInitKnown 表示能否识别容器的入口进程：Linux 上通过 PID 命名空间中的 1 号进程识别
+const containerInitKnown = true
+
+// processContainer 返回进程所属的 Pod ID、Container ID，以及是否为主机进程
+func processContainer(pid string) (string, string, bool) {
+	return getPodAndContainerID(fmt.Sprintf("/proc/%s/cgroup", pid))
+}
+
+// getPodAndContainerID 从给定的 cgroup 路径中提取 Pod ID 和 Container ID。
+//
+// 工作原理：
+// 1. 打开并读取 cgroup 文件。
+// 2. 使用正则表达式查找包含 "kubepods" 的行。
+// 3. 解析该行以提取 Pod ID 和 Container ID。
+// 4. Pod ID 通常在第四个路径段中，Container ID 在第五个路径段中。
+// 5. 使用正��表达式匹配以适应不同的 cgroup 路径格式。
+// 6. 将 Pod ID 中的下划线替换为连字符，以匹配 Kubernetes 中的 UID 格式。
+//
+// 参数：
+//   - cgroupPath: cgroup 文件的路径，通常为 "/proc/<PID>/cgroup"
+//
+// 返回值：
+//   - string: Pod ID（如果找到）
+//   - string: Container ID（如果找到）
+//   - bool: 是否为主机进程（如果找到）
+//   - 如果未找到，两个返回值都为空字符串
+func getPodAndContainerID(cgroupPath string) (string, string, bool) {
+	file, err := os.Open(cgroupPath)
+	if err != nil {
+		// 输出到 stderr，避免混入 -follow 模式的 JSONL
+		fmt.Fprintf(os.Stderr, "打开 cgroup 文件时出错：%v\n", err)
+		return "", "", false
+	}
+	defer file.Close()
+
+	podRegex := regexp.MustCompile(`kubepods-[^-]+-pod([^.]+)\.slice`)
+	containerRegex := regexp.MustCompile(`[^-]+-([^.]+)\.scope`)
+	dockerContainerRegex := regexp.MustCompile(`docker-([0-9a-f]{64})\.scope$`)
+	containerdContainerRegex := regexp.MustCompile(`containerd-([0-9a-f]{64})\.scope$`)
+	crioContainerRegex := regexp.MustCompile(`crio-([0-9a-f]{64})\.scope$`)
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.Contains(line, "kubepods") {
+			// 现有的 Kubernetes Pod 逻辑
+			parts := strings.Split(line, "/")
+			if len(parts) >= 4 {
+				podMatch := podRegex.FindStringSubmatch(parts[3])
+				if len(podMatch) == 2 {
+					podID := strings.ReplaceAll(podMatch[1], "_", "-")
+
+					if len(parts) >= 5 {
+						containerMatch := containerRegex.FindStringSubmatch(parts[4])
+						if len(containerMatch) == 2 {
+							return podID, containerMatch[1], false
+						}
+					}
+				}
+			}
+		} else if dockerMatch := dockerContainerRegex.FindStringSubmatch(line); dockerMatch != nil {
+			return "", dockerMatch[1], false
+		} else if containerdMatch := containerdContainerRegex.FindStringSubmatch(line); containerdMatch != nil {
+			return "", containerdMatch[1], false
+		} else if crioMatch := crioContainerRegex.FindStringSubmatch(line); crioMatch != nil {
+			return "", crioMatch[1], false
+		} else if isHostProcess(line) {
+			return "", "", true
+		}
+	}
+
+	return "", "", false
+}
+
+var hostPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`^0::/$`),
+	regexp.MustCompile(`^0::/init\.scope$`),
+	regexp.MustCompile(`^0::/user\.slice/.*$`),
+	regexp.MustCompile(`^0::/system\.slice/.*$`),
+}
+
+// isHostProcess 使用正则表达式检查给定的 cgroup 行是否表示主机进程
+func isHostProcess(line string) bool {
+	for _, pattern := range hostPatterns {
+		if pattern.MatchString(line) {
+			return true
+		}
+	}
+	return false
+}
+
+// getProcessAncestors 返回从给定进程开始，逐级向上直到 1 号进程的祖先链。
+//
+// 工作原理：
+// 1. 读取 /proc/<PID>/stat，解析进程名和父进程 ID（进程名可能包含空格和括号，因此以最后一个 ')' 为界）。
+// 2. 读取 /proc/<PID>/cmdline 获取命令行。
+// 3. 复用 getPodAndContainerID 解析每个进程所属的 Pod 和容器。
+// 4. 读取 /proc/<PID>/status 中的 NSpid，最后一级为 1 表示该进程是其 PID 命名空间中的 1 号进程。
+func getProcessAncestors(pid int) ([]ProcessAncestor, error) {
+	var ancestors []ProcessAncestor
+	seen := make(map[int]bool)
+	for pid > 0 && !seen[pid] {
+		seen[pid] = true
+
+		stat, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+		if err != nil {
+			if len(ancestors) == 0 {
+				return nil, err
+			}
+			break
+		}
+		content := string(stat)
+		start, end := strings.Index(content, "("), strings.LastIndex(content, ")")
+		fields := strings.Fields(content[end+1:])
+		if start < 0 || end < start || len(fields) < 2 {
+			return ancestors, fmt.Errorf("无法解析 /proc/%d/stat", pid)
+		}
+		ppid, _ := strconv.Atoi(fields[1])
+
+		ancestor := ProcessAncestor{PID: pid, PPID: ppid, Comm: content[start+1 : end]}
+		if cmdline, err := os.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid)); err == nil {
+			ancestor.Cmdline = strings.TrimSpace(strings.ReplaceAll(string(cmdline), "\x00", " "))
+		}
+		ancestor.PodID, ancestor.ContainerID, ancestor.IsHost = getPodAndContainerID(fmt.Sprintf("/proc/%d/cgroup", pid))
+		ancestor.ContainerNS = isPIDNamespaceInit(pid)
+
+		ancestors = append(ancestors, ancestor)
+		pid = ppid
+	}
+	return ancestors, nil
+}
+
+// isPIDNamespaceInit 检查进程是否为其所在 PID 命名空间中的 1 号进程
+func isPIDNamespaceInit(pid int) bool {
+	status, err := os.ReadFile(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(string(status), "\n") {
+		if strings.HasPrefix(line, "NSpid:") {
+			nspids := strings.Fields(strings.TrimPrefix(line, "NSpid:"))
+			// 只有一级表示进程在主机的 PID 命名空间中
+			return len(nspids) > 1 && nspids[len(nspids)-1] == "1"
+		}
+	}
+	return false
+}
+
+// followProcesses 持续输出本节点上新创建的进程及其所属的 Pod（JSONL）。
+//
+// 工作原理：
+// 1. source 为 netlink 或 auto 时，订阅内核的 proc connector（NETLINK_CONNECTOR），每次 exec 都会收到事件，短命进程也不会漏掉。
+// 2. proc connector 需要 root（CAP_NET_ADMIN）并且在主机的 PID 命名空间中运行（hostPID），auto 模式下订阅失败时退回周期扫描。
+// 3. source 为 scan 时，每隔 interval 扫描一次 /proc，按 PID 和启动时间识别新进程，存活时间短于扫描间隔的进程可能被漏掉。
+// 4. 复用 getPodAndContainerID 解析进程的 Pod UID 和容器 ID，再通过 podResolver 解析出命名空间、Pod 和容器名称。
+// 5. 默认只输出属于容器的进程，all 为 true 时也输出主机进程。
+func followProcesses(source string, interval time.Duration, all bool, resolver *podResolver) error {
+	encoder := json.NewEncoder(os.Stdout)
+	emit := func(pid int, eventSource string) {
+		event := describeNewProcess(pid, eventSource, resolver)
+		if event.ContainerID == "" && !all {
+			return
+		}
+		encoder.Encode(event)
+	}
+
+	if source == "netlink" || source == "auto" {
+		conn, err := subscribeProcConnector()
+		if err == nil {
+			defer syscall.Close(conn)
+			fmt.Fprintln(os.Stderr, "Following new processes with the proc connector")
+			return readProcConnector(conn, func(pid int) { emit(pid, "netlink") })
+		}
+		if source == "netlink" {
+			return fmt.Errorf("无法订阅 proc connector：%v", err)
+		}
+		fmt.Fprintf(os.Stderr, "Unable to use the proc connector (%v), scanning /proc every %s\n", err, interval)
+	}
+
+	// 第一次扫描只记录已存在的进程
+	known := scanProcesses()
+	for range time.Tick(interval) {
+		current := scanProcesses()
+		for pid, started := range current {
+			if previous, ok := known[pid]; !ok || previous != started {
+				emit(pid, "scan")
+			}
+		}
+		known = current
+	}
+	return nil
+}
+
+// scanProcesses 返回 /proc 中所有进程的 PID 及其启动时间（/proc/<PID>/stat 的第 22 个字段），
+// 启动时间用于识别被复用的 PID
+func scanProcesses() map[int]string {
+	processes := make(map[int]string)
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return processes
+	}
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		stat, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+		if err != nil {
+			continue
+		}
+		content := string(stat)
+		fields := strings.Fields(content[strings.LastIndex(content, ")")+1:])
+		// 去掉 pid 和 comm 后，starttime 是第 20 个字段
+		if len(fields) > 19 {
+			processes[pid] = fields[19]
+		}
+	}
+	return processes
+}
+
+// proc connector 的常量，见 linux/connector.h 和 linux/cn_proc.h
+const (
+	netlinkConnector      = 11 // NETLINK_CONNECTOR
+	cnIdxProc             = 1  // CN_IDX_PROC
+	cnValProc             = 1  // CN_VAL_PROC
+	procCnMcastListen     = 1  // PROC_CN_MCAST_LISTEN
+	procEventExec         = 2  // PROC_EVENT_EXEC
+	netlinkHeaderLength   = 16 // sizeof(struct nlmsghdr)
+	connectorHeaderLength = 20 // sizeof(struct cn_msg)
+)
+
+// subscribeProcConnector 打开 NETLINK_CONNECTOR socket 并订阅进程事件
+func subscribeProcConnector() (int, error) {
+	conn, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, netlinkConnector)
+	if err != nil {
+		return -1, err
+	}
+	if err := syscall.Bind(conn, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK, Groups: cnIdxProc, Pid: uint32(os.Getpid())}); err != nil {
+		syscall.Close(conn)
+		return -1, err
+	}
+
+	// nlmsghdr + cn_msg + PROC_CN_MCAST_LISTEN
+	message := make([]byte, netlinkHeaderLength+connectorHeaderLength+4)
+	binary.LittleEndian.PutUint32(message[0:], uint32(len(message)))
+	binary.LittleEndian.PutUint16(message[4:], syscall.NLMSG_DONE)
+	binary.LittleEndian.PutUint32(message[12:], uint32(os.Getpid()))
+	binary.LittleEndian.PutUint32(message[16:], cnIdxProc)
+	binary.LittleEndian.PutUint32(message[20:], cnValProc)
+	binary.LittleEndian.PutUint16(message[32:], 4)
+	binary.LittleEndian.PutUint32(message[36:], procCnMcastListen)
+	if err := syscall.Sendto(conn, message, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		syscall.Close(conn)
+		return -1, err
+	}
+	return conn, nil
+}
+
+// readProcConnector 读取 proc connector 的事件，对每个 exec 事件以进程的 TGID 调用 onExec
+func readProcConnector(conn int, onExec func(pid int)) error {
+	buffer := make([]byte, 64*1024)
+	for {
+		n, _, err := syscall.Recvfrom(conn, buffer, 0)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err == syscall.ENOBUFS {
+			// 事件过多时内核会丢弃事件，继续读取
+			fmt.Fprintln(os.Stderr, "Some process events were dropped by the kernel (ENOBUFS)")
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		messages, err := syscall.ParseNetlinkMessage(buffer[:n])
+		if err != nil {
+			continue
+		}
+		for _, message := range messages {
+			data := message.Data
+			// cn_msg 之后是 proc_event：what(4) cpu(4) timestamp_ns(8) 和事件数据
+			if len(data) < connectorHeaderLength+16+8 {
+				continue
+			}
+			event := data[connectorHeaderLength:]
+			if binary.LittleEndian.Uint32(event[0:]) != procEventExec {
+				continue
+			}
+			// exec_proc_event：process_pid(4) process_tgid(4)
+			tgid := int(binary.LittleEndian.Uint32(event[20:]))
+			onExec(tgid)
+		}
+	}
+}
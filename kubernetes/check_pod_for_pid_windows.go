@@ -0,0 +1,260 @@
+//go:build windows
+
+package main
+
+// 本文件是 check_pod_for_pid.go 在 Windows 节点上的实现。Windows 没有 /proc 和 cgroup：
+// 进程所属的容器来自 HCS（Host Compute Service，vmcompute.dll）列出的各个容器的进程列表，
+// 进程的祖先链来自 Toolhelp 进程快照，新进程通过周期扫描进程快照发现。
+// 只有进程隔离的容器可以归属：Hyper-V 隔离的容器运行在独立的实用虚拟机中，其进程在主机上不可见。
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// containerInitKnown 表示能否识别容器的入口进程：Windows 容器中的入口进程和 exec 会话都由 CExecSvc 启动，无法区分
+const containerInitKnown = false
+
+// processQueryLimitedInformation 是 OpenProcess 的 PROCESS_QUERY_LIMITED_INFORMATION 权限
+const processQueryLimitedInformation = 0x1000
+
+var (
+	vmcompute                         = syscall.NewLazyDLL("vmcompute.dll")
+	procHcsEnumerateComputeSystems    = vmcompute.NewProc("HcsEnumerateComputeSystems")
+	procHcsOpenComputeSystem          = vmcompute.NewProc("HcsOpenComputeSystem")
+	procHcsGetComputeSystemProperties = vmcompute.NewProc("HcsGetComputeSystemProperties")
+	procHcsCloseComputeSystem         = vmcompute.NewProc("HcsCloseComputeSystem")
+	procCoTaskMemFree                 = syscall.NewLazyDLL("ole32.dll").NewProc("CoTaskMemFree")
+)
+
+// hcsComputeSystem 是 HcsEnumerateComputeSystems 返回的一个计算系统（容器或实用虚拟机）
+type hcsComputeSystem struct {
+	Id         string // 容器 ID，containerd 和 Docker 使用容器的 ID
+	SystemType string // Container 或 VirtualMachine
+	Owner      string // 创建者，例如 containerd-shim-runhcs-v1.exe
+}
+
+// hcsProcess 是计算系统 ProcessList 属性中的一个进程，进程隔离的容器中的进程 ID 与主机一致
+type hcsProcess struct {
+	ProcessId uint32
+	ImageName string
+}
+
+// processContainer 返回进程所属的 Pod ID、Container ID，以及是否为主机进程。
+// HCS 中没有 Pod 的信息，Pod ID 总是为空，由调用者通过 Container ID 查找 Pod。
+func processContainer(pid string) (string, string, bool) {
+	pidNumber, err := strconv.Atoi(pid)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "无效的 PID %s：%v\n", pid, err)
+		return "", "", false
+	}
+	containers, err := containerProcesses()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "无法通过 HCS 列出容器的进程：%v\n", err)
+		return "", "", false
+	}
+	if containerID, ok := containers[pidNumber]; ok {
+		return "", containerID, false
+	}
+	return "", "", true
+}
+
+// containerProcesses 返回所有进程隔离的容器中的进程 ID 及其所属的容器 ID
+func containerProcesses() (map[int]string, error) {
+	var output *uint16
+	if err := hcsCall(procHcsEnumerateComputeSystems, utf16Arg("{}"), uintptr(unsafe.Pointer(&output))); err != nil {
+		return nil, err
+	}
+	var systems []hcsComputeSystem
+	if err := json.Unmarshal([]byte(takeHCSString(output)), &systems); err != nil {
+		return nil, fmt.Errorf("无法解析 HCS 的计算系统列表：%v", err)
+	}
+
+	processes := make(map[int]string)
+	for _, system := range systems {
+		if system.SystemType != "Container" {
+			continue
+		}
+		list, err := computeSystemProcesses(system.Id)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "无法列出容器 %s 的进程：%v\n", shortID(system.Id), err)
+			continue
+		}
+		for _, process := range list {
+			processes[int(process.ProcessId)] = system.Id
+		}
+	}
+	return processes, nil
+}
+
+// computeSystemProcesses 查询一个计算系统的 ProcessList 属性
+func computeSystemProcesses(id string) ([]hcsProcess, error) {
+	var handle uintptr
+	if err := hcsCall(procHcsOpenComputeSystem, utf16Arg(id), uintptr(unsafe.Pointer(&handle))); err != nil {
+		return nil, err
+	}
+	defer procHcsCloseComputeSystem.Call(handle)
+
+	var output *uint16
+	if err := hcsCall(procHcsGetComputeSystemProperties, handle, utf16Arg(`{"PropertyTypes":["ProcessList"]}`), uintptr(unsafe.Pointer(&output))); err != nil {
+		return nil, err
+	}
+	var properties struct {
+		ProcessList []hcsProcess
+	}
+	if err := json.Unmarshal([]byte(takeHCSString(output)), &properties); err != nil {
+		return nil, fmt.Errorf("无法解析计算系统 %s 的进程列表：%v", id, err)
+	}
+	return properties.ProcessList, nil
+}
+
+// hcsCall 调用一个 HCS 函数，args 之后追加接收错误文档的参数。HCS 以 HRESULT 报告失败，并在错误文档中给出原因。
+func hcsCall(proc *syscall.LazyProc, args ...uintptr) error {
+	if err := proc.Find(); err != nil {
+		return fmt.Errorf("HCS 不可用，节点需要启用 Containers 功能：%v", err)
+	}
+	var result *uint16
+	hr, _, _ := proc.Call(append(args, uintptr(unsafe.Pointer(&result)))...)
+	message := takeHCSString(result)
+	if int32(hr) < 0 {
+		return fmt.Errorf("%s 失败（HRESULT 0x%08X）：%s", proc.Name, uint32(hr), message)
+	}
+	return nil
+}
+
+// utf16Arg 将字符串转换为以 NUL 结尾的 UTF-16 字符串的指针，作为系统调用的参数
+func utf16Arg(s string) uintptr {
+	p, _ := syscall.UTF16PtrFromString(s)
+	return uintptr(unsafe.Pointer(p))
+}
+
+// takeHCSString 读取 HCS 分配的 UTF-16 字符串，并通过 CoTaskMemFree 释放
+func takeHCSString(p *uint16) string {
+	if p == nil {
+		return ""
+	}
+	defer procCoTaskMemFree.Call(uintptr(unsafe.Pointer(p)))
+	n := 0
+	for ptr := unsafe.Pointer(p); *(*uint16)(ptr) != 0; ptr = unsafe.Add(ptr, 2) {
+		n++
+	}
+	return syscall.UTF16ToString(unsafe.Slice(p, n))
+}
+
+// processSnapshot 通过 Toolhelp 快照返回所有进程的信息
+func processSnapshot() (map[int]syscall.ProcessEntry32, error) {
+	snapshot, err := syscall.CreateToolhelp32Snapshot(syscall.TH32CS_SNAPPROCESS, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer syscall.CloseHandle(snapshot)
+
+	processes := make(map[int]syscall.ProcessEntry32)
+	entry := syscall.ProcessEntry32{Size: uint32(unsafe.Sizeof(syscall.ProcessEntry32{}))}
+	for err = syscall.Process32First(snapshot, &entry); err == nil; err = syscall.Process32Next(snapshot, &entry) {
+		processes[int(entry.ProcessID)] = entry
+	}
+	if err != syscall.ERROR_NO_MORE_FILES {
+		return nil, err
+	}
+	return processes, nil
+}
+
+// getProcessAncestors 返回从给定进程开始，按父进程 ID 逐级向上的祖先链。
+//
+// 与 Linux 的区别：
+// 1. 进程名为可执行文件名，读取其他进程的命令行需要读取其 PEB，因此 Cmdline 为空。
+// 2. Windows 不会在父进程退出时重新指定父进程，父进程 ID 可能已经被复用，祖先链遇到这种情况时可能不准确。
+// 3. 容器中没有 PID 命名空间，ContainerNS 总是为 false。
+func getProcessAncestors(pid int) ([]ProcessAncestor, error) {
+	processes, err := processSnapshot()
+	if err != nil {
+		return nil, fmt.Errorf("无法获取进程快照：%v", err)
+	}
+	containers, err := containerProcesses()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "无法通过 HCS 列出容器的进程，祖先链中不包含容器信息：%v\n", err)
+	}
+
+	var ancestors []ProcessAncestor
+	seen := make(map[int]bool)
+	for pid > 0 && !seen[pid] {
+		seen[pid] = true
+		entry, ok := processes[pid]
+		if !ok {
+			if len(ancestors) == 0 {
+				return nil, fmt.Errorf("进程 %d 不存在", pid)
+			}
+			break
+		}
+		ancestor := ProcessAncestor{PID: pid, PPID: int(entry.ParentProcessID), Comm: syscall.UTF16ToString(entry.ExeFile[:])}
+		ancestor.ContainerID = containers[pid]
+		ancestor.IsHost = ancestor.ContainerID == ""
+		ancestors = append(ancestors, ancestor)
+		pid = ancestor.PPID
+	}
+	return ancestors, nil
+}
+
+// followProcesses 持续输出本节点上新创建的进程及其所属的 Pod（JSONL）。
+// Windows 上没有 proc connector，只支持周期扫描进程快照，存活时间短于扫描间隔的进程可能被漏掉。
+func followProcesses(source string, interval time.Duration, all bool, resolver *podResolver) error {
+	if source == "netlink" {
+		return fmt.Errorf("Windows 上没有 proc connector，请使用 -follow-source=scan")
+	}
+	encoder := json.NewEncoder(os.Stdout)
+
+	// 第一次扫描只记录已存在的进程
+	known, err := scanProcesses()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Scanning the process snapshot every %s\n", interval)
+	for range time.Tick(interval) {
+		current, err := scanProcesses()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to scan the processes: %v\n", err)
+			continue
+		}
+		for pid, started := range current {
+			if previous, ok := known[pid]; ok && previous == started {
+				continue
+			}
+			event := describeNewProcess(pid, "scan", resolver)
+			if event.ContainerID == "" && !all {
+				continue
+			}
+			encoder.Encode(event)
+		}
+		known = current
+	}
+	return nil
+}
+
+// scanProcesses 返回所有进程的 PID 及其标识：进程的创建时间，无法打开进程时为父进程 ID 和可执行文件名，
+// 用于识别被复用的 PID
+func scanProcesses() (map[int]string, error) {
+	snapshot, err := processSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	processes := make(map[int]string)
+	for pid, entry := range snapshot {
+		processes[pid] = fmt.Sprintf("%d/%s", entry.ParentProcessID, syscall.UTF16ToString(entry.ExeFile[:]))
+		process, err := syscall.OpenProcess(processQueryLimitedInformation, false, uint32(pid))
+		if err != nil {
+			continue
+		}
+		var creation, exit, kernel, user syscall.Filetime
+		if syscall.GetProcessTimes(process, &creation, &exit, &kernel, &user) == nil {
+			processes[pid] = strconv.FormatInt(creation.Nanoseconds(), 10)
+		}
+		syscall.CloseHandle(process)
+	}
+	return processes, nil
+}
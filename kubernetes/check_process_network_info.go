@@ -7,20 +7,43 @@
 3. 切换到目标进程的网络命名空间。
 4. 获取指定网络接口(如果提供)或所有接口的IPv4和IPv6地址。
 5. 输出获取到的IP地址信息。
+6. diff 模式下,比较目标进程与主机(PID 1)网络命名空间中的地址、路由和 sysctl,
+   以 JSON 格式只输出不同的条目,便于排查非对称路由等问题。
+7. route-to 模式下,在目标进程的网络命名空间中对目的地址做一次路由查找(netlink FIB 查找,不发送任何报文),
+   以 JSON 格式输出选中的出接口、网关和源地址,用于安全地验证路由决策。
+8. 输出目标进程接口的 MTU 路径:主机一侧的 veth 对端、所在网桥(ipvlan/macvlan 为父接口)、隧道接口和默认路由出接口的 MTU,
+   任何一段的 MTU 小于目标进程接口的 MTU 时输出 WARNING,用于发现封装方式变化后静默的 MTU 不一致。
+9. 支持 Windows 节点:通过 HCS(Host Compute Service)找到进程所属的容器,从 HNS(Host Networking Service)的端点中
+   报告挂载到该容器的端点地址,主机进程报告主机接口的地址;diff、route-to 和 MTU 路径在 Windows 节点上报告不支持。
+
+与操作系统相关的实现在 check_process_network_info_linux.go 和 check_process_network_info_windows.go 中(以 build tag 区分),
+运行时需要与本文件一起指定,go run 会忽略命令行上列出的文件的 build tag。
 
 使用方法:
-go run check_process_network_info.go <PID> [interface1] [interface2] ...
+go run check_process_network_info.go check_process_network_info_linux.go <PID> [interface1] [interface2] ...
+go run check_process_network_info.go check_process_network_info_linux.go -diff <PID>
+go run check_process_network_info.go check_process_network_info_linux.go -route-to <dest-ip> <PID>
+Windows 节点上(PowerShell):
+go run check_process_network_info.go check_process_network_info_windows.go <PID>
 
 工作原理:
 1. 使用netns包切换到目标进程的网络命名空间。
 2. 遍历指定的网络接口(或所有接口),获取其IP地址。
 3. 将获取到的IP地址分类为IPv4和IPv6。
 4. 返回到原始网络命名空间并输出结果。
+5. 在主机(PID 1)网络命名空间中按 veth 的对端索引找到主机一侧的接口,并读取其网桥、隧道接口和出接口的 MTU。
 
 注意事项:
 - 需要root权限才能切换网络命名空间。
 - 如果不指定接口名称,将获取所有接口的IP地址。
 - 程序会同时获取IPv4和IPv6地址。
+- diff 模式比较的路由为 main 路由表中的路由;sysctl 包括转发、rp_filter、accept_local 等与路由相关的全局和接口级参数。
+- MTU 路径中的隧道接口(vxlan、geneve、ipip、wireguard 等)为主机上所有的隧道接口,只有跨节点的报文会经过它们;
+  出接口为主机 main 路由表中默认路由的接口。目标进程与主机共享网络命名空间时不检查 MTU 路径。
+- route-to 模式的查找结果与内核为该目的地址发出的报文选择的路由一致,会考虑策略路由规则,但不考虑报文的 fwmark 和 iptables 的修改。
+- Windows 节点上需要以管理员身份运行(或在 HostProcess 容器中运行),只支持进程隔离的容器。接口名称参数匹配 HNS 端点的名称。
+  端点通过其 SharedContainers 匹配容器,containerd 将端点挂载到 Pod 的网络命名空间而不是容器,此时可能找不到端点,
+  程序会报错并提示使用 hnsdiag list endpoints 查看。
 
 此程序对于理解容器化环境中进程的网络配置非常有用,
 可用于网络调试、监控和系统管理等场景。
@@ -29,12 +52,12 @@ go run check_process_network_info.go <PID> [interface1] [interface2] ...
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"net"
 	"os"
+	"runtime"
 	"strconv"
-
-	"github.com/vishvananda/netns"
 )
 
 type IPAddresses struct {
@@ -44,10 +67,59 @@ type IPAddresses struct {
 
 func main() {
 	if len(os.Args) < 2 {
-		fmt.Println("Usage: go run check_process_network_info.go <PID> [interface1] [interface2] ...")
+		fmt.Printf("Usage: go run check_process_network_info.go check_process_network_info_%s.go <PID> [interface1] [interface2] ...\n", runtime.GOOS)
+		fmt.Printf("       go run check_process_network_info.go check_process_network_info_%s.go -diff <PID>\n", runtime.GOOS)
+		fmt.Printf("       go run check_process_network_info.go check_process_network_info_%s.go -route-to <dest-ip> <PID>\n", runtime.GOOS)
 		os.Exit(1)
 	}
 
+	if os.Args[1] == "-route-to" {
+		if len(os.Args) != 4 {
+			fmt.Printf("Usage: go run check_process_network_info.go check_process_network_info_%s.go -route-to <dest-ip> <PID>\n", runtime.GOOS)
+			os.Exit(1)
+		}
+		dst := net.ParseIP(os.Args[2])
+		if dst == nil {
+			fmt.Printf("Invalid destination IP: %s\n", os.Args[2])
+			os.Exit(1)
+		}
+		pid, err := strconv.Atoi(os.Args[3])
+		if err != nil {
+			fmt.Printf("Invalid PID: %v\n", err)
+			os.Exit(1)
+		}
+
+		lookup, err := LookupRoute(pid, dst)
+		if err != nil {
+			fmt.Printf("Error looking up the route: %v\n", err)
+			os.Exit(1)
+		}
+		output, _ := json.MarshalIndent(lookup, "", "  ")
+		fmt.Println(string(output))
+		return
+	}
+
+	if os.Args[1] == "-diff" {
+		if len(os.Args) != 3 {
+			fmt.Printf("Usage: go run check_process_network_info.go check_process_network_info_%s.go -diff <PID>\n", runtime.GOOS)
+			os.Exit(1)
+		}
+		pid, err := strconv.Atoi(os.Args[2])
+		if err != nil {
+			fmt.Printf("Invalid PID: %v\n", err)
+			os.Exit(1)
+		}
+
+		diff, err := DiffWithHost(pid)
+		if err != nil {
+			fmt.Printf("Error comparing network namespaces: %v\n", err)
+			os.Exit(1)
+		}
+		output, _ := json.MarshalIndent(diff, "", "  ")
+		fmt.Println(string(output))
+		return
+	}
+
 	pid, err := strconv.Atoi(os.Args[1])
 	if err != nil {
 		fmt.Printf("Invalid PID: %v\n", err)
@@ -71,31 +143,32 @@ func main() {
 	for _, ip := range ips.IPv6 {
 		fmt.Println(ip)
 	}
-}
 
-func GetContainerIP(pid int, interfaceNames []string) (*IPAddresses, error) {
-	// Save current network namespace
-	currentNS, err := netns.Get()
+	// MTU 检查失败不影响已经输出的地址
+	paths, err := CheckMTUPath(pid, interfaceNames)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get current network namespace: %v", err)
+		fmt.Printf("Error checking the MTU path: %v\n", err)
+		return
 	}
-	defer currentNS.Close()
-
-	// Get target process network namespace
-	targetNS, err := netns.GetFromPid(pid)
-	if err != nil {
-		return nil, fmt.Errorf("failed to get target process network namespace: %v", err)
+	if paths == nil {
+		fmt.Println("MTU path: the process shares the host network namespace")
+		return
+	}
+	for _, path := range paths {
+		fmt.Printf("MTU path of %s:\n", path.PodInterface)
+		for _, segment := range path.Segments {
+			fmt.Printf("  %-9s %-16s %-9s mtu %d\n", segment.Role, segment.Interface, segment.Type, segment.MTU)
+		}
+		for _, warning := range path.Warnings {
+			fmt.Printf("WARNING: %s\n", warning)
+		}
 	}
-	defer targetNS.Close()
+}
 
+// interfaceIPs 获取当前网络命名空间中指定接口(或所有接口)的 IPv4 和 IPv6 地址,忽略回环接口和链路本地地址
+func interfaceIPs(interfaceNames []string) (*IPAddresses, error) {
 	var allIPs IPAddresses
 
-	// Switch to target network namespace
-	err = netns.Set(targetNS)
-	if err != nil {
-		return nil, fmt.Errorf("failed to switch to target network namespace: %v", err)
-	}
-
 	// Get all network interfaces
 	interfaces, err := net.Interfaces()
 	if err != nil {
@@ -142,16 +215,6 @@ func GetContainerIP(pid int, interfaceNames []string) (*IPAddresses, error) {
 		}
 	}
 
-	// Switch back to original network namespace
-	err = netns.Set(currentNS)
-	if err != nil {
-		return nil, fmt.Errorf("failed to switch back to original network namespace: %v", err)
-	}
-
-	if len(allIPs.IPv4) == 0 && len(allIPs.IPv6) == 0 {
-		return nil, fmt.Errorf("no valid IP addresses found")
-	}
-
 	return &allIPs, nil
 }
 
@@ -172,3 +235,59 @@ func containsIP(slice []net.IP, ip net.IP) bool {
 	}
 	return false
 }
+
+// NetnsSnapshot 记录一个网络命名空间中的地址、路由和 sysctl
+type NetnsSnapshot struct {
+	Addresses []string          // "接口 地址/掩码"
+	Routes    []string          // main 路由表中的路由
+	Sysctls   map[string]string // 与路由相关的 sysctl
+}
+
+// ValueDiff 表示同一个键在两个网络命名空间中的不同取值
+type ValueDiff struct {
+	Key  string `json:"Key"`
+	Pod  string `json:"Pod"`  // 目标进程网络命名空间中的取值,不存在时为空
+	Host string `json:"Host"` // 主机网络命名空间中的取值,不存在时为空
+}
+
+// ListDiff 表示只存在于其中一个网络命名空间中的条目
+type ListDiff struct {
+	OnlyInPod  []string `json:"OnlyInPod"`
+	OnlyInHost []string `json:"OnlyInHost"`
+}
+
+// NetnsDiff 表示目标进程与主机网络命名空间之间的差异,只包含不同的条目
+type NetnsDiff struct {
+	PID       int         `json:"PID"`
+	SameNetns bool        `json:"SameNetns"` // 目标进程是否与主机共享网络命名空间
+	Addresses ListDiff    `json:"Addresses"`
+	Routes    ListDiff    `json:"Routes"`
+	Sysctls   []ValueDiff `json:"Sysctls"`
+}
+
+// RouteLookup 表示在目标进程网络命名空间中对一个目的地址的路由查找结果
+type RouteLookup struct {
+	PID         int    `json:"PID"`
+	Destination string `json:"Destination"`
+	Interface   string `json:"Interface"` // 选中的出接口
+	Gateway     string `json:"Gateway"`   // 下一跳网关,目的地址直连时为空
+	Source      string `json:"Source"`    // 内核为报文选择的源地址
+	Table       int    `json:"Table"`     // 命中的路由表
+	Route       string `json:"Route"`     // 类似 ip route get 的输出
+}
+
+// MTUSegment 表示目标进程接口到主机出接口的路径上的一段接口
+type MTUSegment struct {
+	Role      string `json:"Role"` // pod、host-veth、bridge、parent、tunnel 或 uplink
+	Interface string `json:"Interface"`
+	Type      string `json:"Type"` // 接口类型,如 veth、bridge、vxlan
+	MTU       int    `json:"MTU"`
+}
+
+// MTUPath 表示目标进程的一个接口经过主机的路径及其各段 MTU
+type MTUPath struct {
+	PodInterface string       `json:"PodInterface"`
+	PodMTU       int          `json:"PodMTU"`
+	Segments     []MTUSegment `json:"Segments"`
+	Warnings     []string     `json:"Warnings"` // MTU 小于目标进程接口 MTU 的路径段
+}
@@ -0,0 +1,448 @@
+//go:build linux
+
+package main
+
+// 本文件是 check_process_network_info.go 在 Linux 节点上的实现:切换到目标进程的网络命名空间,
+// 通过 netlink 读取其接口、路由和 sysctl。
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+)
+
+// GetContainerIP 切换到目标进程的网络命名空间,获取指定接口(或所有接口)的 IPv4 和 IPv6 地址
+func GetContainerIP(pid int, interfaceNames []string) (*IPAddresses, error) {
+	// Save current network namespace
+	currentNS, err := netns.Get()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get current network namespace: %v", err)
+	}
+	defer currentNS.Close()
+
+	// Get target process network namespace
+	targetNS, err := netns.GetFromPid(pid)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get target process network namespace: %v", err)
+	}
+	defer targetNS.Close()
+
+	// Switch to target network namespace
+	err = netns.Set(targetNS)
+	if err != nil {
+		return nil, fmt.Errorf("failed to switch to target network namespace: %v", err)
+	}
+
+	allIPs, err := interfaceIPs(interfaceNames)
+	if err != nil {
+		netns.Set(currentNS)
+		return nil, err
+	}
+
+	// Switch back to original network namespace
+	err = netns.Set(currentNS)
+	if err != nil {
+		return nil, fmt.Errorf("failed to switch back to original network namespace: %v", err)
+	}
+
+	if len(allIPs.IPv4) == 0 && len(allIPs.IPv6) == 0 {
+		return nil, fmt.Errorf("no valid IP addresses found")
+	}
+
+	return allIPs, nil
+}
+
+// routingSysctls 是与路由相关的全局 sysctl,相对于 /proc/sys
+var routingSysctls = []string{
+	"net/ipv4/ip_forward",
+	"net/ipv4/conf/all/rp_filter",
+	"net/ipv4/conf/default/rp_filter",
+	"net/ipv4/conf/all/accept_local",
+	"net/ipv4/conf/all/src_valid_mark",
+	"net/ipv4/fwmark_reflect",
+	"net/ipv4/tcp_fwmark_accept",
+	"net/ipv4/ip_local_port_range",
+	"net/ipv6/conf/all/forwarding",
+	"net/ipv6/conf/all/disable_ipv6",
+	"net/ipv6/fwmark_reflect",
+}
+
+// interfaceSysctls 是与路由相关的接口级 sysctl,%s 为接口名称
+var interfaceSysctls = []string{
+	"net/ipv4/conf/%s/rp_filter",
+	"net/ipv4/conf/%s/accept_local",
+	"net/ipv4/conf/%s/forwarding",
+	"net/ipv6/conf/%s/forwarding",
+	"net/ipv6/conf/%s/disable_ipv6",
+}
+
+// DiffWithHost 比较目标进程与主机(PID 1)网络命名空间中的地址、路由和 sysctl
+func DiffWithHost(pid int) (*NetnsDiff, error) {
+	hostNS, err := netns.GetFromPath("/proc/1/ns/net")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get host network namespace: %v", err)
+	}
+	defer hostNS.Close()
+
+	targetNS, err := netns.GetFromPid(pid)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get target process network namespace: %v", err)
+	}
+	defer targetNS.Close()
+
+	podSnapshot, err := collectSnapshot(targetNS)
+	if err != nil {
+		return nil, fmt.Errorf("failed to inspect target process network namespace: %v", err)
+	}
+	hostSnapshot, err := collectSnapshot(hostNS)
+	if err != nil {
+		return nil, fmt.Errorf("failed to inspect host network namespace: %v", err)
+	}
+
+	diff := &NetnsDiff{
+		PID:       pid,
+		SameNetns: hostNS.Equal(targetNS),
+		Addresses: diffLists(podSnapshot.Addresses, hostSnapshot.Addresses),
+		Routes:    diffLists(podSnapshot.Routes, hostSnapshot.Routes),
+	}
+
+	keys := make(map[string]bool)
+	for key := range podSnapshot.Sysctls {
+		keys[key] = true
+	}
+	for key := range hostSnapshot.Sysctls {
+		keys[key] = true
+	}
+	for key := range keys {
+		if podSnapshot.Sysctls[key] != hostSnapshot.Sysctls[key] {
+			diff.Sysctls = append(diff.Sysctls, ValueDiff{Key: key, Pod: podSnapshot.Sysctls[key], Host: hostSnapshot.Sysctls[key]})
+		}
+	}
+	sort.Slice(diff.Sysctls, func(i, j int) bool { return diff.Sysctls[i].Key < diff.Sysctls[j].Key })
+
+	return diff, nil
+}
+
+// collectSnapshot 切换到指定的网络命名空间,读取地址、路由和 sysctl 后切换回来
+//
+// 网络命名空间是线程级别的属性,因此在切换期间需要锁定当前线程。
+func collectSnapshot(ns netns.NsHandle) (*NetnsSnapshot, error) {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	currentNS, err := netns.Get()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get current network namespace: %v", err)
+	}
+	defer currentNS.Close()
+
+	if err := netns.Set(ns); err != nil {
+		return nil, fmt.Errorf("failed to switch network namespace: %v", err)
+	}
+	defer netns.Set(currentNS)
+
+	snapshot := &NetnsSnapshot{Sysctls: make(map[string]string)}
+
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get network interfaces: %v", err)
+	}
+	linkNames := make(map[int]string)
+	for _, iface := range interfaces {
+		linkNames[iface.Index] = iface.Name
+
+		addrs, err := iface.Addrs()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get the ip of interface %s: %v", iface.Name, err)
+		}
+		for _, addr := range addrs {
+			snapshot.Addresses = append(snapshot.Addresses, iface.Name+" "+addr.String())
+		}
+
+		for _, format := range interfaceSysctls {
+			readSysctl(snapshot.Sysctls, fmt.Sprintf(format, iface.Name))
+		}
+	}
+
+	routes, err := netlink.RouteList(nil, netlink.FAMILY_ALL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list routes: %v", err)
+	}
+	for _, route := range routes {
+		snapshot.Routes = append(snapshot.Routes, formatRoute(route, linkNames))
+	}
+
+	for _, key := range routingSysctls {
+		readSysctl(snapshot.Sysctls, key)
+	}
+
+	return snapshot, nil
+}
+
+// readSysctl 读取 /proc/sys 下的 sysctl,不存在的 sysctl 会被忽略
+func readSysctl(sysctls map[string]string, key string) {
+	data, err := os.ReadFile(filepath.Join("/proc/sys", key))
+	if err != nil {
+		return
+	}
+	sysctls[strings.ReplaceAll(key, "/", ".")] = strings.Join(strings.Fields(string(data)), " ")
+}
+
+// formatRoute 将路由格式化为类似 ip route 的输出
+func formatRoute(route netlink.Route, linkNames map[int]string) string {
+	dst := "default"
+	if route.Dst != nil {
+		dst = route.Dst.String()
+	}
+	parts := []string{dst}
+	if route.Gw != nil {
+		parts = append(parts, "via", route.Gw.String())
+	}
+	if name, ok := linkNames[route.LinkIndex]; ok {
+		parts = append(parts, "dev", name)
+	}
+	if route.Src != nil {
+		parts = append(parts, "src", route.Src.String())
+	}
+	if route.Priority > 0 {
+		parts = append(parts, "metric", strconv.Itoa(route.Priority))
+	}
+	return strings.Join(parts, " ")
+}
+
+// diffLists 返回只存在于其中一个列表中的条目
+func diffLists(pod, host []string) ListDiff {
+	var diff ListDiff
+	for _, item := range pod {
+		if !containStr(host, item) {
+			diff.OnlyInPod = append(diff.OnlyInPod, item)
+		}
+	}
+	for _, item := range host {
+		if !containStr(pod, item) {
+			diff.OnlyInHost = append(diff.OnlyInHost, item)
+		}
+	}
+	sort.Strings(diff.OnlyInPod)
+	sort.Strings(diff.OnlyInHost)
+	return diff
+}
+
+// LookupRoute 切换到目标进程的网络命名空间,通过 netlink 向内核查询到达 dst 的路由,不发送任何报文
+func LookupRoute(pid int, dst net.IP) (*RouteLookup, error) {
+	targetNS, err := netns.GetFromPid(pid)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get target process network namespace: %v", err)
+	}
+	defer targetNS.Close()
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	currentNS, err := netns.Get()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get current network namespace: %v", err)
+	}
+	defer currentNS.Close()
+
+	if err := netns.Set(targetNS); err != nil {
+		return nil, fmt.Errorf("failed to switch network namespace: %v", err)
+	}
+	defer netns.Set(currentNS)
+
+	routes, err := netlink.RouteGet(dst)
+	if err != nil {
+		return nil, fmt.Errorf("no route to %s: %v", dst, err)
+	}
+	if len(routes) == 0 {
+		return nil, fmt.Errorf("no route to %s", dst)
+	}
+	route := routes[0]
+
+	lookup := &RouteLookup{PID: pid, Destination: dst.String(), Table: route.Table}
+	linkNames := make(map[int]string)
+	if link, err := netlink.LinkByIndex(route.LinkIndex); err == nil {
+		lookup.Interface = link.Attrs().Name
+		linkNames[route.LinkIndex] = lookup.Interface
+	}
+	if route.Gw != nil {
+		lookup.Gateway = route.Gw.String()
+	}
+	if route.Src != nil {
+		lookup.Source = route.Src.String()
+	}
+	lookup.Route = formatRoute(route, linkNames)
+
+	return lookup, nil
+}
+
+// tunnelLinkTypes 是会对报文做封装的接口类型,跨节点的报文通常经过它们
+var tunnelLinkTypes = []string{"vxlan", "geneve", "ipip", "ip6tnl", "gre", "gretap", "ip6gre", "wireguard"}
+
+// CheckMTUPath 读取目标进程接口在主机一侧的 veth、网桥、隧道和出接口的 MTU,
+// 任何一段的 MTU 小于目标进程接口的 MTU 时给出警告。目标进程与主机共享网络命名空间时返回 nil。
+func CheckMTUPath(pid int, interfaceNames []string) ([]MTUPath, error) {
+	hostNS, err := netns.GetFromPath("/proc/1/ns/net")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get host network namespace: %v", err)
+	}
+	defer hostNS.Close()
+
+	targetNS, err := netns.GetFromPid(pid)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get target process network namespace: %v", err)
+	}
+	defer targetNS.Close()
+
+	if hostNS.Equal(targetNS) {
+		return nil, nil
+	}
+
+	var podLinks []netlink.Link
+	err = runInNetns(targetNS, func() error {
+		podLinks, err = netlink.LinkList()
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the links of target process network namespace: %v", err)
+	}
+
+	hostLinks := make(map[int]netlink.Link)
+	var uplinks []int
+	err = runInNetns(hostNS, func() error {
+		links, err := netlink.LinkList()
+		if err != nil {
+			return err
+		}
+		for _, link := range links {
+			hostLinks[link.Attrs().Index] = link
+		}
+		routes, err := netlink.RouteList(nil, netlink.FAMILY_ALL)
+		if err != nil {
+			return err
+		}
+		for _, route := range routes {
+			if isDefaultRoute(route) && route.LinkIndex > 0 && !containsInt(uplinks, route.LinkIndex) {
+				uplinks = append(uplinks, route.LinkIndex)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to inspect host network namespace: %v", err)
+	}
+	sort.Ints(uplinks)
+
+	var paths []MTUPath
+	for _, link := range podLinks {
+		attrs := link.Attrs()
+		if attrs.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		if len(interfaceNames) > 0 && !containStr(interfaceNames, attrs.Name) {
+			continue
+		}
+
+		path := MTUPath{PodInterface: attrs.Name, PodMTU: attrs.MTU}
+		path.Segments = append(path.Segments, mtuSegment("pod", link))
+
+		switch link.Type() {
+		case "veth":
+			// 容器内 veth 的 IFLA_LINK 是主机一侧对端的索引,对端的 IFLA_LINK 也应指回本接口,以排除索引巧合
+			peer, ok := hostLinks[attrs.ParentIndex]
+			if ok && peer.Type() == "veth" && peer.Attrs().ParentIndex == attrs.Index {
+				path.Segments = append(path.Segments, mtuSegment("host-veth", peer))
+				if master, ok := hostLinks[peer.Attrs().MasterIndex]; ok {
+					path.Segments = append(path.Segments, mtuSegment("bridge", master))
+				}
+			} else {
+				path.Warnings = append(path.Warnings, fmt.Sprintf("the host side peer of veth %s is not found", attrs.Name))
+			}
+		case "ipvlan", "macvlan":
+			if parent, ok := hostLinks[attrs.ParentIndex]; ok {
+				path.Segments = append(path.Segments, mtuSegment("parent", parent))
+			}
+		}
+
+		for _, index := range sortedLinkIndexes(hostLinks) {
+			if containStr(tunnelLinkTypes, hostLinks[index].Type()) {
+				path.Segments = append(path.Segments, mtuSegment("tunnel", hostLinks[index]))
+			}
+		}
+		for _, index := range uplinks {
+			if uplink, ok := hostLinks[index]; ok {
+				path.Segments = append(path.Segments, mtuSegment("uplink", uplink))
+			}
+		}
+
+		for _, segment := range path.Segments[1:] {
+			if segment.MTU < path.PodMTU {
+				path.Warnings = append(path.Warnings, fmt.Sprintf("%s %s has MTU %d, smaller than MTU %d of pod interface %s",
+					segment.Role, segment.Interface, segment.MTU, path.PodMTU, attrs.Name))
+			}
+		}
+		paths = append(paths, path)
+	}
+
+	return paths, nil
+}
+
+// runInNetns 切换到指定的网络命名空间执行 fn 后切换回来,期间锁定当前线程
+func runInNetns(ns netns.NsHandle, fn func() error) error {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	currentNS, err := netns.Get()
+	if err != nil {
+		return fmt.Errorf("failed to get current network namespace: %v", err)
+	}
+	defer currentNS.Close()
+
+	if err := netns.Set(ns); err != nil {
+		return fmt.Errorf("failed to switch network namespace: %v", err)
+	}
+	defer netns.Set(currentNS)
+
+	return fn()
+}
+
+// isDefaultRoute 判断路由是否为默认路由,netlink 可能以 nil 或 0.0.0.0/0、::/0 表示默认目的地址
+func isDefaultRoute(route netlink.Route) bool {
+	if route.Dst == nil {
+		return true
+	}
+	ones, _ := route.Dst.Mask.Size()
+	return ones == 0
+}
+
+// mtuSegment 根据接口生成一段 MTU 路径
+func mtuSegment(role string, link netlink.Link) MTUSegment {
+	return MTUSegment{Role: role, Interface: link.Attrs().Name, Type: link.Type(), MTU: link.Attrs().MTU}
+}
+
+// sortedLinkIndexes 返回按索引排序的接口索引,使输出稳定
+func sortedLinkIndexes(links map[int]netlink.Link) []int {
+	indexes := make([]int, 0, len(links))
+	for index := range links {
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+	return indexes
+}
+
+func containsInt(slice []int, item int) bool {
+	for _, v := range slice {
+		if v == item {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,214 @@
+//go:build windows
+
+package main
+
+// 本文件是 check_process_network_info.go 在 Windows 节点上的实现。Windows 没有网络命名空间可以切换:
+// 主机进程的地址来自主机的接口;容器中的进程先通过 HCS(Host Compute Service,vmcompute.dll)找到所属的容器,
+// 再从 HNS(Host Networking Service)的端点列表中找到挂载到该容器的端点,报告端点的地址。
+// diff、route-to 和 MTU 路径依赖 Linux 的 netlink,在 Windows 节点上不支持。
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+var (
+	vmcompute                         = syscall.NewLazyDLL("vmcompute.dll")
+	procHcsEnumerateComputeSystems    = vmcompute.NewProc("HcsEnumerateComputeSystems")
+	procHcsOpenComputeSystem          = vmcompute.NewProc("HcsOpenComputeSystem")
+	procHcsGetComputeSystemProperties = vmcompute.NewProc("HcsGetComputeSystemProperties")
+	procHcsCloseComputeSystem         = vmcompute.NewProc("HcsCloseComputeSystem")
+	procHNSCall                       = vmcompute.NewProc("HNSCall")
+	procCoTaskMemFree                 = syscall.NewLazyDLL("ole32.dll").NewProc("CoTaskMemFree")
+)
+
+// errNotSupportedOnWindows 是依赖 netlink 和网络命名空间的功能在 Windows 节点上返回的错误
+var errNotSupportedOnWindows = fmt.Errorf("this check relies on Linux netlink and network namespaces, it is not supported on Windows nodes")
+
+// hnsEndpoint 是 HNS 端点列表中的一个端点
+type hnsEndpoint struct {
+	ID                 string
+	Name               string
+	VirtualNetworkName string
+	IPAddress          string
+	IPv6Address        string
+	MacAddress         string
+	SharedContainers   []string // 挂载了该端点的容器 ID
+}
+
+// GetContainerIP 获取进程的 IPv4 和 IPv6 地址:主机进程为主机接口的地址,容器中的进程为挂载到其容器的 HNS 端点的地址,
+// interfaceNames 此时为端点的名称
+func GetContainerIP(pid int, interfaceNames []string) (*IPAddresses, error) {
+	containerID, err := processContainer(pid)
+	if err != nil {
+		return nil, err
+	}
+	if containerID == "" {
+		fmt.Printf("Process %d is not in a process-isolated container, reporting the host addresses\n", pid)
+		allIPs, err := interfaceIPs(interfaceNames)
+		if err == nil && len(allIPs.IPv4) == 0 && len(allIPs.IPv6) == 0 {
+			err = fmt.Errorf("no valid IP addresses found")
+		}
+		return allIPs, err
+	}
+
+	endpoints, err := listHNSEndpoints()
+	if err != nil {
+		return nil, err
+	}
+	var allIPs IPAddresses
+	for _, endpoint := range endpoints {
+		if !containsContainer(endpoint.SharedContainers, containerID) {
+			continue
+		}
+		if len(interfaceNames) > 0 && !containStr(interfaceNames, endpoint.Name) {
+			continue
+		}
+		fmt.Printf("Container %s endpoint %s on network %s (MAC %s)\n", containerID, endpoint.Name, endpoint.VirtualNetworkName, endpoint.MacAddress)
+		if ip := net.ParseIP(endpoint.IPAddress); ip != nil && !containsIP(allIPs.IPv4, ip) {
+			allIPs.IPv4 = append(allIPs.IPv4, ip)
+		}
+		if ip := net.ParseIP(endpoint.IPv6Address); ip != nil && !containsIP(allIPs.IPv6, ip) {
+			allIPs.IPv6 = append(allIPs.IPv6, ip)
+		}
+	}
+	if len(allIPs.IPv4) == 0 && len(allIPs.IPv6) == 0 {
+		// containerd 将端点挂载到 Pod 的网络命名空间而不是容器,HNS 中的端点不一定记录容器 ID
+		return nil, fmt.Errorf("no HNS endpoint is attached to container %s, the endpoints of containerd pods are attached to their network namespace, see hnsdiag list endpoints", containerID)
+	}
+	return &allIPs, nil
+}
+
+// DiffWithHost 在 Windows 节点上不支持
+func DiffWithHost(pid int) (*NetnsDiff, error) {
+	return nil, errNotSupportedOnWindows
+}
+
+// LookupRoute 在 Windows 节点上不支持
+func LookupRoute(pid int, dst net.IP) (*RouteLookup, error) {
+	return nil, errNotSupportedOnWindows
+}
+
+// CheckMTUPath 在 Windows 节点上不支持
+func CheckMTUPath(pid int, interfaceNames []string) ([]MTUPath, error) {
+	return nil, errNotSupportedOnWindows
+}
+
+// containsContainer 判断容器 ID 列表中是否包含 containerID,忽略大小写
+func containsContainer(containers []string, containerID string) bool {
+	for _, id := range containers {
+		if strings.EqualFold(id, containerID) {
+			return true
+		}
+	}
+	return false
+}
+
+// processContainer 返回进程所属的进程隔离容器的 ID,主机进程返回空字符串
+func processContainer(pid int) (string, error) {
+	var output *uint16
+	if err := hcsCall(procHcsEnumerateComputeSystems, utf16Arg("{}"), uintptr(unsafe.Pointer(&output))); err != nil {
+		return "", err
+	}
+	var systems []struct {
+		Id         string
+		SystemType string // Container 或 VirtualMachine
+	}
+	if err := json.Unmarshal([]byte(takeHCSString(output)), &systems); err != nil {
+		return "", fmt.Errorf("failed to parse the compute systems of HCS: %v", err)
+	}
+
+	for _, system := range systems {
+		if system.SystemType != "Container" {
+			continue
+		}
+		var handle uintptr
+		if err := hcsCall(procHcsOpenComputeSystem, utf16Arg(system.Id), uintptr(unsafe.Pointer(&handle))); err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to open container %s: %v\n", system.Id, err)
+			continue
+		}
+		var properties struct {
+			ProcessList []struct {
+				ProcessId uint32
+			}
+		}
+		err := hcsCall(procHcsGetComputeSystemProperties, handle, utf16Arg(`{"PropertyTypes":["ProcessList"]}`), uintptr(unsafe.Pointer(&output)))
+		procHcsCloseComputeSystem.Call(handle)
+		if err == nil {
+			err = json.Unmarshal([]byte(takeHCSString(output)), &properties)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to list the processes of container %s: %v\n", system.Id, err)
+			continue
+		}
+		for _, process := range properties.ProcessList {
+			if int(process.ProcessId) == pid {
+				return system.Id, nil
+			}
+		}
+	}
+	return "", nil
+}
+
+// listHNSEndpoints 通过 HNSCall 列出 HNS 的所有端点
+func listHNSEndpoints() ([]hnsEndpoint, error) {
+	if err := procHNSCall.Find(); err != nil {
+		return nil, fmt.Errorf("HNS is not available, the node needs the Containers feature: %v", err)
+	}
+	var output *uint16
+	hr, _, _ := procHNSCall.Call(utf16Arg("GET"), utf16Arg("/endpoints/"), utf16Arg(""), uintptr(unsafe.Pointer(&output)))
+	response := takeHCSString(output)
+	if int32(hr) < 0 {
+		return nil, fmt.Errorf("HNSCall failed (HRESULT 0x%08X): %s", uint32(hr), response)
+	}
+	var result struct {
+		Success bool
+		Error   string
+		Output  []hnsEndpoint
+	}
+	if err := json.Unmarshal([]byte(response), &result); err != nil {
+		return nil, fmt.Errorf("failed to parse the endpoints of HNS: %v", err)
+	}
+	if !result.Success {
+		return nil, fmt.Errorf("HNS failed to list the endpoints: %s", result.Error)
+	}
+	return result.Output, nil
+}
+
+// hcsCall 调用一个 HCS 函数,args 之后追加接收错误文档的参数。HCS 以 HRESULT 报告失败,并在错误文档中给出原因。
+func hcsCall(proc *syscall.LazyProc, args ...uintptr) error {
+	if err := proc.Find(); err != nil {
+		return fmt.Errorf("HCS is not available, the node needs the Containers feature: %v", err)
+	}
+	var result *uint16
+	hr, _, _ := proc.Call(append(args, uintptr(unsafe.Pointer(&result)))...)
+	message := takeHCSString(result)
+	if int32(hr) < 0 {
+		return fmt.Errorf("%s failed (HRESULT 0x%08X): %s", proc.Name, uint32(hr), message)
+	}
+	return nil
+}
+
+// utf16Arg 将字符串转换为以 NUL 结尾的 UTF-16 字符串的指针,作为系统调用的参数
+func utf16Arg(s string) uintptr {
+	p, _ := syscall.UTF16PtrFromString(s)
+	return uintptr(unsafe.Pointer(p))
+}
+
+// takeHCSString 读取 HCS 和 HNS 分配的 UTF-16 字符串,并通过 CoTaskMemFree 释放
+func takeHCSString(p *uint16) string {
+	if p == nil {
+		return ""
+	}
+	defer procCoTaskMemFree.Call(uintptr(unsafe.Pointer(p)))
+	n := 0
+	for ptr := unsafe.Pointer(p); *(*uint16)(ptr) != 0; ptr = unsafe.Add(ptr, 2) {
+		n++
+	}
+	return syscall.UTF16ToString(unsafe.Slice(p, n))
+}
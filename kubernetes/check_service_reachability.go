@@ -0,0 +1,448 @@
+/*
+本程序用于从当前位置检查 Kubernetes 中 NodePort 和 LoadBalancer 类型 Service 的外部可达性，
+自动完成对外暴露的验证，替代手工逐个节点、逐个端口地 curl。
+
+主要功能：
+1. 列出所有（或指定命名空间、标签选择器匹配的）NodePort 和 LoadBalancer 类型的 Service。
+2. 对每个 Service 端口，探测每个节点地址上的 nodePort，以及每个 LoadBalancer ingress IP（或主机名）上的 Service 端口。
+3. TCP 端口先尝试 HTTP GET，失败时退化为只检查 TCP 建连；UDP 端口发送一个探测报文并等待回包。
+   后端是本仓库的 echo 服务器（appServer）时，从回包的 Identity 中解析出应答的后端 Pod 及其所在节点，
+   并与 Service 的 EndpointSlice 对比，确认应答的确实是该 Service 的后端。
+4. 根据 externalTrafficPolicy 推断每个探测的预期结果：Local 策略下，没有本地就绪后端的节点上的 nodePort 预期不可达。
+5. 以 JSON 格式输出所有探测结果和汇总，存在与预期不符的结果时以非零状态退出。
+
+使用方法：
+go run check_service_reachability.go [-kubeconfig=<path>] [-namespace=<ns>] [-selector=<label selector>] \
+    [-address-type=InternalIP] [-timeout=3s] [-concurrency=16] [-skip-lb] [-skip-nodeport]
+
+参数说明：
+-kubeconfig: kubeconfig 文件路径（默认为 ~/.kube/config，文件不存在时使用 in-cluster 配置）
+-namespace: 只检查该命名空间中的 Service（默认为所有命名空间）
+-selector: 只检查匹配该标签选择器的 Service，例如 app=echo（默认为全部）
+-address-type: 探测 nodePort 时使用的节点地址类型，InternalIP 或 ExternalIP（默认为 InternalIP）
+-timeout: 每个探测的超时时间（默认为 3s）
+-concurrency: 同时进行的探测数量（默认为 16）
+-skip-lb: 不探测 LoadBalancer ingress
+-skip-nodeport: 不探测 nodePort
+
+示例：
+  go run check_service_reachability.go -namespace=default -selector=app=echo | jq '.Probes[] | select(.AsExpected | not)'
+
+注意事项：
+- 探测结果取决于运行位置：在集群外运行时验证的是外部暴露，在节点或 Pod 中运行时还会受到 kube-proxy 本地规则的影响。
+- UDP 探测没有收到回包时记为不可达，但 UDP 的后端可能只是不回包，因此只对会回包的后端（例如 echo 服务器）有意义。
+- 不支持 SCTP 端口，这些端口会被记为跳过。
+- 后端不是 echo 服务器时，只能得到可达与否，BackendPod 为空。
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// maxProbeBody 限制读取的 HTTP 响应体大小
+const maxProbeBody = 1 << 20
+
+// ServiceProbe 结构体用于存储一次探测的结果
+type ServiceProbe struct {
+	Service      string  `json:"Service"`      // Service 的 namespace/name
+	PortName     string  `json:"PortName"`     // Service 端口的名称
+	Protocol     string  `json:"Protocol"`     // 端口协议：TCP 或 UDP
+	Kind         string  `json:"Kind"`         // 探测类型：NodePort 或 LoadBalancer
+	Target       string  `json:"Target"`       // 探测的地址 host:port
+	Node         string  `json:"Node"`         // NodePort 探测的节点名称
+	Method       string  `json:"Method"`       // 探测方法：http、tcp、udp 或 skipped
+	Reachable    bool    `json:"Reachable"`    // 是否可达
+	Expected     bool    `json:"Expected"`     // 预期是否可达
+	AsExpected   bool    `json:"AsExpected"`   // 结果是否与预期一致
+	Reason       string  `json:"Reason"`       // 预期结果的依据
+	LatencyMs    float64 `json:"LatencyMs"`    // 探测耗时（毫秒）
+	StatusCode   int     `json:"StatusCode"`   // HTTP 探测的状态码
+	BackendPod   string  `json:"BackendPod"`   // 应答的后端 Pod（namespace/name），后端不是 echo 服务器时为空
+	BackendNode  string  `json:"BackendNode"`  // 应答的后端 Pod 所在的节点
+	KnownBackend bool    `json:"KnownBackend"` // 应答的后端 Pod 是否在该 Service 的 EndpointSlice 中
+	Error        string  `json:"Error"`        // 探测失败的原因
+
+	namespace string            // Service 所在的命名空间
+	backends  map[string]string // Service 的就绪后端 Pod（namespace/name）到节点名称的映射
+}
+
+// ReachabilitySummary 结构体用于存储探测结果的汇总
+type ReachabilitySummary struct {
+	Services   int `json:"Services"`   // 检查的 Service 数量
+	Probes     int `json:"Probes"`     // 探测总数
+	Reachable  int `json:"Reachable"`  // 可达的探测数量
+	Unexpected int `json:"Unexpected"` // 与预期不符的探测数量
+	Skipped    int `json:"Skipped"`    // 跳过的探测数量
+}
+
+// ReachabilityReport 结构体用于存储整体的检查结果
+type ReachabilityReport struct {
+	Vantage   string              `json:"Vantage"`   // 探测发起的位置（主机名）
+	Timestamp string              `json:"Timestamp"` // 检查时间
+	Summary   ReachabilitySummary `json:"Summary"`   // 汇总
+	Probes    []ServiceProbe      `json:"Probes"`    // 所有探测结果
+}
+
+// echoIdentity 是 echo 服务器回包中用于识别后端 Pod 的字段
+type echoIdentity struct {
+	ServerHostName string `json:"ServerHostName"`
+	Identity       struct {
+		PodName      string `json:"PodName"`
+		PodNamespace string `json:"PodNamespace"`
+		NodeName     string `json:"NodeName"`
+	} `json:"Identity"`
+}
+
+// serviceBackends 记录一个 Service 的就绪后端 Pod 及其所在节点
+type serviceBackends struct {
+	pods  map[string]string // Pod（namespace/name）到节点名称的映射
+	nodes map[string]bool   // 有就绪后端的节点
+}
+
+func main() {
+	kubeconfig := flag.String("kubeconfig", filepath.Join(os.Getenv("HOME"), ".kube", "config"), "kubeconfig 文件路径，文件不存在时使用 in-cluster 配置")
+	namespace := flag.String("namespace", "", "只检查该命名空间中的 Service（默认为所有命名空间）")
+	selector := flag.String("selector", "", "只检查匹配该标签选择器的 Service")
+	addressType := flag.String("address-type", string(corev1.NodeInternalIP), "探测 nodePort 时使用的节点地址类型：InternalIP 或 ExternalIP")
+	timeout := flag.Duration("timeout", 3*time.Second, "每个探测的超时时间")
+	concurrency := flag.Int("concurrency", 16, "同时进行的探测数量")
+	skipLB := flag.Bool("skip-lb", false, "不探测 LoadBalancer ingress")
+	skipNodePort := flag.Bool("skip-nodeport", false, "不探测 nodePort")
+	flag.Parse()
+
+	if *concurrency < 1 {
+		fmt.Fprintln(os.Stderr, "-concurrency 必须大于 0")
+		os.Exit(1)
+	}
+
+	clientset, err := newClientset(*kubeconfig)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error creating Kubernetes client: %v\n", err)
+		os.Exit(1)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	services, err := clientset.CoreV1().Services(*namespace).List(ctx, metav1.ListOptions{LabelSelector: *selector})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error listing services: %v\n", err)
+		os.Exit(1)
+	}
+	nodes, err := clientset.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error listing nodes: %v\n", err)
+		os.Exit(1)
+	}
+
+	var probes []ServiceProbe
+	checked := 0
+	for _, svc := range services.Items {
+		if svc.Spec.Type != corev1.ServiceTypeNodePort && svc.Spec.Type != corev1.ServiceTypeLoadBalancer {
+			continue
+		}
+		checked++
+
+		backends, err := listServiceBackends(ctx, clientset, svc)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error listing the endpoints of %s/%s: %v\n", svc.Namespace, svc.Name, err)
+		}
+		probes = append(probes, planServiceProbes(svc, nodes.Items, backends, corev1.NodeAddressType(*addressType), *skipNodePort, *skipLB)...)
+	}
+
+	runProbes(probes, *timeout, *concurrency)
+
+	report := ReachabilityReport{Timestamp: time.Now().Format(time.RFC3339), Probes: probes}
+	report.Vantage, _ = os.Hostname()
+	report.Summary.Services = checked
+	report.Summary.Probes = len(probes)
+	for _, probe := range probes {
+		switch {
+		case probe.Method == "skipped":
+			report.Summary.Skipped++
+		case !probe.AsExpected:
+			report.Summary.Unexpected++
+		}
+		if probe.Reachable {
+			report.Summary.Reachable++
+		}
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(report)
+
+	if report.Summary.Unexpected > 0 {
+		os.Exit(1)
+	}
+}
+
+// newClientset 使用 kubeconfig 创建 Kubernetes 客户端，kubeconfig 文件不存在时使用 in-cluster 配置
+func newClientset(kubeconfig string) (*kubernetes.Clientset, error) {
+	var config *rest.Config
+	var err error
+	if _, statErr := os.Stat(kubeconfig); statErr == nil {
+		config, err = clientcmd.BuildConfigFromFlags("", kubeconfig)
+	} else {
+		config, err = rest.InClusterConfig()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error building kubeconfig: %v", err)
+	}
+	return kubernetes.NewForConfig(config)
+}
+
+// listServiceBackends 从 Service 的 EndpointSlice 中列出就绪的后端 Pod 及其所在节点
+func listServiceBackends(ctx context.Context, clientset *kubernetes.Clientset, svc corev1.Service) (serviceBackends, error) {
+	backends := serviceBackends{pods: make(map[string]string), nodes: make(map[string]bool)}
+	slices, err := clientset.DiscoveryV1().EndpointSlices(svc.Namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: discoveryv1.LabelServiceName + "=" + svc.Name,
+	})
+	if err != nil {
+		return backends, err
+	}
+
+	for _, slice := range slices.Items {
+		for _, endpoint := range slice.Endpoints {
+			if endpoint.Conditions.Ready != nil && !*endpoint.Conditions.Ready {
+				continue
+			}
+			nodeName := ""
+			if endpoint.NodeName != nil {
+				nodeName = *endpoint.NodeName
+				backends.nodes[nodeName] = true
+			}
+			if endpoint.TargetRef != nil && endpoint.TargetRef.Kind == "Pod" {
+				backends.pods[endpoint.TargetRef.Namespace+"/"+endpoint.TargetRef.Name] = nodeName
+			}
+		}
+	}
+	return backends, nil
+}
+
+// planServiceProbes 为 Service 的每个端口生成 nodePort 和 LoadBalancer ingress 的探测，并推断预期结果
+func planServiceProbes(svc corev1.Service, nodes []corev1.Node, backends serviceBackends, addressType corev1.NodeAddressType, skipNodePort, skipLB bool) []ServiceProbe {
+	name := svc.Namespace + "/" + svc.Name
+	local := svc.Spec.ExternalTrafficPolicy == corev1.ServiceExternalTrafficPolicyLocal
+
+	var probes []ServiceProbe
+	for _, port := range svc.Spec.Ports {
+		base := ServiceProbe{Service: name, PortName: port.Name, Protocol: string(port.Protocol), namespace: svc.Namespace, backends: backends.pods}
+		if base.Protocol == "" {
+			base.Protocol = string(corev1.ProtocolTCP)
+		}
+
+		if !skipNodePort && port.NodePort > 0 {
+			for _, node := range nodes {
+				address := nodeAddress(node, addressType)
+				if address == "" {
+					continue
+				}
+				probe := base
+				probe.Kind = "NodePort"
+				probe.Node = node.Name
+				probe.Target = net.JoinHostPort(address, strconv.Itoa(int(port.NodePort)))
+				probe.Expected, probe.Reason = expectReachable(backends, local, node.Name)
+				probes = append(probes, probe)
+			}
+		}
+
+		if !skipLB && svc.Spec.Type == corev1.ServiceTypeLoadBalancer {
+			for _, ingress := range svc.Status.LoadBalancer.Ingress {
+				host := ingress.IP
+				if host == "" {
+					host = ingress.Hostname
+				}
+				if host == "" {
+					continue
+				}
+				probe := base
+				probe.Kind = "LoadBalancer"
+				probe.Target = net.JoinHostPort(host, strconv.Itoa(int(port.Port)))
+				// 负载均衡器只把流量发给健康检查通过的节点，因此只要有就绪的后端就预期可达
+				probe.Expected, probe.Reason = expectReachable(backends, false, "")
+				probes = append(probes, probe)
+			}
+		}
+	}
+	return probes
+}
+
+// expectReachable 推断探测是否预期可达：需要有就绪的后端，Local 策略下还需要该节点上有就绪的后端
+func expectReachable(backends serviceBackends, local bool, nodeName string) (bool, string) {
+	if len(backends.pods) == 0 && len(backends.nodes) == 0 {
+		return false, "no ready endpoints"
+	}
+	if local && !backends.nodes[nodeName] {
+		return false, "externalTrafficPolicy=Local and no ready endpoint on the node"
+	}
+	if local {
+		return true, "externalTrafficPolicy=Local with a ready endpoint on the node"
+	}
+	return true, "ready endpoints"
+}
+
+// nodeAddress 返回节点指定类型的第一个地址
+func nodeAddress(node corev1.Node, addressType corev1.NodeAddressType) string {
+	for _, address := range node.Status.Addresses {
+		if address.Type == addressType {
+			return address.Address
+		}
+	}
+	return ""
+}
+
+// runProbes 以给定的并发度执行所有探测，并按 Service、端口和目标排序
+func runProbes(probes []ServiceProbe, timeout time.Duration, concurrency int) {
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, concurrency)
+	for i := range probes {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(probe *ServiceProbe) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			runProbe(probe, timeout)
+		}(&probes[i])
+	}
+	wg.Wait()
+
+	sort.SliceStable(probes, func(i, j int) bool {
+		if probes[i].Service != probes[j].Service {
+			return probes[i].Service < probes[j].Service
+		}
+		if probes[i].PortName != probes[j].PortName {
+			return probes[i].PortName < probes[j].PortName
+		}
+		return probes[i].Target < probes[j].Target
+	})
+}
+
+// runProbe 执行一次探测：TCP 端口先尝试 HTTP，失败时退化为 TCP 建连；UDP 端口发送探测报文并等待回包
+func runProbe(probe *ServiceProbe, timeout time.Duration) {
+	start := time.Now()
+	var reply []byte
+	var err error
+	switch probe.Protocol {
+	case string(corev1.ProtocolTCP):
+		probe.Method = "http"
+		probe.StatusCode, reply, err = probeHTTP(probe.Target, timeout)
+		if err != nil {
+			probe.Method = "tcp"
+			err = probeTCP(probe.Target, timeout)
+		}
+	case string(corev1.ProtocolUDP):
+		probe.Method = "udp"
+		reply, err = probeUDP(probe.Target, timeout)
+	default:
+		probe.Method = "skipped"
+		probe.Error = fmt.Sprintf("protocol %s is not supported", probe.Protocol)
+		probe.AsExpected = true
+		return
+	}
+	probe.LatencyMs = float64(time.Since(start).Microseconds()) / 1000
+
+	if err != nil {
+		probe.Error = err.Error()
+	} else {
+		probe.Reachable = true
+		identifyBackend(probe, reply)
+	}
+	probe.AsExpected = probe.Reachable == probe.Expected
+}
+
+// probeHTTP 发送 HTTP GET 请求，返回状态码和响应体
+func probeHTTP(target string, timeout time.Duration) (int, []byte, error) {
+	client := &http.Client{
+		Timeout: timeout,
+		// 每次探测使用新的连接，避免复用连接导致总是命中同一个后端
+		Transport: &http.Transport{DisableKeepAlives: true},
+	}
+	resp, err := client.Get("http://" + target + "/")
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxProbeBody))
+	return resp.StatusCode, body, err
+}
+
+// probeTCP 检查能否建立 TCP 连接
+func probeTCP(target string, timeout time.Duration) error {
+	conn, err := net.DialTimeout("tcp", target, timeout)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// probeUDP 发送一个探测报文并等待回包
+func probeUDP(target string, timeout time.Duration) ([]byte, error) {
+	conn, err := net.DialTimeout("udp", target, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(timeout))
+	if _, err := conn.Write([]byte("service reachability probe")); err != nil {
+		return nil, err
+	}
+	buffer := make([]byte, 65535)
+	n, err := conn.Read(buffer)
+	if err != nil {
+		return nil, fmt.Errorf("no reply: %v", err)
+	}
+	return buffer[:n], nil
+}
+
+// identifyBackend 从 echo 服务器的回包中解析应答的 Pod 和节点，并确认它是否是 Service 的后端。
+// 回包不是 echo 服务器的格式时不做任何设置
+func identifyBackend(probe *ServiceProbe, reply []byte) {
+	var echo echoIdentity
+	if err := json.Unmarshal(reply, &echo); err != nil {
+		return
+	}
+
+	podName, podNamespace := echo.Identity.PodName, echo.Identity.PodNamespace
+	if podName == "" {
+		// 没有通过 downward API 注入 Pod 名称时，Pod 的主机名默认就是 Pod 名称
+		podName = echo.ServerHostName
+	}
+	if podName == "" {
+		return
+	}
+	if podNamespace == "" {
+		podNamespace = probe.namespace
+	}
+
+	probe.BackendPod = podNamespace + "/" + podName
+	nodeName, known := probe.backends[probe.BackendPod]
+	probe.KnownBackend = known
+	probe.BackendNode = echo.Identity.NodeName
+	if probe.BackendNode == "" {
+		probe.BackendNode = nodeName
+	}
+}
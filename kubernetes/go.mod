@@ -1,3 +1,8 @@
 module main
 
-go 1.23
+go 1.25.0
+
+require (
+	github.com/vishvananda/netns v0.0.5 // indirect
+	google.golang.org/grpc v1.84.0 // indirect
+)
@@ -4,47 +4,83 @@
 主要功能和原理：
 
 1. 数据结构：
-   - 使用 PodInfo 结构体封装 Pod 的标签和 IP 地址（包括 IPv4 和 IPv6）。
+   - 使用 PodInfo 结构体封装 Pod 的标签、注解、所在节点和 IP 地址（包括 IPv4 和 IPv6）。
    - 使用 PodStore 结构体以 name 和 namespace 作为键存储 Pod 信息。
    - 提供线程安全的操作，使用 sync.RWMutex 确保并发安全。
 
 2. 主要方法：
    - NewPodStore：创建新的 PodStore 实例。
    - AddPod：添加 Pod 信息到存储中。
+   - AddPodWithMetadata：添加包含注解和节点信息的 Pod 信息到存储中。
    - DeletePod：从存储中删除指定的 Pod 信息。
    - GetIPWithLabelSelector：根据 metav1.LabelSelector 查找匹配的 IP 地址（返回 IpInfo 结构体切片）。
+   - GetIPWithCELExpression：根据 CEL 表达式查找匹配的 IP 地址，表达式中可以使用 name、namespace、node、
+     labels 和 annotations 变量，例如 labels.app == 'nginx' && namespace.startsWith('team-')。
+   - SetNodeZone：记录节点所在的可用区（通常取节点的 topology.kubernetes.io/zone 标签）。
+   - GetIPGroupsWithLabelSelector：返回选择器匹配的 Pod 的 IP 按节点和按可用区的分组，以及各节点、
+     各可用区的 Pod 数，用于验证 Pod 反亲和和拓扑分布约束、EndpointSlice 的 hints 分布是否符合预期。
+   - GetPeerSets：对某个 Pod，把选择器匹配的其他 Pod 分为同节点、同可用区（不同节点）和其他可用区
+     三组 peer（缺少节点或可用区信息的归入 Unknown），用于验证拓扑感知路由（如 trafficDistribution: PreferClose）是否优先访问就近的 peer。
+   - OpenPodStore：创建持久化到 bbolt 数据库文件的 PodStore，启动时从文件恢复上次的状态。
+   - Reconcile：用 informer 同步完成后的完整 Pod 列表校正恢复的状态。
 
-3. 使用场景：
+3. 持久化：
+   - 使用 OpenPodStore 创建时，AddPod、AddPodWithMetadata、DeletePod、SetNodeZone 和 Reconcile 的每次变更都在
+     PodStore 的写锁内作为一个 bbolt 事务提交，磁盘上始终是某次变更之后的完整状态，进程崩溃最多丢失未提交的那次变更。
+   - pods bucket 以 "namespace/name" 为键保存 PodInfo 的 JSON，zones bucket 以节点名为键保存可用区。
+   - 嵌入 PodStore 的控制器重启时先从文件恢复，无需等待全量 List 即可回答查询；informer 同步完成后调用 Reconcile，
+     删除重启期间已消失的 Pod 并补齐新增和变化的 Pod。
+   - 数据库文件损坏而无法打开时，会将其重命名为 <path>.corrupt-<时间戳> 并以空状态启动，此时退化为全量 List；
+     文件中的记录无法解析时 OpenPodStore 返回错误。
+   - 写入失败不影响内存中的状态，失败会被记录日志，最近一次错误可以通过 Err 获取。
+
+4. 使用场景：
    - 适用于需要存储和查询 Kubernetes Pod 信息的场景。
    - 可用于网络管理、监控和调试等场景。
 
-4. 示例用法：
+5. 示例用法：
    - 创建 PodStore 实例。
    - 添加 Pod 信息。
    - 使用标签选择器查询匹配的 IP 地址。
    - 删除 Pod 信息。
+   - 使用 OpenPodStore 持久化并在重启后恢复。
 
 注意事项：
 - 所有公共方法都是并发安全的。
 - IP 地址字段（IPv4 和 IPv6）允许为空字符串。
+- CEL 表达式必须返回 bool。访问不存在的标签（如 labels.app）会导致求值失败，此时视为不匹配，
+  需要区分时可以使用 has(labels.app) 或 'app' in labels。编译后的表达式会被缓存。
+- 分组时，没有节点信息的 Pod 归入节点 ""，所在节点没有通过 SetNodeZone 记录可用区的 Pod 归入可用区 ""。
 */
 
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
 	"net"
+	"os"
+	"path/filepath"
+	"reflect"
 	"sort"
+	"strings"
 	"sync"
+	"time"
 
+	"github.com/google/cel-go/cel"
+	bolt "go.etcd.io/bbolt"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
-// PodInfo 结构体用于存储 Pod 的标签和 IP 地址（包括 IPv4 和 IPv6）
+// PodInfo 结构体用于存储 Pod 的标签、注解、所在节点和 IP 地址（包括 IPv4 和 IPv6）
 type PodInfo struct {
-	Labels map[string]string
-	IPv4   string
-	IPv6   string
+	Labels      map[string]string
+	Annotations map[string]string
+	NodeName    string
+	IPv4        string
+	IPv6        string
 }
 
 // IpInfo 结构体用于存储 IP 地址信息
@@ -57,24 +93,59 @@ type IpInfo struct {
 type PodStore struct {
 	mutex sync.RWMutex
 	data  map[string]map[string]PodInfo
+
+	// nodeZones 记录节点所在的可用区
+	nodeZones map[string]string
+
+	// celEnv 和 celPrograms 用于编译和缓存 CEL 表达式
+	celEnv      *cel.Env
+	celMutex    sync.Mutex
+	celPrograms map[string]cel.Program
+
+	// db 为持久化的数据库，为 nil 时不持久化；persistErr 记录最近一次写入错误
+	db         *bolt.DB
+	persistErr error
+}
+
+// ReconcileResult 记录 Reconcile 对 PodStore 的修改
+type ReconcileResult struct {
+	Added   int // 新增的 Pod 数量
+	Updated int // 信息发生变化的 Pod 数量
+	Removed int // 已不存在而被删除的 Pod 数量
 }
 
+var (
+	podsBucket  = []byte("pods")  // "namespace/name" -> PodInfo 的 JSON
+	zonesBucket = []byte("zones") // 节点名 -> 可用区
+)
+
 // NewPodStore 创建一个新的 PodStore
 func NewPodStore() *PodStore {
 	return &PodStore{
-		data: make(map[string]map[string]PodInfo),
+		data:        make(map[string]map[string]PodInfo),
+		nodeZones:   make(map[string]string),
+		celPrograms: make(map[string]cel.Program),
 	}
 }
 
 // AddPod 添加一个 Pod 信息到存储中
 func (ps *PodStore) AddPod(namespace, name string, labels map[string]string, ipv4, ipv6 string) {
+	ps.AddPodWithMetadata(namespace, name, labels, nil, "", ipv4, ipv6)
+}
+
+// AddPodWithMetadata 添加一个包含注解和所在节点的 Pod 信息到存储中
+func (ps *PodStore) AddPodWithMetadata(namespace, name string, labels, annotations map[string]string, nodeName, ipv4, ipv6 string) {
 	ps.mutex.Lock()
 	defer ps.mutex.Unlock()
 
 	if _, exists := ps.data[namespace]; !exists {
 		ps.data[namespace] = make(map[string]PodInfo)
 	}
-	ps.data[namespace][name] = PodInfo{Labels: labels, IPv4: ipv4, IPv6: ipv6}
+	podInfo := PodInfo{Labels: labels, Annotations: annotations, NodeName: nodeName, IPv4: ipv4, IPv6: ipv6}
+	ps.data[namespace][name] = podInfo
+	ps.persist(func(tx *bolt.Tx) error {
+		return putPodInfo(tx, namespace, name, podInfo)
+	})
 }
 
 // DeletePod 从存储中删除一个 Pod 信息
@@ -88,6 +159,9 @@ func (ps *PodStore) DeletePod(namespace, name string) {
 			delete(ps.data, namespace)
 		}
 	}
+	ps.persist(func(tx *bolt.Tx) error {
+		return tx.Bucket(podsBucket).Delete(podKey(namespace, name))
+	})
 }
 
 // GetIPWithLabelSelector 根据 metav1.LabelSelector 查找匹配的 IP 地址（包括 IPv4 和 IPv6）
@@ -117,6 +191,366 @@ func (ps *PodStore) GetIPWithLabelSelector(selector *metav1.LabelSelector) []IpI
 	return ipInfos
 }
 
+// GetIPWithCELExpression 根据 CEL 表达式查找匹配的 IP 地址（包括 IPv4 和 IPv6）
+//
+// 表达式中可用的变量：
+//   - name、namespace、node：Pod 名称、命名空间和所在节点（string）
+//   - labels、annotations：Pod 的标签和注解（map(string, string)）
+func (ps *PodStore) GetIPWithCELExpression(expression string) ([]IpInfo, error) {
+	program, err := ps.compileCELExpression(expression)
+	if err != nil {
+		return nil, err
+	}
+
+	ps.mutex.RLock()
+	defer ps.mutex.RUnlock()
+
+	var ipInfos []IpInfo
+	for namespace, namespaceData := range ps.data {
+		for name, podInfo := range namespaceData {
+			labels, annotations := podInfo.Labels, podInfo.Annotations
+			if labels == nil {
+				labels = map[string]string{}
+			}
+			if annotations == nil {
+				annotations = map[string]string{}
+			}
+			out, _, err := program.Eval(map[string]interface{}{
+				"name":        name,
+				"namespace":   namespace,
+				"node":        podInfo.NodeName,
+				"labels":      labels,
+				"annotations": annotations,
+			})
+			// 求值失败（例如访问不存在的标签）视为不匹配
+			if err != nil {
+				continue
+			}
+			if matched, ok := out.Value().(bool); ok && matched {
+				ipInfos = append(ipInfos, IpInfo{IPv4: podInfo.IPv4, IPv6: podInfo.IPv6})
+			}
+		}
+	}
+	// 对 IP 地址进行排序
+	sort.Slice(ipInfos, func(i, j int) bool {
+		return net.ParseIP(ipInfos[i].IPv4).String() < net.ParseIP(ipInfos[j].IPv4).String()
+	})
+	return ipInfos, nil
+}
+
+// IpGroups 结构体用于存储选择器匹配的 Pod 的 IP 地址按节点和按可用区的分组
+type IpGroups struct {
+	ByNode     map[string][]IpInfo // 各节点上的 Pod 的 IP 地址
+	ByZone     map[string][]IpInfo // 各可用区中的 Pod 的 IP 地址
+	NodeCounts map[string]int      // 各节点上的 Pod 数
+	ZoneCounts map[string]int      // 各可用区中的 Pod 数
+}
+
+// PeerSets 结构体用于存储某个 Pod 的 peer（选择器匹配的其他 Pod）按拓扑距离的分组
+type PeerSets struct {
+	NodeName  string   // 该 Pod 所在的节点
+	Zone      string   // 该 Pod 所在的可用区
+	SameNode  []IpInfo // 同一节点上的 peer
+	SameZone  []IpInfo // 同一可用区其他节点上的 peer
+	OtherZone []IpInfo // 其他可用区的 peer
+	Unknown   []IpInfo // 无法确定拓扑距离的 peer：自身或该 Pod 缺少节点或可用区信息
+}
+
+// SetNodeZone 记录节点所在的可用区
+func (ps *PodStore) SetNodeZone(nodeName, zone string) {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	ps.nodeZones[nodeName] = zone
+	ps.persist(func(tx *bolt.Tx) error {
+		return tx.Bucket(zonesBucket).Put([]byte(nodeName), []byte(zone))
+	})
+}
+
+// GetIPGroupsWithLabelSelector 根据 metav1.LabelSelector 查找匹配的 Pod，返回其 IP 地址按节点和按可用区的分组
+func (ps *PodStore) GetIPGroupsWithLabelSelector(selector *metav1.LabelSelector) IpGroups {
+	ps.mutex.RLock()
+	defer ps.mutex.RUnlock()
+
+	groups := IpGroups{
+		ByNode:     make(map[string][]IpInfo),
+		ByZone:     make(map[string][]IpInfo),
+		NodeCounts: make(map[string]int),
+		ZoneCounts: make(map[string]int),
+	}
+	for _, namespaceData := range ps.data {
+		for _, podInfo := range namespaceData {
+			if !matchesSelector(podInfo.Labels, selector.MatchLabels) {
+				continue
+			}
+			ipInfo := IpInfo{IPv4: podInfo.IPv4, IPv6: podInfo.IPv6}
+			zone := ps.nodeZones[podInfo.NodeName]
+			groups.ByNode[podInfo.NodeName] = append(groups.ByNode[podInfo.NodeName], ipInfo)
+			groups.ByZone[zone] = append(groups.ByZone[zone], ipInfo)
+			groups.NodeCounts[podInfo.NodeName]++
+			groups.ZoneCounts[zone]++
+		}
+	}
+	for _, ipInfos := range groups.ByNode {
+		sortIpInfos(ipInfos)
+	}
+	for _, ipInfos := range groups.ByZone {
+		sortIpInfos(ipInfos)
+	}
+	return groups
+}
+
+// GetPeerSets 返回指定 Pod 的 peer（选择器匹配的其他 Pod）按同节点、同可用区和其他可用区的分组
+func (ps *PodStore) GetPeerSets(namespace, name string, selector *metav1.LabelSelector) (PeerSets, error) {
+	ps.mutex.RLock()
+	defer ps.mutex.RUnlock()
+
+	self, exists := ps.data[namespace][name]
+	if !exists {
+		return PeerSets{}, fmt.Errorf("Pod %s/%s 不存在", namespace, name)
+	}
+	peers := PeerSets{NodeName: self.NodeName, Zone: ps.nodeZones[self.NodeName]}
+	for podNamespace, namespaceData := range ps.data {
+		for podName, podInfo := range namespaceData {
+			if (podNamespace == namespace && podName == name) || !matchesSelector(podInfo.Labels, selector.MatchLabels) {
+				continue
+			}
+			ipInfo := IpInfo{IPv4: podInfo.IPv4, IPv6: podInfo.IPv6}
+			zone := ps.nodeZones[podInfo.NodeName]
+			switch {
+			case podInfo.NodeName == "" || self.NodeName == "":
+				peers.Unknown = append(peers.Unknown, ipInfo)
+			case podInfo.NodeName == self.NodeName:
+				peers.SameNode = append(peers.SameNode, ipInfo)
+			case zone == "" || peers.Zone == "":
+				peers.Unknown = append(peers.Unknown, ipInfo)
+			case zone == peers.Zone:
+				peers.SameZone = append(peers.SameZone, ipInfo)
+			default:
+				peers.OtherZone = append(peers.OtherZone, ipInfo)
+			}
+		}
+	}
+	sortIpInfos(peers.SameNode)
+	sortIpInfos(peers.SameZone)
+	sortIpInfos(peers.OtherZone)
+	sortIpInfos(peers.Unknown)
+	return peers, nil
+}
+
+// OpenPodStore 打开（或创建）path 处的 bbolt 数据库，返回从中恢复的 PodStore，其后续变更都会持久化到该数据库
+func OpenPodStore(path string) (*PodStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		if !errors.Is(err, bolt.ErrInvalid) && !errors.Is(err, bolt.ErrChecksum) && !errors.Is(err, bolt.ErrVersionMismatch) {
+			return nil, err
+		}
+		// 文件已损坏，保留它以便排查，并以空状态启动
+		corrupt := fmt.Sprintf("%s.corrupt-%d", path, time.Now().Unix())
+		if renameErr := os.Rename(path, corrupt); renameErr != nil {
+			return nil, fmt.Errorf("无法打开 %s: %v，也无法将其重命名: %v", path, err, renameErr)
+		}
+		log.Printf("无法打开 %s (%v)，已将其重命名为 %s 并以空状态启动", path, err, corrupt)
+		if db, err = bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second}); err != nil {
+			return nil, err
+		}
+	}
+
+	ps := NewPodStore()
+	err = db.Update(func(tx *bolt.Tx) error {
+		pods, err := tx.CreateBucketIfNotExists(podsBucket)
+		if err != nil {
+			return err
+		}
+		zones, err := tx.CreateBucketIfNotExists(zonesBucket)
+		if err != nil {
+			return err
+		}
+
+		err = pods.ForEach(func(key, value []byte) error {
+			namespace, name, found := strings.Cut(string(key), "/")
+			if !found {
+				return fmt.Errorf("无效的记录键 %q", key)
+			}
+			var podInfo PodInfo
+			if err := json.Unmarshal(value, &podInfo); err != nil {
+				return fmt.Errorf("无效的记录 %q: %v", key, err)
+			}
+			if _, exists := ps.data[namespace]; !exists {
+				ps.data[namespace] = make(map[string]PodInfo)
+			}
+			ps.data[namespace][name] = podInfo
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return zones.ForEach(func(key, value []byte) error {
+			ps.nodeZones[string(key)] = string(value)
+			return nil
+		})
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("从 %s 恢复失败: %v", path, err)
+	}
+
+	ps.db = db
+	return ps, nil
+}
+
+// Reconcile 用完整的 Pod 列表（例如 informer 同步完成后的缓存，按 namespace 和 name 索引）校正 PodStore：
+// 新增和更新列表中的 Pod，删除列表中没有的 Pod
+func (ps *PodStore) Reconcile(pods map[string]map[string]PodInfo) ReconcileResult {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	var result ReconcileResult
+	var removed [][2]string
+	for namespace, namespaceData := range ps.data {
+		for name := range namespaceData {
+			if _, exists := pods[namespace][name]; !exists {
+				removed = append(removed, [2]string{namespace, name})
+			}
+		}
+	}
+	for _, pod := range removed {
+		delete(ps.data[pod[0]], pod[1])
+		if len(ps.data[pod[0]]) == 0 {
+			delete(ps.data, pod[0])
+		}
+	}
+	result.Removed = len(removed)
+
+	changed := make(map[string]map[string]PodInfo)
+	for namespace, namespaceData := range pods {
+		for name, podInfo := range namespaceData {
+			current, exists := ps.data[namespace][name]
+			switch {
+			case !exists:
+				result.Added++
+			case !reflect.DeepEqual(current, podInfo):
+				result.Updated++
+			default:
+				continue
+			}
+			if _, exists := ps.data[namespace]; !exists {
+				ps.data[namespace] = make(map[string]PodInfo)
+			}
+			ps.data[namespace][name] = podInfo
+			if _, exists := changed[namespace]; !exists {
+				changed[namespace] = make(map[string]PodInfo)
+			}
+			changed[namespace][name] = podInfo
+		}
+	}
+
+	// 所有修改在一个事务中提交
+	ps.persist(func(tx *bolt.Tx) error {
+		for _, pod := range removed {
+			if err := tx.Bucket(podsBucket).Delete(podKey(pod[0], pod[1])); err != nil {
+				return err
+			}
+		}
+		for namespace, namespaceData := range changed {
+			for name, podInfo := range namespaceData {
+				if err := putPodInfo(tx, namespace, name, podInfo); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	return result
+}
+
+// Err 返回最近一次持久化失败的错误
+func (ps *PodStore) Err() error {
+	ps.mutex.RLock()
+	defer ps.mutex.RUnlock()
+
+	return ps.persistErr
+}
+
+// Close 关闭持久化的数据库，未持久化的 PodStore 不做任何操作
+func (ps *PodStore) Close() error {
+	if ps.db == nil {
+		return nil
+	}
+	return ps.db.Close()
+}
+
+// persist 在一个事务中提交变更并记录失败，调用者须持有写锁，未持久化的 PodStore 不做任何操作
+func (ps *PodStore) persist(change func(tx *bolt.Tx) error) {
+	if ps.db == nil {
+		return
+	}
+	if err := ps.db.Update(change); err != nil {
+		log.Printf("持久化 PodStore 变更失败: %v", err)
+		ps.persistErr = err
+	}
+}
+
+// putPodInfo 写入 Pod 信息的记录
+func putPodInfo(tx *bolt.Tx, namespace, name string, podInfo PodInfo) error {
+	data, err := json.Marshal(podInfo)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(podsBucket).Put(podKey(namespace, name), data)
+}
+
+// podKey 返回 Pod 记录的键，namespace 和 name 中都不会出现 "/"
+func podKey(namespace, name string) []byte {
+	return []byte(namespace + "/" + name)
+}
+
+// sortIpInfos 对 IP 地址进行排序
+func sortIpInfos(ipInfos []IpInfo) {
+	sort.Slice(ipInfos, func(i, j int) bool {
+		return net.ParseIP(ipInfos[i].IPv4).String() < net.ParseIP(ipInfos[j].IPv4).String()
+	})
+}
+
+// compileCELExpression 编译 CEL 表达式并缓存编译结果
+func (ps *PodStore) compileCELExpression(expression string) (cel.Program, error) {
+	ps.celMutex.Lock()
+	defer ps.celMutex.Unlock()
+
+	if program, exists := ps.celPrograms[expression]; exists {
+		return program, nil
+	}
+
+	if ps.celEnv == nil {
+		env, err := cel.NewEnv(
+			cel.Variable("name", cel.StringType),
+			cel.Variable("namespace", cel.StringType),
+			cel.Variable("node", cel.StringType),
+			cel.Variable("labels", cel.MapType(cel.StringType, cel.StringType)),
+			cel.Variable("annotations", cel.MapType(cel.StringType, cel.StringType)),
+		)
+		if err != nil {
+			return nil, fmt.Errorf("创建 CEL 环境失败: %v", err)
+		}
+		ps.celEnv = env
+	}
+
+	ast, issues := ps.celEnv.Compile(expression)
+	if issues != nil && issues.Err() != nil {
+		return nil, fmt.Errorf("CEL 表达式编译失败: %v", issues.Err())
+	}
+	if !ast.OutputType().IsExactType(cel.BoolType) {
+		return nil, fmt.Errorf("CEL 表达式必须返回 bool，实际返回 %v", ast.OutputType())
+	}
+
+	program, err := ps.celEnv.Program(ast)
+	if err != nil {
+		return nil, fmt.Errorf("CEL 表达式无效: %v", err)
+	}
+	ps.celPrograms[expression] = program
+	return program, nil
+}
+
 // matchesSelector 检查给定的标签是否匹配选择器
 func matchesSelector(labels, selector map[string]string) bool {
 	for key, value := range selector {
@@ -134,6 +568,7 @@ func main() {
 	store.AddPod("default", "pod1", map[string]string{"app": "nginx", "env": "prod"}, "192.168.1.1", "fe80::1")
 	store.AddPod("default", "pod2", map[string]string{"app": "nginx", "env": "dev"}, "192.168.1.2", "")
 	store.AddPod("kube-system", "pod3", map[string]string{"app": "kube-dns"}, "", "fe80::2")
+	store.AddPodWithMetadata("team-a", "pod4", map[string]string{"app": "nginx"}, map[string]string{"debug": "true"}, "node1", "192.168.1.4", "")
 
 	// 创建 LabelSelector
 	selector := &metav1.LabelSelector{
@@ -147,6 +582,61 @@ func main() {
 		fmt.Printf("IPv4: %s, IPv6: %s\n", ipInfo.IPv4, ipInfo.IPv6)
 	}
 
+	// 使用 CEL 表达式查找匹配的 IP 地址
+	expression := "labels.app == 'nginx' && namespace.startsWith('team-')"
+	ipInfos, err := store.GetIPWithCELExpression(expression)
+	if err != nil {
+		fmt.Printf("查询失败: %v\n", err)
+	} else {
+		fmt.Printf("匹配 %s 的 IP 地址:\n", expression)
+		for _, ipInfo := range ipInfos {
+			fmt.Printf("IPv4: %s, IPv6: %s\n", ipInfo.IPv4, ipInfo.IPv6)
+		}
+	}
+
+	// 按节点和可用区分组，并计算 pod4 的 peer
+	store.AddPodWithMetadata("team-a", "pod5", map[string]string{"app": "nginx"}, nil, "node2", "192.168.1.5", "")
+	store.AddPodWithMetadata("team-a", "pod6", map[string]string{"app": "nginx"}, nil, "node3", "192.168.1.6", "")
+	store.SetNodeZone("node1", "zone-a")
+	store.SetNodeZone("node2", "zone-a")
+	store.SetNodeZone("node3", "zone-b")
+	groups := store.GetIPGroupsWithLabelSelector(selector)
+	fmt.Printf("各节点的 Pod 数: %v，各可用区的 Pod 数: %v\n", groups.NodeCounts, groups.ZoneCounts)
+	peers, err := store.GetPeerSets("team-a", "pod4", selector)
+	if err != nil {
+		fmt.Printf("查询失败: %v\n", err)
+	} else {
+		fmt.Printf("pod4 在 %s/%s，同节点 peer: %v，同可用区 peer: %v，其他可用区 peer: %v，未知: %v\n", peers.Zone, peers.NodeName, peers.SameNode, peers.SameZone, peers.OtherZone, peers.Unknown)
+	}
+
 	// 删除 Pod 信息
 	store.DeletePod("default", "pod1")
+
+	// 持久化的 PodStore 重启后从文件恢复，再与 informer 的完整列表对账
+	path := filepath.Join(os.TempDir(), "podstore.db")
+	defer os.Remove(path)
+	persisted, err := OpenPodStore(path)
+	if err != nil {
+		fmt.Printf("打开失败: %v\n", err)
+		return
+	}
+	persisted.AddPodWithMetadata("default", "pod1", map[string]string{"app": "nginx"}, nil, "node1", "192.168.1.1", "")
+	persisted.AddPodWithMetadata("default", "pod2", map[string]string{"app": "nginx"}, nil, "node2", "192.168.1.2", "")
+	persisted.SetNodeZone("node1", "zone-a")
+	persisted.Close()
+
+	restored, err := OpenPodStore(path)
+	if err != nil {
+		fmt.Printf("恢复失败: %v\n", err)
+		return
+	}
+	defer restored.Close()
+	fmt.Printf("恢复后匹配的 IP 地址: %v\n", restored.GetIPWithLabelSelector(selector))
+	result := restored.Reconcile(map[string]map[string]PodInfo{
+		"default": {
+			"pod2": {Labels: map[string]string{"app": "nginx"}, NodeName: "node2", IPv4: "192.168.1.2"},
+			"pod3": {Labels: map[string]string{"app": "nginx"}, NodeName: "node1", IPv4: "192.168.1.3"},
+		},
+	})
+	fmt.Printf("对账: 新增 %d，更新 %d，删除 %d，对账后匹配的 IP 地址: %v\n", result.Added, result.Updated, result.Removed, restored.GetIPWithLabelSelector(selector))
 }
@@ -0,0 +1,301 @@
+/*
+本程序是以 DaemonSet 方式运行在每个节点上的网络诊断代理，以 Prometheus 指标的形式持续导出节点的网络健康状态，
+为集群运维人员提供一个常驻的健康信号，而不必在出现问题后才逐个运行本目录下的检查工具。
+
+主要功能：
+1. 检查 CNI 配置目录中是否存在有效的配置文件（与 check_node_readiness.go 的 CNI 检查一致）。
+2. 统计节点上 Pod 网络命名空间的数量：遍历 /proc/<pid>/ns/net 和 /var/run/netns 下的命名空间，
+   按 inode 去重并排除主机网络命名空间。
+3. 统计主机网络命名空间中 veth 接口的数量，并导出其与 Pod 网络命名空间数量的差值，
+   差值不为零通常意味着存在泄漏的 veth 或没有网卡的 Pod 网络命名空间。
+4. 读取 conntrack 表的当前条目数和上限，导出使用率。
+5. 周期性地执行连通性自检（TCP 连接到指定地址，默认为 kubernetes Service），导出最近一次自检的结果、耗时和时间。
+6. 在 /metrics 接口以 Prometheus 文本格式输出以上指标，除自检外的指标在每次抓取时实时采集。
+
+使用方法：
+go run netdebug_agent.go [-listen=:9102] [-cni-conf-dir=/etc/cni/net.d] [-netns-dir=/var/run/netns] \
+    [-self-check-target=<host:port>] [-self-check-interval=30s] [-timeout=3s]
+
+导出的指标：
+- netdebug_cni_config_present：CNI 配置目录中是否存在有效配置（1 或 0）
+- netdebug_pod_netns_count：节点上 Pod 网络命名空间的数量
+- netdebug_veth_count：主机网络命名空间中 veth 接口的数量
+- netdebug_veth_netns_mismatch：veth 数量减去 Pod 网络命名空间数量
+- netdebug_conntrack_entries / netdebug_conntrack_max / netdebug_conntrack_utilization：conntrack 表的使用情况
+- netdebug_self_check_success / netdebug_self_check_latency_seconds / netdebug_self_check_timestamp_seconds：最近一次连通性自检的结果
+- netdebug_scrape_errors：本次采集中失败的检查项数量，失败原因会记录在日志中
+
+注意事项：
+- DaemonSet 需要设置 hostNetwork: true 和 hostPID: true，并以 root 权限运行，
+  同时以 hostPath 方式挂载 /etc/cni/net.d 和 /var/run/netns（mountPropagation: HostToContainer）。
+- 未加载 nf_conntrack 模块时不会导出 conntrack 相关指标。
+- hostNetwork Pod 没有独立的网络命名空间，不计入 Pod 网络命名空间数量；
+  使用 ipvlan、macvlan 等非 veth 方案的 CNI 下，veth 差值没有参考意义。
+- 未指定 -self-check-target 时使用 KUBERNETES_SERVICE_HOST 和 KUBERNETES_SERVICE_PORT 环境变量，两者都没有时不执行自检。
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/vishvananda/netlink"
+)
+
+// SelfCheckResult 结构体用于存储最近一次连通性自检的结果
+type SelfCheckResult struct {
+	Target    string        // 自检的目标地址
+	Success   bool          // 是否成功
+	Latency   time.Duration // 建立连接的耗时
+	Timestamp time.Time     // 自检的时间
+}
+
+// NetdebugAgent 负责采集节点的网络健康指标
+type NetdebugAgent struct {
+	cniConfDir string
+	netnsDir   string
+
+	mutex     sync.Mutex
+	selfCheck *SelfCheckResult
+}
+
+func main() {
+	listen := flag.String("listen", ":9102", "指标接口的监听地址")
+	cniConfDir := flag.String("cni-conf-dir", "/etc/cni/net.d", "CNI 配置目录")
+	netnsDir := flag.String("netns-dir", "/var/run/netns", "CNI 运行时挂载网络命名空间的目录")
+	selfCheckTarget := flag.String("self-check-target", "", "连通性自检的 TCP 地址（默认为 kubernetes Service）")
+	selfCheckInterval := flag.Duration("self-check-interval", 30*time.Second, "连通性自检的间隔")
+	timeout := flag.Duration("timeout", 3*time.Second, "连通性自检的超时时间")
+	flag.Parse()
+
+	agent := &NetdebugAgent{cniConfDir: *cniConfDir, netnsDir: *netnsDir}
+
+	target := *selfCheckTarget
+	if target == "" && os.Getenv("KUBERNETES_SERVICE_HOST") != "" {
+		target = net.JoinHostPort(os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT"))
+	}
+	if target != "" {
+		go agent.runSelfChecks(target, *selfCheckInterval, *timeout)
+	} else {
+		log.Printf("未指定自检地址，不执行连通性自检")
+	}
+
+	http.HandleFunc("/metrics", agent.handleMetrics)
+	http.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+
+	log.Printf("netdebug agent 正在监听 %s", *listen)
+	if err := http.ListenAndServe(*listen, nil); err != nil {
+		log.Fatalf("启动指标接口失败: %v", err)
+	}
+}
+
+// runSelfChecks 按固定间隔执行连通性自检并保存最近一次的结果
+func (a *NetdebugAgent) runSelfChecks(target string, interval, timeout time.Duration) {
+	for {
+		result := &SelfCheckResult{Target: target, Timestamp: time.Now()}
+		conn, err := net.DialTimeout("tcp", target, timeout)
+		result.Latency = time.Since(result.Timestamp)
+		if err != nil {
+			log.Printf("连通性自检失败: %v", err)
+		} else {
+			conn.Close()
+			result.Success = true
+		}
+
+		a.mutex.Lock()
+		a.selfCheck = result
+		a.mutex.Unlock()
+
+		time.Sleep(interval)
+	}
+}
+
+// handleMetrics 实时采集各项指标并以 Prometheus 文本格式输出
+func (a *NetdebugAgent) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+	scrapeErrors := 0
+	checkErr := func(name string, err error) bool {
+		if err != nil {
+			log.Printf("采集 %s 失败: %v", name, err)
+			scrapeErrors++
+			return false
+		}
+		return true
+	}
+
+	writeGauge(&buf, "netdebug_cni_config_present", "CNI 配置目录中是否存在有效配置", boolValue(hasValidCNIConfig(a.cniConfDir)))
+
+	netnsCount, netnsErr := countPodNetns(a.netnsDir)
+	if checkErr("pod netns", netnsErr) {
+		writeGauge(&buf, "netdebug_pod_netns_count", "节点上 Pod 网络命名空间的数量", float64(netnsCount))
+	}
+
+	vethCount, vethErr := countVeths()
+	if checkErr("veth", vethErr) {
+		writeGauge(&buf, "netdebug_veth_count", "主机网络命名空间中 veth 接口的数量", float64(vethCount))
+		if netnsErr == nil {
+			writeGauge(&buf, "netdebug_veth_netns_mismatch", "veth 数量减去 Pod 网络命名空间数量", float64(vethCount-netnsCount))
+		}
+	}
+
+	if entries, limit, ok := readConntrack(); ok {
+		writeGauge(&buf, "netdebug_conntrack_entries", "conntrack 表的当前条目数", entries)
+		writeGauge(&buf, "netdebug_conntrack_max", "conntrack 表的条目上限", limit)
+		if limit > 0 {
+			writeGauge(&buf, "netdebug_conntrack_utilization", "conntrack 表的使用率（0 到 1）", entries/limit)
+		}
+	}
+
+	a.mutex.Lock()
+	selfCheck := a.selfCheck
+	a.mutex.Unlock()
+	if selfCheck != nil {
+		writeGauge(&buf, "netdebug_self_check_success", "最近一次连通性自检是否成功", boolValue(selfCheck.Success))
+		writeGauge(&buf, "netdebug_self_check_latency_seconds", "最近一次连通性自检的耗时", selfCheck.Latency.Seconds())
+		writeGauge(&buf, "netdebug_self_check_timestamp_seconds", "最近一次连通性自检的 Unix 时间", float64(selfCheck.Timestamp.Unix()))
+	}
+
+	writeGauge(&buf, "netdebug_scrape_errors", "本次采集中失败的检查项数量", float64(scrapeErrors))
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(buf.Bytes())
+}
+
+// writeGauge 以 Prometheus 文本格式写出一个 gauge 指标
+func writeGauge(buf *bytes.Buffer, name, help string, value float64) {
+	fmt.Fprintf(buf, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(buf, "# TYPE %s gauge\n", name)
+	fmt.Fprintf(buf, "%s %s\n", name, strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+// boolValue 将布尔值转换为指标值
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// hasValidCNIConfig 检查 CNI 配置目录中是否存在至少一个引用了插件的有效配置文件
+func hasValidCNIConfig(confDir string) bool {
+	for _, pattern := range []string{"*.conf", "*.conflist", "*.json"} {
+		matches, _ := filepath.Glob(filepath.Join(confDir, pattern))
+		for _, file := range matches {
+			data, err := os.ReadFile(file)
+			if err != nil {
+				continue
+			}
+			var conf struct {
+				Type    string            `json:"type"`
+				Plugins []json.RawMessage `json:"plugins"`
+			}
+			if json.Unmarshal(data, &conf) == nil && (conf.Type != "" || len(conf.Plugins) > 0) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// countPodNetns 统计主机网络命名空间以外的网络命名空间数量
+//
+// 工作原理：
+// 1. 读取 /proc/1/ns/net 的 inode 作为主机网络命名空间。
+// 2. 遍历所有进程的 /proc/<pid>/ns/net，以及 netnsDir 下挂载的网络命名空间（已没有进程的命名空间也会被统计）。
+// 3. 按 inode 去重后计数。
+func countPodNetns(netnsDir string) (int, error) {
+	hostIno, err := netnsInode("/proc/1/ns/net")
+	if err != nil {
+		return 0, fmt.Errorf("failed to get host network namespace: %v", err)
+	}
+
+	namespaces := make(map[uint64]bool)
+	procs, err := os.ReadDir("/proc")
+	if err != nil {
+		return 0, err
+	}
+	for _, proc := range procs {
+		if _, err := strconv.Atoi(proc.Name()); err != nil {
+			continue
+		}
+		// 进程可能在遍历期间退出，忽略错误
+		if ino, err := netnsInode(filepath.Join("/proc", proc.Name(), "ns/net")); err == nil {
+			namespaces[ino] = true
+		}
+	}
+
+	if entries, err := os.ReadDir(netnsDir); err == nil {
+		for _, entry := range entries {
+			if ino, err := netnsInode(filepath.Join(netnsDir, entry.Name())); err == nil {
+				namespaces[ino] = true
+			}
+		}
+	}
+
+	delete(namespaces, hostIno)
+	return len(namespaces), nil
+}
+
+// netnsInode 返回网络命名空间文件的 inode，只接受 nsfs 上的文件，未挂载的占位文件会被忽略
+func netnsInode(path string) (uint64, error) {
+	var statfs syscall.Statfs_t
+	if err := syscall.Statfs(path, &statfs); err != nil {
+		return 0, err
+	}
+	const nsfsMagic = 0x6e736673
+	if statfs.Type != nsfsMagic {
+		return 0, fmt.Errorf("%s is not a network namespace", path)
+	}
+
+	var stat syscall.Stat_t
+	if err := syscall.Stat(path, &stat); err != nil {
+		return 0, err
+	}
+	return stat.Ino, nil
+}
+
+// countVeths 统计当前（主机）网络命名空间中的 veth 接口数量
+func countVeths() (int, error) {
+	links, err := netlink.LinkList()
+	if err != nil {
+		return 0, fmt.Errorf("failed to list links: %v", err)
+	}
+	count := 0
+	for _, link := range links {
+		if link.Type() == "veth" {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// readConntrack 读取 conntrack 表的当前条目数和上限，未加载 nf_conntrack 时返回 false
+func readConntrack() (entries, limit float64, ok bool) {
+	read := func(name string) (float64, bool) {
+		data, err := os.ReadFile(filepath.Join("/proc/sys/net/netfilter", name))
+		if err != nil {
+			return 0, false
+		}
+		value, err := strconv.ParseFloat(strings.TrimSpace(string(data)), 64)
+		return value, err == nil
+	}
+
+	entries, entriesOK := read("nf_conntrack_count")
+	limit, limitOK := read("nf_conntrack_max")
+	return entries, limit, entriesOK && limitOK
+}
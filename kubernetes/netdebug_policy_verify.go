@@ -0,0 +1,565 @@
+/*
+本程序是 NetworkPolicy 的在线验证工具：对抽样的 Pod 对，先按 NetworkPolicy 的语义模拟出允许或拒绝的预期结论，
+再通过源 Pod 中运行的代理服务器（appServer/src/proxy_server.go）实际探测目的 Pod，对比两者并报告不一致的 Pod 对，
+用于自动发现数据面与策略引擎之间的分歧（例如 CNI 的策略规则没有下发、下发了过期的规则，或者 CNI 对策略语义的实现有偏差）。
+
+主要功能：
+1. 列出集群中的 Pod、命名空间和 NetworkPolicy，按 Pod 的标签和命名空间建立索引，与 labelSelector.go 中 PodStore 的方式一致。
+2. 对一个源 Pod、目的 Pod 和 TCP 端口，模拟 NetworkPolicy 的判定：
+   源 Pod 被 Egress 类型的策略选中时，需要其中至少一条 egress 规则允许到目的 Pod 和端口；
+   目的 Pod 被 Ingress 类型的策略选中时，需要其中至少一条 ingress 规则允许来自源 Pod 的连接。
+   规则中的 podSelector、namespaceSelector（及两者的组合）、ipBlock（包括 except）、端口范围（endPort）和命名端口都按 API 的定义处理。
+3. 源 Pod 为匹配 -proxy-selector 的代理服务器 Pod，目的 Pod 为匹配 -target-selector 的 Pod。
+   在所有 Pod 对中按预期结论分层抽样，允许和拒绝的 Pod 对各占一半（某一类不够时由另一类补足），使两种分歧都能被发现。
+4. 向源 Pod 中的代理服务器发送 connect 类型的转发请求（只建立 TCP 连接，不发送数据），根据结果判定实际为 allowed、blocked 或 inconclusive。
+5. 以 JSON 格式输出每个 Pod 对的预期、依据、实际结果和是否一致，以及汇总；存在不一致时以非零状态退出。
+
+使用方法：
+go run netdebug_policy_verify.go [-kubeconfig=<path>] [-namespace=<ns>] [-proxy-selector=app=proxy] [-proxy-port=8090] \
+    [-target-selector=<label selector>] [-port=8080] [-samples=50] [-seed=<n>] [-timeout=3s] [-concurrency=8] [-proxy-token=<token>]
+
+参数说明：
+-kubeconfig: kubeconfig 文件路径（默认为 ~/.kube/config，文件不存在时使用 in-cluster 配置）
+-namespace: 只抽样该命名空间中的目的 Pod（默认为所有命名空间），源 Pod 可以在任意命名空间
+-proxy-selector: 运行代理服务器的源 Pod 的标签选择器（默认为 app=proxy）
+-proxy-port: 代理服务器的端口（默认为 8090）
+-target-selector: 目的 Pod 的标签选择器（默认为所有 Pod）
+-port: 探测的目的 TCP 端口（默认为 8080）
+-samples: 抽样的 Pod 对数量（默认为 50）
+-seed: 抽样的随机种子，用于复现同一组 Pod 对（默认为当前时间）
+-timeout: 每个探测的超时时间（默认为 3s）
+-concurrency: 同时进行的探测数量（默认为 8）
+-proxy-token: 代理服务器开启 -auth-token 时使用的 bearer token（默认为 PROXY_AUTH_TOKEN 环境变量）
+
+示例：
+  go run netdebug_policy_verify.go -proxy-selector=app=proxy -target-selector=app=echo -port=8080 | jq '.Results[] | select(.Match | not)'
+
+注意事项：
+- 本程序直接访问源 Pod 的 IP 上的代理服务器，因此需要在集群网络中运行（例如在一个 Pod 中），并且代理服务器 Pod 的 ingress 策略需要允许本程序访问。
+- 实际结果的判定：代理报告连接成功为 allowed；超时或不可达（TIMEOUT、UNREACHABLE）为 blocked；
+  连接被拒绝（CONNECTION_REFUSED）可能是目的 Pod 没有监听该端口，也可能是 CNI 以 RST 拒绝，记为 inconclusive，
+  访问不到代理服务器或代理返回其他错误也记为 inconclusive。inconclusive 的 Pod 对不计入不一致。
+- 目的 Pod 需要在 -port 上监听（例如本仓库的 echo 服务器），否则允许的连接也会被拒绝而记为 inconclusive。
+- hostNetwork Pod、没有 IP 或未 Running 的 Pod 不参与抽样；模拟只使用 Pod 的第一个 IP，不考虑 Service 的 DNAT（探测直接访问 Pod IP）。
+- 模拟只覆盖 networking.k8s.io/v1 的 NetworkPolicy，CNI 自己的策略资源（如 CiliumNetworkPolicy、Calico GlobalNetworkPolicy）
+  和 AdminNetworkPolicy 造成的差异也会表现为不一致，这正是需要人工确认的情况。
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// PolicyPairResult 结构体用于存储一个 Pod 对的模拟结论和实际探测结果
+type PolicyPairResult struct {
+	Source         string  `json:"Source"`         // 源 Pod（namespace/name），即发起探测的代理服务器
+	SourceIP       string  `json:"SourceIP"`       // 源 Pod 的 IP
+	Destination    string  `json:"Destination"`    // 目的 Pod（namespace/name）
+	DestinationIP  string  `json:"DestinationIP"`  // 目的 Pod 的 IP
+	Port           int     `json:"Port"`           // 探测的 TCP 端口
+	Verdict        string  `json:"Verdict"`        // 模拟的结论：allow 或 deny
+	Reason         string  `json:"Reason"`         // 模拟结论的依据
+	Observed       string  `json:"Observed"`       // 实际结果：allowed、blocked 或 inconclusive
+	ProxyErrorCode string  `json:"ProxyErrorCode"` // 代理服务器返回的 ErrorCode，连接成功时为空
+	LatencyMs      float64 `json:"LatencyMs"`      // 探测耗时（毫秒）
+	Match          bool    `json:"Match"`          // 实际结果是否与模拟的结论一致，inconclusive 时为 true
+	Error          string  `json:"Error"`          // 探测失败的原因
+}
+
+// PolicyVerifySummary 结构体用于存储验证结果的汇总
+type PolicyVerifySummary struct {
+	Pairs         int `json:"Pairs"`         // 候选的 Pod 对数量
+	Probed        int `json:"Probed"`        // 探测的 Pod 对数量
+	ExpectedAllow int `json:"ExpectedAllow"` // 模拟结论为允许的数量
+	ExpectedDeny  int `json:"ExpectedDeny"`  // 模拟结论为拒绝的数量
+	Mismatches    int `json:"Mismatches"`    // 实际结果与模拟结论不一致的数量
+	Inconclusive  int `json:"Inconclusive"`  // 无法判定实际结果的数量
+}
+
+// PolicyVerifyReport 结构体用于存储整体的验证结果
+type PolicyVerifyReport struct {
+	Timestamp string              `json:"Timestamp"` // 验证时间
+	Seed      int64               `json:"Seed"`      // 抽样的随机种子
+	Policies  int                 `json:"Policies"`  // 集群中的 NetworkPolicy 数量
+	Summary   PolicyVerifySummary `json:"Summary"`   // 汇总
+	Results   []PolicyPairResult  `json:"Results"`   // 每个 Pod 对的结果
+}
+
+// PolicyStore 按命名空间索引 Pod、命名空间标签和 NetworkPolicy，用于模拟策略判定
+type PolicyStore struct {
+	pods            map[string][]corev1.Pod                 // 命名空间到 Pod 的映射
+	namespaceLabels map[string]map[string]string            // 命名空间到其标签的映射
+	policies        map[string][]networkingv1.NetworkPolicy // 命名空间到 NetworkPolicy 的映射
+}
+
+// proxyConnectResponse 是代理服务器响应中用于判定探测结果的字段
+type proxyConnectResponse struct {
+	Success      bool   `json:"Success"`
+	ErrorMessage string `json:"ErrorMessage"`
+	ErrorCode    string `json:"ErrorCode"`
+}
+
+func main() {
+	kubeconfig := flag.String("kubeconfig", filepath.Join(os.Getenv("HOME"), ".kube", "config"), "kubeconfig 文件路径，文件不存在时使用 in-cluster 配置")
+	namespace := flag.String("namespace", "", "只抽样该命名空间中的目的 Pod（默认为所有命名空间）")
+	proxySelector := flag.String("proxy-selector", "app=proxy", "运行代理服务器的源 Pod 的标签选择器")
+	proxyPort := flag.Int("proxy-port", 8090, "代理服务器的端口")
+	targetSelector := flag.String("target-selector", "", "目的 Pod 的标签选择器（默认为所有 Pod）")
+	port := flag.Int("port", 8080, "探测的目的 TCP 端口")
+	samples := flag.Int("samples", 50, "抽样的 Pod 对数量")
+	seed := flag.Int64("seed", time.Now().UnixNano(), "抽样的随机种子")
+	timeout := flag.Duration("timeout", 3*time.Second, "每个探测的超时时间")
+	concurrency := flag.Int("concurrency", 8, "同时进行的探测数量")
+	proxyToken := flag.String("proxy-token", os.Getenv("PROXY_AUTH_TOKEN"), "代理服务器的 bearer token")
+	flag.Parse()
+
+	if *samples < 1 || *concurrency < 1 || *port < 1 || *port > 65535 {
+		fmt.Fprintln(os.Stderr, "-samples 和 -concurrency 必须大于 0，-port 必须在 1 到 65535 之间")
+		os.Exit(1)
+	}
+	proxySel, err := labels.Parse(*proxySelector)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid -proxy-selector: %v\n", err)
+		os.Exit(1)
+	}
+	targetSel, err := labels.Parse(*targetSelector)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid -target-selector: %v\n", err)
+		os.Exit(1)
+	}
+
+	clientset, err := newClientset(*kubeconfig)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error creating Kubernetes client: %v\n", err)
+		os.Exit(1)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	store, policyCount, err := loadPolicyStore(ctx, clientset)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading the cluster state: %v\n", err)
+		os.Exit(1)
+	}
+
+	// 所有候选 Pod 对按模拟结论分为允许和拒绝两组
+	var allowed, denied []PolicyPairResult
+	for _, src := range store.selectPods("", proxySel) {
+		for _, dst := range store.selectPods(*namespace, targetSel) {
+			if src.UID == dst.UID {
+				continue
+			}
+			verdict, reason := store.Simulate(src, dst, *port)
+			pair := PolicyPairResult{
+				Source:        src.Namespace + "/" + src.Name,
+				SourceIP:      src.Status.PodIP,
+				Destination:   dst.Namespace + "/" + dst.Name,
+				DestinationIP: dst.Status.PodIP,
+				Port:          *port,
+				Reason:        reason,
+			}
+			if verdict {
+				pair.Verdict = "allow"
+				allowed = append(allowed, pair)
+			} else {
+				pair.Verdict = "deny"
+				denied = append(denied, pair)
+			}
+		}
+	}
+
+	report := PolicyVerifyReport{Timestamp: time.Now().Format(time.RFC3339), Seed: *seed, Policies: policyCount}
+	report.Summary.Pairs = len(allowed) + len(denied)
+	if report.Summary.Pairs == 0 {
+		fmt.Fprintln(os.Stderr, "No pod pair to verify, check -proxy-selector, -target-selector and -namespace")
+		os.Exit(1)
+	}
+	report.Results = samplePairs(rand.New(rand.NewSource(*seed)), allowed, denied, *samples)
+
+	proxy := &proxyProber{port: *proxyPort, token: *proxyToken, timeout: *timeout}
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, *concurrency)
+	for i := range report.Results {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(result *PolicyPairResult) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			proxy.probe(result)
+		}(&report.Results[i])
+	}
+	wg.Wait()
+
+	sort.SliceStable(report.Results, func(i, j int) bool {
+		if report.Results[i].Source != report.Results[j].Source {
+			return report.Results[i].Source < report.Results[j].Source
+		}
+		return report.Results[i].Destination < report.Results[j].Destination
+	})
+	report.Summary.Probed = len(report.Results)
+	for _, result := range report.Results {
+		if result.Verdict == "allow" {
+			report.Summary.ExpectedAllow++
+		} else {
+			report.Summary.ExpectedDeny++
+		}
+		if result.Observed == "inconclusive" {
+			report.Summary.Inconclusive++
+		}
+		if !result.Match {
+			report.Summary.Mismatches++
+		}
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(report)
+
+	if report.Summary.Mismatches > 0 {
+		os.Exit(1)
+	}
+}
+
+// newClientset 使用 kubeconfig 创建 Kubernetes 客户端，kubeconfig 文件不存在时使用 in-cluster 配置
+func newClientset(kubeconfig string) (*kubernetes.Clientset, error) {
+	var config *rest.Config
+	var err error
+	if _, statErr := os.Stat(kubeconfig); statErr == nil {
+		config, err = clientcmd.BuildConfigFromFlags("", kubeconfig)
+	} else {
+		config, err = rest.InClusterConfig()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error building kubeconfig: %v", err)
+	}
+	return kubernetes.NewForConfig(config)
+}
+
+// loadPolicyStore 列出所有 Pod、命名空间和 NetworkPolicy，返回 PolicyStore 和 NetworkPolicy 的数量
+func loadPolicyStore(ctx context.Context, clientset *kubernetes.Clientset) (*PolicyStore, int, error) {
+	store := &PolicyStore{
+		pods:            make(map[string][]corev1.Pod),
+		namespaceLabels: make(map[string]map[string]string),
+		policies:        make(map[string][]networkingv1.NetworkPolicy),
+	}
+
+	namespaces, err := clientset.CoreV1().Namespaces().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, 0, fmt.Errorf("listing namespaces: %v", err)
+	}
+	for _, ns := range namespaces.Items {
+		store.namespaceLabels[ns.Name] = ns.Labels
+	}
+
+	pods, err := clientset.CoreV1().Pods("").List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, 0, fmt.Errorf("listing pods: %v", err)
+	}
+	for _, pod := range pods.Items {
+		store.pods[pod.Namespace] = append(store.pods[pod.Namespace], pod)
+	}
+
+	policies, err := clientset.NetworkingV1().NetworkPolicies("").List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, 0, fmt.Errorf("listing network policies: %v", err)
+	}
+	for _, policy := range policies.Items {
+		store.policies[policy.Namespace] = append(store.policies[policy.Namespace], policy)
+	}
+	return store, len(policies.Items), nil
+}
+
+// selectPods 返回指定命名空间（为空时为所有命名空间）中匹配选择器、可以参与探测的 Pod
+func (s *PolicyStore) selectPods(namespace string, selector labels.Selector) []corev1.Pod {
+	var selected []corev1.Pod
+	for ns, pods := range s.pods {
+		if namespace != "" && ns != namespace {
+			continue
+		}
+		for _, pod := range pods {
+			if pod.Spec.HostNetwork || pod.Status.PodIP == "" || pod.Status.Phase != corev1.PodRunning {
+				continue
+			}
+			if selector.Matches(labels.Set(pod.Labels)) {
+				selected = append(selected, pod)
+			}
+		}
+	}
+	sort.Slice(selected, func(i, j int) bool {
+		return selected[i].Namespace+"/"+selected[i].Name < selected[j].Namespace+"/"+selected[j].Name
+	})
+	return selected
+}
+
+// Simulate 按 NetworkPolicy 的语义判定从 src 到 dst 的 TCP 端口 port 的连接是否被允许，并给出依据
+func (s *PolicyStore) Simulate(src, dst corev1.Pod, port int) (bool, string) {
+	egressAllowed, egressReason := s.evaluate(src, dst, dst, port, networkingv1.PolicyTypeEgress)
+	if !egressAllowed {
+		return false, egressReason
+	}
+	ingressAllowed, ingressReason := s.evaluate(dst, src, dst, port, networkingv1.PolicyTypeIngress)
+	if !ingressAllowed {
+		return false, ingressReason
+	}
+	return true, egressReason + "; " + ingressReason
+}
+
+// evaluate 判定 subject 的某个方向的策略是否允许与 peer 的连接，target 为连接的目的 Pod，用于解析命名端口
+func (s *PolicyStore) evaluate(subject, peer, target corev1.Pod, port int, direction networkingv1.PolicyType) (bool, string) {
+	var selecting []string
+	for _, policy := range s.policies[subject.Namespace] {
+		if !hasPolicyType(policy, direction) || !selectorMatches(&policy.Spec.PodSelector, subject.Labels) {
+			continue
+		}
+		name := policy.Namespace + "/" + policy.Name
+		selecting = append(selecting, name)
+
+		if direction == networkingv1.PolicyTypeIngress {
+			for i, rule := range policy.Spec.Ingress {
+				if s.peersMatch(rule.From, policy.Namespace, peer) && portsMatch(rule.Ports, target, port) {
+					return true, fmt.Sprintf("ingress allowed by rule %d of %s", i, name)
+				}
+			}
+		} else {
+			for i, rule := range policy.Spec.Egress {
+				if s.peersMatch(rule.To, policy.Namespace, peer) && portsMatch(rule.Ports, target, port) {
+					return true, fmt.Sprintf("egress allowed by rule %d of %s", i, name)
+				}
+			}
+		}
+	}
+
+	if len(selecting) == 0 {
+		return true, fmt.Sprintf("no %s policy selects %s/%s", strings.ToLower(string(direction)), subject.Namespace, subject.Name)
+	}
+	return false, fmt.Sprintf("%s denied: no rule of %s allows it", strings.ToLower(string(direction)), strings.Join(selecting, ", "))
+}
+
+// hasPolicyType 判断策略是否作用于指定的方向。policyTypes 为空时，策略总是作用于 ingress，有 egress 规则时也作用于 egress
+func hasPolicyType(policy networkingv1.NetworkPolicy, direction networkingv1.PolicyType) bool {
+	if len(policy.Spec.PolicyTypes) == 0 {
+		return direction == networkingv1.PolicyTypeIngress || len(policy.Spec.Egress) > 0
+	}
+	for _, policyType := range policy.Spec.PolicyTypes {
+		if policyType == direction {
+			return true
+		}
+	}
+	return false
+}
+
+// peersMatch 判断 peer 是否匹配规则的 from 或 to 列表，列表为空时匹配所有来源或目的
+func (s *PolicyStore) peersMatch(peers []networkingv1.NetworkPolicyPeer, policyNamespace string, peer corev1.Pod) bool {
+	if len(peers) == 0 {
+		return true
+	}
+	for _, p := range peers {
+		switch {
+		case p.IPBlock != nil:
+			if ipBlockMatches(p.IPBlock, peer.Status.PodIP) {
+				return true
+			}
+		case p.NamespaceSelector != nil:
+			// namespaceSelector 选中的命名空间中，匹配 podSelector（未设置时为所有）的 Pod
+			if selectorMatches(p.NamespaceSelector, s.namespaceLabels[peer.Namespace]) &&
+				(p.PodSelector == nil || selectorMatches(p.PodSelector, peer.Labels)) {
+				return true
+			}
+		case p.PodSelector != nil:
+			// 只有 podSelector 时，只匹配策略所在命名空间中的 Pod
+			if peer.Namespace == policyNamespace && selectorMatches(p.PodSelector, peer.Labels) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// portsMatch 判断目的 Pod 的 TCP 端口是否匹配规则的端口列表，列表为空时匹配所有端口
+func portsMatch(ports []networkingv1.NetworkPolicyPort, target corev1.Pod, port int) bool {
+	if len(ports) == 0 {
+		return true
+	}
+	for _, p := range ports {
+		if p.Protocol != nil && *p.Protocol != corev1.ProtocolTCP {
+			continue
+		}
+		if p.Port == nil {
+			return true
+		}
+		if p.Port.Type == intstr.String {
+			// 命名端口按目的 Pod 中容器端口的名称解析
+			if namedPort(target, p.Port.StrVal) == port {
+				return true
+			}
+			continue
+		}
+		start, end := int(p.Port.IntVal), int(p.Port.IntVal)
+		if p.EndPort != nil {
+			end = int(*p.EndPort)
+		}
+		if port >= start && port <= end {
+			return true
+		}
+	}
+	return false
+}
+
+// namedPort 返回 Pod 中名为 name 的 TCP 容器端口，不存在时返回 0
+func namedPort(pod corev1.Pod, name string) int {
+	for _, container := range pod.Spec.Containers {
+		for _, containerPort := range container.Ports {
+			protocol := containerPort.Protocol
+			if protocol == "" {
+				protocol = corev1.ProtocolTCP
+			}
+			if containerPort.Name == name && protocol == corev1.ProtocolTCP {
+				return int(containerPort.ContainerPort)
+			}
+		}
+	}
+	return 0
+}
+
+// ipBlockMatches 判断 IP 是否在 ipBlock 的 CIDR 中且不在 except 中
+func ipBlockMatches(block *networkingv1.IPBlock, ip string) bool {
+	addr := net.ParseIP(ip)
+	_, cidr, err := net.ParseCIDR(block.CIDR)
+	if addr == nil || err != nil || !cidr.Contains(addr) {
+		return false
+	}
+	for _, except := range block.Except {
+		if _, exceptNet, err := net.ParseCIDR(except); err == nil && exceptNet.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// selectorMatches 判断标签是否匹配 LabelSelector，空的选择器匹配所有标签，无效的选择器不匹配任何标签
+func selectorMatches(selector *metav1.LabelSelector, podLabels map[string]string) bool {
+	sel, err := metav1.LabelSelectorAsSelector(selector)
+	if err != nil {
+		return false
+	}
+	return sel.Matches(labels.Set(podLabels))
+}
+
+// samplePairs 从允许和拒绝的 Pod 对中各抽取一半，某一类不够时由另一类补足
+func samplePairs(rng *rand.Rand, allowed, denied []PolicyPairResult, samples int) []PolicyPairResult {
+	rng.Shuffle(len(allowed), func(i, j int) { allowed[i], allowed[j] = allowed[j], allowed[i] })
+	rng.Shuffle(len(denied), func(i, j int) { denied[i], denied[j] = denied[j], denied[i] })
+
+	allowCount := min(len(allowed), samples/2)
+	denyCount := min(len(denied), samples-allowCount)
+	allowCount = min(len(allowed), samples-denyCount)
+
+	sampled := append([]PolicyPairResult(nil), allowed[:allowCount]...)
+	return append(sampled, denied[:denyCount]...)
+}
+
+// proxyProber 通过源 Pod 中的代理服务器探测目的 Pod
+type proxyProber struct {
+	port    int
+	token   string
+	timeout time.Duration
+}
+
+// probe 请求源 Pod 中的代理服务器建立到目的 Pod 的 TCP 连接，并与模拟的结论比较
+func (p *proxyProber) probe(result *PolicyPairResult) {
+	body, _ := json.Marshal(map[string]interface{}{
+		"BackendUrl":  "tcp://" + net.JoinHostPort(result.DestinationIP, strconv.Itoa(result.Port)),
+		"ForwardType": "connect",
+		"Timeout":     int((p.timeout + time.Second - 1) / time.Second),
+	})
+	proxyURL := "http://" + net.JoinHostPort(result.SourceIP, strconv.Itoa(p.port))
+
+	start := time.Now()
+	observed, errorCode, err := p.connect(proxyURL, body)
+	result.LatencyMs = float64(time.Since(start).Microseconds()) / 1000
+	result.Observed = observed
+	result.ProxyErrorCode = errorCode
+	if err != nil {
+		result.Error = err.Error()
+	}
+
+	switch observed {
+	case "allowed":
+		result.Match = result.Verdict == "allow"
+	case "blocked":
+		result.Match = result.Verdict == "deny"
+	default:
+		result.Match = true
+	}
+}
+
+// connect 发送 connect 类型的转发请求，返回实际结果、代理的 ErrorCode 和错误信息
+func (p *proxyProber) connect(proxyURL string, body []byte) (string, string, error) {
+	req, err := http.NewRequest(http.MethodPost, proxyURL, bytes.NewReader(body))
+	if err != nil {
+		return "inconclusive", "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if p.token != "" {
+		req.Header.Set("Authorization", "Bearer "+p.token)
+	}
+
+	// 给代理留出自己报告超时的时间
+	client := &http.Client{Timeout: p.timeout + 2*time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "inconclusive", "", fmt.Errorf("proxy unreachable: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var response proxyConnectResponse
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err == nil {
+		err = json.Unmarshal(data, &response)
+	}
+	if err != nil {
+		return "inconclusive", "", fmt.Errorf("invalid proxy response (HTTP %d): %v", resp.StatusCode, err)
+	}
+
+	switch {
+	case response.Success:
+		return "allowed", "", nil
+	case response.ErrorCode == "TIMEOUT" || response.ErrorCode == "UNREACHABLE":
+		return "blocked", response.ErrorCode, proxyMessageError(response.ErrorMessage)
+	default:
+		return "inconclusive", response.ErrorCode, proxyMessageError(response.ErrorMessage)
+	}
+}
+
+// proxyMessageError 将代理的错误信息转换为 error，信息为空时返回 nil
+func proxyMessageError(message string) error {
+	if message == "" {
+		return nil
+	}
+	return fmt.Errorf("%s", message)
+}
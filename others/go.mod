@@ -1,3 +1,7 @@
 module main
 
-go 1.23
+go 1.23.0
+
+require go.etcd.io/bbolt v1.3.10
+
+require golang.org/x/sys v0.31.0 // indirect
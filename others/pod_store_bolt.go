@@ -0,0 +1,239 @@
+//go:build bbolt
+
+/*
+本文件为 PodRegistry 实现了基于嵌入式 bbolt 数据库的可选持久化，使嵌入 PodRegistry 的控制器重启时
+不必等待全量 List 即可解析 Pod，随后再与 informer 的缓存对账。
+
+主要功能和原理：
+
+1. 存储格式：
+   - pods bucket 以单调递增的序号（8 字节大端）为键，值为 PodName 和 PodID 的紧凑 JSON，按序号遍历即为插入顺序。
+   - index bucket 以 "namespace/podname" 为键，记录条目当前的序号，用于更新和删除。
+   - 每次变更在 PodRegistry 的写锁内作为一个 bbolt 事务提交，因此磁盘上的顺序与内存中的一致。
+
+2. 恢复：
+   - OpenBoltPodStore 按插入顺序将磁盘上的条目重放到 PodRegistry 中（超出容量的最旧条目会照常被淘汰并从磁盘删除），然后开始记录后续变更。
+   - bbolt 的事务是原子的，进程崩溃只会丢失未提交的最后一次变更。
+   - 数据库文件损坏而无法打开时，会将其重命名为 <path>.corrupt-<时间戳> 并以空状态启动，此时退化为全量 List。
+
+3. 对账：
+   - informer 同步完成后，调用 PodRegistry.Reconcile 传入完整的 Pod 列表，删除重启期间已消失的 Pod 并补齐新增的 Pod，
+     这些修改也会被持久化。
+
+使用方法：
+go build -tags bbolt
+
+	registry := NewPodRegistry(10000)
+	store, err := OpenBoltPodStore("/var/lib/controller/pods.db", registry)
+	if err != nil { ... }
+	defer store.Close()
+	// 启动 informer，同步完成后:
+	registry.Reconcile(livePods)
+
+注意事项：
+- 需要 go.etcd.io/bbolt 依赖，不使用 bbolt 标签编译时 PodRegistry 不依赖任何第三方库。
+- 墓碑不会被持久化。
+- 写入失败不会影响内存中的 PodRegistry，最近一次错误可以通过 Err 获取。
+*/
+
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	podsBucket  = []byte("pods")
+	indexBucket = []byte("index")
+)
+
+// boltPodRecord 是条目在磁盘上的紧凑表示
+type boltPodRecord struct {
+	Namespace   string `json:"ns"`
+	Podname     string `json:"n"`
+	PodUuid     string `json:"u"`
+	ContainerId string `json:"c"`
+}
+
+// BoltPodStore 将 PodRegistry 的变更持久化到 bbolt 数据库
+type BoltPodStore struct {
+	db       *bolt.DB
+	replayed int // 启动时从磁盘重放的条目数量
+
+	mutex   sync.Mutex
+	lastErr error // 最近一次写入错误
+}
+
+// OpenBoltPodStore 打开（或创建）path 处的数据库，将其中的条目重放到 registry 中，
+// 然后将 registry 的后续变更持久化到数据库
+func OpenBoltPodStore(path string, registry *PodRegistry) (*BoltPodStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		if !errors.Is(err, bolt.ErrInvalid) && !errors.Is(err, bolt.ErrChecksum) && !errors.Is(err, bolt.ErrVersionMismatch) {
+			return nil, err
+		}
+		// 文件已损坏，保留它以便排查，并以空状态启动
+		corrupt := fmt.Sprintf("%s.corrupt-%d", path, time.Now().Unix())
+		if renameErr := os.Rename(path, corrupt); renameErr != nil {
+			return nil, fmt.Errorf("failed to open %s: %v, and failed to move it aside: %v", path, err, renameErr)
+		}
+		log.Printf("无法打开 %s (%v)，已将其重命名为 %s 并以空状态启动", path, err, corrupt)
+		if db, err = bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second}); err != nil {
+			return nil, err
+		}
+	}
+
+	store := &BoltPodStore{db: db}
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(podsBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(indexBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	// 重放时 registry 还没有持久化实现，重放不会写回数据库
+	err = db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(podsBucket).ForEach(func(_, data []byte) error {
+			var record boltPodRecord
+			if err := json.Unmarshal(data, &record); err != nil {
+				return fmt.Errorf("invalid record %q: %v", data, err)
+			}
+			registry.Set(PodName{Podname: record.Podname, Namespace: record.Namespace},
+				PodID{PodUuid: record.PodUuid, ContainerId: record.ContainerId})
+			store.replayed++
+			return nil
+		})
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	// 删除重放时因容量上限被淘汰的条目，使磁盘上的状态与 registry 一致
+	present := registry.GetAll()
+	err = db.Update(func(tx *bolt.Tx) error {
+		pods, index := tx.Bucket(podsBucket), tx.Bucket(indexBucket)
+		var evicted []PodName
+		err := pods.ForEach(func(_, data []byte) error {
+			var record boltPodRecord
+			if err := json.Unmarshal(data, &record); err != nil {
+				return fmt.Errorf("invalid record %q: %v", data, err)
+			}
+			key := PodName{Podname: record.Podname, Namespace: record.Namespace}
+			if _, exists := present[key]; !exists {
+				evicted = append(evicted, key)
+			}
+			return nil
+		})
+		for _, key := range evicted {
+			if err == nil {
+				err = removeRecord(pods, index, key)
+			}
+		}
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	registry.SetPersister(store)
+	return store, nil
+}
+
+// Replayed 返回启动时从磁盘重放的条目数量
+func (s *BoltPodStore) Replayed() int {
+	return s.replayed
+}
+
+// Err 返回最近一次写入错误
+func (s *BoltPodStore) Err() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.lastErr
+}
+
+// Close 关闭数据库
+func (s *BoltPodStore) Close() error {
+	return s.db.Close()
+}
+
+// Saved 实现 PodRegistryPersister，将条目追加为最新的记录
+func (s *BoltPodStore) Saved(key PodName, value PodID) {
+	s.update(func(pods, index *bolt.Bucket) error {
+		if err := removeRecord(pods, index, key); err != nil {
+			return err
+		}
+
+		seq, err := pods.NextSequence()
+		if err != nil {
+			return err
+		}
+		data, err := json.Marshal(boltPodRecord{
+			Namespace:   key.Namespace,
+			Podname:     key.Podname,
+			PodUuid:     value.PodUuid,
+			ContainerId: value.ContainerId,
+		})
+		if err != nil {
+			return err
+		}
+		seqKey := binary.BigEndian.AppendUint64(nil, seq)
+		if err := pods.Put(seqKey, data); err != nil {
+			return err
+		}
+		return index.Put(indexKey(key), seqKey)
+	})
+}
+
+// Removed 实现 PodRegistryPersister，删除条目的记录
+func (s *BoltPodStore) Removed(key PodName) {
+	s.update(func(pods, index *bolt.Bucket) error {
+		return removeRecord(pods, index, key)
+	})
+}
+
+// update 在一个事务中执行变更，并记录失败
+func (s *BoltPodStore) update(change func(pods, index *bolt.Bucket) error) {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		return change(tx.Bucket(podsBucket), tx.Bucket(indexBucket))
+	})
+	if err != nil {
+		log.Printf("持久化 PodRegistry 变更失败: %v", err)
+		s.mutex.Lock()
+		s.lastErr = err
+		s.mutex.Unlock()
+	}
+}
+
+// removeRecord 删除条目的记录及其索引，条目不存在时不做任何操作
+func removeRecord(pods, index *bolt.Bucket, key PodName) error {
+	seqKey := index.Get(indexKey(key))
+	if seqKey == nil {
+		return nil
+	}
+	if err := pods.Delete(seqKey); err != nil {
+		return err
+	}
+	return index.Delete(indexKey(key))
+}
+
+// indexKey 返回条目在 index bucket 中的键
+func indexKey(key PodName) []byte {
+	return []byte(key.Namespace + "/" + key.Podname)
+}
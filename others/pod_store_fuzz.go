@@ -0,0 +1,240 @@
+/*
+本文件为 PodRegistry 提供不变量检查和随机操作生成器，使嵌入 PodRegistry 的项目可以对自己的使用模式做模糊测试和基于属性的测试，
+验证大量变更后 keyToValue、valueToKey 和 keyOrder 是否仍然一致。
+
+主要功能和原理：
+
+1. 不变量检查：
+   - CheckInvariants 在读锁内检查：keyToValue、valueToKey 和 keyOrder 的长度相同；keyToValue 和 valueToKey 互为反向映射；
+     keyOrder 中没有重复的键，且每个键都在 keyToValue 中；条目数量不超过容量。
+   - 墓碑：tombstoneByValue 与 tombstones 互为反向映射，仍然存在的条目没有墓碑。
+   - 返回所有违反的不变量（最多 maxInvariantViolations 条），全部满足时返回 nil。
+
+2. 随机操作生成器：
+   - GeneratePodRegistryOps 按种子生成可复现的操作序列（Set、Delete、Reconcile、Purge、PurgeAll），
+     键和值从有限的集合中选取，使更新、重复的值、容量淘汰和墓碑都会频繁出现。
+   - RunPodRegistryOps 依次执行操作，并在每一步之后检查不变量，返回第一个破坏不变量的操作。
+   - ShrinkPodRegistryOps 将失败的操作序列缩减为仍然失败的最短序列，便于定位问题。
+
+使用方法（在嵌入项目的测试中）：
+
+	func FuzzRegistry(f *testing.F) {
+		f.Add(int64(1))
+		f.Fuzz(func(t *testing.T, seed int64) {
+			ops := GeneratePodRegistryOps(rand.New(rand.NewSource(seed)), 500, PodRegistryFuzzOptions{Keys: 20, Values: 20})
+			newRegistry := func() *PodRegistry { return NewPodRegistryWithTombstones(10, time.Minute) }
+			if step, err := RunPodRegistryOps(newRegistry(), ops); err != nil {
+				t.Fatalf("op %d: %v\n%v", step, err, ShrinkPodRegistryOps(newRegistry, ops[:step+1]))
+			}
+		})
+	}
+
+注意事项：
+- CheckInvariants 遍历所有条目，开销与条目数量成正比，只适合在测试和排查时调用。
+- 操作序列只依赖种子和选项，报告问题时附上种子即可复现。
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// maxInvariantViolations 限制 CheckInvariants 返回的违反数量
+const maxInvariantViolations = 20
+
+// CheckInvariants 检查 PodRegistry 内部结构的一致性，返回所有违反的不变量，全部满足时返回 nil
+func (pr *PodRegistry) CheckInvariants() error {
+	pr.mutex.RLock()
+	defer pr.mutex.RUnlock()
+
+	var violations []error
+	violate := func(format string, args ...interface{}) {
+		if len(violations) < maxInvariantViolations {
+			violations = append(violations, fmt.Errorf(format, args...))
+		}
+	}
+
+	if len(pr.keyToValue) != len(pr.valueToKey) || len(pr.keyToValue) != len(pr.keyOrder) {
+		violate("size mismatch: keyToValue %d, valueToKey %d, keyOrder %d", len(pr.keyToValue), len(pr.valueToKey), len(pr.keyOrder))
+	}
+	if len(pr.keyToValue) > pr.capacity {
+		violate("%d entries over the capacity of %d", len(pr.keyToValue), pr.capacity)
+	}
+	for key, value := range pr.keyToValue {
+		if back, exists := pr.valueToKey[value]; !exists {
+			violate("keyToValue %v -> %v has no valueToKey entry", key, value)
+		} else if back != key {
+			violate("keyToValue %v -> %v but valueToKey maps it back to %v", key, value, back)
+		}
+	}
+	for value, key := range pr.valueToKey {
+		if forward, exists := pr.keyToValue[key]; !exists {
+			violate("valueToKey %v -> %v has no keyToValue entry", value, key)
+		} else if forward != value {
+			violate("valueToKey %v -> %v but keyToValue maps it to %v", value, key, forward)
+		}
+	}
+	seen := make(map[PodName]bool, len(pr.keyOrder))
+	for i, key := range pr.keyOrder {
+		if seen[key] {
+			violate("keyOrder[%d] %v is a duplicate", i, key)
+		}
+		seen[key] = true
+		if _, exists := pr.keyToValue[key]; !exists {
+			violate("keyOrder[%d] %v has no keyToValue entry", i, key)
+		}
+	}
+
+	for value, key := range pr.tombstoneByValue {
+		if stone, exists := pr.tombstones[key]; !exists || stone.value != value {
+			violate("tombstoneByValue %v -> %v does not match the tombstones", value, key)
+		}
+	}
+	for key, stone := range pr.tombstones {
+		if pr.tombstoneByValue[stone.value] != key {
+			// 两个墓碑的值相同时，反向映射只保留其中一个
+			if _, shared := pr.tombstoneByValue[stone.value]; !shared {
+				violate("tombstone %v -> %v has no tombstoneByValue entry", key, stone.value)
+			}
+		}
+		if _, alive := pr.keyToValue[key]; alive {
+			violate("%v is both an entry and a tombstone", key)
+		}
+	}
+
+	return errors.Join(violations...)
+}
+
+// PodRegistryOp 是对 PodRegistry 的一次操作
+type PodRegistryOp struct {
+	Kind  string            // 操作类型：set、delete、reconcile、purge 或 purgeall
+	Key   PodName           // set 和 delete 的键
+	Value PodID             // set 的值
+	Live  map[PodName]PodID // reconcile 的完整 Pod 列表
+}
+
+func (op PodRegistryOp) String() string {
+	switch op.Kind {
+	case "set":
+		return fmt.Sprintf("set %s/%s=%s/%s", op.Key.Namespace, op.Key.Podname, op.Value.PodUuid, op.Value.ContainerId)
+	case "delete":
+		return fmt.Sprintf("delete %s/%s", op.Key.Namespace, op.Key.Podname)
+	case "reconcile":
+		return fmt.Sprintf("reconcile %d pods", len(op.Live))
+	default:
+		return op.Kind
+	}
+}
+
+// PodRegistryFuzzOptions 控制随机操作的分布
+type PodRegistryFuzzOptions struct {
+	Keys   int // 键的集合大小，默认为 16
+	Values int // 值的集合大小，默认与 Keys 相同；小于 Keys 时不同的键会频繁共享同一个值
+}
+
+// GeneratePodRegistryOps 生成 n 个随机操作，序列只取决于 rng 的种子和选项
+func GeneratePodRegistryOps(rng *rand.Rand, n int, options PodRegistryFuzzOptions) []PodRegistryOp {
+	if options.Keys <= 0 {
+		options.Keys = 16
+	}
+	if options.Values <= 0 {
+		options.Values = options.Keys
+	}
+	randomKey := func() PodName {
+		i := rng.Intn(options.Keys)
+		return PodName{Podname: fmt.Sprintf("pod%d", i), Namespace: fmt.Sprintf("ns%d", i%3)}
+	}
+	randomValue := func() PodID {
+		i := rng.Intn(options.Values)
+		return PodID{PodUuid: fmt.Sprintf("uuid%d", i), ContainerId: fmt.Sprintf("container%d", i)}
+	}
+
+	ops := make([]PodRegistryOp, 0, n)
+	for len(ops) < n {
+		switch roll := rng.Intn(100); {
+		case roll < 60:
+			ops = append(ops, PodRegistryOp{Kind: "set", Key: randomKey(), Value: randomValue()})
+		case roll < 90:
+			ops = append(ops, PodRegistryOp{Kind: "delete", Key: randomKey()})
+		case roll < 95:
+			live := make(map[PodName]PodID)
+			for i := rng.Intn(options.Keys); i > 0; i-- {
+				live[randomKey()] = randomValue()
+			}
+			ops = append(ops, PodRegistryOp{Kind: "reconcile", Live: live})
+		case roll < 98:
+			ops = append(ops, PodRegistryOp{Kind: "purge"})
+		default:
+			ops = append(ops, PodRegistryOp{Kind: "purgeall"})
+		}
+	}
+	return ops
+}
+
+// ApplyPodRegistryOp 对 PodRegistry 执行一次操作
+func ApplyPodRegistryOp(pr *PodRegistry, op PodRegistryOp) {
+	switch op.Kind {
+	case "set":
+		pr.Set(op.Key, op.Value)
+	case "delete":
+		pr.Delete(op.Key)
+	case "reconcile":
+		pr.Reconcile(op.Live)
+	case "purge":
+		pr.Purge()
+	case "purgeall":
+		pr.PurgeAll()
+	}
+}
+
+// RunPodRegistryOps 依次执行操作，并在每一步之后检查不变量。返回第一个破坏不变量的操作的下标和违反的不变量，
+// 全部满足时返回 -1 和 nil
+func RunPodRegistryOps(pr *PodRegistry, ops []PodRegistryOp) (int, error) {
+	for i, op := range ops {
+		ApplyPodRegistryOp(pr, op)
+		if err := pr.CheckInvariants(); err != nil {
+			return i, err
+		}
+	}
+	return -1, nil
+}
+
+// ShrinkPodRegistryOps 将破坏不变量的操作序列缩减为仍然破坏不变量的最短序列：依次尝试删除每个操作，
+// 删除后仍然失败则保留删除。newRegistry 每次返回一个新的、与原始测试相同配置的 PodRegistry
+func ShrinkPodRegistryOps(newRegistry func() *PodRegistry, ops []PodRegistryOp) []PodRegistryOp {
+	if _, err := RunPodRegistryOps(newRegistry(), ops); err == nil {
+		return ops
+	}
+
+	shrunk := append([]PodRegistryOp(nil), ops...)
+	for i := len(shrunk) - 1; i >= 0; i-- {
+		candidate := append(append([]PodRegistryOp(nil), shrunk[:i]...), shrunk[i+1:]...)
+		if step, err := RunPodRegistryOps(newRegistry(), candidate); err != nil {
+			shrunk = candidate[:step+1]
+			if i > len(shrunk) {
+				i = len(shrunk)
+			}
+		}
+	}
+	return shrunk
+}
+
+// fuzzPodRegistry 用 seed 生成操作并执行，发现问题时打印缩减后的操作序列
+func fuzzPodRegistry(seed int64, n int, options PodRegistryFuzzOptions) {
+	newRegistry := func() *PodRegistry { return NewPodRegistryWithTombstones(8, time.Minute) }
+	ops := GeneratePodRegistryOps(rand.New(rand.NewSource(seed)), n, options)
+	step, err := RunPodRegistryOps(newRegistry(), ops)
+	if err == nil {
+		fmt.Printf("种子 %d: %d 个操作后不变量全部满足\n", seed, n)
+		return
+	}
+
+	fmt.Printf("种子 %d: 第 %d 个操作后不变量被破坏:\n%v\n缩减后的操作序列:\n", seed, step+1, err)
+	for _, op := range ShrinkPodRegistryOps(newRegistry, ops[:step+1]) {
+		fmt.Printf("  %v\n", op)
+	}
+}
@@ -16,7 +16,24 @@
 3. 容量管理：
    - 当达到容量上限时，自动删除最旧的键值对。
 
-4. 主要方法：
+4. 墓碑（软删除）：
+   - 使用 NewPodRegistryWithTombstones 创建时，Delete 删除的条目会以墓碑的形式保留一段时间，
+     在此期间 GetValueByKey 和 GetKeyByValue 仍然可以查到，便于解析晚到的查询（例如日志中引用了刚被删除的 Pod）。
+   - 过期的墓碑不再参与查询，并在每次写操作（Set、Delete、Reconcile）时按删除顺序被清理，因此墓碑数量不会无限增长；
+     Purge 立即清理所有过期的墓碑，PurgeAll 立即清理所有墓碑。
+   - TombstoneMetrics 返回墓碑数量、通过墓碑命中的查询次数和已清理的墓碑数量。
+
+5. 持久化：
+   - 通过 SetPersister 设置 PodRegistryPersister 后，每次新增、更新和删除（包括因容量上限被自动删除）都会同步通知持久化实现，
+     例如 pod_store_bolt.go 中基于 bbolt 的实现（使用 -tags bbolt 编译），使嵌入 PodRegistry 的控制器重启时无需等待全量 List。
+   - Reconcile 用 informer 同步后的完整 Pod 列表校正从磁盘恢复的状态。
+   - 墓碑不会被持久化。
+
+6. 不变量检查：
+   - CheckInvariants 检查 keyToValue、valueToKey、keyOrder 和墓碑之间的一致性，pod_store_fuzz.go 中的随机操作生成器
+     可以在嵌入项目的测试中对其使用模式做模糊测试，并将失败的操作序列缩减到最短。
+
+7. 主要方法：
    - NewStringStorage：创建新的 StringStorage 实例。
    - Set：设置键值对，处理容量限制。
    - Get：根据键获取值。
@@ -24,7 +41,7 @@
    - GetByValue：根据值查找对应的键。
    - Len：返回当前存储的键值对数量。
 
-5. 使用场景：
+8. 使用场景：
    - 适用于需要双向查找、有序存储和容量限制的键值对管理。
    - 可用于缓存系统、会话管理等场景。
 
@@ -32,6 +49,7 @@
 - 所有公共方法都是并发安全的。
 - 达到容量上限时会自动删除最旧的数据。
 - 支持通过值查找键，但要注意值的唯一性。
+- 因容量上限被自动删除的条目不会留下墓碑，墓碑也不占用容量。
 */
 
 package main
@@ -40,6 +58,8 @@ package main
 import (
 	"fmt"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // PodName 封装 Podname 和 Namespace
@@ -54,6 +74,39 @@ type PodID struct {
 	ContainerId string
 }
 
+// tombstone 记录被删除的条目及其删除时间
+type tombstone struct {
+	value     PodID
+	deletedAt time.Time
+}
+
+// tombstoneEntry 记录墓碑的创建顺序，用于按过期顺序清理
+type tombstoneEntry struct {
+	key       PodName
+	deletedAt time.Time
+}
+
+// TombstoneMetrics 记录墓碑相关的统计信息
+type TombstoneMetrics struct {
+	Tombstones int    // 当前保留的墓碑数量（包括已过期但尚未清理的）
+	Hits       uint64 // 通过墓碑解析的查询次数
+	Purged     uint64 // 已清理的墓碑数量
+}
+
+// PodRegistryPersister 接收 PodRegistry 的变更，用于将其持久化。方法在持有 PodRegistry 写锁时被调用，
+// 因此调用顺序与变更顺序一致，实现中不能再调用 PodRegistry 的方法
+type PodRegistryPersister interface {
+	Saved(key PodName, value PodID) // 新增或更新了条目
+	Removed(key PodName)            // 删除了条目
+}
+
+// ReconcileResult 记录 Reconcile 对注册表的修改
+type ReconcileResult struct {
+	Added   int // 新增的条目数量
+	Updated int // 值发生变化的条目数量
+	Removed int // 已不存在而被删除的条目数量
+}
+
 // PodRegistry 是一个存储结构，用于存储和检索 Pod 相关信息
 type PodRegistry struct {
 	mutex      sync.RWMutex
@@ -61,6 +114,15 @@ type PodRegistry struct {
 	valueToKey map[PodID]PodName
 	keyOrder   []PodName // 用于维护键的插入顺序
 	capacity   int       // 存储的最大容量
+
+	tombstoneTTL     time.Duration         // 墓碑的保留时间，为 0 时不保留墓碑
+	tombstones       map[PodName]tombstone // 被删除的条目
+	tombstoneByValue map[PodID]PodName     // 被删除条目的反向映射
+	tombstoneOrder   []tombstoneEntry      // 按删除时间排序的墓碑，其中可能有已被移除的墓碑
+	tombstoneHits    atomic.Uint64         // 通过墓碑解析的查询次数，查询只持有读锁，因此使用原子计数
+	tombstonePurged  uint64                // 已清理的墓碑数量
+
+	persister PodRegistryPersister // 变更的持久化实现，为 nil 时不持久化
 }
 
 // NewPodRegistry 创建并返回一个新的 PodRegistry 实例
@@ -73,11 +135,37 @@ func NewPodRegistry(capacity int) *PodRegistry {
 	}
 }
 
+// NewPodRegistryWithTombstones 创建一个 PodRegistry，被删除的条目会以墓碑的形式保留 ttl 时长
+func NewPodRegistryWithTombstones(capacity int, ttl time.Duration) *PodRegistry {
+	pr := NewPodRegistry(capacity)
+	pr.tombstoneTTL = ttl
+	pr.tombstones = make(map[PodName]tombstone)
+	pr.tombstoneByValue = make(map[PodID]PodName)
+	return pr
+}
+
+// SetPersister 设置变更的持久化实现，已有的条目不会被通知
+func (pr *PodRegistry) SetPersister(persister PodRegistryPersister) {
+	pr.mutex.Lock()
+	defer pr.mutex.Unlock()
+
+	pr.persister = persister
+}
+
 // Set 设置 PodName 对应的 PodID 值
 func (pr *PodRegistry) Set(key PodName, value PodID) {
 	pr.mutex.Lock()
 	defer pr.mutex.Unlock()
 
+	pr.setInternal(key, value)
+}
+
+// setInternal 内部使用的设置方法，不加锁
+func (pr *PodRegistry) setInternal(key PodName, value PodID) {
+	pr.expireTombstones()
+	// 重新添加的条目不再是墓碑
+	pr.removeTombstone(key)
+
 	_, exists := pr.keyToValue[key]
 	if exists {
 		// 如果键已存在，直接更新值
@@ -100,6 +188,10 @@ func (pr *PodRegistry) Set(key PodName, value PodID) {
 		pr.valueToKey[value] = key
 		pr.keyOrder = append(pr.keyOrder, key)
 	}
+
+	if pr.persister != nil {
+		pr.persister.Saved(key, value)
+	}
 }
 
 // Delete 删除与 PodName 对应的条目
@@ -107,7 +199,105 @@ func (pr *PodRegistry) Delete(key PodName) {
 	pr.mutex.Lock()
 	defer pr.mutex.Unlock()
 
+	pr.expireTombstones()
+	value, exists := pr.keyToValue[key]
 	pr.deleteInternal(key)
+
+	// 保留墓碑，使晚到的查询仍然可以解析
+	if exists {
+		pr.addTombstone(key, value)
+	}
+}
+
+// addTombstone 为被删除的条目保留墓碑，未启用墓碑时不做任何操作，不加锁
+func (pr *PodRegistry) addTombstone(key PodName, value PodID) {
+	if pr.tombstoneTTL <= 0 {
+		return
+	}
+	pr.removeTombstone(key)
+	now := time.Now()
+	pr.tombstones[key] = tombstone{value: value, deletedAt: now}
+	pr.tombstoneByValue[value] = key
+	pr.tombstoneOrder = append(pr.tombstoneOrder, tombstoneEntry{key: key, deletedAt: now})
+}
+
+// expireTombstones 按删除顺序清理过期的墓碑，返回清理的数量，不加锁。
+// tombstoneOrder 中已被移除或重新创建的墓碑只出队，不计入清理数量
+func (pr *PodRegistry) expireTombstones() int {
+	purged, expired := 0, 0
+	for _, entry := range pr.tombstoneOrder {
+		if time.Since(entry.deletedAt) < pr.tombstoneTTL {
+			break
+		}
+		expired++
+		if stone, exists := pr.tombstones[entry.key]; exists && stone.deletedAt.Equal(entry.deletedAt) {
+			pr.removeTombstone(entry.key)
+			purged++
+		}
+	}
+	if expired > 0 {
+		pr.tombstoneOrder = append([]tombstoneEntry(nil), pr.tombstoneOrder[expired:]...)
+	}
+	pr.tombstonePurged += uint64(purged)
+	return purged
+}
+
+// removeTombstone 删除指定键的墓碑，不加锁
+func (pr *PodRegistry) removeTombstone(key PodName) {
+	if stone, exists := pr.tombstones[key]; exists {
+		delete(pr.tombstones, key)
+		if pr.tombstoneByValue[stone.value] == key {
+			delete(pr.tombstoneByValue, stone.value)
+		}
+	}
+}
+
+// isAlive 检查墓碑是否仍在保留时间内
+func (pr *PodRegistry) isAlive(stone tombstone) bool {
+	return time.Since(stone.deletedAt) < pr.tombstoneTTL
+}
+
+// Purge 清理所有过期的墓碑，返回清理的数量
+func (pr *PodRegistry) Purge() int {
+	pr.mutex.Lock()
+	defer pr.mutex.Unlock()
+
+	return pr.expireTombstones()
+}
+
+// PurgeAll 立即清理所有墓碑，返回清理的数量
+func (pr *PodRegistry) PurgeAll() int {
+	pr.mutex.Lock()
+	defer pr.mutex.Unlock()
+
+	purged := len(pr.tombstones)
+	for key := range pr.tombstones {
+		pr.removeTombstone(key)
+	}
+	pr.tombstoneOrder = nil
+	pr.tombstonePurged += uint64(purged)
+	return purged
+}
+
+// IsTombstone 检查 PodName 是否为仍在保留时间内的墓碑
+func (pr *PodRegistry) IsTombstone(key PodName) bool {
+	pr.mutex.RLock()
+	defer pr.mutex.RUnlock()
+
+	stone, exists := pr.tombstones[key]
+	return exists && pr.isAlive(stone)
+}
+
+// TombstoneMetrics 返回墓碑相关的统计信息
+func (pr *PodRegistry) TombstoneMetrics() TombstoneMetrics {
+	pr.mutex.RLock()
+	defer pr.mutex.RUnlock()
+
+	return TombstoneMetrics{
+		Tombstones: len(pr.tombstones),
+		Hits:       pr.tombstoneHits.Load(),
+		Purged:     pr.tombstonePurged,
+	}
 }
 
 // deleteInternal 内部使用的删除方法，不加锁
@@ -126,6 +316,10 @@ func (pr *PodRegistry) deleteInternal(key PodName) {
 
 	// 从 keyOrder 中移除键
 	pr.removeFromKeyOrder(key)
+
+	if pr.persister != nil {
+		pr.persister.Removed(key)
+	}
 }
 
 // removeFromKeyOrder 从 keyOrder 切片中移除指定的键
@@ -140,21 +334,33 @@ func (pr *PodRegistry) removeFromKeyOrder(key PodName) {
 	}
 }
 
-// GetValueByKey 根据 PodName 查询 PodID
+// GetValueByKey 根据 PodName 查询 PodID，仍在保留时间内的墓碑也可以查到
 func (pr *PodRegistry) GetValueByKey(key PodName) (PodID, bool) {
 	pr.mutex.RLock()
 	defer pr.mutex.RUnlock()
 
 	value, exists := pr.keyToValue[key]
+	if !exists {
+		if stone, found := pr.tombstones[key]; found && pr.isAlive(stone) {
+			pr.tombstoneHits.Add(1)
+			return stone.value, true
+		}
+	}
 	return value, exists
 }
 
-// GetKeyByValue 根据 PodID 查询 PodName
+// GetKeyByValue 根据 PodID 查询 PodName，仍在保留时间内的墓碑也可以查到
 func (pr *PodRegistry) GetKeyByValue(value PodID) (PodName, bool) {
 	pr.mutex.RLock()
 	defer pr.mutex.RUnlock()
 
 	key, exists := pr.valueToKey[value]
+	if !exists {
+		if tombKey, found := pr.tombstoneByValue[value]; found && pr.isAlive(pr.tombstones[tombKey]) {
+			pr.tombstoneHits.Add(1)
+			return tombKey, true
+		}
+	}
 	return key, exists
 }
 
@@ -178,6 +384,38 @@ func (pr *PodRegistry) GetAll() map[PodName]PodID {
 	return result
 }
 
+// Reconcile 用完整的 Pod 列表（例如 informer 同步完成后的缓存）校正注册表：新增和更新列表中的条目，
+// 删除列表中没有的条目。被删除的条目会像 Delete 一样保留墓碑
+func (pr *PodRegistry) Reconcile(live map[PodName]PodID) ReconcileResult {
+	pr.mutex.Lock()
+	defer pr.mutex.Unlock()
+
+	pr.expireTombstones()
+	var result ReconcileResult
+	for _, key := range append([]PodName(nil), pr.keyOrder...) {
+		if _, exists := live[key]; !exists {
+			value := pr.keyToValue[key]
+			pr.deleteInternal(key)
+			pr.addTombstone(key, value)
+			result.Removed++
+		}
+	}
+	for key, value := range live {
+		current, exists := pr.keyToValue[key]
+		switch {
+		case !exists:
+			result.Added++
+		case current != value:
+			result.Updated++
+		default:
+			continue
+		}
+		pr.removeTombstone(key)
+		pr.setInternal(key, value)
+	}
+	return result
+}
+
 // main 函数用于测试 PodRegistry
 func main() {
 	registry := NewPodRegistry(3) // 创建容量为 3 的注册表
@@ -212,4 +450,25 @@ func main() {
 	if _, found := registry.GetValueByKey(key1); !found {
 		fmt.Printf("键 %v 已被自动删除\n", key1)
 	}
+
+	// 测试墓碑：删除后在保留时间内仍可查询
+	tombRegistry := NewPodRegistryWithTombstones(3, 100*time.Millisecond)
+	tombRegistry.Set(key1, value1)
+	tombRegistry.Delete(key1)
+	if value, found := tombRegistry.GetValueByKey(key1); found {
+		fmt.Printf("键 %v 已删除，但仍可通过墓碑查到: %v\n", key1, value)
+	}
+
+	// 墓碑过期后不再可查，并由 Purge 清理
+	time.Sleep(150 * time.Millisecond)
+	if _, found := tombRegistry.GetKeyByValue(value1); !found {
+		fmt.Printf("值 %v 的墓碑已过期\n", value1)
+	}
+	fmt.Printf("清理的墓碑数量: %d, 墓碑统计: %+v\n", tombRegistry.Purge(), tombRegistry.TombstoneMetrics())
+
+	// 随机操作后检查不变量
+	if err := registry.CheckInvariants(); err != nil {
+		fmt.Printf("不变量被破坏: %v\n", err)
+	}
+	fuzzPodRegistry(1, 2000, PodRegistryFuzzOptions{Keys: 16, Values: 16})
 }